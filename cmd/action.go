@@ -21,14 +21,11 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
-	"github.com/bizflycloud/bizflyctl/formatter"
 	"github.com/spf13/cobra"
 )
 
@@ -66,26 +63,20 @@ var listActionCmd = &cobra.Command{
 		// make request
 		req, err := http.NewRequest(http.MethodGet, urlRequest, nil)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
 
 		var rla backupapi.ListActivity
 		if err := json.NewDecoder(resp.Body).Decode(&rla); err != nil {
-			_, err := fmt.Fprintln(os.Stderr, err.Error())
-			if err != nil {
-				return
-			}
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		data := make([][]string, 0, len(rla.Activities))
@@ -103,7 +94,7 @@ var listActionCmd = &cobra.Command{
 			data = append(data, []string{ac.ID, ac.Action, ac.Status, ac.RecoveryPoint.ID, ac.PolicyID, progress, ac.Message})
 		}
 
-		formatter.Output(listActionsHeaders, data)
+		printList(cmd, listActionsHeaders, data, rla.Activities)
 	},
 }
 
@@ -130,20 +121,18 @@ var stopActionCmd = &cobra.Command{
 		// make request
 		req, err := http.NewRequest(http.MethodDelete, urlRequest, nil)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
 
-		_, _ = io.Copy(os.Stderr, resp.Body)
+		printResponse(cmd, args[0], resp)
 	},
 }
 
@@ -25,6 +25,7 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -35,7 +36,10 @@ import (
 
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 	"github.com/bizflycloud/bizfly-backup/pkg/broker/mqtt"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/notifier"
 	"github.com/bizflycloud/bizfly-backup/pkg/server"
+	"github.com/bizflycloud/bizfly-backup/pkg/support"
 )
 
 // agentCmd represents the agent command
@@ -54,13 +58,37 @@ var agentCmd = &cobra.Command{
 		secretKey := viper.GetString("secret_key")
 		apiUrl := viper.GetString("api_url")
 		numGoroutine := viper.GetInt("num_goroutine")
+		maxOpenFiles := viper.GetInt("restore_max_open_files")
 
+		_, cachePath, err := support.CheckPath()
+		if err != nil {
+			logger.Fatal("failed to get cache path", zap.Error(err))
+		}
+		var hostIndex *cache.HostIndex
+		if viper.GetBool("host_cache") {
+			if hostIndex, err = cache.LoadHostIndex(cachePath); err != nil {
+				logger.Fatal("failed to load host cache", zap.Error(err))
+			}
+		}
+
+		encryptor, err := backupapi.EncryptorFromConfig()
+		if err != nil {
+			logger.Fatal("failed to set up chunk encryption", zap.Error(err))
+		}
+		contentKeys, err := backupapi.ContentKeysFromConfig()
+		if err != nil {
+			logger.Fatal("failed to set up chunk encryption recipients", zap.Error(err))
+		}
 		backupClient, err := backupapi.NewClient(
 			backupapi.WithAccessKey(accessKey),
 			backupapi.WithSecretKey(secretKey),
 			backupapi.WithServerURL(apiUrl),
 			backupapi.WithID(machineID),
 			backupapi.WithNumGoroutine(numGoroutine),
+			backupapi.WithMaxOpenFiles(maxOpenFiles),
+			backupapi.WithHostIndex(hostIndex),
+			backupapi.WithEncryptor(encryptor),
+			backupapi.WithContentKeys(contentKeys),
 		)
 		if err != nil {
 			logger.Error("failed to create new backup client", zap.Error(err))
@@ -91,12 +119,25 @@ var agentCmd = &cobra.Command{
 			mqtt.WithUsername(accessKey),
 			mqtt.WithPassword(secretKey),
 			mqtt.WithLogger(logger),
+			mqtt.WithCACert(viper.GetString("broker_ca_cert")),
+			mqtt.WithClientCert(viper.GetString("broker_client_cert"), viper.GetString("broker_client_key")),
 		)
 		if err != nil {
 			logger.Fatal("failed to create broker", zap.Error(err))
 			os.Exit(1)
 		}
 
+		var notifierConfigs []notifier.Config
+		if err := viper.UnmarshalKey("notifiers", &notifierConfigs); err != nil {
+			logger.Fatal("failed to read notifiers config", zap.Error(err))
+			os.Exit(1)
+		}
+		n, err := notifier.New(notifierConfigs)
+		if err != nil {
+			logger.Fatal("failed to create notifier", zap.Error(err))
+			os.Exit(1)
+		}
+
 		logger.Debug("Listening address: " + addr)
 		s, err := server.New(
 			server.WithAddr(addr),
@@ -106,6 +147,9 @@ var agentCmd = &cobra.Command{
 			server.WithBackupClient(backupClient),
 			server.WithLogger(logger),
 			server.WithNumGoroutine(numGoroutine),
+			server.WithNotifier(n),
+			server.WithProgressStateDir(filepath.Join(cachePath, "progress")),
+			server.WithConfigDir(viper.GetString("config_dir")),
 		)
 		if err != nil {
 			logger.Fatal("failed to create new server", zap.Error(err))
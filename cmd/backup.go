@@ -28,25 +28,31 @@ import (
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
 	"time"
 
-	"github.com/bizflycloud/bizflyctl/formatter"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/server"
 )
 
 var (
 	listBackupHeaders         = []string{"ID", "Name", "Path", "PolicyID", "Pattern", "Limit Upload", "Retentions", "Activated"}
 	listRecoveryPointsHeaders = []string{"ID", "Name", "Status", "Type", "CREATED AT"}
+	listScheduleHeaders       = []string{"At", "Backup Directory ID", "PolicyID"}
+	listJournalsHeaders       = []string{"Backup Directory ID", "Recovery Point ID", "Files", "Updated At"}
 	backupID                  string
 	backupName                string
 	recoveryPointID           string
 	backupDownloadOutFile     string
+	scheduleRuns              int
+	scheduleWithin            string
+	rewrapRecipients          []string
 )
 
 // backupCmd represents the backup command
@@ -80,23 +86,20 @@ var backupListCmd = &cobra.Command{
 		// make request
 		req, err := http.NewRequest(http.MethodGet, urlRequest, nil)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
 
 		var c backupapi.Config
 		if err := json.NewDecoder(resp.Body).Decode(&c); err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		var data [][]string
@@ -114,7 +117,7 @@ var backupListCmd = &cobra.Command{
 			}
 		}
 
-		formatter.Output(listBackupHeaders, data)
+		printList(cmd, listBackupHeaders, data, c.BackupDirectories)
 	},
 }
 
@@ -137,23 +140,20 @@ var backupListRecoveryPointCmd = &cobra.Command{
 		// make request
 		req, err := http.NewRequest(http.MethodGet, urlRequest, nil)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
 
 		var rps backupapi.ListRecoveryPointsResponse
 		if err := json.NewDecoder(resp.Body).Decode(&rps); err != nil {
-			fmt.Fprintln(os.Stderr, err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		data := make([][]string, 0, len(rps.RecoveryPoints))
@@ -161,7 +161,7 @@ var backupListRecoveryPointCmd = &cobra.Command{
 			data = append(data, []string{rp.ID, rp.Name, rp.Status, rp.RecoveryPointType, rp.CreatedAt})
 		}
 
-		formatter.Output(listRecoveryPointsHeaders, data)
+		printList(cmd, listRecoveryPointsHeaders, data, rps.RecoveryPoints)
 	},
 }
 
@@ -184,23 +184,257 @@ var backupDeleteRecoveryPointCmd = &cobra.Command{
 		// make request
 		req, err := http.NewRequest(http.MethodDelete, urlRequest, nil)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
+		}
+
+		defer resp.Body.Close()
+
+		printResponse(cmd, recoveryPointID, resp)
+	},
+}
+
+var backupRebuildChunksCmd = &cobra.Command{
+	Use:   "rebuild-chunks",
+	Short: "Rebuild the chunk list of a recovery point from its index.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// make url
+		urlRequest := strings.Join([]string{addr, "recovery-points", recoveryPointID, "rebuild-chunks"}, "/")
+
+		// create client
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial(tcpProtocol, strings.TrimPrefix(addr, httpPrefix))
+				},
+			},
+		}
+
+		// init body
+		buf, _ := json.Marshal(map[string]string{"storage_vault_id": storageVaultID})
+
+		// make request
+		req, err := http.NewRequest(http.MethodPost, urlRequest, bytes.NewBuffer(buf))
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		// call request
+		resp, err := httpc.Do(req)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		defer resp.Body.Close()
+
+		printResponse(cmd, recoveryPointID, resp)
+	},
+}
+
+var backupConsolidateIndexCmd = &cobra.Command{
+	Use:   "consolidate-index",
+	Short: "Store the full index of a recovery point in place of its chain of delta indexes.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// make url
+		urlRequest := strings.Join([]string{addr, "recovery-points", recoveryPointID, "consolidate-index"}, "/")
+
+		// create client
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial(tcpProtocol, strings.TrimPrefix(addr, httpPrefix))
+				},
+			},
+		}
+
+		// init body
+		buf, _ := json.Marshal(map[string]string{"storage_vault_id": storageVaultID})
+
+		// make request
+		req, err := http.NewRequest(http.MethodPost, urlRequest, bytes.NewBuffer(buf))
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		// call request
+		resp, err := httpc.Do(req)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		defer resp.Body.Close()
+
+		printResponse(cmd, recoveryPointID, resp)
+	},
+}
+
+var backupResetCircuitCmd = &cobra.Command{
+	Use:   "reset-circuit",
+	Short: "Resume the scheduled backups of a directory paused after consecutive failures.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// make url
+		urlRequest := strings.Join([]string{addr, "backups", backupID, "circuit"}, "/")
+
+		// create client
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial(tcpProtocol, strings.TrimPrefix(addr, httpPrefix))
+				},
+			},
+		}
+
+		// make request
+		req, err := http.NewRequest(http.MethodDelete, urlRequest, nil)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		// call request
+		resp, err := httpc.Do(req)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		defer resp.Body.Close()
+
+		printResponse(cmd, backupID, resp)
+	},
+}
+
+var backupRewrapKeysCmd = &cobra.Command{
+	Use:   "rewrap-keys",
+	Short: "Wrap the content keys of the recovery points of a directory to new recipients.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// make url
+		urlRequest := strings.Join([]string{addr, "backups", backupID, "rewrap-keys"}, "/")
+
+		// create client
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial(tcpProtocol, strings.TrimPrefix(addr, httpPrefix))
+				},
+			},
+		}
+
+		// init body
+		buf, _ := json.Marshal(map[string]interface{}{"storage_vault_id": storageVaultID, "recipients": rewrapRecipients})
+
+		// make request
+		req, err := http.NewRequest(http.MethodPost, urlRequest, bytes.NewBuffer(buf))
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		// call request
+		resp, err := httpc.Do(req)
+		if err != nil {
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
 
-		_, _ = io.Copy(os.Stderr, resp.Body)
+		printResponse(cmd, backupID, resp)
 	},
 }
 
+var backupJournalsCmd = &cobra.Command{
+	Use:   "journals",
+	Short: "List the backups interrupted by an agent stop which can be resumed.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// make url
+		urlRequest := strings.Join([]string{addr, "backups", "journals"}, "/")
+
+		// create client
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial(tcpProtocol, strings.TrimPrefix(addr, httpPrefix))
+				},
+			},
+		}
+
+		// make request
+		req, err := http.NewRequest(http.MethodGet, urlRequest, nil)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		// call request
+		resp, err := httpc.Do(req)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		defer resp.Body.Close()
+
+		var journals []server.JournalInfo
+		if err := json.NewDecoder(resp.Body).Decode(&journals); err != nil {
+			exitWithError(cmd, err)
+		}
+
+		data := make([][]string, 0, len(journals))
+		for _, j := range journals {
+			data = append(data, []string{j.BackupDirectoryID, j.RecoveryPointID, strconv.Itoa(j.Files), j.UpdatedAt.Format(time.RFC3339)})
+		}
+
+		printList(cmd, listJournalsHeaders, data, journals)
+	},
+}
+
+var backupResumeCmd = &cobra.Command{
+	Use:   "resume",
+	Short: "Resume the backup of a directory interrupted by an agent stop, in the same recovery point.",
+	Run: func(cmd *cobra.Command, args []string) {
+		journalRequest(cmd, http.MethodPost, "resume")
+	},
+}
+
+var backupAbandonCmd = &cobra.Command{
+	Use:   "abandon",
+	Short: "Give up the backup of a directory interrupted by an agent stop.",
+	Run: func(cmd *cobra.Command, args []string) {
+		journalRequest(cmd, http.MethodDelete, "journal")
+	},
+}
+
+// journalRequest sends a request about the interrupted backup of backupID.
+func journalRequest(cmd *cobra.Command, method, path string) {
+	// make url
+	urlRequest := strings.Join([]string{addr, "backups", backupID, path}, "/")
+
+	// create client
+	httpc := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+				return net.Dial(tcpProtocol, strings.TrimPrefix(addr, httpPrefix))
+			},
+		},
+	}
+
+	// make request
+	req, err := http.NewRequest(method, urlRequest, nil)
+	if err != nil {
+		exitWithError(cmd, err)
+	}
+
+	// call request
+	resp, err := httpc.Do(req)
+	if err != nil {
+		exitWithError(cmd, err)
+	}
+
+	defer resp.Body.Close()
+
+	printResponse(cmd, backupID, resp)
+}
+
 var backupDownloadRecoveryPointCmd = &cobra.Command{
 	Use:   "download",
 	Short: "Download backup at given recovery point.",
@@ -220,8 +454,7 @@ var backupDownloadRecoveryPointCmd = &cobra.Command{
 		// make request
 		req, err := http.NewRequest(http.MethodGet, urlRequest, nil)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// update require header
@@ -239,8 +472,7 @@ var backupDownloadRecoveryPointCmd = &cobra.Command{
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
@@ -251,19 +483,20 @@ var backupDownloadRecoveryPointCmd = &cobra.Command{
 
 		f, err := os.Create(backupDownloadOutFile)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		pw := backupapi.NewProgressWriter(os.Stderr)
 		if _, err := io.Copy(f, io.TeeReader(resp.Body, pw)); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		if err := f.Close(); err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+			exitWithError(cmd, err)
+		}
+
+		if jsonOutput() {
+			writeResult(os.Stdout, Result{Command: cmd.CommandPath(), Status: resultSuccess, ID: recoveryPointID, Message: backupDownloadOutFile})
 		}
 	},
 }
@@ -299,8 +532,7 @@ var backupRunCmd = &cobra.Command{
 		// make request
 		req, err := http.NewRequest(http.MethodPost, urlRequest, bytes.NewBuffer(buf))
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// update header
@@ -309,13 +541,61 @@ var backupRunCmd = &cobra.Command{
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
+		}
+
+		defer resp.Body.Close()
+
+		printResponse(cmd, backupID, resp)
+	},
+}
+
+var backupScheduleCmd = &cobra.Command{
+	Use:   "schedule",
+	Short: "Show upcoming scheduled backups.",
+	Run: func(cmd *cobra.Command, args []string) {
+		// make url
+		query := url.Values{}
+		query.Set("runs", strconv.Itoa(scheduleRuns))
+		if scheduleWithin != "" {
+			query.Set("within", scheduleWithin)
+		}
+		urlRequest := strings.Join([]string{addr, "backups", "schedule"}, "/") + "?" + query.Encode()
+
+		// create client
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial(tcpProtocol, strings.TrimPrefix(addr, httpPrefix))
+				},
+			},
+		}
+
+		// make request
+		req, err := http.NewRequest(http.MethodGet, urlRequest, nil)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		// call request
+		resp, err := httpc.Do(req)
+		if err != nil {
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
 
-		_, _ = io.Copy(os.Stderr, resp.Body)
+		var plan []server.ScheduledRun
+		if err := json.NewDecoder(resp.Body).Decode(&plan); err != nil {
+			exitWithError(cmd, err)
+		}
+
+		data := make([][]string, 0, len(plan))
+		for _, run := range plan {
+			data = append(data, []string{run.At.Format(time.RFC3339), run.BackupDirectoryID, run.PolicyID})
+		}
+
+		printList(cmd, listScheduleHeaders, data, plan)
 	},
 }
 
@@ -338,8 +618,7 @@ var backupSyncCmd = &cobra.Command{
 		// make request
 		req, err := http.NewRequest(http.MethodPost, urlRequest, nil)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// update header
@@ -348,8 +627,7 @@ var backupSyncCmd = &cobra.Command{
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
@@ -370,6 +648,35 @@ func init() {
 	_ = backupDeleteRecoveryPointCmd.MarkPersistentFlagRequired("recovery-point-id")
 	backupCmd.AddCommand(backupDeleteRecoveryPointCmd)
 
+	backupRebuildChunksCmd.PersistentFlags().StringVar(&recoveryPointID, "recovery-point-id", "", "The ID of recovery point")
+	backupRebuildChunksCmd.PersistentFlags().StringVar(&storageVaultID, "storage-vault-id", "", "The ID of storage vault")
+	_ = backupRebuildChunksCmd.MarkPersistentFlagRequired("recovery-point-id")
+	_ = backupRebuildChunksCmd.MarkPersistentFlagRequired("storage-vault-id")
+	backupCmd.AddCommand(backupRebuildChunksCmd)
+	backupConsolidateIndexCmd.PersistentFlags().StringVar(&recoveryPointID, "recovery-point-id", "", "The ID of recovery point")
+	backupConsolidateIndexCmd.PersistentFlags().StringVar(&storageVaultID, "storage-vault-id", "", "The ID of storage vault")
+	_ = backupConsolidateIndexCmd.MarkPersistentFlagRequired("recovery-point-id")
+	_ = backupConsolidateIndexCmd.MarkPersistentFlagRequired("storage-vault-id")
+	backupCmd.AddCommand(backupConsolidateIndexCmd)
+	backupRewrapKeysCmd.PersistentFlags().StringVar(&backupID, "backup-id", "", "The ID of backup directory")
+	backupRewrapKeysCmd.PersistentFlags().StringVar(&storageVaultID, "storage-vault-id", "", "The ID of storage vault")
+	backupRewrapKeysCmd.PersistentFlags().StringSliceVar(&rewrapRecipients, "recipient", nil, "An age public key or AWS KMS key to wrap the content keys to, repeated for each recipient")
+	_ = backupRewrapKeysCmd.MarkPersistentFlagRequired("backup-id")
+	_ = backupRewrapKeysCmd.MarkPersistentFlagRequired("storage-vault-id")
+	_ = backupRewrapKeysCmd.MarkPersistentFlagRequired("recipient")
+	backupCmd.AddCommand(backupRewrapKeysCmd)
+
+	backupResetCircuitCmd.PersistentFlags().StringVar(&backupID, "backup-id", "", "The ID of backup directory")
+	_ = backupResetCircuitCmd.MarkPersistentFlagRequired("backup-id")
+	backupCmd.AddCommand(backupResetCircuitCmd)
+
+	backupCmd.AddCommand(backupJournalsCmd)
+	for _, c := range []*cobra.Command{backupResumeCmd, backupAbandonCmd} {
+		c.PersistentFlags().StringVar(&backupID, "backup-id", "", "The ID of backup directory")
+		_ = c.MarkPersistentFlagRequired("backup-id")
+		backupCmd.AddCommand(c)
+	}
+
 	backupDownloadRecoveryPointCmd.PersistentFlags().StringVar(&recoveryPointID, "recovery-point-id", "", "The ID of recovery point")
 	backupDownloadRecoveryPointCmd.PersistentFlags().StringVar(&backupDownloadOutFile, "outfile", "", "Output backup download to file")
 	_ = backupDownloadRecoveryPointCmd.MarkPersistentFlagRequired("recovery-point-id")
@@ -383,6 +690,10 @@ func init() {
 	backupCmd.AddCommand(backupRunCmd)
 
 	backupCmd.AddCommand(backupSyncCmd)
+
+	backupScheduleCmd.PersistentFlags().IntVar(&scheduleRuns, "runs", 10, "The number of upcoming runs to show per policy")
+	backupScheduleCmd.PersistentFlags().StringVar(&scheduleWithin, "within", "", "Only show runs within this duration, e.g. 24h")
+	backupCmd.AddCommand(backupScheduleCmd)
 }
 
 func restoreSessionKey(key, machineID, createdAt, recoveryPointID string) string {
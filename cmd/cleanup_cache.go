@@ -18,7 +18,6 @@
 package cmd
 
 import (
-	"os"
 	"strconv"
 	"time"
 
@@ -39,14 +38,12 @@ var cleanupCacheCmd = &cobra.Command{
 		}
 		number, err := strconv.ParseInt(maxTime, 10, 64)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 		maxCacheAge := time.Duration(number) * time.Hour * 24
 		errRemove := cache.RemoveOldCache(maxCacheAge)
 		if errRemove != nil {
-			logger.Error(errRemove.Error())
-			os.Exit(1)
+			exitWithError(cmd, errRemove)
 		}
 	},
 }
@@ -0,0 +1,107 @@
+// This file is part of bizfly-backup
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+var (
+	storageVaultID       string
+	inspectObjectHeaders = []string{"Key", "Exists", "Size", "ETag", "Storage Class", "Last Modified", "Integrity"}
+)
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <key>",
+	Short: "Inspect an object in the storage vault.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		// make url
+		query := url.Values{}
+		query.Set("key", args[0])
+		urlRequest := strings.Join([]string{addr, "storage-vaults", storageVaultID, "inspect"}, "/") + "?" + query.Encode()
+
+		// create client
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial(tcpProtocol, strings.TrimPrefix(addr, httpPrefix))
+				},
+			},
+		}
+
+		// make request
+		req, err := http.NewRequest(http.MethodGet, urlRequest, nil)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		// call request
+		resp, err := httpc.Do(req)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			printResponse(cmd, args[0], resp)
+			os.Exit(1)
+		}
+
+		var info storage_vault.ObjectInfo
+		if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+			exitWithError(cmd, err)
+		}
+
+		var lastModified string
+		if !info.LastModified.IsZero() {
+			lastModified = info.LastModified.Format(time.RFC3339)
+		}
+		data := [][]string{{
+			info.Key,
+			strconv.FormatBool(info.Exists),
+			strconv.FormatInt(info.Size, 10),
+			info.ETag,
+			info.StorageClass,
+			lastModified,
+			strconv.FormatBool(info.Integrity),
+		}}
+
+		printList(cmd, inspectObjectHeaders, data, info)
+	},
+}
+
+func init() {
+	inspectCmd.PersistentFlags().StringVar(&storageVaultID, "storage-vault-id", "", "The ID of storage vault")
+	_ = inspectCmd.MarkPersistentFlagRequired("storage-vault-id")
+	rootCmd.AddCommand(inspectCmd)
+}
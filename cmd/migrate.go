@@ -0,0 +1,108 @@
+// This file is part of bizfly-backup
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+)
+
+var (
+	sourceStorageVaultID      string
+	destinationStorageVaultID string
+	migrateVaultHeaders       = []string{"Objects", "Copied", "Skipped", "Bytes", "Indexes", "Chunks"}
+)
+
+// migrateVaultCmd represents the migrate-vault command
+var migrateVaultCmd = &cobra.Command{
+	Use:   "migrate-vault",
+	Short: "Copy every object of a storage vault to another one, verifying each copy.",
+	Long: `Copy every object of a storage vault to another one, verifying each copy.
+Objects already copied are skipped, so an interrupted migration is resumed by running the command again.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		// make url
+		urlRequest := strings.Join([]string{addr, "storage-vaults", "migrate"}, "/")
+
+		// create client
+		httpc := http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+					return net.Dial(tcpProtocol, strings.TrimPrefix(addr, httpPrefix))
+				},
+			},
+		}
+
+		// init body
+		buf, _ := json.Marshal(map[string]string{
+			"source_storage_vault_id":      sourceStorageVaultID,
+			"destination_storage_vault_id": destinationStorageVaultID,
+		})
+
+		// make request
+		req, err := http.NewRequest(http.MethodPost, urlRequest, bytes.NewBuffer(buf))
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		// call request
+		resp, err := httpc.Do(req)
+		if err != nil {
+			exitWithError(cmd, err)
+		}
+
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			printResponse(cmd, sourceStorageVaultID, resp)
+			os.Exit(1)
+		}
+
+		var result backupapi.MigrateResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			exitWithError(cmd, err)
+		}
+		data := [][]string{{
+			strconv.FormatUint(result.Objects, 10),
+			strconv.FormatUint(result.Copied, 10),
+			strconv.FormatUint(result.Skipped, 10),
+			strconv.FormatUint(result.Bytes, 10),
+			strconv.Itoa(result.Indexes),
+			strconv.Itoa(result.Chunks),
+		}}
+
+		printList(cmd, migrateVaultHeaders, data, result)
+	},
+}
+
+func init() {
+	migrateVaultCmd.PersistentFlags().StringVar(&sourceStorageVaultID, "from", "", "The ID of the storage vault to copy from")
+	migrateVaultCmd.PersistentFlags().StringVar(&destinationStorageVaultID, "to", "", "The ID of the storage vault to copy to")
+	_ = migrateVaultCmd.MarkPersistentFlagRequired("from")
+	_ = migrateVaultCmd.MarkPersistentFlagRequired("to")
+	rootCmd.AddCommand(migrateVaultCmd)
+}
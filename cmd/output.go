@@ -0,0 +1,104 @@
+// This file is part of bizfly-backup
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package cmd
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bizflycloud/bizflyctl/formatter"
+	"github.com/spf13/cobra"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+
+	resultSuccess = "success"
+	resultError   = "error"
+)
+
+// Result is the document printed to stdout with --output json.
+// Field names are part of the CLI contract, do not rename them.
+type Result struct {
+	Command    string      `json:"command"`
+	Status     string      `json:"status"`
+	ID         string      `json:"id,omitempty"`
+	StatusCode int         `json:"status_code,omitempty"`
+	Count      *int        `json:"count,omitempty"`
+	Items      interface{} `json:"items,omitempty"`
+	Message    string      `json:"message,omitempty"`
+	Error      string      `json:"error,omitempty"`
+}
+
+func jsonOutput() bool {
+	return outputFormat == outputJSON
+}
+
+func writeResult(w io.Writer, r Result) {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(r)
+}
+
+// printList prints data as a table, or items as a JSON result.
+func printList(cmd *cobra.Command, headers []string, data [][]string, items interface{}) {
+	if !jsonOutput() {
+		formatter.Output(headers, data)
+		return
+	}
+	count := len(data)
+	writeResult(os.Stdout, Result{Command: cmd.CommandPath(), Status: resultSuccess, Count: &count, Items: items})
+}
+
+// printResponse prints the plain text answer of the agent for a command acting on id.
+func printResponse(cmd *cobra.Command, id string, resp *http.Response) {
+	if !jsonOutput() {
+		_, _ = io.Copy(os.Stderr, resp.Body)
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		exitWithError(cmd, err)
+	}
+	r := Result{Command: cmd.CommandPath(), Status: resultSuccess, ID: id, StatusCode: resp.StatusCode}
+	if resp.StatusCode >= http.StatusBadRequest {
+		r.Status = resultError
+		r.Error = strings.TrimSpace(string(body))
+	} else {
+		r.Message = strings.TrimSpace(string(body))
+	}
+	writeResult(os.Stdout, r)
+	if r.Status == resultError {
+		os.Exit(1)
+	}
+}
+
+// exitWithError reports err and exits with a non-zero status.
+func exitWithError(cmd *cobra.Command, err error) {
+	if jsonOutput() {
+		writeResult(os.Stdout, Result{Command: cmd.CommandPath(), Status: resultError, Error: err.Error()})
+	} else {
+		logger.Error(err.Error())
+	}
+	os.Exit(1)
+}
@@ -0,0 +1,69 @@
+// This file is part of bizfly-backup
+//
+// Copyright (C) 2020  BizFly Cloud
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>
+
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func Test_writeResult(t *testing.T) {
+	count := 0
+	tests := []struct {
+		name   string
+		result Result
+		want   map[string]interface{}
+	}{
+		{
+			name:   "error",
+			result: Result{Command: "bizfly-backup restore", Status: resultError, Error: "boom"},
+			want:   map[string]interface{}{"command": "bizfly-backup restore", "status": "error", "error": "boom"},
+		},
+		{
+			name:   "empty list",
+			result: Result{Command: "bizfly-backup backup list", Status: resultSuccess, Count: &count, Items: []string{}},
+			want:   map[string]interface{}{"command": "bizfly-backup backup list", "status": "success", "count": float64(0), "items": []interface{}{}},
+		},
+		{
+			name:   "response",
+			result: Result{Command: "bizfly-backup backup run", Status: resultSuccess, ID: "1", StatusCode: 200, Message: "ok"},
+			want:   map[string]interface{}{"command": "bizfly-backup backup run", "status": "success", "id": "1", "status_code": float64(200), "message": "ok"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			writeResult(&buf, tt.result)
+			var got map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("writeResult() = %v, want %v", got, tt.want)
+			}
+			for k, v := range tt.want {
+				gotJSON, _ := json.Marshal(got[k])
+				wantJSON, _ := json.Marshal(v)
+				if !bytes.Equal(gotJSON, wantJSON) {
+					t.Errorf("writeResult()[%s] = %s, want %s", k, gotJSON, wantJSON)
+				}
+			}
+		})
+	}
+}
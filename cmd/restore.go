@@ -21,7 +21,6 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"io"
 	"net"
 	"net/http"
 	"os"
@@ -32,7 +31,13 @@ import (
 
 const postContentType = "application/octet-stream"
 
-var restoreDir string
+var (
+	restoreDir          string
+	restoreStripPrefix  string
+	restoreMetadataOnly bool
+	restoreForce        bool
+	restoreProfile      string
+)
 
 // restoreCmd represents the restore command
 var restoreCmd = &cobra.Command{
@@ -56,33 +61,46 @@ var restoreCmd = &cobra.Command{
 			restoreDir = recoveryPointID
 		}
 		var body struct {
-			Path string `json:"path"`
+			Path         string `json:"path"`
+			StripPrefix  string `json:"strip_prefix,omitempty"`
+			MetadataOnly bool   `json:"metadata_only,omitempty"`
+			Force        bool   `json:"force,omitempty"`
+			Profile      string `json:"profile,omitempty"`
 		}
 		body.Path = restoreDir
+		body.StripPrefix = restoreStripPrefix
+		body.MetadataOnly = restoreMetadataOnly
+		body.Force = restoreForce
+		body.Profile = restoreProfile
 		buf, _ := json.Marshal(body)
 
 		// make request
 		req, err := http.NewRequest(http.MethodGet, urlRequest, bytes.NewBuffer(buf))
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
 
-		_, _ = io.Copy(os.Stderr, resp.Body)
+		printResponse(cmd, recoveryPointID, resp)
+		if resp.StatusCode != http.StatusOK {
+			os.Exit(1)
+		}
 	},
 }
 
 func init() {
 	restoreCmd.PersistentFlags().StringVar(&restoreDir, "dest-directory", "", "The destination directory to restore")
+	restoreCmd.PersistentFlags().StringVar(&restoreStripPrefix, "strip-prefix", "", "Leading path of the backup to strip, its contents are restored directly into the destination directory")
+	restoreCmd.PersistentFlags().BoolVar(&restoreMetadataOnly, "metadata-only", false, "Only reapply the mode, owner and times of the backup to items whose content still matches, without downloading data")
+	restoreCmd.PersistentFlags().BoolVar(&restoreForce, "force", false, "Restore into a protected path or a non-empty directory")
+	restoreCmd.PersistentFlags().StringVar(&restoreProfile, "profile", "", "The restore profile setting concurrency, download limit and chunk cache: fast, balanced, gentle or one of restore_profiles")
 	restoreCmd.PersistentFlags().StringVar(&recoveryPointID, "recovery-point-id", "", "The ID of recovery point")
 	_ = restoreCmd.MarkPersistentFlagRequired("recovery-point-id")
 	rootCmd.AddCommand(restoreCmd)
@@ -24,7 +24,10 @@ import (
 	"github.com/spf13/viper"
 	"go.uber.org/zap"
 	"os"
+	"path/filepath"
 	"strings"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 )
 
 const (
@@ -40,6 +43,8 @@ var (
 	debug   bool
 	force   bool
 	logger  *zap.Logger
+
+	outputFormat string
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -72,6 +77,7 @@ func init() {
 	rootCmd.PersistentFlags().BoolVar(&debug, "debug", false, "enable debug (default is false)")
 	rootCmd.PersistentFlags().StringVar(&addr, "addr", "", "listening address of agent server.")
 	rootCmd.PersistentFlags().BoolVar(&force, "force", false, "force backup (may cause full disk).")
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output", outputTable, "output format, table or json.")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -112,6 +118,16 @@ func initConfig() {
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
 		logger.Info("Using config file: " + viper.ConfigFileUsed())
+		viper.SetDefault("config_dir", filepath.Join(filepath.Dir(viper.ConfigFileUsed()), "conf.d"))
+	}
+	if err := backupapi.MergeConfigDir(viper.GetString("config_dir")); err != nil {
+		logger.Error("Invalid config directory: " + err.Error())
+		os.Exit(1)
+	}
+
+	if outputFormat != outputTable && outputFormat != outputJSON {
+		logger.Error("Invalid output format: " + outputFormat)
+		os.Exit(1)
 	}
 
 	// Set value
@@ -21,7 +21,6 @@ import (
 	"context"
 	"net"
 	"net/http"
-	"os"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -47,15 +46,13 @@ var upgradeCmd = &cobra.Command{
 		// make request
 		req, err := http.NewRequest(http.MethodPost, urlRequest, nil)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		// call request
 		resp, err := httpc.Do(req)
 		if err != nil {
-			logger.Error(err.Error())
-			os.Exit(1)
+			exitWithError(cmd, err)
 		}
 
 		defer resp.Body.Close()
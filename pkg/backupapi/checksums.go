@@ -0,0 +1,83 @@
+package backupapi
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+)
+
+// ChecksumManifestName is the name of the checksum manifest of a recovery
+// point export, in the format of sha256sum.
+const ChecksumManifestName = "SHA256SUMS"
+
+// WriteChecksums writes the sha256 hash recorded in index for every file, in
+// the format read by `sha256sum -c`, and returns the number of files listed.
+// With destDir set, the files are listed where they are restored under it,
+// relative to destDir when inside it. Without, they are listed by their path
+// relative to the backup root. Files without a recorded sha256 hash and images
+// restored onto a device are left out.
+func WriteChecksums(w io.Writer, index cache.Index, destDir string) (int, error) {
+	lines := make(map[string]string)
+	for _, item := range index.Items {
+		if (item.Type != "file" && item.Type != "blockdev") || len(item.Sha256Hash) == 0 || item.HashAlgo != "" {
+			continue
+		}
+		name := filepath.ToSlash(item.RelativePath)
+		if destDir != "" {
+			target, toDevice := restorePath(destDir, item)
+			if toDevice {
+				continue
+			}
+			name = target
+			if rel, err := filepath.Rel(destDir, target); err == nil && !strings.HasPrefix(rel, "..") {
+				name = filepath.ToSlash(rel)
+			}
+		}
+		lines[name] = item.Sha256Hash.String()
+	}
+
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	for _, name := range names {
+		if _, err := bw.WriteString(checksumLine(lines[name], name)); err != nil {
+			return 0, err
+		}
+	}
+	return len(names), bw.Flush()
+}
+
+// checksumLine formats a line of sha256sum. Like sha256sum, a name holding a
+// backslash or a newline is escaped and its line starts with a backslash.
+func checksumLine(hash, name string) string {
+	if !strings.ContainsAny(name, "\\\n") {
+		return fmt.Sprintf("%s  %s\n", hash, name)
+	}
+	name = strings.NewReplacer("\\", "\\\\", "\n", "\\n").Replace(name)
+	return fmt.Sprintf("\\%s  %s\n", hash, name)
+}
+
+// WriteChecksumManifest writes the checksums of the files of index restored
+// under destDir to path.
+func WriteChecksumManifest(path string, index cache.Index, destDir string) (int, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return 0, err
+	}
+	n, err := WriteChecksums(file, index, destDir)
+	if err != nil {
+		file.Close()
+		return 0, err
+	}
+	return n, file.Close()
+}
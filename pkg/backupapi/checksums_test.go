@@ -0,0 +1,105 @@
+package backupapi
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+func TestWriteChecksums(t *testing.T) {
+	hash := func(s string) cache.Sha256Hash {
+		sum := sha256.Sum256([]byte(s))
+		return sum[:]
+	}
+	index := cache.NewIndex("bd", "rp")
+	index.Items["/src/b"] = &cache.Node{Type: "file", BasePath: "/src", AbsolutePath: "/src/b", RelativePath: "src/b", Sha256Hash: hash("b")}
+	index.Items["/src/a\\b"] = &cache.Node{Type: "file", BasePath: "/src", AbsolutePath: "/src/a\\b", RelativePath: "src/a\\b", Sha256Hash: hash("a")}
+	index.Items["/src/dir"] = &cache.Node{Type: "dir", BasePath: "/src", AbsolutePath: "/src/dir", RelativePath: "src/dir"}
+	index.Items["/src/nohash"] = &cache.Node{Type: "file", BasePath: "/src", AbsolutePath: "/src/nohash", RelativePath: "src/nohash"}
+
+	tests := []struct {
+		name    string
+		destDir string
+		want    string
+	}{
+		{"relative to backup root", "", `\` + hash("a").String() + `  src/a\\b` + "\n" + hash("b").String() + "  src/b\n"},
+		{"restored elsewhere", "/restore", `\` + hash("a").String() + `  src/a\\b` + "\n" + hash("b").String() + "  src/b\n"},
+		{"restored in place", "/src", `\` + hash("a").String() + `  a\\b` + "\n" + hash("b").String() + "  b\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			n, err := WriteChecksums(&buf, *index, tt.destDir)
+			require.NoError(t, err)
+			assert.Equal(t, 2, n)
+			assert.Equal(t, tt.want, buf.String())
+		})
+	}
+}
+
+func TestWriteChecksumManifestSha256sum(t *testing.T) {
+	sha256sum, err := exec.LookPath("sha256sum")
+	if err != nil {
+		t.Skip("sha256sum not found")
+	}
+	setUp()
+	defer tearDown()
+
+	vault, index := exportFixture("hello ", "world")
+	node := index.Items["/data/file.txt"]
+	node.Mode = 0600
+	hash := sha256.Sum256([]byte("hello world"))
+	node.Sha256Hash = hash[:]
+
+	dest := t.TempDir()
+	require.NoError(t, client.RestoreDirectory(context.Background(), *index, dest, false, RestoreProfile{}, vault, nil, progress.NewProgress(time.Second)))
+	manifest := filepath.Join(dest, ChecksumManifestName)
+	n, err := WriteChecksumManifest(manifest, *index, dest)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	cmd := exec.Command(sha256sum, "-c", manifest)
+	cmd.Dir = dest
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dest, "data/file.txt"), []byte("hello WORLD"), 0600))
+	cmd = exec.Command(sha256sum, "-c", manifest)
+	cmd.Dir = dest
+	assert.Error(t, cmd.Run())
+}
+
+func TestExportRecoveryPointChecksums(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault, index := exportFixture("hello")
+	hash := sha256.Sum256([]byte("hello"))
+	index.Items["/data/file.txt"].Sha256Hash = hash[:]
+
+	var buf bytes.Buffer
+	require.NoError(t, client.ExportRecoveryPoint(context.Background(), *index, vault, &buf))
+	tr := tar.NewReader(bytes.NewReader(buf.Bytes()))
+	for {
+		hdr, err := tr.Next()
+		require.NoError(t, err, "no %s entry", ChecksumManifestName)
+		if hdr.Name == ChecksumManifestName {
+			sums, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			assert.Equal(t, cache.Sha256Hash(hash[:]).String()+"  data/file.txt\n", string(sums))
+			break
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package backupapi
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// ErrorChunkCollision is returned when a chunk can not be stored under any of
+// its keys because they hold different content.
+var ErrorChunkCollision = errors.New("chunk key collision")
+
+// chunkKey returns the content address of data, its MD5 digest.
+func chunkKey(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// collisionKey returns the key data is stored under when its chunk key already
+// holds different content: the chunk key followed by the sha256 of data.
+func collisionKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return chunkKey(data) + "-" + hex.EncodeToString(sum[:])
+}
+
+// chunkKeyMatches reports whether key is one of the keys of data.
+func chunkKeyMatches(key string, data []byte) bool {
+	if strings.Contains(key, "-") {
+		return key == collisionKey(data)
+	}
+	return key == chunkKey(data)
+}
+
+// storeChunkKey returns the key data is to be stored under, and whether it is
+// already stored there. With chunk_sha256 set the object found under the chunk
+// key of data is compared by sha256 before being reused, so that an MD5
+// collision is stored under a key of its own instead of being deduplicated.
+func (c *Client) storeChunkKey(ctx context.Context, storageVault storage_vault.StorageVault, data []byte) (string, bool, error) {
+	key := chunkKey(data)
+	checker, ok := storageVault.(storage_vault.ChunkChecker)
+	if !ok || !viper.GetBool("chunk_sha256") {
+		return key, false, nil
+	}
+	exists, same, err := checker.CheckChunk(ctx, key, data)
+	if errors.Is(err, storage_vault.ErrNotSupported) {
+		return key, false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	if !exists || same {
+		return key, exists, nil
+	}
+
+	alt := collisionKey(data)
+	c.logger.Error("Chunk key collision, storing chunk under a disambiguated key", zap.String("key", key), zap.String("stored_as", alt))
+	exists, same, err = checker.CheckChunk(ctx, alt, data)
+	if err != nil {
+		return "", false, err
+	}
+	if exists && !same {
+		return "", false, fmt.Errorf("%w: %s", ErrorChunkCollision, alt)
+	}
+	return alt, exists, nil
+}
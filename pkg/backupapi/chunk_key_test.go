@@ -0,0 +1,73 @@
+package backupapi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/fault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+func Test_chunkKeyMatches(t *testing.T) {
+	data := []byte("data")
+	assert.True(t, chunkKeyMatches(chunkKey(data), data))
+	assert.True(t, chunkKeyMatches(collisionKey(data), data))
+	assert.False(t, chunkKeyMatches(chunkKey([]byte("other")), data))
+	assert.False(t, chunkKeyMatches(chunkKey(data)+"-"+chunkKey(data), data))
+}
+
+func TestClient_storeChunkKey(t *testing.T) {
+	setUp()
+	defer tearDown()
+	defer viper.Set("chunk_sha256", nil)
+
+	data := []byte("data")
+	key := chunkKey(data)
+	// The chunk key of data already holds other content, as after a collision.
+	vault := memory.New("vault", "")
+	require.NoError(t, vault.PutObject(context.Background(), key, []byte("colliding")))
+
+	tests := []struct {
+		name       string
+		sha256     bool
+		wantKey    string
+		wantStored bool
+	}{
+		{"trusts the key by default", false, key, false},
+		{"stores a collision apart", true, collisionKey(data), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("chunk_sha256", tt.sha256)
+			got, stored, err := client.storeChunkKey(context.Background(), vault, data)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantKey, got)
+			assert.Equal(t, tt.wantStored, stored)
+		})
+	}
+
+	// Once stored, the disambiguated key is reused.
+	require.NoError(t, vault.PutObject(context.Background(), collisionKey(data), data))
+	got, stored, err := client.storeChunkKey(context.Background(), vault, data)
+	require.NoError(t, err)
+	assert.Equal(t, collisionKey(data), got)
+	assert.True(t, stored)
+
+	// Content already stored under its chunk key is reused as is.
+	other := []byte("other")
+	require.NoError(t, vault.PutObject(context.Background(), chunkKey(other), other))
+	got, stored, err = client.storeChunkKey(context.Background(), vault, other)
+	require.NoError(t, err)
+	assert.Equal(t, chunkKey(other), got)
+	assert.True(t, stored)
+
+	// Vaults which can not compare content fall back to the chunk key.
+	got, stored, err = client.storeChunkKey(context.Background(), fault.New(vault), data)
+	require.NoError(t, err)
+	assert.Equal(t, key, got)
+	assert.False(t, stored)
+}
@@ -0,0 +1,143 @@
+package backupapi
+
+import (
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+
+	"github.com/restic/chunker"
+	"github.com/spf13/viper"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+)
+
+// Values of chunk.mode.
+const (
+	ChunkModeContent = "content"
+	ChunkModeFixed   = "fixed"
+)
+
+const (
+	// DefaultChunkPolynomial is the polynomial files are chunked with.
+	DefaultChunkPolynomial chunker.Pol = 0x3dea92648f6e83
+	// DefaultChunkAvgSize is the average size of a chunk.
+	DefaultChunkAvgSize = 1 << 20
+
+	// minChunkSize and maxChunkSize bound chunk.min_size and chunk.max_size,
+	// a buffer of chunk.max_size is held for every file being read.
+	minChunkSize = 64 << 10
+	maxChunkSize = 64 << 20
+)
+
+// DefaultChunking is the chunking of files unless configured otherwise.
+var DefaultChunking = cache.Chunking{
+	Polynomial: DefaultChunkPolynomial,
+	MinSize:    chunker.MinSize,
+	AvgSize:    DefaultChunkAvgSize,
+	MaxSize:    chunker.MaxSize,
+}
+
+// ChunkingFromConfig returns the chunking set by chunk.mode, chunk.polynomial,
+// chunk.min_size, chunk.avg_size and chunk.max_size, each defaulting to the one
+// of DefaultChunking. Invalid parameters return DefaultChunking along with the
+// error.
+func ChunkingFromConfig() (cache.Chunking, error) {
+	chunking := DefaultChunking
+	switch mode := viper.GetString("chunk.mode"); mode {
+	case "", ChunkModeContent:
+	case ChunkModeFixed:
+		chunking.Mode = ChunkModeFixed
+	default:
+		return DefaultChunking, fmt.Errorf("%w: chunk.mode %q", ErrorInvalidConfig, mode)
+	}
+	if viper.IsSet("chunk.polynomial") {
+		// A hexadecimal polynomial is quoted, YAML reads 0x... as a number.
+		pol, err := strconv.ParseUint(viper.GetString("chunk.polynomial"), 0, 64)
+		if err != nil {
+			return DefaultChunking, fmt.Errorf("%w: chunk.polynomial %q", ErrorInvalidConfig, viper.GetString("chunk.polynomial"))
+		}
+		chunking.Polynomial = chunker.Pol(pol)
+	}
+	if viper.IsSet("chunk.min_size") {
+		chunking.MinSize = viper.GetSizeInBytes("chunk.min_size")
+	}
+	if viper.IsSet("chunk.avg_size") {
+		chunking.AvgSize = viper.GetSizeInBytes("chunk.avg_size")
+	}
+	if viper.IsSet("chunk.max_size") {
+		chunking.MaxSize = viper.GetSizeInBytes("chunk.max_size")
+	}
+	if err := validChunking(chunking); err != nil {
+		return DefaultChunking, err
+	}
+	return chunking, nil
+}
+
+// validChunking checks the polynomial is irreducible of degree 53, and
+// min_size < avg_size < max_size with avg_size a power of two. Fixed chunks
+// only need a valid max_size.
+func validChunking(c cache.Chunking) error {
+	if c.Mode == ChunkModeFixed {
+		if c.MaxSize < minChunkSize || c.MaxSize > maxChunkSize {
+			return fmt.Errorf("%w: chunk.max_size must be between %d and %d bytes", ErrorInvalidConfig, minChunkSize, maxChunkSize)
+		}
+		return nil
+	}
+	if c.Polynomial.Deg() != 53 || !c.Polynomial.Irreducible() {
+		return fmt.Errorf("%w: chunk.polynomial %s is not an irreducible polynomial of degree 53", ErrorInvalidConfig, c.Polynomial)
+	}
+	if c.MinSize < minChunkSize || c.MaxSize > maxChunkSize {
+		return fmt.Errorf("%w: chunk sizes must be between %d and %d bytes", ErrorInvalidConfig, minChunkSize, maxChunkSize)
+	}
+	if c.MinSize >= c.AvgSize || c.AvgSize >= c.MaxSize {
+		return fmt.Errorf("%w: chunk.min_size %d, chunk.avg_size %d and chunk.max_size %d must increase", ErrorInvalidConfig, c.MinSize, c.AvgSize, c.MaxSize)
+	}
+	if bits.OnesCount(c.AvgSize) != 1 {
+		return fmt.Errorf("%w: chunk.avg_size %d is not a power of two", ErrorInvalidConfig, c.AvgSize)
+	}
+	return nil
+}
+
+// chunkReader cuts the content of a file into chunks, read into buf.
+type chunkReader interface {
+	Next(buf []byte) (chunker.Chunk, error)
+}
+
+// newChunker returns the chunkReader of rd with chunking, DefaultChunking when
+// chunking is the zero value, and the size of the buffer it needs.
+func newChunker(rd io.Reader, chunking cache.Chunking) (chunkReader, uint) {
+	if chunking == (cache.Chunking{}) {
+		chunking = DefaultChunking
+	}
+	if chunking.Mode == ChunkModeFixed {
+		return &fixedChunker{rd: rd, size: chunking.MaxSize}, chunking.MaxSize
+	}
+	chk := chunker.NewWithBoundaries(rd, chunking.Polynomial, chunking.MinSize, chunking.MaxSize)
+	chk.SetAverageBits(bits.TrailingZeros(chunking.AvgSize))
+	return chk, chunking.MaxSize
+}
+
+// fixedChunker cuts its reader into blocks of size bytes, the last one
+// shorter, without looking at their content.
+type fixedChunker struct {
+	rd    io.Reader
+	size  uint
+	start uint
+}
+
+func (f *fixedChunker) Next(buf []byte) (chunker.Chunk, error) {
+	if uint(cap(buf)) < f.size {
+		buf = make([]byte, f.size)
+	}
+	n, err := io.ReadFull(f.rd, buf[:f.size])
+	if err == io.EOF {
+		return chunker.Chunk{}, io.EOF
+	}
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return chunker.Chunk{}, err
+	}
+	chunk := chunker.Chunk{Start: f.start, Length: uint(n), Data: buf[:n]}
+	f.start += uint(n)
+	return chunk, nil
+}
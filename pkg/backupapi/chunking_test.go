@@ -0,0 +1,149 @@
+package backupapi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/restic/chunker"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+)
+
+func TestChunkingFromConfig(t *testing.T) {
+	pol, err := chunker.RandomPolynomial()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		config  map[string]interface{}
+		want    cache.Chunking
+		wantErr bool
+	}{
+		{"default", nil, DefaultChunking, false},
+		{
+			"custom",
+			map[string]interface{}{"chunk.polynomial": fmt.Sprintf("0x%x", uint64(pol)), "chunk.min_size": "256kb", "chunk.avg_size": "512kb", "chunk.max_size": "2mb"},
+			cache.Chunking{Polynomial: pol, MinSize: 256 << 10, AvgSize: 512 << 10, MaxSize: 2 << 20},
+			false,
+		},
+		{"polynomial read as a number", map[string]interface{}{"chunk.polynomial": uint64(pol)}, cache.Chunking{Polynomial: pol, MinSize: chunker.MinSize, AvgSize: DefaultChunkAvgSize, MaxSize: chunker.MaxSize}, false},
+		{"invalid polynomial", map[string]interface{}{"chunk.polynomial": "polynomial"}, DefaultChunking, true},
+		{"reducible polynomial", map[string]interface{}{"chunk.polynomial": "0x3dea92648f6e84"}, DefaultChunking, true},
+		{"min above avg", map[string]interface{}{"chunk.min_size": "2mb"}, DefaultChunking, true},
+		{"avg not a power of two", map[string]interface{}{"chunk.avg_size": "1000kb"}, DefaultChunking, true},
+		{"max too large", map[string]interface{}{"chunk.max_size": "128mb"}, DefaultChunking, true},
+		{"min too small", map[string]interface{}{"chunk.min_size": 64}, DefaultChunking, true},
+		{"fixed", map[string]interface{}{"chunk.mode": "fixed", "chunk.min_size": "4mb"}, cache.Chunking{Mode: ChunkModeFixed, Polynomial: DefaultChunkPolynomial, MinSize: 4 << 20, AvgSize: DefaultChunkAvgSize, MaxSize: chunker.MaxSize}, false},
+		{"fixed too large", map[string]interface{}{"chunk.mode": "fixed", "chunk.max_size": "128mb"}, DefaultChunking, true},
+		{"unknown mode", map[string]interface{}{"chunk.mode": "variable"}, DefaultChunking, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.config {
+				viper.Set(key, value)
+			}
+			defer func() {
+				for key := range tc.config {
+					viper.Set(key, nil)
+				}
+			}()
+
+			got, err := ChunkingFromConfig()
+			if tc.wantErr {
+				assert.ErrorIs(t, err, ErrorInvalidConfig)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.want, got)
+		})
+	}
+}
+
+func TestNewChunker(t *testing.T) {
+	data := make([]byte, 8<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	chunking := cache.Chunking{Polynomial: DefaultChunkPolynomial, MinSize: 64 << 10, AvgSize: 128 << 10, MaxSize: 256 << 10}
+
+	chk, size := newChunker(bytes.NewReader(data), chunking)
+	require.Equal(t, chunking.MaxSize, size)
+	buf := make([]byte, size)
+	var chunks int
+	var read uint
+	for {
+		chunk, err := chk.Next(buf)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.LessOrEqual(t, chunk.Length, chunking.MaxSize)
+		if read+chunk.Length < uint(len(data)) {
+			assert.GreaterOrEqual(t, chunk.Length, chunking.MinSize)
+		}
+		read += chunk.Length
+		chunks++
+	}
+	assert.Equal(t, uint(len(data)), read)
+	// Far more chunks than the 8 or so of the default chunking.
+	assert.Greater(t, chunks, 32)
+
+	// The zero chunking is the default one.
+	_, size = newChunker(bytes.NewReader(data), cache.Chunking{})
+	assert.Equal(t, uint(chunker.MaxSize), size)
+}
+
+func TestFixedChunker(t *testing.T) {
+	data := make([]byte, 1<<20+100)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chk, size := newChunker(bytes.NewReader(data), cache.Chunking{Mode: ChunkModeFixed, MaxSize: 256 << 10})
+	require.Equal(t, uint(256<<10), size)
+	buf := make([]byte, size)
+	var got []byte
+	var lengths []uint
+	for {
+		chunk, err := chk.Next(buf)
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		assert.Equal(t, uint(len(got)), chunk.Start)
+		got = append(got, chunk.Data...)
+		lengths = append(lengths, chunk.Length)
+	}
+	assert.Equal(t, []uint{256 << 10, 256 << 10, 256 << 10, 256 << 10, 100}, lengths)
+	assert.Equal(t, data, got)
+}
+
+// BenchmarkChunking compares the CPU spent cutting random data into content
+// defined chunks and into fixed blocks.
+func BenchmarkChunking(b *testing.B) {
+	data := make([]byte, 32<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, mode := range []string{ChunkModeContent, ChunkModeFixed} {
+		chunking := DefaultChunking
+		if mode == ChunkModeFixed {
+			chunking.Mode = ChunkModeFixed
+		}
+		b.Run(mode, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				chk, size := newChunker(bytes.NewReader(data), chunking)
+				buf := make([]byte, size)
+				for {
+					if _, err := chk.Next(buf); err == io.EOF {
+						break
+					} else if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
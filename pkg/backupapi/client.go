@@ -16,7 +16,9 @@ import (
 	"time"
 
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
 
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
 	"github.com/cenkalti/backoff"
 )
 
@@ -35,6 +37,23 @@ type Client struct {
 	accessKey    string
 	secretKey    string
 	numGoroutine int
+	maxOpenFiles int
+
+	// openFiles bounds the number of files held open while restoring. It is
+	// shared by the restores running at once: file descriptors are limited
+	// for the whole process, not per restore.
+	openFiles *semaphore.Weighted
+	// job is the restore job run by RestoreDirectory, nil outside of it.
+	job *restoreJob
+
+	// hostIndex is shared by the backups of all directories, nil when disabled.
+	hostIndex *cache.HostIndex
+
+	// encryptor encrypts the chunks stored, nil when they are stored as is.
+	encryptor Encryptor
+	// contentKeys wraps the content key for the recovery points stored, and
+	// unwraps it for a restore without the passphrase. nil when disabled.
+	contentKeys *ContentKeys
 
 	userAgent string
 
@@ -75,6 +94,12 @@ func NewClient(opts ...ClientOption) (*Client, error) {
 		c.logger = l
 	}
 
+	if c.maxOpenFiles <= 0 {
+		c.maxOpenFiles = DefaultMaxOpenFiles
+	}
+	c.openFiles = semaphore.NewWeighted(int64(c.maxOpenFiles))
+	c.logger.Sugar().Infof("Restore open file budget: %d", c.maxOpenFiles)
+
 	return c, nil
 }
 
@@ -136,6 +161,45 @@ func WithNumGoroutine(num int) ClientOption {
 	}
 }
 
+// WithMaxOpenFiles sets the number of files the restores of the client may
+// hold open at once, all of them together.
+func WithMaxOpenFiles(num int) ClientOption {
+	return func(c *Client) error {
+		c.maxOpenFiles = num
+		return nil
+	}
+}
+
+// WithEncryptor sets the Encryptor of the chunks, nil stores them as is.
+func WithEncryptor(e Encryptor) ClientOption {
+	return func(c *Client) error {
+		c.encryptor = e
+		return nil
+	}
+}
+
+// WithContentKeys sets the recipients the content key of chunk encryption is
+// wrapped to, and the identities unwrapping it.
+func WithContentKeys(k *ContentKeys) ClientOption {
+	return func(c *Client) error {
+		c.contentKeys = k
+		return nil
+	}
+}
+
+// WithHostIndex sets the host-wide index of uploaded files.
+func WithHostIndex(h *cache.HostIndex) ClientOption {
+	return func(c *Client) error {
+		c.hostIndex = h
+		return nil
+	}
+}
+
+// SaveHostIndex persists the host-wide index of uploaded files, if enabled.
+func (c *Client) SaveHostIndex() error {
+	return c.hostIndex.Save()
+}
+
 // NewRequest create new http request
 func (c *Client) NewRequest(method, relPath string, body interface{}) (*http.Request, error) {
 	buf := new(bytes.Buffer)
@@ -46,6 +46,8 @@ func TestClientOptions(t *testing.T) {
 		{"invalid server url", WithServerURL("https://:foo.bar/api/v1"), true, nil},
 		{"access key", WithAccessKey("access_key"), false, func(c *Client) bool { return c.accessKey == "access_key" }},
 		{"secret key", WithSecretKey("secret_key"), false, func(c *Client) bool { return c.secretKey == "secret_key" }},
+		{"max open files", WithMaxOpenFiles(8), false, func(c *Client) bool { return c.maxOpenFiles == 8 }},
+		{"default max open files", WithMaxOpenFiles(0), false, func(c *Client) bool { return c.maxOpenFiles == DefaultMaxOpenFiles }},
 	}
 
 	for _, tc := range tests {
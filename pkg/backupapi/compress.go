@@ -0,0 +1,160 @@
+package backupapi
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/viper"
+)
+
+// Values of compression, the codec of the chunks stored.
+const (
+	CompressionNone = "none"
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+)
+
+// codecHeader is the byte a chunk compressed with a codec starts with.
+var codecHeader = map[string]byte{
+	CompressionZstd: 1,
+	CompressionGzip: 2,
+}
+
+// ErrorChunkDecompress is returned for a chunk which does not decompress with
+// the codec recorded for it.
+var ErrorChunkDecompress = errors.New("chunk decompression failed")
+
+var (
+	zstdOnce    sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr     error
+)
+
+// zstdCodec returns the encoder and decoder shared by all chunks, both are
+// safe for concurrent use.
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEncoder, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDecoder, zstdErr = zstd.NewReader(nil)
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// CompressionFromConfig returns the codec of compression, none by default.
+func CompressionFromConfig() (string, error) {
+	codec := viper.GetString("compression")
+	switch codec {
+	case "":
+		return CompressionNone, nil
+	case CompressionNone, CompressionZstd, CompressionGzip:
+		return codec, nil
+	default:
+		return "", fmt.Errorf("%w: compression %q", ErrorInvalidConfig, codec)
+	}
+}
+
+// compressChunk returns data compressed with codec, preceded by the header of
+// codec, and the codec used. data is returned as is, with no codec, when it
+// does not get smaller.
+func compressChunk(codec string, data []byte) ([]byte, string, error) {
+	header, ok := codecHeader[codec]
+	if !ok {
+		return data, "", nil
+	}
+	out := []byte{header}
+	switch codec {
+	case CompressionZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, "", err
+		}
+		out = enc.EncodeAll(data, out)
+	case CompressionGzip:
+		buf := bytes.NewBuffer(out)
+		w := gzip.NewWriter(buf)
+		if _, err := w.Write(data); err != nil {
+			return nil, "", err
+		}
+		if err := w.Close(); err != nil {
+			return nil, "", err
+		}
+		out = buf.Bytes()
+	}
+	if len(out) >= len(data) {
+		return data, "", nil
+	}
+	return out, codec, nil
+}
+
+// decompressChunk returns the content of the chunk stored as data with codec,
+// none when codec is empty.
+func decompressChunk(codec string, data []byte) ([]byte, error) {
+	if codec == "" {
+		return data, nil
+	}
+	header, ok := codecHeader[codec]
+	if !ok || len(data) == 0 || data[0] != header {
+		return nil, fmt.Errorf("%w: not a %s chunk", ErrorChunkDecompress, codec)
+	}
+	var out []byte
+	var err error
+	switch codec {
+	case CompressionZstd:
+		var dec *zstd.Decoder
+		if _, dec, err = zstdCodec(); err != nil {
+			return nil, err
+		}
+		out, err = dec.DecodeAll(data[1:], nil)
+	case CompressionGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(data[1:])); err == nil {
+			out, err = ioutil.ReadAll(r)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrorChunkDecompress, err)
+	}
+	return out, nil
+}
+
+// decompressReader returns a reader of the content of the chunk stored with
+// codec and read from r, none when codec is empty.
+func decompressReader(codec string, r io.Reader) (io.ReadCloser, error) {
+	if codec == "" {
+		return ioutil.NopCloser(r), nil
+	}
+	header, ok := codecHeader[codec]
+	if !ok {
+		return nil, fmt.Errorf("%w: not a %s chunk", ErrorChunkDecompress, codec)
+	}
+	var first [1]byte
+	if _, err := io.ReadFull(r, first[:]); err != nil {
+		return nil, err
+	}
+	if first[0] != header {
+		return nil, fmt.Errorf("%w: not a %s chunk", ErrorChunkDecompress, codec)
+	}
+	switch codec {
+	case CompressionZstd:
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrorChunkDecompress, err)
+		}
+		return dec.IOReadCloser(), nil
+	default:
+		gr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s", ErrorChunkDecompress, err)
+		}
+		return gr, nil
+	}
+}
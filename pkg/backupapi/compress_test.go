@@ -0,0 +1,70 @@
+package backupapi
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressChunk(t *testing.T) {
+	text := bytes.Repeat([]byte("2022-01-02 03:04:05 INFO backup started\n"), 1000)
+	random := make([]byte, 4096)
+	_, err := rand.Read(random)
+	require.NoError(t, err)
+
+	for _, codec := range []string{CompressionZstd, CompressionGzip} {
+		t.Run(codec, func(t *testing.T) {
+			stored, got, err := compressChunk(codec, text)
+			require.NoError(t, err)
+			assert.Equal(t, codec, got)
+			assert.Less(t, len(stored), len(text)/5)
+			assert.Equal(t, codecHeader[codec], stored[0])
+			data, err := decompressChunk(codec, stored)
+			require.NoError(t, err)
+			assert.Equal(t, text, data)
+
+			// Data which does not get smaller is stored as is.
+			stored, got, err = compressChunk(codec, random)
+			require.NoError(t, err)
+			assert.Empty(t, got)
+			assert.Equal(t, random, stored)
+		})
+	}
+
+	stored, got, err := compressChunk(CompressionNone, text)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+	assert.Equal(t, text, stored)
+	data, err := decompressChunk("", stored)
+	require.NoError(t, err)
+	assert.Equal(t, text, data)
+}
+
+func TestDecompressChunkInvalid(t *testing.T) {
+	stored, _, err := compressChunk(CompressionZstd, bytes.Repeat([]byte("a"), 1000))
+	require.NoError(t, err)
+
+	_, err = decompressChunk(CompressionGzip, stored)
+	assert.ErrorIs(t, err, ErrorChunkDecompress)
+	_, err = decompressChunk(CompressionZstd, stored[:len(stored)/2])
+	assert.ErrorIs(t, err, ErrorChunkDecompress)
+	_, err = decompressChunk(CompressionZstd, nil)
+	assert.ErrorIs(t, err, ErrorChunkDecompress)
+}
+
+func TestCompressionFromConfig(t *testing.T) {
+	defer viper.Set("compression", nil)
+	for value, want := range map[string]string{"": CompressionNone, "none": CompressionNone, "zstd": CompressionZstd, "gzip": CompressionGzip} {
+		viper.Set("compression", value)
+		got, err := CompressionFromConfig()
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	viper.Set("compression", "lz4")
+	_, err := CompressionFromConfig()
+	assert.ErrorIs(t, err, ErrorInvalidConfig)
+}
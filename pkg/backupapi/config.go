@@ -15,6 +15,19 @@ type BackupDirectoryConfig struct {
 	Path      string                        `json:"path" yaml:"path"`
 	Policies  []BackupDirectoryConfigPolicy `json:"policies" yaml:"policies"`
 	Activated bool                          `json:"activated" yaml:"activated"`
+
+	// StableWait and StablePolicy override stable_file_wait and
+	// stable_file_policy for the directory.
+	StableWait   string `json:"stable_wait,omitempty" yaml:"stable_wait,omitempty"`
+	StablePolicy string `json:"stable_policy,omitempty" yaml:"stable_policy,omitempty"`
+
+	// MaxAge and MinAge leave out the files modified longer ago, or more
+	// recently, than the backup start.
+	MaxAge string `json:"max_age,omitempty" yaml:"max_age,omitempty"`
+	MinAge string `json:"min_age,omitempty" yaml:"min_age,omitempty"`
+
+	// TrustMtime overrides trust_mtime for the directory.
+	TrustMtime string `json:"trust_mtime,omitempty" yaml:"trust_mtime,omitempty"`
 }
 
 // BackupDirectoryConfigPolicy is the cron policy.
@@ -24,6 +37,23 @@ type BackupDirectoryConfigPolicy struct {
 	SchedulePattern string `json:"schedule_pattern" yaml:"schedule_pattern"`
 	Retentions      string `json:"retentions" yaml:"retentions"`
 	LimitUpload     int    `json:"limit_upload" yaml:"limit_upload"`
+	// Timezone is the IANA name of the time zone of SchedulePattern, e.g.
+	// Asia/Ho_Chi_Minh, the time zone of the agent when empty.
+	Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+
+	// Verify schedules integrity scans of the recovery points of the
+	// directory.
+	Verify *VerifyPolicy `json:"verify,omitempty" yaml:"verify,omitempty"`
+}
+
+// VerifyPolicy is the schedule of the integrity scans of a policy. Each scan
+// picks Sample recovery points at random among the Recent latest completed
+// ones and reads back all their chunks from storage vault StorageVaultID.
+type VerifyPolicy struct {
+	SchedulePattern string `json:"schedule_pattern" yaml:"schedule_pattern"`
+	Sample          int    `json:"sample,omitempty" yaml:"sample,omitempty"`
+	Recent          int    `json:"recent,omitempty" yaml:"recent,omitempty"`
+	StorageVaultID  string `json:"storage_vault_id" yaml:"storage_vault_id"`
 }
 
 type Config struct {
@@ -0,0 +1,138 @@
+package backupapi
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	ErrorDuplicateID   = errors.New("duplicate id in config")
+	ErrorInvalidConfig = errors.New("invalid config")
+)
+
+// configFragments returns the config fragments of dir in lexical order of
+// their names, which is the order of precedence.
+func configFragments(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml") {
+			continue
+		}
+		paths = append(paths, filepath.Join(dir, entry.Name()))
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// LoadConfigDir returns the backup directories defined by the fragments of
+// dir. A backup directory may only be defined once across all fragments, and
+// a policy once per directory.
+func LoadConfigDir(dir string) (*Config, error) {
+	paths, err := configFragments(dir)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	definedIn := make(map[string]string)
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var fragment Config
+		if err := yaml.Unmarshal(buf, &fragment); err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrorInvalidConfig, path, err)
+		}
+		for _, bd := range fragment.BackupDirectories {
+			if bd.ID == "" || bd.Path == "" {
+				return nil, fmt.Errorf("%w: %s: backup directory %q needs an id and a path", ErrorInvalidConfig, path, bd.Name)
+			}
+			if other, ok := definedIn[bd.ID]; ok {
+				return nil, fmt.Errorf("%w: backup directory %s in %s and %s", ErrorDuplicateID, bd.ID, other, path)
+			}
+			definedIn[bd.ID] = path
+			if _, err := StableCheckFromConfig(&bd); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			if _, err := MtimeCheckFromConfig(&bd); err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			policies := make(map[string]bool)
+			for _, policy := range bd.Policies {
+				if policy.ID == "" {
+					return nil, fmt.Errorf("%w: %s: policy of backup directory %s needs an id", ErrorInvalidConfig, path, bd.ID)
+				}
+				if policies[policy.ID] {
+					return nil, fmt.Errorf("%w: policy %s of backup directory %s in %s", ErrorDuplicateID, policy.ID, bd.ID, path)
+				}
+				policies[policy.ID] = true
+			}
+			cfg.BackupDirectories = append(cfg.BackupDirectories, bd)
+		}
+	}
+	return cfg, nil
+}
+
+// MergeConfigDir merges the settings of the fragments of dir into viper, in
+// lexical order of their names. A later fragment overrides the earlier ones
+// and the main config file.
+func MergeConfigDir(dir string) error {
+	paths, err := configFragments(dir)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		buf, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		settings := make(map[string]interface{})
+		if err := yaml.Unmarshal(buf, &settings); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrorInvalidConfig, path, err)
+		}
+		// Backup directories are not settings, they are read by LoadConfigDir.
+		delete(settings, "backup_directories")
+		if err := viper.MergeConfigMap(settings); err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrorInvalidConfig, path, err)
+		}
+	}
+	return nil
+}
+
+// MergeBackupDirectories returns the backup directories of the server with
+// the local ones. A local backup directory replaces the one of the server
+// with the same id.
+func MergeBackupDirectories(server []BackupDirectoryConfig, local []BackupDirectoryConfig) []BackupDirectoryConfig {
+	if len(local) == 0 {
+		return server
+	}
+	localIDs := make(map[string]bool, len(local))
+	for _, bd := range local {
+		localIDs[bd.ID] = true
+	}
+	merged := make([]BackupDirectoryConfig, 0, len(server)+len(local))
+	for _, bd := range server {
+		if !localIDs[bd.ID] {
+			merged = append(merged, bd)
+		}
+	}
+	return append(merged, local...)
+}
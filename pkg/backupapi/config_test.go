@@ -3,8 +3,11 @@ package backupapi
 import (
 	"context"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -49,3 +52,87 @@ func TestClient_GetConfig(t *testing.T) {
 		assert.Len(t, bd.Policies, 1)
 	}
 }
+
+func writeFragments(t *testing.T, fragments map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range fragments {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0600))
+	}
+	return dir
+}
+
+func TestLoadConfigDir(t *testing.T) {
+	const images = `
+backup_directories:
+- id: bd-images
+  path: /data/images
+  activated: true
+  policies:
+  - id: daily
+    schedule_pattern: '0 1 * * *'
+`
+	const video = `
+backup_directories:
+- id: bd-video
+  path: /data/video
+  policies:
+  - id: daily
+    schedule_pattern: '0 2 * * *'
+`
+	tests := []struct {
+		name      string
+		fragments map[string]string
+		wantIDs   []string
+		wantErr   error
+	}{
+		{"missing dir", nil, nil, nil},
+		{"lexical order", map[string]string{"20-video.yaml": video, "10-images.yml": images, "README": "not yaml"}, []string{"bd-images", "bd-video"}, nil},
+		{"duplicate directory", map[string]string{"a.yaml": images, "b.yaml": images}, nil, ErrorDuplicateID},
+		{"duplicate policy", map[string]string{"a.yaml": images + "  - id: daily\n"}, nil, ErrorDuplicateID},
+		{"missing path", map[string]string{"a.yaml": "backup_directories:\n- id: bd\n"}, nil, ErrorInvalidConfig},
+		{"missing policy id", map[string]string{"a.yaml": "backup_directories:\n- id: bd\n  path: /data\n  policies:\n  - name: p\n"}, nil, ErrorInvalidConfig},
+		{"malformed", map[string]string{"a.yaml": "backup_directories: ["}, nil, ErrorInvalidConfig},
+		{"invalid stable wait", map[string]string{"a.yaml": "backup_directories:\n- id: bd\n  path: /data\n  stable_wait: soon\n"}, nil, ErrorInvalidConfig},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "missing")
+			if tt.fragments != nil {
+				dir = writeFragments(t, tt.fragments)
+			}
+			cfg, err := LoadConfigDir(dir)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			var ids []string
+			for _, bd := range cfg.BackupDirectories {
+				ids = append(ids, bd.ID)
+			}
+			assert.Equal(t, tt.wantIDs, ids)
+		})
+	}
+}
+
+func TestMergeConfigDir(t *testing.T) {
+	// Merged fragments live in the config layer of viper, only Reset clears them.
+	defer viper.Reset()
+	dir := writeFragments(t, map[string]string{
+		"10-base.yaml":     "limit_upload: 100\nlimit_download: 200\nbackup_directories: []\n",
+		"20-override.yaml": "limit_upload: 300\n",
+	})
+	require.NoError(t, MergeConfigDir(dir))
+	assert.Equal(t, 300, viper.GetInt("limit_upload"))
+	assert.Equal(t, 200, viper.GetInt("limit_download"))
+	assert.False(t, viper.IsSet("backup_directories"))
+}
+
+func TestMergeBackupDirectories(t *testing.T) {
+	server := []BackupDirectoryConfig{{ID: "a", Path: "/server/a"}, {ID: "b", Path: "/server/b"}}
+	local := []BackupDirectoryConfig{{ID: "b", Path: "/local/b"}, {ID: "c", Path: "/local/c"}}
+
+	merged := MergeBackupDirectories(server, local)
+	assert.Equal(t, []BackupDirectoryConfig{{ID: "a", Path: "/server/a"}, {ID: "b", Path: "/local/b"}, {ID: "c", Path: "/local/c"}}, merged)
+	assert.Equal(t, server, MergeBackupDirectories(server, nil))
+}
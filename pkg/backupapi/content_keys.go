@@ -0,0 +1,226 @@
+package backupapi
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/spf13/viper"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/keys"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// ContentKeysName is the object of a recovery point holding the content key
+// of chunk encryption wrapped to the recipients of chunk_encryption_recipients.
+const ContentKeysName = "keys.json"
+
+// kmsIdentity is the identity of chunk_encryption_identities unwrapping the
+// keys wrapped by KMS, with the AWS credentials of the agent.
+const kmsIdentity = "kms"
+
+// ContentKeys holds the content key of chunk encryption with the recipients
+// it is wrapped to for every recovery point, and the identities a restore
+// unwraps it with.
+type ContentKeys struct {
+	key        []byte
+	recipients []keys.Recipient
+	identities []keys.Identity
+}
+
+// ContentKeysFromConfig returns the ContentKeys of chunk_encryption_recipients
+// and chunk_encryption_identities, nil when neither is set. Recipients wrap
+// the key derived from chunk_encryption_passphrase, which must be set with
+// them.
+func ContentKeysFromConfig() (*ContentKeys, error) {
+	recipients := viper.GetStringSlice("chunk_encryption_recipients")
+	identities := viper.GetStringSlice("chunk_encryption_identities")
+	if len(recipients) == 0 && len(identities) == 0 {
+		return nil, nil
+	}
+
+	newKMS := kmsFromConfig()
+	k := &ContentKeys{}
+	if len(recipients) > 0 {
+		passphrase := viper.GetString("chunk_encryption_passphrase")
+		if passphrase == "" {
+			return nil, fmt.Errorf("%w: chunk_encryption_recipients needs chunk_encryption_passphrase", ErrorInvalidConfig)
+		}
+		k.key = ContentKey(passphrase)
+	}
+	var err error
+	if k.recipients, err = parseRecipients("chunk_encryption_recipients", recipients, newKMS); err != nil {
+		return nil, err
+	}
+	for _, s := range identities {
+		if s == kmsIdentity {
+			client, err := newKMS()
+			if err != nil {
+				return nil, err
+			}
+			k.identities = append(k.identities, keys.NewKMSIdentity(client))
+			continue
+		}
+		id, err := keys.ParseIdentity(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: chunk_encryption_identities: %v", ErrorInvalidConfig, err)
+		}
+		k.identities = append(k.identities, id)
+	}
+	return k, nil
+}
+
+// kmsFromConfig returns a function creating the KMS client of the AWS
+// credentials of the agent and chunk_encryption_kms_region once, when first
+// needed.
+func kmsFromConfig() func() (kmsiface.KMSAPI, error) {
+	var kmsClient kmsiface.KMSAPI
+	return func() (kmsiface.KMSAPI, error) {
+		if kmsClient != nil {
+			return kmsClient, nil
+		}
+		config := aws.NewConfig()
+		if region := viper.GetString("chunk_encryption_kms_region"); region != "" {
+			config = config.WithRegion(region)
+		}
+		sess, err := session.NewSessionWithOptions(session.Options{Config: *config, SharedConfigState: session.SharedConfigEnable})
+		if err != nil {
+			return nil, err
+		}
+		kmsClient = kms.New(sess)
+		return kmsClient, nil
+	}
+}
+
+// ParseRecipients parses age public keys and AWS KMS keys to wrap the content
+// key to, as in chunk_encryption_recipients.
+func ParseRecipients(recipients []string) ([]keys.Recipient, error) {
+	return parseRecipients("recipients", recipients, kmsFromConfig())
+}
+
+func parseRecipients(name string, recipients []string, newKMS func() (kmsiface.KMSAPI, error)) ([]keys.Recipient, error) {
+	var parsed []keys.Recipient
+	for _, s := range recipients {
+		var client kmsiface.KMSAPI
+		if !strings.HasPrefix(s, "age1") {
+			var err error
+			if client, err = newKMS(); err != nil {
+				return nil, err
+			}
+		}
+		r, err := keys.ParseRecipient(s, client)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrorInvalidConfig, name, err)
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+func contentKeysKey(mcID, rpID string) string {
+	return filepath.Join(mcID, rpID, ContentKeysName)
+}
+
+// PutContentKeys stores with recovery point rpID of machine mcID the content
+// key wrapped to every recipient of chunk_encryption_recipients. Nothing is
+// stored without recipients.
+func (c *Client) PutContentKeys(ctx context.Context, storageVault storage_vault.StorageVault, mcID, rpID string) error {
+	if c.contentKeys == nil || len(c.contentKeys.recipients) == 0 {
+		return nil
+	}
+	wrapped, err := keys.Wrap(c.contentKeys.key, c.contentKeys.recipients)
+	if err != nil {
+		return err
+	}
+	buf, err := json.Marshal(wrapped)
+	if err != nil {
+		return err
+	}
+	return c.PutObject(ctx, storageVault, contentKeysKey(mcID, rpID), buf)
+}
+
+// RestoreClient returns the client restoring the chunks of recovery point
+// rpID of machine mcID: with chunk_encryption_identities set, a copy of c with
+// the content key stored with the recovery point, unwrapped by the first
+// identity able to, so that neither chunk_encryption_passphrase nor the
+// passphrase the recovery point was stored under is needed. A recovery point
+// stored without wrapped keys is restored by c.
+func (c *Client) RestoreClient(ctx context.Context, storageVault storage_vault.StorageVault, mcID, rpID string, restoreKey *AuthRestore) (*Client, error) {
+	if c.contentKeys == nil || len(c.contentKeys.identities) == 0 {
+		return c, nil
+	}
+	key := contentKeysKey(mcID, rpID)
+	exists, _, err := storageVault.HeadObject(ctx, key)
+	if err != nil && !isNotFound(err) {
+		return nil, err
+	}
+	if !exists {
+		return c, nil
+	}
+	buf, err := c.GetObject(ctx, storageVault, key, restoreKey)
+	if err != nil {
+		return nil, err
+	}
+	var wrapped []*keys.WrappedKey
+	if err := json.Unmarshal(buf, &wrapped); err != nil {
+		return nil, err
+	}
+	contentKey, err := keys.Unwrap(wrapped, c.contentKeys.identities)
+	if err != nil {
+		return nil, fmt.Errorf("recovery point %s: %w", rpID, err)
+	}
+	encryptor, err := NewKeyEncryptor(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	restore := *c
+	restore.encryptor = encryptor
+	return &restore, nil
+}
+
+// RewrapContentKeys wraps the content key stored with recovery point rpID of
+// machine mcID, unwrapped by the identities of chunk_encryption_identities, to
+// recipients in place of the recipients it was stored for. Only keys.json is
+// rewritten, the chunks are left as they are. It reports false for a recovery
+// point stored without wrapped keys, which is left as is.
+func (c *Client) RewrapContentKeys(ctx context.Context, storageVault storage_vault.StorageVault, mcID, rpID string, recipients []keys.Recipient) (bool, error) {
+	if c.contentKeys == nil || len(c.contentKeys.identities) == 0 {
+		return false, fmt.Errorf("%w: rewrapping keys needs chunk_encryption_identities", ErrorInvalidConfig)
+	}
+	if len(recipients) == 0 {
+		return false, fmt.Errorf("%w: no recipient to wrap keys to", ErrorInvalidConfig)
+	}
+	key := contentKeysKey(mcID, rpID)
+	exists, _, err := storageVault.HeadObject(ctx, key)
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+	if !exists {
+		return false, nil
+	}
+	buf, err := c.GetObject(ctx, storageVault, key, nil)
+	if err != nil {
+		return false, err
+	}
+	var wrapped []*keys.WrappedKey
+	if err := json.Unmarshal(buf, &wrapped); err != nil {
+		return false, err
+	}
+	contentKey, err := keys.Unwrap(wrapped, c.contentKeys.identities)
+	if err != nil {
+		return false, fmt.Errorf("recovery point %s: %w", rpID, err)
+	}
+	if wrapped, err = keys.Wrap(contentKey, recipients); err != nil {
+		return false, err
+	}
+	if buf, err = json.Marshal(wrapped); err != nil {
+		return false, err
+	}
+	return true, c.PutObject(ctx, storageVault, key, buf)
+}
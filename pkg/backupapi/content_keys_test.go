@@ -0,0 +1,170 @@
+package backupapi
+
+import (
+	"context"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/keys"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+func TestContentKeysFromConfig(t *testing.T) {
+	defer viper.Set("chunk_encryption_recipients", nil)
+	defer viper.Set("chunk_encryption_identities", nil)
+	defer viper.Set("chunk_encryption_passphrase", nil)
+
+	k, err := ContentKeysFromConfig()
+	require.NoError(t, err)
+	assert.Nil(t, k)
+
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	viper.Set("chunk_encryption_recipients", []string{id.Recipient().String()})
+	_, err = ContentKeysFromConfig()
+	assert.ErrorIs(t, err, ErrorInvalidConfig, "recipients need the passphrase")
+
+	viper.Set("chunk_encryption_passphrase", "passphrase")
+	k, err = ContentKeysFromConfig()
+	require.NoError(t, err)
+	assert.Equal(t, ContentKey("passphrase"), k.key)
+	assert.Len(t, k.recipients, 1)
+
+	viper.Set("chunk_encryption_recipients", []string{"ssh-ed25519 AAAA"})
+	_, err = ContentKeysFromConfig()
+	assert.ErrorIs(t, err, ErrorInvalidConfig)
+
+	viper.Set("chunk_encryption_recipients", nil)
+	viper.Set("chunk_encryption_identities", []string{id.String()})
+	k, err = ContentKeysFromConfig()
+	require.NoError(t, err)
+	assert.Len(t, k.identities, 1)
+	viper.Set("chunk_encryption_identities", []string{"AGE-SECRET-KEY-1BAD"})
+	_, err = ContentKeysFromConfig()
+	assert.ErrorIs(t, err, ErrorInvalidConfig)
+}
+
+func TestClient_RestoreClient(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipient, err := keys.ParseRecipient(alice.Recipient().String(), nil)
+	require.NoError(t, err)
+
+	// A backup with the passphrase stores the content key wrapped to alice.
+	encryptor, err := NewEncryptor("passphrase")
+	require.NoError(t, err)
+	backup := *client
+	backup.encryptor = encryptor
+	backup.contentKeys = &ContentKeys{key: ContentKey("passphrase"), recipients: []keys.Recipient{recipient}}
+	vault := memory.New("vault", "")
+	require.NoError(t, backup.PutContentKeys(context.Background(), vault, "mc", "rp1"))
+	assert.Contains(t, vault.Keys(), "mc/rp1/"+ContentKeysName)
+	data := []byte("hello world")
+	blob, err := backup.sealChunk(data)
+	require.NoError(t, err)
+
+	// Alice restores without the passphrase.
+	restore := *client
+	restore.contentKeys = &ContentKeys{identities: []keys.Identity{mustIdentity(t, bob), mustIdentity(t, alice)}}
+	rc, err := restore.RestoreClient(context.Background(), vault, "mc", "rp1", nil)
+	require.NoError(t, err)
+	got, err := rc.openChunk(chunkKey(blob), blob)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	assert.Nil(t, restore.encryptor, "the client restoring is a copy")
+
+	// Bob can not.
+	restore.contentKeys = &ContentKeys{identities: []keys.Identity{mustIdentity(t, bob)}}
+	_, err = restore.RestoreClient(context.Background(), vault, "mc", "rp1", nil)
+	assert.ErrorIs(t, err, keys.ErrorNoIdentity)
+
+	// A recovery point stored without wrapped keys is restored as configured.
+	rc, err = restore.RestoreClient(context.Background(), vault, "mc", "rp2", nil)
+	require.NoError(t, err)
+	assert.Same(t, &restore, rc)
+
+	// Nothing is stored without recipients.
+	plain := *client
+	require.NoError(t, plain.PutContentKeys(context.Background(), vault, "mc", "rp2"))
+	assert.NotContains(t, vault.Keys(), "mc/rp2/"+ContentKeysName)
+}
+
+func TestClient_RewrapContentKeys(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	alice, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	bob, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipients, err := ParseRecipients([]string{alice.Recipient().String()})
+	require.NoError(t, err)
+
+	// A recovery point stored under a former passphrase, wrapped to alice.
+	encryptor, err := NewEncryptor("former")
+	require.NoError(t, err)
+	backup := *client
+	backup.encryptor = encryptor
+	backup.contentKeys = &ContentKeys{key: ContentKey("former"), recipients: recipients}
+	vault := memory.New("vault", "")
+	require.NoError(t, backup.PutContentKeys(context.Background(), vault, "mc", "rp1"))
+	data := []byte("hello world")
+	blob, err := backup.sealChunk(data)
+	require.NoError(t, err)
+	require.NoError(t, vault.PutObject(context.Background(), chunkKey(blob), blob))
+
+	restores := func(id *age.X25519Identity) error {
+		restore := *client
+		restore.contentKeys = &ContentKeys{identities: []keys.Identity{mustIdentity(t, id)}}
+		rc, err := restore.RestoreClient(context.Background(), vault, "mc", "rp1", nil)
+		if err != nil {
+			return err
+		}
+		stored, err := vault.GetObject(context.Background(), chunkKey(blob))
+		require.NoError(t, err)
+		got, err := rc.openChunk(chunkKey(blob), stored)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+		return nil
+	}
+	require.NoError(t, restores(alice))
+	assert.ErrorIs(t, restores(bob), keys.ErrorNoIdentity)
+
+	// Alice rewraps the key to bob, without the passphrase.
+	rewrap := *client
+	rewrap.contentKeys = &ContentKeys{identities: []keys.Identity{mustIdentity(t, alice)}}
+	recipients, err = ParseRecipients([]string{bob.Recipient().String()})
+	require.NoError(t, err)
+	rewrapped, err := rewrap.RewrapContentKeys(context.Background(), vault, "mc", "rp1", recipients)
+	require.NoError(t, err)
+	assert.True(t, rewrapped)
+	require.NoError(t, restores(bob))
+	assert.ErrorIs(t, restores(alice), keys.ErrorNoIdentity)
+	stored, err := vault.GetObject(context.Background(), chunkKey(blob))
+	require.NoError(t, err)
+	assert.Equal(t, blob, stored, "chunks are left as they are")
+
+	// Alice can not rewrap it again, a recovery point without keys is skipped.
+	_, err = rewrap.RewrapContentKeys(context.Background(), vault, "mc", "rp1", recipients)
+	assert.ErrorIs(t, err, keys.ErrorNoIdentity)
+	rewrapped, err = rewrap.RewrapContentKeys(context.Background(), vault, "mc", "rp2", recipients)
+	require.NoError(t, err)
+	assert.False(t, rewrapped)
+	_, err = rewrap.RewrapContentKeys(context.Background(), vault, "mc", "rp1", nil)
+	assert.ErrorIs(t, err, ErrorInvalidConfig)
+}
+
+func mustIdentity(t *testing.T, id *age.X25519Identity) keys.Identity {
+	identity, err := keys.ParseIdentity(id.String())
+	require.NoError(t, err)
+	return identity
+}
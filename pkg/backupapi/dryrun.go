@@ -0,0 +1,33 @@
+package backupapi
+
+import (
+	"context"
+	"errors"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// A dry run, with dry_run set, chunks the files a backup would upload and
+// reports through progress the bytes of the chunks which would be uploaded,
+// of the files changed and of the files unchanged. Nothing is uploaded, and
+// neither the chunks nor the files are recorded in any cache, so that a later
+// backup does not take them for stored.
+
+// chunkStored reports whether storageVault holds data under key, with
+// VerifyObject when the vault supports it and HeadObject otherwise.
+func chunkStored(ctx context.Context, storageVault storage_vault.StorageVault, key string, data []byte) (bool, error) {
+	if verifier, ok := storageVault.(storage_vault.ObjectVerifier); ok {
+		exists, integrity, _, err := verifier.VerifyObject(ctx, key, data)
+		if err == nil {
+			return exists && integrity, nil
+		}
+		if !errors.Is(err, storage_vault.ErrNotSupported) {
+			return false, err
+		}
+	}
+	exists, _, err := storageVault.HeadObject(ctx, key)
+	if err != nil && !isNotFound(err) {
+		return false, err
+	}
+	return exists, nil
+}
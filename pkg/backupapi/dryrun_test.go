@@ -0,0 +1,117 @@
+package backupapi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/budget"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/cooldown"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/naming"
+)
+
+func TestClient_UploadFileDryRun(t *testing.T) {
+	setUp()
+	defer tearDown()
+	viper.Set("dry_run", true)
+	defer viper.Set("dry_run", nil)
+
+	pool, err := ants.NewPool(2)
+	require.NoError(t, err)
+	defer pool.Release()
+	hostIndex, err := cache.LoadHostIndex(t.TempDir())
+	require.NoError(t, err)
+	client.hostIndex = hostIndex
+	defer func() { client.hostIndex = nil }()
+
+	dir := t.TempDir()
+	mtime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	write := func(name, content string) *cache.Node {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+		return &cache.Node{Type: "file", AbsolutePath: path, ModTime: mtime, Size: uint64(len(content))}
+	}
+	stored := write("stored", "already in the vault")
+	added := write("added", "not in the vault yet")
+	same := write("same", "as in the last backup")
+	last := &cache.Node{AbsolutePath: same.AbsolutePath, ModTime: mtime, Size: same.Size,
+		Content: []*cache.ChunkInfo{{Length: uint(same.Size), Etag: "etag"}}}
+
+	vault := memory.New("vault", "")
+	require.NoError(t, vault.PutObject(context.Background(), chunkKey([]byte("already in the vault")), []byte("already in the vault")))
+	p := progress.NewProgress(time.Hour)
+	p.Start()
+	defer p.Done()
+	pipe := make(chan *cache.Chunk, 4)
+
+	for _, tt := range []struct{ item, last *cache.Node }{{stored, nil}, {added, nil}, {same, last}} {
+		size, err := client.UploadFile(context.Background(), pool, tt.last, tt.item, nil, vault, p, pipe, "rp", "bd", StableCheck{}, nil, cache.Chunking{}, "", nil, "")
+		require.NoError(t, err)
+		assert.LessOrEqual(t, size, tt.item.Size)
+	}
+
+	stat := p.Current()
+	assert.Equal(t, added.Size, stat.NewBytes)
+	assert.Equal(t, stored.Size+added.Size, stat.ChangedBytes)
+	assert.Equal(t, same.Size, stat.UnchangedBytes)
+
+	// Nothing is uploaded nor recorded for a later backup.
+	assert.Len(t, vault.Keys(), 1)
+	assert.Empty(t, pipe)
+	_, ok := hostIndex.Lookup("vault", added.AbsolutePath, mtime, added.Size)
+	assert.False(t, ok)
+	assert.Equal(t, last.Content, same.Content)
+}
+
+func TestChunkStored(t *testing.T) {
+	vault := memory.New("vault", "")
+	data := []byte("hello world")
+	key := chunkKey(data)
+
+	ok, err := chunkStored(context.Background(), vault, key, data)
+	require.NoError(t, err)
+	assert.False(t, ok)
+
+	require.NoError(t, vault.PutObject(context.Background(), key, data))
+	ok, err = chunkStored(context.Background(), vault, key, data)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// A vault which can not verify objects is asked with HeadObject.
+	ok, err = chunkStored(context.Background(), plainVault{vault}, key, data)
+	require.NoError(t, err)
+	assert.True(t, ok)
+}
+
+func TestChunkStoredWrapped(t *testing.T) {
+	// The wrappers of a storage vault as built for a backup.
+	inner := memory.New("vault", "")
+	counted := budget.New(cooldown.New(inner, cooldown.NewGate(0.5, time.Second, zap.NewNop())), 0)
+	vault, err := naming.New(counted, []byte("secret"), true, false)
+	require.NoError(t, err)
+	data := []byte("hello world")
+	key := chunkKey(data)
+
+	require.NoError(t, vault.PutObject(context.Background(), key, data))
+	ok, err := chunkStored(context.Background(), vault, key, data)
+	require.NoError(t, err)
+	assert.True(t, ok)
+
+	// The content of the chunk is checked, not only that it exists.
+	require.NoError(t, inner.PutObject(context.Background(), vault.ObjectName(key), []byte("corrupt")))
+	ok, err = chunkStored(context.Background(), vault, key, data)
+	require.NoError(t, err)
+	assert.False(t, ok)
+}
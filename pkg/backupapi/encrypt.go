@@ -0,0 +1,131 @@
+package backupapi
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Encryptor encrypts chunks before they are stored, and decrypts them once
+// read back.
+type Encryptor interface {
+	Encrypt(plaintext []byte) ([]byte, error)
+	Decrypt(blob []byte) ([]byte, error)
+}
+
+// ErrorChunkDecrypt is returned for a chunk which is too short, tampered with,
+// or encrypted under another passphrase.
+var ErrorChunkDecrypt = errors.New("chunk decryption failed")
+
+const (
+	// chunkKeySalt is fixed, so that every agent sharing the passphrase
+	// derives the same key and deduplicates the same chunks.
+	chunkKeySalt       = "bizfly-backup chunk encryption"
+	chunkKeyIterations = 200000
+	chunkNonceLabel    = "bizfly-backup chunk nonce"
+)
+
+// chunkHeader prefixes encrypted chunks, followed by the nonce.
+var chunkHeader = []byte("BZBKCHK1")
+
+// gcmEncryptor encrypts with AES-256-GCM. The nonce is the HMAC of the
+// plaintext under a key of its own, so a chunk always encrypts to the same
+// blob and is stored once under the MD5 of that blob.
+type gcmEncryptor struct {
+	aead     cipher.AEAD
+	nonceKey []byte
+}
+
+// NewEncryptor returns an AES-256-GCM Encryptor keyed by passphrase.
+func NewEncryptor(passphrase string) (Encryptor, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("%w: empty chunk encryption passphrase", ErrorInvalidConfig)
+	}
+	return NewKeyEncryptor(ContentKey(passphrase))
+}
+
+// ContentKey returns the content key derived from passphrase, which chunks
+// are encrypted with.
+func ContentKey(passphrase string) []byte {
+	return pbkdf2.Key([]byte(passphrase), []byte(chunkKeySalt), chunkKeyIterations, 32, sha256.New)
+}
+
+// NewKeyEncryptor returns an AES-256-GCM Encryptor keyed by content key key,
+// as derived from a passphrase by ContentKey.
+func NewKeyEncryptor(key []byte) (Encryptor, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(chunkNonceLabel))
+	return &gcmEncryptor{aead: aead, nonceKey: mac.Sum(nil)}, nil
+}
+
+// EncryptorFromConfig returns the Encryptor of chunk_encryption_passphrase,
+// nil when it is not set.
+func EncryptorFromConfig() (Encryptor, error) {
+	passphrase := viper.GetString("chunk_encryption_passphrase")
+	if passphrase == "" {
+		return nil, nil
+	}
+	return NewEncryptor(passphrase)
+}
+
+func (e *gcmEncryptor) Encrypt(plaintext []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, e.nonceKey)
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:e.aead.NonceSize()]
+	out := make([]byte, 0, len(chunkHeader)+len(nonce)+len(plaintext)+e.aead.Overhead())
+	out = append(append(out, chunkHeader...), nonce...)
+	return e.aead.Seal(out, nonce, plaintext, chunkHeader), nil
+}
+
+func (e *gcmEncryptor) Decrypt(blob []byte) ([]byte, error) {
+	if !bytes.HasPrefix(blob, chunkHeader) || len(blob) < len(chunkHeader)+e.aead.NonceSize()+e.aead.Overhead() {
+		return nil, ErrorChunkDecrypt
+	}
+	blob = blob[len(chunkHeader):]
+	plaintext, err := e.aead.Open(nil, blob[:e.aead.NonceSize()], blob[e.aead.NonceSize():], chunkHeader)
+	if err != nil {
+		return nil, ErrorChunkDecrypt
+	}
+	return plaintext, nil
+}
+
+// sealChunk returns data as it is to be stored, encrypted when the client has
+// an Encryptor.
+func (c *Client) sealChunk(data []byte) ([]byte, error) {
+	if c.encryptor == nil {
+		return data, nil
+	}
+	return c.encryptor.Encrypt(data)
+}
+
+// openChunk returns the content of the chunk stored as blob under key. A chunk
+// stored before encryption was enabled is returned as is, once checked to be
+// the content key addresses.
+func (c *Client) openChunk(key string, blob []byte) ([]byte, error) {
+	if c.encryptor == nil {
+		return blob, nil
+	}
+	if !bytes.HasPrefix(blob, chunkHeader) && chunkKeyMatches(key, blob) {
+		return blob, nil
+	}
+	data, err := c.encryptor.Decrypt(blob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, key)
+	}
+	return data, nil
+}
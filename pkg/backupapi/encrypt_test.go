@@ -0,0 +1,82 @@
+package backupapi
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptor(t *testing.T) {
+	e, err := NewEncryptor("passphrase")
+	require.NoError(t, err)
+	data := []byte("hello world")
+
+	blob, err := e.Encrypt(data)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(blob, data))
+	again, err := e.Encrypt(data)
+	require.NoError(t, err)
+	assert.Equal(t, blob, again, "a chunk always encrypts to the same blob")
+
+	got, err := e.Decrypt(blob)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	tampered := append([]byte(nil), blob...)
+	tampered[len(tampered)-1] ^= 1
+	_, err = e.Decrypt(tampered)
+	assert.ErrorIs(t, err, ErrorChunkDecrypt)
+	_, err = e.Decrypt(blob[:len(chunkHeader)+4])
+	assert.ErrorIs(t, err, ErrorChunkDecrypt)
+	_, err = e.Decrypt(data)
+	assert.ErrorIs(t, err, ErrorChunkDecrypt)
+
+	other, err := NewEncryptor("other")
+	require.NoError(t, err)
+	_, err = other.Decrypt(blob)
+	assert.ErrorIs(t, err, ErrorChunkDecrypt)
+
+	_, err = NewEncryptor("")
+	assert.ErrorIs(t, err, ErrorInvalidConfig)
+}
+
+func TestEncryptorFromConfig(t *testing.T) {
+	e, err := EncryptorFromConfig()
+	require.NoError(t, err)
+	assert.Nil(t, e)
+
+	viper.Set("chunk_encryption_passphrase", "passphrase")
+	defer viper.Set("chunk_encryption_passphrase", nil)
+	e, err = EncryptorFromConfig()
+	require.NoError(t, err)
+	assert.NotNil(t, e)
+}
+
+func TestClient_openChunk(t *testing.T) {
+	e, err := NewEncryptor("passphrase")
+	require.NoError(t, err)
+	c := &Client{encryptor: e}
+	data := []byte("hello world")
+
+	blob, err := c.sealChunk(data)
+	require.NoError(t, err)
+	got, err := c.openChunk(chunkKey(blob), blob)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// A chunk stored before encryption was enabled is read as is, unless it
+	// is not the content of its key.
+	got, err = c.openChunk(chunkKey(data), data)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	_, err = c.openChunk(chunkKey(data), []byte("swapped"))
+	assert.ErrorIs(t, err, ErrorChunkDecrypt)
+
+	plain := &Client{}
+	got, err = plain.sealChunk(data)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+}
@@ -0,0 +1,209 @@
+package backupapi
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// IgnoreFile is the file at the root of a backup directory listing the
+// patterns of the items left out of its backups, after those of exclude.
+const IgnoreFile = ".bizflyignore"
+
+// Excluder leaves items of a backup directory out of its backups with
+// gitignore-style patterns. The last pattern matching an item decides,
+// patterns starting with ! include it again. With include patterns, only the
+// files they match are kept, unless excluded: excludes take precedence.
+// A nil Excluder excludes nothing.
+type Excluder struct {
+	patterns []excludePattern
+	includes []excludePattern
+}
+
+type excludePattern struct {
+	segments []string
+	negate   bool
+	dirOnly  bool
+}
+
+// NewExcluder returns the Excluder of patterns. Blank patterns and those
+// starting with # are ignored.
+func NewExcluder(patterns []string) (*Excluder, error) {
+	parsed, err := parseExcludePatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return &Excluder{patterns: parsed}, nil
+}
+
+// WithIncludes returns a copy of e keeping only the files matched by patterns,
+// or in a directory they match, when there is any. Directories are always
+// walked, so that the files under them can be matched.
+func (e *Excluder) WithIncludes(patterns []string) (*Excluder, error) {
+	parsed, err := parseExcludePatterns(patterns)
+	if err != nil {
+		return nil, err
+	}
+	out := &Excluder{includes: parsed}
+	if e != nil {
+		out.patterns = e.patterns
+	}
+	return out, nil
+}
+
+func parseExcludePatterns(lines []string) ([]excludePattern, error) {
+	var patterns []excludePattern
+	for _, line := range lines {
+		p, ok, err := parseExcludePattern(line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns, nil
+}
+
+// ExcluderFromConfig returns the Excluder of the patterns of exclude followed
+// by those of the IgnoreFile under root, when there is one, keeping only the
+// files matched by include when it is set.
+func ExcluderFromConfig(root string) (*Excluder, error) {
+	patterns := viper.GetStringSlice("exclude")
+	file, err := os.Open(filepath.Join(root, IgnoreFile))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+	case err != nil:
+		return nil, err
+	default:
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			patterns = append(patterns, scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	e, err := NewExcluder(patterns)
+	if err != nil {
+		return nil, err
+	}
+	return e.WithIncludes(viper.GetStringSlice("include"))
+}
+
+// parseExcludePattern parses a line of gitignore syntax. A pattern with a
+// slash before its end is anchored at the root, others match at any depth; a
+// trailing slash matches directories only.
+func parseExcludePattern(line string) (excludePattern, bool, error) {
+	var p excludePattern
+	s := strings.TrimSpace(line)
+	if s == "" || strings.HasPrefix(s, "#") {
+		return p, false, nil
+	}
+	if strings.HasPrefix(s, "!") {
+		p.negate = true
+		s = s[1:]
+	} else if strings.HasPrefix(s, `\!`) || strings.HasPrefix(s, `\#`) {
+		s = s[1:]
+	}
+	if strings.HasSuffix(s, "/") {
+		p.dirOnly = true
+		s = strings.TrimRight(s, "/")
+	}
+	anchored := strings.Contains(s, "/")
+	s = strings.TrimPrefix(s, "/")
+	if s == "" {
+		return p, false, fmt.Errorf("%w: exclude pattern %q", ErrorInvalidConfig, line)
+	}
+	p.segments = strings.Split(s, "/")
+	for _, segment := range p.segments {
+		if _, err := path.Match(segment, ""); segment == "" || err != nil {
+			return p, false, fmt.Errorf("%w: exclude pattern %q", ErrorInvalidConfig, line)
+		}
+	}
+	if !anchored {
+		p.segments = append([]string{"**"}, p.segments...)
+	}
+	return p, true, nil
+}
+
+// ShouldExclude reports whether the item at relPath, relative to the root of
+// the backup directory, is left out. An item under an excluded directory is
+// left out with it, as in gitignore. With include patterns, a file is also
+// left out unless it or a directory above it is matched by them.
+func (e *Excluder) ShouldExclude(relPath string, isDir bool) bool {
+	if e == nil || len(e.patterns) == 0 && len(e.includes) == 0 {
+		return false
+	}
+	rel := strings.Trim(path.Clean(filepath.ToSlash(relPath)), "/")
+	if rel == "" || rel == "." {
+		return false
+	}
+	parts := strings.Split(rel, "/")
+	if matchesTree(e.patterns, parts, isDir) {
+		return true
+	}
+	return len(e.includes) > 0 && !isDir && !matchesTree(e.includes, parts, isDir)
+}
+
+// matchesTree reports whether patterns match the item at parts or one of the
+// directories above it.
+func matchesTree(patterns []excludePattern, parts []string, isDir bool) bool {
+	for i := 1; i < len(parts); i++ {
+		if matchesLast(patterns, parts[:i], true) {
+			return true
+		}
+	}
+	return matchesLast(patterns, parts, isDir)
+}
+
+// matchesLast reports whether the last of patterns matching the item at parts
+// is not negated.
+func matchesLast(patterns []excludePattern, parts []string, isDir bool) bool {
+	matched := false
+	for _, p := range patterns {
+		if p.dirOnly && !isDir {
+			continue
+		}
+		// Only a pattern which would change the outcome is matched.
+		if p.negate == matched && matchSegments(p.segments, parts) {
+			matched = !p.negate
+		}
+	}
+	return matched
+}
+
+// matchSegments matches the path elements parts against pattern, where **
+// stands for any number of elements, at least one when it ends pattern.
+func matchSegments(pattern, parts []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			rest := pattern[1:]
+			if len(rest) == 0 {
+				return len(parts) > 0
+			}
+			for i := 0; i <= len(parts); i++ {
+				if matchSegments(rest, parts[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(parts) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], parts[0]); !ok {
+			return false
+		}
+		pattern, parts = pattern[1:], parts[1:]
+	}
+	return len(parts) == 0
+}
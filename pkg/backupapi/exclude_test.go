@@ -0,0 +1,129 @@
+package backupapi
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExcluder_ShouldExclude(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"no patterns", nil, "a.log", false, false},
+		{"basename at root", []string{"*.log"}, "a.log", false, true},
+		{"basename at any depth", []string{"*.log"}, "x/y/a.log", false, true},
+		{"no match", []string{"*.log"}, "a.txt", false, false},
+		{"comment", []string{"# *.log", ""}, "a.log", false, false},
+		{"anchored", []string{"/build"}, "build", true, true},
+		{"anchored not below root", []string{"/build"}, "src/build", true, false},
+		{"inner slash anchors", []string{"src/gen"}, "src/gen", true, true},
+		{"inner slash anchors not below root", []string{"src/gen"}, "x/src/gen", true, false},
+		{"dir only on dir", []string{"node_modules/"}, "a/node_modules", true, true},
+		{"dir only on file", []string{"node_modules/"}, "a/node_modules", false, false},
+		{"content of excluded dir", []string{"node_modules/"}, "a/node_modules/pkg/index.js", false, true},
+		{"leading double star", []string{"**/tmp"}, "a/b/tmp", true, true},
+		{"trailing double star", []string{"cache/**"}, "cache/a/b", false, true},
+		{"trailing double star not the dir", []string{"cache/**"}, "cache", true, false},
+		{"middle double star", []string{"a/**/z.txt"}, "a/z.txt", false, true},
+		{"middle double star deep", []string{"a/**/z.txt"}, "a/b/c/z.txt", false, true},
+		{"middle double star elsewhere", []string{"a/**/z.txt"}, "b/a/z.txt", false, false},
+		{"negation", []string{"*.log", "!keep.log"}, "keep.log", false, false},
+		{"negation other file", []string{"*.log", "!keep.log"}, "drop.log", false, true},
+		{"last pattern wins", []string{"*.log", "!keep.log", "keep.*"}, "keep.log", false, true},
+		{"negation before pattern", []string{"!keep.log", "*.log"}, "keep.log", false, true},
+		{"no negation under excluded dir", []string{"logs/", "!logs/keep.log"}, "logs/keep.log", false, true},
+		{"negated dir", []string{"build/", "!src/build/"}, "src/build/out", false, false},
+		{"escaped bang", []string{`\!important`}, "!important", false, true},
+		{"windows separators", []string{"a/b"}, filepath.Join("a", "b"), false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewExcluder(tt.patterns)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, e.ShouldExclude(tt.path, tt.isDir))
+		})
+	}
+
+	var none *Excluder
+	assert.False(t, none.ShouldExclude("a.log", false))
+}
+
+func TestExcluder_ShouldExcludeIncludes(t *testing.T) {
+	tests := []struct {
+		name     string
+		includes []string
+		excludes []string
+		path     string
+		isDir    bool
+		want     bool
+	}{
+		{"included", []string{"*.conf", "*.sql"}, nil, "etc/app.conf", false, false},
+		{"not included", []string{"*.conf", "*.sql"}, nil, "etc/app.log", false, true},
+		{"dirs are walked", []string{"*.conf"}, nil, "etc", true, false},
+		{"included dir", []string{"/etc/"}, nil, "etc/app/app.log", false, false},
+		{"anchored include", []string{"/etc/*.conf"}, nil, "opt/etc/app.conf", false, true},
+		{"negated include", []string{"*.conf", "!sample.conf"}, nil, "sample.conf", false, true},
+		{"exclude wins over include", []string{"*.sql"}, []string{"dump.sql"}, "db/dump.sql", false, true},
+		{"exclude wins over included dir", []string{"/etc/"}, []string{"*.bak"}, "etc/app.conf.bak", false, true},
+		{"excluded dir wins over include", []string{"*.conf"}, []string{"vendor/"}, "vendor/x/app.conf", false, true},
+		{"excluded dir is not walked", []string{"*.conf"}, []string{"vendor/"}, "vendor", true, true},
+		{"negated exclude keeps include", []string{"*.sql"}, []string{"*.sql", "!keep.sql"}, "keep.sql", false, false},
+		{"negated exclude does not include", []string{"*.sql"}, []string{"*.txt", "!keep.txt"}, "keep.txt", false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := NewExcluder(tt.excludes)
+			require.NoError(t, err)
+			e, err = e.WithIncludes(tt.includes)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, e.ShouldExclude(tt.path, tt.isDir))
+		})
+	}
+
+	var none *Excluder
+	e, err := none.WithIncludes(nil)
+	require.NoError(t, err)
+	assert.False(t, e.ShouldExclude("a.log", false), "no include pattern keeps everything")
+	_, err = none.WithIncludes([]string{"[a"})
+	assert.ErrorIs(t, err, ErrorInvalidConfig)
+}
+
+func TestNewExcluderInvalid(t *testing.T) {
+	for _, pattern := range []string{"[a", "/", "a//b", "!"} {
+		_, err := NewExcluder([]string{pattern})
+		assert.ErrorIs(t, err, ErrorInvalidConfig, pattern)
+	}
+}
+
+func TestExcluderFromConfig(t *testing.T) {
+	root := t.TempDir()
+	e, err := ExcluderFromConfig(root)
+	require.NoError(t, err)
+	assert.False(t, e.ShouldExclude("a.log", false))
+
+	viper.Set("exclude", []string{"*.log"})
+	defer viper.Set("exclude", nil)
+	require.NoError(t, os.WriteFile(filepath.Join(root, IgnoreFile), []byte("# keep the important log\n!important.log\n"), 0600))
+	e, err = ExcluderFromConfig(root)
+	require.NoError(t, err)
+	assert.True(t, e.ShouldExclude("a.log", false))
+	assert.False(t, e.ShouldExclude("important.log", false))
+
+	viper.Set("include", []string{"*.log", "*.conf"})
+	defer viper.Set("include", nil)
+	e, err = ExcluderFromConfig(root)
+	require.NoError(t, err)
+	assert.False(t, e.ShouldExclude("important.log", false))
+	assert.False(t, e.ShouldExclude("app.conf", false))
+	assert.True(t, e.ShouldExclude("app.txt", false))
+	assert.True(t, e.ShouldExclude("a.log", false))
+}
@@ -0,0 +1,218 @@
+package backupapi
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+
+	"go.uber.org/zap"
+)
+
+const (
+	exportManifestName = "manifest.json"
+	exportIndexName    = "index.json"
+	exportChunkDir     = "chunks"
+	exportVersion      = 2
+)
+
+var (
+	ErrorInvalidExport   = errors.New("invalid recovery point export")
+	ErrorExportIntegrity = errors.New("recovery point export integrity check failed")
+)
+
+// ExportManifest is the first entry of a recovery point export and lists
+// everything the archive must contain.
+type ExportManifest struct {
+	Version           int               `json:"version"`
+	MachineID         string            `json:"machine_id"`
+	BackupDirectoryID string            `json:"backup_directory_id"`
+	RecoveryPointID   string            `json:"recovery_point_id"`
+	IndexSha256       string            `json:"index_sha256"`
+	Chunks            map[string]uint64 `json:"chunks"`
+	CreatedAt         time.Time         `json:"created_at"`
+}
+
+// ExportRecoveryPoint writes index and every chunk it references to w as a
+// single tar archive: the manifest, the index, the checksums of its files, then
+// one entry per chunk key.
+func (c *Client) ExportRecoveryPoint(ctx context.Context, index cache.Index, storageVault storage_vault.StorageVault, w io.Writer) error {
+	indexBuf, err := json.Marshal(index)
+	if err != nil {
+		return err
+	}
+	indexHash := sha256.Sum256(indexBuf)
+
+	manifest := ExportManifest{
+		Version:           exportVersion,
+		MachineID:         c.Id,
+		BackupDirectoryID: index.BackupDirectoryID,
+		RecoveryPointID:   index.RecoveryPointID,
+		IndexSha256:       hex.EncodeToString(indexHash[:]),
+		Chunks:            make(map[string]uint64),
+		CreatedAt:         time.Now().UTC(),
+	}
+	for _, item := range index.Items {
+		for _, chunk := range item.Content {
+			manifest.Chunks[chunk.Etag] = uint64(chunk.Length)
+		}
+	}
+	manifestBuf, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeTarEntry(tw, exportManifestName, manifestBuf); err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, exportIndexName, indexBuf); err != nil {
+		return err
+	}
+	var sums bytes.Buffer
+	if _, err := WriteChecksums(&sums, index, ""); err != nil {
+		return err
+	}
+	if err := writeTarEntry(tw, ChecksumManifestName, sums.Bytes()); err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(manifest.Chunks))
+	for key := range manifest.Chunks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		select {
+		case <-ctx.Done():
+			return ErrorGotCancelRequest
+		default:
+		}
+		data, err := storageVault.GetObject(ctx, key)
+		if err != nil {
+			c.logger.Error("err get chunk for export ", zap.Error(err), zap.String("key", key))
+			return err
+		}
+		if err := writeTarEntry(tw, path.Join(exportChunkDir, key), data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// ImportRecoveryPoint reads an archive written by ExportRecoveryPoint and
+// stores its chunks and index in destVault. Every chunk is checked against its
+// content address and the index against the manifest before being stored.
+func (c *Client) ImportRecoveryPoint(ctx context.Context, r io.Reader, destVault storage_vault.StorageVault) (*ExportManifest, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorInvalidExport, err)
+	}
+	if hdr.Name != exportManifestName {
+		return nil, fmt.Errorf("%w: first entry is %s", ErrorInvalidExport, hdr.Name)
+	}
+	var manifest ExportManifest
+	if err := json.NewDecoder(tr).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrorInvalidExport, err)
+	}
+	// Version 1 exports have no checksums, they are read the same way.
+	if manifest.Version < 1 || manifest.Version > exportVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrorInvalidExport, manifest.Version)
+	}
+
+	var indexBuf []byte
+	imported := make(map[string]bool, len(manifest.Chunks))
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ErrorGotCancelRequest
+		default:
+		}
+
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrorInvalidExport, err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		if hdr.Name == exportIndexName {
+			hash := sha256.Sum256(data)
+			if hex.EncodeToString(hash[:]) != manifest.IndexSha256 {
+				return nil, fmt.Errorf("%w: index hash mismatch", ErrorExportIntegrity)
+			}
+			indexBuf = data
+			continue
+		}
+		if hdr.Name == ChecksumManifestName {
+			continue
+		}
+
+		dir, key := path.Split(hdr.Name)
+		if _, ok := manifest.Chunks[key]; path.Clean(dir) != exportChunkDir || !ok {
+			return nil, fmt.Errorf("%w: unexpected entry %s", ErrorInvalidExport, hdr.Name)
+		}
+		// The manifest records the length of the content of a chunk, which
+		// is not the one stored when it is compressed or encrypted.
+		if !chunkKeyMatches(key, data) {
+			return nil, fmt.Errorf("%w: chunk %s", ErrorExportIntegrity, key)
+		}
+		if err := c.PutObject(ctx, destVault, key, data); err != nil {
+			c.logger.Error("err put chunk for import ", zap.Error(err), zap.String("key", key))
+			return nil, err
+		}
+		imported[key] = true
+	}
+
+	if indexBuf == nil {
+		return nil, fmt.Errorf("%w: missing %s", ErrorInvalidExport, exportIndexName)
+	}
+	for key := range manifest.Chunks {
+		if !imported[key] {
+			return nil, fmt.Errorf("%w: missing chunk %s", ErrorInvalidExport, key)
+		}
+	}
+
+	// The index goes last so that an interrupted import never leaves an index
+	// pointing at missing chunks.
+	indexKey := path.Join(manifest.MachineID, manifest.RecoveryPointID, exportIndexName)
+	if err := c.PutObject(ctx, destVault, indexKey, indexBuf); err != nil {
+		c.logger.Error("err put index for import ", zap.Error(err), zap.String("key", indexKey))
+		return nil, err
+	}
+	return &manifest, nil
+}
+
+func writeTarEntry(tw *tar.Writer, name string, data []byte) error {
+	hdr := &tar.Header{
+		Name:     name,
+		Mode:     0600,
+		Size:     int64(len(data)),
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Now(),
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
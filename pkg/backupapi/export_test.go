@@ -0,0 +1,84 @@
+package backupapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func exportFixture(parts ...string) (*memory.Memory, *cache.Index) {
+	vault := memory.New("vault", "")
+	index := cache.NewIndex("bd", "rp")
+	node := &cache.Node{Type: "file", RelativePath: "data/file.txt"}
+	var start uint
+	for _, part := range parts {
+		hash := md5.Sum([]byte(part))
+		key := hex.EncodeToString(hash[:])
+		_ = vault.PutObject(context.Background(), key, []byte(part))
+		node.Content = append(node.Content, &cache.ChunkInfo{Start: start, Length: uint(len(part)), Etag: key})
+		start += uint(len(part))
+	}
+	node.Size = uint64(start)
+	index.Items["/data/file.txt"] = node
+	return vault, index
+}
+
+func TestClient_ExportImportRecoveryPoint(t *testing.T) {
+	setUp()
+	defer tearDown()
+	client.Id = "machine"
+
+	src, index := exportFixture("hello ", "world", "hello ")
+	var buf bytes.Buffer
+	require.NoError(t, client.ExportRecoveryPoint(context.Background(), *index, src, &buf))
+
+	dest := memory.New("dest", "")
+	manifest, err := client.ImportRecoveryPoint(context.Background(), &buf, dest)
+	require.NoError(t, err)
+	assert.Equal(t, "rp", manifest.RecoveryPointID)
+	assert.Len(t, manifest.Chunks, 2)
+
+	for _, key := range src.Keys() {
+		want, _ := src.GetObject(context.Background(), key)
+		got, err := dest.GetObject(context.Background(), key)
+		require.NoError(t, err)
+		assert.Equal(t, want, got)
+	}
+	indexBuf, err := dest.GetObject(context.Background(), "machine/rp/index.json")
+	require.NoError(t, err)
+	var got cache.Index
+	require.NoError(t, json.Unmarshal(indexBuf, &got))
+	assert.Equal(t, index.Items["/data/file.txt"].Content, got.Items["/data/file.txt"].Content)
+}
+
+func TestClient_ImportRecoveryPointCorrupted(t *testing.T) {
+	setUp()
+	defer tearDown()
+	client.Id = "machine"
+
+	src, index := exportFixture("hello ", "world")
+	src.Corrupt(src.Keys()[0], []byte("corrupted"))
+	var buf bytes.Buffer
+	require.NoError(t, client.ExportRecoveryPoint(context.Background(), *index, src, &buf))
+
+	dest := memory.New("dest", "")
+	_, err := client.ImportRecoveryPoint(context.Background(), &buf, dest)
+	assert.ErrorIs(t, err, ErrorExportIntegrity)
+	assert.NotContains(t, dest.Keys(), "machine/rp/index.json")
+}
+
+func TestClient_ImportRecoveryPointInvalid(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	_, err := client.ImportRecoveryPoint(context.Background(), bytes.NewReader([]byte("not a tar")), memory.New("dest", ""))
+	assert.ErrorIs(t, err, ErrorInvalidExport)
+}
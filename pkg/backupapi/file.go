@@ -2,10 +2,8 @@ package backupapi
 
 import (
 	"context"
-	"crypto/md5"
-	"crypto/sha256"
-	"encoding/hex"
 	"errors"
+	"fmt"
 	"hash"
 	"io"
 	"io/fs"
@@ -13,15 +11,17 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/bizflycloud/bizfly-backup/pkg/cache"
 	"github.com/bizflycloud/bizfly-backup/pkg/progress"
 	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/chunkcache"
 	"github.com/bizflycloud/bizfly-backup/pkg/support"
 	"github.com/bizflycloud/bizfly-backup/pkg/vss"
 	"github.com/cenkalti/backoff"
@@ -39,12 +39,34 @@ const (
 	ChunkUploadLowerBound  = chunker.MaxSize
 	IntervalTimeRetryChunk = 30 * time.Second
 	MaxTimesRetryChunk     = 3
+	MaxTimesRetryOpenFile  = 5
+	DefaultMaxOpenFiles    = 256
 )
 
+// Values of chown_failure.
+const (
+	ChownFailureIgnore = "ignore"
+	ChownFailureWarn   = "warn"
+	ChownFailureError  = "error"
+)
+
+// restoreTempSuffix is the suffix of the temporary file an existing file is
+// restored to, before it is renamed over the file.
+const restoreTempSuffix = ".restore-*"
+
 var (
-	ErrorGotCancelRequest = errors.New("got cancel request")
+	ErrorGotCancelRequest  = errors.New("got cancel request")
+	ErrorSymlinkParent     = errors.New("refusing to restore through symlinked parent directory")
+	ErrorRestorePathEscape = errors.New("restore path escapes destination directory")
+	ErrorPanic             = errors.New("recovered from panic")
+	ErrorStripPrefix       = errors.New("strip prefix matches no item")
+	ErrorDeviceSize        = errors.New("device size mismatch")
 )
 
+func panicError(r interface{}) error {
+	return fmt.Errorf("%w: %v", ErrorPanic, r)
+}
+
 func (c *Client) urlStringFromRelPath(relPath string) (string, error) {
 	if c.ServerURL.Path != "" && c.ServerURL.Path != "/" {
 		relPath = path.Join(c.ServerURL.Path, relPath)
@@ -59,30 +81,86 @@ func (c *Client) urlStringFromRelPath(relPath string) (string, error) {
 	return u.String(), nil
 }
 
-func (c *Client) backupChunk(ctx context.Context, data []byte, chunk *cache.ChunkInfo, cacheWriter *cache.Repository, storageVault storage_vault.StorageVault, pipe chan<- *cache.Chunk, rpID, bdID string) (uint64, error) {
+// backupChunk stores data unless the vault has it already. A chunk uploaded
+// with a storage class is placed in it, the class is claimed for the chunk in
+// any case so that a chunk shared with a hotter file can be raised to it.
+// It also returns whether the chunk was uploaded, the vault not holding it:
+// a vault finding the chunk stored already, as S3 does, sends nothing. In a
+// dry run, nothing is stored and only the length of a chunk the vault
+// does not have is returned.
+func (c *Client) backupChunk(ctx context.Context, data []byte, chunk *cache.ChunkInfo, cacheWriter *cache.Repository, storageVault storage_vault.StorageVault, pipe chan<- *cache.Chunk, rpID, bdID, class string) (uint64, bool, error) {
 	select {
 	case <-ctx.Done():
-		return 0, ErrorGotCancelRequest
+		return 0, false, ErrorGotCancelRequest
 	default:
 		var stat uint64
 
-		hash := md5.Sum(data)
-		key := hex.EncodeToString(hash[:])
+		// Chunks are compressed, then encrypted, and addressed by the MD5 of
+		// what is stored.
+		codec, err := CompressionFromConfig()
+		if err != nil {
+			return stat, false, err
+		}
+		data, chunk.Codec, err = compressChunk(codec, data)
+		if err != nil {
+			return stat, false, err
+		}
+		data, err = c.sealChunk(data)
+		if err != nil {
+			return stat, false, err
+		}
+		key, stored, err := c.storeChunkKey(ctx, storageVault, data)
+		if err != nil {
+			c.logger.Error("err check chunk", zap.Error(err))
+			return stat, false, err
+		}
 		chunk.Etag = key
 
+		// A dry run only counts the chunks which would be uploaded.
+		if viper.GetBool("dry_run") {
+			if !stored {
+				if stored, err = chunkStored(ctx, storageVault, key, data); err != nil {
+					return stat, false, err
+				}
+			}
+			if !stored {
+				stat += uint64(chunk.Length)
+			}
+			return stat, !stored, nil
+		}
+
 		chunks := cache.NewChunk(bdID, rpID)
 		chunks.Chunks[key] = []string{strconv.Itoa(1), strconv.Itoa(int(chunk.Length))}
+		if class != "" {
+			chunks.Classes[key] = class
+		}
 
 		// Put object
-		err := c.PutObject(storageVault, key, data)
-		if err != nil {
-			c.logger.Error("err put object", zap.Error(err))
-			return stat, err
+		uploaded := false
+		if !stored {
+			_, place := storageVault.(storage_vault.ClassPlacer)
+			place = place && class != ""
+			putCtx, upload := storage_vault.WithUpload(ctx)
+			if place {
+				putCtx = storage_vault.WithClass(putCtx, class)
+			}
+			err = c.PutObject(putCtx, storageVault, key, data)
+			if err != nil && ctx.Err() != nil {
+				return stat, false, ErrorGotCancelRequest
+			}
+			if err != nil {
+				c.logger.Error("err put object", zap.Error(err))
+				return stat, false, err
+			}
+			uploaded = upload.Sent()
+			if place && uploaded {
+				chunks.Uploaded[key] = class
+			}
 		}
 
 		pipe <- chunks
 		stat += uint64(chunk.Length)
-		return stat, nil
+		return stat, uploaded, nil
 	}
 }
 
@@ -111,7 +189,7 @@ func (c *Client) OpenFile(ctx context.Context, path string) (io.ReadCloser, erro
 }
 
 func (c *Client) ChunkFileToBackup(ctx context.Context, pool *ants.Pool, itemInfo *cache.Node, cacheWriter *cache.Repository,
-	storageVault storage_vault.StorageVault, p *progress.Progress, pipe chan<- *cache.Chunk, rpID, bdID string) (uint64, error) {
+	storageVault storage_vault.StorageVault, p *progress.Progress, pipe chan<- *cache.Chunk, rpID, bdID string, chunking cache.Chunking, hashAlgo, class string) (uint64, error) {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 	select {
@@ -144,9 +222,13 @@ func (c *Client) ChunkFileToBackup(ctx context.Context, pool *ants.Pool, itemInf
 				}
 			}
 
-			chk := chunker.New(file, 0x3dea92648f6e83)
-			buf := make([]byte, ChunkUploadLowerBound)
-			fileHash = sha256.New()
+			chk, size := newChunker(file, chunking)
+			buf := make([]byte, size)
+			fileHash, err = newFileHash(hashAlgo)
+			if err != nil {
+				_ = file.Close()
+				return 0, err
+			}
 			for {
 				chunk, err = chk.Next(buf)
 				if err == io.EOF {
@@ -172,7 +254,7 @@ func (c *Client) ChunkFileToBackup(ctx context.Context, pool *ants.Pool, itemInf
 				fileHash.Write(temp)
 				itemInfo.Content = append(itemInfo.Content, &chunkToBackup)
 				wg.Add(1)
-				_ = pool.Submit(c.backupChunkJob(ctx, cancel, &wg, &errBackupChunk, &stat, temp, &chunkToBackup, cacheWriter, storageVault, p, pipe, rpID, bdID))
+				_ = pool.Submit(c.backupChunkJob(ctx, cancel, &wg, &errBackupChunk, &stat, temp, &chunkToBackup, cacheWriter, storageVault, p, pipe, rpID, bdID, class))
 			}
 
 			if err != nil && err != io.EOF {
@@ -197,7 +279,17 @@ func (c *Client) ChunkFileToBackup(ctx context.Context, pool *ants.Pool, itemInf
 			c.logger.Error("err backup chunk ", zap.Error(errBackupChunk))
 			return 0, errBackupChunk
 		}
+		if itemInfo.Type == "blockdev" {
+			var read uint64
+			for _, chunk := range itemInfo.Content {
+				read += uint64(chunk.Length)
+			}
+			if read != itemInfo.Size {
+				return 0, fmt.Errorf("%w: read %d bytes of %s, expected %d", ErrorDeviceSize, read, itemInfo.AbsolutePath, itemInfo.Size)
+			}
+		}
 		itemInfo.Sha256Hash = fileHash.Sum(nil)
+		itemInfo.HashAlgo = hashAlgo
 		return stat, nil
 	}
 }
@@ -205,18 +297,27 @@ func (c *Client) ChunkFileToBackup(ctx context.Context, pool *ants.Pool, itemInf
 type chunkJob func()
 
 func (c *Client) backupChunkJob(ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup, chErr *error, size *uint64,
-	data []byte, chunk *cache.ChunkInfo, cacheWriter *cache.Repository, storageVault storage_vault.StorageVault, p *progress.Progress, pipe chan<- *cache.Chunk, rpID, bdID string) chunkJob {
+	data []byte, chunk *cache.ChunkInfo, cacheWriter *cache.Repository, storageVault storage_vault.StorageVault, p *progress.Progress, pipe chan<- *cache.Chunk, rpID, bdID, class string) chunkJob {
 	return func() {
 		defer func() {
 			wg.Done()
 		}()
+		defer func() {
+			if r := recover(); r != nil {
+				err := panicError(r)
+				c.logger.Error("backupChunkJob panic ", zap.Error(err), zap.Stack("stack"))
+				*chErr = err
+				p.Report(progress.Stat{Errors: true})
+				cancel()
+			}
+		}()
 
 		select {
 		case <-ctx.Done():
 			return
 		default:
 			s := progress.Stat{}
-			saveSize, err := c.backupChunk(ctx, data, chunk, cacheWriter, storageVault, pipe, rpID, bdID)
+			saveSize, uploaded, err := c.backupChunk(ctx, data, chunk, cacheWriter, storageVault, pipe, rpID, bdID, class)
 			if err != nil {
 				c.logger.Error("backupChunk err ", zap.Error(err))
 				*chErr = err
@@ -227,57 +328,156 @@ func (c *Client) backupChunkJob(ctx context.Context, cancel context.CancelFunc,
 			}
 			s.Storage = saveSize
 			s.Bytes = uint64(chunk.Length)
+			if uploaded {
+				s.NewBytes = uint64(chunk.Length)
+			} else {
+				s.DedupedBytes = uint64(chunk.Length)
+			}
 			p.Report(s)
 			*size += saveSize
 		}
 	}
 }
 
+// UploadFile uploads the chunks of itemInfo changed since lastInfo, in
+// storage class class when not empty. A file whose modification time trust
+// does not trust is compared to lastInfo by content. A changed file is cut into
+// chunks with chunking, DefaultChunking when zero, and hashed with hashAlgo,
+// sha256 when empty, unless dedup holds a file of the same content seen
+// before by the backup, changed or not, whose chunks are reused. The bytes of
+// the file are reported as changed or unchanged, a reused copy as changed and
+// deduped. In a dry run, nothing is uploaded.
 func (c *Client) UploadFile(ctx context.Context, pool *ants.Pool, lastInfo *cache.Node, itemInfo *cache.Node, cacheWriter *cache.Repository,
-	storageVault storage_vault.StorageVault, p *progress.Progress, pipe chan<- *cache.Chunk, rpID, bdID string) (uint64, error) {
+	storageVault storage_vault.StorageVault, p *progress.Progress, pipe chan<- *cache.Chunk, rpID, bdID string, stable StableCheck, trust *MtimeCheck, chunking cache.Chunking, hashAlgo string, dedup *FileDedup, class string) (uint64, error) {
 
 	select {
 	case <-ctx.Done():
 		return 0, ErrorGotCancelRequest
 	default:
 		s := progress.Stat{}
+		dryRun := viper.GetBool("dry_run")
+
+		vaultID, _ := storageVault.ID()
+		// The mtime of a device node says nothing about its content, a device
+		// is always read again and only its new chunks are uploaded.
+		device := itemInfo.Type == "blockdev"
+		trusted := device || trust.Trusted(itemInfo.AbsolutePath)
+		changed := device || lastInfo == nil
+		if !changed && trusted {
+			changed = c.fileChanged(itemInfo.AbsolutePath, itemInfo.Size, itemInfo.ModTime, lastInfo)
+		} else if !changed {
+			c.logger.Sugar().Debugf("mtime of %s not trusted, compare by content", itemInfo.AbsolutePath)
+			changed = !sameContent(itemInfo.AbsolutePath, itemInfo.Size, lastInfo)
+		}
+		if changed && !device && trusted {
+			// A file already uploaded by the backup of another directory is
+			// reused as is, when its mtime can tell it is the same.
+			if entry, ok := c.hostIndex.Lookup(vaultID, itemInfo.AbsolutePath, itemInfo.ModTime, itemInfo.Size); ok {
+				lastInfo = &cache.Node{Content: entry.Content, Sha256Hash: entry.Sha256Hash, HashAlgo: entry.HashAlgo}
+				changed = false
+			}
+		}
+
+		copied := false
+		if changed && !device {
+			// A file being written would be read torn.
+			if err := c.waitStable(ctx, itemInfo, stable); err != nil {
+				s.Errors = true
+				p.Report(s)
+				return 0, err
+			}
+			// A copy of a file read before by this backup reuses its chunks.
+			if node, ok := c.lookupFile(ctx, dedup, itemInfo.AbsolutePath, itemInfo.Size); ok {
+				c.logger.Sugar().Debugf("%s has the content of a file already read, reuse its chunks", itemInfo.AbsolutePath)
+				lastInfo = node
+				changed, copied = false, true
+			}
+		}
 
 		// backup item with item change mtime
-		if lastInfo == nil || !strings.EqualFold(timeToString(lastInfo.ModTime), timeToString(itemInfo.ModTime)) {
-			storageSize, err := c.ChunkFileToBackup(ctx, pool, itemInfo, cacheWriter, storageVault, p, pipe, rpID, bdID)
+		if changed {
+			storageSize, err := c.ChunkFileToBackup(ctx, pool, itemInfo, cacheWriter, storageVault, p, pipe, rpID, bdID, chunking, hashAlgo, class)
 			if err != nil {
 				c.logger.Error("c.ChunkFileToBackup ", zap.Error(err))
 				s.Errors = true
 				p.Report(s)
 				return 0, err
 			}
+			if !device {
+				dedup.store(itemInfo)
+			}
+			s.ChangedBytes = itemInfo.Size
+			if dryRun {
+				p.Report(s)
+				return storageSize, nil
+			}
+			if !device {
+				c.hostIndex.Store(vaultID, itemInfo.AbsolutePath, itemInfo.ModTime, itemInfo.Size, &cache.HostEntry{Content: itemInfo.Content, Sha256Hash: itemInfo.Sha256Hash, HashAlgo: itemInfo.HashAlgo})
+			}
 			p.Report(s)
 			return storageSize, nil
+		}
+
+		// A copy is still changed since the last backup, only not uploaded.
+		if copied {
+			s.ChangedBytes, s.DedupedBytes = itemInfo.Size, itemInfo.Size
+		} else {
+			s.UnchangedBytes = itemInfo.Size
+		}
+		if dryRun {
+			itemInfo.Content = lastInfo.Content
+			itemInfo.Sha256Hash, itemInfo.HashAlgo = lastInfo.Sha256Hash, lastInfo.HashAlgo
 		} else {
 			for _, content := range lastInfo.Content {
 				chunks := cache.NewChunk(bdID, rpID)
 				chunks.Chunks[content.Etag] = []string{strconv.Itoa(1), strconv.Itoa(int(content.Length))}
+				if class != "" {
+					chunks.Classes[content.Etag] = class
+				}
 				pipe <- chunks
 			}
 
 			itemInfo.Content = lastInfo.Content
-			itemInfo.Sha256Hash = lastInfo.Sha256Hash
+			itemInfo.Sha256Hash, itemInfo.HashAlgo = lastInfo.Sha256Hash, lastInfo.HashAlgo
+		}
+		// A file changed into a copy of an unchanged one reuses its chunks.
+		if !copied {
+			dedup.store(itemInfo)
 		}
 		p.Report(s)
 		return 0, nil
 	}
 }
 
-func (c *Client) RestoreDirectory(ctx context.Context, index cache.Index, destDir string, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, p *progress.Progress) error {
-	s := progress.Stat{}
-	numGoroutine := viper.GetInt("num_goroutine")
-	if numGoroutine == 0 {
-		numGoroutine = int(float64(runtime.NumCPU()) * 0.2)
-		if numGoroutine <= 1 {
-			numGoroutine = 2
-		}
+// RestoreDirectory restores the items of index under destDir. Unless force is
+// set, a protected or non-empty destDir is refused before anything is written,
+// see CheckRestoreDestination. profile sets the number of items restored at
+// once, which is also the number of chunks fetched at once across all items,
+// and the size of the chunk cache; its download limit is the one of
+// storageVault.
+//
+// The chunk budget and the chunk cache belong to the call, so that restores
+// running side by side each get the resources of their own profile. Only the
+// open file budget of the client is shared by all of them, see
+// WithMaxOpenFiles.
+func (c *Client) RestoreDirectory(ctx context.Context, index cache.Index, destDir string, force bool, profile RestoreProfile, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, p *progress.Progress) error {
+	if err := CheckRestoreDestination(destDir, force); err != nil {
+		c.logger.Error("Refuse restore destination ", zap.Error(err))
+		return err
+	}
+	if profile.ChunkCacheMB > 0 {
+		chunks := chunkcache.New(storageVault, int64(profile.ChunkCacheMB)<<20)
+		defer func() {
+			hits, misses := chunks.Stats()
+			c.logger.Info("Restore chunk cache stats", zap.Uint64("hits", hits), zap.Uint64("misses", misses))
+		}()
+		storageVault = chunks
 	}
-	sem := semaphore.NewWeighted(int64(numGoroutine))
+	s := progress.Stat{}
+	sem := semaphore.NewWeighted(int64(profile.concurrency()))
+	job := *c
+	job.job = profile.newRestoreJob()
+	c = &job
 	group, ctx := errgroup.WithContext(ctx)
 
 	for _, item := range index.Items {
@@ -292,9 +492,16 @@ func (c *Client) RestoreDirectory(ctx context.Context, index cache.Index, destDi
 				c.logger.Error("err ", zap.Error(err))
 				continue
 			}
-			group.Go(func() error {
+			group.Go(func() (err error) {
 				defer sem.Release(1)
-				err := c.RestoreItem(ctx, destDir, *item, storageVault, restoreKey, p)
+				defer func() {
+					if r := recover(); r != nil {
+						err = panicError(r)
+						c.logger.Error("Restore item panic ", zap.Error(err), zap.Stack("stack"))
+						p.Report(progress.Stat{Errors: true})
+					}
+				}()
+				err = c.RestoreItem(ctx, destDir, *item, storageVault, restoreKey, p)
 				if err != nil {
 					c.logger.Error("Restore file error ", zap.Error(err), zap.String("item name", item.AbsolutePath))
 					s.Errors = true
@@ -310,23 +517,91 @@ func (c *Client) RestoreDirectory(ctx context.Context, index cache.Index, destDi
 		c.logger.Error("Has a goroutine error ", zap.Error(err))
 		return err
 	}
+	return restoreDirTimes(index, destDir)
+}
+
+// restoreDirTimes sets the times of the directories of index again, deepest
+// first, once their content is restored: creating an entry in a directory
+// updates its modification time.
+func restoreDirTimes(index cache.Index, destDir string) error {
+	var dirs []*cache.Node
+	for _, item := range index.Items {
+		if item.Type == "dir" {
+			dirs = append(dirs, item)
+		}
+	}
+	sort.Slice(dirs, func(i, j int) bool { return dirs[i].RelativePath > dirs[j].RelativePath })
+	for _, item := range dirs {
+		target, _ := restorePath(destDir, item)
+		if err := os.Chtimes(target, item.AccessTime, item.ModTime); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
+// StripPrefix returns a copy of index with only the items below prefix, with
+// prefix trimmed from their relative path, so that they are restored directly
+// into the destination directory.
+func StripPrefix(index cache.Index, prefix string) (cache.Index, error) {
+	prefix = strings.TrimPrefix(filepath.Clean(prefix), string(filepath.Separator))
+	stripped := cache.NewIndex(index.BackupDirectoryID, index.RecoveryPointID)
+	for key, item := range index.Items {
+		rel, err := filepath.Rel(prefix, filepath.Clean(item.RelativePath))
+		if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		node := *item
+		node.RelativePath = rel
+		// Never restore to the original absolute path, see RestoreItem.
+		node.BasePath = ""
+		stripped.Items[key] = &node
+		if node.Type != "dir" {
+			stripped.TotalFiles++
+		}
+	}
+	if len(stripped.Items) == 0 {
+		return cache.Index{}, fmt.Errorf("%w: %s", ErrorStripPrefix, prefix)
+	}
+	return *stripped, nil
+}
+
+// restorePath returns where item is restored under destDir, and whether it is
+// a device image restored onto the device destDir.
+func restorePath(destDir string, item *cache.Node) (string, bool) {
+	// A device image restored onto a device is written to the device itself.
+	if item.Type == "blockdev" {
+		if fi, err := os.Stat(destDir); err == nil && support.IsBlockDevice(fi) {
+			return destDir, true
+		}
+	}
+	if destDir == item.BasePath {
+		return item.AbsolutePath, false
+	}
+	return filepath.Join(destDir, item.RelativePath), false
+}
+
 func (c *Client) RestoreItem(ctx context.Context, destDir string, item cache.Node, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, p *progress.Progress) error {
 	select {
 	case <-ctx.Done():
 		return ErrorGotCancelRequest
 	default:
 		s := progress.Stat{}
-		var pathItem string
-		if destDir == item.BasePath {
-			pathItem = item.AbsolutePath
-		} else {
-			pathItem = filepath.Join(destDir, item.RelativePath)
+		pathItem, toDevice := restorePath(destDir, &item)
+		if !toDevice {
+			if err := checkRestoreParents(destDir, pathItem); err != nil {
+				c.logger.Error("Unsafe restore path ", zap.Error(err), zap.String("path", pathItem))
+				s.Errors = true
+				p.Report(s)
+				return err
+			}
 		}
 		switch item.Type {
 		case "symlink":
+			if target, ok := symlinkTarget(destDir, &item); ok {
+				c.logger.Info("Rewrite symlink target ", zap.String("path", pathItem), zap.String("target", item.LinkTarget), zap.String("rewritten_target", target))
+				item.LinkTarget = target
+			}
 			err := c.restoreSymlink(ctx, pathItem, item, p)
 			if err != nil {
 				c.logger.Error("Error restore symlink ", zap.Error(err))
@@ -353,6 +628,15 @@ func (c *Client) RestoreItem(ctx context.Context, destDir string, item cache.Nod
 				return err
 			}
 			p.Report(s)
+		case "blockdev":
+			err := c.restoreDevice(ctx, pathItem, item, storageVault, restoreKey, p)
+			if err != nil {
+				c.logger.Error("Error restore device ", zap.Error(err))
+				s.Errors = true
+				p.Report(s)
+				return err
+			}
+			p.Report(s)
 		}
 		s.Items = 1
 		p.Report(s)
@@ -366,7 +650,7 @@ func (c *Client) restoreSymlink(ctx context.Context, target string, item cache.N
 		return errors.New("context restore item done")
 	default:
 		s := progress.Stat{}
-		fi, err := os.Stat(target)
+		fi, err := os.Lstat(target)
 		if err != nil {
 			if os.IsNotExist(err) {
 				c.logger.Sugar().Info("symlink not exist, create ", target)
@@ -387,15 +671,12 @@ func (c *Client) restoreSymlink(ctx context.Context, target string, item cache.N
 		}
 		_, ctimeLocal, _, _, _, _ := support.ItemLocal(fi)
 		if !strings.EqualFold(timeToString(ctimeLocal), timeToString(item.ChangeTime)) {
-			c.logger.Sugar().Info("symlink change ctime. update mode, uid, gid ", item.Name)
-			err = os.Chmod(target, item.Mode)
-			if err != nil {
-				c.logger.Error("err ", zap.Error(err))
+			c.logger.Sugar().Info("symlink change ctime. update uid, gid ", item.Name)
+			if err := c.lchown(target, int(item.UID), int(item.GID)); err != nil {
 				s.Errors = true
 				p.Report(s)
 				return err
 			}
-			_ = support.SetChownItem(target, int(item.UID), int(item.GID))
 		}
 		return nil
 	}
@@ -418,6 +699,11 @@ func (c *Client) restoreDirectory(ctx context.Context, target string, item cache
 					p.Report(s)
 					return err
 				}
+				if err := c.restoreSecurity(target, item); err != nil {
+					s.Errors = true
+					p.Report(s)
+					return err
+				}
 				return nil
 			} else {
 				c.logger.Error("err ", zap.Error(err))
@@ -436,7 +722,16 @@ func (c *Client) restoreDirectory(ctx context.Context, target string, item cache
 				p.Report(s)
 				return err
 			}
-			_ = support.SetChownItem(target, int(item.UID), int(item.GID))
+			if err := c.chown(target, int(item.UID), int(item.GID)); err != nil {
+				s.Errors = true
+				p.Report(s)
+				return err
+			}
+			if err := c.restoreSecurity(target, item); err != nil {
+				s.Errors = true
+				p.Report(s)
+				return err
+			}
 		}
 		return nil
 	}
@@ -452,15 +747,7 @@ func (c *Client) restoreFile(ctx context.Context, target string, item cache.Node
 		if err != nil {
 			if os.IsNotExist(err) {
 				c.logger.Sugar().Info("file not exist. create ", target)
-				file, err := c.createFile(target, item.Mode, int(item.UID), int(item.GID))
-				if err != nil {
-					c.logger.Error("err ", zap.Error(err))
-					s.Errors = true
-					p.Report(s)
-					return err
-				}
-
-				err = c.downloadFile(ctx, file, item, storageVault, restoreKey, p)
+				err := c.createAndDownload(ctx, target, item, storageVault, restoreKey, p)
 				if err != nil {
 					c.logger.Error("downloadFile error ", zap.Error(err))
 					s.Errors = true
@@ -479,41 +766,41 @@ func (c *Client) restoreFile(ctx context.Context, target string, item cache.Node
 		c.logger.Sugar().Info("file exist ", target)
 		_, ctimeLocal, mtimeLocal, _, _, _ := support.ItemLocal(fi)
 		if !strings.EqualFold(timeToString(ctimeLocal), timeToString(item.ChangeTime)) {
-			if !strings.EqualFold(timeToString(mtimeLocal), timeToString(item.ModTime)) {
+			if c.fileChanged(target, uint64(fi.Size()), mtimeLocal, &item) {
 				c.logger.Sugar().Info("file change mtime, ctime ", target)
-				if err = os.Remove(target); err != nil {
-					c.logger.Error("err ", zap.Error(err))
+				var err error
+				if viper.GetBool("restore_resume") && fi.Mode().IsRegular() {
+					err = c.resumeFile(ctx, target, item, storageVault, restoreKey, p)
+				} else {
+					delta := viper.GetBool("restore_delta") && fi.Mode().IsRegular()
+					err = c.replaceFile(ctx, target, item, storageVault, restoreKey, delta, p)
+				}
+				if err != nil {
+					c.logger.Error("downloadFile error ", zap.Error(err))
 					s.Errors = true
 					p.Report(s)
 					return err
 				}
-
-				file, err := c.createFile(target, item.Mode, int(item.UID), int(item.GID))
+				return nil
+			} else {
+				c.logger.Sugar().Info("file change ctime. update mode, uid, gid ", target)
+				err = os.Chmod(target, item.Mode)
 				if err != nil {
 					c.logger.Error("err ", zap.Error(err))
 					s.Errors = true
 					p.Report(s)
 					return err
 				}
-
-				err = c.downloadFile(ctx, file, item, storageVault, restoreKey, p)
-				if err != nil {
-					c.logger.Error("downloadFile error ", zap.Error(err))
+				if err := c.chown(target, int(item.UID), int(item.GID)); err != nil {
 					s.Errors = true
 					p.Report(s)
 					return err
 				}
-				return nil
-			} else {
-				c.logger.Sugar().Info("file change ctime. update mode, uid, gid ", target)
-				err = os.Chmod(target, item.Mode)
-				if err != nil {
-					c.logger.Error("err ", zap.Error(err))
+				if err := c.restoreSecurity(target, item); err != nil {
 					s.Errors = true
 					p.Report(s)
 					return err
 				}
-				_ = support.SetChownItem(target, int(item.UID), int(item.GID))
 				err = os.Chtimes(target, item.AccessTime, item.ModTime)
 				if err != nil {
 					c.logger.Error("err ", zap.Error(err))
@@ -530,52 +817,254 @@ func (c *Client) restoreFile(ctx context.Context, target string, item cache.Node
 	}
 }
 
-func (c *Client) downloadFile(ctx context.Context, file *os.File, item cache.Node, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, p *progress.Progress) error {
-	s := progress.Stat{}
-	for _, info := range item.Content {
-		select {
-		case <-ctx.Done():
-			return ErrorGotCancelRequest
-		default:
-			offset := info.Start
-			key := info.Etag
-			length := info.Length
+// createAndDownload creates target and writes the content of item into it. A
+// slot of the open file budget is held while the file is open.
+func (c *Client) createAndDownload(ctx context.Context, target string, item cache.Node, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, p *progress.Progress) error {
+	if err := c.acquireOpenFile(ctx); err != nil {
+		return err
+	}
+	defer c.releaseOpenFile()
 
-			data, err := c.GetObject(storageVault, key, restoreKey)
-			if err != nil {
-				c.logger.Error("err ", zap.Error(err))
+	file, err := c.createFile(target, item.Mode, int(item.UID), int(item.GID))
+	if err != nil {
+		c.logger.Error("err ", zap.Error(err))
+		return err
+	}
+	defer file.Close()
+
+	if err := c.downloadFile(ctx, file, nil, item, storageVault, restoreKey, p); err != nil {
+		return err
+	}
+	return c.applyMetadata(file.Name(), item)
+}
+
+// replaceFile replaces the existing target with the content of item. The
+// content is downloaded next to target and only renamed over it once complete
+// and matching the recorded hash, so a failed download, e.g. of an in place
+// restore, never loses the existing file. With delta, the chunks target
+// already holds are copied from it instead of fetched from the vault; target
+// is only ever read.
+func (c *Client) replaceFile(ctx context.Context, target string, item cache.Node, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, delta bool, p *progress.Progress) error {
+	if err := c.acquireOpenFile(ctx); err != nil {
+		return err
+	}
+	defer c.releaseOpenFile()
+
+	var local *os.File
+	if delta {
+		var err error
+		if local, err = os.Open(target); err != nil {
+			c.logger.Error("err ", zap.Error(err))
+			return err
+		}
+		defer local.Close()
+	}
+	file, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+restoreTempSuffix)
+	if err != nil {
+		c.logger.Error("err ", zap.Error(err))
+		return err
+	}
+	defer func() {
+		if file != nil {
+			_ = file.Close()
+			_ = os.Remove(file.Name())
+		}
+	}()
+
+	if err := c.downloadFile(ctx, file, local, item, storageVault, restoreKey, p); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if len(item.Sha256Hash) > 0 {
+		if reason := verifyFile(file.Name(), &item); reason != "" {
+			return fmt.Errorf("%w: %s: %s", ErrorRestoreMismatch, target, reason)
+		}
+	}
+	if err := c.applyMetadata(file.Name(), item); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if local != nil {
+		_ = local.Close()
+	}
+	if err := os.Rename(file.Name(), target); err != nil {
+		c.logger.Error("err ", zap.Error(err))
+		return err
+	}
+	file = nil
+	return nil
+}
+
+// localChunk returns the chunk described by info when file already holds it.
+func (c *Client) localChunk(file *os.File, info *cache.ChunkInfo) ([]byte, bool) {
+	buf := make([]byte, info.Length)
+	if _, err := file.ReadAt(buf, int64(info.Start)); err != nil {
+		return nil, false
+	}
+	stored, _, err := compressChunk(info.Codec, buf)
+	if err != nil {
+		return nil, false
+	}
+	if stored, err = c.sealChunk(stored); err != nil {
+		return nil, false
+	}
+	return buf, chunkKeyMatches(info.Etag, stored)
+}
+
+// restoreDevice writes the image of a block device to target. An existing
+// block device must be at least as large as the image, otherwise the image is
+// written to a regular file.
+func (c *Client) restoreDevice(ctx context.Context, target string, item cache.Node, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, p *progress.Progress) error {
+	if err := c.acquireOpenFile(ctx); err != nil {
+		return err
+	}
+	defer c.releaseOpenFile()
+
+	var file *os.File
+	fi, err := os.Stat(target)
+	if err == nil && support.IsBlockDevice(fi) {
+		size, err := support.DeviceSize(target, true)
+		if err != nil {
+			return err
+		}
+		if size < item.Size {
+			return fmt.Errorf("%w: %s has %d bytes, image has %d", ErrorDeviceSize, target, size, item.Size)
+		}
+		file, err = os.OpenFile(target, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		file, err = os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	defer file.Close()
+
+	c.logger.Sugar().Info("restore device image to ", target)
+	if err := c.writeFileContent(ctx, file, &item, storageVault, restoreKey); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	p.Report(progress.Stat{Bytes: item.Size, Storage: item.Size})
+	return file.Close()
+}
+
+// acquireOpenFile blocks until a slot of the open file budget is available.
+func (c *Client) acquireOpenFile(ctx context.Context) error {
+	if c.openFiles == nil {
+		return nil
+	}
+	if err := c.openFiles.Acquire(ctx, 1); err != nil {
+		return ErrorGotCancelRequest
+	}
+	return nil
+}
+
+func (c *Client) releaseOpenFile() {
+	if c.openFiles == nil {
+		return
+	}
+	c.openFiles.Release(1)
+}
+
+// isTooManyOpenFiles reports whether err is caused by running out of file descriptors.
+func isTooManyOpenFiles(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE)
+}
+
+// downloadFile writes the content of item into file, each chunk at its offset,
+// as many at once as the restore job allows, or else up to
+// restoreChunkConcurrency. When local is
+// set, the chunks already present in local are copied and only the others are
+// fetched. The first chunk failing cancels the others, all are done when it
+// returns.
+func (c *Client) downloadFile(ctx context.Context, file *os.File, local *os.File, item cache.Node, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, p *progress.Progress) error {
+	prefetcher, _ := storageVault.(storage_vault.ChunkPrefetcher)
+	depth := restorePrefetchDepth()
+	var sem *semaphore.Weighted
+	if c.job != nil {
+		sem, depth = c.job.chunks, c.job.prefetchDepth
+	} else {
+		sem = semaphore.NewWeighted(int64(restoreChunkConcurrency(len(item.Content))))
+	}
+	next := 0
+	group, gctx := errgroup.WithContext(ctx)
+	canceled := false
+	for i, info := range item.Content {
+		if gctx.Err() != nil || sem.Acquire(gctx, 1) != nil {
+			canceled = true
+			break
+		}
+		// Read the next chunks ahead while this one is fetched, unless they
+		// may be copied from the local file.
+		if prefetcher != nil && local == nil {
+			if next <= i {
+				next = i + 1
+			}
+			for ; next < len(item.Content) && next <= i+depth; next++ {
+				ahead := item.Content[next]
+				if !prefetcher.Prefetch(gctx, ahead.Etag, int64(ahead.Length)) {
+					break
+				}
+			}
+		}
+
+		info := info
+		group.Go(func() error {
+			defer sem.Release(1)
+			return c.downloadChunk(gctx, file, local, item, info, storageVault, restoreKey, p)
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+	if canceled {
+		return ErrorGotCancelRequest
+	}
+	return nil
+}
+
+// downloadChunk writes the chunk info of item into file, copied from local
+// when it holds it.
+func (c *Client) downloadChunk(ctx context.Context, file *os.File, local *os.File, item cache.Node, info *cache.ChunkInfo, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, p *progress.Progress) error {
+	s := progress.Stat{}
+	if local != nil {
+		if data, ok := c.localChunk(local, info); ok {
+			if _, err := file.WriteAt(data, int64(info.Start)); err != nil {
+				c.logger.Error("err write file ", zap.Error(err))
 				s.Errors = true
 				p.Report(s)
 				return err
 			}
-			s.Bytes = uint64(length)
-			s.Storage = uint64(length)
+			s.Bytes = uint64(info.Length)
 			p.Report(s)
-			_, errWriteFile := file.WriteAt(data, int64(offset))
-			if errWriteFile != nil {
-				c.logger.Error("err write file ", zap.Error(errWriteFile))
-				s.Errors = true
-				p.Report(s)
-				return errWriteFile
-			}
+			return nil
 		}
 	}
 
-	err := os.Chmod(file.Name(), item.Mode)
-	if err != nil {
-		c.logger.Error("err ", zap.Error(err))
-		s.Errors = true
-		p.Report(s)
-		return err
-	}
-	_ = support.SetChownItem(file.Name(), int(item.UID), int(item.GID))
-	err = os.Chtimes(file.Name(), item.AccessTime, item.ModTime)
-	if err != nil {
+	if err := c.restoreChunk(ctx, file, info, storageVault, restoreKey); err != nil {
 		c.logger.Error("err ", zap.Error(err))
 		s.Errors = true
 		p.Report(s)
+		if errors.Is(err, storage_vault.ErrObjectArchived) {
+			return fmt.Errorf("restore %s: %w", item.AbsolutePath, err)
+		}
 		return err
 	}
+	s.Bytes = uint64(info.Length)
+	s.Storage = uint64(info.Length)
+	p.Report(s)
 	return nil
 }
 
@@ -593,12 +1082,9 @@ func (c *Client) createSymlink(symlinkPath string, path string, mode fs.FileMode
 		c.logger.Error("err ", zap.Error(err))
 	}
 
-	err = os.Chmod(path, mode)
-	if err != nil {
-		c.logger.Error("err ", zap.Error(err))
-	}
-	_ = support.SetChownItem(path, uid, gid)
-	return nil
+	// The mode of a symlink is not used, and chmod would change the mode
+	// of its target.
+	return c.lchown(path, uid, gid)
 }
 
 func (c *Client) createDir(path string, mode fs.FileMode, uid int, gid int, atime time.Time, mtime time.Time) error {
@@ -614,7 +1100,9 @@ func (c *Client) createDir(path string, mode fs.FileMode, uid int, gid int, atim
 		return err
 	}
 
-	_ = support.SetChownItem(path, uid, gid)
+	if err := c.chown(path, uid, gid); err != nil {
+		return err
+	}
 	err = os.Chtimes(path, atime, mtime)
 	if err != nil {
 		c.logger.Error("err ", zap.Error(err))
@@ -634,7 +1122,20 @@ func (c *Client) createFile(path string, mode fs.FileMode, uid int, gid int) (*o
 		}
 	}
 	var file *os.File
-	file, err := os.Create(path)
+	var err error
+	bo := backoff.WithMaxRetries(backoff.NewExponentialBackOff(), MaxTimesRetryOpenFile)
+	for {
+		file, err = os.Create(path)
+		if err == nil || !isTooManyOpenFiles(err) {
+			break
+		}
+		d := bo.NextBackOff()
+		if d == backoff.Stop {
+			break
+		}
+		c.logger.Sugar().Warnf("Too many open files when creating %s. Retry in %s", path, d)
+		time.Sleep(d)
+	}
 	if err != nil {
 		c.logger.Error("err ", zap.Error(err))
 		return nil, err
@@ -646,10 +1147,152 @@ func (c *Client) createFile(path string, mode fs.FileMode, uid int, gid int) (*o
 		return nil, err
 	}
 
-	_ = support.SetChownItem(path, uid, gid)
+	if err := c.chown(path, uid, gid); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
 	return file, nil
 }
 
+// chown sets the owner of path. Failures, e.g. when restoring as a non-root
+// user, are ignored, logged or returned depending on chown_failure.
+func (c *Client) chown(path string, uid int, gid int) error {
+	return c.handleChownError(path, uid, gid, support.SetChownItem(path, uid, gid))
+}
+
+// lchown is chown for a symlink, whose target is left alone.
+func (c *Client) lchown(path string, uid int, gid int) error {
+	return c.handleChownError(path, uid, gid, support.SetLchownItem(path, uid, gid))
+}
+
+func (c *Client) handleChownError(path string, uid int, gid int, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch viper.GetString("chown_failure") {
+	case ChownFailureIgnore:
+		return nil
+	case ChownFailureError:
+		c.logger.Error("Failed to set owner ", zap.Error(err), zap.String("path", path), zap.Int("uid", uid), zap.Int("gid", gid))
+		return err
+	default:
+		c.logger.Warn("Failed to set owner ", zap.Error(err), zap.String("path", path), zap.Int("uid", uid), zap.Int("gid", gid))
+		return nil
+	}
+}
+
+// restoreSecurity applies the Windows security descriptor recorded for item
+// to path when preserve_acls is enabled. If only the DACL could be applied,
+// a warning is logged and the restore goes on.
+func (c *Client) restoreSecurity(path string, item cache.Node) error {
+	if item.SecurityDescriptor == "" || !viper.GetBool("preserve_acls") {
+		return nil
+	}
+	err := support.SetSecurityDescriptor(path, item.SecurityDescriptor)
+	if errors.Is(err, support.ErrOwnerNotRestored) {
+		c.logger.Warn("Failed to set owner, restored DACL only ", zap.Error(err), zap.String("path", path))
+		return nil
+	}
+	if err != nil {
+		c.logger.Error("Failed to set ACL ", zap.Error(err), zap.String("path", path))
+		return err
+	}
+	return nil
+}
+
+// checkRestoreParents makes sure no parent directory of target below root is a
+// symlink, so that a restore can not be redirected outside of root. When
+// restore_follow_symlinks is enabled, symlinked parents are allowed as long as
+// they resolve to a location inside root.
+func checkRestoreParents(root string, target string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+	if !isWithin(root, target) {
+		return ErrorRestorePathEscape
+	}
+
+	follow := viper.GetBool("restore_follow_symlinks")
+	current := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		current = filepath.Join(current, part)
+		fi, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			// the rest of the tree does not exist yet and will be created
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		if !follow {
+			return ErrorSymlinkParent
+		}
+
+		resolvedRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return err
+		}
+		resolved, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return err
+		}
+		if !isWithin(resolvedRoot, resolved) {
+			return ErrorRestorePathEscape
+		}
+	}
+	return nil
+}
+
+// isWithin reports whether path is root or lies below it.
+func isWithin(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// compareModTime reports whether a and b are the same time at microsecond
+// precision, and whether they lie within the configured mtime_tolerance of each
+// other.
+func compareModTime(a time.Time, b time.Time) (bool, bool) {
+	if strings.EqualFold(timeToString(a), timeToString(b)) {
+		return true, true
+	}
+	tolerance := viper.GetDuration("mtime_tolerance")
+	d := a.Sub(b)
+	if d < 0 {
+		d = -d
+	}
+	return false, tolerance > 0 && d <= tolerance
+}
+
+// fileChanged reports whether the file at path differs from the recorded node.
+//
+// A modification time within mtime_tolerance of the recorded one is not enough
+// to tell, as filesystems with coarse timestamps or clock adjustments may shift
+// it slightly. The size of the file and its content, against the hash recorded
+// with the file, are compared instead. This costs a full read of the file, and a file rewritten with identical content
+// inside the tolerance window is treated as unchanged.
+func (c *Client) fileChanged(path string, size uint64, mtime time.Time, node *cache.Node) bool {
+	equal, withinTolerance := compareModTime(mtime, node.ModTime)
+	if equal {
+		return false
+	}
+	if !withinTolerance {
+		return true
+	}
+	c.logger.Sugar().Debugf("mtime of %s within tolerance, compare by content", path)
+	return !sameContent(path, size, node)
+}
+
 func timeToString(time time.Time) string {
 	return time.Format("2006-01-02 15:04:05.000000")
 }
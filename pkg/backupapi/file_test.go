@@ -1,10 +1,28 @@
 package backupapi
 
 import (
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+	"github.com/panjf2000/ants/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_createDir(t *testing.T) {
@@ -77,3 +95,672 @@ func Test_createFile(t *testing.T) {
 		})
 	}
 }
+
+func Test_checkRestoreParents(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "dir", "inner"), 0700))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(root, "dir"), filepath.Join(root, "inside")))
+
+	tests := []struct {
+		name    string
+		follow  bool
+		target  string
+		wantErr error
+	}{
+		{
+			name:   "regular parent",
+			target: filepath.Join(root, "dir", "inner", "file.txt"),
+		},
+		{
+			name:   "parent not created yet",
+			target: filepath.Join(root, "new", "file.txt"),
+		},
+		{
+			name:    "symlinked parent refused",
+			target:  filepath.Join(root, "inside", "file.txt"),
+			wantErr: ErrorSymlinkParent,
+		},
+		{
+			name:   "symlinked parent inside root",
+			follow: true,
+			target: filepath.Join(root, "inside", "file.txt"),
+		},
+		{
+			name:    "symlinked parent outside root",
+			follow:  true,
+			target:  filepath.Join(root, "escape", "file.txt"),
+			wantErr: ErrorRestorePathEscape,
+		},
+		{
+			name:    "target outside root",
+			target:  filepath.Join(outside, "file.txt"),
+			wantErr: ErrorRestorePathEscape,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("restore_follow_symlinks", tt.follow)
+			defer viper.Set("restore_follow_symlinks", false)
+			assert.Equal(t, tt.wantErr, checkRestoreParents(root, tt.target))
+		})
+	}
+}
+
+func Test_isTooManyOpenFiles(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"emfile", &os.PathError{Op: "open", Path: "/tmp/file.txt", Err: syscall.EMFILE}, true},
+		{"enfile", &os.PathError{Op: "open", Path: "/tmp/file.txt", Err: syscall.ENFILE}, true},
+		{"not exist", &os.PathError{Op: "open", Path: "/tmp/file.txt", Err: syscall.ENOENT}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isTooManyOpenFiles(tt.err))
+		})
+	}
+}
+
+func Test_localChunk(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "file.txt")
+	require.NoError(t, os.WriteFile(path, []byte("hello world"), 0600))
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	hash := md5.Sum([]byte("world"))
+	etag := hex.EncodeToString(hash[:])
+
+	tests := []struct {
+		name string
+		info *cache.ChunkInfo
+		want bool
+	}{
+		{"same content", &cache.ChunkInfo{Start: 6, Length: 5, Etag: etag}, true},
+		{"other offset", &cache.ChunkInfo{Start: 0, Length: 5, Etag: etag}, false},
+		{"beyond end of file", &cache.ChunkInfo{Start: 8, Length: 5, Etag: etag}, false},
+		{"disambiguated key", &cache.ChunkInfo{Start: 6, Length: 5, Etag: collisionKey([]byte("world"))}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data, ok := (&Client{}).localChunk(file, tt.info)
+			assert.Equal(t, tt.want, ok)
+			if ok {
+				assert.Equal(t, "world", string(data))
+			}
+		})
+	}
+}
+
+func TestClient_fileChanged(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	path := filepath.Join(t.TempDir(), "file.txt")
+	content := []byte("hello world")
+	require.NoError(t, os.WriteFile(path, content, 0600))
+	hash := sha256.Sum256(content)
+
+	mtime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	node := &cache.Node{ModTime: mtime, Size: uint64(len(content)), Sha256Hash: hash[:]}
+
+	tests := []struct {
+		name      string
+		tolerance time.Duration
+		mtime     time.Time
+		size      uint64
+		node      *cache.Node
+		want      bool
+	}{
+		{"same mtime", 0, mtime, node.Size, node, false},
+		{"skewed mtime without tolerance", 0, mtime.Add(500 * time.Millisecond), node.Size, node, true},
+		{"skewed mtime same content", time.Second, mtime.Add(500 * time.Millisecond), node.Size, node, false},
+		{"skewed mtime other size", time.Second, mtime.Add(500 * time.Millisecond), node.Size + 1, node, true},
+		{"skewed mtime other content", time.Second, mtime.Add(500 * time.Millisecond), node.Size, &cache.Node{ModTime: mtime, Size: node.Size, Sha256Hash: make([]byte, sha256.Size)}, true},
+		{"mtime beyond tolerance", time.Second, mtime.Add(2 * time.Second), node.Size, node, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("mtime_tolerance", tt.tolerance)
+			defer viper.Set("mtime_tolerance", 0)
+			assert.Equal(t, tt.want, client.fileChanged(path, tt.size, tt.mtime, tt.node))
+		})
+	}
+}
+
+func TestClient_backupChunkJobPanic(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	p := progress.NewProgress(time.Second)
+	var reported progress.Stat
+	p.OnUpdate = func(s progress.Stat, _ time.Duration, _ bool) { reported = s }
+	p.Start()
+	defer p.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var errChunk error
+	var size uint64
+	wg.Add(1)
+	// A nil chunk makes backupChunk dereference a nil pointer.
+	go client.backupChunkJob(ctx, cancel, &wg, &errChunk, &size, []byte("data"), nil, nil, nil, p, nil, "rp", "bd", "")()
+	wg.Wait()
+
+	assert.ErrorIs(t, errChunk, ErrorPanic)
+	assert.Error(t, ctx.Err())
+	assert.True(t, reported.Errors)
+}
+
+func TestClient_RestoreDirectoryPanic(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	index := cache.NewIndex("bd", "rp")
+	index.Items["broken"] = nil
+
+	err := client.RestoreDirectory(context.Background(), *index, t.TempDir(), false, RestoreProfile{}, nil, nil, progress.NewProgress(time.Second))
+	assert.ErrorIs(t, err, ErrorPanic)
+}
+
+func TestClient_UploadFileHostIndex(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	hostIndex, err := cache.LoadHostIndex(t.TempDir())
+	require.NoError(t, err)
+	client.hostIndex = hostIndex
+	defer func() { client.hostIndex = nil }()
+
+	mtime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	content := []*cache.ChunkInfo{{Start: 0, Length: 4, Etag: "etag"}}
+	hostIndex.Store("vault", "/other/file", mtime, 4, &cache.HostEntry{Content: content, Sha256Hash: []byte{1}})
+
+	// The file does not exist on disk, so it can only be backed up from the host index.
+	item := &cache.Node{AbsolutePath: "/other/file", ModTime: mtime, Size: 4}
+	pipe := make(chan *cache.Chunk, 1)
+	size, err := client.UploadFile(context.Background(), nil, nil, item, nil, memory.New("vault", ""), progress.NewProgress(time.Second), pipe, "rp", "bd", StableCheck{}, nil, cache.Chunking{}, "", nil, "")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), size)
+	assert.Equal(t, content, item.Content)
+	assert.Contains(t, (<-pipe).Chunks, "etag")
+}
+
+func TestStripPrefix(t *testing.T) {
+	index := cache.NewIndex("bd", "rp")
+	index.Items["/backup/data"] = &cache.Node{Type: "dir", RelativePath: "data", BasePath: "/backup/data"}
+	index.Items["/backup/data/app"] = &cache.Node{Type: "dir", RelativePath: "data/app", BasePath: "/backup/data"}
+	index.Items["/backup/data/app/file"] = &cache.Node{Type: "file", RelativePath: "data/app/file", BasePath: "/backup/data"}
+	index.Items["/backup/data/app/link"] = &cache.Node{Type: "symlink", RelativePath: "data/app/link", BasePath: "/backup/data"}
+	index.Items["/backup/data/application"] = &cache.Node{Type: "file", RelativePath: "data/application", BasePath: "/backup/data"}
+
+	tests := []struct {
+		name    string
+		prefix  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"subfolder", "data/app", map[string]string{"/backup/data/app/file": "file", "/backup/data/app/link": "link"}, false},
+		{"trailing and leading separator", "/data/app/", map[string]string{"/backup/data/app/file": "file", "/backup/data/app/link": "link"}, false},
+		{"root", "data", map[string]string{
+			"/backup/data/app":         "app",
+			"/backup/data/app/file":    filepath.Join("app", "file"),
+			"/backup/data/app/link":    filepath.Join("app", "link"),
+			"/backup/data/application": "application",
+		}, false},
+		{"no match", "other", nil, true},
+		{"partial segment", "data/ap", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := StripPrefix(*index, tt.prefix)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrorStripPrefix)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, got.Items, len(tt.want))
+			for key, rel := range tt.want {
+				require.Contains(t, got.Items, key)
+				assert.Equal(t, rel, got.Items[key].RelativePath)
+				assert.Empty(t, got.Items[key].BasePath)
+			}
+			// The original index is left untouched.
+			assert.Equal(t, "data/app/file", index.Items["/backup/data/app/file"].RelativePath)
+		})
+	}
+}
+
+func TestClient_chown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ownership is not restored on windows")
+	}
+	setUp()
+	defer tearDown()
+	defer viper.Set("chown_failure", "")
+
+	// Chown of a missing path fails whatever the current user is.
+	missing := filepath.Join(t.TempDir(), "missing")
+	tests := []struct {
+		mode    string
+		wantErr bool
+	}{
+		{"", false},
+		{ChownFailureIgnore, false},
+		{ChownFailureWarn, false},
+		{ChownFailureError, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			viper.Set("chown_failure", tt.mode)
+			err := client.chown(missing, os.Getuid(), os.Getgid())
+			assert.Equal(t, tt.wantErr, err != nil)
+		})
+	}
+}
+
+func Test_restoreDirTimes(t *testing.T) {
+	dest := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dest, "data", "sub"), 0700))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	index := cache.NewIndex("bd", "rp")
+	for _, rel := range []string{"data", "data/sub", "data/missing"} {
+		index.Items["/"+rel] = &cache.Node{Type: "dir", RelativePath: rel, AccessTime: mtime, ModTime: mtime}
+	}
+
+	// Creating the entries of a directory after it changes its time, and a
+	// directory not restored is skipped.
+	require.NoError(t, os.WriteFile(filepath.Join(dest, "data", "sub", "file"), nil, 0600))
+	require.NoError(t, restoreDirTimes(*index, dest))
+	for _, rel := range []string{"data", "data/sub"} {
+		fi, err := os.Stat(filepath.Join(dest, rel))
+		require.NoError(t, err)
+		assert.True(t, mtime.Equal(fi.ModTime()), rel)
+	}
+}
+
+func TestClient_RestoreItemDevice(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault, index := exportFixture("boot sector ", "and the rest")
+	item := *index.Items["/data/file.txt"]
+	item.Type = "blockdev"
+	item.RelativePath = "sdb"
+	item.BasePath = "/dev/sdb"
+
+	dest := t.TempDir()
+	err := client.RestoreItem(context.Background(), dest, item, vault, nil, progress.NewProgress(time.Second))
+	require.NoError(t, err)
+	got, err := os.ReadFile(filepath.Join(dest, "sdb"))
+	require.NoError(t, err)
+	assert.Equal(t, "boot sector and the rest", string(got))
+
+	// A chunk missing from the image must fail the restore.
+	item.Size++
+	err = client.RestoreItem(context.Background(), dest, item, vault, nil, progress.NewProgress(time.Second))
+	assert.Error(t, err)
+}
+
+// failingVault fails to get key without retries.
+type failingVault struct {
+	storage_vault.StorageVault
+	key string
+}
+
+func (v failingVault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	if key == v.key {
+		return nil, storage_vault.ErrRequestBudgetExhausted
+	}
+	return v.StorageVault.GetObject(ctx, key)
+}
+
+// slowVault counts the gets of chunks in flight, each taking delay, and fails
+// the get of key.
+type slowVault struct {
+	storage_vault.StorageVault
+	delay time.Duration
+	key   string
+
+	mu       sync.Mutex
+	inflight int
+	max      int
+	gets     int
+}
+
+func (v *slowVault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	v.mu.Lock()
+	v.inflight++
+	v.gets++
+	if v.inflight > v.max {
+		v.max = v.inflight
+	}
+	v.mu.Unlock()
+	defer func() {
+		v.mu.Lock()
+		v.inflight--
+		v.mu.Unlock()
+	}()
+	time.Sleep(v.delay)
+	if key == v.key {
+		return nil, storage_vault.ErrRequestBudgetExhausted
+	}
+	return v.StorageVault.GetObject(ctx, key)
+}
+
+func TestClient_RestoreItemParallelChunks(t *testing.T) {
+	setUp()
+	defer tearDown()
+	viper.Set("num_goroutine", 4)
+	defer viper.Set("num_goroutine", nil)
+
+	var parts []string
+	for i := 0; i < 16; i++ {
+		parts = append(parts, strings.Repeat(string(rune('a'+i)), 10+i))
+	}
+	inner, index := exportFixture(parts...)
+	item := *index.Items["/data/file.txt"]
+	item.Mode = 0640
+	item.ModTime = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+
+	vault := &slowVault{StorageVault: inner, delay: 20 * time.Millisecond}
+	dest := t.TempDir()
+	require.NoError(t, client.RestoreItem(context.Background(), dest, item, vault, nil, progress.NewProgress(time.Second)))
+	got, err := os.ReadFile(filepath.Join(dest, "data", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, strings.Join(parts, ""), string(got))
+	assert.Equal(t, 4, vault.max, "chunks are read num_goroutine at once")
+	// The metadata is applied once all chunks are written.
+	fi, err := os.Stat(filepath.Join(dest, "data", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0640), fi.Mode().Perm())
+	assert.True(t, fi.ModTime().Equal(item.ModTime))
+
+	// A failing chunk cancels the chunks not started yet.
+	failing := &slowVault{StorageVault: inner, delay: 20 * time.Millisecond, key: item.Content[0].Etag}
+	err = client.RestoreItem(context.Background(), t.TempDir(), item, failing, nil, progress.NewProgress(time.Second))
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+	assert.Less(t, failing.gets, len(item.Content))
+
+	// A chunk shorter than its index records fails the restore.
+	short := item
+	short.Content = append([]*cache.ChunkInfo(nil), item.Content...)
+	last := *short.Content[len(short.Content)-1]
+	last.Length++
+	short.Content[len(short.Content)-1] = &last
+	err = client.RestoreItem(context.Background(), t.TempDir(), short, inner, nil, progress.NewProgress(time.Second))
+	assert.ErrorIs(t, err, ErrorChunkLength)
+}
+
+func TestClient_RestoreDirectoryChunkBudget(t *testing.T) {
+	setUp()
+	defer tearDown()
+	viper.Set("num_goroutine", 4)
+	defer viper.Set("num_goroutine", nil)
+
+	var parts []string
+	for i := 0; i < 8; i++ {
+		parts = append(parts, strings.Repeat(string(rune('a'+i)), 10+i))
+	}
+	inner, index := exportFixture(parts...)
+	other := *index.Items["/data/file.txt"]
+	other.RelativePath = "data/other.txt"
+	index.Items["/data/other.txt"] = &other
+
+	// The chunks of all files share the concurrency of the profile.
+	for _, profile := range []RestoreProfile{{Name: "gentle", Concurrency: 1}, {Name: "two", Concurrency: 2}} {
+		vault := &slowVault{StorageVault: inner, delay: 10 * time.Millisecond}
+		require.NoError(t, client.RestoreDirectory(context.Background(), *index, t.TempDir(), false, profile, vault, nil, progress.NewProgress(time.Second)))
+		assert.Equal(t, profile.Concurrency, vault.max, profile.Name)
+	}
+}
+
+func TestClient_RestoreDirectoryJobs(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	var parts []string
+	for i := 0; i < 8; i++ {
+		parts = append(parts, strings.Repeat(string(rune('a'+i)), 10+i))
+	}
+	inner, index := exportFixture(parts...)
+	vault := &slowVault{StorageVault: inner, delay: 20 * time.Millisecond}
+
+	// Restores running side by side each get the budget of their profile.
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		i := i
+		dest := t.TempDir()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = client.RestoreDirectory(context.Background(), *index, dest, false, RestoreProfile{Name: "gentle", Concurrency: 1}, vault, nil, progress.NewProgress(time.Second))
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, vault.max)
+}
+
+func TestClient_RestoreItemResume(t *testing.T) {
+	setUp()
+	defer tearDown()
+	viper.Set("restore_resume", true)
+	defer viper.Set("restore_resume", nil)
+
+	vault, index := exportFixture("hello ", "world")
+	hash := sha256.Sum256([]byte("hello world"))
+	dest := t.TempDir()
+	item := *index.Items["/data/file.txt"]
+	item.Mode = 0640
+	item.ModTime = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	item.Sha256Hash = hash[:]
+	target := filepath.Join(dest, "data", "file.txt")
+	require.NoError(t, os.MkdirAll(filepath.Dir(target), 0700))
+	noFirst := failingVault{StorageVault: vault, key: item.Content[0].Etag}
+	noChunks := failingVault{StorageVault: noFirst, key: item.Content[1].Etag}
+
+	tests := []struct {
+		name  string
+		old   string
+		vault storage_vault.StorageVault
+	}{
+		{"complete file is kept", "hello world", noChunks},
+		{"changed chunk is downloaded", "hello WORLD", noFirst},
+		{"missing chunk is downloaded", "hello ", noFirst},
+		{"extra bytes are cut", "hello world and more", noChunks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.NoError(t, os.WriteFile(target, []byte(tt.old), 0600))
+			require.NoError(t, client.RestoreItem(context.Background(), dest, item, tt.vault, nil, progress.NewProgress(time.Second)))
+			got, err := os.ReadFile(target)
+			require.NoError(t, err)
+			assert.Equal(t, "hello world", string(got))
+			fi, err := os.Stat(target)
+			require.NoError(t, err)
+			assert.Equal(t, fs.FileMode(0640), fi.Mode().Perm())
+			assert.True(t, fi.ModTime().Equal(item.ModTime))
+		})
+	}
+
+	// A file which can not be completed keeps its metadata.
+	require.NoError(t, os.WriteFile(target, []byte("HELLO world"), 0600))
+	require.NoError(t, os.Chmod(target, 0600))
+	err := client.RestoreItem(context.Background(), dest, item, noFirst, nil, progress.NewProgress(time.Second))
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+	fi, err := os.Stat(target)
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0600), fi.Mode().Perm())
+}
+
+func Test_changedChunks(t *testing.T) {
+	_, index := exportFixture("hello ", "world", "!")
+	item := index.Items["/data/file.txt"]
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	require.NoError(t, err)
+	defer file.Close()
+	_, err = file.WriteString("hello WORLD")
+	require.NoError(t, err)
+
+	c := &Client{}
+	assert.Equal(t, item.Content[1:], c.changedChunks(file, item))
+}
+
+func TestClient_RestoreItemInPlace(t *testing.T) {
+	setUp()
+	defer tearDown()
+	defer viper.Set("restore_delta", nil)
+
+	vault, index := exportFixture("hello ", "world")
+	hash := sha256.Sum256([]byte("hello world"))
+	dest := t.TempDir()
+	item := *index.Items["/data/file.txt"]
+	item.BasePath = dest
+	item.AbsolutePath = filepath.Join(dest, "file.txt")
+	item.RelativePath = "file.txt"
+	item.Mode = 0640
+	item.ModTime = time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	item.Sha256Hash = hash[:]
+
+	// The original file is restored in place, onto itself.
+	target := item.AbsolutePath
+	reset := func(content string) {
+		require.NoError(t, os.WriteFile(target, []byte(content), 0600))
+	}
+	assertUntouched := func(content string) {
+		got, err := os.ReadFile(target)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(got))
+		entries, err := os.ReadDir(dest)
+		require.NoError(t, err)
+		assert.Len(t, entries, 1, "temporary file left behind")
+	}
+
+	// A chunk which can not be read leaves the existing file as is.
+	reset("old content")
+	broken := failingVault{StorageVault: vault, key: item.Content[1].Etag}
+	err := client.RestoreItem(context.Background(), dest, item, broken, nil, progress.NewProgress(time.Second))
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+	assertUntouched("old content")
+
+	// So does content which does not match the recorded hash.
+	wrong := item
+	wrong.Sha256Hash = make([]byte, sha256.Size)
+	err = client.RestoreItem(context.Background(), dest, wrong, vault, nil, progress.NewProgress(time.Second))
+	assert.ErrorIs(t, err, ErrorRestoreMismatch)
+	assertUntouched("old content")
+
+	require.NoError(t, client.RestoreItem(context.Background(), dest, item, vault, nil, progress.NewProgress(time.Second)))
+	assertUntouched("hello world")
+	fi, err := os.Stat(target)
+	require.NoError(t, err)
+	assert.Equal(t, fs.FileMode(0640), fi.Mode().Perm())
+	assert.True(t, fi.ModTime().Equal(item.ModTime))
+
+	// With restore_delta, the chunks of the existing file are read from it
+	// while it is left untouched until the replacement is complete.
+	// Only the second chunk can be read from the vault.
+	viper.Set("restore_delta", true)
+	partial := failingVault{StorageVault: vault, key: item.Content[0].Etag}
+	reset("hello WORLD")
+	require.NoError(t, client.RestoreItem(context.Background(), dest, item, partial, nil, progress.NewProgress(time.Second)))
+	assertUntouched("hello world")
+
+	reset("HELLO world")
+	err = client.RestoreItem(context.Background(), dest, item, partial, nil, progress.NewProgress(time.Second))
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+	assertUntouched("HELLO world")
+}
+
+func TestClient_UploadFileStat(t *testing.T) {
+	setUp()
+	defer tearDown()
+	// Chunks are only known to be in the vault when addressed by content.
+	viper.Set("chunk_sha256", true)
+	defer viper.Set("chunk_sha256", nil)
+
+	pool, err := ants.NewPool(2)
+	require.NoError(t, err)
+	defer pool.Release()
+	vault := memory.New("vault", "")
+
+	dir := t.TempDir()
+	upload := func(name string, last *cache.Node) (*cache.Node, progress.Stat) {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err != nil {
+			require.NoError(t, os.WriteFile(path, []byte("hello world"), 0600))
+		}
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		item := &cache.Node{AbsolutePath: path, Type: "file", Size: uint64(fi.Size()), ModTime: fi.ModTime()}
+		p := progress.NewProgress(time.Second)
+		p.Start()
+		defer p.Done()
+		pipe := make(chan *cache.Chunk, 10)
+		_, err = client.UploadFile(context.Background(), pool, last, item, nil, vault, p, pipe, "rp", "bd", StableCheck{}, nil, cache.Chunking{}, "", nil, "")
+		require.NoError(t, err)
+		return item, p.Current()
+	}
+
+	first, stat := upload("first", nil)
+	assert.Equal(t, progress.Stat{Bytes: 11, Storage: 11, NewBytes: 11, ChangedBytes: 11}, stat)
+
+	// The chunks of a copy are already in the vault.
+	_, stat = upload("copy", nil)
+	assert.Equal(t, progress.Stat{Bytes: 11, Storage: 11, ChangedBytes: 11, DedupedBytes: 11}, stat)
+
+	// An unchanged file is scanned, not read.
+	_, stat = upload("first", first)
+	assert.Equal(t, progress.Stat{UnchangedBytes: 11}, stat)
+	assert.Equal(t, uint64(11), stat.ScannedBytes())
+}
+
+// skippingVault sends nothing for an object it holds already, as S3 does.
+type skippingVault struct {
+	*memory.Memory
+}
+
+func (v skippingVault) PutObject(ctx context.Context, key string, data []byte) error {
+	if exists, same, _, _ := v.VerifyObject(ctx, key, data); exists && same {
+		return nil
+	}
+	return v.Memory.PutObject(ctx, key, data)
+}
+
+func TestClient_UploadFileStatExisting(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	pool, err := ants.NewPool(2)
+	require.NoError(t, err)
+	defer pool.Release()
+	// Without chunk_sha256, the chunk is only found stored by the put.
+	vault := skippingVault{memory.New("vault", "")}
+
+	dir := t.TempDir()
+	upload := func(name string) progress.Stat {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("hello world"), 0600))
+		item := &cache.Node{AbsolutePath: path, Type: "file", Size: 11, ModTime: time.Now()}
+		p := progress.NewProgress(time.Second)
+		p.Start()
+		defer p.Done()
+		pipe := make(chan *cache.Chunk, 10)
+		_, err = client.UploadFile(context.Background(), pool, nil, item, nil, vault, p, pipe, "rp", "bd", StableCheck{}, nil, cache.Chunking{}, "", nil, "")
+		require.NoError(t, err)
+		return p.Current()
+	}
+
+	assert.Equal(t, progress.Stat{Bytes: 11, Storage: 11, NewBytes: 11, ChangedBytes: 11}, upload("first"))
+	assert.Equal(t, progress.Stat{Bytes: 11, Storage: 11, ChangedBytes: 11, DedupedBytes: 11}, upload("copy"))
+}
@@ -0,0 +1,102 @@
+package backupapi
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/spf13/viper"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+)
+
+// FileDedup records the files seen by a backup by their size and hash, those
+// read and those unchanged since the last backup, so that a changed file
+// identical to one seen before reuses its chunks instead of being chunked and
+// uploaded again. A nil FileDedup does nothing.
+type FileDedup struct {
+	hashAlgo string
+
+	mu    sync.Mutex
+	sizes map[uint64]bool
+	files map[fileKey]*cache.Node
+}
+
+type fileKey struct {
+	size uint64
+	hash string
+}
+
+// NewFileDedup returns an empty FileDedup of files hashed with hashAlgo.
+func NewFileDedup(hashAlgo string) *FileDedup {
+	return &FileDedup{
+		hashAlgo: hashAlgo,
+		sizes:    make(map[uint64]bool),
+		files:    make(map[fileKey]*cache.Node),
+	}
+}
+
+// FileDedupFromConfig returns the FileDedup of a backup hashing files with
+// hashAlgo, or nil unless dedup_files is set. It is off by default: a changed
+// file of the size of one seen before is read twice when it is no copy, once
+// to hash it and once to chunk it.
+func FileDedupFromConfig(hashAlgo string) *FileDedup {
+	if !viper.GetBool("dedup_files") {
+		return nil
+	}
+	return NewFileDedup(hashAlgo)
+}
+
+// store records the chunks of node, seen by the backup.
+func (d *FileDedup) store(node *cache.Node) {
+	if d == nil || node.Size == 0 || len(node.Sha256Hash) == 0 || node.HashAlgo != d.hashAlgo {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sizes[node.Size] = true
+	d.files[fileKey{size: node.Size, hash: string(node.Sha256Hash)}] = &cache.Node{
+		Content:    node.Content,
+		Sha256Hash: node.Sha256Hash,
+		HashAlgo:   node.HashAlgo,
+	}
+}
+
+// lookup returns the chunks of a file read before with the same content as
+// the one of size read from open. The file is only read when a file of the
+// same size was read before.
+func (d *FileDedup) lookup(size uint64, open func() (io.ReadCloser, error)) (*cache.Node, bool) {
+	if d == nil || size == 0 {
+		return nil, false
+	}
+	d.mu.Lock()
+	seen := d.sizes[size]
+	d.mu.Unlock()
+	if !seen {
+		return nil, false
+	}
+
+	file, err := open()
+	if err != nil {
+		return nil, false
+	}
+	defer file.Close()
+	hash, err := newFileHash(d.hashAlgo)
+	if err != nil {
+		return nil, false
+	}
+	// A file whose size changed since it was listed is read again.
+	if n, err := io.Copy(hash, file); err != nil || uint64(n) != size {
+		return nil, false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	node, ok := d.files[fileKey{size: size, hash: string(hash.Sum(nil))}]
+	return node, ok
+}
+
+// lookupFile is lookup of the file at path.
+func (c *Client) lookupFile(ctx context.Context, d *FileDedup, path string, size uint64) (*cache.Node, bool) {
+	return d.lookup(size, func() (io.ReadCloser, error) { return c.OpenFile(ctx, path) })
+}
@@ -0,0 +1,93 @@
+package backupapi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+func TestClient_UploadFileDedup(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	pool, err := ants.NewPool(2)
+	require.NoError(t, err)
+	defer pool.Release()
+	vault := memory.New("vault", "")
+	dedup := NewFileDedup("")
+
+	dir := t.TempDir()
+	upload := func(name, data string) (*cache.Node, uint64, []*cache.Chunk) {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(data), 0600))
+		item := &cache.Node{AbsolutePath: path, Type: "file", Size: uint64(len(data))}
+		pipe := make(chan *cache.Chunk, 10)
+		size, err := client.UploadFile(context.Background(), pool, nil, item, nil, vault, progress.NewProgress(time.Second), pipe, "rp", "bd", StableCheck{}, nil, cache.Chunking{}, "", dedup, "")
+		require.NoError(t, err)
+		close(pipe)
+		var chunks []*cache.Chunk
+		for chunk := range pipe {
+			chunks = append(chunks, chunk)
+		}
+		return item, size, chunks
+	}
+
+	first, size, _ := upload("first", "hello world")
+	require.NotEmpty(t, first.Content)
+	assert.NotZero(t, size)
+
+	// A copy reuses the chunks of the first file, nothing is uploaded.
+	copied, size, chunks := upload("copy", "hello world")
+	assert.Equal(t, first.Content, copied.Content)
+	assert.Equal(t, first.Sha256Hash, copied.Sha256Hash)
+	assert.Zero(t, size)
+	require.Len(t, chunks, 1)
+	assert.Contains(t, chunks[0].Chunks, first.Content[0].Etag)
+
+	// A file of the same size but another content is read.
+	other, _, _ := upload("other", "hello there")
+	assert.NotEqual(t, first.Sha256Hash, other.Sha256Hash)
+	assert.NotEqual(t, first.Content, other.Content)
+	assert.Equal(t, "", verifyFile(other.AbsolutePath, other))
+
+	// A file unchanged since the last backup is not read, a copy of it reuses
+	// its chunks all the same.
+	path := filepath.Join(dir, "unchanged")
+	require.NoError(t, os.WriteFile(path, []byte("hello again"), 0600))
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	last, _, _ := upload("last", "hello again")
+	item := &cache.Node{AbsolutePath: path, Type: "file", Size: last.Size, ModTime: fi.ModTime()}
+	lastInfo := &cache.Node{Size: last.Size, ModTime: fi.ModTime(), Content: last.Content, Sha256Hash: last.Sha256Hash}
+	dedup = NewFileDedup("")
+	pipe := make(chan *cache.Chunk, 10)
+	_, err = client.UploadFile(context.Background(), pool, lastInfo, item, nil, vault, progress.NewProgress(time.Second), pipe, "rp", "bd", StableCheck{}, nil, cache.Chunking{}, "", dedup, "")
+	require.NoError(t, err)
+	copied, size, _ = upload("copy of unchanged", "hello again")
+	assert.Equal(t, last.Content, copied.Content)
+	assert.Zero(t, size)
+}
+
+func TestFileDedupFromConfig(t *testing.T) {
+	assert.Nil(t, FileDedupFromConfig(""), "off by default")
+	viper.Set("dedup_files", true)
+	defer viper.Set("dedup_files", nil)
+	assert.NotNil(t, FileDedupFromConfig(""))
+
+	// A nil FileDedup holds nothing.
+	var dedup *FileDedup
+	dedup.store(&cache.Node{Size: 1, Sha256Hash: []byte{1}})
+	_, ok := dedup.lookup(1, nil)
+	assert.False(t, ok)
+}
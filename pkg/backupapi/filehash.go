@@ -0,0 +1,55 @@
+package backupapi
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/spf13/viper"
+	"lukechampine.com/blake3"
+)
+
+// Values of hash_algo.
+const (
+	HashSHA256 = "sha256"
+	HashBlake3 = "blake3"
+)
+
+// ErrorUnknownHash is returned for a file hashed with an algorithm this agent
+// does not know.
+var ErrorUnknownHash = errors.New("unknown hash algorithm")
+
+// FileHashFromConfig returns the hash_algo files are hashed with, as recorded
+// in the index: empty for sha256, the default.
+func FileHashFromConfig() (string, error) {
+	switch algo := viper.GetString("hash_algo"); algo {
+	case "", HashSHA256:
+		return "", nil
+	case HashBlake3:
+		return HashBlake3, nil
+	default:
+		return "", fmt.Errorf("%w: hash_algo %q", ErrorInvalidConfig, algo)
+	}
+}
+
+// newFileHash returns the hash of files recorded with algo, sha256 when empty.
+func newFileHash(algo string) (hash.Hash, error) {
+	switch algo {
+	case "", HashSHA256:
+		return sha256.New(), nil
+	case HashBlake3:
+		return blake3.New(32, nil), nil
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrorUnknownHash, algo)
+	}
+}
+
+// HashName returns the name of algo, sha256 when empty, for messages and
+// listings.
+func HashName(algo string) string {
+	if algo == "" {
+		return HashSHA256
+	}
+	return algo
+}
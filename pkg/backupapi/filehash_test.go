@@ -0,0 +1,132 @@
+package backupapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"lukechampine.com/blake3"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+func TestFileHashFromConfig(t *testing.T) {
+	tests := []struct {
+		algo    string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{HashSHA256, "", false},
+		{HashBlake3, HashBlake3, false},
+		{"md5", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.algo, func(t *testing.T) {
+			viper.Set("hash_algo", tt.algo)
+			defer viper.Set("hash_algo", nil)
+
+			got, err := FileHashFromConfig()
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrorInvalidConfig)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestClient_VerifyBlake3(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault, index := exportFixture("hello ", "world")
+	hash := blake3.Sum256([]byte("hello world"))
+	node := index.Items["/data/file.txt"]
+	node.Mode = 0600
+	node.Sha256Hash, node.HashAlgo = hash[:], HashBlake3
+
+	verified, mismatches, err := client.VerifyBackup(context.Background(), index, vault, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, verified)
+	assert.Empty(t, mismatches)
+
+	dest := t.TempDir()
+	require.NoError(t, client.RestoreDirectory(context.Background(), *index, dest, false, RestoreProfile{}, vault, nil, progress.NewProgress(time.Second)))
+	verified, mismatches, err = client.VerifyRestore(context.Background(), *index, dest)
+	require.NoError(t, err)
+	assert.Equal(t, 1, verified)
+	assert.Empty(t, mismatches)
+	target := filepath.Join(dest, "data/file.txt")
+	assert.True(t, sameContent(target, node.Size, node))
+
+	// The sha256 hash of the file does not pass for its blake3 hash.
+	sha := sha256.Sum256([]byte("hello world"))
+	node.Sha256Hash = sha[:]
+	_, mismatches, err = client.VerifyBackup(context.Background(), index, vault, 1)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Contains(t, mismatches[0].Reason, HashBlake3)
+	assert.False(t, sameContent(target, node.Size, node))
+
+	node.HashAlgo = "md5"
+	_, mismatches, err = client.VerifyRestore(context.Background(), *index, dest)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Contains(t, mismatches[0].Reason, ErrorUnknownHash.Error())
+}
+
+func TestClient_ChunkFileToBackupHashAlgo(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	// Nothing is uploaded by a dry run, the file is still read and hashed.
+	viper.Set("dry_run", true)
+	defer viper.Set("dry_run", nil)
+	pool, err := ants.NewPool(2)
+	require.NoError(t, err)
+	defer pool.Release()
+
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, []byte("hello world"), 0600))
+	vault, _ := exportFixture()
+
+	for _, algo := range []string{"", HashBlake3} {
+		item := &cache.Node{AbsolutePath: path, Type: "file", Size: 11}
+		pipe := make(chan *cache.Chunk, 10)
+		_, err := client.ChunkFileToBackup(context.Background(), pool, item, nil, vault, progress.NewProgress(time.Second), pipe, "rp", "bd", cache.Chunking{}, algo, "")
+		require.NoError(t, err)
+		assert.Equal(t, algo, item.HashAlgo)
+		assert.Equal(t, "", verifyFile(path, item))
+	}
+}
+
+// BenchmarkFileHash compares the hashing of files with sha256 and blake3.
+func BenchmarkFileHash(b *testing.B) {
+	data := make([]byte, 32<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	for _, algo := range []string{HashSHA256, HashBlake3} {
+		b.Run(algo, func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				hash, err := newFileHash(algo)
+				if err != nil {
+					b.Fatal(err)
+				}
+				hash.Write(data)
+				hash.Sum(nil)
+			}
+		})
+	}
+}
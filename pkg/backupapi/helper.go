@@ -12,6 +12,10 @@ import (
 	"github.com/dustin/go-humanize"
 )
 
+// ErrorNotFound is returned when the backup service does not know the
+// resource asked for.
+var ErrorNotFound = errors.New("not found")
+
 // NewProgressWriter returns new progress writer.
 func NewProgressWriter(out io.Writer) *ProgressWriter {
 	return &ProgressWriter{w: out}
@@ -47,6 +51,9 @@ func checkResponse(resp *http.Response) error {
 	var buf bytes.Buffer
 	_, _ = io.Copy(&buf, resp.Body)
 
+	if resp.StatusCode == http.StatusNotFound {
+		return fmt.Errorf("%w: %s", ErrorNotFound, buf.String())
+	}
 	return errors.New(buf.String())
 }
 
@@ -0,0 +1,111 @@
+package backupapi
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+// RepairMetadata applies the mode, owner and times recorded in index to the
+// items already under destDir, without reading anything from the storage
+// vault. Files are only repaired when their size and the hash recorded with
+// the file match the index, links when they point to the recorded target; links keep their own
+// metadata. It returns the number of items repaired and the ones which could
+// not be, which need a full restore.
+func (c *Client) RepairMetadata(ctx context.Context, index cache.Index, destDir string, p *progress.Progress) (int, []Mismatch, error) {
+	// Children come before their directory, so that a directory made read
+	// only does not stop the repair of its content.
+	paths := make([]string, 0, len(index.Items))
+	for path := range index.Items {
+		paths = append(paths, path)
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(paths)))
+
+	var repaired int
+	var mismatches []Mismatch
+	for _, path := range paths {
+		select {
+		case <-ctx.Done():
+			return repaired, mismatches, ErrorGotCancelRequest
+		default:
+		}
+		item := index.Items[path]
+		target, toDevice := restorePath(destDir, item)
+		if !toDevice {
+			if err := checkRestoreParents(destDir, target); err != nil {
+				return repaired, mismatches, err
+			}
+		}
+		reason := metadataMismatch(target, item)
+		p.Report(progress.Stat{Items: 1, Bytes: item.Size, Errors: reason != ""})
+		if reason != "" {
+			c.logger.Warn("Content differs from backup, metadata not repaired", zap.String("path", target), zap.String("reason", reason))
+			mismatches = append(mismatches, Mismatch{Path: target, Reason: reason})
+			continue
+		}
+		// A device keeps its own metadata, a link the metadata of its target.
+		if toDevice || item.Type == "symlink" {
+			continue
+		}
+		if err := c.applyMetadata(target, *item); err != nil {
+			return repaired, mismatches, err
+		}
+		repaired++
+	}
+	return repaired, mismatches, nil
+}
+
+// metadataMismatch returns why the item at path can not have the metadata of
+// item applied, or "" when its content matches.
+func metadataMismatch(path string, item *cache.Node) string {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return err.Error()
+	}
+	switch item.Type {
+	case "dir":
+		if !fi.IsDir() {
+			return "not a directory"
+		}
+	case "symlink":
+		if fi.Mode()&os.ModeSymlink == 0 {
+			return "not a symlink"
+		}
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err.Error()
+		}
+		if target != item.LinkTarget {
+			return fmt.Sprintf("link to %s, expected %s", target, item.LinkTarget)
+		}
+	default:
+		return verifyFile(path, item)
+	}
+	return ""
+}
+
+// applyMetadata sets the mode, owner, security descriptor and times of item
+// on path.
+func (c *Client) applyMetadata(path string, item cache.Node) error {
+	if err := os.Chmod(path, item.Mode); err != nil {
+		c.logger.Error("err ", zap.Error(err))
+		return err
+	}
+	if err := c.chown(path, int(item.UID), int(item.GID)); err != nil {
+		return err
+	}
+	if err := c.restoreSecurity(path, item); err != nil {
+		return err
+	}
+	if err := os.Chtimes(path, item.AccessTime, item.ModTime); err != nil {
+		c.logger.Error("err ", zap.Error(err))
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package backupapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+func TestClient_RepairMetadata(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	index := cache.NewIndex("bd", "rp")
+	node := func(typ, rel string, mode os.FileMode, content string) *cache.Node {
+		hash := sha256.Sum256([]byte(content))
+		n := &cache.Node{
+			Type:         typ,
+			RelativePath: rel,
+			Mode:         mode,
+			UID:          uint32(os.Getuid()),
+			GID:          uint32(os.Getgid()),
+			AccessTime:   mtime,
+			ModTime:      mtime,
+			Size:         uint64(len(content)),
+			Sha256Hash:   hash[:],
+		}
+		index.Items["/"+rel] = n
+		return n
+	}
+	node("dir", "data", 0750, "")
+	node("file", "data/file.txt", 0640, "hello world")
+	node("file", "data/changed.txt", 0640, "hello world")
+	node("symlink", "data/link", 0777, "").LinkTarget = "file.txt"
+	node("file", "data/missing.txt", 0640, "hello world")
+
+	dest := t.TempDir()
+	dir := filepath.Join(dest, "data")
+	require.NoError(t, os.Mkdir(dir, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), []byte("hello world"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "changed.txt"), []byte("hello WORLD"), 0600))
+	require.NoError(t, os.Symlink("file.txt", filepath.Join(dir, "link")))
+
+	repaired, mismatches, err := client.RepairMetadata(context.Background(), *index, dest, progress.NewProgress(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 2, repaired)
+	require.Len(t, mismatches, 2)
+	assert.Equal(t, filepath.Join(dir, "missing.txt"), mismatches[0].Path)
+	assert.Contains(t, mismatches[0].Reason, "no such file")
+	assert.Equal(t, filepath.Join(dir, "changed.txt"), mismatches[1].Path)
+	assert.Contains(t, mismatches[1].Reason, "sha256")
+
+	for path, mode := range map[string]os.FileMode{dir: 0750, filepath.Join(dir, "file.txt"): 0640} {
+		fi, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, mode, fi.Mode().Perm(), path)
+		assert.True(t, fi.ModTime().Equal(mtime), path)
+	}
+	fi, err := os.Stat(filepath.Join(dir, "changed.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+}
@@ -0,0 +1,242 @@
+package backupapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/naming"
+)
+
+var (
+	ErrorMigrationVerify     = errors.New("migrated object does not match source")
+	ErrorMigrationIncomplete = errors.New("chunks referenced by indexes missing on destination")
+)
+
+// MigrateResult is the outcome of a storage vault migration.
+type MigrateResult struct {
+	Objects uint64 `json:"objects"`
+	Copied  uint64 `json:"copied"`
+	Skipped uint64 `json:"skipped"`
+	Bytes   uint64 `json:"bytes"`
+	Indexes int    `json:"indexes"`
+	Chunks  int    `json:"chunks"`
+}
+
+// MigrateVault copies every object of src to dst as it is listed, and checks
+// each copy on dst. Objects already on dst with the ETag they have on src are
+// skipped, so an interrupted migration is resumed by running it again. Once
+// all objects are copied, every chunk referenced by an index is checked to be
+// on dst.
+//
+// Objects are copied under their names in src, as stored, so dst must not
+// be wrapped by naming. The indexes are read as configured by
+// vault_object_naming and vault_encrypt_index.
+func (c *Client) MigrateVault(ctx context.Context, src, dst storage_vault.StorageVault, p *progress.Progress) (*MigrateResult, error) {
+	lister, ok := src.(storage_vault.ObjectLister)
+	if !ok {
+		return nil, fmt.Errorf("list objects of source: %w", storage_vault.ErrNotSupported)
+	}
+	view, err := naming.FromConfig(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	numGoroutine := viper.GetInt("num_goroutine")
+	if numGoroutine == 0 {
+		numGoroutine = int(float64(runtime.NumCPU()) * 0.2)
+		if numGoroutine <= 1 {
+			numGoroutine = 2
+		}
+	}
+	sem := semaphore.NewWeighted(int64(numGoroutine))
+	group, gctx := errgroup.WithContext(ctx)
+
+	p.Start()
+	var mu sync.Mutex
+	result := &MigrateResult{}
+	var indexes []string
+	err = lister.ListObjects(gctx, "", func(key string) error {
+		if err := sem.Acquire(gctx, 1); err != nil {
+			return ErrorGotCancelRequest
+		}
+		if name := path.Base(key); name == cache.Type(cache.INDEX).String() || name == cache.Type(cache.INDEX_DELTA).String() || cache.IsIndexShard(name) {
+			mu.Lock()
+			indexes = append(indexes, key)
+			mu.Unlock()
+		}
+		group.Go(func() error {
+			defer sem.Release(1)
+			copied, size, err := c.migrateObject(gctx, src, dst, key)
+			if err != nil {
+				c.logger.Error("Migrate object error ", zap.Error(err), zap.String("key", key))
+				p.Report(progress.Stat{Errors: true})
+				return err
+			}
+			mu.Lock()
+			result.Objects++
+			if copied {
+				result.Copied++
+				result.Bytes += size
+			} else {
+				result.Skipped++
+			}
+			mu.Unlock()
+			stat := progress.Stat{Items: 1, ItemName: []string{key}}
+			if copied {
+				stat.Bytes = size
+				stat.Storage = size
+			}
+			p.Report(stat)
+			return nil
+		})
+		return nil
+	})
+	// A failed copy cancels the listing, the failure is what to report.
+	if werr := group.Wait(); werr != nil && (err == nil || errors.Is(err, ErrorGotCancelRequest)) {
+		err = werr
+	}
+	if err == nil && ctx.Err() != nil {
+		err = ErrorGotCancelRequest
+	}
+	if err != nil {
+		p.Cancel()
+		return result, err
+	}
+
+	sort.Strings(indexes)
+	result.Indexes = len(indexes)
+	if result.Chunks, err = c.checkMigratedChunks(ctx, view, indexes); err != nil {
+		p.Cancel()
+		return result, err
+	}
+	p.Done()
+	return result, nil
+}
+
+// migrateObject copies key from src to dst unless dst already holds it with
+// the same ETag, and reports whether it was copied and its size.
+func (c *Client) migrateObject(ctx context.Context, src, dst storage_vault.StorageVault, key string) (bool, uint64, error) {
+	exists, dstETag, err := dst.HeadObject(ctx, key)
+	if err != nil && !isNotFound(err) {
+		return false, 0, err
+	}
+	if exists {
+		_, srcETag, err := src.HeadObject(ctx, key)
+		if err != nil {
+			return false, 0, err
+		}
+		if srcETag != "" && srcETag == dstETag {
+			return false, 0, nil
+		}
+	}
+
+	data, err := src.GetObject(ctx, key)
+	if err != nil {
+		return false, 0, err
+	}
+	if err := c.PutObject(ctx, dst, key, data); err != nil {
+		return false, 0, err
+	}
+	if err := verifyMigratedObject(ctx, dst, key, data); err != nil {
+		return false, 0, err
+	}
+	return true, uint64(len(data)), nil
+}
+
+// verifyMigratedObject checks that dst holds data under key, with VerifyObject
+// when dst supports it. Objects whose ETag is not their MD5, such as
+// encrypted ones, are read back and compared.
+func verifyMigratedObject(ctx context.Context, dst storage_vault.StorageVault, key string, data []byte) error {
+	if verifier, ok := dst.(storage_vault.ObjectVerifier); ok {
+		exists, integrity, _, err := verifier.VerifyObject(ctx, key, data)
+		if err != nil && !errors.Is(err, storage_vault.ErrNotSupported) {
+			return err
+		}
+		if err == nil && !exists {
+			return fmt.Errorf("%w: %s not found", ErrorMigrationVerify, key)
+		}
+		if err == nil && integrity {
+			return nil
+		}
+	}
+	stored, err := dst.GetObject(ctx, key)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stored, data) {
+		return fmt.Errorf("%w: %s", ErrorMigrationVerify, key)
+	}
+	return nil
+}
+
+// checkMigratedChunks checks that every chunk referenced by the indexes is in
+// view, and returns the number of chunks referenced.
+func (c *Client) checkMigratedChunks(ctx context.Context, view storage_vault.StorageVault, indexes []string) (int, error) {
+	chunks := make(map[string]bool)
+	for _, key := range indexes {
+		buf, err := view.GetObject(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+		var items map[string]*cache.Node
+		if path.Base(key) == cache.Type(cache.INDEX_DELTA).String() {
+			var delta cache.IndexDelta
+			if err := json.Unmarshal(buf, &delta); err != nil {
+				return 0, fmt.Errorf("%s: %w", key, err)
+			}
+			items = delta.Upserted
+		} else {
+			var index cache.Index
+			if err := json.Unmarshal(buf, &index); err != nil {
+				return 0, fmt.Errorf("%s: %w", key, err)
+			}
+			items = index.Items
+		}
+		for _, node := range items {
+			for _, chunk := range node.Content {
+				chunks[chunk.Etag] = true
+			}
+		}
+	}
+
+	var missing []string
+	for key := range chunks {
+		if ctx.Err() != nil {
+			return 0, ErrorGotCancelRequest
+		}
+		exists, _, err := view.HeadObject(ctx, key)
+		if err != nil && !isNotFound(err) {
+			return 0, err
+		}
+		if !exists {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		c.logger.Error("Chunks referenced by indexes are missing on destination", zap.Strings("keys", missing))
+		return 0, fmt.Errorf("%w: %d of %d, e.g. %s", ErrorMigrationIncomplete, len(missing), len(chunks), missing[0])
+	}
+	return len(chunks), nil
+}
+
+func isNotFound(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && (aerr.Code() == "NotFound" || aerr.Code() == "NoSuchKey")
+}
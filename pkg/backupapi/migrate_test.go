@@ -0,0 +1,113 @@
+package backupapi
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/fault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+// migrateFixture returns a vault holding a full index and a delta index,
+// whose chunks are all stored.
+func migrateFixture(t *testing.T) *memory.Memory {
+	src, index := exportFixture("hello ", "world")
+	buf, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, src.PutObject(context.Background(), "machine/rp/index.json", buf))
+
+	key := chunkKey([]byte("again"))
+	require.NoError(t, src.PutObject(context.Background(), key, []byte("again")))
+	delta := cache.IndexDelta{
+		RecoveryPointID:       "rp2",
+		ParentRecoveryPointID: "rp",
+		Upserted: map[string]*cache.Node{
+			"/data/other.txt": {Type: "file", Content: []*cache.ChunkInfo{{Length: 5, Etag: key}}},
+		},
+	}
+	buf, err = json.Marshal(delta)
+	require.NoError(t, err)
+	require.NoError(t, src.PutObject(context.Background(), "machine/rp2/index_delta.json", buf))
+	return src
+}
+
+func TestClient_MigrateVault(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	src := migrateFixture(t)
+	dst := memory.New("dest", "")
+	result, err := client.MigrateVault(context.Background(), src, dst, nil)
+	require.NoError(t, err)
+	assert.Equal(t, src.Keys(), dst.Keys())
+	assert.Equal(t, uint64(5), result.Objects)
+	assert.Equal(t, uint64(5), result.Copied)
+	assert.Equal(t, 2, result.Indexes)
+	assert.Equal(t, 3, result.Chunks)
+	for _, key := range src.Keys() {
+		want, _ := src.GetObject(context.Background(), key)
+		got, _ := dst.GetObject(context.Background(), key)
+		assert.Equal(t, want, got, key)
+	}
+
+	// Run again after an interruption, only the objects missing or different
+	// on the destination are copied.
+	key := chunkKey([]byte("world"))
+	require.NoError(t, dst.PutObject(context.Background(), key, []byte("wor")))
+	inner := memory.New("dest", "")
+	for _, k := range dst.Keys() {
+		data, _ := dst.GetObject(context.Background(), k)
+		if k != "machine/rp2/index_delta.json" {
+			require.NoError(t, inner.PutObject(context.Background(), k, data))
+		}
+	}
+	resumed := fault.New(inner)
+	result, err = client.MigrateVault(context.Background(), src, resumed, nil)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), result.Skipped)
+	assert.Equal(t, uint64(2), result.Copied)
+	assert.Equal(t, 2, resumed.Calls(fault.OpPut))
+	data, err := inner.GetObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("world"), data)
+}
+
+func TestClient_MigrateVaultVerify(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	// A copy reading back differently fails the migration.
+	src := migrateFixture(t)
+	dst := fault.New(memory.New("dest", "")).Inject(fault.Fault{Op: fault.OpGet, Key: "machine/rp/index.json", Truncate: 1})
+	_, err := client.MigrateVault(context.Background(), src, dst, nil)
+	assert.ErrorIs(t, err, ErrorMigrationVerify)
+}
+
+func TestClient_MigrateVaultMissingChunk(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	// A chunk missing on the source is reported once everything is copied.
+	src := migrateFixture(t)
+	src2 := memory.New("vault", "")
+	missing := chunkKey([]byte("again"))
+	for _, key := range src.Keys() {
+		if key != missing {
+			data, _ := src.GetObject(context.Background(), key)
+			require.NoError(t, src2.PutObject(context.Background(), key, data))
+		}
+	}
+	result, err := client.MigrateVault(context.Background(), src2, memory.New("dest", ""), nil)
+	assert.ErrorIs(t, err, ErrorMigrationIncomplete)
+	assert.Contains(t, err.Error(), missing)
+	assert.Equal(t, uint64(4), result.Copied)
+
+	// The source must be listable.
+	_, err = client.MigrateVault(context.Background(), fault.New(src), memory.New("dest", ""), nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,110 @@
+package backupapi
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/spf13/viper"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/support"
+)
+
+// Values of trust_mtime.
+const (
+	TrustMtimeAlways  = "true"
+	TrustMtimeNever   = "false"
+	TrustMtimeNetwork = "network"
+)
+
+// MtimeCheck tells whether the modification time of a file is trusted to
+// find out it did not change since the last backup. An untrusted file is
+// compared by size and the hash recorded with the file, which reads it in full. A nil MtimeCheck
+// trusts every file.
+type MtimeCheck struct {
+	// Trust is one of the values of trust_mtime.
+	Trust string
+
+	isNetworkFS func(path string) (bool, error)
+
+	mu      sync.Mutex
+	devices map[uint64]bool
+}
+
+// MtimeCheckFromConfig returns the mtime check of bd, whose trust_mtime takes
+// precedence over the global one. bd may be nil.
+func MtimeCheckFromConfig(bd *BackupDirectoryConfig) (*MtimeCheck, error) {
+	trust := TrustMtimeAlways
+	if viper.IsSet("trust_mtime") {
+		trust = viper.GetString("trust_mtime")
+	}
+	if bd != nil && bd.TrustMtime != "" {
+		trust = bd.TrustMtime
+	}
+	switch trust {
+	case TrustMtimeAlways, TrustMtimeNever, TrustMtimeNetwork:
+	default:
+		return nil, fmt.Errorf("%w: trust_mtime %q", ErrorInvalidConfig, trust)
+	}
+	return &MtimeCheck{Trust: trust, isNetworkFS: support.IsNetworkFS, devices: make(map[uint64]bool)}, nil
+}
+
+// Trusted reports whether the modification time of the file at path is
+// trusted. With the network policy, the filesystem of each device is looked
+// up once; a file whose filesystem cannot be told is not trusted.
+func (m *MtimeCheck) Trusted(path string) bool {
+	if m == nil || m.Trust == TrustMtimeAlways {
+		return true
+	}
+	if m.Trust == TrustMtimeNever {
+		return false
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return false
+	}
+	dev, ok := support.DeviceID(fi)
+	if ok {
+		m.mu.Lock()
+		network, known := m.devices[dev]
+		m.mu.Unlock()
+		if known {
+			return !network
+		}
+	}
+	network, err := m.isNetworkFS(path)
+	if err != nil {
+		return false
+	}
+	if ok {
+		m.mu.Lock()
+		m.devices[dev] = network
+		m.mu.Unlock()
+	}
+	return !network
+}
+
+// sameContent reports whether the file at path has the size and hash recorded
+// in node.
+func sameContent(path string, size uint64, node *cache.Node) bool {
+	if size != node.Size || len(node.Sha256Hash) == 0 {
+		return false
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	hash, err := newFileHash(node.HashAlgo)
+	if err != nil {
+		return false
+	}
+	if _, err := io.Copy(hash, file); err != nil {
+		return false
+	}
+	return bytes.Equal(hash.Sum(nil), node.Sha256Hash)
+}
@@ -0,0 +1,134 @@
+package backupapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/panjf2000/ants/v2"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+	"github.com/bizflycloud/bizfly-backup/pkg/support"
+)
+
+func TestMtimeCheckFromConfig(t *testing.T) {
+	defer viper.Set("trust_mtime", nil)
+
+	var bd BackupDirectoryConfig
+	require.NoError(t, yaml.Unmarshal([]byte("id: bd\ntrust_mtime: false\n"), &bd))
+	assert.Equal(t, TrustMtimeNever, bd.TrustMtime)
+
+	tests := []struct {
+		name    string
+		global  interface{}
+		bd      *BackupDirectoryConfig
+		want    string
+		wantErr bool
+	}{
+		{"default", nil, nil, TrustMtimeAlways, false},
+		{"global", false, nil, TrustMtimeNever, false},
+		{"directory override", false, &BackupDirectoryConfig{TrustMtime: TrustMtimeNetwork}, TrustMtimeNetwork, false},
+		{"directory flagged", nil, &bd, TrustMtimeNever, false},
+		{"invalid", "sometimes", nil, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			viper.Set("trust_mtime", tt.global)
+			got, err := MtimeCheckFromConfig(tt.bd)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrorInvalidConfig)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.Trust)
+		})
+	}
+}
+
+func TestMtimeCheckTrusted(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	b := filepath.Join(dir, "b")
+	require.NoError(t, os.WriteFile(a, nil, 0600))
+	require.NoError(t, os.WriteFile(b, nil, 0600))
+
+	var nilCheck *MtimeCheck
+	assert.True(t, nilCheck.Trusted(a))
+	assert.False(t, (&MtimeCheck{Trust: TrustMtimeNever}).Trusted(a))
+
+	lookups := 0
+	check, err := MtimeCheckFromConfig(&BackupDirectoryConfig{TrustMtime: TrustMtimeNetwork})
+	require.NoError(t, err)
+	check.isNetworkFS = func(path string) (bool, error) {
+		lookups++
+		return true, nil
+	}
+	assert.False(t, check.Trusted(a))
+	assert.False(t, check.Trusted(b))
+	// Files of the same device are looked up once.
+	if fi, err := os.Lstat(a); err == nil {
+		if _, ok := support.DeviceID(fi); ok {
+			assert.Equal(t, 1, lookups)
+		}
+	}
+
+	// A filesystem which cannot be told is not trusted.
+	check, err = MtimeCheckFromConfig(&BackupDirectoryConfig{TrustMtime: TrustMtimeNetwork})
+	require.NoError(t, err)
+	check.isNetworkFS = func(path string) (bool, error) { return false, errors.New("statfs") }
+	assert.False(t, check.Trusted(a))
+	check.isNetworkFS = func(path string) (bool, error) { return false, nil }
+	assert.True(t, check.Trusted(a))
+}
+
+func TestClient_UploadFileUntrustedMtime(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	pool, err := ants.NewPool(2)
+	require.NoError(t, err)
+	defer pool.Release()
+
+	// The content changes while the size and mtime stay the same, as seen on
+	// some network filesystems.
+	path := filepath.Join(t.TempDir(), "file.txt")
+	old := []byte("hello world")
+	hash := sha256.Sum256(old)
+	require.NoError(t, os.WriteFile(path, []byte("HELLO WORLD"), 0600))
+	mtime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+	last := &cache.Node{AbsolutePath: path, ModTime: mtime, Size: uint64(len(old)), Sha256Hash: hash[:],
+		Content: []*cache.ChunkInfo{{Length: uint(len(old)), Etag: "old"}}}
+
+	upload := func(trust *MtimeCheck) *cache.Node {
+		item := &cache.Node{Type: "file", AbsolutePath: path, ModTime: mtime, Size: uint64(len(old))}
+		pipe := make(chan *cache.Chunk, 4)
+		_, err := client.UploadFile(context.Background(), pool, last, item, nil, memory.New("vault", ""), progress.NewProgress(time.Second), pipe, "rp", "bd", StableCheck{}, trust, cache.Chunking{}, "", nil, "")
+		require.NoError(t, err)
+		return item
+	}
+
+	// Trusting the mtime keeps the recorded content.
+	assert.Equal(t, last.Content, upload(nil).Content)
+
+	// Without trust, the file is compared by content and read again.
+	item := upload(&MtimeCheck{Trust: TrustMtimeNever})
+	require.Len(t, item.Content, 1)
+	assert.NotEqual(t, "old", item.Content[0].Etag)
+	assert.NotEqual(t, last.Sha256Hash, item.Sha256Hash)
+
+	// Unchanged content is still reused.
+	require.NoError(t, os.WriteFile(path, old, 0600))
+	require.NoError(t, os.Chtimes(path, mtime, mtime))
+	assert.Equal(t, last.Content, upload(&MtimeCheck{Trust: TrustMtimeNever}).Content)
+}
@@ -0,0 +1,55 @@
+package backupapi
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// ClassRule places the chunks of the files matching Pattern in storage class
+// Class. A pattern without a slash matches the base name of a file, e.g.
+// "*.mp4", one with a slash matches its whole path, e.g. "/etc/*".
+type ClassRule struct {
+	Pattern string `json:"pattern" mapstructure:"pattern"`
+	Class   string `json:"class" mapstructure:"class"`
+}
+
+// ClassRules are the rules of storage_class_rules, the first match wins.
+type ClassRules []ClassRule
+
+// ClassRulesFromConfig returns the rules of storage_class_rules.
+func ClassRulesFromConfig() (ClassRules, error) {
+	var rules ClassRules
+	if err := viper.UnmarshalKey("storage_class_rules", &rules); err != nil {
+		return nil, fmt.Errorf("%w: storage_class_rules: %s", ErrorInvalidConfig, err)
+	}
+	for _, rule := range rules {
+		if _, err := path.Match(rule.Pattern, ""); err != nil || rule.Pattern == "" {
+			return nil, fmt.Errorf("%w: storage class pattern %q", ErrorInvalidConfig, rule.Pattern)
+		}
+		if rule.Class == "" {
+			return nil, fmt.Errorf("%w: no storage class for pattern %q", ErrorInvalidConfig, rule.Pattern)
+		}
+	}
+	return rules, nil
+}
+
+// Class returns the storage class of the chunks of the file at name, "" for
+// the class of the vault when no rule matches.
+func (r ClassRules) Class(name string) string {
+	name = filepath.ToSlash(name)
+	base := path.Base(name)
+	for _, rule := range r {
+		target := base
+		if strings.Contains(rule.Pattern, "/") {
+			target = name
+		}
+		if ok, _ := path.Match(rule.Pattern, target); ok {
+			return rule.Class
+		}
+	}
+	return ""
+}
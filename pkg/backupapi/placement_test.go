@@ -0,0 +1,71 @@
+package backupapi
+
+import (
+	"context"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+func TestClassRulesFromConfig(t *testing.T) {
+	defer viper.Set("storage_class_rules", nil)
+
+	rules, err := ClassRulesFromConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "", rules.Class("/etc/app.conf"))
+
+	viper.Set("storage_class_rules", []map[string]interface{}{
+		{"pattern": "/etc/*", "class": "STANDARD"},
+		{"pattern": "*.mp4", "class": "GLACIER_IR"},
+		{"pattern": "*.conf", "class": "STANDARD"},
+	})
+	rules, err = ClassRulesFromConfig()
+	require.NoError(t, err)
+	assert.Equal(t, "STANDARD", rules.Class("/etc/movie.mp4"))
+	assert.Equal(t, "GLACIER_IR", rules.Class("/home/user/movie.mp4"))
+	assert.Equal(t, "STANDARD", rules.Class("/srv/app.conf"))
+	assert.Equal(t, "", rules.Class("/srv/app.log"))
+
+	viper.Set("storage_class_rules", []map[string]interface{}{{"pattern": "[", "class": "STANDARD"}})
+	_, err = ClassRulesFromConfig()
+	assert.ErrorIs(t, err, ErrorInvalidConfig)
+
+	viper.Set("storage_class_rules", []map[string]interface{}{{"pattern": "*.mp4"}})
+	_, err = ClassRulesFromConfig()
+	assert.ErrorIs(t, err, ErrorInvalidConfig)
+}
+
+func TestClient_backupChunkClass(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault := memory.New("vault", "")
+	pipe := make(chan *cache.Chunk, 2)
+	data := []byte("media")
+
+	chunk := &cache.ChunkInfo{Length: uint(len(data))}
+	_, _, err := client.backupChunk(context.Background(), data, chunk, nil, vault, pipe, "rp", "bd", "GLACIER")
+	require.NoError(t, err)
+	uploaded := <-pipe
+	key := chunk.Etag
+	assert.Equal(t, map[string]string{key: "GLACIER"}, uploaded.Classes)
+	assert.Equal(t, map[string]string{key: "GLACIER"}, uploaded.Uploaded)
+	info, err := vault.InspectObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, "GLACIER", info.StorageClass)
+
+	// A chunk known to be stored already is claimed for the class of the
+	// file, not uploaded again.
+	viper.Set("chunk_sha256", true)
+	defer viper.Set("chunk_sha256", false)
+	_, _, err = client.backupChunk(context.Background(), data, &cache.ChunkInfo{Length: uint(len(data))}, nil, vault, pipe, "rp", "bd", "STANDARD")
+	require.NoError(t, err)
+	reused := <-pipe
+	assert.Equal(t, map[string]string{key: "STANDARD"}, reused.Classes)
+	assert.Empty(t, reused.Uploaded)
+}
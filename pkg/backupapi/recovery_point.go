@@ -5,7 +5,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
-
+	"io"
 	"net/http"
 
 	"go.uber.org/zap"
@@ -54,8 +54,12 @@ type CreateRecoveryPointRequest struct {
 
 // CreateRestoreRequest represents a request manual backup.
 type CreateRestoreRequest struct {
-	MachineID string `json:"machine_id"`
-	Path      string `json:"path"`
+	MachineID    string `json:"machine_id"`
+	Path         string `json:"path"`
+	StripPrefix  string `json:"strip_prefix,omitempty"`
+	MetadataOnly bool   `json:"metadata_only,omitempty"`
+	Force        bool   `json:"force,omitempty"`
+	Profile      string `json:"profile,omitempty"`
 }
 
 // UpdateRecoveryPointRequest represents a request to update a recovery point.
@@ -63,6 +67,13 @@ type UpdateRecoveryPointRequest struct {
 	Status string `json:"status"`
 }
 
+// UpdateRecoveryPointIndexRequest represents a request to update the index
+// stored with a recovery point.
+type UpdateRecoveryPointIndexRequest struct {
+	IndexHash string `json:"index_hash"`
+	IndexSize int    `json:"index_size"`
+}
+
 // LatestRecoveryPointID get a id latest recovery point of backup directory id.
 type RecoveryPointResponse struct {
 	Name              string `json:"name"`
@@ -219,35 +230,58 @@ func (c *Client) DeleteRecoveryPoints(ctx context.Context, recoveryPointID strin
 	return nil
 }
 
-// RequestRestore requests restore
-func (c *Client) RequestRestore(recoveryPointID string, crr *CreateRestoreRequest) error {
-	req, err := c.NewRequest(http.MethodPost, c.recoveryPointActionPath(recoveryPointID), crr)
+// UpdateRecoveryPointIndex records the hash and size of the index stored in
+// place of the one of a recovery point.
+func (c *Client) UpdateRecoveryPointIndex(ctx context.Context, recoveryPointID, indexHash string, indexSize int) error {
+	req, err := c.NewRequest(http.MethodPatch, c.recoveryPointInfo(recoveryPointID), &UpdateRecoveryPointIndexRequest{IndexHash: indexHash, IndexSize: indexSize})
 	if err != nil {
 		c.logger.Error("err ", zap.Error(err))
 		return err
 	}
-	resp, err := c.Do(req)
+
+	resp, err := c.Do(req.WithContext(ctx))
 	if err != nil {
 		c.logger.Error("err ", zap.Error(err))
 		return err
 	}
-
 	if err := checkResponse(resp); err != nil {
 		c.logger.Error("err ", zap.Error(err))
-		return err
+		return fmt.Errorf("%w: %v", ErrUpdateRecoveryPoint, err)
 	}
 	defer resp.Body.Close()
+
 	return nil
 }
 
-func (c *Client) GetRestoreSessionKey(recoveryPointID string, actionID string, createdAt string) (*RestoreResponse, error) {
-	reqURL, err := c.urlStringFromRelPath(c.getRestoreSessionKey(recoveryPointID))
+// RequestRestore requests restore, returning the restore action created by
+// the server. The action is empty when the server answers without it.
+func (c *Client) RequestRestore(recoveryPointID string, crr *CreateRestoreRequest) (*RestoreResponse, error) {
+	req, err := c.NewRequest(http.MethodPost, c.recoveryPointActionPath(recoveryPointID), crr)
+	if err != nil {
+		c.logger.Error("err ", zap.Error(err))
+		return nil, err
+	}
+	resp, err := c.Do(req)
 	if err != nil {
 		c.logger.Error("err ", zap.Error(err))
 		return nil, err
 	}
 
-	req, err := c.NewRequest(http.MethodGet, reqURL, nil)
+	if err := checkResponse(resp); err != nil {
+		c.logger.Error("err ", zap.Error(err))
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var action RestoreResponse
+	if err := json.NewDecoder(resp.Body).Decode(&action); err != nil && err != io.EOF {
+		c.logger.Error("err ", zap.Error(err))
+		return nil, err
+	}
+	return &action, nil
+}
+
+func (c *Client) GetRestoreSessionKey(recoveryPointID string, actionID string, createdAt string) (*RestoreResponse, error) {
+	req, err := c.NewRequest(http.MethodGet, c.getRestoreSessionKey(recoveryPointID), nil)
 	if err != nil {
 		c.logger.Error("err ", zap.Error(err))
 		return nil, err
@@ -115,6 +115,23 @@ func TestClient_ListRecoveryPoints(t *testing.T) {
 	assert.NotEmpty(t, rps.RecoveryPoints[0].ID)
 }
 
+func TestClient_UpdateRecoveryPointIndex(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	recoveryPointID := "recovery-point-id"
+	mux.HandleFunc(path.Join("/api/v1/", client.recoveryPointInfo(recoveryPointID)), func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPatch, r.Method)
+		var req UpdateRecoveryPointIndexRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, UpdateRecoveryPointIndexRequest{IndexHash: "hash", IndexSize: 10}, req)
+	})
+
+	require.NoError(t, client.UpdateRecoveryPointIndex(context.Background(), recoveryPointID, "hash", 10))
+	err := client.UpdateRecoveryPointIndex(context.Background(), "missing", "hash", 10)
+	assert.ErrorIs(t, err, ErrUpdateRecoveryPoint)
+}
+
 func TestClient_RequestRestore(t *testing.T) {
 	setUp()
 	defer tearDown()
@@ -129,11 +146,13 @@ func TestClient_RequestRestore(t *testing.T) {
 		require.NoError(t, json.NewDecoder(r.Body).Decode(&crr))
 		assert.Equal(t, machine_id, crr.MachineID)
 		assert.Equal(t, path_restore, crr.Path)
+		_ = json.NewEncoder(w).Encode(RestoreResponse{ActionID: "action-id", CreatedAt: "created-at"})
 	})
 
-	err := client.RequestRestore(recoveryPointID, &CreateRestoreRequest{
+	action, err := client.RequestRestore(recoveryPointID, &CreateRestoreRequest{
 		MachineID: machine_id,
 		Path:      path_restore,
 	})
 	require.NoError(t, err)
+	assert.Equal(t, &RestoreResponse{ActionID: "action-id", CreatedAt: "created-at"}, action)
 }
@@ -0,0 +1,115 @@
+package backupapi
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/spf13/viper"
+)
+
+var (
+	ErrorProtectedDestination = errors.New("refusing to restore into a protected path, use force to override")
+	ErrorDestinationNotEmpty  = errors.New("refusing to restore into a non-empty directory, use force to override")
+	ErrorDestinationReadOnly  = errors.New("restore destination is not writable")
+)
+
+// defaultProtectedPaths returns the paths a restore may not target by default.
+func defaultProtectedPaths() []string {
+	if runtime.GOOS == "windows" {
+		return []string{`C:\`, `C:\Windows`, `C:\Program Files`, `C:\Users`}
+	}
+	return []string{"/", "/bin", "/boot", "/dev", "/etc", "/home", "/lib", "/proc", "/root", "/sbin", "/sys", "/usr", "/var"}
+}
+
+// protectedPaths returns restore_protected_paths, or the default ones when it
+// is not set.
+func protectedPaths() []string {
+	if !viper.IsSet("restore_protected_paths") {
+		return defaultProtectedPaths()
+	}
+	return viper.GetStringSlice("restore_protected_paths")
+}
+
+// refuseNonEmpty returns restore_refuse_non_empty, true when not set.
+func refuseNonEmpty() bool {
+	return !viper.IsSet("restore_refuse_non_empty") || viper.GetBool("restore_refuse_non_empty")
+}
+
+// CheckRestoreDestination returns an error when destDir is a protected path
+// or the parent of one, or an existing directory which is not empty. Symlinks
+// in destDir are resolved, so that a link to a protected path is refused too.
+// force skips the checks.
+func CheckRestoreDestination(destDir string, force bool) error {
+	if force {
+		return nil
+	}
+	abs, err := filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+	candidates := []string{abs}
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil && resolved != abs {
+		candidates = append(candidates, resolved)
+	}
+	for _, protected := range protectedPaths() {
+		if protected == "" {
+			continue
+		}
+		protected = filepath.Clean(protected)
+		for _, dest := range candidates {
+			if isWithin(dest, protected) {
+				return fmt.Errorf("%w: %s, protected %s", ErrorProtectedDestination, destDir, protected)
+			}
+		}
+	}
+
+	if !refuseNonEmpty() {
+		return nil
+	}
+	// Devices and missing destinations hold nothing a restore could clobber.
+	fi, err := os.Stat(abs)
+	if err != nil || !fi.IsDir() {
+		return nil
+	}
+	f, err := os.Open(abs)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if names, _ := f.Readdirnames(1); len(names) > 0 {
+		return fmt.Errorf("%w: %s", ErrorDestinationNotEmpty, destDir)
+	}
+	return nil
+}
+
+// CheckRestoreWritable returns an error when files can not be created in
+// destDir, or in the closest existing directory above it when it does not
+// exist yet.
+func CheckRestoreWritable(destDir string) error {
+	dir, err := filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+	for {
+		fi, err := os.Stat(dir)
+		if err == nil {
+			if !fi.IsDir() {
+				return fmt.Errorf("%w: %s is not a directory", ErrorDestinationReadOnly, dir)
+			}
+			break
+		}
+		if !os.IsNotExist(err) || filepath.Dir(dir) == dir {
+			return fmt.Errorf("%w: %v", ErrorDestinationReadOnly, err)
+		}
+		dir = filepath.Dir(dir)
+	}
+	f, err := os.CreateTemp(dir, ".bizfly-backup-")
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrorDestinationReadOnly, err)
+	}
+	_ = f.Close()
+	return os.Remove(f.Name())
+}
@@ -0,0 +1,111 @@
+package backupapi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+func TestCheckRestoreDestination(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix paths")
+	}
+	defer viper.Set("restore_protected_paths", nil)
+	defer viper.Set("restore_refuse_non_empty", nil)
+
+	root := t.TempDir()
+	protected := filepath.Join(root, "srv", "data")
+	require.NoError(t, os.MkdirAll(protected, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(protected, "file"), []byte("data"), 0600))
+	empty := filepath.Join(root, "empty")
+	require.NoError(t, os.Mkdir(empty, 0700))
+	link := filepath.Join(root, "link")
+	require.NoError(t, os.Symlink(protected, link))
+	viper.Set("restore_protected_paths", []string{protected})
+
+	tests := []struct {
+		name    string
+		dest    string
+		force   bool
+		wantErr error
+	}{
+		{"protected", protected, false, ErrorProtectedDestination},
+		{"parent of protected", filepath.Join(root, "srv"), false, ErrorProtectedDestination},
+		{"unclean protected", protected + "/../data/", false, ErrorProtectedDestination},
+		{"link to protected", link, false, ErrorProtectedDestination},
+		{"forced", protected, true, nil},
+		{"non-empty", root, false, ErrorProtectedDestination},
+		{"empty", empty, false, nil},
+		{"missing", filepath.Join(root, "missing"), false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckRestoreDestination(tt.dest, tt.force)
+			if tt.wantErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.ErrorIs(t, err, tt.wantErr)
+			}
+		})
+	}
+
+	// Below a protected path is fine when empty, not when it holds files.
+	viper.Set("restore_protected_paths", []string{"/"})
+	assert.NoError(t, CheckRestoreDestination(empty, false))
+	assert.ErrorIs(t, CheckRestoreDestination(protected, false), ErrorDestinationNotEmpty)
+	assert.ErrorIs(t, CheckRestoreDestination("/", false), ErrorProtectedDestination)
+
+	viper.Set("restore_refuse_non_empty", false)
+	assert.NoError(t, CheckRestoreDestination(protected, false))
+
+	// The default paths include the root of the file system and /home.
+	viper.Set("restore_protected_paths", nil)
+	assert.ErrorIs(t, CheckRestoreDestination("/", false), ErrorProtectedDestination)
+	assert.ErrorIs(t, CheckRestoreDestination("/home/", false), ErrorProtectedDestination)
+}
+
+func TestCheckRestoreWritable(t *testing.T) {
+	root := t.TempDir()
+	file := filepath.Join(root, "file")
+	require.NoError(t, os.WriteFile(file, []byte("data"), 0600))
+
+	assert.NoError(t, CheckRestoreWritable(root))
+	assert.NoError(t, CheckRestoreWritable(filepath.Join(root, "missing", "below")))
+	assert.ErrorIs(t, CheckRestoreWritable(file), ErrorDestinationReadOnly)
+	assert.ErrorIs(t, CheckRestoreWritable(filepath.Join(file, "below")), ErrorDestinationReadOnly)
+
+	// The check leaves nothing behind.
+	entries, err := os.ReadDir(root)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestClient_RestoreDirectoryRefused(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault, index := exportFixture("hello ", "world")
+	dest := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dest, "existing"), []byte("keep"), 0600))
+
+	// Nothing is written into a non-empty destination.
+	err := client.RestoreDirectory(context.Background(), *index, dest, false, RestoreProfile{}, vault, nil, progress.NewProgress(time.Second))
+	assert.ErrorIs(t, err, ErrorDestinationNotEmpty)
+	entries, err := os.ReadDir(dest)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	require.NoError(t, client.RestoreDirectory(context.Background(), *index, dest, true, RestoreProfile{}, vault, nil, progress.NewProgress(time.Second)))
+	data, err := os.ReadFile(filepath.Join(dest, "data", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(data))
+}
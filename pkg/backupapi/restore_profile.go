@@ -0,0 +1,152 @@
+package backupapi
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+	"golang.org/x/sync/semaphore"
+)
+
+// DefaultRestoreProfile is the profile of a restore requested without one.
+const DefaultRestoreProfile = "balanced"
+
+// defaultRestorePrefetchDepth is the number of chunks of a file read ahead
+// into the chunk cache when restore_prefetch_depth is not set.
+const defaultRestorePrefetchDepth = 4
+
+var ErrorUnknownRestoreProfile = errors.New("unknown restore profile")
+
+// RestoreProfile is the resource usage of a restore job.
+type RestoreProfile struct {
+	Name string `json:"name" mapstructure:"-"`
+	// Concurrency is the number of items restored at once, 0 for num_goroutine.
+	Concurrency int `json:"concurrency" mapstructure:"concurrency"`
+	// LimitDownload is the download rate in KiB, as limit_download, 0 for none.
+	LimitDownload int `json:"limit_download" mapstructure:"limit_download"`
+	// ChunkCacheMB is the memory kept for the chunks read, 0 for none.
+	ChunkCacheMB int `json:"chunk_cache_mb" mapstructure:"chunk_cache_mb"`
+}
+
+// restoreProfilePresets returns the profiles defined in code: fast ignores the
+// download limit, balanced keeps it, gentle restores one item at a time with
+// at most 1 MiB/s.
+func restoreProfilePresets() map[string]RestoreProfile {
+	limitDownload := viper.GetInt("limit_download")
+	gentleLimit := 1024
+	if limitDownload > 0 && limitDownload < gentleLimit {
+		gentleLimit = limitDownload
+	}
+	return map[string]RestoreProfile{
+		"fast":     {Concurrency: 4 * runtime.NumCPU(), ChunkCacheMB: 256},
+		"balanced": {LimitDownload: limitDownload, ChunkCacheMB: 64},
+		"gentle":   {Concurrency: 1, LimitDownload: gentleLimit, ChunkCacheMB: 16},
+	}
+}
+
+// restoreProfiles returns the presets and the profiles of restore_profiles,
+// which replace presets of the same name.
+func restoreProfiles() (map[string]RestoreProfile, error) {
+	profiles := restoreProfilePresets()
+	var custom map[string]RestoreProfile
+	if err := viper.UnmarshalKey("restore_profiles", &custom); err != nil {
+		return nil, fmt.Errorf("restore_profiles: %w", err)
+	}
+	for name, profile := range custom {
+		profiles[name] = profile
+	}
+	return profiles, nil
+}
+
+// GetRestoreProfile returns the restore profile called name, the default one
+// when name is empty.
+func GetRestoreProfile(name string) (RestoreProfile, error) {
+	if name == "" {
+		name = DefaultRestoreProfile
+	}
+	profiles, err := restoreProfiles()
+	if err != nil {
+		return RestoreProfile{}, err
+	}
+	profile, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return RestoreProfile{}, fmt.Errorf("%w: %q, one of %s", ErrorUnknownRestoreProfile, name, strings.Join(names, ", "))
+	}
+	profile.Name = name
+	return profile, nil
+}
+
+// concurrency returns the number of items restored at once with p.
+func (p RestoreProfile) concurrency() int {
+	if p.Concurrency > 0 {
+		return p.Concurrency
+	}
+	return numGoroutine()
+}
+
+// restoreChunkConcurrency returns the number of the chunks of a file of n
+// chunks restored at once by a file restored on its own, at most
+// num_goroutine. A restore job shares the concurrency of its profile.
+func restoreChunkConcurrency(n int) int {
+	if limit := numGoroutine(); n > limit {
+		return limit
+	}
+	if n < 1 {
+		return 1
+	}
+	return n
+}
+
+// restoreJob is the share of the resources of a restore profile used by all
+// the files of a restore.
+type restoreJob struct {
+	// chunks bounds the chunks fetched at once across the files.
+	chunks *semaphore.Weighted
+	// prefetchDepth is the number of chunks of a file read ahead.
+	prefetchDepth int
+}
+
+// newRestoreJob returns the restore job of profile p: it fetches as many
+// chunks at once as it restores items, reading ahead within that share, so
+// that a profile restoring one item at a time makes one request at a time.
+func (p RestoreProfile) newRestoreJob() *restoreJob {
+	concurrency := p.concurrency()
+	depth := restorePrefetchDepth()
+	if depth > concurrency-1 {
+		depth = concurrency - 1
+	}
+	return &restoreJob{chunks: semaphore.NewWeighted(int64(concurrency)), prefetchDepth: depth}
+}
+
+// numGoroutine returns num_goroutine, or a share of the CPUs when it is not
+// set.
+func numGoroutine() int {
+	numGoroutine := viper.GetInt("num_goroutine")
+	if numGoroutine == 0 {
+		numGoroutine = int(float64(runtime.NumCPU()) * 0.2)
+		if numGoroutine <= 1 {
+			numGoroutine = 2
+		}
+	}
+	return numGoroutine
+}
+
+// restorePrefetchDepth returns the number of chunks of a file read ahead into
+// the chunk cache of a restore, 0 for none.
+func restorePrefetchDepth() int {
+	if !viper.IsSet("restore_prefetch_depth") {
+		return defaultRestorePrefetchDepth
+	}
+	if depth := viper.GetInt("restore_prefetch_depth"); depth > 0 {
+		return depth
+	}
+	return 0
+}
@@ -0,0 +1,77 @@
+package backupapi
+
+import (
+	"runtime"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRestoreProfile(t *testing.T) {
+	viper.Set("limit_download", 512)
+	defer viper.Set("limit_download", nil)
+
+	profile, err := GetRestoreProfile("")
+	require.NoError(t, err)
+	assert.Equal(t, RestoreProfile{Name: "balanced", LimitDownload: 512, ChunkCacheMB: 64}, profile)
+
+	profile, err = GetRestoreProfile("fast")
+	require.NoError(t, err)
+	assert.Equal(t, 4*runtime.NumCPU(), profile.concurrency())
+	assert.Zero(t, profile.LimitDownload)
+
+	// gentle never downloads faster than limit_download.
+	profile, err = GetRestoreProfile("gentle")
+	require.NoError(t, err)
+	assert.Equal(t, RestoreProfile{Name: "gentle", Concurrency: 1, LimitDownload: 512, ChunkCacheMB: 16}, profile)
+
+	_, err = GetRestoreProfile("unknown")
+	assert.ErrorIs(t, err, ErrorUnknownRestoreProfile)
+	assert.Contains(t, err.Error(), "balanced, fast, gentle")
+
+	// Custom profiles are added to the presets or replace them.
+	viper.Set("restore_profiles", map[string]interface{}{
+		"night":  map[string]interface{}{"concurrency": 16, "limit_download": 0, "chunk_cache_mb": 512},
+		"gentle": map[string]interface{}{"concurrency": 2, "limit_download": 100},
+	})
+	defer viper.Set("restore_profiles", nil)
+	profile, err = GetRestoreProfile("night")
+	require.NoError(t, err)
+	assert.Equal(t, RestoreProfile{Name: "night", Concurrency: 16, ChunkCacheMB: 512}, profile)
+	profile, err = GetRestoreProfile("gentle")
+	require.NoError(t, err)
+	assert.Equal(t, RestoreProfile{Name: "gentle", Concurrency: 2, LimitDownload: 100}, profile)
+
+	// Without a concurrency, num_goroutine applies.
+	viper.Set("num_goroutine", 3)
+	defer viper.Set("num_goroutine", nil)
+	assert.Equal(t, 3, RestoreProfile{}.concurrency())
+}
+
+func TestRestorePrefetchDepth(t *testing.T) {
+	defer viper.Set("restore_prefetch_depth", nil)
+	assert.Equal(t, defaultRestorePrefetchDepth, restorePrefetchDepth())
+	viper.Set("restore_prefetch_depth", 8)
+	assert.Equal(t, 8, restorePrefetchDepth())
+	viper.Set("restore_prefetch_depth", 0)
+	assert.Equal(t, 0, restorePrefetchDepth())
+	viper.Set("restore_prefetch_depth", -1)
+	assert.Equal(t, 0, restorePrefetchDepth())
+}
+
+func TestRestoreChunkConcurrency(t *testing.T) {
+	viper.Set("num_goroutine", 4)
+	defer viper.Set("num_goroutine", nil)
+
+	assert.Equal(t, 1, restoreChunkConcurrency(0))
+	assert.Equal(t, 1, restoreChunkConcurrency(1))
+	assert.Equal(t, 3, restoreChunkConcurrency(3))
+	assert.Equal(t, 4, restoreChunkConcurrency(100))
+
+	// A restore job reads ahead within the concurrency of its profile.
+	assert.Equal(t, 0, RestoreProfile{Concurrency: 1}.newRestoreJob().prefetchDepth)
+	assert.Equal(t, 2, RestoreProfile{Concurrency: 3}.newRestoreJob().prefetchDepth)
+	assert.Equal(t, defaultRestorePrefetchDepth, RestoreProfile{Concurrency: 16}.newRestoreJob().prefetchDepth)
+}
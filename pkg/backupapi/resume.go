@@ -0,0 +1,82 @@
+package backupapi
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// resumeFile completes target in place, such as a file left behind by an
+// interrupted restore. A file of the expected size matching the hash recorded
+// with the file is kept as is, otherwise only the chunks whose bytes on disk
+// differ are downloaded. The metadata of item is applied once the content is
+// complete.
+func (c *Client) resumeFile(ctx context.Context, target string, item cache.Node, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, p *progress.Progress) error {
+	if err := c.acquireOpenFile(ctx); err != nil {
+		return err
+	}
+	defer c.releaseOpenFile()
+
+	file, err := os.OpenFile(target, os.O_RDWR, 0)
+	if err != nil {
+		c.logger.Error("err ", zap.Error(err))
+		return err
+	}
+	defer file.Close()
+	fi, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	if uint64(fi.Size()) == item.Size && len(item.Sha256Hash) > 0 && verifyFile(target, &item) == "" {
+		c.logger.Sugar().Info("file already restored, keep it ", target)
+		p.Report(progress.Stat{Bytes: item.Size})
+		return c.applyMetadata(target, item)
+	}
+
+	if err := file.Truncate(int64(item.Size)); err != nil {
+		return err
+	}
+	missing := item
+	missing.Content = c.changedChunks(file, &item)
+	c.logger.Sugar().Infof("resume %s, downloading %d of %d chunks", target, len(missing.Content), len(item.Content))
+	var kept uint64
+	for _, info := range item.Content {
+		kept += uint64(info.Length)
+	}
+	for _, info := range missing.Content {
+		kept -= uint64(info.Length)
+	}
+	p.Report(progress.Stat{Bytes: kept})
+
+	if err := c.downloadFile(ctx, file, nil, missing, storageVault, restoreKey, p); err != nil {
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	if len(item.Sha256Hash) > 0 {
+		if reason := verifyFile(target, &item); reason != "" {
+			return fmt.Errorf("%w: %s: %s", ErrorRestoreMismatch, target, reason)
+		}
+	}
+	return c.applyMetadata(target, item)
+}
+
+// changedChunks returns the chunks of item which file does not hold at their
+// offset, compared by their key.
+func (c *Client) changedChunks(file *os.File, item *cache.Node) []*cache.ChunkInfo {
+	var changed []*cache.ChunkInfo
+	for _, info := range item.Content {
+		if _, ok := c.localChunk(file, info); !ok {
+			changed = append(changed, info)
+		}
+	}
+	return changed
+}
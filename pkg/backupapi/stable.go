@@ -0,0 +1,114 @@
+package backupapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+)
+
+const (
+	StablePolicySkip  = "skip"
+	StablePolicyRetry = "retry"
+
+	defaultStableRetries = 3
+)
+
+// ErrorFileUnstable is returned when a file is still written to after its
+// stability window.
+var ErrorFileUnstable = errors.New("file is still being written")
+
+// StableCheck is the check run before reading a changed file: its size and
+// modification time must stay the same for Wait. Files modified longer than
+// Wait ago pass at once. Otherwise, the skip policy gives up after a single
+// window, the retry policy checks again up to Retries times. A zero Wait
+// disables the check.
+type StableCheck struct {
+	Wait    time.Duration
+	Policy  string
+	Retries int
+}
+
+// StableCheckFromConfig returns the stable check of bd, whose stable_wait and
+// stable_policy take precedence over stable_file_wait and stable_file_policy.
+// bd may be nil.
+func StableCheckFromConfig(bd *BackupDirectoryConfig) (StableCheck, error) {
+	check := StableCheck{
+		Wait:    viper.GetDuration("stable_file_wait"),
+		Policy:  viper.GetString("stable_file_policy"),
+		Retries: defaultStableRetries,
+	}
+	if viper.IsSet("stable_file_retries") {
+		check.Retries = viper.GetInt("stable_file_retries")
+	}
+	if bd != nil && bd.StableWait != "" {
+		wait, err := time.ParseDuration(bd.StableWait)
+		if err != nil || wait < 0 {
+			return StableCheck{}, fmt.Errorf("%w: stable_wait %q of backup directory %s", ErrorInvalidConfig, bd.StableWait, bd.ID)
+		}
+		check.Wait = wait
+	}
+	if bd != nil && bd.StablePolicy != "" {
+		check.Policy = bd.StablePolicy
+	}
+	switch check.Policy {
+	case "":
+		check.Policy = StablePolicySkip
+	case StablePolicySkip, StablePolicyRetry:
+	default:
+		return StableCheck{}, fmt.Errorf("%w: stable policy %q", ErrorInvalidConfig, check.Policy)
+	}
+	return check, nil
+}
+
+// waitStable waits until item is stable, and records the size and
+// modification time it settled on.
+func (c *Client) waitStable(ctx context.Context, item *cache.Node, check StableCheck) error {
+	if check.Wait <= 0 {
+		return nil
+	}
+	// A file gone is reported when it is read.
+	before, err := os.Stat(item.AbsolutePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// A file last written longer than the window ago needs no wait.
+	if time.Since(before.ModTime()) >= check.Wait {
+		item.Size = uint64(before.Size())
+		item.ModTime = before.ModTime()
+		return nil
+	}
+	for attempt := 0; ; attempt++ {
+		select {
+		case <-ctx.Done():
+			return ErrorGotCancelRequest
+		case <-time.After(check.Wait):
+		}
+		after, err := os.Stat(item.AbsolutePath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if after.Size() == before.Size() && after.ModTime().Equal(before.ModTime()) {
+			item.Size = uint64(after.Size())
+			item.ModTime = after.ModTime()
+			return nil
+		}
+		if check.Policy != StablePolicyRetry || attempt >= check.Retries {
+			return fmt.Errorf("%w: %s changed within %s", ErrorFileUnstable, item.AbsolutePath, check.Wait)
+		}
+		c.logger.Debug("File still changing, checking again", zap.String("path", item.AbsolutePath), zap.Int("attempt", attempt+1))
+		before = after
+	}
+}
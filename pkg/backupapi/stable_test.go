@@ -0,0 +1,91 @@
+package backupapi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+)
+
+func TestStableCheckFromConfig(t *testing.T) {
+	viper.Set("stable_file_wait", 2*time.Second)
+	defer viper.Set("stable_file_wait", nil)
+
+	tests := []struct {
+		name    string
+		bd      *BackupDirectoryConfig
+		want    StableCheck
+		wantErr bool
+	}{
+		{"global", nil, StableCheck{Wait: 2 * time.Second, Policy: StablePolicySkip, Retries: defaultStableRetries}, false},
+		{"directory override", &BackupDirectoryConfig{StableWait: "10s", StablePolicy: StablePolicyRetry}, StableCheck{Wait: 10 * time.Second, Policy: StablePolicyRetry, Retries: defaultStableRetries}, false},
+		{"directory disables", &BackupDirectoryConfig{StableWait: "0s"}, StableCheck{Policy: StablePolicySkip, Retries: defaultStableRetries}, false},
+		{"invalid wait", &BackupDirectoryConfig{StableWait: "soon"}, StableCheck{}, true},
+		{"invalid policy", &BackupDirectoryConfig{StablePolicy: "wait"}, StableCheck{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := StableCheckFromConfig(tt.bd)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrorInvalidConfig)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+// writeFor appends to path every few milliseconds for d.
+func writeFor(t *testing.T, path string, d time.Duration) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	require.NoError(t, err)
+	go func() {
+		defer f.Close()
+		for end := time.Now().Add(d); time.Now().Before(end); {
+			_, _ = f.Write([]byte("x"))
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+}
+
+func TestWaitStable(t *testing.T) {
+	setUp()
+	defer tearDown()
+	dir := t.TempDir()
+	wait := 50 * time.Millisecond
+
+	// Not written within the window, no wait.
+	old := filepath.Join(dir, "old")
+	require.NoError(t, os.WriteFile(old, []byte("old"), 0600))
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(old, past, past))
+	item := &cache.Node{AbsolutePath: old}
+	started := time.Now()
+	require.NoError(t, client.waitStable(context.Background(), item, StableCheck{Wait: time.Hour, Policy: StablePolicySkip}))
+	assert.Less(t, int64(time.Since(started)), int64(time.Second))
+	assert.Equal(t, uint64(3), item.Size)
+
+	// Still written after the window.
+	busy := filepath.Join(dir, "busy")
+	writeFor(t, busy, 6*wait)
+	err := client.waitStable(context.Background(), &cache.Node{AbsolutePath: busy}, StableCheck{Wait: wait, Policy: StablePolicySkip})
+	assert.ErrorIs(t, err, ErrorFileUnstable)
+
+	// Written for a while, retried until it settles.
+	settling := filepath.Join(dir, "settling")
+	writeFor(t, settling, 3*wait)
+	item = &cache.Node{AbsolutePath: settling}
+	require.NoError(t, client.waitStable(context.Background(), item, StableCheck{Wait: wait, Policy: StablePolicyRetry, Retries: 20}))
+	fi, err := os.Stat(settling)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(fi.Size()), item.Size)
+	assert.Equal(t, fi.ModTime(), item.ModTime)
+}
@@ -1,9 +1,16 @@
 package backupapi
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/cenkalti/backoff"
@@ -33,6 +40,21 @@ type AuthRestore struct {
 	ActionID          string
 	CreatedAt         string
 	RestoreSessionKey string
+
+	// mu serializes the refreshes of the session by the chunks downloaded at
+	// once, refreshes counts them.
+	mu        sync.Mutex
+	refreshes uint64
+}
+
+// generation returns the number of refreshes of the session so far.
+func (k *AuthRestore) generation() uint64 {
+	if k == nil {
+		return 0
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.refreshes
 }
 
 // credentialStorageVaultPath API
@@ -61,8 +83,7 @@ func (c *Client) GetCredentialStorageVault(storageVaultID string, actionID strin
 			resp, err = c.Do(req)
 			if err != nil {
 				c.logger.Error("err ", zap.Error(err))
-			}
-			if resp.StatusCode == 401 {
+			} else if resp.StatusCode == 401 {
 				c.logger.Sugar().Info("GetRestoreSessionKey access denied: ", resp.StatusCode)
 				newSessionKey, err := c.GetRestoreSessionKey(restoreKey.RecoveryPointID, restoreKey.ActionID, restoreKey.CreatedAt)
 				if err != nil {
@@ -83,6 +104,7 @@ func (c *Client) GetCredentialStorageVault(storageVaultID string, actionID strin
 				break
 			}
 			c.logger.Sugar().Info("GetCredentialStorageVault. Retry in ", d)
+			time.Sleep(d)
 		}
 	} else {
 		req, err := c.NewRequest(http.MethodGet, c.credentialStorageVaultPath(storageVaultID, actionID), nil)
@@ -98,6 +120,9 @@ func (c *Client) GetCredentialStorageVault(storageVaultID string, actionID strin
 		}
 	}
 
+	if resp == nil {
+		return nil, fmt.Errorf("get credential of storage vault %s: no response", storageVaultID)
+	}
 	if err = checkResponse(resp); err != nil {
 		c.logger.Error("err ", zap.Error(err))
 		return nil, err
@@ -113,16 +138,24 @@ func (c *Client) GetCredentialStorageVault(storageVaultID string, actionID strin
 	return &vault, nil
 }
 
-// PutObject stores the data to the storage vault.
-func (c *Client) PutObject(storageVault storage_vault.StorageVault, key string, data []byte) error {
+// PutObject stores the data to the storage vault, retrying until ctx is done.
+func (c *Client) PutObject(ctx context.Context, storageVault storage_vault.StorageVault, key string, data []byte) error {
 	var err error
 	bo := backoff.NewExponentialBackOff()
 	bo.MaxInterval = maxRetry
 	bo.MaxElapsedTime = maxRetry
 
+	retries := storage_vault.RetriesOf(storageVault)
+	var retry *storage_vault.Retry
+	defer func() { retries.Done(retry) }()
+
 	for {
-		err = storageVault.PutObject(key, data)
-		if err == nil {
+		err = storageVault.PutObject(ctx, key, data)
+		if err == nil || errors.Is(err, storage_vault.ErrRequestBudgetExhausted) {
+			break
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
 			break
 		}
 		if aerr, ok := err.(awserr.Error); ok {
@@ -151,51 +184,78 @@ func (c *Client) PutObject(storageVault storage_vault.StorageVault, key string,
 			break
 		}
 		c.logger.Sugar().Info("Put object error. Retry in ", d)
+		retry = retries.Wait(retry, d)
+		if err = storage_vault.Sleep(ctx, d); err != nil {
+			break
+		}
 	}
 	return err
 }
 
-// GetObject downloads the object by name in storage vault.
-func (c *Client) GetObject(storageVault storage_vault.StorageVault, key string, restoreKey *AuthRestore) ([]byte, error) {
+// GetObject downloads the object by name in storage vault, retrying until ctx
+// is done.
+func (c *Client) GetObject(ctx context.Context, storageVault storage_vault.StorageVault, key string, restoreKey *AuthRestore) ([]byte, error) {
+	var data []byte
+	err := c.retryGet(ctx, storageVault, restoreKey, func() (err error) {
+		data, err = storageVault.GetObject(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// GetObjectStream opens the object by name in storage vault for reading as it
+// is downloaded, retried like GetObject until it is open. The object is read
+// whole from a storage vault which cannot stream.
+func (c *Client) GetObjectStream(ctx context.Context, storageVault storage_vault.StorageVault, key string, restoreKey *AuthRestore) (io.ReadCloser, error) {
+	streamer, ok := storageVault.(storage_vault.ObjectStreamer)
+	if ok {
+		var body io.ReadCloser
+		err := c.retryGet(ctx, storageVault, restoreKey, func() (err error) {
+			body, err = streamer.GetObjectStream(ctx, key)
+			return err
+		})
+		if !errors.Is(err, storage_vault.ErrNotSupported) {
+			return body, err
+		}
+	}
+	data, err := c.GetObject(ctx, storageVault, key, restoreKey)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// retryGet calls get until it succeeds or ctx is done, refreshing the
+// credential of storageVault when it is denied. An object not found is not
+// retried.
+func (c *Client) retryGet(ctx context.Context, storageVault storage_vault.StorageVault, restoreKey *AuthRestore, get func() error) error {
 	var err error
 	bo := backoff.NewExponentialBackOff()
 	bo.MaxInterval = maxRetry
 	bo.MaxElapsedTime = maxRetry
 
+	retries := storage_vault.RetriesOf(storageVault)
+	var retry *storage_vault.Retry
+	defer func() { retries.Done(retry) }()
+
 	for {
-		data, err := storageVault.GetObject(key)
-		if err == nil {
-			return data, nil
+		seen := restoreKey.generation()
+		if err = get(); err == nil {
+			return nil
 		}
-		if aerr, ok := err.(awserr.Error); ok {
-			if (aerr.Code() == "Forbidden" || aerr.Code() == "AccessDenied") && storageVault.Type().CredentialType == "DEFAULT" {
-				storageVaultID, actID := storageVault.ID()
-
-				// get new restore session key
-				newSessionKey, err := c.GetRestoreSessionKey(restoreKey.RecoveryPointID, restoreKey.ActionID, restoreKey.CreatedAt)
-				c.logger.Sugar().Info("newSessionKey ", newSessionKey)
-				if err != nil {
-					c.logger.Error("Get restore session key error: ", zap.Error(err))
-					return nil, err
-				}
-				c.logger.Sugar().Info("new session key: ", newSessionKey)
-
-				restoreKey.CreatedAt = newSessionKey.CreatedAt
-				restoreKey.RestoreSessionKey = newSessionKey.RestoreSessionKey
-
-				// get credential storage vault
-				vault, err := c.GetCredentialStorageVault(storageVaultID, actID, restoreKey)
-				if err != nil {
-					c.logger.Error("Error get credential ", zap.Error(err))
-					break
-				}
-
-				// refresh credential storage vault
-				err = storageVault.RefreshCredential(vault.Credential)
-				if err != nil {
-					c.logger.Error("Error refresht credential ", zap.Error(err))
-					break
-				}
+		if errors.Is(err, storage_vault.ErrRequestBudgetExhausted) || errors.Is(err, storage_vault.ErrObjectArchived) || errors.Is(err, storage_vault.ErrNotSupported) || isNotFound(err) {
+			return err
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && (aerr.Code() == "Forbidden" || aerr.Code() == "AccessDenied") && storageVault.Type().CredentialType == "DEFAULT" {
+			if errRefresh := c.refreshRestoreCredential(storageVault, restoreKey, seen); errRefresh != nil {
+				return errRefresh
 			}
 		}
 
@@ -203,9 +263,56 @@ func (c *Client) GetObject(storageVault storage_vault.StorageVault, key string,
 		d := bo.NextBackOff()
 		if d == backoff.Stop {
 			c.logger.Debug("GetObject error. Retry time out")
-			break
+			return err
 		}
 		c.logger.Sugar().Info("GetObject error. Retry in ", d)
+		retry = retries.Wait(retry, d)
+		if err := storage_vault.Sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// refreshRestoreCredential renews the credential of storageVault once it was
+// denied, with a new session of restoreKey, or with the credential of the
+// agent when there is none. seen is the generation of restoreKey when the
+// request was made: a session renewed since by another chunk is kept, so that
+// the chunks denied together refresh it once.
+func (c *Client) refreshRestoreCredential(storageVault storage_vault.StorageVault, restoreKey *AuthRestore, seen uint64) error {
+	storageVaultID, actID := storageVault.ID()
+	if restoreKey == nil {
+		vault, err := c.GetCredentialStorageVault(storageVaultID, actID, nil)
+		if err != nil {
+			c.logger.Error("Error get credential ", zap.Error(err))
+			return err
+		}
+		return storageVault.RefreshCredential(vault.Credential)
+	}
+
+	restoreKey.mu.Lock()
+	defer restoreKey.mu.Unlock()
+	if restoreKey.refreshes != seen {
+		return nil
+	}
+
+	newSessionKey, err := c.GetRestoreSessionKey(restoreKey.RecoveryPointID, restoreKey.ActionID, restoreKey.CreatedAt)
+	if err != nil {
+		c.logger.Error("Get restore session key error: ", zap.Error(err))
+		return err
+	}
+	restoreKey.CreatedAt = newSessionKey.CreatedAt
+	restoreKey.RestoreSessionKey = newSessionKey.RestoreSessionKey
+
+	vault, err := c.GetCredentialStorageVault(storageVaultID, actID, restoreKey)
+	if err != nil {
+		c.logger.Error("Error get credential ", zap.Error(err))
+		return err
+	}
+	if err := storageVault.RefreshCredential(vault.Credential); err != nil {
+		c.logger.Error("Error refresh credential ", zap.Error(err))
+		return err
 	}
-	return nil, err
+	restoreKey.refreshes++
+	c.logger.Info("Restore credential refreshed", zap.String("recovery_point_id", restoreKey.RecoveryPointID), zap.Uint64("refreshes", restoreKey.refreshes))
+	return nil
 }
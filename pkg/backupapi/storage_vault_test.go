@@ -1,11 +1,23 @@
 package backupapi
 
 import (
+	"context"
+	"fmt"
 	"net/http"
 	"net/url"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/budget"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/cooldown"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/fault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
 )
 
 func TestClient_credentialStorageVaultPath(t *testing.T) {
@@ -54,3 +66,146 @@ func TestClient_credentialStorageVaultPath(t *testing.T) {
 		})
 	}
 }
+
+func TestClient_PutObjectRetry(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	mux.HandleFunc("/api/v1/agent/storage_vaults/vault/credential", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, `{"id": "vault", "credential": {"aws_access_key_id": "new"}}`)
+	})
+
+	inner := memory.New("vault", "action")
+	vault := fault.New(inner).
+		SetCredentialType("DEFAULT").
+		Inject(fault.Fault{Op: fault.OpPut, Times: 1, Err: fault.ServiceUnavailable()}).
+		Inject(fault.Fault{Op: fault.OpPut, Times: 1, Err: fault.AccessDenied()})
+
+	require.NoError(t, client.PutObject(context.Background(), vault, "key", []byte("data")))
+	assert.Equal(t, 3, vault.Calls(fault.OpPut))
+	assert.Equal(t, 1, vault.Calls(fault.OpRefresh))
+	assert.Equal(t, []string{"key"}, inner.Keys())
+}
+
+func TestClient_GetObjectRetry(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	inner := memory.New("vault", "action")
+	require.NoError(t, inner.PutObject(context.Background(), "key", []byte("data")))
+	vault := fault.New(inner).Inject(fault.Fault{Op: fault.OpGet, Times: 1, Err: fault.ServiceUnavailable()})
+
+	data, err := client.GetObject(context.Background(), vault, "key", nil)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), data)
+	assert.Equal(t, 2, vault.Calls(fault.OpGet))
+
+	// The request counts as retrying while it waits for the next attempt.
+	vault.Inject(fault.Fault{Op: fault.OpGet, Times: 1, Err: fault.ServiceUnavailable()})
+	wrapped := cooldown.New(vault, nil)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, err := client.GetObject(context.Background(), wrapped, "key", nil)
+		assert.NoError(t, err)
+	}()
+	assert.Eventually(t, func() bool { return wrapped.Retries().State().Retrying == 1 }, time.Second, time.Millisecond)
+	assert.Greater(t, wrapped.Retries().State().NextDelay, time.Duration(0))
+	<-done
+	assert.Equal(t, storage_vault.RetryState{}, wrapped.Retries().State())
+}
+
+func TestClient_ObjectRetryCanceled(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	// A vault failing every request is given up on as soon as the backup
+	// is canceled, not at the retry timeout.
+	vault := fault.New(memory.New("vault", "action")).Inject(fault.Fault{Err: fault.ServiceUnavailable()})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	assert.ErrorIs(t, client.PutObject(ctx, vault, "key", []byte("data")), context.Canceled)
+	_, err := client.GetObject(ctx, vault, "key", nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Less(t, time.Since(start), 5*time.Second)
+	assert.Equal(t, 1, vault.Calls(fault.OpGet), "a canceled get is not retried")
+}
+
+func TestClient_GetObjectArchived(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	inner := memory.New("vault", "action")
+	require.NoError(t, inner.PutObject(context.Background(), "key", []byte("data")))
+	vault := fault.New(inner).Inject(fault.Fault{Op: fault.OpGet, Times: 2, Err: fmt.Errorf("%w: key", storage_vault.ErrObjectArchived)})
+
+	_, err := client.GetObject(context.Background(), vault, "key", nil)
+	assert.ErrorIs(t, err, storage_vault.ErrObjectArchived)
+	assert.Equal(t, 1, vault.Calls(fault.OpGet), "an archived object is not retried")
+}
+
+func TestClient_GetObjectRestoreCredential(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	var sessions, credentials int32
+	mux.HandleFunc("/api/v1/agent/recovery-points/rp/restore-key", func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&sessions, 1)
+		assert.Equal(t, "action", r.URL.Query().Get("action_id"))
+		_, _ = fmt.Fprintf(w, `{"action_id": "action", "created_at": "t%d", "restore_session_key": "key%d"}`, n, n)
+	})
+	mux.HandleFunc("/api/v1/agent/storage_vaults/vault/credential", func(w http.ResponseWriter, r *http.Request) {
+		if key := r.Header.Get("X-Restore-Session-Key"); key != "" {
+			atomic.AddInt32(&credentials, 1)
+			assert.Equal(t, "key1", key)
+		}
+		_, _ = fmt.Fprint(w, `{"id": "vault", "credential": {"aws_access_key_id": "new"}}`)
+	})
+
+	inner := memory.New("vault", "action")
+	require.NoError(t, inner.PutObject(context.Background(), "key", []byte("data")))
+	vault := fault.New(inner).
+		SetCredentialType("DEFAULT").
+		Inject(fault.Fault{Op: fault.OpGet, Times: 1, Err: fmt.Errorf("chunk: %w", fault.AccessDenied())})
+	restoreKey := &AuthRestore{RecoveryPointID: "rp", ActionID: "action", CreatedAt: "t0", RestoreSessionKey: "key0"}
+
+	// A denied chunk renews the session and its credential, then is read.
+	data, err := client.GetObject(context.Background(), vault, "key", restoreKey)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("data"), data)
+	assert.Equal(t, "key1", restoreKey.RestoreSessionKey)
+	assert.Equal(t, uint64(1), restoreKey.generation())
+	assert.Equal(t, 1, vault.Calls(fault.OpRefresh))
+
+	// Chunks denied before the renewal do not renew it again.
+	require.NoError(t, client.refreshRestoreCredential(vault, restoreKey, 0))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&sessions))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&credentials))
+	assert.Equal(t, 1, vault.Calls(fault.OpRefresh))
+
+	// Without a session, the credential of the agent is used.
+	vault.Inject(fault.Fault{Op: fault.OpGet, Times: 1, Err: fault.AccessDenied()})
+	_, err = client.GetObject(context.Background(), vault, "key", nil)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&sessions))
+	assert.Equal(t, 2, vault.Calls(fault.OpRefresh))
+}
+
+func TestClient_ObjectRequestBudget(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	// A vault failing every request exhausts the budget instead of retrying
+	// until the retry timeout.
+	inner := fault.New(memory.New("vault", "action")).Inject(fault.Fault{Err: fault.ServiceUnavailable()})
+	vault := budget.New(inner, 2)
+
+	err := client.PutObject(context.Background(), vault, "key", []byte("data"))
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+	_, err = client.GetObject(context.Background(), vault, "key", nil)
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+	assert.Equal(t, 2, inner.Calls(fault.OpPut))
+	assert.Equal(t, uint64(4), vault.Requests())
+}
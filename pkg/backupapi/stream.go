@@ -0,0 +1,124 @@
+package backupapi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// ErrorChunkLength is returned for a chunk whose content is not as long as its
+// index records, which would leave part of the restored file unwritten.
+var ErrorChunkLength = errors.New("chunk length mismatch")
+
+// chunkStreamAttempts is the number of times a chunk is downloaded when its
+// download fails on the way.
+const chunkStreamAttempts = 3
+
+// sectionWriter writes sequentially to w from off.
+type sectionWriter struct {
+	w   io.WriterAt
+	off int64
+	err error
+}
+
+func (s *sectionWriter) Write(p []byte) (int, error) {
+	n, err := s.w.WriteAt(p, s.off)
+	s.off += int64(n)
+	if err != nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// sourceReader remembers the error of reading r, telling a failed download
+// from a chunk which does not decompress.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// restoreChunk writes the chunk info into file at its offset. The chunk is
+// copied as it is downloaded, and downloaded again when that fails on the
+// way, unless chunks are encrypted: they are authenticated whole, so they are
+// read in memory first.
+func (c *Client) restoreChunk(ctx context.Context, file io.WriterAt, info *cache.ChunkInfo, storageVault storage_vault.StorageVault, restoreKey *AuthRestore) error {
+	if c.encryptor != nil {
+		data, err := c.GetObject(ctx, storageVault, info.Etag, restoreKey)
+		if err == nil {
+			data, err = c.openChunk(info.Etag, data)
+		}
+		if err == nil {
+			data, err = decompressChunk(info.Codec, data)
+		}
+		if err != nil {
+			return err
+		}
+		if len(data) != int(info.Length) {
+			return chunkLengthError(info, int64(len(data)))
+		}
+		_, err = file.WriteAt(data, int64(info.Start))
+		return err
+	}
+
+	var err error
+	for attempt := 1; attempt <= chunkStreamAttempts; attempt++ {
+		var interrupted bool
+		if interrupted, err = c.streamChunk(ctx, file, info, storageVault, restoreKey); !interrupted {
+			return err
+		}
+		c.logger.Warn("Chunk download interrupted", zap.Error(err), zap.String("key", info.Etag), zap.Int("attempt", attempt))
+	}
+	return err
+}
+
+// streamChunk copies the chunk info into file as it is downloaded. It reports
+// whether the download failed on the way, so the chunk may be read again.
+func (c *Client) streamChunk(ctx context.Context, file io.WriterAt, info *cache.ChunkInfo, storageVault storage_vault.StorageVault, restoreKey *AuthRestore) (bool, error) {
+	body, err := c.GetObjectStream(ctx, storageVault, info.Etag, restoreKey)
+	if err != nil {
+		return false, err
+	}
+	defer body.Close()
+
+	src := &sourceReader{r: body}
+	r, err := decompressReader(info.Codec, src)
+	if err != nil {
+		return src.err != nil, err
+	}
+	defer r.Close()
+
+	w := &sectionWriter{w: file, off: int64(info.Start)}
+	n, err := io.Copy(w, r)
+	if err != nil {
+		switch {
+		case src.err != nil:
+			return true, src.err
+		case w.err != nil:
+			return false, w.err
+		default:
+			return false, fmt.Errorf("%w: %s: %s", ErrorChunkDecompress, info.Etag, err)
+		}
+	}
+	if n != int64(info.Length) {
+		return false, chunkLengthError(info, n)
+	}
+	return false, nil
+}
+
+func chunkLengthError(info *cache.ChunkInfo, n int64) error {
+	return fmt.Errorf("%w: %s has %d bytes, index records %d", ErrorChunkLength, info.Etag, n, info.Length)
+}
@@ -0,0 +1,146 @@
+package backupapi
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/budget"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+// brokenStreamVault streams its objects, breaking the first broken streams
+// after a few bytes.
+type brokenStreamVault struct {
+	*memory.Memory
+	broken  int
+	streams int
+}
+
+func (v *brokenStreamVault) GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	body, err := v.Memory.GetObjectStream(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	v.streams++
+	if v.streams <= v.broken {
+		return ioutil.NopCloser(io.MultiReader(io.LimitReader(body, 4), &failingReader{})), nil
+	}
+	return body, nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+// plainVault hides the stream of the wrapped vault.
+type plainVault struct {
+	storage_vault.StorageVault
+}
+
+func TestClient_GetObjectStream(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	inner := memory.New("vault", "action")
+	require.NoError(t, inner.PutObject(context.Background(), "key", []byte("data")))
+
+	for _, vault := range []storage_vault.StorageVault{budget.New(inner, 0), plainVault{inner}, budget.New(plainVault{inner}, 0)} {
+		body, err := client.GetObjectStream(context.Background(), vault, "key", nil)
+		require.NoError(t, err)
+		got, err := io.ReadAll(body)
+		require.NoError(t, err)
+		require.NoError(t, body.Close())
+		assert.Equal(t, []byte("data"), got)
+	}
+
+	limited := budget.New(inner, 1)
+	body, err := client.GetObjectStream(context.Background(), limited, "key", nil)
+	require.NoError(t, err)
+	require.NoError(t, body.Close())
+	_, err = client.GetObjectStream(context.Background(), limited, "key", nil)
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+}
+
+func TestClient_restoreChunk(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	content := []byte("hello hello hello hello hello hello hello hello world")
+	for _, codec := range []string{CompressionNone, CompressionZstd, CompressionGzip} {
+		t.Run(codec, func(t *testing.T) {
+			stored, used, err := compressChunk(codec, content)
+			require.NoError(t, err)
+			key := chunkKey(stored)
+			vault := &brokenStreamVault{Memory: memory.New("vault", "action"), broken: 1}
+			require.NoError(t, vault.PutObject(context.Background(), key, stored))
+
+			file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+			require.NoError(t, err)
+			defer file.Close()
+			info := &cache.ChunkInfo{Start: 3, Length: uint(len(content)), Etag: key, Codec: used}
+			require.NoError(t, client.restoreChunk(context.Background(), file, info, vault, nil))
+			assert.Equal(t, 2, vault.streams, "a broken download is read again")
+
+			got, err := os.ReadFile(file.Name())
+			require.NoError(t, err)
+			assert.Equal(t, append(make([]byte, 3), content...), got)
+		})
+	}
+}
+
+func TestClient_restoreChunkInvalid(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault := &brokenStreamVault{Memory: memory.New("vault", "action")}
+	require.NoError(t, vault.PutObject(context.Background(), "key", []byte{codecHeader[CompressionZstd], 1, 2, 3}))
+	file, err := os.Create(filepath.Join(t.TempDir(), "file"))
+	require.NoError(t, err)
+	defer file.Close()
+
+	err = client.restoreChunk(context.Background(), file, &cache.ChunkInfo{Length: 3, Etag: "key", Codec: CompressionZstd}, vault, nil)
+	assert.ErrorIs(t, err, ErrorChunkDecompress)
+	err = client.restoreChunk(context.Background(), file, &cache.ChunkInfo{Length: 3, Etag: "key", Codec: CompressionGzip}, vault, nil)
+	assert.ErrorIs(t, err, ErrorChunkDecompress)
+	assert.Equal(t, 2, vault.streams, "a chunk which does not decompress is not read again")
+}
+
+func TestClient_RestoreDirectoryStream(t *testing.T) {
+	setUp()
+	defer tearDown()
+	viper.Set("num_goroutine", 1)
+	defer viper.Set("num_goroutine", nil)
+	viper.Set("restore_prefetch_depth", 0)
+	defer viper.Set("restore_prefetch_depth", nil)
+
+	inner, index := exportFixture("hello ", "world", "hello ")
+	index.Items["/data/file.txt"].Mode = 0640
+	vault := &brokenStreamVault{Memory: inner}
+	profile, err := GetRestoreProfile("balanced")
+	require.NoError(t, err)
+	require.NotZero(t, profile.ChunkCacheMB)
+
+	dest := t.TempDir()
+	require.NoError(t, client.RestoreDirectory(context.Background(), *index, dest, false, profile, budget.New(vault, 0), nil, progress.NewProgress(time.Second)))
+	got, err := os.ReadFile(filepath.Join(dest, "data", "file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "hello worldhello ", string(got))
+	// Chunks are streamed through the chunk cache, a chunk read again is
+	// served from it.
+	assert.Equal(t, 2, vault.streams)
+}
@@ -0,0 +1,75 @@
+package backupapi
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+)
+
+// SymlinkRewrite is a restored symlink whose absolute target, inside the
+// backup root, was rewritten to point into the restore destination.
+type SymlinkRewrite struct {
+	Path            string `json:"path"`
+	Target          string `json:"target"`
+	RewrittenTarget string `json:"rewritten_target"`
+}
+
+// restoreRoots returns the original directory the items restored along with
+// item were backed up from, and where it is restored under destDir. Both are
+// empty when item is restored in place.
+func restoreRoots(destDir string, item *cache.Node) (string, string) {
+	if item.BasePath != "" {
+		if destDir == item.BasePath {
+			return "", ""
+		}
+		return item.BasePath, filepath.Join(destDir, filepath.Base(item.BasePath))
+	}
+	// Restored with StripPrefix, the relative path of the item is below the
+	// prefix restored as destDir.
+	suffix := string(filepath.Separator) + filepath.Clean(item.RelativePath)
+	if !strings.HasSuffix(item.AbsolutePath, suffix) {
+		return "", ""
+	}
+	return strings.TrimSuffix(item.AbsolutePath, suffix), destDir
+}
+
+// symlinkTarget returns the target symlink item is restored with under
+// destDir, and whether it was rewritten. With rewrite_symlinks set, an
+// absolute target inside the original root is rewritten to the same path under
+// the restored root, other targets are kept as they are.
+func symlinkTarget(destDir string, item *cache.Node) (string, bool) {
+	target := item.LinkTarget
+	if !viper.GetBool("rewrite_symlinks") || !filepath.IsAbs(target) {
+		return target, false
+	}
+	from, to := restoreRoots(destDir, item)
+	if from == "" || from == to {
+		return target, false
+	}
+	rel, err := filepath.Rel(from, filepath.Clean(target))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return target, false
+	}
+	return filepath.Join(to, rel), true
+}
+
+// RewrittenSymlinks returns the symlinks of index whose target is rewritten
+// when restored under destDir, sorted by path.
+func RewrittenSymlinks(index cache.Index, destDir string) []SymlinkRewrite {
+	var rewrites []SymlinkRewrite
+	for _, item := range index.Items {
+		if item.Type != "symlink" {
+			continue
+		}
+		if target, ok := symlinkTarget(destDir, item); ok {
+			path, _ := restorePath(destDir, item)
+			rewrites = append(rewrites, SymlinkRewrite{Path: path, Target: item.LinkTarget, RewrittenTarget: target})
+		}
+	}
+	sort.Slice(rewrites, func(i, j int) bool { return rewrites[i].Path < rewrites[j].Path })
+	return rewrites
+}
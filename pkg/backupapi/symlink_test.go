@@ -0,0 +1,160 @@
+package backupapi
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/support"
+)
+
+func Test_symlinkTarget(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix paths")
+	}
+	viper.Set("rewrite_symlinks", true)
+	defer viper.Set("rewrite_symlinks", nil)
+
+	link := func(target string) *cache.Node {
+		return &cache.Node{Type: "symlink", LinkTarget: target, AbsolutePath: "/backup/data/app/link", BasePath: "/backup/data", RelativePath: "data/app/link"}
+	}
+	tests := []struct {
+		name      string
+		item      *cache.Node
+		destDir   string
+		want      string
+		rewritten bool
+	}{
+		{"internal", link("/backup/data/app/file"), "/restore", "/restore/data/app/file", true},
+		{"root", link("/backup/data"), "/restore", "/restore/data", true},
+		{"unclean internal", link("/backup/data/app/../conf/"), "/restore", "/restore/data/conf", true},
+		{"external", link("/etc/passwd"), "/restore", "/etc/passwd", false},
+		{"sibling with same prefix", link("/backup/database/file"), "/restore", "/backup/database/file", false},
+		{"parent of root", link("/backup"), "/restore", "/backup", false},
+		{"relative", link("../file"), "/restore", "../file", false},
+		{"in place", link("/backup/data/app/file"), "/backup/data", "/backup/data/app/file", false},
+		{"stripped prefix", &cache.Node{Type: "symlink", LinkTarget: "/backup/data/app/sub/file", AbsolutePath: "/backup/data/app/link", RelativePath: "link"},
+			"/restore", "/restore/sub/file", true},
+		{"stripped prefix, target above it", &cache.Node{Type: "symlink", LinkTarget: "/backup/data/other", AbsolutePath: "/backup/data/app/link", RelativePath: "link"},
+			"/restore", "/backup/data/other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, rewritten := symlinkTarget(tt.destDir, tt.item)
+			assert.Equal(t, tt.want, got)
+			assert.Equal(t, tt.rewritten, rewritten)
+		})
+	}
+
+	// Off by default.
+	viper.Set("rewrite_symlinks", nil)
+	got, rewritten := symlinkTarget("/restore", link("/backup/data/app/file"))
+	assert.Equal(t, "/backup/data/app/file", got)
+	assert.False(t, rewritten)
+}
+
+func TestClient_RestoreItemRewriteSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks differ on windows")
+	}
+	setUp()
+	defer tearDown()
+	viper.Set("rewrite_symlinks", true)
+	defer viper.Set("rewrite_symlinks", nil)
+
+	index := cache.NewIndex("bd", "rp")
+	index.Items["/backup/data/internal"] = &cache.Node{Type: "symlink", Name: "internal", LinkTarget: "/backup/data/app/file",
+		AbsolutePath: "/backup/data/internal", BasePath: "/backup/data", RelativePath: "data/internal"}
+	index.Items["/backup/data/external"] = &cache.Node{Type: "symlink", Name: "external", LinkTarget: "/etc/hosts",
+		AbsolutePath: "/backup/data/external", BasePath: "/backup/data", RelativePath: "data/external"}
+
+	dest := t.TempDir()
+	for _, item := range index.Items {
+		require.NoError(t, client.RestoreItem(context.Background(), dest, *item, nil, nil, progress.NewProgress(time.Second)))
+	}
+	target, err := os.Readlink(filepath.Join(dest, "data", "internal"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dest, "data", "app", "file"), target)
+	target, err = os.Readlink(filepath.Join(dest, "data", "external"))
+	require.NoError(t, err)
+	assert.Equal(t, "/etc/hosts", target)
+
+	assert.Equal(t, []SymlinkRewrite{{
+		Path:            filepath.Join(dest, "data", "internal"),
+		Target:          "/backup/data/app/file",
+		RewrittenTarget: filepath.Join(dest, "data", "app", "file"),
+	}}, RewrittenSymlinks(*index, dest))
+}
+
+func TestClient_RestoreItemSymlinkOwner(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ownership is not restored on windows")
+	}
+	setUp()
+	defer tearDown()
+	viper.Set("chown_failure", ChownFailureError)
+	defer viper.Set("chown_failure", "")
+
+	dest := t.TempDir()
+	file := filepath.Join(dest, "data", "file")
+	require.NoError(t, os.MkdirAll(filepath.Dir(file), 0700))
+	require.NoError(t, os.WriteFile(file, []byte("data"), 0600))
+
+	// As root the symlinks are given to another owner, else to the current one.
+	uid, gid := os.Getuid(), os.Getgid()
+	if uid == 0 {
+		uid, gid = 1000, 1000
+	}
+	link := cache.Node{Type: "symlink", Name: "link", LinkTarget: file, Mode: os.ModeSymlink | 0777,
+		UID: uint32(uid), GID: uint32(gid), RelativePath: "data/link"}
+	dangling := cache.Node{Type: "symlink", Name: "dangling", LinkTarget: filepath.Join(dest, "missing"), Mode: os.ModeSymlink | 0777,
+		UID: uint32(uid), GID: uint32(gid), RelativePath: "data/dangling"}
+
+	// A symlink restored again is found in place, even when dangling.
+	for i := 0; i < 2; i++ {
+		for _, item := range []cache.Node{link, dangling} {
+			require.NoError(t, client.RestoreItem(context.Background(), dest, item, nil, nil, progress.NewProgress(time.Second)))
+		}
+	}
+
+	for _, name := range []string{"link", "dangling"} {
+		fi, err := os.Lstat(filepath.Join(dest, "data", name))
+		require.NoError(t, err)
+		_, _, _, linkUID, linkGID, _ := support.ItemLocal(fi)
+		assert.Equal(t, uint32(uid), linkUID, name)
+		assert.Equal(t, uint32(gid), linkGID, name)
+	}
+
+	// The target keeps its mode and owner.
+	fi, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+	_, _, _, fileUID, fileGID, _ := support.ItemLocal(fi)
+	assert.Equal(t, uint32(os.Getuid()), fileUID)
+	assert.Equal(t, uint32(os.Getgid()), fileGID)
+}
+
+func TestClient_lchown(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("ownership is not restored on windows")
+	}
+	setUp()
+	defer tearDown()
+	defer viper.Set("chown_failure", "")
+
+	// Lchown of a missing path fails whatever the current user is.
+	missing := filepath.Join(t.TempDir(), "missing")
+	viper.Set("chown_failure", ChownFailureIgnore)
+	assert.NoError(t, client.lchown(missing, os.Getuid(), os.Getgid()))
+	viper.Set("chown_failure", ChownFailureError)
+	assert.Error(t, client.lchown(missing, os.Getuid(), os.Getgid()))
+}
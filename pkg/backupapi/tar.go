@@ -0,0 +1,125 @@
+package backupapi
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+
+	"go.uber.org/zap"
+)
+
+// RestoreToTar writes the items of index to w as a tar stream. File content is
+// fetched chunk by chunk from the storage vault, nothing is staged on disk.
+func (c *Client) RestoreToTar(ctx context.Context, index cache.Index, w io.Writer, storageVault storage_vault.StorageVault, restoreKey *AuthRestore) error {
+	items := make([]*cache.Node, 0, len(index.Items))
+	for _, item := range index.Items {
+		items = append(items, item)
+	}
+	// Parents sort before their children.
+	sort.Slice(items, func(i, j int) bool {
+		return filepath.ToSlash(items[i].RelativePath) < filepath.ToSlash(items[j].RelativePath)
+	})
+
+	tw := tar.NewWriter(w)
+	for _, item := range items {
+		select {
+		case <-ctx.Done():
+			return ErrorGotCancelRequest
+		default:
+		}
+
+		hdr, err := tarHeader(item)
+		if err != nil {
+			c.logger.Error("Skip item ", zap.Error(err), zap.String("path", item.AbsolutePath))
+			continue
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			c.logger.Error("err write tar header ", zap.Error(err), zap.String("path", item.AbsolutePath))
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		if err := c.writeFileContent(ctx, tw, item, storageVault, restoreKey); err != nil {
+			c.logger.Error("err write tar content ", zap.Error(err), zap.String("path", item.AbsolutePath))
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (c *Client) writeFileContent(ctx context.Context, w io.Writer, item *cache.Node, storageVault storage_vault.StorageVault, restoreKey *AuthRestore) error {
+	chunks := make([]*cache.ChunkInfo, len(item.Content))
+	copy(chunks, item.Content)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Start < chunks[j].Start })
+
+	var written uint64
+	for _, chunk := range chunks {
+		select {
+		case <-ctx.Done():
+			return ErrorGotCancelRequest
+		default:
+		}
+
+		if uint64(chunk.Start) != written {
+			return fmt.Errorf("chunk %s starts at %d, expected %d", chunk.Etag, chunk.Start, written)
+		}
+		data, err := c.GetObject(ctx, storageVault, chunk.Etag, restoreKey)
+		if err != nil {
+			return err
+		}
+		if data, err = c.openChunk(chunk.Etag, data); err != nil {
+			return err
+		}
+		if data, err = decompressChunk(chunk.Codec, data); err != nil {
+			return err
+		}
+		if uint(len(data)) != chunk.Length {
+			return fmt.Errorf("chunk %s has %d bytes, expected %d", chunk.Etag, len(data), chunk.Length)
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+		written += uint64(len(data))
+	}
+	if written != item.Size {
+		return fmt.Errorf("file has %d bytes, expected %d", written, item.Size)
+	}
+	return nil
+}
+
+func tarHeader(item *cache.Node) (*tar.Header, error) {
+	hdr := &tar.Header{
+		Name:       filepath.ToSlash(item.RelativePath),
+		Mode:       int64(item.Mode & os.ModePerm),
+		Uid:        int(item.UID),
+		Gid:        int(item.GID),
+		Uname:      item.User,
+		Gname:      item.Group,
+		ModTime:    item.ModTime,
+		AccessTime: item.AccessTime,
+		ChangeTime: item.ChangeTime,
+		Format:     tar.FormatPAX,
+	}
+	switch item.Type {
+	case "dir":
+		hdr.Typeflag = tar.TypeDir
+		hdr.Name += "/"
+	case "symlink":
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = item.LinkTarget
+	case "file":
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = int64(item.Size)
+	default:
+		return nil, fmt.Errorf("unsupported item type %q", item.Type)
+	}
+	return hdr, nil
+}
@@ -0,0 +1,86 @@
+package backupapi
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient_RestoreToTar(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault := memory.New("vault", "")
+	var content []*cache.ChunkInfo
+	var start uint
+	for _, part := range []string{"hello ", "tar ", "world"} {
+		hash := md5.Sum([]byte(part))
+		key := hex.EncodeToString(hash[:])
+		require.NoError(t, vault.PutObject(context.Background(), key, []byte(part)))
+		content = append(content, &cache.ChunkInfo{Start: start, Length: uint(len(part)), Etag: key})
+		start += uint(len(part))
+	}
+	// Chunks are reassembled by offset, not by slice order.
+	content[0], content[2] = content[2], content[0]
+
+	mtime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	index := cache.NewIndex("bd", "rp")
+	index.Items["/data/file.txt"] = &cache.Node{Type: "file", RelativePath: "data/file.txt", Mode: 0640, UID: 1000, GID: 1000, ModTime: mtime, Size: uint64(start), Content: content}
+	index.Items["/data"] = &cache.Node{Type: "dir", RelativePath: "data", Mode: 0755, ModTime: mtime}
+	index.Items["/data/link"] = &cache.Node{Type: "symlink", RelativePath: "data/link", Mode: 0777, LinkTarget: "file.txt", ModTime: mtime}
+
+	var buf bytes.Buffer
+	require.NoError(t, client.RestoreToTar(context.Background(), *index, &buf, vault, nil))
+
+	tr := tar.NewReader(&buf)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		require.NoError(t, err)
+		names = append(names, hdr.Name)
+		assert.True(t, hdr.ModTime.Equal(mtime))
+		switch hdr.Name {
+		case "data/":
+			assert.Equal(t, byte(tar.TypeDir), hdr.Typeflag)
+			assert.Equal(t, int64(0755), hdr.Mode)
+		case "data/file.txt":
+			assert.Equal(t, byte(tar.TypeReg), hdr.Typeflag)
+			assert.Equal(t, int64(0640), hdr.Mode)
+			assert.Equal(t, 1000, hdr.Uid)
+			data, err := ioutil.ReadAll(tr)
+			require.NoError(t, err)
+			assert.Equal(t, "hello tar world", string(data))
+		case "data/link":
+			assert.Equal(t, byte(tar.TypeSymlink), hdr.Typeflag)
+			assert.Equal(t, "file.txt", hdr.Linkname)
+		}
+	}
+	assert.Equal(t, []string{"data/", "data/file.txt", "data/link"}, names)
+}
+
+func TestClient_RestoreToTarCancel(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	index := cache.NewIndex("bd", "rp")
+	index.Items["/data"] = &cache.Node{Type: "dir", RelativePath: "data"}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := client.RestoreToTar(ctx, *index, ioutil.Discard, memory.New("vault", ""), nil)
+	assert.ErrorIs(t, err, ErrorGotCancelRequest)
+}
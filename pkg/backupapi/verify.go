@@ -0,0 +1,280 @@
+package backupapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+
+	"go.uber.org/zap"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// ErrorRestoreMismatch is returned when restored files differ from the hashes
+// recorded in the index of the recovery point.
+var ErrorRestoreMismatch = errors.New("restored data does not match recorded hash")
+
+// Mismatch describes a restored file which differs from the index.
+type Mismatch struct {
+	Path   string `json:"path"`
+	Reason string `json:"reason"`
+}
+
+// VerifyRestore reads back the files of index restored under destDir and
+// compares each to the hash recorded with the file. It returns the number of
+// files verified and the ones which differ.
+func (c *Client) VerifyRestore(ctx context.Context, index cache.Index, destDir string) (int, []Mismatch, error) {
+	paths := make([]string, 0, len(index.Items))
+	for path, item := range index.Items {
+		if item.Type == "file" || item.Type == "blockdev" {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	var verified int
+	var mismatches []Mismatch
+	for _, path := range paths {
+		select {
+		case <-ctx.Done():
+			return verified, mismatches, ErrorGotCancelRequest
+		default:
+		}
+		item := index.Items[path]
+		target, _ := restorePath(destDir, item)
+		if reason := verifyFile(target, item); reason != "" {
+			c.logger.Warn("Restored file differs from backup", zap.String("path", target), zap.String("reason", reason))
+			mismatches = append(mismatches, Mismatch{Path: target, Reason: reason})
+			continue
+		}
+		verified++
+	}
+	return verified, mismatches, nil
+}
+
+// verifyFile returns why the file at path differs from item, or "" when it
+// matches. Only the first item.Size bytes of a device are read.
+func verifyFile(path string, item *cache.Node) string {
+	if len(item.Sha256Hash) == 0 {
+		return "no recorded hash"
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer file.Close()
+
+	if item.Type == "file" {
+		fi, err := file.Stat()
+		if err != nil {
+			return err.Error()
+		}
+		if uint64(fi.Size()) != item.Size {
+			return fmt.Sprintf("size %d, expected %d", fi.Size(), item.Size)
+		}
+	}
+	hash, err := newFileHash(item.HashAlgo)
+	if err != nil {
+		return err.Error()
+	}
+	n, err := io.Copy(hash, io.LimitReader(file, int64(item.Size)))
+	if err != nil {
+		return err.Error()
+	}
+	if uint64(n) != item.Size {
+		return fmt.Sprintf("size %d, expected %d", n, item.Size)
+	}
+	if sum := hash.Sum(nil); !bytes.Equal(sum, item.Sha256Hash) {
+		return fmt.Sprintf("%s %s, expected %s", HashName(item.HashAlgo), hex.EncodeToString(sum), item.Sha256Hash)
+	}
+	return ""
+}
+
+// ErrorBackupMismatch is returned when the chunks uploaded for a backup do not
+// rebuild the files they were read from.
+var ErrorBackupMismatch = errors.New("uploaded data does not match recorded hash")
+
+// VerifyBackup reads back from storageVault the chunks of a share rate of the
+// files of index, at least one, and compares each rebuilt file to the hash
+// recorded for it. A rate of 1 or more checks every file. It returns the
+// number of files verified and the ones which differ.
+func (c *Client) VerifyBackup(ctx context.Context, index *cache.Index, storageVault storage_vault.StorageVault, rate float64) (int, []Mismatch, error) {
+	paths := make([]string, 0, len(index.Items))
+	for path, item := range index.Items {
+		if (item.Type == "file" || item.Type == "blockdev") && len(item.Sha256Hash) > 0 {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+	if rate < 1 && len(paths) > 0 {
+		sampled := paths[:0]
+		for _, path := range paths {
+			if rand.Float64() < rate {
+				sampled = append(sampled, path)
+			}
+		}
+		if len(sampled) == 0 {
+			sampled = append(sampled, paths[rand.Intn(len(paths))])
+		}
+		paths = sampled
+	}
+
+	var verified int
+	var mismatches []Mismatch
+	for _, path := range paths {
+		select {
+		case <-ctx.Done():
+			return verified, mismatches, ErrorGotCancelRequest
+		default:
+		}
+		item := index.Items[path]
+		if reason := c.verifyChunks(ctx, storageVault, item); reason != "" {
+			c.logger.Warn("Uploaded file differs from backup", zap.String("path", path), zap.String("reason", reason))
+			mismatches = append(mismatches, Mismatch{Path: path, Reason: reason})
+			continue
+		}
+		verified++
+	}
+	return verified, mismatches, nil
+}
+
+// verifyChunks returns why the chunks of item in storageVault do not rebuild
+// it, or "" when they do. The holes between chunks read as zeros, as they are
+// restored. Chunks are read like a restore reads them, retried and with the
+// credential refreshed.
+func (c *Client) verifyChunks(ctx context.Context, storageVault storage_vault.StorageVault, item *cache.Node) string {
+	content := make([]*cache.ChunkInfo, len(item.Content))
+	copy(content, item.Content)
+	sort.Slice(content, func(i, j int) bool { return content[i].Start < content[j].Start })
+
+	hash, err := newFileHash(item.HashAlgo)
+	if err != nil {
+		return err.Error()
+	}
+	var size uint64
+	for _, info := range content {
+		if uint64(info.Start) < size {
+			return fmt.Sprintf("chunk %s overlaps at %d", info.Etag, info.Start)
+		}
+		hashZeros(hash, uint64(info.Start)-size)
+		data, err := c.GetObject(ctx, storageVault, info.Etag, nil)
+		if err == nil {
+			data, err = c.openChunk(info.Etag, data)
+		}
+		if err == nil {
+			data, err = decompressChunk(info.Codec, data)
+		}
+		if err != nil {
+			return fmt.Sprintf("chunk %s: %s", info.Etag, err)
+		}
+		if uint(len(data)) != info.Length {
+			return fmt.Sprintf("chunk %s size %d, expected %d", info.Etag, len(data), info.Length)
+		}
+		hash.Write(data)
+		size = uint64(info.Start) + uint64(info.Length)
+	}
+	if item.Type == "file" && size < item.Size {
+		hashZeros(hash, item.Size-size)
+		size = item.Size
+	}
+	if size != item.Size {
+		return fmt.Sprintf("size %d, expected %d", size, item.Size)
+	}
+	if sum := hash.Sum(nil); !bytes.Equal(sum, item.Sha256Hash) {
+		return fmt.Sprintf("%s %s, expected %s", HashName(item.HashAlgo), hex.EncodeToString(sum), item.Sha256Hash)
+	}
+	return ""
+}
+
+// hashZeros writes n zero bytes to w, the hole of a sparse file.
+func hashZeros(w io.Writer, n uint64) {
+	if n == 0 {
+		return
+	}
+	zeros := make([]byte, 32*1024)
+	for n > 0 {
+		chunk := uint64(len(zeros))
+		if n < chunk {
+			chunk = n
+		}
+		w.Write(zeros[:chunk])
+		n -= chunk
+	}
+}
+
+// ChunkHealth is the state of the chunks of a recovery point in its storage
+// vault.
+type ChunkHealth struct {
+	Chunks  int      `json:"chunks"`
+	Missing []string `json:"missing"`
+	Corrupt []string `json:"corrupt"`
+}
+
+// Healthy reports whether every chunk was found with its content.
+func (h *ChunkHealth) Healthy() bool {
+	return len(h.Missing) == 0 && len(h.Corrupt) == 0
+}
+
+// VerifyChunks reads back every chunk of chunks from storageVault,
+// concurrency at a time, and checks that its content matches its key. A chunk
+// not found is missing, one which reads back different is corrupt; any other
+// error stops the check.
+func (c *Client) VerifyChunks(ctx context.Context, chunks *cache.Chunk, storageVault storage_vault.StorageVault, concurrency int) (*ChunkHealth, error) {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	keys := make([]string, 0, len(chunks.Chunks))
+	for key := range chunks.Chunks {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	sem := semaphore.NewWeighted(int64(concurrency))
+	group, gctx := errgroup.WithContext(ctx)
+	var mu sync.Mutex
+	health := &ChunkHealth{Chunks: len(keys)}
+	for _, key := range keys {
+		if err := sem.Acquire(gctx, 1); err != nil {
+			break
+		}
+		key := key
+		group.Go(func() error {
+			defer sem.Release(1)
+			data, err := c.GetObject(gctx, storageVault, key, nil)
+			if err != nil && !isNotFound(err) {
+				return fmt.Errorf("chunk %s: %w", key, err)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				health.Missing = append(health.Missing, key)
+			} else if !chunkKeyMatches(key, data) {
+				health.Corrupt = append(health.Corrupt, key)
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return health, err
+	}
+	if ctx.Err() != nil {
+		return health, ErrorGotCancelRequest
+	}
+	sort.Strings(health.Missing)
+	sort.Strings(health.Corrupt)
+	if !health.Healthy() {
+		c.logger.Warn("Chunks of recovery point are damaged", zap.String("recovery_point_id", chunks.RecoveryPointID),
+			zap.Int("missing", len(health.Missing)), zap.Int("corrupt", len(health.Corrupt)))
+	}
+	return health, nil
+}
@@ -0,0 +1,157 @@
+package backupapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/fault"
+)
+
+func TestClient_VerifyRestore(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault, index := exportFixture("hello ", "world")
+	hash := sha256.Sum256([]byte("hello world"))
+	node := index.Items["/data/file.txt"]
+	node.Mode = 0600
+	node.Sha256Hash = hash[:]
+
+	dest := t.TempDir()
+	require.NoError(t, client.RestoreDirectory(context.Background(), *index, dest, false, RestoreProfile{}, vault, nil, progress.NewProgress(time.Second)))
+	verified, mismatches, err := client.VerifyRestore(context.Background(), *index, dest)
+	require.NoError(t, err)
+	assert.Equal(t, 1, verified)
+	assert.Empty(t, mismatches)
+
+	target := filepath.Join(dest, "data/file.txt")
+	tests := []struct {
+		name    string
+		content string
+		reason  string
+	}{
+		{"same size", "hello WORLD", "sha256"},
+		{"truncated", "hello", "size 5, expected 11"},
+		{"missing", "", "no such file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.content == "" {
+				require.NoError(t, os.Remove(target))
+			} else {
+				require.NoError(t, os.WriteFile(target, []byte(tt.content), 0600))
+			}
+			verified, mismatches, err := client.VerifyRestore(context.Background(), *index, dest)
+			require.NoError(t, err)
+			assert.Equal(t, 0, verified)
+			require.Len(t, mismatches, 1)
+			assert.Equal(t, target, mismatches[0].Path)
+			assert.Contains(t, mismatches[0].Reason, tt.reason)
+		})
+	}
+
+	node.Sha256Hash = nil
+	_, mismatches, err = client.VerifyRestore(context.Background(), *index, dest)
+	require.NoError(t, err)
+	require.Len(t, mismatches, 1)
+	assert.Equal(t, "no recorded hash", mismatches[0].Reason)
+}
+
+func TestClient_VerifyBackup(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault, index := exportFixture("hello ", "world")
+	hash := sha256.Sum256([]byte("hello world"))
+	node := index.Items["/data/file.txt"]
+	node.Sha256Hash = hash[:]
+	// A sparse file, its hole read as zeros.
+	sparse := []byte("\x00\x00\x00\x00hello \x00\x00")
+	sparseHash := sha256.Sum256(sparse)
+	index.Items["/data/sparse"] = &cache.Node{Type: "file", Size: uint64(len(sparse)), Sha256Hash: sparseHash[:],
+		Content: []*cache.ChunkInfo{{Start: 4, Length: 6, Etag: node.Content[0].Etag}}}
+	index.Items["/data"] = &cache.Node{Type: "directory"}
+
+	verified, mismatches, err := client.VerifyBackup(context.Background(), index, vault, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, verified)
+	assert.Empty(t, mismatches)
+
+	// A chunk failing to read is retried rather than reported.
+	failing := fault.New(vault).Inject(fault.Fault{Op: fault.OpGet, Key: node.Content[1].Etag, Times: 1, Err: fault.ServiceUnavailable()})
+	verified, mismatches, err = client.VerifyBackup(context.Background(), index, failing, 1)
+	require.NoError(t, err)
+	assert.Equal(t, 2, verified)
+	assert.Empty(t, mismatches)
+
+	// At least one file is sampled.
+	verified, mismatches, err = client.VerifyBackup(context.Background(), index, vault, 0.0001)
+	require.NoError(t, err)
+	assert.Equal(t, 1, verified+len(mismatches))
+
+	tests := []struct {
+		name   string
+		setup  func()
+		reason string
+	}{
+		{"corrupt chunk", func() {
+			require.NoError(t, vault.PutObject(context.Background(), node.Content[1].Etag, []byte("WORLD")))
+		}, "sha256"},
+		{"short chunk", func() { require.NoError(t, vault.PutObject(context.Background(), node.Content[1].Etag, []byte("wor"))) }, "size 3, expected 5"},
+		{"missing chunk", func() { vault.Delete(node.Content[1].Etag) }, "chunk " + node.Content[1].Etag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.setup()
+			verified, mismatches, err := client.VerifyBackup(context.Background(), index, vault, 1)
+			require.NoError(t, err)
+			assert.Equal(t, 1, verified)
+			require.Len(t, mismatches, 1)
+			assert.Equal(t, "/data/file.txt", mismatches[0].Path)
+			assert.Contains(t, mismatches[0].Reason, tt.reason)
+		})
+	}
+}
+
+func TestClient_VerifyChunks(t *testing.T) {
+	setUp()
+	defer tearDown()
+
+	vault, index := exportFixture("hello ", "world", "again")
+	chunks := cache.RebuildChunk(index)
+	content := index.Items["/data/file.txt"].Content
+
+	health, err := client.VerifyChunks(context.Background(), chunks, vault, 2)
+	require.NoError(t, err)
+	assert.Equal(t, &ChunkHealth{Chunks: 3}, health)
+	assert.True(t, health.Healthy())
+
+	vault.Delete(content[1].Etag)
+	require.True(t, vault.Corrupt(content[2].Etag, []byte("AGAIN")))
+	health, err = client.VerifyChunks(context.Background(), chunks, vault, 2)
+	require.NoError(t, err)
+	assert.False(t, health.Healthy())
+	assert.Equal(t, []string{content[1].Etag}, health.Missing)
+	assert.Equal(t, []string{content[2].Etag}, health.Corrupt)
+
+	// A chunk failing to read is retried.
+	failing := fault.New(vault).Inject(fault.Fault{Op: fault.OpGet, Key: content[0].Etag, Times: 1, Err: fault.ServiceUnavailable()})
+	health, err = client.VerifyChunks(context.Background(), chunks, failing, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{content[1].Etag}, health.Missing)
+
+	// Errors other than a missing chunk stop the check.
+	failing = fault.New(vault).Inject(fault.Fault{Op: fault.OpGet, Key: content[0].Etag, Err: storage_vault.ErrRequestBudgetExhausted})
+	_, err = client.VerifyChunks(context.Background(), chunks, failing, 2)
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+}
@@ -1,5 +1,7 @@
 package broker
 
+import "errors"
+
 // Broker is the interface to perform async messaging.
 type Broker interface {
 	Connect() error
@@ -10,9 +12,45 @@ type Broker interface {
 	String() string
 }
 
-// Handler handles a message receive from a topic.
+// ConnectionStatus is implemented by brokers which can report whether they
+// are currently connected.
+type ConnectionStatus interface {
+	IsConnected() bool
+}
+
+// Handler handles a message receive from a topic. The message is
+// acknowledged once Handler returns nil or a permanent error, see Permanent.
+// Any other error leaves it unacknowledged, and the broker delivers it again
+// on the next connection, e.g. after a restart of the agent.
 type Handler func(Event) error
 
+// ErrPermanent is matched by the errors of Handler which would happen again if
+// the message was delivered again.
+var ErrPermanent = errors.New("permanent failure")
+
+type permanentError struct {
+	err error
+}
+
+func (e permanentError) Error() string        { return e.err.Error() }
+func (e permanentError) Unwrap() error        { return e.err }
+func (e permanentError) Is(target error) bool { return target == ErrPermanent }
+
+// Permanent marks err as a permanent failure, so that the message is
+// acknowledged instead of being delivered again. Permanent(nil) is nil.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return permanentError{err: err}
+}
+
+// IsPermanent reports whether err is a permanent failure. An unknown event
+// type always is.
+func IsPermanent(err error) bool {
+	return errors.Is(err, ErrPermanent) || errors.Is(err, ErrUnknownEventType)
+}
+
 // Event is the event passed to Handler
 type Event struct {
 	Topic     string
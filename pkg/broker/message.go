@@ -9,6 +9,7 @@ import (
 const (
 	BackupManual                        = "backup_manual"
 	RestoreManual                       = "restore_manual"
+	RebuildChunks                       = "rebuild_chunks"
 	ConfigUpdate                        = "update_config"
 	ConfigRefresh                       = "refresh_config"
 	AgentUpgrade                        = "agent_upgrade"
@@ -20,8 +21,10 @@ const (
 	ConfigUpdateActionAddDirectory      = "add_directory"
 	ConfigUpdateActionDelDirectory      = "del_directory"
 	StatusNotify                        = "status_notify"
+	Heartbeat                           = "heartbeat"
 	StopAction                          = "stop_action"
 	UpdateNumGoroutine                  = "update_num_goroutine"
+	BackupProgress                      = "backup_progress"
 )
 
 // ErrUnknownEventType is raised when receiving unhandled event from broker.
@@ -51,6 +54,10 @@ type Message struct {
 	RestoreSessionKey    string `json:"restore_session_key"`
 	ActionId             string `json:"action_id"`
 	StorageVaultId       string `json:"storage_vault_id"`
+	StripPrefix          string `json:"strip_prefix"`
+	MetadataOnly         bool   `json:"metadata_only"`
+	Force                bool   `json:"force"`
+	Profile              string `json:"profile"`
 
 	// For config update
 	BackupDirectories []backupapi.BackupDirectoryConfig `json:"backup_directories"`
@@ -1,8 +1,10 @@
 package mqtt
 
 import (
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"net"
 	"net/url"
 	"time"
 
@@ -18,9 +20,17 @@ const (
 )
 
 var _ broker.Broker = (*MQTTBroker)(nil)
+var _ broker.ConnectionStatus = (*MQTTBroker)(nil)
 
 var ErrNoConnection = errors.New("no connection to broker server")
 
+// ErrCertificate is returned when a certificate for the TLS connection to the
+// broker can not be loaded.
+var ErrCertificate = errors.New("failed to load broker certificate")
+
+// defaultTLSPort is the port of a broker reached over TLS when the url has none.
+const defaultTLSPort = "8883"
+
 var tokenWaitTimeout = 3 * time.Second
 
 // MQTTBroker implements broker.Broker interface.
@@ -37,6 +47,9 @@ type MQTTBroker struct {
 	// Option for resubscribe when OnConnect
 	subscribeTopics  []string
 	subscribeHandler broker.Handler
+
+	// tlsConfig is set to connect over TLS.
+	tlsConfig *tls.Config
 }
 
 // NewBroker creates new mqtt broker.
@@ -60,7 +73,20 @@ func NewBroker(opts ...Option) (*MQTTBroker, error) {
 
 func (m *MQTTBroker) opts() *mqtt.ClientOptions {
 	opts := mqtt.NewClientOptions()
-	opts.AddBroker("tcp://" + m.uri.Host)
+	if m.useTLS() {
+		host := m.uri.Host
+		if m.uri.Port() == "" {
+			host = net.JoinHostPort(m.uri.Hostname(), defaultTLSPort)
+		}
+		opts.AddBroker("ssl://" + host)
+		config := m.tlsConfig
+		if config == nil {
+			config = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		opts.SetTLSConfig(config)
+	} else {
+		opts.AddBroker("tcp://" + m.uri.Host)
+	}
 	username := m.username
 	if u := m.uri.User.Username(); u != "" {
 		username = u
@@ -73,6 +99,13 @@ func (m *MQTTBroker) opts() *mqtt.ClientOptions {
 	opts.SetPassword(password)
 	opts.SetClientID(m.clientID)
 	opts.SetCleanSession(false)
+	// The agent reconnects on its own, so that IsConnected reports a lost
+	// connection rather than one being restored.
+	opts.SetAutoReconnect(false)
+	// Messages are acknowledged by messageHandler once handled, each in its
+	// own goroutine so that a long running event does not hold the others.
+	opts.SetAutoAckDisabled(true)
+	opts.SetOrderMatters(false)
 
 	var connectHandler mqtt.OnConnectHandler = func(client mqtt.Client) {
 		m.logger.Info("Connected to broker")
@@ -109,6 +142,24 @@ func (m *MQTTBroker) opts() *mqtt.ClientOptions {
 	return opts
 }
 
+// tlsConf returns the TLS config of the connection, creating it.
+func (m *MQTTBroker) tlsConf() *tls.Config {
+	if m.tlsConfig == nil {
+		m.tlsConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	return m.tlsConfig
+}
+
+// useTLS reports whether the broker is reached over TLS, asked by the scheme
+// of its url or by a TLS option.
+func (m *MQTTBroker) useTLS() bool {
+	switch m.uri.Scheme {
+	case "mqtts", "ssl", "tls", "tcps":
+		return true
+	}
+	return m.tlsConfig != nil
+}
+
 // connect and update option to auto resubscribe with option OnConnect
 func (m *MQTTBroker) ConnectAndSubscribe(subHandler broker.Handler, subTopics []string) error {
 	// update subscribe option
@@ -137,6 +188,11 @@ func (m *MQTTBroker) Disconnect() error {
 	return nil
 }
 
+// IsConnected reports whether the client is connected to the broker.
+func (m *MQTTBroker) IsConnected() bool {
+	return m.client != nil && m.client.IsConnected()
+}
+
 func (m *MQTTBroker) Publish(topic string, payload interface{}) error {
 	if m.client == nil {
 		return ErrNoConnection
@@ -160,22 +216,34 @@ func (m *MQTTBroker) Subscribe(topics []string, h broker.Handler) error {
 		filters[topic] = m.qos
 	}
 
-	token := m.client.SubscribeMultiple(filters, func(client mqtt.Client, msg mqtt.Message) {
-		if err := h(broker.Event{
+	token := m.client.SubscribeMultiple(filters, m.messageHandler(h))
+	for !token.WaitTimeout(tokenWaitTimeout) {
+	}
+
+	return token.Error()
+}
+
+// messageHandler calls h with a received message, and acknowledges it unless
+// h failed with an error which is not permanent.
+func (m *MQTTBroker) messageHandler(h broker.Handler) mqtt.MessageHandler {
+	return func(client mqtt.Client, msg mqtt.Message) {
+		err := h(broker.Event{
 			Topic:     msg.Topic(),
 			Payload:   msg.Payload(),
 			Duplicate: msg.Duplicate(),
 			Qos:       msg.Qos(),
 			Retained:  msg.Retained(),
 			Ack:       msg.Ack,
-		}); err != nil {
+		})
+		if err != nil && !broker.IsPermanent(err) {
+			m.logger.Error("Message left unacknowledged to be delivered again", zap.Error(err), zap.String("topic", msg.Topic()))
+			return
+		}
+		if err != nil {
 			m.logger.Error(err.Error())
 		}
-	})
-	for !token.WaitTimeout(tokenWaitTimeout) {
+		msg.Ack()
 	}
-
-	return token.Error()
 }
 
 func (m *MQTTBroker) String() string {
@@ -1,9 +1,20 @@
 package mqtt
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
+	"math/big"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/ory/dockertest/v3"
@@ -140,3 +151,115 @@ func Test_mqttBroker_opts(t *testing.T) {
 		})
 	}
 }
+
+// writeCert writes a self-signed certificate and its key as PEM files in dir.
+func writeCert(t *testing.T, dir string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "agent"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
+
+func Test_mqttBroker_optsTLS(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeCert(t, dir)
+
+	plain, err := NewBroker(WithURL("mqtt://localhost:1883"))
+	require.NoError(t, err)
+	opts := plain.opts()
+	assert.Equal(t, "tcp", opts.Servers[0].Scheme)
+
+	// mqtts urls connect over TLS, on the default port when none is given.
+	secure, err := NewBroker(WithURL("mqtts://localhost"))
+	require.NoError(t, err)
+	opts = secure.opts()
+	assert.Equal(t, "ssl://localhost:8883", opts.Servers[0].String())
+	require.NotNil(t, opts.TLSConfig)
+
+	// Certificates connect over TLS whatever the url.
+	mutual, err := NewBroker(WithURL("mqtt://localhost:1883"), WithCACert(certFile), WithClientCert(certFile, keyFile))
+	require.NoError(t, err)
+	opts = mutual.opts()
+	assert.Equal(t, "ssl://localhost:1883", opts.Servers[0].String())
+	require.NotNil(t, opts.TLSConfig.RootCAs)
+	assert.Len(t, opts.TLSConfig.Certificates, 1)
+
+	custom, err := NewBroker(WithURL("mqtt://localhost:1883"), WithTLSConfig(&tls.Config{ServerName: "broker"}), WithCACert(certFile))
+	require.NoError(t, err)
+	opts = custom.opts()
+	assert.Equal(t, "broker", opts.TLSConfig.ServerName)
+	assert.NotNil(t, opts.TLSConfig.RootCAs)
+
+	// Empty paths leave the connection as it is.
+	unset, err := NewBroker(WithURL("mqtt://localhost:1883"), WithCACert(""), WithClientCert("", ""))
+	require.NoError(t, err)
+	assert.Equal(t, "tcp", unset.opts().Servers[0].Scheme)
+
+	// Certificates which can not be loaded are refused rather than ignored.
+	notPEM := filepath.Join(dir, "not.pem")
+	require.NoError(t, os.WriteFile(notPEM, []byte("garbage"), 0600))
+	for name, opt := range map[string]Option{
+		"missing CA":     WithCACert(filepath.Join(dir, "missing.pem")),
+		"invalid CA":     WithCACert(notPEM),
+		"missing key":    WithClientCert(certFile, ""),
+		"mismatched key": WithClientCert(certFile, notPEM),
+		"missing cert":   WithClientCert(filepath.Join(dir, "missing.pem"), keyFile),
+	} {
+		_, err := NewBroker(WithURL("mqtt://localhost:1883"), opt)
+		assert.ErrorIs(t, err, ErrCertificate, name)
+	}
+}
+
+type fakeMessage struct {
+	mqtt.Message
+	acks int
+}
+
+func (m *fakeMessage) Duplicate() bool   { return false }
+func (m *fakeMessage) Qos() byte         { return 1 }
+func (m *fakeMessage) Retained() bool    { return false }
+func (m *fakeMessage) Topic() string     { return "topic" }
+func (m *fakeMessage) MessageID() uint16 { return 1 }
+func (m *fakeMessage) Payload() []byte   { return nil }
+func (m *fakeMessage) Ack()              { m.acks++ }
+
+func Test_mqttBroker_messageHandler(t *testing.T) {
+	m, err := NewBroker(WithURL("mqtt://localhost:1883"))
+	require.NoError(t, err)
+	opts := m.opts()
+	assert.True(t, opts.AutoAckDisabled)
+	assert.False(t, opts.Order)
+
+	tests := []struct {
+		name    string
+		err     error
+		wantAck bool
+	}{
+		{"handled", nil, true},
+		{"permanent failure", broker.Permanent(errors.New("bad payload")), true},
+		{"unknown event type", fmt.Errorf("%w: unknown", broker.ErrUnknownEventType), true},
+		{"transient failure", errors.New("server unavailable"), false},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			msg := &fakeMessage{}
+			m.messageHandler(func(broker.Event) error { return tc.err })(nil, msg)
+			assert.Equal(t, tc.wantAck, msg.acks == 1)
+		})
+	}
+}
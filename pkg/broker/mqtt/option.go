@@ -1,8 +1,12 @@
 package mqtt
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"net/url"
+	"os"
 
 	"go.uber.org/zap"
 )
@@ -55,3 +59,56 @@ func WithLogger(logger *zap.Logger) Option {
 		return nil
 	}
 }
+
+// WithTLSConfig returns an Option which connects to the broker over TLS with
+// config. WithCACert and WithClientCert add to it.
+func WithTLSConfig(config *tls.Config) Option {
+	return func(m *MQTTBroker) error {
+		if config == nil {
+			return errors.New("empty tls config")
+		}
+		m.tlsConfig = config.Clone()
+		return nil
+	}
+}
+
+// WithCACert returns an Option which connects to the broker over TLS, trusting
+// the certificates of the PEM file path in place of the system roots. An empty
+// path leaves the options as they are.
+func WithCACert(path string) Option {
+	return func(m *MQTTBroker) error {
+		if path == "" {
+			return nil
+		}
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("%w: CA %s: %v", ErrCertificate, path, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("%w: CA %s: no PEM certificate found", ErrCertificate, path)
+		}
+		m.tlsConf().RootCAs = pool
+		return nil
+	}
+}
+
+// WithClientCert returns an Option which connects to the broker over TLS,
+// authenticated by the certificate and private key of the PEM files certFile
+// and keyFile. Both empty leave the options as they are.
+func WithClientCert(certFile, keyFile string) Option {
+	return func(m *MQTTBroker) error {
+		if certFile == "" && keyFile == "" {
+			return nil
+		}
+		if certFile == "" || keyFile == "" {
+			return fmt.Errorf("%w: client certificate and key go together", ErrCertificate)
+		}
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("%w: client %s: %v", ErrCertificate, certFile, err)
+		}
+		m.tlsConf().Certificates = []tls.Certificate{cert}
+		return nil
+	}
+}
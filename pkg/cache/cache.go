@@ -29,6 +29,7 @@ type Type int
 const (
 	INDEX = iota
 	CHUNK
+	INDEX_DELTA
 )
 
 func (t Type) String() string {
@@ -37,6 +38,8 @@ func (t Type) String() string {
 		return "index.json"
 	case CHUNK:
 		return "chunk.json"
+	case INDEX_DELTA:
+		return "index_delta.json"
 	}
 
 	return fmt.Sprintf("unknown type %d", t)
@@ -91,31 +94,21 @@ func (r *Repository) filename(t Type) string {
 }
 
 func (r *Repository) SaveIndex(index *Index) error {
-	buf, err := json.Marshal(index)
-	if err != nil {
-		return err
-	}
-	f, err := r.tempFile()
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-	_, err = f.Write(buf)
-	if err != nil {
-		return err
-	}
-	if err := f.Close(); err != nil {
-		return err
-	}
-	err = r.renameFile(f, INDEX)
-	if err != nil {
-		return err
-	}
-	return nil
+	return r.save(index, INDEX)
+}
+
+// SaveIndexDelta stores the delta index of the recovery point next to its full
+// index, so that the depth of the chain is known to the next backup.
+func (r *Repository) SaveIndexDelta(delta *IndexDelta) error {
+	return r.save(delta, INDEX_DELTA)
 }
 
 func (r *Repository) SaveChunk(chunk *Chunk) error {
-	buf, err := json.Marshal(chunk)
+	return r.save(chunk, CHUNK)
+}
+
+func (r *Repository) save(v interface{}, t Type) error {
+	buf, err := json.Marshal(v)
 	if err != nil {
 		return err
 	}
@@ -128,14 +121,15 @@ func (r *Repository) SaveChunk(chunk *Chunk) error {
 	if err != nil {
 		return err
 	}
-	if err := f.Close(); err != nil {
+	// The file is only renamed in place once its content is on disk, so that a
+	// crash never leaves a partial index behind.
+	if err := f.Sync(); err != nil {
 		return err
 	}
-	err = r.renameFile(f, CHUNK)
-	if err != nil {
+	if err := f.Close(); err != nil {
 		return err
 	}
-	return nil
+	return r.renameFile(f, t)
 }
 
 // listCacheDirs returns the list of cache directories.
@@ -1,9 +1,18 @@
 package cache
 
+import "fmt"
+
 type Chunk struct {
 	BackupDirectoryID string              `json:"backup_directory_id"`
 	RecoveryPointID   string              `json:"recovery_point_id"`
 	Chunks            map[string][]string `json:"chunks"`
+	// Classes is the storage class claimed for the chunks referenced by the
+	// backup, see storage_class_rules.
+	Classes map[string]string `json:"classes,omitempty"`
+	// Uploaded is the storage class the chunks were uploaded with by the
+	// backup, before the class of a chunk shared with a hotter file is
+	// raised. It is not saved.
+	Uploaded map[string]string `json:"-"`
 }
 
 func NewChunk(bdID string, rpID string) *Chunk {
@@ -11,5 +20,25 @@ func NewChunk(bdID string, rpID string) *Chunk {
 		BackupDirectoryID: bdID,
 		RecoveryPointID:   rpID,
 		Chunks:            make(map[string][]string),
+		Classes:           make(map[string]string),
+		Uploaded:          make(map[string]string),
+	}
+}
+
+// RebuildChunk derives the chunk list of index from the content of its items,
+// listing every chunk as "<references>-<length>" like a backup does.
+func RebuildChunk(index *Index) *Chunk {
+	chunks := NewChunk(index.BackupDirectoryID, index.RecoveryPointID)
+	counts := make(map[string]int)
+	lengths := make(map[string]uint)
+	for _, node := range index.Items {
+		for _, chunk := range node.Content {
+			counts[chunk.Etag]++
+			lengths[chunk.Etag] = chunk.Length
+		}
+	}
+	for key, count := range counts {
+		chunks.Chunks[key] = []string{fmt.Sprintf("%d-%d", count, lengths[key])}
 	}
+	return chunks
 }
@@ -0,0 +1,21 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRebuildChunk(t *testing.T) {
+	index := NewIndex("bd", "rp1")
+	index.Items["/a"] = &Node{AbsolutePath: "/a", Type: "file", Content: []*ChunkInfo{{Length: 10, Etag: "e1"}, {Start: 10, Length: 5, Etag: "e2"}}}
+	index.Items["/b"] = &Node{AbsolutePath: "/b", Type: "file", Content: []*ChunkInfo{{Length: 10, Etag: "e1"}}}
+	index.Items["/dir"] = &Node{AbsolutePath: "/dir", Type: "dir"}
+
+	chunks := RebuildChunk(index)
+	assert.Equal(t, "bd", chunks.BackupDirectoryID)
+	assert.Equal(t, "rp1", chunks.RecoveryPointID)
+	assert.Equal(t, map[string][]string{"e1": {"2-10"}, "e2": {"1-5"}}, chunks.Chunks)
+	require.NoError(t, ValidateChunks(index, chunks))
+}
@@ -0,0 +1,149 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// MaxIndexChain bounds the number of deltas folded by ResolveIndex, so that a
+// cycle in the parent links can not loop forever.
+const MaxIndexChain = 1000
+
+var ErrBrokenIndexChain = errors.New("broken index chain")
+
+// IndexDelta is the index of a recovery point stored as the changes against
+// the index of its parent recovery point.
+type IndexDelta struct {
+	Version               int              `json:"version,omitempty"`
+	BackupDirectoryID     string           `json:"backup_directory_id"`
+	RecoveryPointID       string           `json:"recovery_point_id"`
+	ParentRecoveryPointID string           `json:"parent_recovery_point_id"`
+	Depth                 int              `json:"depth"`
+	Upserted              map[string]*Node `json:"upserted"`
+	Deleted               []string         `json:"deleted"`
+	TotalFiles            int64            `json:"total_files"`
+	Path                  string           `json:"path,omitempty"`
+	ResolvedPath          string           `json:"resolved_path,omitempty"`
+	SkippedMounts         []string         `json:"skipped_mounts,omitempty"`
+	PermissionDenied      []string         `json:"permission_denied,omitempty"`
+	AgeSkipped            int64            `json:"age_skipped,omitempty"`
+	Excluded              int64            `json:"excluded,omitempty"`
+	Chunking              *Chunking        `json:"chunking,omitempty"`
+}
+
+// NewIndexDelta returns the nodes of index added or modified since parent and
+// the paths deleted since parent. depth is the number of deltas between index
+// and the closest full index, including this one.
+func NewIndexDelta(parentID string, depth int, parent *Index, index *Index) (*IndexDelta, error) {
+	d := &IndexDelta{
+		Version:               IndexVersion,
+		BackupDirectoryID:     index.BackupDirectoryID,
+		RecoveryPointID:       index.RecoveryPointID,
+		ParentRecoveryPointID: parentID,
+		Depth:                 depth,
+		Upserted:              make(map[string]*Node),
+		Deleted:               []string{},
+		TotalFiles:            index.TotalFiles,
+		Path:                  index.Path,
+		ResolvedPath:          index.ResolvedPath,
+		SkippedMounts:         index.SkippedMounts,
+		PermissionDenied:      index.PermissionDenied,
+		AgeSkipped:            index.AgeSkipped,
+		Excluded:              index.Excluded,
+		Chunking:              index.Chunking,
+	}
+	for path, node := range index.Items {
+		equal, err := nodeEqual(parent.Items[path], node)
+		if err != nil {
+			return nil, err
+		}
+		if !equal {
+			d.Upserted[path] = node
+		}
+	}
+	for path := range parent.Items {
+		if _, ok := index.Items[path]; !ok {
+			d.Deleted = append(d.Deleted, path)
+		}
+	}
+	sort.Strings(d.Deleted)
+	return d, nil
+}
+
+// nodeEqual compares nodes by their stored form, times read back from an
+// index differ from the ones of a walk only by their location.
+func nodeEqual(a *Node, b *Node) (bool, error) {
+	if a == nil || b == nil {
+		return a == b, nil
+	}
+	bufA, err := json.Marshal(a)
+	if err != nil {
+		return false, err
+	}
+	bufB, err := json.Marshal(b)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(bufA, bufB), nil
+}
+
+// Apply returns the full index obtained by applying d to the index of its
+// parent. parent is not modified.
+func (d *IndexDelta) Apply(parent *Index) *Index {
+	index := NewIndex(d.BackupDirectoryID, d.RecoveryPointID)
+	index.TotalFiles = d.TotalFiles
+	index.Path, index.ResolvedPath = d.Path, d.ResolvedPath
+	index.SkippedMounts, index.PermissionDenied = d.SkippedMounts, d.PermissionDenied
+	index.AgeSkipped, index.Excluded = d.AgeSkipped, d.Excluded
+	index.Chunking = d.Chunking
+	for path, node := range parent.Items {
+		index.Items[path] = node
+	}
+	for _, path := range d.Deleted {
+		delete(index.Items, path)
+	}
+	for path, node := range d.Upserted {
+		index.Items[path] = node
+	}
+	return index
+}
+
+// IndexLoader returns the stored index of rpID, either full or as a delta.
+type IndexLoader func(rpID string) (*Index, *IndexDelta, error)
+
+// ResolveIndex returns the full index of rpID, following the parents of delta
+// indexes until a full index and folding the chain back, and the depth stored
+// with the delta index of rpID, 0 when its index is a full one. It fails with
+// ErrBrokenIndexChain if an ancestor can not be loaded.
+func ResolveIndex(rpID string, load IndexLoader) (*Index, int, error) {
+	var chain []*IndexDelta
+	id := rpID
+	for {
+		if len(chain) > MaxIndexChain {
+			return nil, 0, fmt.Errorf("%w: more than %d deltas from %s", ErrBrokenIndexChain, MaxIndexChain, rpID)
+		}
+		index, delta, err := load(id)
+		if err != nil {
+			if id == rpID {
+				return nil, 0, err
+			}
+			return nil, 0, fmt.Errorf("%w: ancestor %s of %s: %v", ErrBrokenIndexChain, id, rpID, err)
+		}
+		if index != nil {
+			depth := 0
+			for i := len(chain) - 1; i >= 0; i-- {
+				index = chain[i].Apply(index)
+				depth = chain[i].Depth
+			}
+			return index, depth, nil
+		}
+		if delta == nil || delta.ParentRecoveryPointID == "" {
+			return nil, 0, fmt.Errorf("%w: delta %s has no parent", ErrBrokenIndexChain, id)
+		}
+		chain = append(chain, delta)
+		id = delta.ParentRecoveryPointID
+	}
+}
@@ -0,0 +1,106 @@
+package cache
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testIndex(rpID string, nodes ...*Node) *Index {
+	index := NewIndex("bd", rpID)
+	for _, node := range nodes {
+		index.Items[node.AbsolutePath] = node
+		index.TotalFiles++
+	}
+	return index
+}
+
+func TestIndexDelta(t *testing.T) {
+	mtime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local)
+	parent := testIndex("rp1",
+		&Node{AbsolutePath: "/a", Type: "file", Size: 1, ModTime: mtime},
+		&Node{AbsolutePath: "/b", Type: "file", Size: 2, ModTime: mtime},
+		&Node{AbsolutePath: "/c", Type: "file", Size: 3, ModTime: mtime},
+	)
+	// The parent is read back from its stored form, its times lose their location.
+	buf, err := json.Marshal(parent)
+	require.NoError(t, err)
+	var stored Index
+	require.NoError(t, json.Unmarshal(buf, &stored))
+
+	index := testIndex("rp2",
+		&Node{AbsolutePath: "/a", Type: "file", Size: 1, ModTime: mtime},
+		&Node{AbsolutePath: "/b", Type: "file", Size: 20, ModTime: mtime},
+		&Node{AbsolutePath: "/d", Type: "file", Size: 4, ModTime: mtime},
+	)
+	index.Chunking = &Chunking{Polynomial: 0x3dea92648f6e83, MinSize: 1 << 19, AvgSize: 1 << 20, MaxSize: 1 << 23}
+
+	delta, err := NewIndexDelta("rp1", 1, &stored, index)
+	require.NoError(t, err)
+	assert.Equal(t, "rp1", delta.ParentRecoveryPointID)
+	assert.Equal(t, "rp2", delta.RecoveryPointID)
+	assert.Len(t, delta.Upserted, 2)
+	assert.Contains(t, delta.Upserted, "/b")
+	assert.Contains(t, delta.Upserted, "/d")
+	assert.Equal(t, []string{"/c"}, delta.Deleted)
+
+	full := delta.Apply(&stored)
+	assert.Equal(t, "rp2", full.RecoveryPointID)
+	assert.Equal(t, int64(3), full.TotalFiles)
+	assert.Len(t, full.Items, 3)
+	assert.Equal(t, uint64(1), full.Items["/a"].Size)
+	assert.Equal(t, uint64(20), full.Items["/b"].Size)
+	assert.Equal(t, uint64(4), full.Items["/d"].Size)
+	assert.Equal(t, index.Chunking, full.Chunking)
+	assert.Len(t, stored.Items, 3, "parent must not be modified")
+}
+
+func TestResolveIndex(t *testing.T) {
+	rp1 := testIndex("rp1", &Node{AbsolutePath: "/a", Size: 1}, &Node{AbsolutePath: "/b", Size: 2})
+	rp2 := testIndex("rp2", &Node{AbsolutePath: "/a", Size: 10}, &Node{AbsolutePath: "/b", Size: 2})
+	rp3 := testIndex("rp3", &Node{AbsolutePath: "/a", Size: 10}, &Node{AbsolutePath: "/c", Size: 3})
+	d2, err := NewIndexDelta("rp1", 1, rp1, rp2)
+	require.NoError(t, err)
+	d3, err := NewIndexDelta("rp2", 2, rp2, rp3)
+	require.NoError(t, err)
+
+	stored := map[string]interface{}{"rp1": rp1, "rp2": d2, "rp3": d3}
+	load := func(rpID string) (*Index, *IndexDelta, error) {
+		switch v := stored[rpID].(type) {
+		case *Index:
+			return v, nil, nil
+		case *IndexDelta:
+			return nil, v, nil
+		}
+		return nil, nil, errors.New("not found")
+	}
+
+	got, depth, err := ResolveIndex("rp3", load)
+	require.NoError(t, err)
+	assert.Equal(t, 2, depth)
+	assert.Equal(t, "rp3", got.RecoveryPointID)
+	assert.Len(t, got.Items, 2)
+	assert.Equal(t, uint64(10), got.Items["/a"].Size)
+	assert.Equal(t, uint64(3), got.Items["/c"].Size)
+
+	got, depth, err = ResolveIndex("rp1", load)
+	require.NoError(t, err)
+	assert.Equal(t, 0, depth)
+	assert.Equal(t, rp1, got)
+
+	_, _, err = ResolveIndex("missing", load)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrBrokenIndexChain))
+
+	delete(stored, "rp1")
+	_, _, err = ResolveIndex("rp3", load)
+	assert.ErrorIs(t, err, ErrBrokenIndexChain)
+
+	stored["rp1"] = &IndexDelta{RecoveryPointID: "rp1", ParentRecoveryPointID: "rp3"}
+	_, _, err = ResolveIndex("rp3", load)
+	assert.ErrorIs(t, err, ErrBrokenIndexChain)
+}
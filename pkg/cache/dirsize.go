@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// AggregateDirSizes sets the logical size and the number of files below each
+// directory of index. Items are summed into their parent deepest first, so a
+// directory is complete before it is added to its own parent.
+func (index *Index) AggregateDirSizes() {
+	paths := make([]string, 0, len(index.Items))
+	for path, node := range index.Items {
+		if node.Type == "dir" {
+			node.DirSize, node.DirFiles = 0, 0
+		}
+		paths = append(paths, path)
+	}
+	sep := string(filepath.Separator)
+	sort.Slice(paths, func(i, j int) bool {
+		return strings.Count(paths[i], sep) > strings.Count(paths[j], sep)
+	})
+	for _, path := range paths {
+		parentPath := filepath.Dir(path)
+		if parentPath == path {
+			continue
+		}
+		parent, ok := index.Items[parentPath]
+		if !ok || parent.Type != "dir" {
+			continue
+		}
+		node := index.Items[path]
+		if node.Type == "dir" {
+			parent.DirSize += node.DirSize
+			parent.DirFiles += node.DirFiles
+		} else {
+			parent.DirSize += node.Size
+			parent.DirFiles++
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexAggregateDirSizes(t *testing.T) {
+	dir := func(path string) *Node { return &Node{AbsolutePath: path, Type: "dir", DirSize: 99, DirFiles: 99} }
+	file := func(path string, size uint64) *Node { return &Node{AbsolutePath: path, Type: "file", Size: size} }
+	index := testIndex("rp1",
+		dir("/data"),
+		dir("/data/a"),
+		dir("/data/a/b"),
+		dir("/data/empty"),
+		file("/data/f", 1),
+		file("/data/a/f", 10),
+		file("/data/a/b/f1", 100),
+		file("/data/a/b/f2", 1000),
+		&Node{AbsolutePath: "/data/a/link", Type: "symlink", LinkTarget: "f"},
+	)
+	index.AggregateDirSizes()
+
+	assert.Equal(t, uint64(1111), index.Items["/data"].DirSize)
+	assert.Equal(t, int64(5), index.Items["/data"].DirFiles)
+	assert.Equal(t, uint64(1110), index.Items["/data/a"].DirSize)
+	assert.Equal(t, int64(4), index.Items["/data/a"].DirFiles)
+	assert.Equal(t, uint64(1100), index.Items["/data/a/b"].DirSize)
+	assert.Equal(t, int64(2), index.Items["/data/a/b"].DirFiles)
+	assert.Zero(t, index.Items["/data/empty"].DirSize)
+	assert.Zero(t, index.Items["/data/empty"].DirFiles)
+	assert.Zero(t, index.Items["/data/f"].DirSize)
+
+	// Aggregating again gives the same sizes, not twice them.
+	index.AggregateDirSizes()
+	assert.Equal(t, uint64(1111), index.Items["/data"].DirSize)
+	assert.Equal(t, int64(5), index.Items["/data"].DirFiles)
+}
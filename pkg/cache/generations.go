@@ -0,0 +1,121 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Generation is the cache directory of a recovery point.
+type Generation struct {
+	RecoveryPointID   string    `json:"recovery_point_id"`
+	BackupDirectoryID string    `json:"backup_directory_id"`
+	ModTime           time.Time `json:"mod_time"`
+	Size              int64     `json:"size"`
+}
+
+// Generations returns the cache directories of the recovery points of mcID
+// under cachePath which hold an index, newest first. Directories of backups
+// which did not get as far as saving their index are left out.
+func Generations(cachePath, mcID string) ([]Generation, error) {
+	entries, err := os.ReadDir(filepath.Join(cachePath, mcID))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var generations []Generation
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := filepath.Join(cachePath, mcID, entry.Name())
+		f, err := os.Open(filepath.Join(dir, Type(INDEX).String()))
+		if err != nil {
+			continue
+		}
+		fi, err := f.Stat()
+		var header struct {
+			BackupDirectoryID string `json:"backup_directory_id"`
+		}
+		if err == nil {
+			err = json.NewDecoder(f).Decode(&header)
+		}
+		_ = f.Close()
+		if err != nil {
+			continue
+		}
+		size, err := Size(dir)
+		if err != nil {
+			return nil, err
+		}
+		generations = append(generations, Generation{
+			RecoveryPointID:   entry.Name(),
+			BackupDirectoryID: header.BackupDirectoryID,
+			ModTime:           fi.ModTime(),
+			Size:              size,
+		})
+	}
+	sort.SliceStable(generations, func(i, j int) bool {
+		return generations[i].ModTime.After(generations[j].ModTime)
+	})
+	return generations, nil
+}
+
+// PruneGenerations removes the cache directories of the recovery points of
+// backup directory bdID of mcID, but for the keep newest ones. current, the
+// recovery point the next incremental backup compares to, is always kept. It
+// returns the recovery points removed.
+func PruneGenerations(cachePath, mcID, bdID, current string, keep int) ([]string, error) {
+	generations, err := Generations(cachePath, mcID)
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	kept := 0
+	for _, g := range generations {
+		if g.BackupDirectoryID != bdID {
+			continue
+		}
+		if g.RecoveryPointID == current {
+			continue
+		}
+		// The current generation takes one of the places to keep.
+		if kept < keep-1 {
+			kept++
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(cachePath, mcID, g.RecoveryPointID)); err != nil {
+			return removed, err
+		}
+		removed = append(removed, g.RecoveryPointID)
+	}
+	return removed, nil
+}
+
+// Size returns the size of the files under dir.
+func Size(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPruneGenerations(t *testing.T) {
+	cachePath := t.TempDir()
+	save := func(bdID, rpID string, age time.Duration) {
+		repo, err := NewRepository(cachePath, "mc", rpID)
+		require.NoError(t, err)
+		require.NoError(t, repo.SaveIndex(NewIndex(bdID, rpID)))
+		mtime := time.Now().Add(-age)
+		require.NoError(t, os.Chtimes(repo.filename(INDEX), mtime, mtime))
+	}
+	save("bd1", "rp1", 4*time.Hour)
+	save("bd1", "rp2", 3*time.Hour)
+	save("bd2", "rp3", 2*time.Hour)
+	save("bd1", "rp4", time.Hour)
+	// An interrupted backup never saved its index.
+	_, err := NewRepository(cachePath, "mc", "rp5")
+	require.NoError(t, err)
+
+	generations, err := Generations(cachePath, "mc")
+	require.NoError(t, err)
+	var ids []string
+	for _, g := range generations {
+		ids = append(ids, g.RecoveryPointID)
+		assert.Positive(t, g.Size)
+	}
+	assert.Equal(t, []string{"rp4", "rp3", "rp2", "rp1"}, ids)
+
+	size, err := Size(cachePath)
+	require.NoError(t, err)
+	assert.Positive(t, size)
+
+	// The current recovery point is kept even when it is not the newest.
+	removed, err := PruneGenerations(cachePath, "mc", "bd1", "rp2", 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rp1"}, removed)
+
+	removed, err = PruneGenerations(cachePath, "mc", "bd1", "rp4", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"rp2"}, removed)
+	for _, rpID := range []string{"rp3", "rp4", "rp5"} {
+		assert.DirExists(t, filepath.Join(cachePath, "mc", rpID))
+	}
+
+	generations, err = Generations(filepath.Join(cachePath, "missing"), "mc")
+	require.NoError(t, err)
+	assert.Empty(t, generations)
+}
@@ -0,0 +1,117 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const hostIndexFile = "host_index.json"
+
+// HostEntry holds the chunks of a file as it was last uploaded.
+type HostEntry struct {
+	Content    []*ChunkInfo `json:"content"`
+	Sha256Hash Sha256Hash   `json:"sha256_hash"`
+	HashAlgo   string       `json:"hash_algo,omitempty"`
+}
+
+// HostIndex maps (storage vault, path, mtime, size) to the chunks of a file.
+// It is shared by the backups of all directories on the agent, so a file that
+// was already uploaded by any of them is not read again.
+type HostIndex struct {
+	mu      sync.Mutex
+	path    string
+	dirty   bool
+	Entries map[string]*HostEntry `json:"entries"`
+}
+
+// LoadHostIndex reads the host index stored in cacheDir, or returns an empty
+// one if there is none yet.
+func LoadHostIndex(cacheDir string) (*HostIndex, error) {
+	h := &HostIndex{
+		path:    filepath.Join(cacheDir, hostIndexFile),
+		Entries: make(map[string]*HostEntry),
+	}
+	buf, err := ioutil.ReadFile(h.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, h); err != nil {
+		return nil, err
+	}
+	if h.Entries == nil {
+		h.Entries = make(map[string]*HostEntry)
+	}
+	return h, nil
+}
+
+func hostKey(vaultID string, path string, mtime time.Time, size uint64) string {
+	return strings.Join([]string{vaultID, path, strconv.FormatInt(mtime.UnixNano(), 10), strconv.FormatUint(size, 10)}, "|")
+}
+
+// Lookup returns the entry of a file uploaded to vaultID with the same path,
+// mtime and size.
+func (h *HostIndex) Lookup(vaultID string, path string, mtime time.Time, size uint64) (*HostEntry, bool) {
+	if h == nil {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.Entries[hostKey(vaultID, path, mtime, size)]
+	return entry, ok
+}
+
+// Store records the chunks of a file uploaded to vaultID.
+func (h *HostIndex) Store(vaultID string, path string, mtime time.Time, size uint64, entry *HostEntry) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.Entries[hostKey(vaultID, path, mtime, size)] = entry
+	h.dirty = true
+}
+
+// Save writes the host index to disk if it changed since the last save.
+func (h *HostIndex) Save() error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return nil
+	}
+	buf, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), dirMode); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(h.path), hostIndexFile+"-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), h.path); err != nil {
+		return err
+	}
+	h.dirty = false
+	return nil
+}
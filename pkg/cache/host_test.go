@@ -0,0 +1,40 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostIndex(t *testing.T) {
+	dir := t.TempDir()
+	mtime := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	entry := &HostEntry{Content: []*ChunkInfo{{Start: 0, Length: 4, Etag: "etag"}}, Sha256Hash: []byte{1, 2}}
+
+	h, err := LoadHostIndex(dir)
+	require.NoError(t, err)
+	h.Store("vault", "/data/file", mtime, 4, entry)
+	require.NoError(t, h.Save())
+
+	loaded, err := LoadHostIndex(dir)
+	require.NoError(t, err)
+	got, ok := loaded.Lookup("vault", "/data/file", mtime, 4)
+	require.True(t, ok)
+	assert.Equal(t, entry.Content, got.Content)
+	assert.Equal(t, entry.Sha256Hash, got.Sha256Hash)
+
+	_, ok = loaded.Lookup("other-vault", "/data/file", mtime, 4)
+	assert.False(t, ok)
+	_, ok = loaded.Lookup("vault", "/data/file", mtime.Add(time.Second), 4)
+	assert.False(t, ok)
+	_, ok = loaded.Lookup("vault", "/data/file", mtime, 5)
+	assert.False(t, ok)
+
+	var disabled *HostIndex
+	disabled.Store("vault", "/data/file", mtime, 4, entry)
+	_, ok = disabled.Lookup("vault", "/data/file", mtime, 4)
+	assert.False(t, ok)
+	assert.NoError(t, disabled.Save())
+}
@@ -10,18 +10,52 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/restic/chunker"
+
 	"github.com/bizflycloud/bizfly-backup/pkg/support"
 )
 
 type Index struct {
+	Version           int              `json:"version,omitempty"`
 	BackupDirectoryID string           `json:"backup_directory_id"`
 	RecoveryPointID   string           `json:"recovery_point_id"`
 	Items             map[string]*Node `json:"items"`
 	TotalFiles        int64            `json:"total_files"`
+
+	// Path is the root of the backup as configured, ResolvedPath the target
+	// walked in its place when Path is a symlink.
+	Path         string `json:"path,omitempty"`
+	ResolvedPath string `json:"resolved_path,omitempty"`
+	// SkippedMounts are the mount points left out with one_file_system.
+	SkippedMounts []string `json:"skipped_mounts,omitempty"`
+	// PermissionDenied are the items left out with permission_errors: skip.
+	PermissionDenied []string `json:"permission_denied,omitempty"`
+	// AgeSkipped is the number of files left out by max_age and min_age.
+	AgeSkipped int64 `json:"age_skipped,omitempty"`
+	// Excluded is the number of items left out by exclude and include
+	// patterns, an excluded directory counting once for its whole subtree.
+	Excluded int64 `json:"excluded,omitempty"`
+	// Shards are the objects holding the items of a sharded index, whose
+	// Items are then empty.
+	Shards []IndexShard `json:"shards,omitempty"`
+	// Chunking is the chunking of the files changed by the backup, unset for
+	// recovery points older than it.
+	Chunking *Chunking `json:"chunking,omitempty"`
+}
+
+// Chunking are the parameters files are cut into chunks with.
+type Chunking struct {
+	// Mode is empty for content defined chunks, fixed for blocks of MaxSize.
+	Mode       string      `json:"mode,omitempty"`
+	Polynomial chunker.Pol `json:"polynomial"`
+	MinSize    uint        `json:"min_size"`
+	AvgSize    uint        `json:"avg_size"`
+	MaxSize    uint        `json:"max_size"`
 }
 
 func NewIndex(bdID string, rpID string) *Index {
 	return &Index{
+		Version:           IndexVersion,
 		BackupDirectoryID: bdID,
 		RecoveryPointID:   rpID,
 		Items:             make(map[string]*Node),
@@ -32,12 +66,16 @@ type ChunkInfo struct {
 	Start  uint   `json:"start"`
 	Length uint   `json:"length"`
 	Etag   string `json:"etag"`
+	// Codec is the compression of the chunk stored, empty when it is not.
+	Codec string `json:"codec,omitempty"`
 }
 
 type Node struct {
-	Name         string       `json:"name"`
-	Type         string       `json:"type"`
-	Sha256Hash   Sha256Hash   `json:"sha256_hash,omitempty"`
+	Name       string     `json:"name"`
+	Type       string     `json:"type"`
+	Sha256Hash Sha256Hash `json:"sha256_hash,omitempty"`
+	// HashAlgo is the algorithm of Sha256Hash, empty for sha256.
+	HashAlgo     string       `json:"hash_algo,omitempty"`
 	Mode         os.FileMode  `json:"mode,omitempty"`
 	ModTime      time.Time    `json:"mtime,omitempty"`
 	AccessTime   time.Time    `json:"atime,omitempty"`
@@ -52,6 +90,15 @@ type Node struct {
 	AbsolutePath string       `json:"path"`
 	BasePath     string       `json:"base_path"`
 	RelativePath string       `json:"relative_path"`
+
+	// SecurityDescriptor is the Windows owner, group and ACLs in SDDL form,
+	// recorded when preserve_acls is enabled.
+	SecurityDescriptor string `json:"security_descriptor,omitempty"`
+
+	// DirSize and DirFiles are the logical size and number of files below a
+	// directory, recorded when index_dir_sizes is enabled.
+	DirSize  uint64 `json:"dir_size,omitempty"`
+	DirFiles int64  `json:"dir_files,omitempty"`
 }
 
 type Sha256Hash []byte
@@ -97,6 +144,8 @@ func (node *Node) fill_extra(path string, fi os.FileInfo) (err error) {
 		// nothing to do
 	case "symlink":
 		node.LinkTarget, err = os.Readlink(path)
+	case "blockdev":
+		node.Size, err = support.DeviceSize(path, false)
 	default:
 		fmt.Printf(" %s invalid node type %q", path, node.Type)
 	}
@@ -130,6 +179,12 @@ func NodeFromFileInfo(rootPath string, pathName string, fi os.FileInfo) (*Node,
 		node.Type = "dir"
 	case os.ModeSymlink:
 		node.Type = "symlink"
+	case os.ModeDevice:
+		// Only a device given as the backup root is read as an image, devices
+		// inside a directory tree are not followed.
+		if pathName == rootPath {
+			node.Type = "blockdev"
+		}
 	}
 
 	err = node.fill_extra(pathName, fi)
@@ -0,0 +1,154 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// ShardedIndexVersion is the version of a sharded index, whose items are
+// stored in shards listed by the index itself. Agents reading up to
+// IndexVersion only refuse it.
+const ShardedIndexVersion = 2
+
+const shardPrefix = "index_shard_"
+
+// IndexShard is an object holding the items of a sharded index whose cleaned
+// relative paths sort from First to Last.
+type IndexShard struct {
+	Name  string `json:"name"`
+	Hash  string `json:"hash"`
+	Items int    `json:"items"`
+	First string `json:"first"`
+	Last  string `json:"last"`
+}
+
+// ShardName returns the name of shard n of an index.
+func ShardName(n int) string {
+	return fmt.Sprintf("%s%d.json", shardPrefix, n)
+}
+
+// IsIndexShard reports whether name is the name of an index shard.
+func IsIndexShard(name string) bool {
+	return strings.HasPrefix(name, shardPrefix) && strings.HasSuffix(name, ".json")
+}
+
+func hashShard(buf []byte) string {
+	hash := sha256.Sum256(buf)
+	return hex.EncodeToString(hash[:])
+}
+
+// Sharded reports whether index only lists the shards holding its items.
+func (index *Index) Sharded() bool {
+	return len(index.Shards) > 0
+}
+
+// ShardIndex splits the items of index, sorted by relative path, into shards
+// of at most perShard items. It returns the index listing the shards and the
+// encoded shards in the same order.
+func ShardIndex(index *Index, perShard int) (*Index, [][]byte, error) {
+	if perShard <= 0 {
+		return nil, nil, fmt.Errorf("invalid shard size %d", perShard)
+	}
+	keys := make([]string, 0, len(index.Items))
+	for key := range index.Items {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := filepath.Clean(index.Items[keys[i]].RelativePath), filepath.Clean(index.Items[keys[j]].RelativePath)
+		if a != b {
+			return a < b
+		}
+		return keys[i] < keys[j]
+	})
+
+	manifest := *index
+	manifest.Version = ShardedIndexVersion
+	manifest.Items = make(map[string]*Node)
+	manifest.Shards = nil
+	var bufs [][]byte
+	for start := 0; start < len(keys); start += perShard {
+		end := start + perShard
+		if end > len(keys) {
+			end = len(keys)
+		}
+		shard := NewIndex(index.BackupDirectoryID, index.RecoveryPointID)
+		for _, key := range keys[start:end] {
+			shard.Items[key] = index.Items[key]
+		}
+		buf, err := json.Marshal(shard)
+		if err != nil {
+			return nil, nil, err
+		}
+		manifest.Shards = append(manifest.Shards, IndexShard{
+			Name:  ShardName(len(bufs)),
+			Hash:  hashShard(buf),
+			Items: end - start,
+			First: filepath.Clean(index.Items[keys[start]].RelativePath),
+			Last:  filepath.Clean(index.Items[keys[end-1]].RelativePath),
+		})
+		bufs = append(bufs, buf)
+	}
+	return &manifest, bufs, nil
+}
+
+// ShardsUnder returns the shards of index which may hold items whose relative
+// path is below prefix, all of them when prefix is empty.
+func (index *Index) ShardsUnder(prefix string) []IndexShard {
+	prefix = strings.TrimPrefix(filepath.Clean(prefix), string(filepath.Separator))
+	if prefix == "" || prefix == "." {
+		return index.Shards
+	}
+	// Paths below prefix sort from prefix/ up to, excluding, the path with the
+	// separator replaced by the next byte.
+	from := prefix + string(filepath.Separator)
+	to := prefix + string(filepath.Separator+1)
+	var shards []IndexShard
+	for _, shard := range index.Shards {
+		if shard.Last >= from && shard.First < to {
+			shards = append(shards, shard)
+		}
+	}
+	return shards
+}
+
+// MergeShards returns the index holding the items of the given shards of
+// index, read as encoded by name. Every shard must be listed by index with the
+// same hash.
+func (index *Index) MergeShards(rpID string, shards map[string][]byte) (*Index, error) {
+	listed := make(map[string]IndexShard, len(index.Shards))
+	for _, shard := range index.Shards {
+		listed[shard.Name] = shard
+	}
+	merged := *index
+	merged.Version = IndexVersion
+	merged.Items = make(map[string]*Node)
+	merged.Shards = nil
+	for name, buf := range shards {
+		shard, ok := listed[name]
+		if !ok {
+			return nil, incomplete(rpID, "shard %s is not listed", name)
+		}
+		if hashShard(buf) != shard.Hash {
+			return nil, incomplete(rpID, "shard %s does not match its hash", name)
+		}
+		var part Index
+		if err := json.Unmarshal(buf, &part); err != nil {
+			return nil, incomplete(rpID, "shard %s: %v", name, err)
+		}
+		if err := part.Validate(rpID); err != nil {
+			return nil, err
+		}
+		if len(part.Items) != shard.Items {
+			return nil, incomplete(rpID, "shard %s holds %d items, not %d", name, len(part.Items), shard.Items)
+		}
+		for key, node := range part.Items {
+			merged.Items[key] = node
+		}
+	}
+	return &merged, nil
+}
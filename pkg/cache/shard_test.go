@@ -0,0 +1,123 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func shardTestIndex() *Index {
+	index := testIndex("rp1")
+	index.Path = "/data"
+	add := func(rel string) {
+		abs := "/" + rel
+		index.Items[abs] = &Node{AbsolutePath: abs, BasePath: "/data", RelativePath: rel, Type: "file",
+			Content: []*ChunkInfo{{Etag: "e-" + rel}}}
+		index.TotalFiles++
+	}
+	add("data")
+	for _, dir := range []string{"a", "a.b", "b"} {
+		for i := 0; i < 3; i++ {
+			add(fmt.Sprintf("data/%s/f%d", dir, i))
+		}
+	}
+	return index
+}
+
+func decodeShards(t *testing.T, manifest *Index, bufs [][]byte, shards []IndexShard) map[string][]byte {
+	byName := make(map[string][]byte)
+	for i, shard := range manifest.Shards {
+		byName[shard.Name] = bufs[i]
+	}
+	selected := make(map[string][]byte)
+	for _, shard := range shards {
+		require.Contains(t, byName, shard.Name)
+		selected[shard.Name] = byName[shard.Name]
+	}
+	return selected
+}
+
+func TestShardIndex(t *testing.T) {
+	index := shardTestIndex()
+	manifest, bufs, err := ShardIndex(index, 4)
+	require.NoError(t, err)
+
+	// 10 items in shards of 4.
+	require.Len(t, manifest.Shards, 3)
+	require.Len(t, bufs, 3)
+	assert.Equal(t, ShardedIndexVersion, manifest.Version)
+	assert.True(t, manifest.Sharded())
+	assert.Empty(t, manifest.Items)
+	assert.Equal(t, index.TotalFiles, manifest.TotalFiles)
+	assert.Equal(t, "/data", manifest.Path)
+	assert.Equal(t, IndexShard{Name: "index_shard_0.json", Hash: hashShard(bufs[0]), Items: 4, First: "data", Last: "data/a.b/f2"}, manifest.Shards[0])
+	// "." sorts before the separator.
+	assert.Equal(t, "data/a/f0", manifest.Shards[1].First)
+	assert.Equal(t, 2, manifest.Shards[2].Items)
+	assert.NoError(t, manifest.Validate("rp1"))
+
+	// The stored manifest reads back as is.
+	buf, err := json.Marshal(manifest)
+	require.NoError(t, err)
+	var stored Index
+	require.NoError(t, json.Unmarshal(buf, &stored))
+	assert.Equal(t, manifest.Shards, stored.Shards)
+
+	merged, err := stored.MergeShards("rp1", decodeShards(t, manifest, bufs, stored.Shards))
+	require.NoError(t, err)
+	assert.Equal(t, IndexVersion, merged.Version)
+	assert.False(t, merged.Sharded())
+	assert.Equal(t, index.TotalFiles, merged.TotalFiles)
+	require.Len(t, merged.Items, len(index.Items))
+	for key, node := range index.Items {
+		assert.Equal(t, node.RelativePath, merged.Items[key].RelativePath)
+	}
+	assert.NoError(t, merged.Validate("rp1"))
+
+	_, _, err = ShardIndex(index, 0)
+	assert.Error(t, err)
+
+	// An index that fits in one shard is stored in one.
+	manifest, bufs, err = ShardIndex(index, 100)
+	require.NoError(t, err)
+	assert.Len(t, manifest.Shards, 1)
+	assert.Len(t, bufs, 1)
+}
+
+func TestIndexShardsUnder(t *testing.T) {
+	manifest, _, err := ShardIndex(shardTestIndex(), 4)
+	require.NoError(t, err)
+	names := func(shards []IndexShard) []string {
+		var names []string
+		for _, shard := range shards {
+			names = append(names, shard.Name)
+		}
+		return names
+	}
+	assert.Len(t, manifest.ShardsUnder(""), 3)
+	assert.Len(t, manifest.ShardsUnder("/"), 3)
+	assert.Len(t, manifest.ShardsUnder("data"), 3)
+	assert.Equal(t, []string{"index_shard_1.json"}, names(manifest.ShardsUnder("data/a")))
+	assert.Equal(t, []string{"index_shard_1.json"}, names(manifest.ShardsUnder("/data/a/")))
+	assert.Equal(t, []string{"index_shard_0.json"}, names(manifest.ShardsUnder("data/a.b")))
+	assert.Equal(t, []string{"index_shard_1.json", "index_shard_2.json"}, names(manifest.ShardsUnder("data/b")))
+	assert.Empty(t, manifest.ShardsUnder("data/c"))
+	assert.Empty(t, manifest.ShardsUnder("other"))
+}
+
+func TestIndexMergeShardsCorrupt(t *testing.T) {
+	manifest, bufs, err := ShardIndex(shardTestIndex(), 4)
+	require.NoError(t, err)
+
+	_, err = manifest.MergeShards("rp1", map[string][]byte{"index_shard_9.json": bufs[0]})
+	assert.ErrorIs(t, err, ErrIncompleteIndex)
+
+	_, err = manifest.MergeShards("rp1", map[string][]byte{manifest.Shards[0].Name: bufs[1]})
+	assert.ErrorIs(t, err, ErrIncompleteIndex)
+
+	_, err = manifest.MergeShards("rp2", map[string][]byte{manifest.Shards[0].Name: bufs[0]})
+	assert.ErrorIs(t, err, ErrIncompleteIndex)
+}
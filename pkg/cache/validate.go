@@ -0,0 +1,92 @@
+package cache
+
+import (
+	"errors"
+	"fmt"
+)
+
+// IndexVersion is the version of the index format written by this agent.
+// Indexes written by older agents carry no version and read as 0.
+const IndexVersion = 1
+
+// ErrIncompleteIndex is returned when a stored index or chunk list can not be
+// used as is, e.g. after an interrupted upload.
+var ErrIncompleteIndex = errors.New("corrupt or incomplete index")
+
+func incomplete(rpID string, format string, args ...interface{}) error {
+	return fmt.Errorf("%w: recovery point %s: %s", ErrIncompleteIndex, rpID, fmt.Sprintf(format, args...))
+}
+
+func checkHeader(rpID string, version int, storedID string) error {
+	if version > ShardedIndexVersion {
+		return incomplete(rpID, "version %d is newer than %d", version, ShardedIndexVersion)
+	}
+	if storedID != rpID {
+		return incomplete(rpID, "stored for recovery point %q", storedID)
+	}
+	return nil
+}
+
+func checkNodes(rpID string, items map[string]*Node) error {
+	for path, node := range items {
+		if node == nil {
+			return incomplete(rpID, "item %s is empty", path)
+		}
+		for i, chunk := range node.Content {
+			if chunk == nil || chunk.Etag == "" {
+				return incomplete(rpID, "chunk %d of %s has no key", i, path)
+			}
+		}
+	}
+	return nil
+}
+
+// Validate checks that index was read whole for recovery point rpID.
+func (index *Index) Validate(rpID string) error {
+	if err := checkHeader(rpID, index.Version, index.RecoveryPointID); err != nil {
+		return err
+	}
+	if index.Version == ShardedIndexVersion {
+		if !index.Sharded() {
+			return incomplete(rpID, "no shards")
+		}
+		for _, shard := range index.Shards {
+			if !IsIndexShard(shard.Name) || shard.Hash == "" {
+				return incomplete(rpID, "invalid shard %q", shard.Name)
+			}
+		}
+		return nil
+	}
+	if index.Items == nil {
+		return incomplete(rpID, "no items")
+	}
+	return checkNodes(rpID, index.Items)
+}
+
+// Validate checks that d was read whole for recovery point rpID.
+func (d *IndexDelta) Validate(rpID string) error {
+	if err := checkHeader(rpID, d.Version, d.RecoveryPointID); err != nil {
+		return err
+	}
+	if d.Upserted == nil || d.Deleted == nil {
+		return incomplete(rpID, "no changes")
+	}
+	return checkNodes(rpID, d.Upserted)
+}
+
+// ValidateChunks checks that every chunk referenced by index is listed in
+// chunks, the chunk list of the same recovery point.
+func ValidateChunks(index *Index, chunks *Chunk) error {
+	rpID := index.RecoveryPointID
+	if err := checkHeader(rpID, 0, chunks.RecoveryPointID); err != nil {
+		return err
+	}
+	for path, node := range index.Items {
+		for _, chunk := range node.Content {
+			if _, ok := chunks.Chunks[chunk.Etag]; !ok {
+				return incomplete(rpID, "chunk %s of %s is not in %s", chunk.Etag, path, Type(CHUNK))
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIndexValidate(t *testing.T) {
+	node := func(etags ...string) *Node {
+		n := &Node{AbsolutePath: "/a", Type: "file"}
+		for _, etag := range etags {
+			n.Content = append(n.Content, &ChunkInfo{Etag: etag})
+		}
+		return n
+	}
+	tests := []struct {
+		name   string
+		index  *Index
+		reason string
+	}{
+		{"valid", testIndex("rp1", node("e1")), ""},
+		{"legacy", &Index{RecoveryPointID: "rp1", Items: map[string]*Node{}}, ""},
+		{"newer", &Index{Version: ShardedIndexVersion + 1, RecoveryPointID: "rp1", Items: map[string]*Node{}}, "version 3 is newer than 2"},
+		{"sharded", &Index{Version: ShardedIndexVersion, RecoveryPointID: "rp1", Shards: []IndexShard{{Name: ShardName(0), Hash: "h"}}}, ""},
+		{"no shards", &Index{Version: ShardedIndexVersion, RecoveryPointID: "rp1", Items: map[string]*Node{}}, "no shards"},
+		{"invalid shard", &Index{Version: ShardedIndexVersion, RecoveryPointID: "rp1", Shards: []IndexShard{{Name: "../index.json", Hash: "h"}}}, `invalid shard "../index.json"`},
+		{"other recovery point", testIndex("rp2"), `stored for recovery point "rp2"`},
+		{"no items", &Index{RecoveryPointID: "rp1"}, "no items"},
+		{"empty item", &Index{RecoveryPointID: "rp1", Items: map[string]*Node{"/a": nil}}, "item /a is empty"},
+		{"chunk without key", testIndex("rp1", node("e1", "")), "chunk 1 of /a has no key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.index.Validate("rp1")
+			if tt.reason == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorIs(t, err, ErrIncompleteIndex)
+			assert.Contains(t, err.Error(), "recovery point rp1: "+tt.reason)
+		})
+	}
+}
+
+func TestIndexDeltaValidate(t *testing.T) {
+	delta, err := NewIndexDelta("rp1", 1, testIndex("rp1"), testIndex("rp2", &Node{AbsolutePath: "/a"}))
+	require.NoError(t, err)
+	assert.NoError(t, delta.Validate("rp2"))
+
+	delta.Deleted = nil
+	assert.ErrorIs(t, delta.Validate("rp2"), ErrIncompleteIndex)
+}
+
+func TestValidateChunks(t *testing.T) {
+	index := testIndex("rp1", &Node{AbsolutePath: "/a", Type: "file", Content: []*ChunkInfo{{Etag: "e1"}, {Etag: "e2"}}})
+	chunks := NewChunk("bd", "rp1")
+	chunks.Chunks["e1"] = []string{"1-10"}
+	chunks.Chunks["e3"] = []string{"1-10"}
+
+	err := ValidateChunks(index, chunks)
+	assert.ErrorIs(t, err, ErrIncompleteIndex)
+	assert.Contains(t, err.Error(), "chunk e2 of /a is not in chunk.json")
+
+	chunks.Chunks["e2"] = []string{"1-10"}
+	assert.NoError(t, ValidateChunks(index, chunks))
+
+	assert.ErrorIs(t, ValidateChunks(index, NewChunk("bd", "rp2")), ErrIncompleteIndex)
+}
@@ -0,0 +1,225 @@
+// Package keys wraps the content key of a repository to one or more
+// recipients, so that any operator holding a matching private key can unwrap
+// it for a restore.
+//
+// A recipient is either an age X25519 public key ("age1...") or an AWS KMS
+// customer master key ("arn:aws:kms:..." or "kms:<key id>"). The content key
+// is wrapped once per recipient and the resulting WrappedKey list is stored
+// with every recovery point, see backupapi.ContentKeysName.
+//
+// Restore-time recipient selection: Unwrap tries the identities in the order
+// given, each against the wrapped keys it matches, and the first successful
+// unwrap wins. An age identity only matches the key wrapped to its own public
+// key, a KMS identity matches every key wrapped by KMS and lets KMS decide
+// whether the caller may use the CMK.
+//
+// Key rotation: a change of recipients applies to the recovery points created
+// afterwards, existing ones keep the keys they were stored with. The content
+// key is the same for every recovery point of a repository, so a recipient
+// removed can still read what it could unwrap before; rotating the content key
+// itself only applies to recovery points created afterwards.
+package keys
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+)
+
+const (
+	TypeAge = "age"
+	TypeKMS = "kms"
+
+	// ContentKeySize is the size in bytes of a content key.
+	ContentKeySize = 32
+
+	kmsPrefix = "kms:"
+)
+
+var (
+	ErrorNoRecipient      = errors.New("no recipient to wrap the content key to")
+	ErrorNoIdentity       = errors.New("no identity can unwrap the content key")
+	ErrorInvalidRecipient = errors.New("invalid recipient")
+	ErrorInvalidKey       = errors.New("invalid content key")
+)
+
+// WrappedKey is the content key encrypted to a single recipient.
+type WrappedKey struct {
+	Type      string `json:"type"`
+	Recipient string `json:"recipient"`
+	Data      []byte `json:"data"`
+}
+
+// Recipient wraps a content key so that only its holder can unwrap it.
+type Recipient interface {
+	Wrap(key []byte) (*WrappedKey, error)
+}
+
+// Identity unwraps the content keys wrapped to it.
+type Identity interface {
+	Match(w *WrappedKey) bool
+	Unwrap(w *WrappedKey) ([]byte, error)
+}
+
+// NewContentKey returns a random content key.
+func NewContentKey() ([]byte, error) {
+	key := make([]byte, ContentKeySize)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ParseRecipient parses an age public key or a KMS key. kmsClient is only
+// needed for KMS recipients.
+func ParseRecipient(s string, kmsClient kmsiface.KMSAPI) (Recipient, error) {
+	switch {
+	case strings.HasPrefix(s, "age1"):
+		r, err := age.ParseX25519Recipient(s)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrorInvalidRecipient, err)
+		}
+		return &ageRecipient{r: r}, nil
+	case strings.HasPrefix(s, "arn:aws:kms:") || strings.HasPrefix(s, kmsPrefix):
+		if kmsClient == nil {
+			return nil, fmt.Errorf("%w: no KMS client for %s", ErrorInvalidRecipient, s)
+		}
+		return &KMS{client: kmsClient, keyID: strings.TrimPrefix(s, kmsPrefix)}, nil
+	}
+	return nil, fmt.Errorf("%w: %q", ErrorInvalidRecipient, s)
+}
+
+// ParseIdentity parses an age private key ("AGE-SECRET-KEY-1...").
+func ParseIdentity(s string) (Identity, error) {
+	id, err := age.ParseX25519Identity(s)
+	if err != nil {
+		return nil, err
+	}
+	return &ageIdentity{id: id}, nil
+}
+
+// Wrap wraps key to every recipient.
+func Wrap(key []byte, recipients []Recipient) ([]*WrappedKey, error) {
+	if len(key) != ContentKeySize {
+		return nil, ErrorInvalidKey
+	}
+	if len(recipients) == 0 {
+		return nil, ErrorNoRecipient
+	}
+	wrapped := make([]*WrappedKey, 0, len(recipients))
+	for _, r := range recipients {
+		w, err := r.Wrap(key)
+		if err != nil {
+			return nil, err
+		}
+		wrapped = append(wrapped, w)
+	}
+	return wrapped, nil
+}
+
+// Unwrap returns the content key unwrapped by the first identity able to.
+func Unwrap(wrapped []*WrappedKey, identities []Identity) ([]byte, error) {
+	var errs []string
+	for _, id := range identities {
+		for _, w := range wrapped {
+			if !id.Match(w) {
+				continue
+			}
+			key, err := id.Unwrap(w)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s %s: %v", w.Type, w.Recipient, err))
+				continue
+			}
+			if len(key) != ContentKeySize {
+				return nil, ErrorInvalidKey
+			}
+			return key, nil
+		}
+	}
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("%w: %s", ErrorNoIdentity, strings.Join(errs, "; "))
+	}
+	return nil, ErrorNoIdentity
+}
+
+type ageRecipient struct {
+	r *age.X25519Recipient
+}
+
+func (a *ageRecipient) Wrap(key []byte) (*WrappedKey, error) {
+	var buf bytes.Buffer
+	w, err := age.Encrypt(&buf, a.r)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(key); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return &WrappedKey{Type: TypeAge, Recipient: a.r.String(), Data: buf.Bytes()}, nil
+}
+
+type ageIdentity struct {
+	id *age.X25519Identity
+}
+
+func (a *ageIdentity) Match(w *WrappedKey) bool {
+	return w.Type == TypeAge && w.Recipient == a.id.Recipient().String()
+}
+
+func (a *ageIdentity) Unwrap(w *WrappedKey) ([]byte, error) {
+	r, err := age.Decrypt(bytes.NewReader(w.Data), a.id)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+// KMS wraps content keys with a KMS customer master key. As an identity it
+// unwraps any key wrapped by KMS the caller is allowed to decrypt.
+type KMS struct {
+	client kmsiface.KMSAPI
+	keyID  string
+}
+
+// NewKMSIdentity returns an identity decrypting with client.
+func NewKMSIdentity(client kmsiface.KMSAPI) *KMS {
+	return &KMS{client: client}
+}
+
+func (k *KMS) Wrap(key []byte) (*WrappedKey, error) {
+	out, err := k.client.Encrypt(&kms.EncryptInput{
+		KeyId:     aws.String(k.keyID),
+		Plaintext: key,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &WrappedKey{Type: TypeKMS, Recipient: k.keyID, Data: out.CiphertextBlob}, nil
+}
+
+func (k *KMS) Match(w *WrappedKey) bool {
+	return w.Type == TypeKMS
+}
+
+func (k *KMS) Unwrap(w *WrappedKey) ([]byte, error) {
+	out, err := k.client.Decrypt(&kms.DecryptInput{
+		CiphertextBlob: w.Data,
+		KeyId:          aws.String(w.Recipient),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Plaintext, nil
+}
@@ -0,0 +1,126 @@
+package keys
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/kms"
+	"github.com/aws/aws-sdk-go/service/kms/kmsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeKMS "encrypts" by prefixing the key ID, and refuses keys in denied.
+type fakeKMS struct {
+	kmsiface.KMSAPI
+	denied map[string]bool
+}
+
+func (f *fakeKMS) Encrypt(in *kms.EncryptInput) (*kms.EncryptOutput, error) {
+	blob := append([]byte(aws.StringValue(in.KeyId)+":"), in.Plaintext...)
+	return &kms.EncryptOutput{CiphertextBlob: blob, KeyId: in.KeyId}, nil
+}
+
+func (f *fakeKMS) Decrypt(in *kms.DecryptInput) (*kms.DecryptOutput, error) {
+	keyID := aws.StringValue(in.KeyId)
+	if f.denied[keyID] {
+		return nil, errors.New("AccessDeniedException")
+	}
+	return &kms.DecryptOutput{Plaintext: bytes.TrimPrefix(in.CiphertextBlob, []byte(keyID+":")), KeyId: in.KeyId}, nil
+}
+
+func newAgeIdentity(t *testing.T) (Identity, string) {
+	id, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	parsed, err := ParseIdentity(id.String())
+	require.NoError(t, err)
+	return parsed, id.Recipient().String()
+}
+
+func TestWrapUnwrap(t *testing.T) {
+	kmsClient := &fakeKMS{denied: map[string]bool{}}
+	alice, aliceKey := newAgeIdentity(t)
+	bob, bobKey := newAgeIdentity(t)
+	eve, _ := newAgeIdentity(t)
+
+	var recipients []Recipient
+	for _, s := range []string{aliceKey, bobKey, "arn:aws:kms:ap-southeast-1:111:key/cmk"} {
+		r, err := ParseRecipient(s, kmsClient)
+		require.NoError(t, err)
+		recipients = append(recipients, r)
+	}
+
+	key, err := NewContentKey()
+	require.NoError(t, err)
+	wrapped, err := Wrap(key, recipients)
+	require.NoError(t, err)
+	require.Len(t, wrapped, 3)
+	assert.Equal(t, TypeAge, wrapped[0].Type)
+	assert.Equal(t, aliceKey, wrapped[0].Recipient)
+	assert.Equal(t, TypeKMS, wrapped[2].Type)
+
+	tests := []struct {
+		name       string
+		identities []Identity
+		wantErr    bool
+	}{
+		{"alice", []Identity{alice}, false},
+		{"bob", []Identity{bob}, false},
+		{"kms", []Identity{NewKMSIdentity(kmsClient)}, false},
+		{"first match wins", []Identity{eve, bob}, false},
+		{"not a recipient", []Identity{eve}, true},
+		{"no identity", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Unwrap(wrapped, tt.identities)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrorNoIdentity)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, key, got)
+		})
+	}
+
+	kmsClient.denied["arn:aws:kms:ap-southeast-1:111:key/cmk"] = true
+	_, err = Unwrap(wrapped, []Identity{NewKMSIdentity(kmsClient)})
+	assert.ErrorIs(t, err, ErrorNoIdentity)
+	assert.Contains(t, err.Error(), "AccessDeniedException")
+}
+
+func TestParseRecipient(t *testing.T) {
+	_, ageKey := newAgeIdentity(t)
+	tests := []struct {
+		name    string
+		s       string
+		kms     kmsiface.KMSAPI
+		wantErr bool
+	}{
+		{"age", ageKey, nil, false},
+		{"kms arn", "arn:aws:kms:ap-southeast-1:111:key/cmk", &fakeKMS{}, false},
+		{"kms alias", "kms:alias/backup", &fakeKMS{}, false},
+		{"kms without client", "kms:alias/backup", nil, true},
+		{"bad age", "age1invalid", nil, true},
+		{"unknown", "ssh-ed25519 AAAA", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseRecipient(tt.s, tt.kms)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrorInvalidRecipient)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+
+	_, err := Wrap([]byte("short"), nil)
+	assert.ErrorIs(t, err, ErrorInvalidKey)
+	key, _ := NewContentKey()
+	_, err = Wrap(key, nil)
+	assert.ErrorIs(t, err, ErrorNoRecipient)
+}
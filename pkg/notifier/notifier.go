@@ -0,0 +1,82 @@
+package notifier
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	TypeWebhook = "webhook"
+	TypeSlack   = "slack"
+)
+
+const (
+	ActionBackup  = "backup"
+	ActionRestore = "restore"
+)
+
+// Notifier sends the result of a backup or restore to an external sink.
+type Notifier interface {
+	Notify(ctx context.Context, e Event) error
+	String() string
+}
+
+// Event is the result of a backup or restore action.
+type Event struct {
+	Action          string        `json:"action"`
+	ActionID        string        `json:"action_id"`
+	RecoveryPointID string        `json:"recovery_point_id"`
+	Status          string        `json:"status"`
+	Duration        time.Duration `json:"duration"`
+	TotalSize       uint64        `json:"total_size"`
+	StorageSize     uint64        `json:"storage_size"`
+	TotalFiles      int64         `json:"total_files"`
+	Error           string        `json:"error,omitempty"`
+}
+
+// Config describes a notification sink.
+type Config struct {
+	Type string `mapstructure:"type" json:"type" yaml:"type"`
+	URL  string `mapstructure:"url" json:"url" yaml:"url"`
+}
+
+// New creates a Notifier sending events to every sink in cfgs.
+func New(cfgs []Config) (Notifier, error) {
+	var m Multi
+	for _, cfg := range cfgs {
+		if cfg.URL == "" {
+			return nil, errors.New("notifier url is required")
+		}
+		switch cfg.Type {
+		case TypeWebhook:
+			m = append(m, NewWebhook(cfg.URL))
+		case TypeSlack:
+			m = append(m, NewSlack(cfg.URL))
+		default:
+			return nil, fmt.Errorf("notifier type not supported %s", cfg.Type)
+		}
+	}
+	return m, nil
+}
+
+// Multi sends events to all of its notifiers.
+type Multi []Notifier
+
+var _ Notifier = (Multi)(nil)
+
+// Notify sends e to every notifier, returning the first error encountered.
+func (m Multi) Notify(ctx context.Context, e Event) error {
+	var firstErr error
+	for _, n := range m {
+		if err := n.Notify(ctx, e); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("%s: %w", n, err)
+		}
+	}
+	return firstErr
+}
+
+func (m Multi) String() string {
+	return fmt.Sprintf("Multi%v", []Notifier(m))
+}
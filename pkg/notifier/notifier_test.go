@@ -0,0 +1,100 @@
+package notifier
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfgs    []Config
+		wantLen int
+		wantErr bool
+	}{
+		{"empty", nil, 0, false},
+		{"webhook and slack", []Config{{Type: TypeWebhook, URL: "http://localhost"}, {Type: TypeSlack, URL: "http://localhost"}}, 2, false},
+		{"missing url", []Config{{Type: TypeWebhook}}, 0, true},
+		{"unknown type", []Config{{Type: "email", URL: "http://localhost"}}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n, err := New(tt.cfgs)
+			if tt.wantErr {
+				require.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Len(t, n, tt.wantLen)
+		})
+	}
+}
+
+func TestWebhook_Notify(t *testing.T) {
+	var calls int
+	var got Event
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer server.Close()
+
+	e := Event{
+		Action:          ActionBackup,
+		ActionID:        "action",
+		RecoveryPointID: "rp",
+		Status:          "COMPLETED",
+		Duration:        time.Minute,
+		TotalSize:       100,
+		StorageSize:     10,
+		TotalFiles:      2,
+	}
+	require.NoError(t, NewWebhook(server.URL).Notify(context.Background(), e))
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, e, got)
+}
+
+func TestSlack_Notify(t *testing.T) {
+	var got map[string]string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&got))
+	}))
+	defer server.Close()
+
+	e := Event{Action: ActionRestore, RecoveryPointID: "rp", Status: "FAILED", Error: "no space left on device"}
+	require.NoError(t, NewSlack(server.URL).Notify(context.Background(), e))
+	assert.Contains(t, got["text"], "restore FAILED")
+	assert.Contains(t, got["text"], "no space left on device")
+}
+
+type recordNotifier struct {
+	events []Event
+}
+
+func (r *recordNotifier) Notify(_ context.Context, e Event) error {
+	r.events = append(r.events, e)
+	return nil
+}
+
+func (r *recordNotifier) String() string {
+	return "record"
+}
+
+func TestMulti_Notify(t *testing.T) {
+	first, second := &recordNotifier{}, &recordNotifier{}
+	m := Multi{first, second}
+	require.NoError(t, m.Notify(context.Background(), Event{ActionID: "action"}))
+	assert.Len(t, first.events, 1)
+	assert.Len(t, second.events, 1)
+}
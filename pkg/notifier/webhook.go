@@ -0,0 +1,93 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+const (
+	defaultTimeout    = 10 * time.Second
+	maxTimesRetryPost = 3
+)
+
+// Webhook posts events as JSON to an HTTP endpoint.
+type Webhook struct {
+	url    string
+	client *http.Client
+}
+
+var _ Notifier = (*Webhook)(nil)
+
+// NewWebhook creates a Webhook posting to url.
+func NewWebhook(url string) *Webhook {
+	return &Webhook{url: url, client: &http.Client{Timeout: defaultTimeout}}
+}
+
+func (w *Webhook) Notify(ctx context.Context, e Event) error {
+	return post(ctx, w.client, w.url, e)
+}
+
+func (w *Webhook) String() string {
+	return fmt.Sprintf("Webhook [%s]", w.url)
+}
+
+// Slack posts events as messages to a Slack compatible incoming webhook.
+type Slack struct {
+	url    string
+	client *http.Client
+}
+
+var _ Notifier = (*Slack)(nil)
+
+// NewSlack creates a Slack notifier posting to the incoming webhook url.
+func NewSlack(url string) *Slack {
+	return &Slack{url: url, client: &http.Client{Timeout: defaultTimeout}}
+}
+
+func (s *Slack) Notify(ctx context.Context, e Event) error {
+	text := fmt.Sprintf("%s %s: recovery point %s, action %s, duration %s, total %d bytes, stored %d bytes, %d files",
+		e.Action, e.Status, e.RecoveryPointID, e.ActionID, e.Duration.Round(time.Second), e.TotalSize, e.StorageSize, e.TotalFiles)
+	if e.Error != "" {
+		text += ", error: " + e.Error
+	}
+	return post(ctx, s.client, s.url, map[string]string{"text": text})
+}
+
+func (s *Slack) String() string {
+	return "Slack"
+}
+
+// post sends body as JSON to url, retrying on failure.
+func post(ctx context.Context, client *http.Client, url string, body interface{}) error {
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	bo := backoff.WithMaxRetries(backoff.NewExponentialBackOff(), maxTimesRetryPost)
+	return backoff.Retry(func() error {
+		req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(buf))
+		if err != nil {
+			return backoff.Permanent(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			if ctx.Err() != nil {
+				return backoff.Permanent(ctx.Err())
+			}
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+		}
+		return nil
+	}, backoff.WithContext(bo, ctx))
+}
@@ -34,6 +34,16 @@ type Stat struct {
 	Storage  uint64
 	Errors   bool
 	ItemName []string
+
+	// Set by a backup: the bytes of the chunks uploaded, or which would be by
+	// a dry run, of the files read again as changed, and of the files left as
+	// they were in the last backup. DedupedBytes are the bytes of changed
+	// files not uploaded as the vault already holds them, so that
+	// ChangedBytes is NewBytes plus DedupedBytes.
+	NewBytes       uint64
+	ChangedBytes   uint64
+	UnchangedBytes uint64
+	DedupedBytes   uint64
 }
 
 type ProgressFunc func(s Stat, runtime time.Duration, ticker bool)
@@ -126,6 +136,16 @@ func (p *Progress) Report(s Stat) {
 	}
 }
 
+// Current returns the statistics accumulated so far.
+func (p *Progress) Current() Stat {
+	if p == nil {
+		return Stat{}
+	}
+	p.currentMutex.Lock()
+	defer p.currentMutex.Unlock()
+	return p.currentStat
+}
+
 func (p *Progress) Done() {
 	if p == nil || !p.running {
 		return
@@ -167,6 +187,15 @@ func (s *Stat) Add(other Stat) {
 	s.Errors = other.Errors
 	s.Storage += other.Storage
 	s.ItemName = other.ItemName
+	s.NewBytes += other.NewBytes
+	s.ChangedBytes += other.ChangedBytes
+	s.UnchangedBytes += other.UnchangedBytes
+	s.DedupedBytes += other.DedupedBytes
+}
+
+// ScannedBytes returns the bytes of the files backed up, changed or not.
+func (s Stat) ScannedBytes() uint64 {
+	return s.ChangedBytes + s.UnchangedBytes
 }
 
 func (s Stat) String() string {
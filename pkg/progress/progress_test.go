@@ -1,6 +1,10 @@
 package progress
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestStat_String(t *testing.T) {
 	type fields struct {
@@ -42,3 +46,17 @@ func TestStat_String(t *testing.T) {
 		})
 	}
 }
+
+func TestStat_Add(t *testing.T) {
+	var s Stat
+	s.Add(Stat{Bytes: 10, NewBytes: 4, ChangedBytes: 10, DedupedBytes: 6})
+	s.Add(Stat{UnchangedBytes: 20})
+	s.Add(Stat{Bytes: 5, NewBytes: 5, ChangedBytes: 5})
+
+	assert.Equal(t, uint64(15), s.Bytes)
+	assert.Equal(t, uint64(9), s.NewBytes)
+	assert.Equal(t, uint64(15), s.ChangedBytes)
+	assert.Equal(t, uint64(20), s.UnchangedBytes)
+	assert.Equal(t, uint64(6), s.DedupedBytes)
+	assert.Equal(t, uint64(35), s.ScannedBytes())
+}
@@ -0,0 +1,119 @@
+package progress
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const stateFileExt = ".json"
+
+// Snapshot is the last known progress of a job, persisted so that it survives
+// an agent crash.
+type Snapshot struct {
+	ActionID          string    `json:"action_id"`
+	BackupDirectoryID string    `json:"backup_directory_id"`
+	RecoveryPointID   string    `json:"recovery_point_id"`
+	Items             uint64    `json:"items"`
+	Bytes             uint64    `json:"bytes"`
+	Storage           uint64    `json:"storage"`
+	Errors            bool      `json:"errors"`
+	TodoItems         uint64    `json:"todo_items"`
+	TodoBytes         uint64    `json:"todo_bytes"`
+	Elapsed           int64     `json:"elapsed"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// StateFile writes the snapshots of a job to a file, at most once per
+// interval.
+type StateFile struct {
+	path     string
+	interval time.Duration
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+// NewStateFile returns a StateFile writing to path. An interval of 0 writes
+// every snapshot.
+func NewStateFile(path string, interval time.Duration) *StateFile {
+	return &StateFile{path: path, interval: interval}
+}
+
+// Save writes snap unless the previous write is more recent than the interval.
+func (f *StateFile) Save(snap Snapshot) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.last.IsZero() && time.Since(f.last) < f.interval {
+		return nil
+	}
+	f.last = time.Now()
+
+	snap.UpdatedAt = f.last.UTC()
+	buf, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+	// Write then rename, a crash during the write must not leave a truncated state.
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// Remove deletes the state file once the job is over.
+func (f *StateFile) Remove() error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// LoadStates returns the snapshots left in dir, keyed by their file name
+// without extension.
+func LoadStates(dir string) (map[string]*Snapshot, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	states := make(map[string]*Snapshot)
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != stateFileExt {
+			continue
+		}
+		buf, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		var snap Snapshot
+		if err := json.Unmarshal(buf, &snap); err != nil {
+			continue
+		}
+		states[strings.TrimSuffix(entry.Name(), stateFileExt)] = &snap
+	}
+	return states, nil
+}
+
+// StatePath returns the path of the state file of name in dir.
+func StatePath(dir, name string) string {
+	return filepath.Join(dir, name+stateFileExt)
+}
@@ -0,0 +1,44 @@
+package progress
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStateFile(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "progress")
+	f := NewStateFile(StatePath(dir, "bd1"), time.Hour)
+
+	require.NoError(t, f.Save(Snapshot{RecoveryPointID: "rp1", Bytes: 10}))
+	// Throttled, the first snapshot stays on disk.
+	require.NoError(t, f.Save(Snapshot{RecoveryPointID: "rp1", Bytes: 20}))
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "garbage.json"), []byte("{"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "other.txt"), []byte("{}"), 0600))
+
+	states, err := LoadStates(dir)
+	require.NoError(t, err)
+	require.Len(t, states, 1)
+	assert.Equal(t, "rp1", states["bd1"].RecoveryPointID)
+	assert.Equal(t, uint64(10), states["bd1"].Bytes)
+	assert.False(t, states["bd1"].UpdatedAt.IsZero())
+
+	require.NoError(t, f.Remove())
+	_, err = os.Stat(StatePath(dir, "bd1"))
+	assert.True(t, os.IsNotExist(err))
+	require.NoError(t, f.Remove())
+
+	states, err = LoadStates(filepath.Join(dir, "missing"))
+	assert.NoError(t, err)
+	assert.Empty(t, states)
+
+	var nilFile *StateFile
+	assert.NoError(t, nilFile.Save(Snapshot{}))
+	assert.NoError(t, nilFile.Remove())
+}
@@ -0,0 +1,150 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+// progressStreamInterval is the interval between two snapshots of the
+// progress stream.
+var progressStreamInterval = time.Second
+
+// progressEvent is a snapshot of the progress of a running action.
+type progressEvent struct {
+	ActionID          string `json:"action_id"`
+	Action            string `json:"action"`
+	BackupDirectoryID string `json:"backup_directory_id,omitempty"`
+	RecoveryPointID   string `json:"recovery_point_id"`
+	Phase             string `json:"phase,omitempty"`
+	Items             uint64 `json:"items"`
+	Bytes             uint64 `json:"bytes"`
+	Storage           uint64 `json:"storage"`
+	Errors            bool   `json:"errors"`
+	TotalItems        uint64 `json:"total_items"`
+	TotalBytes        uint64 `json:"total_bytes"`
+	// Set by a backup, see progress.Stat.
+	ScannedBytes   uint64 `json:"scanned_bytes,omitempty"`
+	NewBytes       uint64 `json:"new_bytes,omitempty"`
+	ChangedBytes   uint64 `json:"changed_bytes,omitempty"`
+	UnchangedBytes uint64 `json:"unchanged_bytes,omitempty"`
+	DedupedBytes   uint64 `json:"deduped_bytes,omitempty"`
+	// Done is set on the last snapshot, once the action completed.
+	Done bool `json:"done"`
+}
+
+// setActionProgress records p as the progress of the running phase of
+// actionID, whose totals are todo.
+func (s *Server) setActionProgress(actionID, phase string, p *progress.Progress, todo progress.Stat) {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	c, ok := s.mapActionContext[actionID]
+	if !ok {
+		return
+	}
+	c.phase, c.progress, c.todo = phase, p, todo
+	s.mapActionContext[actionID] = c
+}
+
+// findAction returns the running action id, or the running backup of the
+// backup directory id.
+func (s *Server) findAction(id string) (string, contextStruct, bool) {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	if c, ok := s.mapActionContext[id]; ok {
+		return id, c, true
+	}
+	for actionID, c := range s.mapActionContext {
+		if c.backupDirectoryID == id {
+			return actionID, c, true
+		}
+	}
+	return "", contextStruct{}, false
+}
+
+func newProgressEvent(actionID string, c contextStruct) progressEvent {
+	stat := c.progress.Current()
+	return progressEvent{
+		ActionID:          actionID,
+		Action:            c.action,
+		BackupDirectoryID: c.backupDirectoryID,
+		RecoveryPointID:   c.recoveryPointID,
+		Phase:             c.phase,
+		Items:             stat.Items,
+		Bytes:             stat.Bytes,
+		Storage:           stat.Storage,
+		Errors:            stat.Errors,
+		TotalItems:        c.todo.Items,
+		TotalBytes:        c.todo.Bytes,
+		ScannedBytes:      stat.ScannedBytes(),
+		NewBytes:          stat.NewBytes,
+		ChangedBytes:      stat.ChangedBytes,
+		UnchangedBytes:    stat.UnchangedBytes,
+		DedupedBytes:      stat.DedupedBytes,
+	}
+}
+
+// StreamProgress streams the progress of a running backup or restore, found by
+// its action ID or by the backup directory ID, until it completes. Snapshots
+// are newline delimited JSON, or server-sent events when asked with
+// Accept: text/event-stream.
+func (s *Server) StreamProgress(w http.ResponseWriter, r *http.Request) {
+	actionID, c, ok := s.findAction(chi.URLParam(r, "backupID"))
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("no running action"))
+		return
+	}
+
+	sse := strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+	if sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	flusher, _ := w.(http.Flusher)
+	write := func(e progressEvent) error {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if sse {
+			_, err = fmt.Fprintf(w, "data: %s\n\n", payload)
+		} else {
+			_, err = fmt.Fprintf(w, "%s\n", payload)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return err
+	}
+
+	ticker := time.NewTicker(progressStreamInterval)
+	defer ticker.Stop()
+	for {
+		if err := write(newProgressEvent(actionID, c)); err != nil {
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+		running, ok := s.action(actionID)
+		if !ok {
+			// The last snapshot is taken from the progress the action ended with.
+			e := newProgressEvent(actionID, c)
+			e.Done = true
+			_ = write(e)
+			return
+		}
+		c = running
+	}
+}
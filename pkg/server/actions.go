@@ -0,0 +1,141 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/notifier"
+)
+
+// ErrorRestoreRunning is returned when a restore of the same recovery point
+// into the same destination is already running.
+var ErrorRestoreRunning = errors.New("restore already running")
+
+// ErrorRestoreRun is returned for the restore_manual event of a restore the
+// agent ran itself.
+var ErrorRestoreRun = errors.New("restore already run by the agent")
+
+// ErrorBackupRunning is returned when a backup of the same backup directory is
+// already running.
+var ErrorBackupRunning = errors.New("backup already running")
+
+// ErrorUnknownBackupDirectory and ErrorUnknownPolicy are returned for a
+// requested backup of a directory, or under a policy of it, missing from the
+// config of the agent.
+var (
+	ErrorUnknownBackupDirectory = errors.New("unknown backup directory")
+	ErrorUnknownPolicy          = errors.New("unknown policy")
+)
+
+// setAction registers a running action.
+func (s *Server) setAction(actionID string, c contextStruct) {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	s.mapActionContext[actionID] = c
+}
+
+// startRestore registers a running restore, unless another restore of the same
+// recovery point into the same destination is running.
+func (s *Server) startRestore(actionID string, c contextStruct) error {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	return s.startRestoreLocked(actionID, c)
+}
+
+func (s *Server) startRestoreLocked(actionID string, c contextStruct) error {
+	for id, running := range s.mapActionContext {
+		if id != actionID && running.action == notifier.ActionRestore &&
+			running.recoveryPointID == c.recoveryPointID && running.destDir == c.destDir {
+			return fmt.Errorf("%w: recovery point %s into %s by action %s", ErrorRestoreRunning, c.recoveryPointID, c.destDir, id)
+		}
+	}
+	s.mapActionContext[actionID] = c
+	return nil
+}
+
+// startLocalRestore registers a restore the agent runs itself under actionID,
+// as startRestore, and remembers actionID so that the restore_manual event the
+// backup service sends for the action is acknowledged without running the
+// restore again, even once it ended. It reports false when the event came
+// first and runs the restore already.
+func (s *Server) startLocalRestore(actionID string, c contextStruct) (bool, error) {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	if _, ok := s.mapActionContext[actionID]; ok {
+		return false, nil
+	}
+	if err := s.startRestoreLocked(actionID, c); err != nil {
+		return false, err
+	}
+	s.localRestores[actionID] = true
+	return true, nil
+}
+
+// checkRestoreEvent returns the error acknowledging the restore_manual event of
+// actionID without running it, when its restore runs or was run by the agent.
+func (s *Server) checkRestoreEvent(actionID string) error {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	if s.localRestores[actionID] {
+		return fmt.Errorf("%w: action %s", ErrorRestoreRun, actionID)
+	}
+	if _, ok := s.mapActionContext[actionID]; ok {
+		return fmt.Errorf("%w: action %s", ErrorRestoreRunning, actionID)
+	}
+	return nil
+}
+
+// reserveBackup holds backupDirectoryID for a backup about to start, unless
+// a backup of it is running or starting. The reservation is released with
+// releaseBackup once the backup is registered as running.
+func (s *Server) reserveBackup(backupDirectoryID string) error {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	if s.startingBackups[backupDirectoryID] {
+		return fmt.Errorf("%w: backup directory %s", ErrorBackupRunning, backupDirectoryID)
+	}
+	if id, ok := s.runningBackupLocked(backupDirectoryID); ok {
+		return fmt.Errorf("%w: backup directory %s by action %s", ErrorBackupRunning, backupDirectoryID, id)
+	}
+	s.startingBackups[backupDirectoryID] = true
+	return nil
+}
+
+// runningBackup returns the action of the running backup of
+// backupDirectoryID.
+func (s *Server) runningBackup(backupDirectoryID string) (string, bool) {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	return s.runningBackupLocked(backupDirectoryID)
+}
+
+func (s *Server) runningBackupLocked(backupDirectoryID string) (string, bool) {
+	for id, running := range s.mapActionContext {
+		if running.action == notifier.ActionBackup && running.backupDirectoryID == backupDirectoryID {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+// releaseBackup drops the reservation of backupDirectoryID.
+func (s *Server) releaseBackup(backupDirectoryID string) {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	delete(s.startingBackups, backupDirectoryID)
+}
+
+// action returns the running action actionID.
+func (s *Server) action(actionID string) (contextStruct, bool) {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	c, ok := s.mapActionContext[actionID]
+	return c, ok
+}
+
+// deleteAction unregisters a finished action.
+func (s *Server) deleteAction(actionID string) {
+	s.actionsMu.Lock()
+	defer s.actionsMu.Unlock()
+	delete(s.mapActionContext, actionID)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+)
+
+// ageWindow leaves out of a backup the files modified longer than maxAge, or
+// less than minAge, before start. Zero bounds are not checked.
+type ageWindow struct {
+	start  time.Time
+	maxAge time.Duration
+	minAge time.Duration
+}
+
+// ageWindowFromConfig returns the age window of the backup of bd started at
+// start.
+func ageWindowFromConfig(bd *backupapi.BackupDirectoryConfig, start time.Time) (ageWindow, error) {
+	w := ageWindow{start: start}
+	if bd == nil {
+		return w, nil
+	}
+	var err error
+	if w.maxAge, err = parseAge(bd.MaxAge); err != nil {
+		return ageWindow{}, fmt.Errorf("%w: max_age %q of backup directory %s", backupapi.ErrorInvalidConfig, bd.MaxAge, bd.ID)
+	}
+	if w.minAge, err = parseAge(bd.MinAge); err != nil {
+		return ageWindow{}, fmt.Errorf("%w: min_age %q of backup directory %s", backupapi.ErrorInvalidConfig, bd.MinAge, bd.ID)
+	}
+	if w.maxAge > 0 && w.minAge > w.maxAge {
+		return ageWindow{}, fmt.Errorf("%w: min_age %q above max_age %q of backup directory %s", backupapi.ErrorInvalidConfig, bd.MinAge, bd.MaxAge, bd.ID)
+	}
+	return w, nil
+}
+
+// parseAge parses a duration such as 36h, or a number of days such as 30d.
+func parseAge(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	var d time.Duration
+	if days := strings.TrimSuffix(s, "d"); days != s {
+		n, err := strconv.ParseUint(days, 10, 32)
+		if err != nil {
+			return 0, err
+		}
+		d = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative age %s", s)
+	}
+	return d, nil
+}
+
+// excludes reports whether a file modified at mtime is outside the window.
+func (w ageWindow) excludes(mtime time.Time) bool {
+	age := w.start.Sub(mtime)
+	if w.maxAge > 0 && age > w.maxAge {
+		return true
+	}
+	return w.minAge > 0 && age < w.minAge
+}
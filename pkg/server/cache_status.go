@@ -0,0 +1,64 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/support"
+)
+
+// CacheStatusResponse describes the local cache of the agent.
+type CacheStatusResponse struct {
+	Path        string             `json:"path"`
+	Size        int64              `json:"size"`
+	Generations []cache.Generation `json:"generations"`
+}
+
+// pruneCache keeps the cache_generations newest cache directories of the
+// recovery points of bdID once rpID, the latest one, completed. Nothing is
+// pruned when cache_generations is not set.
+func (s *Server) pruneCache(cachePath, mcID, bdID, rpID string) {
+	keep := viper.GetInt("cache_generations")
+	if keep <= 0 {
+		return
+	}
+	removed, err := cache.PruneGenerations(cachePath, mcID, bdID, rpID, keep)
+	if err != nil {
+		s.logger.Error("Prune cache error", zap.Error(err), zap.String("backup_directory_id", bdID))
+	}
+	if len(removed) > 0 {
+		s.logger.Info("Pruned cache of old recovery points", zap.String("backup_directory_id", bdID), zap.Strings("recovery_point_ids", removed))
+	}
+}
+
+// CacheStatus returns the size of the local cache and its recovery points.
+func (s *Server) CacheStatus(w http.ResponseWriter, r *http.Request) {
+	status, err := s.cacheStatus()
+	if err != nil {
+		s.logger.Error("err ", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(status)
+}
+
+func (s *Server) cacheStatus() (*CacheStatusResponse, error) {
+	_, cachePath, err := support.CheckPath()
+	if err != nil {
+		return nil, err
+	}
+	size, err := cache.Size(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	generations, err := cache.Generations(cachePath, s.backupClient.Id)
+	if err != nil {
+		return nil, err
+	}
+	return &CacheStatusResponse{Path: cachePath, Size: size, Generations: generations}, nil
+}
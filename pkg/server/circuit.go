@@ -0,0 +1,135 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+)
+
+const (
+	statusPaused = "PAUSED"
+
+	defaultCircuitFailures = 5
+	defaultCircuitCooldown = 24 * time.Hour
+)
+
+// circuit counts the consecutive failures of the scheduled backups of a
+// backup directory. Once open, scheduled backups of the directory are skipped
+// until Until, then a single run is let through: success closes the circuit,
+// failure opens it again.
+type circuit struct {
+	BackupDirectoryID string    `json:"backup_directory_id"`
+	Failures          int       `json:"failures"`
+	Open              bool      `json:"open"`
+	Until             time.Time `json:"until,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// circuitConfig returns backup_circuit_failures and backup_circuit_cooldown,
+// no failures disables the circuit breaker.
+func circuitConfig() (int, time.Duration) {
+	failures := defaultCircuitFailures
+	if viper.IsSet("backup_circuit_failures") {
+		failures = viper.GetInt("backup_circuit_failures")
+	}
+	cooldown := defaultCircuitCooldown
+	if viper.IsSet("backup_circuit_cooldown") {
+		cooldown = viper.GetDuration("backup_circuit_cooldown")
+	}
+	return failures, cooldown
+}
+
+// circuitAllows reports whether a scheduled backup of directoryID may run.
+func (s *Server) circuitAllows(directoryID string) bool {
+	s.circuitMu.Lock()
+	defer s.circuitMu.Unlock()
+	c, ok := s.circuits[directoryID]
+	return !ok || !c.Open || !time.Now().Before(c.Until)
+}
+
+// recordScheduledBackup updates the circuit of directoryID with the result of
+// a scheduled backup, and opens it after backup_circuit_failures consecutive
+// failures. Cancelled backups are not counted.
+func (s *Server) recordScheduledBackup(directoryID, policyID string, err error) {
+	if errors.Is(err, backupapi.ErrorGotCancelRequest) {
+		return
+	}
+	maxFailures, cooldown := circuitConfig()
+
+	s.circuitMu.Lock()
+	defer s.circuitMu.Unlock()
+	if err == nil || maxFailures <= 0 {
+		delete(s.circuits, directoryID)
+		return
+	}
+	c, ok := s.circuits[directoryID]
+	if !ok {
+		c = &circuit{BackupDirectoryID: directoryID}
+		s.circuits[directoryID] = c
+	}
+	c.Failures++
+	c.Error = err.Error()
+	if c.Failures < maxFailures {
+		return
+	}
+	c.Open = true
+	c.Until = time.Now().Add(cooldown)
+
+	s.logger.Warn("Pausing scheduled backups of directory after consecutive failures",
+		zap.String("backup_directory_id", directoryID),
+		zap.Int("failures", c.Failures),
+		zap.Time("until", c.Until))
+	s.notifyMsg(map[string]string{
+		"status":              statusPaused,
+		"backup_directory_id": directoryID,
+		"policy_id":           policyID,
+		"failures":            strconv.Itoa(c.Failures),
+		"until":               c.Until.Format(time.RFC3339),
+		"reason":              c.Error,
+	})
+}
+
+// resetCircuit closes the circuit of directoryID, reporting whether it was
+// tracked.
+func (s *Server) resetCircuit(directoryID string) bool {
+	s.circuitMu.Lock()
+	defer s.circuitMu.Unlock()
+	_, ok := s.circuits[directoryID]
+	delete(s.circuits, directoryID)
+	return ok
+}
+
+// ListCircuits returns the backup directories whose scheduled backups are
+// failing.
+func (s *Server) ListCircuits(w http.ResponseWriter, r *http.Request) {
+	s.circuitMu.Lock()
+	circuits := make([]circuit, 0, len(s.circuits))
+	for _, c := range s.circuits {
+		circuits = append(circuits, *c)
+	}
+	s.circuitMu.Unlock()
+	sort.Slice(circuits, func(i, j int) bool { return circuits[i].BackupDirectoryID < circuits[j].BackupDirectoryID })
+	_ = json.NewEncoder(w).Encode(circuits)
+}
+
+// ResetCircuit resumes the scheduled backups of a backup directory paused
+// after consecutive failures.
+func (s *Server) ResetCircuit(w http.ResponseWriter, r *http.Request) {
+	backupID := chi.URLParam(r, "backupID")
+	if !s.resetCircuit(backupID) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("No failures recorded"))
+		return
+	}
+	s.logger.Info("Circuit of backup directory reset", zap.String("backup_directory_id", backupID))
+	_, _ = w.Write([]byte("Success"))
+}
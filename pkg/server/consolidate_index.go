@@ -0,0 +1,105 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// ConsolidateIndexResult is the outcome of consolidating the index of a
+// recovery point. Depth is the depth of the delta index replaced, 0 when the
+// index was already a full one and was left as is.
+type ConsolidateIndexResult struct {
+	RecoveryPointID string `json:"recovery_point_id"`
+	Depth           int    `json:"depth"`
+	IndexHash       string `json:"index_hash"`
+	IndexSize       int    `json:"index_size,omitempty"`
+}
+
+// consolidateIndex stores the full index of rpID, folded from its chain of
+// delta indexes, next to its delta index and records its hash with the backup
+// service: a synthetic full index, read without the ancestors of rpID, which
+// the next backup starts a new chain from.
+func (s *Server) consolidateIndex(ctx context.Context, storageVault storage_vault.StorageVault, mcID, rpID, indexHash string) (*ConsolidateIndexResult, error) {
+	index, depth, err := s.loadIndex(ctx, storageVault, "", mcID, rpID, indexHash)
+	if err != nil {
+		return nil, err
+	}
+	result := &ConsolidateIndexResult{RecoveryPointID: rpID, Depth: depth, IndexHash: indexHash}
+	if depth == 0 {
+		s.logger.Info("Index is a full one already", zap.String("recovery_point_id", rpID))
+		return result, nil
+	}
+
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return nil, err
+	}
+	if buf, err = s.putIndexShards(ctx, storageVault, mcID, rpID, buf, nil); err != nil {
+		return nil, err
+	}
+	key := filepath.Join(mcID, rpID, cache.Type(cache.INDEX).String())
+	if err := storageVault.PutObject(ctx, key, buf); err != nil {
+		return nil, err
+	}
+	result.IndexHash, result.IndexSize = hashIndex(buf), len(buf)
+	if err := s.backupClient.UpdateRecoveryPointIndex(ctx, rpID, result.IndexHash, result.IndexSize); err != nil {
+		return nil, err
+	}
+	s.logger.Info("Index consolidated", zap.String("key", key), zap.Int("depth", depth), zap.Int("size", result.IndexSize))
+	return result, nil
+}
+
+// requestConsolidateIndex consolidates the index of recovery point rpID of
+// machine mcID stored in storage vault storageVaultID.
+func (s *Server) requestConsolidateIndex(ctx context.Context, mcID, rpID, storageVaultID string) (*ConsolidateIndexResult, error) {
+	vault, err := s.backupClient.GetCredentialStorageVault(storageVaultID, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	storageVault, err := s.NewStorageVault(*vault, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer s.logVaultRequests(storageVault)
+
+	rp, err := s.backupClient.GetRecoveryPointInfo(rpID)
+	if err != nil {
+		return nil, err
+	}
+	return s.consolidateIndex(ctx, storageVault, mcID, rpID, rp.IndexHash)
+}
+
+// ConsolidateIndex stores the full index of a recovery point in place of its
+// chain of delta indexes.
+func (s *Server) ConsolidateIndex(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		MachineID      string `json:"machine_id"`
+		StorageVaultID string `json:"storage_vault_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.StorageVaultID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`malformed body`))
+		return
+	}
+	if body.MachineID == "" {
+		body.MachineID = s.backupClient.Id
+	}
+
+	recoveryPointID := chi.URLParam(r, "recoveryPointID")
+	result, err := s.requestConsolidateIndex(r.Context(), body.MachineID, recoveryPointID, body.StorageVaultID)
+	if err != nil {
+		s.logger.Error("err ", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
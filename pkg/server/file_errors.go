@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// minItemsForErrorPercent is the number of items below which a percentage
+// threshold is only checked at the end of the backup, so that the first
+// failures of a walk do not abort it.
+const minItemsForErrorPercent = 100
+
+// Values of permission_errors.
+const (
+	permissionErrorsFail = "fail"
+	permissionErrorsSkip = "skip"
+)
+
+// ErrorTooManyFileErrors is returned when the failures of a backup run with
+// continue_on_error go past max_file_errors.
+var ErrorTooManyFileErrors = errors.New("too many file errors")
+
+// errorThreshold is the number or the percentage of items allowed to fail,
+// zero means unlimited.
+type errorThreshold struct {
+	count   uint64
+	percent float64
+}
+
+// parseErrorThreshold parses an absolute count ("100") or a percentage of
+// the items ("5%").
+func parseErrorThreshold(s string) (errorThreshold, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return errorThreshold{}, nil
+	}
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return errorThreshold{}, fmt.Errorf("invalid max_file_errors %q", s)
+		}
+		return errorThreshold{percent: percent}, nil
+	}
+	count, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return errorThreshold{}, fmt.Errorf("invalid max_file_errors %q", s)
+	}
+	return errorThreshold{count: count}, nil
+}
+
+// exceeded reports whether failed out of total items is past the threshold.
+// Until final, a percentage is only checked once enough items are seen.
+func (t errorThreshold) exceeded(failed, total uint64, final bool) bool {
+	if t.count > 0 && failed > t.count {
+		return true
+	}
+	if t.percent > 0 && total > 0 && (final || total >= minItemsForErrorPercent) {
+		return float64(failed)*100/float64(total) > t.percent
+	}
+	return false
+}
+
+func (t errorThreshold) String() string {
+	if t.percent > 0 {
+		return strconv.FormatFloat(t.percent, 'f', -1, 64) + "%"
+	}
+	return strconv.FormatUint(t.count, 10)
+}
+
+// fileErrors counts the items of a backup which failed. A nil fileErrors
+// fails the backup on the first error.
+type fileErrors struct {
+	threshold errorThreshold
+
+	mu    sync.Mutex
+	paths []string
+}
+
+// fileErrorsFromConfig returns nil unless continue_on_error is set.
+func fileErrorsFromConfig() (*fileErrors, error) {
+	if !viper.GetBool("continue_on_error") {
+		return nil, nil
+	}
+	threshold, err := parseErrorThreshold(viper.GetString("max_file_errors"))
+	if err != nil {
+		return nil, err
+	}
+	return &fileErrors{threshold: threshold}, nil
+}
+
+// permissionErrorsFromConfig returns the record of the items skipped for lack
+// of permission when permission_errors is skip, nil when they fail the backup.
+func permissionErrorsFromConfig() (*fileErrors, error) {
+	switch policy := viper.GetString("permission_errors"); policy {
+	case "", permissionErrorsFail:
+		return nil, nil
+	case permissionErrorsSkip:
+		return &fileErrors{}, nil
+	default:
+		return nil, fmt.Errorf("invalid permission_errors %q", policy)
+	}
+}
+
+// add records the failure of path out of total items seen so far. It returns
+// the error which must abort the backup, if any.
+func (f *fileErrors) add(path string, err error, total uint64) error {
+	if f == nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.paths = append(f.paths, path)
+	return f.check(total, false)
+}
+
+// failed returns the paths which failed.
+func (f *fileErrors) failed() []string {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.paths...)
+}
+
+// final checks the threshold against the total number of items of the backup.
+func (f *fileErrors) final(total uint64) error {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.check(total, true)
+}
+
+func (f *fileErrors) check(total uint64, final bool) error {
+	failed := uint64(len(f.paths))
+	if !f.threshold.exceeded(failed, total, final) {
+		return nil
+	}
+	return fmt.Errorf("%w: %d of %d items failed, more than max_file_errors %s", ErrorTooManyFileErrors, failed, total, f.threshold)
+}
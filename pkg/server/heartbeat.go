@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/broker"
+	"github.com/bizflycloud/bizfly-backup/pkg/notifier"
+)
+
+const defaultHeartbeatInterval = time.Minute
+
+// heartbeat is published on the status topic every heartbeat_interval, so the
+// server can mark the agent offline when they stop.
+type heartbeat struct {
+	EventType       string        `json:"event_type"`
+	MachineID       string        `json:"machine_id"`
+	Version         string        `json:"version"`
+	Uptime          int64         `json:"uptime"`
+	BrokerConnected bool          `json:"broker_connected"`
+	LastBackup      *backupResult `json:"last_backup,omitempty"`
+	CreatedAt       string        `json:"created_at"`
+}
+
+// backupResult is the outcome of the last backup run by the agent.
+type backupResult struct {
+	ActionID        string    `json:"action_id"`
+	RecoveryPointID string    `json:"recovery_point_id,omitempty"`
+	Status          string    `json:"status"`
+	Error           string    `json:"error,omitempty"`
+	FinishedAt      time.Time `json:"finished_at"`
+}
+
+// heartbeatInterval returns the configured heartbeat_interval, 0 disables the
+// heartbeat.
+func heartbeatInterval() time.Duration {
+	if !viper.IsSet("heartbeat_interval") {
+		return defaultHeartbeatInterval
+	}
+	return viper.GetDuration("heartbeat_interval")
+}
+
+// heartbeatLoop publishes a heartbeat on every tick until ctx is done or stop
+// is closed.
+func (s *Server) heartbeatLoop(ctx context.Context, stop <-chan struct{}) {
+	interval := heartbeatInterval()
+	if interval <= 0 || len(s.publishTopics) == 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	s.logger.Debug("Start heartbeat loop.", zap.Duration("interval", interval))
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stop:
+			s.logger.Debug("Stop heartbeat loop.")
+			return
+		case <-ticker.C:
+			s.notifyMsg(s.heartbeat())
+		}
+	}
+}
+
+func (s *Server) heartbeat() heartbeat {
+	hb := heartbeat{
+		EventType: broker.Heartbeat,
+		Version:   Version,
+		Uptime:    int64(time.Since(s.startedAt).Seconds()),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	if s.backupClient != nil {
+		hb.MachineID = s.backupClient.Id
+	}
+	if c, ok := s.b.(broker.ConnectionStatus); ok {
+		hb.BrokerConnected = c.IsConnected()
+	}
+
+	s.lastBackupMu.Lock()
+	defer s.lastBackupMu.Unlock()
+	if s.lastBackup != nil {
+		last := *s.lastBackup
+		hb.LastBackup = &last
+	}
+	return hb
+}
+
+// recordBackupResult keeps the result of a backup for the next heartbeats.
+func (s *Server) recordBackupResult(e notifier.Event) {
+	if e.Action != notifier.ActionBackup {
+		return
+	}
+	s.lastBackupMu.Lock()
+	defer s.lastBackupMu.Unlock()
+	s.lastBackup = &backupResult{
+		ActionID:        e.ActionID,
+		RecoveryPointID: e.RecoveryPointID,
+		Status:          e.Status,
+		Error:           e.Error,
+		FinishedAt:      time.Now().UTC(),
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/robfig/cron/v3"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// Statuses of the recovery points checked by an integrity scan.
+const (
+	statusVerifiedOK = "VERIFIED_OK"
+	statusDegraded   = "DEGRADED"
+)
+
+const (
+	defaultVerifySample      = 1
+	defaultVerifyRecent      = 7
+	defaultVerifyConcurrency = 4
+	// maxReportedChunks caps the chunk keys listed in a health report, the
+	// counts are always complete.
+	maxReportedChunks = 100
+)
+
+// verifyMappingID identifies the integrity scans of a policy in the cron
+// manager.
+func verifyMappingID(backupDirectoryID, policyID string) string {
+	return "verify|" + mappingID(backupDirectoryID, policyID)
+}
+
+// addVerifyToCron schedules the integrity scans of policy of directoryID.
+func (s *Server) addVerifyToCron(directoryID string, policy backupapi.BackupDirectoryConfigPolicy) {
+	vp := *policy.Verify
+	if vp.StorageVaultID == "" {
+		s.logger.Error("Integrity scan needs a storage vault, not scheduled",
+			zap.String("backup_directory_id", directoryID), zap.String("policy_id", policy.ID))
+		return
+	}
+	id := verifyMappingID(directoryID, policy.ID)
+	ctx, cancel := context.WithCancel(context.Background())
+	entryID, err := s.cronManager.AddFunc(s.schedulePattern(policy, vp.SchedulePattern), func() {
+		if err := s.integrityScan(ctx, directoryID, policy.ID, vp); err != nil {
+			s.logger.Error("failed to run integrity scan", zap.Error(err), zap.String("service", "cron"),
+				zap.String("backup_directory_id", directoryID), zap.String("policy_id", policy.ID))
+		}
+	})
+	if err != nil {
+		cancel()
+		s.logger.Error("failed to add cron entry", zap.Error(err))
+		return
+	}
+	s.mappingToVerifyEntryID[id] = entryID
+	s.mappingToCronCancel[id] = cancel
+}
+
+// removeVerifyFromCron removes the integrity scans of policyID of directoryID.
+func (s *Server) removeVerifyFromCron(directoryID, policyID string) {
+	id := verifyMappingID(directoryID, policyID)
+	if entryID, ok := s.mappingToVerifyEntryID[id]; ok {
+		s.cronManager.Remove(entryID)
+		delete(s.mappingToVerifyEntryID, id)
+	}
+	if cancel, ok := s.mappingToCronCancel[id]; ok {
+		cancel()
+		delete(s.mappingToCronCancel, id)
+	}
+}
+
+// resetVerifyCron forgets the integrity scans, the cron manager being
+// replaced.
+func (s *Server) resetVerifyCron() {
+	s.mappingToVerifyEntryID = make(map[string]cron.EntryID)
+}
+
+// sampleRecoveryPoints returns sample recovery points picked at random among
+// the recent latest completed ones of rps.
+func sampleRecoveryPoints(rps []backupapi.RecoveryPointResponse, recent, sample int) []backupapi.RecoveryPointResponse {
+	var completed []backupapi.RecoveryPointResponse
+	for _, rp := range rps {
+		if rp.Status == backupapi.RecoveryPointStatusCompleted {
+			completed = append(completed, rp)
+		}
+	}
+	sort.SliceStable(completed, func(i, j int) bool { return completed[i].CreatedAt > completed[j].CreatedAt })
+	if len(completed) > recent {
+		completed = completed[:recent]
+	}
+	rand.Shuffle(len(completed), func(i, j int) { completed[i], completed[j] = completed[j], completed[i] })
+	if len(completed) > sample {
+		completed = completed[:sample]
+	}
+	return completed
+}
+
+// integrityScan reads back the chunks of a sample of the recent recovery
+// points of directoryID, and publishes the health of each to the broker.
+func (s *Server) integrityScan(ctx context.Context, directoryID, policyID string, vp backupapi.VerifyPolicy) error {
+	sample, recent := vp.Sample, vp.Recent
+	if sample <= 0 {
+		sample = defaultVerifySample
+	}
+	if recent <= 0 {
+		recent = defaultVerifyRecent
+	}
+	rps, err := s.backupClient.ListRecoveryPoints(ctx, directoryID)
+	if err != nil {
+		return err
+	}
+	selected := sampleRecoveryPoints(rps.RecoveryPoints, recent, sample)
+	if len(selected) == 0 {
+		s.logger.Info("No completed recovery point to scan", zap.String("backup_directory_id", directoryID))
+		return nil
+	}
+
+	vault, err := s.backupClient.GetCredentialStorageVault(vp.StorageVaultID, "", nil)
+	if err != nil {
+		return err
+	}
+	storageVault, err := s.NewStorageVault(*vault, "", 0, 0)
+	if err != nil {
+		return err
+	}
+	defer s.logVaultRequests(storageVault)
+
+	for _, rp := range selected {
+		msg := map[string]string{
+			"backup_directory_id": directoryID,
+			"policy_id":           policyID,
+			"recovery_point_id":   rp.ID,
+		}
+		health, err := s.verifyRecoveryPoint(ctx, storageVault, rp)
+		if errors.Is(err, backupapi.ErrorGotCancelRequest) {
+			return err
+		}
+		switch {
+		case err != nil:
+			msg["status"] = statusFailed
+			msg["reason"] = err.Error()
+		case health.Healthy():
+			msg["status"] = statusVerifiedOK
+		default:
+			msg["status"] = statusDegraded
+		}
+		if health != nil {
+			msg["chunks"] = strconv.Itoa(health.Chunks)
+			msg["missing_chunks"] = strconv.Itoa(len(health.Missing))
+			msg["corrupt_chunks"] = strconv.Itoa(len(health.Corrupt))
+			if len(health.Missing) > 0 {
+				msg["missing"] = reportedChunks(health.Missing)
+			}
+			if len(health.Corrupt) > 0 {
+				msg["corrupt"] = reportedChunks(health.Corrupt)
+			}
+		}
+		s.logger.Info("Recovery point scanned", zap.Any("report", msg))
+		s.notifyMsg(msg)
+	}
+	return nil
+}
+
+// verifyRecoveryPoint reads back the chunks of rp from storageVault. A
+// recovery point whose index is gone is degraded, with no chunk checked.
+func (s *Server) verifyRecoveryPoint(ctx context.Context, storageVault storage_vault.StorageVault, rp backupapi.RecoveryPointResponse) (*backupapi.ChunkHealth, error) {
+	index, _, err := s.loadIndex(ctx, storageVault, "", s.backupClient.Id, rp.ID, rp.IndexHash)
+	if err != nil {
+		var aerr awserr.Error
+		if errors.As(err, &aerr) && (aerr.Code() == "NoSuchKey" || aerr.Code() == "NotFound") {
+			return &backupapi.ChunkHealth{Missing: []string{cache.Type(cache.INDEX).String()}}, nil
+		}
+		return nil, err
+	}
+	concurrency := defaultVerifyConcurrency
+	if viper.IsSet("verify_concurrency") {
+		concurrency = viper.GetInt("verify_concurrency")
+	}
+	return s.backupClient.VerifyChunks(ctx, cache.RebuildChunk(index), storageVault, concurrency)
+}
+
+// reportedChunks lists keys in a health report, at most maxReportedChunks.
+func reportedChunks(keys []string) string {
+	if len(keys) > maxReportedChunks {
+		keys = keys[:maxReportedChunks]
+	}
+	return strings.Join(keys, ",")
+}
@@ -0,0 +1,495 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/notifier"
+)
+
+const (
+	statusResumable = "RESUMABLE"
+
+	journalExt              = ".journal"
+	defaultJournalMaxAge    = 24 * time.Hour
+	journalAbandonReason    = "backup abandoned"
+	journalExpiredReason    = "backup journal expired"
+	journalSupersededReason = "superseded by a new backup"
+)
+
+// ErrorNoJournal is returned when a backup directory has no interrupted
+// backup to resume.
+var ErrorNoJournal = errors.New("no journal of interrupted backup")
+
+// journalMaxAge returns the configured backup_journal_max_age, 0 keeps
+// journals until they are resumed or abandoned.
+func journalMaxAge() time.Duration {
+	if !viper.IsSet("backup_journal_max_age") {
+		return defaultJournalMaxAge
+	}
+	return viper.GetDuration("backup_journal_max_age")
+}
+
+// journalHeader is the first line of a journal, what is needed to carry on
+// with the recovery point.
+type journalHeader struct {
+	Action            *backupapi.CreateRecoveryPointResponse `json:"action"`
+	BackupDirectoryID string                                 `json:"backup_directory_id"`
+	StartedAt         time.Time                              `json:"started_at"`
+}
+
+// journalEntry is a file whose chunks are all in the storage vault.
+type journalEntry struct {
+	Path       string             `json:"path"`
+	ModTime    time.Time          `json:"mod_time"`
+	Size       uint64             `json:"size"`
+	Content    []*cache.ChunkInfo `json:"content"`
+	Sha256Hash cache.Sha256Hash   `json:"sha256_hash"`
+	HashAlgo   string             `json:"hash_algo,omitempty"`
+}
+
+// journal records the files uploaded by a running backup, one JSON line each,
+// so that a backup interrupted by an agent stop goes on with the same recovery
+// point without uploading them again. A nil journal does nothing.
+type journal struct {
+	path      string
+	header    journalHeader
+	updatedAt time.Time
+
+	mu      sync.Mutex
+	file    *os.File
+	entries map[string]*cache.Node
+}
+
+// JournalInfo describes the interrupted backup of a journal.
+type JournalInfo struct {
+	BackupDirectoryID string    `json:"backup_directory_id"`
+	RecoveryPointID   string    `json:"recovery_point_id"`
+	ActionID          string    `json:"action_id"`
+	StartedAt         time.Time `json:"started_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+	Files             int       `json:"files"`
+}
+
+func journalPath(dir, bdID string) string {
+	return filepath.Join(dir, bdID+journalExt)
+}
+
+// createJournal starts the journal of a backup, replacing any previous one of
+// the directory.
+func createJournal(dir string, header journalHeader) (*journal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	path := journalPath(dir, header.BackupDirectoryID)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j := &journal{path: path, header: header, updatedAt: time.Now(), file: f, entries: make(map[string]*cache.Node)}
+	if err := j.append(header); err != nil {
+		_ = j.remove()
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		_ = j.remove()
+		return nil, err
+	}
+	return j, nil
+}
+
+// readJournal reads the journal at path. A last line cut short by the agent
+// stop is ignored.
+func readJournal(path string) (*journal, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	j := &journal{path: path, updatedAt: fi.ModTime(), entries: make(map[string]*cache.Node)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("empty journal %s", path)
+	}
+	if err := json.Unmarshal(scanner.Bytes(), &j.header); err != nil || j.header.Action == nil || j.header.Action.RecoveryPoint == nil {
+		return nil, fmt.Errorf("invalid journal header %s", path)
+	}
+	for scanner.Scan() {
+		var e journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		j.entries[e.Path] = &cache.Node{
+			Type:         "file",
+			AbsolutePath: e.Path,
+			ModTime:      e.ModTime,
+			Size:         e.Size,
+			Content:      e.Content,
+			Sha256Hash:   e.Sha256Hash,
+			HashAlgo:     e.HashAlgo,
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, bufio.ErrTooLong) {
+		return nil, err
+	}
+	return j, nil
+}
+
+// openJournal reads the journal at path and opens it to record more files.
+func openJournal(path string) (*journal, error) {
+	j, err := readJournal(path)
+	if err != nil {
+		return nil, err
+	}
+	// Write the journal again without a line cut short, the next entry
+	// would be lost behind it.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(tmp)
+	err = enc.Encode(j.header)
+	for _, node := range j.entries {
+		if err != nil {
+			break
+		}
+		err = enc.Encode(journalEntry{Path: node.AbsolutePath, ModTime: node.ModTime, Size: node.Size, Content: node.Content, Sha256Hash: node.Sha256Hash, HashAlgo: node.HashAlgo})
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if errClose := tmp.Close(); err == nil {
+		err = errClose
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	j.file = f
+	return j, nil
+}
+
+func (j *journal) append(v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = j.file.Write(append(buf, '\n'))
+	return err
+}
+
+// lookup returns the file at path recorded by the journal when it did not
+// change since.
+func (j *journal) lookup(path string, mtime time.Time, size uint64) *cache.Node {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	node, ok := j.entries[path]
+	if !ok || !node.ModTime.Equal(mtime) || node.Size != size {
+		return nil
+	}
+	return node
+}
+
+// record appends a file whose chunks are all stored.
+func (j *journal) record(node *cache.Node) error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	return j.append(journalEntry{
+		Path:       node.AbsolutePath,
+		ModTime:    node.ModTime,
+		Size:       node.Size,
+		Content:    node.Content,
+		Sha256Hash: node.Sha256Hash,
+		HashAlgo:   node.HashAlgo,
+	})
+}
+
+func (j *journal) info() JournalInfo {
+	return JournalInfo{
+		BackupDirectoryID: j.header.BackupDirectoryID,
+		RecoveryPointID:   j.header.Action.RecoveryPoint.ID,
+		ActionID:          j.header.Action.ID,
+		StartedAt:         j.header.StartedAt,
+		UpdatedAt:         j.updatedAt,
+		Files:             len(j.entries),
+	}
+}
+
+// remove closes and deletes the journal.
+func (j *journal) remove() error {
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file != nil {
+		_ = j.file.Close()
+		j.file = nil
+	}
+	if err := os.Remove(j.path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadJournals returns the journals under dir by backup directory. Journals
+// which can not be read are skipped.
+func loadJournals(dir string) (map[string]*journal, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+journalExt))
+	if err != nil {
+		return nil, err
+	}
+	journals := make(map[string]*journal, len(paths))
+	for _, path := range paths {
+		j, err := readJournal(path)
+		if err != nil {
+			continue
+		}
+		journals[strings.TrimSuffix(filepath.Base(path), journalExt)] = j
+	}
+	return journals, nil
+}
+
+// journalEnabled reports whether backups record a journal.
+func (s *Server) journalEnabled() bool {
+	return s.progressStateDir != "" && viper.GetBool("backup_journal")
+}
+
+// startJournal starts the journal of a new backup of bdID, or returns nil when
+// journals are disabled or can not be written.
+func (s *Server) startJournal(action *backupapi.CreateRecoveryPointResponse, bdID string) *journal {
+	if !s.journalEnabled() {
+		return nil
+	}
+	j, err := createJournal(s.progressStateDir, journalHeader{Action: action, BackupDirectoryID: bdID, StartedAt: time.Now()})
+	if err != nil {
+		s.logger.Warn("failed to create backup journal", zap.Error(err), zap.String("backup_directory_id", bdID))
+		return nil
+	}
+	return j
+}
+
+// abandonJournal reports the interrupted backup of bdID as failed with
+// reason and removes its journal.
+func (s *Server) abandonJournal(bdID, reason string) error {
+	if s.progressStateDir == "" {
+		return ErrorNoJournal
+	}
+	j, err := readJournal(journalPath(s.progressStateDir, bdID))
+	if os.IsNotExist(err) {
+		return ErrorNoJournal
+	}
+	if err != nil {
+		// An unreadable journal is of no use, there is nothing to report.
+		_ = os.Remove(journalPath(s.progressStateDir, bdID))
+		return err
+	}
+	s.logger.Warn("Interrupted backup abandoned",
+		zap.String("backup_directory_id", bdID),
+		zap.String("recovery_point_id", j.header.Action.RecoveryPoint.ID),
+		zap.String("reason", reason))
+	s.notifyMsg(map[string]string{
+		"action_id":         j.header.Action.ID,
+		"status":            statusFailed,
+		"reason":            reason,
+		"recovery_point_id": j.header.Action.RecoveryPoint.ID,
+	})
+	return j.remove()
+}
+
+// reportResumableBackups reports the backups the previous run of the agent
+// left a journal of as resumable, and abandons the ones older than
+// backup_journal_max_age. It returns the backup directories still resumable.
+func (s *Server) reportResumableBackups() map[string]bool {
+	if s.progressStateDir == "" {
+		return nil
+	}
+	journals, err := loadJournals(s.progressStateDir)
+	if err != nil {
+		s.logger.Warn("failed to load backup journals", zap.Error(err))
+		return nil
+	}
+	maxAge := journalMaxAge()
+	resumable := make(map[string]bool, len(journals))
+	for bdID, j := range journals {
+		if maxAge > 0 && time.Since(j.updatedAt) > maxAge {
+			if err := s.abandonJournal(bdID, journalExpiredReason); err != nil {
+				s.logger.Warn("failed to abandon backup journal", zap.Error(err))
+			}
+			continue
+		}
+		info := j.info()
+		s.logger.Warn("Backup interrupted by agent stop can be resumed",
+			zap.String("backup_directory_id", bdID),
+			zap.String("recovery_point_id", info.RecoveryPointID),
+			zap.Int("files", info.Files),
+			zap.Time("updated_at", info.UpdatedAt))
+		s.notifyMsg(map[string]string{
+			"action_id":         info.ActionID,
+			"status":            statusResumable,
+			"recovery_point_id": info.RecoveryPointID,
+			"files":             strconv.Itoa(info.Files),
+			"updated_at":        info.UpdatedAt.Format(time.RFC3339),
+		})
+		resumable[bdID] = true
+	}
+	return resumable
+}
+
+// resumeBackup goes on with the interrupted backup of bdID, in the same
+// recovery point. Files recorded by its journal are not uploaded again.
+func (s *Server) resumeBackup(bdID string, limitUpload, limitDownload int, progressOutput io.Writer) error {
+	if s.progressStateDir == "" {
+		return ErrorNoJournal
+	}
+	j, err := openJournal(journalPath(s.progressStateDir, bdID))
+	if os.IsNotExist(err) {
+		return ErrorNoJournal
+	}
+	if err != nil {
+		return err
+	}
+	action := j.header.Action
+	s.logger.Info("Resuming backup from journal",
+		zap.String("backup_directory_id", bdID),
+		zap.String("recovery_point_id", action.RecoveryPoint.ID),
+		zap.Int("files", len(j.entries)))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if timeout := viper.GetDuration("backup_timeout"); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
+	defer cancel()
+
+	s.setAction(action.ID, contextStruct{
+		ctx:               ctx,
+		cancel:            cancel,
+		action:            notifier.ActionBackup,
+		recoveryPointID:   action.RecoveryPoint.ID,
+		startedAt:         time.Now(),
+		backupDirectoryID: bdID,
+	})
+	s.notifyMsg(map[string]string{
+		"action_id": action.ID,
+		"status":    statusPendingFile,
+	})
+
+	chErr := make(chan error, 1)
+	if err := s.poolDir.Submit(s.backupWorker(ctx, action, bdID, limitUpload, limitDownload, progressOutput, chErr, j)); err != nil {
+		s.logger.Error("Submit backup worker error", zap.Error(err))
+		s.notifyStatusFailed(action.ID, err.Error())
+		_ = j.remove()
+		return err
+	}
+	err = <-chErr
+	if errRemove := j.remove(); errRemove != nil {
+		s.logger.Warn("failed to remove backup journal", zap.Error(errRemove))
+	}
+	return err
+}
+
+// ListJournals returns the interrupted backups which can be resumed.
+func (s *Server) ListJournals(w http.ResponseWriter, r *http.Request) {
+	infos := []JournalInfo{}
+	if s.progressStateDir != "" {
+		journals, err := loadJournals(s.progressStateDir)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+		for _, j := range journals {
+			infos = append(infos, j.info())
+		}
+	}
+	sort.Slice(infos, func(i, k int) bool { return infos[i].BackupDirectoryID < infos[k].BackupDirectoryID })
+	_ = json.NewEncoder(w).Encode(infos)
+}
+
+// ResumeBackup goes on with the interrupted backup of a backup directory.
+func (s *Server) ResumeBackup(w http.ResponseWriter, r *http.Request) {
+	backupID := chi.URLParam(r, "backupID")
+	if s.progressStateDir == "" {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(ErrorNoJournal.Error()))
+		return
+	}
+	if _, err := os.Stat(journalPath(s.progressStateDir, backupID)); err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(ErrorNoJournal.Error()))
+		return
+	}
+	limitUpload := viper.GetInt("limit_upload")
+	limitDownload := viper.GetInt("limit_download")
+	go func() {
+		err := runIsolated(func() error {
+			return s.resumeBackup(backupID, limitUpload, limitDownload, ioutil.Discard)
+		})
+		if err != nil {
+			s.logger.Error("failed to resume backup", zap.Error(err), zap.String("backup_directory_id", backupID))
+		}
+	}()
+	_, _ = w.Write([]byte("Resuming"))
+}
+
+// AbandonJournal gives up the interrupted backup of a backup directory, which
+// is reported as failed.
+func (s *Server) AbandonJournal(w http.ResponseWriter, r *http.Request) {
+	backupID := chi.URLParam(r, "backupID")
+	err := s.abandonJournal(backupID, journalAbandonReason)
+	if errors.Is(err, ErrorNoJournal) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_, _ = w.Write([]byte("Success"))
+}
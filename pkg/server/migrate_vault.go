@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// newMigrationVault returns storage vault storageVaultID for a migration.
+// Objects are copied as stored, so the vault is not wrapped by naming, and
+// not by the request budget either, which is meant for a single backup.
+func (s *Server) newMigrationVault(storageVaultID string) (storage_vault.StorageVault, error) {
+	vault, err := s.backupClient.GetCredentialStorageVault(storageVaultID, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	return s.newVault(*vault, "", 0, 0)
+}
+
+// newMigrateProgress logs the progress of the migration of src to dst.
+func (s *Server) newMigrateProgress(src, dst string) *progress.Progress {
+	p := progress.NewProgress(intervalPushProgress)
+	p.OnUpdate = func(stat progress.Stat, d time.Duration, ticker bool) {
+		if ticker {
+			s.logger.Info("Vault migration progress", zap.String("source", src), zap.String("destination", dst),
+				zap.Uint64("objects", stat.Items), zap.String("copied", formatBytes(stat.Bytes)), zap.String("duration", formatDuration(d)))
+		}
+	}
+	return p
+}
+
+// migrateVault copies the objects of storage vault src to storage vault dst.
+func (s *Server) migrateVault(ctx context.Context, src, dst string) (*backupapi.MigrateResult, error) {
+	srcVault, err := s.newMigrationVault(src)
+	if err != nil {
+		return nil, err
+	}
+	dstVault, err := s.newMigrationVault(dst)
+	if err != nil {
+		return nil, err
+	}
+
+	s.logger.Info("Vault migration started", zap.String("source", src), zap.String("destination", dst))
+	result, err := s.backupClient.MigrateVault(ctx, srcVault, dstVault, s.newMigrateProgress(src, dst))
+	if err != nil {
+		s.logger.Error("Vault migration failed", zap.Error(err), zap.String("source", src), zap.String("destination", dst), zap.Any("result", result))
+		return result, err
+	}
+	s.logger.Info("Vault migration complete", zap.String("source", src), zap.String("destination", dst), zap.Any("result", result))
+	return result, nil
+}
+
+// MigrateVault copies the objects of a storage vault to another one. The
+// migration stops with the request, running it again resumes it.
+func (s *Server) MigrateVault(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		SourceStorageVaultID      string `json:"source_storage_vault_id"`
+		DestinationStorageVaultID string `json:"destination_storage_vault_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.SourceStorageVaultID == "" || body.DestinationStorageVaultID == "" ||
+		body.SourceStorageVaultID == body.DestinationStorageVaultID {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`malformed body`))
+		return
+	}
+
+	result, err := s.migrateVault(r.Context(), body.SourceStorageVaultID, body.DestinationStorageVaultID)
+	if errors.Is(err, ErrorStorageVaultNotSupported) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
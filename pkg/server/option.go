@@ -5,6 +5,7 @@ import (
 
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 	"github.com/bizflycloud/bizfly-backup/pkg/broker"
+	"github.com/bizflycloud/bizfly-backup/pkg/notifier"
 )
 
 type Option func(s *Server) error
@@ -64,3 +65,29 @@ func WithNumGoroutine(num int) Option {
 		return nil
 	}
 }
+
+// WithNotifier returns an Option which set the notifier receiving backup and restore results.
+func WithNotifier(n notifier.Notifier) Option {
+	return func(s *Server) error {
+		s.notifier = n
+		return nil
+	}
+}
+
+// WithProgressStateDir returns an Option which set the directory where the
+// progress of running backups is persisted.
+func WithProgressStateDir(dir string) Option {
+	return func(s *Server) error {
+		s.progressStateDir = dir
+		return nil
+	}
+}
+
+// WithConfigDir returns an Option which set the directory of the config
+// fragments defining local backup directories.
+func WithConfigDir(dir string) Option {
+	return func(s *Server) error {
+		s.configDir = dir
+		return nil
+	}
+}
@@ -0,0 +1,60 @@
+package server
+
+import (
+	"context"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// mergeClasses adds the storage classes of receiver to chunks. A chunk
+// claimed by files of different classes gets the hottest one, and the
+// coldest class it was uploaded with is kept to know if it must be raised.
+func mergeClasses(chunks, receiver *cache.Chunk) {
+	for key, class := range receiver.Classes {
+		if claimed, ok := chunks.Classes[key]; ok {
+			class = storage_vault.HotterClass(claimed, class)
+		}
+		chunks.Classes[key] = class
+	}
+	for key, class := range receiver.Uploaded {
+		if uploaded, ok := chunks.Uploaded[key]; ok {
+			class = storage_vault.ColderClass(uploaded, class)
+		}
+		chunks.Uploaded[key] = class
+	}
+}
+
+// placeChunks moves the chunks claimed by the backup in a colder class than
+// the hottest file sharing them to that class. The class of a chunk uploaded
+// by the backup is known, the one of a chunk stored by an earlier backup is
+// inspected. Every claim is kept in chunks; a chunk which cannot be moved
+// records the class it is stored in, one whose class is unknown the claim.
+func (s *Server) placeChunks(ctx context.Context, storageVault storage_vault.StorageVault, chunks *cache.Chunk) {
+	placer, canPlace := storageVault.(storage_vault.ClassPlacer)
+	for key, class := range chunks.Classes {
+		uploaded, ok := chunks.Uploaded[key]
+		if !ok && canPlace {
+			info, err := storageVault.InspectObject(ctx, key)
+			if err != nil {
+				s.logger.Warn("Unknown storage class of chunk", zap.String("key", key), zap.Error(err))
+				continue
+			}
+			uploaded, ok = info.StorageClass, info.Exists
+		}
+		if !ok || storage_vault.HotterClass(uploaded, class) == uploaded {
+			continue
+		}
+		err := storage_vault.ErrNotSupported
+		if canPlace {
+			err = placer.SetObjectClass(ctx, key, class)
+		}
+		if err != nil {
+			s.logger.Warn("Keep chunk in the storage class it was uploaded with", zap.String("key", key),
+				zap.String("class", uploaded), zap.String("wanted", class), zap.Error(err))
+			chunks.Classes[key] = uploaded
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/broker"
+	"github.com/bizflycloud/bizfly-backup/pkg/notifier"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+const defaultProgressEventInterval = 5 * time.Second
+
+// progressEventInterval returns the configured progress_event_interval, 0
+// disables the progress events published to the broker.
+func progressEventInterval() time.Duration {
+	if !viper.IsSet("progress_event_interval") {
+		return defaultProgressEventInterval
+	}
+	return viper.GetDuration("progress_event_interval")
+}
+
+// brokerProgressEvent is the progress of a backup published to the broker.
+type brokerProgressEvent struct {
+	EventType string `json:"event_type"`
+	progressEvent
+	// Canceled is set on the last event of a backup which failed.
+	Canceled bool `json:"canceled,omitempty"`
+}
+
+// progressPublisher publishes the progress of a backup to the broker, at most
+// once per interval. A nil progressPublisher does nothing.
+type progressPublisher struct {
+	s        *Server
+	base     progressEvent
+	interval time.Duration
+	last     time.Time
+}
+
+// newProgressPublisher returns the publisher of the progress of the backup
+// actionID, or nil when progress events are disabled.
+func (s *Server) newProgressPublisher(actionID, bdID, rpID string, todo progress.Stat) *progressPublisher {
+	interval := progressEventInterval()
+	if interval <= 0 {
+		return nil
+	}
+	return &progressPublisher{
+		s: s,
+		base: progressEvent{
+			ActionID:          actionID,
+			Action:            notifier.ActionBackup,
+			BackupDirectoryID: bdID,
+			RecoveryPointID:   rpID,
+			Phase:             statusUploadFile,
+			TotalItems:        todo.Items,
+			TotalBytes:        todo.Bytes,
+		},
+		interval: interval,
+	}
+}
+
+// update publishes stat unless an event was published less than an interval
+// ago.
+func (pp *progressPublisher) update(stat progress.Stat) {
+	if pp == nil || time.Since(pp.last) < pp.interval {
+		return
+	}
+	pp.publish(stat, false, false)
+}
+
+// final publishes the last event of the backup, whatever the interval.
+func (pp *progressPublisher) final(stat progress.Stat, canceled bool) {
+	if pp == nil {
+		return
+	}
+	pp.publish(stat, true, canceled)
+}
+
+func (pp *progressPublisher) publish(stat progress.Stat, done, canceled bool) {
+	pp.last = time.Now()
+	e := brokerProgressEvent{
+		EventType:     broker.BackupProgress,
+		progressEvent: pp.base,
+		Canceled:      canceled,
+	}
+	e.Items, e.Bytes, e.Storage, e.Errors = stat.Items, stat.Bytes, stat.Storage, stat.Errors
+	e.ScannedBytes = stat.ScannedBytes()
+	e.NewBytes, e.ChangedBytes, e.UnchangedBytes, e.DedupedBytes = stat.NewBytes, stat.ChangedBytes, stat.UnchangedBytes, stat.DedupedBytes
+	e.Done = done
+	pp.s.notifyMsg(e)
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+const defaultProgressStateInterval = 10 * time.Second
+
+// progressStateInterval returns the configured progress_state_interval, 0
+// disables the persistence of backup progress.
+func progressStateInterval() time.Duration {
+	if !viper.IsSet("progress_state_interval") {
+		return defaultProgressStateInterval
+	}
+	return viper.GetDuration("progress_state_interval")
+}
+
+// backupState persists the progress of a running backup. A nil backupState
+// does nothing.
+type backupState struct {
+	file *progress.StateFile
+	base progress.Snapshot
+	// resumedFrom is the backup of the same directory interrupted by the
+	// previous run of the agent.
+	resumedFrom *progress.Snapshot
+}
+
+// newBackupState returns the state of the backup of bdID, or nil when the
+// persistence is disabled.
+func (s *Server) newBackupState(actionID, bdID, rpID string, todo progress.Stat) *backupState {
+	interval := progressStateInterval()
+	if s.progressStateDir == "" || interval <= 0 {
+		return nil
+	}
+	st := &backupState{
+		file: progress.NewStateFile(progress.StatePath(s.progressStateDir, bdID), interval),
+		base: progress.Snapshot{
+			ActionID:          actionID,
+			BackupDirectoryID: bdID,
+			RecoveryPointID:   rpID,
+			TodoItems:         todo.Items,
+			TodoBytes:         todo.Bytes,
+		},
+	}
+
+	s.interruptedMu.Lock()
+	st.resumedFrom = s.interrupted[bdID]
+	delete(s.interrupted, bdID)
+	s.interruptedMu.Unlock()
+	if st.resumedFrom != nil {
+		s.logger.Info("Resuming interrupted backup",
+			zap.String("backup_directory_id", bdID),
+			zap.String("recovery_point_id", rpID),
+			zap.String("resumed_from", st.resumedFrom.RecoveryPointID))
+	}
+	return st
+}
+
+func (st *backupState) save(stat progress.Stat, d time.Duration) error {
+	if st == nil {
+		return nil
+	}
+	snap := st.base
+	snap.Items = stat.Items
+	snap.Bytes = stat.Bytes
+	snap.Storage = stat.Storage
+	snap.Errors = stat.Errors
+	snap.Elapsed = int64(d / time.Second)
+	return st.file.Save(snap)
+}
+
+func (st *backupState) remove() error {
+	if st == nil {
+		return nil
+	}
+	return st.file.Remove()
+}
+
+func (st *backupState) resumedFromID() string {
+	if st == nil || st.resumedFrom == nil {
+		return ""
+	}
+	return st.resumedFrom.RecoveryPointID
+}
+
+// reportInterruptedBackups reports the backups the previous run of the agent
+// did not finish, with their last known progress, as failed, but for the ones
+// with a journal which are reported as resumable. The snapshots are kept in
+// memory so that the next backup of the directory reports where it resumes
+// from.
+func (s *Server) reportInterruptedBackups() {
+	if s.progressStateDir == "" {
+		return
+	}
+	resumable := s.reportResumableBackups()
+	states, err := progress.LoadStates(s.progressStateDir)
+	if err != nil {
+		s.logger.Warn("failed to load progress state", zap.Error(err))
+		return
+	}
+
+	s.interruptedMu.Lock()
+	defer s.interruptedMu.Unlock()
+	if s.interrupted == nil {
+		s.interrupted = make(map[string]*progress.Snapshot)
+	}
+	for bdID, snap := range states {
+		if resumable[bdID] {
+			s.interrupted[bdID] = snap
+			s.removeProgressState(bdID)
+			continue
+		}
+		s.logger.Warn("Backup interrupted by agent stop",
+			zap.String("backup_directory_id", bdID),
+			zap.String("recovery_point_id", snap.RecoveryPointID),
+			zap.Uint64("bytes", snap.Bytes),
+			zap.Time("updated_at", snap.UpdatedAt))
+		s.notifyMsg(map[string]string{
+			"action_id":         snap.ActionID,
+			"status":            statusFailed,
+			"reason":            "agent stopped during backup",
+			"recovery_point_id": snap.RecoveryPointID,
+			"total":             fmt.Sprintf("%s/%s", formatBytes(snap.Bytes), formatBytes(snap.TodoBytes)),
+			"push_storage":      formatBytes(snap.Storage),
+			"items":             fmt.Sprintf("%d/%d", snap.Items, snap.TodoItems),
+			"updated_at":        snap.UpdatedAt.Format(time.RFC3339),
+		})
+		s.interrupted[bdID] = snap
+		s.removeProgressState(bdID)
+	}
+}
+
+func (s *Server) removeProgressState(bdID string) {
+	if err := progress.NewStateFile(progress.StatePath(s.progressStateDir, bdID), 0).Remove(); err != nil {
+		s.logger.Warn("failed to remove progress state", zap.Error(err))
+	}
+}
@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// ErrorMissingChunks is returned when rebuilding a chunk list finds chunks
+// referenced by the index missing from the storage vault.
+var ErrorMissingChunks = errors.New("referenced chunks are missing from storage vault")
+
+// RebuildChunksResult is the outcome of rebuilding the chunk list of a
+// recovery point.
+type RebuildChunksResult struct {
+	RecoveryPointID string `json:"recovery_point_id"`
+	Chunks          int    `json:"chunks"`
+	References      int    `json:"references"`
+}
+
+// rebuildChunks rebuilds the chunk list of rpID from its index in the storage
+// vault and uploads it in place of the stored one. Every referenced chunk must
+// exist in the storage vault, otherwise nothing is uploaded.
+func (s *Server) rebuildChunks(ctx context.Context, storageVault storage_vault.StorageVault, mcID, rpID, indexHash string) (*RebuildChunksResult, error) {
+	index, _, err := s.loadIndex(ctx, storageVault, "", mcID, rpID, indexHash)
+	if err != nil {
+		return nil, err
+	}
+	chunks := cache.RebuildChunk(index)
+
+	result := &RebuildChunksResult{RecoveryPointID: rpID, Chunks: len(chunks.Chunks)}
+	for _, node := range index.Items {
+		result.References += len(node.Content)
+	}
+	var missing []string
+	for key := range chunks.Chunks {
+		exists, _, err := storageVault.HeadObject(ctx, key)
+		if !exists {
+			if aerr, ok := err.(awserr.Error); err != nil && (!ok || aerr.Code() != "NotFound") {
+				return nil, err
+			}
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		s.logger.Error("Chunks referenced by index are missing", zap.String("recovery_point_id", rpID), zap.Strings("keys", missing))
+		return nil, fmt.Errorf("%w: recovery point %s: %d of %d chunks, e.g. %s", ErrorMissingChunks, rpID, len(missing), len(chunks.Chunks), missing[0])
+	}
+
+	buf, err := json.Marshal(chunks)
+	if err != nil {
+		return nil, err
+	}
+	key := filepath.Join(mcID, rpID, cache.Type(cache.CHUNK).String())
+	if err := storageVault.PutObject(ctx, key, buf); err != nil {
+		return nil, err
+	}
+	s.logger.Info("Chunk list rebuilt", zap.String("key", key), zap.Int("chunks", result.Chunks), zap.Int("references", result.References))
+	return result, nil
+}
+
+// requestRebuildChunks rebuilds the chunk list of recovery point rpID of
+// machine mcID stored in storage vault storageVaultID.
+func (s *Server) requestRebuildChunks(ctx context.Context, mcID, rpID, storageVaultID string) (*RebuildChunksResult, error) {
+	vault, err := s.backupClient.GetCredentialStorageVault(storageVaultID, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	storageVault, err := s.NewStorageVault(*vault, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer s.logVaultRequests(storageVault)
+
+	rp, err := s.backupClient.GetRecoveryPointInfo(rpID)
+	if err != nil {
+		return nil, err
+	}
+	return s.rebuildChunks(ctx, storageVault, mcID, rpID, rp.IndexHash)
+}
+
+// RebuildChunks rebuilds the chunk list of a recovery point from its index.
+func (s *Server) RebuildChunks(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		MachineID      string `json:"machine_id"`
+		StorageVaultID string `json:"storage_vault_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.StorageVaultID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`malformed body`))
+		return
+	}
+	if body.MachineID == "" {
+		body.MachineID = s.backupClient.Id
+	}
+
+	recoveryPointID := chi.URLParam(r, "recoveryPointID")
+	result, err := s.requestRebuildChunks(r.Context(), body.MachineID, recoveryPointID, body.StorageVaultID)
+	if err != nil {
+		s.logger.Error("err ", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"io"
+	"strconv"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/notifier"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
+)
+
+// restoreMetadata reapplies the metadata of index to the items under destDir
+// whose content still matches the backup. Items which differ are reported in
+// the completion message, they need a full restore.
+func (s *Server) restoreMetadata(ctx context.Context, actionID, recoveryPointID, destDir string, index cache.Index, startedAt time.Time, p *progress.Progress, progressOutput io.Writer) error {
+	s.logger.Info("Repair metadata", zap.String("dest_directory", destDir))
+	repaired, mismatches, err := s.backupClient.RepairMetadata(ctx, index, destDir, p)
+	if err != nil {
+		s.logger.Error("failed to repair metadata", zap.Error(err))
+		s.notifyStatusFailed(actionID, err.Error())
+		p.Done()
+		return err
+	}
+	if len(mismatches) > 0 {
+		paths := make([]string, 0, len(mismatches))
+		for _, m := range mismatches {
+			paths = append(paths, m.Path)
+		}
+		s.logger.Warn("Content differs from backup, metadata not repaired", zap.Int("items", len(mismatches)), zap.Strings("paths", paths))
+	}
+
+	select {
+	case <-ctx.Done():
+		return backupapi.ErrorGotCancelRequest
+	default:
+	}
+	s.reportRestoreCompleted(progressOutput)
+	p.Done()
+	msg := map[string]string{
+		"action_id":         actionID,
+		"status":            statusComplete,
+		"recovery_point_id": recoveryPointID,
+		"dest_directory":    destDir,
+		"metadata_only":     "true",
+		"repaired_items":    strconv.Itoa(repaired),
+	}
+	if len(mismatches) > 0 {
+		msg["mismatched_items"] = strconv.Itoa(len(mismatches))
+	}
+	s.notifyMsg(msg)
+	s.notifyResult(notifier.Event{
+		Action:          notifier.ActionRestore,
+		ActionID:        actionID,
+		RecoveryPointID: recoveryPointID,
+		Status:          statusComplete,
+		Duration:        time.Since(startedAt),
+		TotalFiles:      int64(repaired),
+	})
+	return nil
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"github.com/go-chi/chi"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/keys"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// RewrapKeysResult is the outcome of rewrapping the content keys of the
+// recovery points of a backup directory.
+type RewrapKeysResult struct {
+	BackupDirectoryID string   `json:"backup_directory_id"`
+	RecoveryPoints    int      `json:"recovery_points"`
+	Rewrapped         []string `json:"rewrapped"`
+}
+
+// rewrapContentKeys wraps the content key stored with each recovery point of
+// backup directory bdID to recipients. Recovery points stored without wrapped
+// keys are left as they are. It stops at the first recovery point failing, a
+// new run rewraps again those done, which the identities of the agent must
+// then unwrap as well.
+func (s *Server) rewrapContentKeys(ctx context.Context, storageVault storage_vault.StorageVault, mcID, bdID string, recipients []keys.Recipient) (*RewrapKeysResult, error) {
+	rps, err := s.backupClient.ListRecoveryPoints(ctx, bdID)
+	if err != nil {
+		return nil, err
+	}
+	result := &RewrapKeysResult{BackupDirectoryID: bdID, RecoveryPoints: len(rps.RecoveryPoints), Rewrapped: []string{}}
+	for _, rp := range rps.RecoveryPoints {
+		rewrapped, err := s.backupClient.RewrapContentKeys(ctx, storageVault, mcID, rp.ID, recipients)
+		if err != nil {
+			s.logger.Error("Failed to rewrap content keys", zap.Error(err), zap.String("recovery_point_id", rp.ID),
+				zap.Strings("rewrapped", result.Rewrapped))
+			return nil, err
+		}
+		if rewrapped {
+			result.Rewrapped = append(result.Rewrapped, rp.ID)
+		}
+	}
+	s.logger.Info("Content keys rewrapped", zap.String("backup_directory_id", bdID),
+		zap.Int("recovery_points", result.RecoveryPoints), zap.Int("rewrapped", len(result.Rewrapped)))
+	return result, nil
+}
+
+// requestRewrapContentKeys rewraps to recipients the content keys of the
+// recovery points of backup directory bdID of machine mcID stored in storage
+// vault storageVaultID.
+func (s *Server) requestRewrapContentKeys(ctx context.Context, mcID, bdID, storageVaultID string, recipients []string) (*RewrapKeysResult, error) {
+	parsed, err := backupapi.ParseRecipients(recipients)
+	if err != nil {
+		return nil, err
+	}
+	vault, err := s.backupClient.GetCredentialStorageVault(storageVaultID, "", nil)
+	if err != nil {
+		return nil, err
+	}
+	storageVault, err := s.NewStorageVault(*vault, "", 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer s.logVaultRequests(storageVault)
+
+	return s.rewrapContentKeys(ctx, storageVault, mcID, bdID, parsed)
+}
+
+// RewrapContentKeys wraps the content keys of the recovery points of a backup
+// directory to new recipients.
+func (s *Server) RewrapContentKeys(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		MachineID      string   `json:"machine_id"`
+		StorageVaultID string   `json:"storage_vault_id"`
+		Recipients     []string `json:"recipients"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.StorageVaultID == "" || len(body.Recipients) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`malformed body`))
+		return
+	}
+	if body.MachineID == "" {
+		body.MachineID = s.backupClient.Id
+	}
+
+	backupID := chi.URLParam(r, "backupID")
+	result, err := s.requestRewrapContentKeys(r.Context(), body.MachineID, backupID, body.StorageVaultID, body.Recipients)
+	if err != nil {
+		s.logger.Error("err ", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(result)
+}
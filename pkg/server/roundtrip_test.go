@@ -0,0 +1,785 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
+	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/local"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+	"github.com/bizflycloud/bizfly-backup/pkg/support"
+)
+
+// roundTripBackend is the part of the backup API used by a backup and a
+// restore, recovery points being kept in memory. Index hashes are those of
+// the indexes stored in vault.
+type roundTripBackend struct {
+	t     *testing.T
+	mcID  string
+	bdID  string
+	path  string
+	vault storage_vault.StorageVault
+	// vaultType and bucket describe the storage vault returned to the agent,
+	// an S3 one by default.
+	vaultType string
+	bucket    string
+
+	mu     sync.Mutex
+	n      int
+	latest string
+}
+
+func (b *roundTripBackend) storageVault() *backupapi.StorageVault {
+	vaultType := b.vaultType
+	if vaultType == "" {
+		vaultType = "S3"
+	}
+	return &backupapi.StorageVault{ID: "vault", StorageVaultType: vaultType, StorageBucket: b.bucket}
+}
+
+func (b *roundTripBackend) indexHash(rpID string) string {
+	for _, name := range []string{"index.json", "index_delta.json"} {
+		if buf, err := b.vault.GetObject(context.Background(), b.mcID+"/"+rpID+"/"+name); err == nil {
+			return hashIndex(buf)
+		}
+	}
+	return ""
+}
+
+func (b *roundTripBackend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/api/v1/agent")
+	bdPath := "/backup-directories/" + b.bdID
+	var resp interface{}
+	switch {
+	case r.Method == http.MethodPost && path == bdPath+"/recovery-points":
+		b.n++
+		resp = backupapi.CreateRecoveryPointResponse{
+			ID:            fmt.Sprintf("action%d", b.n),
+			RecoveryPoint: &backupapi.RecoveryPoint{ID: fmt.Sprintf("rp%d", b.n)},
+			StorageVault:  b.storageVault(),
+		}
+	case r.Method == http.MethodGet && path == bdPath+"/recovery-points":
+		list := backupapi.ListRecoveryPointsResponse{}
+		for i := 1; i <= b.n; i++ {
+			id := fmt.Sprintf("rp%d", i)
+			list.RecoveryPoints = append(list.RecoveryPoints, backupapi.RecoveryPointResponse{ID: id, Status: backupapi.RecoveryPointStatusCompleted,
+				CreatedAt: fmt.Sprintf("2021-01-%02dT00:00:00Z", i), IndexHash: b.indexHash(id)})
+		}
+		resp = list
+	case path == bdPath+"/latest-recovery-points":
+		resp = backupapi.RecoveryPointResponse{ID: b.latest, IndexHash: b.indexHash(b.latest)}
+	case path == bdPath:
+		resp = backupapi.BackupDirectory{ID: b.bdID, Path: b.path}
+	case path == "/config":
+		resp = backupapi.Config{BackupDirectories: []backupapi.BackupDirectoryConfig{
+			{ID: b.bdID, Path: b.path, Activated: true, Policies: []backupapi.BackupDirectoryConfigPolicy{{ID: "policy"}}},
+		}}
+	case r.Method == http.MethodPost && strings.HasPrefix(path, "/recovery-points/") && strings.HasSuffix(path, "/action"):
+		b.n++
+		resp = backupapi.RestoreResponse{ActionID: fmt.Sprintf("action%d", b.n), CreatedAt: "2021-01-01T00:00:00Z"}
+	case strings.HasPrefix(path, "/recovery-points/"):
+		id := strings.TrimPrefix(path, "/recovery-points/")
+		resp = backupapi.RecoveryPointResponse{ID: id, IndexHash: b.indexHash(id)}
+	case strings.HasPrefix(path, "/storage_vaults/"):
+		resp = *b.storageVault()
+	default:
+		b.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// writeTree generates a directory tree under root with files of various
+// sizes, some spanning several chunks, nested directories and symlinks. Modes
+// and times are set explicitly so that their restore can be checked.
+func writeTree(t *testing.T, root string) {
+	rnd := rand.New(rand.NewSource(1))
+	data := func(n int) []byte {
+		buf := make([]byte, n)
+		_, _ = rnd.Read(buf)
+		return buf
+	}
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	files := map[string][]byte{
+		"empty":                   {},
+		"small.txt":               []byte("hello world\n"),
+		"large.bin":               data(3 << 20),
+		"docs/readme.md":          []byte("# readme\n"),
+		"docs/nested/deep/a.bin":  data(64 << 10),
+		"docs/nested/deep/b.bin":  data(64 << 10),
+		"docs/nested/duplicate":   []byte("hello world\n"),
+		"with space/file (1).txt": []byte("spaces\n"),
+	}
+	for rel, content := range files {
+		path := filepath.Join(root, rel)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755))
+		require.NoError(t, os.WriteFile(path, content, 0644))
+	}
+	require.NoError(t, os.Chmod(filepath.Join(root, "small.txt"), 0600))
+	require.NoError(t, os.Chmod(filepath.Join(root, "docs/readme.md"), 0755))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "empty dir"), 0700))
+	require.NoError(t, os.Symlink("small.txt", filepath.Join(root, "link")))
+	require.NoError(t, os.Symlink("../large.bin", filepath.Join(root, "docs/link-up")))
+	require.NoError(t, os.Symlink("missing", filepath.Join(root, "dangling")))
+
+	// Children first, so that setting their times does not touch the
+	// times of their directory.
+	var paths []string
+	require.NoError(t, filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		paths = append(paths, path)
+		return err
+	}))
+	for i := len(paths) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(paths[i])
+		require.NoError(t, err)
+		if fi.Mode()&os.ModeSymlink == 0 {
+			mtime = mtime.Add(time.Minute)
+			require.NoError(t, os.Chtimes(paths[i], mtime, mtime))
+		}
+	}
+}
+
+// assertSameTree asserts that every item under want is under got with the
+// same content, type, mode, owner and times, and that got holds nothing more.
+func assertSameTree(t *testing.T, want, got string) {
+	seen := make(map[string]bool)
+	require.NoError(t, filepath.Walk(want, func(path string, fi os.FileInfo, err error) error {
+		require.NoError(t, err)
+		rel, err := filepath.Rel(want, path)
+		require.NoError(t, err)
+		seen[rel] = true
+		wantNode, err := cache.NodeFromFileInfo(want, path, fi)
+		require.NoError(t, err)
+		gotFi, err := os.Lstat(filepath.Join(got, rel))
+		if !assert.NoError(t, err, rel) {
+			return nil
+		}
+		gotNode, err := cache.NodeFromFileInfo(got, filepath.Join(got, rel), gotFi)
+		require.NoError(t, err)
+
+		assert.Equal(t, wantNode.Type, gotNode.Type, rel)
+		assert.Equal(t, wantNode.LinkTarget, gotNode.LinkTarget, rel)
+		if wantNode.Type == "symlink" {
+			return nil
+		}
+		assert.Equal(t, wantNode.Mode, gotNode.Mode, rel)
+		assert.Equal(t, wantNode.UID, gotNode.UID, rel)
+		assert.Equal(t, wantNode.GID, gotNode.GID, rel)
+		assert.True(t, wantNode.ModTime.Equal(gotNode.ModTime), "%s: mtime %s, want %s", rel, gotNode.ModTime, wantNode.ModTime)
+		if wantNode.Type == "file" {
+			wantData, err := os.ReadFile(path)
+			require.NoError(t, err)
+			gotData, err := os.ReadFile(filepath.Join(got, rel))
+			require.NoError(t, err)
+			assert.True(t, string(wantData) == string(gotData), "%s: content differs", rel)
+		}
+		return nil
+	}))
+	require.NoError(t, filepath.Walk(got, func(path string, fi os.FileInfo, err error) error {
+		require.NoError(t, err)
+		rel, err := filepath.Rel(got, path)
+		require.NoError(t, err)
+		assert.True(t, seen[rel], "%s: not in backup", rel)
+		return nil
+	}))
+}
+
+// treeSize returns the number of files below root and the size of the
+// regular ones.
+func treeSize(t *testing.T, root string) (int64, uint64) {
+	var files int64
+	var size uint64
+	require.NoError(t, filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		files++
+		if fi.Mode().IsRegular() {
+			size += uint64(fi.Size())
+		}
+		return nil
+	}))
+	return files, size
+}
+
+// TestServerBackupRestoreRoundTrip backs up a generated tree through the
+// chunking path into an in-memory storage vault, changes it and backs it up
+// again, then restores each recovery point to a fresh destination, which must
+// match the tree it was taken from.
+func TestServerBackupRestoreRoundTrip(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes differ on windows")
+	}
+	for _, delta := range []bool{false, true} {
+		t.Run(fmt.Sprintf("index_delta=%t", delta), func(t *testing.T) {
+			viper.Set("index_delta", delta)
+			defer viper.Set("index_delta", nil)
+			viper.Set("index_dir_sizes", true)
+			defer viper.Set("index_dir_sizes", nil)
+
+			src := filepath.Join(t.TempDir(), "src")
+			writeTree(t, src)
+
+			vault := memory.New("vault", "")
+			mcID := fmt.Sprintf("roundtrip-%d", time.Now().UnixNano())
+			backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+			srv := httptest.NewServer(backend)
+			defer srv.Close()
+
+			rb := &recordBroker{}
+			s, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+			require.NoError(t, err)
+			s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+			require.NoError(t, err)
+			s.testStorageVault = vault
+			_, cachePath, err := support.CheckPath()
+			require.NoError(t, err)
+			defer os.RemoveAll(filepath.Join(cachePath, mcID))
+			defer os.RemoveAll("cache")
+
+			backup := func() string {
+				require.NoError(t, s.backup("bd", "policy", "roundtrip", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+				backend.mu.Lock()
+				defer backend.mu.Unlock()
+				backend.latest = fmt.Sprintf("rp%d", backend.n)
+				return backend.latest
+			}
+			restore := func(rpID string) string {
+				dest := t.TempDir()
+				require.NoError(t, s.restore(mcID, "restore-"+rpID, "", "", rpID, dest, "", false, false, "", "vault", 0, io.Discard))
+				return filepath.Join(dest, "src")
+			}
+
+			rp1 := backup()
+			restored1 := restore(rp1)
+			assertSameTree(t, src, restored1)
+
+			// Change the tree, the second recovery point reuses the chunks
+			// of the first for the files left as they were.
+			keys := len(vault.Keys())
+			mtime := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+			require.NoError(t, os.WriteFile(filepath.Join(src, "docs/nested/deep/a.bin"), []byte("changed"), 0644))
+			require.NoError(t, os.Chtimes(filepath.Join(src, "docs/nested/deep/a.bin"), mtime, mtime))
+			require.NoError(t, os.Remove(filepath.Join(src, "docs/nested/duplicate")))
+			require.NoError(t, os.WriteFile(filepath.Join(src, "new.txt"), []byte("new file\n"), 0640))
+			require.NoError(t, os.Chtimes(filepath.Join(src, "new.txt"), mtime, mtime))
+			for _, dir := range []string{"docs/nested/deep", "docs/nested", src} {
+				if !filepath.IsAbs(dir) {
+					dir = filepath.Join(src, dir)
+				}
+				require.NoError(t, os.Chtimes(dir, mtime, mtime))
+			}
+			rp2 := backup()
+			// Two new chunks and the metadata of the recovery point.
+			assert.Less(t, len(vault.Keys())-keys, 10)
+			assertSameTree(t, src, restore(rp2))
+
+			// The root records the size of the tree backed up.
+			index, _, err := s.loadIndex(context.Background(), vault, "", mcID, rp2, backend.indexHash(rp2))
+			require.NoError(t, err)
+			files, size := treeSize(t, src)
+			assert.Equal(t, files, index.Items[src].DirFiles)
+			assert.Equal(t, size, index.Items[src].DirSize)
+
+			// The first recovery point still restores as it was taken.
+			assertSameTree(t, restored1, restore(rp1))
+
+			completed := 0
+			rb.mu.Lock()
+			for _, msg := range rb.payloads {
+				if msg["status"] == statusComplete && strings.HasPrefix(msg["action_id"], "action") {
+					completed++
+				}
+			}
+			rb.mu.Unlock()
+			assert.Equal(t, 2, completed)
+		})
+	}
+}
+
+// TestServerBackupRestoreLocalVault backs up and restores a generated tree
+// through a local storage vault made by the agent, as an air-gapped machine
+// would.
+func TestServerBackupRestoreLocalVault(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes differ on windows")
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src)
+
+	root := filepath.Join(t.TempDir(), "vault")
+	vault, err := local.New("vault", "", root)
+	require.NoError(t, err)
+	mcID := fmt.Sprintf("local-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault,
+		vaultType: local.StorageVaultType, bucket: root}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	s, err := New(WithBroker(&recordBroker{}), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+
+	require.NoError(t, s.backup("bd", "policy", "local", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+	exists, _, err := vault.HeadObject(context.Background(), mcID+"/rp1/index.json")
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	dest := t.TempDir()
+	require.NoError(t, s.restore(mcID, "restore-rp1", "", "", "rp1", dest, "", false, false, "", "vault", 0, io.Discard))
+	assertSameTree(t, src, filepath.Join(dest, "src"))
+}
+
+// TestServerBackupRestoreEncrypted backs up a generated tree with chunk
+// encryption, no chunk stored may hold file content in the clear, and
+// restores it.
+func TestServerBackupRestoreEncrypted(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes differ on windows")
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src)
+	require.NoError(t, os.WriteFile(filepath.Join(src, "secret.txt"), []byte("top secret content"), 0600))
+
+	vault := memory.New("vault", "")
+	mcID := fmt.Sprintf("encrypted-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	// The key of chunk encryption is wrapped to an operator.
+	operator, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	viper.Set("chunk_encryption_passphrase", "passphrase")
+	viper.Set("chunk_encryption_recipients", []string{operator.Recipient().String()})
+	encryptor, err := backupapi.EncryptorFromConfig()
+	require.NoError(t, err)
+	contentKeys, err := backupapi.ContentKeysFromConfig()
+	viper.Set("chunk_encryption_passphrase", nil)
+	viper.Set("chunk_encryption_recipients", nil)
+	require.NoError(t, err)
+	s, err := New(WithBroker(&recordBroker{}), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID),
+		backupapi.WithEncryptor(encryptor), backupapi.WithContentKeys(contentKeys))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+
+	require.NoError(t, s.backup("bd", "policy", "encrypted", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+	for _, key := range vault.Keys() {
+		if strings.Contains(key, "/") {
+			continue
+		}
+		data, err := vault.GetObject(context.Background(), key)
+		require.NoError(t, err)
+		assert.NotContains(t, string(data), "top secret content", key)
+	}
+
+	dest := t.TempDir()
+	require.NoError(t, s.restore(mcID, "restore-rp1", "", "", "rp1", dest, "", false, false, "", "vault", 0, io.Discard))
+	assertSameTree(t, src, filepath.Join(dest, "src"))
+
+	// The operator restores without the passphrase.
+	assert.Contains(t, vault.Keys(), mcID+"/rp1/"+backupapi.ContentKeysName)
+	viper.Set("chunk_encryption_identities", []string{operator.String()})
+	contentKeys, err = backupapi.ContentKeysFromConfig()
+	viper.Set("chunk_encryption_identities", nil)
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID),
+		backupapi.WithContentKeys(contentKeys))
+	require.NoError(t, err)
+	dest = t.TempDir()
+	require.NoError(t, s.restore(mcID, "restore-rp1-operator", "", "", "rp1", dest, "", false, false, "", "vault", 0, io.Discard))
+	assertSameTree(t, src, filepath.Join(dest, "src"))
+
+	// The operator rewraps the key to a successor, who restores in their place.
+	successor, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipients, err := backupapi.ParseRecipients([]string{successor.Recipient().String()})
+	require.NoError(t, err)
+	result, err := s.rewrapContentKeys(context.Background(), vault, mcID, "bd", recipients)
+	require.NoError(t, err)
+	assert.Equal(t, &RewrapKeysResult{BackupDirectoryID: "bd", RecoveryPoints: 1, Rewrapped: []string{"rp1"}}, result)
+	assert.Error(t, s.restore(mcID, "restore-rp1-former", "", "", "rp1", t.TempDir(), "", false, false, "", "vault", 0, io.Discard))
+
+	viper.Set("chunk_encryption_identities", []string{successor.String()})
+	contentKeys, err = backupapi.ContentKeysFromConfig()
+	viper.Set("chunk_encryption_identities", nil)
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID),
+		backupapi.WithContentKeys(contentKeys))
+	require.NoError(t, err)
+	dest = t.TempDir()
+	require.NoError(t, s.restore(mcID, "restore-rp1-successor", "", "", "rp1", dest, "", false, false, "", "vault", 0, io.Discard))
+	assertSameTree(t, src, filepath.Join(dest, "src"))
+}
+
+// TestServerBackupRestoreCompressed backs up a generated tree with each
+// codec, the chunks of compressible files are stored smaller, and restores it.
+func TestServerBackupRestoreCompressed(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes differ on windows")
+	}
+	for _, codec := range []string{backupapi.CompressionZstd, backupapi.CompressionGzip} {
+		t.Run(codec, func(t *testing.T) {
+			viper.Set("compression", codec)
+			defer viper.Set("compression", nil)
+
+			src := filepath.Join(t.TempDir(), "src")
+			writeTree(t, src)
+			log := bytes.Repeat([]byte("2022-01-02 03:04:05 INFO backup started\n"), 10000)
+			require.NoError(t, os.WriteFile(filepath.Join(src, "app.log"), log, 0600))
+
+			vault := memory.New("vault", "")
+			mcID := fmt.Sprintf("compressed-%d", time.Now().UnixNano())
+			backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+			srv := httptest.NewServer(backend)
+			defer srv.Close()
+
+			s, err := New(WithBroker(&recordBroker{}), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+			require.NoError(t, err)
+			s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+			require.NoError(t, err)
+			s.testStorageVault = vault
+			_, cachePath, err := support.CheckPath()
+			require.NoError(t, err)
+			defer os.RemoveAll(filepath.Join(cachePath, mcID))
+			defer os.RemoveAll("cache")
+
+			require.NoError(t, s.backup("bd", "policy", "compressed", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+			index, _, err := s.loadIndex(context.Background(), vault, "", mcID, "rp1", backend.indexHash("rp1"))
+			require.NoError(t, err)
+			item := index.Items[filepath.Join(src, "app.log")]
+			require.NotNil(t, item)
+			for _, chunk := range item.Content {
+				assert.Equal(t, codec, chunk.Codec)
+				data, err := vault.GetObject(context.Background(), chunk.Etag)
+				require.NoError(t, err)
+				assert.Less(t, len(data), int(chunk.Length))
+			}
+
+			dest := t.TempDir()
+			require.NoError(t, s.restore(mcID, "restore-rp1", "", "", "rp1", dest, "", false, false, "", "vault", 0, io.Discard))
+			assertSameTree(t, src, filepath.Join(dest, "src"))
+		})
+	}
+}
+
+// corruptVault returns the chunks of the wrapped vault with their first byte
+// changed once corrupt is set.
+type corruptVault struct {
+	*memory.Memory
+	corrupt bool
+}
+
+func (v *corruptVault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	data, err := v.Memory.GetObject(ctx, key)
+	if err != nil || !v.corrupt || strings.Contains(key, "/") || len(data) == 0 {
+		return data, err
+	}
+	changed := append([]byte{data[0] ^ 0xff}, data[1:]...)
+	return changed, nil
+}
+
+func TestServerBackupVerify(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes differ on windows")
+	}
+	viper.Set("backup_verify_rate", 1)
+	defer viper.Set("backup_verify_rate", nil)
+
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src)
+
+	vault := &corruptVault{Memory: memory.New("vault", "")}
+	mcID := fmt.Sprintf("verify-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault.Memory}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+
+	statuses := func(actionID string) map[string]map[string]string {
+		rb.mu.Lock()
+		defer rb.mu.Unlock()
+		byStatus := make(map[string]map[string]string)
+		for _, msg := range rb.payloads {
+			if msg["action_id"] == actionID {
+				byStatus[msg["status"]] = msg
+			}
+		}
+		return byStatus
+	}
+
+	require.NoError(t, s.backup("bd", "policy", "verify", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+	completed := statuses("action1")[statusComplete]
+	require.NotNil(t, completed)
+	files := 0
+	require.NoError(t, filepath.Walk(src, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			files++
+		}
+		return err
+	}))
+	assert.Equal(t, strconv.Itoa(files), completed["verified_files"])
+
+	// Chunks which do not read back fail the backup before its index is put.
+	vault.corrupt = true
+	assert.ErrorIs(t, s.backup("bd", "policy", "verify", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard), backupapi.ErrorBackupMismatch)
+	byStatus := statuses("action2")
+	assert.NotContains(t, byStatus, statusComplete)
+	assert.Contains(t, byStatus[statusFailed]["reason"], "uploaded data does not match")
+	assert.Empty(t, backend.indexHash("rp2"))
+}
+
+// TestServerBackupDryRun runs a backup with dry_run, which reports the bytes
+// it would upload without storing anything nor being taken as the latest
+// recovery point.
+func TestServerBackupDryRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes differ on windows")
+	}
+	viper.Set("dedup_files", true)
+	defer viper.Set("dedup_files", nil)
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src)
+	_, size := treeSize(t, src)
+
+	vault := memory.New("vault", "")
+	mcID := fmt.Sprintf("dryrun-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+
+	dryRun := func(actionID string) map[string]string {
+		viper.Set("dry_run", true)
+		defer viper.Set("dry_run", nil)
+		require.NoError(t, s.backup("bd", "policy", "dry run", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+		rb.mu.Lock()
+		defer rb.mu.Unlock()
+		for _, msg := range rb.payloads {
+			if msg["action_id"] == actionID && msg["status"] == statusComplete {
+				t.Errorf("dry run %s reported completed", actionID)
+			}
+			if msg["action_id"] == actionID && msg["dry_run"] == "true" {
+				return msg
+			}
+		}
+		t.Fatalf("no dry run result for %s", actionID)
+		return nil
+	}
+
+	msg := dryRun("action1")
+	assert.Equal(t, statusFailed, msg["status"])
+	// docs/nested/duplicate is not uploaded again when read after small.txt,
+	// files being read concurrently.
+	assert.Contains(t, []string{strconv.FormatUint(size, 10), strconv.FormatUint(size-12, 10)}, msg["new_bytes"])
+	assert.Equal(t, strconv.FormatUint(size, 10), msg["changed_bytes"])
+	assert.Equal(t, "0", msg["unchanged_bytes"])
+	assert.Empty(t, vault.Keys())
+	assert.NoDirExists(t, filepath.Join(cachePath, mcID, "rp1"))
+
+	require.NoError(t, s.backup("bd", "policy", "real", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+	backend.mu.Lock()
+	backend.latest = "rp2"
+	backend.mu.Unlock()
+	keys := len(vault.Keys())
+
+	// The backup reports the bytes it scanned and which of them it uploaded.
+	var completed map[string]string
+	rb.mu.Lock()
+	for _, msg := range rb.payloads {
+		if msg["action_id"] == "action2" && msg["status"] == statusComplete {
+			completed = msg
+		}
+	}
+	rb.mu.Unlock()
+	require.NotNil(t, completed)
+	assert.Equal(t, strconv.FormatUint(size, 10), completed["scanned_bytes"])
+	assert.Equal(t, "0", completed["unchanged_bytes"])
+	newBytes, err := strconv.ParseUint(completed["new_bytes"], 10, 64)
+	require.NoError(t, err)
+	deduped, err := strconv.ParseUint(completed["deduped_bytes"], 10, 64)
+	require.NoError(t, err)
+	assert.Equal(t, size, newBytes+deduped)
+
+	// Only the file added since is new.
+	added := []byte("new file\n")
+	require.NoError(t, os.WriteFile(filepath.Join(src, "new.txt"), added, 0640))
+	msg = dryRun("action3")
+	assert.Equal(t, strconv.Itoa(len(added)), msg["new_bytes"])
+	assert.Equal(t, strconv.Itoa(len(added)), msg["changed_bytes"])
+	assert.Equal(t, strconv.FormatUint(size, 10), msg["unchanged_bytes"])
+	assert.Len(t, vault.Keys(), keys)
+	assert.NotEmpty(t, backend.indexHash("rp2"))
+	assert.Empty(t, backend.indexHash("rp3"))
+}
+
+func TestServerBackupStorageClassRules(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes differ on windows")
+	}
+	viper.Set("storage_class_rules", []map[string]interface{}{
+		{"pattern": "small.txt", "class": "STANDARD"},
+		{"pattern": "*", "class": "GLACIER"},
+	})
+	defer viper.Set("storage_class_rules", nil)
+
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src)
+
+	vault := memory.New("vault", "")
+	mcID := fmt.Sprintf("class-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	s, err := New(WithBroker(&recordBroker{}), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+
+	require.NoError(t, s.backup("bd", "policy", "class", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+
+	buf, err := vault.GetObject(context.Background(), mcID+"/rp1/index.json")
+	require.NoError(t, err)
+	var index cache.Index
+	require.NoError(t, json.Unmarshal(buf, &index))
+	buf, err = vault.GetObject(context.Background(), mcID+"/rp1/chunk.json")
+	require.NoError(t, err)
+	var chunks cache.Chunk
+	require.NoError(t, json.Unmarshal(buf, &chunks))
+
+	classOf := func(rel string) string {
+		item := index.Items[filepath.Join(src, rel)]
+		require.NotNil(t, item, rel)
+		require.NotEmpty(t, item.Content, rel)
+		key := item.Content[0].Etag
+		info, err := vault.InspectObject(context.Background(), key)
+		require.NoError(t, err)
+		assert.Equal(t, chunks.Classes[key], info.StorageClass, rel)
+		return info.StorageClass
+	}
+	assert.Equal(t, "GLACIER", classOf("large.bin"))
+	// The chunk shared by small.txt and a cold file stays in the hotter class.
+	assert.Equal(t, "STANDARD", classOf("small.txt"))
+	assert.Equal(t, "STANDARD", classOf("docs/nested/duplicate"))
+}
+
+func TestServerIntegrityScan(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes differ on windows")
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src)
+
+	vault := memory.New("vault", "")
+	mcID := fmt.Sprintf("scan-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+
+	require.NoError(t, s.backup("bd", "policy", "scan", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+
+	report := func() map[string]string {
+		require.NoError(t, s.integrityScan(context.Background(), "bd", "policy", backupapi.VerifyPolicy{StorageVaultID: "vault"}))
+		rb.mu.Lock()
+		defer rb.mu.Unlock()
+		last := rb.payloads[len(rb.payloads)-1]
+		assert.Equal(t, "rp1", last["recovery_point_id"])
+		return last
+	}
+	healthy := report()
+	assert.Equal(t, statusVerifiedOK, healthy["status"])
+	assert.NotEqual(t, "0", healthy["chunks"])
+
+	buf, err := vault.GetObject(context.Background(), mcID+"/rp1/index.json")
+	require.NoError(t, err)
+	var index cache.Index
+	require.NoError(t, json.Unmarshal(buf, &index))
+	missing := index.Items[filepath.Join(src, "small.txt")].Content[0].Etag
+	corrupt := index.Items[filepath.Join(src, "large.bin")].Content[0].Etag
+	vault.Delete(missing)
+	require.True(t, vault.Corrupt(corrupt, []byte("rot")))
+
+	degraded := report()
+	assert.Equal(t, statusDegraded, degraded["status"])
+	assert.Equal(t, healthy["chunks"], degraded["chunks"])
+	assert.Equal(t, "1", degraded["missing_chunks"])
+	assert.Equal(t, missing, degraded["missing"])
+	assert.Equal(t, "1", degraded["corrupt_chunks"])
+	assert.Equal(t, corrupt, degraded["corrupt"])
+
+	// A recovery point whose index is gone is degraded too.
+	vault.Delete(mcID + "/rp1/index.json")
+	assert.Equal(t, statusDegraded, report()["status"])
+}
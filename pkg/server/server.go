@@ -8,7 +8,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"net"
 	"net/http"
@@ -18,6 +20,7 @@ import (
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -26,7 +29,9 @@ import (
 
 	"go.uber.org/zap"
 	"golang.org/x/mod/semver"
+	"golang.org/x/sync/errgroup"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/go-chi/chi"
 	"github.com/go-chi/valve"
 	"github.com/inconshreveable/go-update"
@@ -38,8 +43,13 @@ import (
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 	"github.com/bizflycloud/bizfly-backup/pkg/broker"
 	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/notifier"
 	"github.com/bizflycloud/bizfly-backup/pkg/progress"
 	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/budget"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/cooldown"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/local"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/naming"
 	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/s3"
 	"github.com/bizflycloud/bizfly-backup/pkg/support"
 )
@@ -49,9 +59,14 @@ var Version = "dev"
 const (
 	statusPendingFile = "PENDING"
 	statusUploadFile  = "UPLOADING"
+	statusFinalizing  = "FINALIZING"
 	statusComplete    = "COMPLETED"
 	statusDownloading = "DOWNLOADING"
 	statusFailed      = "FAILED"
+	statusRetrying    = "RETRYING"
+
+	// dryRunReason ends the recovery point of a dry run.
+	dryRunReason = "dry run, nothing uploaded"
 )
 
 const (
@@ -66,6 +81,17 @@ const (
 	maxCacheAgeDefault = 24 * time.Hour * 30
 )
 
+const (
+	defaultScheduleRuns = 10
+)
+
+const (
+	defaultBackupRetryBackoff = time.Minute
+	defaultIndexDeltaMaxChain = 10
+	defaultIndexShardFiles    = 100000
+	indexShardConcurrency     = 8
+)
+
 const (
 	intervalTimeCheckUpgrade     = 86400 * time.Second
 	intervalTimeCheckTaskRunning = 50 * time.Second
@@ -75,6 +101,20 @@ const (
 type contextStruct struct {
 	ctx    context.Context
 	cancel context.CancelFunc
+
+	// action details used when reporting the result to notifiers.
+	action          string
+	recoveryPointID string
+	startedAt       time.Time
+	// destDir is the destination of a restore.
+	destDir string
+	// backupDirectoryID is the directory of a backup.
+	backupDirectoryID string
+
+	// progress is the progress of the running phase, with its totals.
+	phase    string
+	progress *progress.Progress
+	todo     progress.Stat
 }
 
 // Server defines parameters for running BizFly Backup HTTP server.
@@ -91,9 +131,17 @@ type Server struct {
 	mu                   sync.Mutex
 	cronManager          *cron.Cron
 	mappingToCronEntryID map[string]cron.EntryID
+	mappingToCronCancel  map[string]context.CancelFunc
+	// runningPolicies holds the scheduled backups running, by mappingID, so
+	// that a run is skipped while the previous one of the policy goes on.
+	runningPolicies map[string]bool
+	// mappingToVerifyEntryID holds the integrity scans of the policies.
+	mappingToVerifyEntryID map[string]cron.EntryID
 
 	// signal chan use for testing.
 	testSignalCh chan os.Signal
+	// storage vault used instead of the one of the server, for testing.
+	testStorageVault storage_vault.StorageVault
 
 	// Goroutines pool
 	poolDir   *ants.Pool
@@ -105,13 +153,46 @@ type Server struct {
 
 	logger *zap.Logger
 
+	// notifier receives backup and restore results, next to the broker.
+	notifier notifier.Notifier
+
 	// map contains context of running worker
+	actionsMu        sync.Mutex
 	mapActionContext map[string]contextStruct
+	// startingBackups holds the backup directories whose requested backup
+	// is not registered as running yet.
+	startingBackups map[string]bool
+	// localRestores holds the actions of the restores run by the agent itself
+	// from POST /backups/restore.
+	localRestores map[string]bool
+
+	startedAt    time.Time
+	lastBackupMu sync.Mutex
+	lastBackup   *backupResult
+
+	// progressStateDir holds the progress snapshots of running backups,
+	// interrupted the ones left over by a previous run of the agent.
+	progressStateDir string
+	interruptedMu    sync.Mutex
+	interrupted      map[string]*progress.Snapshot
+	// configDir holds the config fragments, localDirectories the backup
+	// directories they define.
+	configDir        string
+	localDirectories []backupapi.BackupDirectoryConfig
+
+	// cooldown pauses the requests of all storage vaults while their error
+	// rate is too high.
+	cooldown *cooldown.Gate
+
+	// circuits tracks the backup directories whose scheduled backups keep
+	// failing, by backup directory ID.
+	circuitMu sync.Mutex
+	circuits  map[string]*circuit
 }
 
 // New creates new server instance.
 func New(opts ...Option) (*Server, error) {
-	s := &Server{}
+	s := &Server{startedAt: time.Now()}
 	for _, opt := range opts {
 		if err := opt(s); err != nil {
 			return nil, err
@@ -123,7 +204,13 @@ func New(opts ...Option) (*Server, error) {
 		cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)))
 	s.cronManager.Start()
 	s.mappingToCronEntryID = make(map[string]cron.EntryID)
+	s.mappingToCronCancel = make(map[string]context.CancelFunc)
+	s.runningPolicies = make(map[string]bool)
+	s.resetVerifyCron()
 	s.mapActionContext = make(map[string]contextStruct)
+	s.startingBackups = make(map[string]bool)
+	s.localRestores = make(map[string]bool)
+	s.circuits = make(map[string]*circuit)
 
 	if s.logger == nil {
 		l, err := backupapi.WriteLog()
@@ -132,6 +219,7 @@ func New(opts ...Option) (*Server, error) {
 		}
 		s.logger = l
 	}
+	s.cooldown = cooldown.FromConfig(s.logger)
 
 	s.setupRoutes()
 
@@ -175,11 +263,28 @@ func (s *Server) setupRoutes() {
 		r.Post("/", s.RequestBackup)
 		r.Get("/{backupID}/recovery-points", s.ListRecoveryPoints)
 		r.Post("/sync", s.SyncConfig)
+		r.Get("/schedule", s.ListSchedule)
+		r.Get("/circuits", s.ListCircuits)
+		r.Delete("/{backupID}/circuit", s.ResetCircuit)
+		r.Post("/{backupID}/rewrap-keys", s.RewrapContentKeys)
+		r.Get("/journals", s.ListJournals)
+		r.Post("/{backupID}/resume", s.ResumeBackup)
+		r.Delete("/{backupID}/journal", s.AbandonJournal)
+		r.Get("/{backupID}/progress", s.StreamProgress)
+		r.Post("/restore", s.Restore)
 	})
 
 	s.router.Route("/recovery-points", func(r chi.Router) {
 		r.Delete("/{recoveryPointID}", s.DeleteRecoveryPoints)
 		r.Post("/{recoveryPointID}/restore", s.RequestRestore)
+		r.Post("/{recoveryPointID}/rebuild-chunks", s.RebuildChunks)
+		r.Post("/{recoveryPointID}/consolidate-index", s.ConsolidateIndex)
+	})
+
+	s.router.Route("/storage-vaults", func(r chi.Router) {
+		r.Get("/{storageVaultID}/inspect", s.InspectObject)
+		r.Get("/cooldown", s.VaultCooldown)
+		r.Post("/migrate", s.MigrateVault)
 	})
 
 	s.router.Route("/upgrade", func(r chi.Router) {
@@ -192,10 +297,13 @@ func (s *Server) setupRoutes() {
 		r.Get("/", s.ListAction)
 		r.Delete("/{actionID}", s.StopAction)
 	})
+	s.router.Route("/cache", func(r chi.Router) {
+		r.Get("/status", s.CacheStatus)
+	})
 }
 
 func (s *Server) ListAction(w http.ResponseWriter, r *http.Request) {
-	c, err := s.backupClient.ListActivity(r.Context(), s.backupClient.Id, []string{statusDownloading, statusUploadFile})
+	c, err := s.backupClient.ListActivity(r.Context(), s.backupClient.Id, []string{statusDownloading, statusUploadFile, statusFinalizing})
 	if err != nil {
 		s.logger.Error("err ", zap.Error(err))
 		w.WriteHeader(http.StatusInternalServerError)
@@ -220,31 +328,31 @@ func (s *Server) StopAction(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write([]byte("Success"))
 }
 
+// handleBrokerEvent handles an event from the broker. A backup or a restore is
+// handled once it ends, so that the event is delivered again when the agent
+// stops before.
 func (s *Server) handleBrokerEvent(e broker.Event) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-	limitUpload := viper.GetInt("limit_upload")
-	limitDownload := viper.GetInt("limit_download")
 	var msg broker.Message
 	if err := json.Unmarshal(e.Payload, &msg); err != nil {
-		return err
+		return broker.Permanent(err)
 	}
 	s.logger.Debug("Got broker event", zap.String("event_type", msg.EventType))
 	switch msg.EventType {
 	case broker.BackupManual:
-		limitDownload = 0
-		var err error
-		go func() {
-			err = s.backup(msg.BackupDirectoryID, msg.PolicyID, msg.Name, limitUpload, limitDownload, backupapi.RecoveryPointTypeInitialReplica, ioutil.Discard)
-		}()
-		return err
+		return s.handleBackupManual(e, msg)
 	case broker.RestoreManual:
-		limitUpload = 0
-		var err error
+		return s.handleRestoreManual(e, msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch msg.EventType {
+	case broker.RebuildChunks:
 		go func() {
-			err = s.restore(msg.MachineID, msg.ActionId, msg.CreatedAt, msg.RestoreSessionKey, msg.RecoveryPointID, msg.DestinationDirectory, msg.StorageVaultId, limitUpload, limitDownload, ioutil.Discard)
+			if _, err := s.requestRebuildChunks(context.Background(), msg.MachineID, msg.RecoveryPointID, msg.StorageVaultId); err != nil {
+				s.logger.Error("failed to rebuild chunk list", zap.Error(err), zap.String("recovery_point_id", msg.RecoveryPointID))
+			}
 		}()
-		return err
 	case broker.ConfigUpdate:
 		return s.handleConfigUpdate(msg)
 	case broker.ConfigRefresh:
@@ -260,24 +368,68 @@ func (s *Server) handleBrokerEvent(e broker.Event) error {
 		s.schedule(15*time.Minute, 2)
 	case broker.StopAction:
 		// Done context of running action
-		if actionContext, ok := s.mapActionContext[msg.ActionId]; ok {
+		if actionContext, ok := s.action(msg.ActionId); ok {
 			actionContext.cancel()
 		}
 		s.notifyStatusFailed(msg.ActionId, backupapi.ErrorGotCancelRequest.Error())
 	default:
 		s.logger.Debug("Got unknown event", zap.Any("message", msg))
+		return fmt.Errorf("%w: %s", broker.ErrUnknownEventType, msg.EventType)
 	}
 	return nil
 }
 
+// handleBackupManual runs the backup asked by msg. A backup failing before it
+// started is delivered again, once started its failure is reported to the
+// server instead.
+func (s *Server) handleBackupManual(e broker.Event, msg broker.Message) error {
+	// The backup of a message delivered again may still be running.
+	if actionID, ok := s.runningBackup(msg.BackupDirectoryID); ok && e.Duplicate {
+		return broker.Permanent(fmt.Errorf("%w: backup directory %s by action %s", ErrorBackupRunning, msg.BackupDirectoryID, actionID))
+	}
+	started := false
+	err := runIsolated(func() error {
+		return s.runBackup(msg.BackupDirectoryID, msg.PolicyID, msg.Name, viper.GetInt("limit_upload"), 0, backupapi.RecoveryPointTypeInitialReplica, ioutil.Discard, func(*backupapi.CreateRecoveryPointResponse) {
+			started = true
+		})
+	})
+	if err == nil {
+		return nil
+	}
+	s.logger.Error("failed to run backup", zap.Error(err), zap.String("backup_directory_id", msg.BackupDirectoryID))
+	if started {
+		return broker.Permanent(err)
+	}
+	return err
+}
+
+// handleRestoreManual runs the restore asked by msg, whose failure is reported
+// to the server.
+func (s *Server) handleRestoreManual(e broker.Event, msg broker.Message) error {
+	// The restore of a message delivered again may still be running. The one
+	// of an action the agent created itself is run by the agent, and may have
+	// ended already.
+	if err := s.checkRestoreEvent(msg.ActionId); err != nil {
+		return broker.Permanent(err)
+	}
+	return broker.Permanent(s.restore(msg.MachineID, msg.ActionId, msg.CreatedAt, msg.RestoreSessionKey, msg.RecoveryPointID, msg.DestinationDirectory, msg.StripPrefix, msg.MetadataOnly, msg.Force, msg.Profile, msg.StorageVaultId, 0, ioutil.Discard))
+}
+
 func (s *Server) handleConfigUpdate(config broker.Message) error {
+	if err := s.reloadConfigDir(); err != nil {
+		s.logger.Error("failed to reload config directory, keep previous", zap.Error(err))
+	}
+	// The local backup directories take precedence over the server ones.
+	config.BackupDirectories = s.withoutLocalDirectories(config.BackupDirectories)
 	switch config.Action {
 	case broker.ConfigUpdateActionAddPolicy,
 		broker.ConfigUpdateActionUpdatePolicy,
 		broker.ConfigUpdateActionActiveDirectory,
 		broker.ConfigUpdateActionAddDirectory:
 		s.removeFromCronManager(config.BackupDirectories)
-		s.addToCronManager(config.BackupDirectories)
+		if err := s.addToCronManager(config.BackupDirectories); err != nil {
+			return err
+		}
 	case broker.ConfigUpdateActionDelPolicy,
 		broker.ConfigUpdateActionDeactiveDirectory,
 		broker.ConfigUpdateActionDelDirectory:
@@ -294,7 +446,7 @@ func (s *Server) handleConfigUpdate(config broker.Message) error {
 		s.poolDir.Tune(config.NumGoroutine)
 
 	default:
-		return fmt.Errorf("unhandled action: %s", config.Action)
+		return broker.Permanent(fmt.Errorf("unhandled action: %s", config.Action))
 	}
 	return nil
 }
@@ -302,17 +454,213 @@ func (s *Server) handleConfigUpdate(config broker.Message) error {
 func (s *Server) handleConfigRefresh(backupDirectories []backupapi.BackupDirectoryConfig) error {
 	ctx := s.cronManager.Stop()
 	<-ctx.Done()
+	for _, cancel := range s.mappingToCronCancel {
+		cancel()
+	}
 	s.cronManager = cron.New()
 	s.cronManager.Start()
 	s.mappingToCronEntryID = make(map[string]cron.EntryID)
-	s.addToCronManager(backupDirectories)
+	s.mappingToCronCancel = make(map[string]context.CancelFunc)
+	s.resetVerifyCron()
+	if err := s.reloadConfigDir(); err != nil {
+		s.logger.Error("failed to reload config directory, keep previous", zap.Error(err))
+		_ = s.addToCronManager(s.localDirectories)
+	}
+	return s.addToCronManager(s.withoutLocalDirectories(backupDirectories))
+}
+
+// reloadConfigDir reads the config fragments again and replaces the schedules
+// of the local backup directories. On error the previous ones are kept.
+func (s *Server) reloadConfigDir() error {
+	if s.configDir == "" {
+		return nil
+	}
+	cfg, err := backupapi.LoadConfigDir(s.configDir)
+	if err != nil {
+		return err
+	}
+	s.removeFromCronManager(s.localDirectories)
+	s.localDirectories = cfg.BackupDirectories
+	// LoadConfigDir already refused duplicate ids.
+	_ = s.addToCronManager(s.localDirectories)
 	return nil
 }
 
+// localDirectory returns the backup directory id defined locally, nil when
+// it is not.
+func (s *Server) localDirectory(id string) *backupapi.BackupDirectoryConfig {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, bd := range s.localDirectories {
+		if bd.ID == id {
+			bd := bd
+			return &bd
+		}
+	}
+	return nil
+}
+
+// withoutLocalDirectories returns bdc without the backup directories defined
+// locally.
+func (s *Server) withoutLocalDirectories(bdc []backupapi.BackupDirectoryConfig) []backupapi.BackupDirectoryConfig {
+	if len(s.localDirectories) == 0 {
+		return bdc
+	}
+	local := make(map[string]bool, len(s.localDirectories))
+	for _, bd := range s.localDirectories {
+		local[bd.ID] = true
+	}
+	var filtered []backupapi.BackupDirectoryConfig
+	for _, bd := range bdc {
+		if local[bd.ID] {
+			s.logger.Warn("Backup directory overridden by config directory", zap.String("backup_directory_id", bd.ID))
+			continue
+		}
+		filtered = append(filtered, bd)
+	}
+	return filtered
+}
+
 func mappingID(backupDirectoryID, policyID string) string {
 	return backupDirectoryID + "|" + policyID
 }
 
+// scheduleJitter returns the delay applied to the scheduled runs of the policy
+// identified by id, within window. The delay is derived from id so that it
+// stays the same across runs and agent restarts.
+func scheduleJitter(id string, window time.Duration) time.Duration {
+	if window <= 0 {
+		return 0
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(id))
+	return time.Duration(h.Sum64() % uint64(window))
+}
+
+// scheduleJitterWindow returns the configured schedule_jitter, a duration or
+// a number of seconds.
+func scheduleJitterWindow() time.Duration {
+	value := viper.GetString("schedule_jitter")
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second))
+	}
+	return viper.GetDuration("schedule_jitter")
+}
+
+// policyJitter returns the delay of the scheduled runs of the policy
+// identified by id on this agent, so that agents sharing a policy spread
+// their runs as well.
+func (s *Server) policyJitter(id string) time.Duration {
+	if s.backupClient != nil {
+		id = s.backupClient.Id + "|" + id
+	}
+	return scheduleJitter(id, scheduleJitterWindow())
+}
+
+// capJitter returns jitter, or jitter wrapped within untilNext when it would
+// delay a run past the next one.
+func capJitter(jitter, untilNext time.Duration) time.Duration {
+	if untilNext <= 0 || jitter < untilNext {
+		return jitter
+	}
+	return jitter % untilNext
+}
+
+// ScheduledRun is an upcoming run of a backup policy.
+type ScheduledRun struct {
+	BackupDirectoryID string    `json:"backup_directory_id"`
+	PolicyID          string    `json:"policy_id"`
+	At                time.Time `json:"at"`
+}
+
+// schedulePlan returns the next runs fire times of every scheduled policy after
+// from, merged into a single timeline sorted by time. Runs later than until are
+// dropped unless until is zero.
+func (s *Server) schedulePlan(from time.Time, until time.Time, runs int) []ScheduledRun {
+	plan := make([]ScheduledRun, 0)
+	for id, entryID := range s.mappingToCronEntryID {
+		entry := s.cronManager.Entry(entryID)
+		if entry.Schedule == nil {
+			continue
+		}
+		ids := strings.SplitN(id, "|", 2)
+		if len(ids) != 2 {
+			continue
+		}
+		jitter := s.policyJitter(id)
+		next := from
+		for i := 0; i < runs; i++ {
+			next = entry.Schedule.Next(next)
+			if next.IsZero() || (!until.IsZero() && next.After(until)) {
+				break
+			}
+			plan = append(plan, ScheduledRun{
+				BackupDirectoryID: ids[0],
+				PolicyID:          ids[1],
+				At:                next.Add(capJitter(jitter, entry.Schedule.Next(next).Sub(next))),
+			})
+		}
+	}
+	sort.SliceStable(plan, func(i, j int) bool {
+		if plan[i].At.Equal(plan[j].At) {
+			return mappingID(plan[i].BackupDirectoryID, plan[i].PolicyID) < mappingID(plan[j].BackupDirectoryID, plan[j].PolicyID)
+		}
+		return plan[i].At.Before(plan[j].At)
+	})
+	return plan
+}
+
+// backupWithRetry runs a scheduled backup job, retrying transient failures up to
+// backup_retry_attempts times with exponential backoff. Retries run inside the
+// same cron invocation and stop when the next scheduled run would come first.
+func (s *Server) backupWithRetry(ctx context.Context, directoryID, policyID string, nextRun func() time.Time, job func() error) error {
+	attempts := viper.GetInt("backup_retry_attempts")
+	wait := viper.GetDuration("backup_retry_backoff")
+	if wait <= 0 {
+		wait = defaultBackupRetryBackoff
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := runIsolated(job)
+		if err == nil || attempt > attempts || !retryableBackupError(err) {
+			return err
+		}
+		retryAt := time.Now().Add(wait)
+		if next := nextRun(); !next.IsZero() && next.Before(retryAt) {
+			return err
+		}
+
+		s.logger.Warn("Scheduled backup failed, retrying",
+			zap.Error(err),
+			zap.String("backup_directory_id", directoryID),
+			zap.String("policy_id", policyID),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", wait))
+		s.notifyMsg(map[string]string{
+			"status":              statusRetrying,
+			"backup_directory_id": directoryID,
+			"policy_id":           policyID,
+			"attempt":             strconv.Itoa(attempt),
+			"max_attempts":        strconv.Itoa(attempts),
+			"retry_at":            retryAt.Format(time.RFC3339),
+			"reason":              err.Error(),
+		})
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// retryableBackupError reports whether retrying the backup might succeed.
+func retryableBackupError(err error) bool {
+	return !errors.Is(err, backupapi.ErrorGotCancelRequest) && !errors.Is(err, ErrorBackupLimitExceeded) &&
+		!errors.Is(err, storage_vault.ErrRequestBudgetExhausted)
+}
+
 func (s *Server) removeFromCronManager(bdc []backupapi.BackupDirectoryConfig) {
 	for _, bd := range bdc {
 		for _, policy := range bd.Policies {
@@ -321,16 +669,65 @@ func (s *Server) removeFromCronManager(bdc []backupapi.BackupDirectoryConfig) {
 				s.cronManager.Remove(entryID)
 				delete(s.mappingToCronEntryID, mappingID)
 			}
+			if cancel, ok := s.mappingToCronCancel[mappingID]; ok {
+				cancel()
+				delete(s.mappingToCronCancel, mappingID)
+			}
+			s.removeVerifyFromCron(bd.ID, policy.ID)
 		}
 	}
 }
 
-func (s *Server) addToCronManager(bdc []backupapi.BackupDirectoryConfig) {
+// schedulePattern returns pattern in the time zone of policy. An unknown
+// time zone is logged and UTC used instead, so that the policy still runs.
+func (s *Server) schedulePattern(policy backupapi.BackupDirectoryConfigPolicy, pattern string) string {
+	if policy.Timezone == "" || strings.HasPrefix(pattern, "CRON_TZ=") || strings.HasPrefix(pattern, "TZ=") {
+		return pattern
+	}
+	tz := policy.Timezone
+	if _, err := time.LoadLocation(tz); err != nil {
+		s.logger.Warn("Unknown policy time zone, schedule in UTC", zap.Error(err), zap.String("policy_id", policy.ID), zap.String("timezone", tz))
+		tz = "UTC"
+	}
+	return "CRON_TZ=" + tz + " " + pattern
+}
+
+// startPolicyRun marks the scheduled backup id as running, unless it is
+// running already.
+func (s *Server) startPolicyRun(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.runningPolicies[id] {
+		return false
+	}
+	s.runningPolicies[id] = true
+	return true
+}
+
+// finishPolicyRun marks the scheduled backup id as done.
+func (s *Server) finishPolicyRun(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.runningPolicies, id)
+}
+
+// addToCronManager schedules the policies of the activated backup directories
+// of bdc. A policy already scheduled for the same backup directory, in bdc or
+// before, is refused rather than replacing the schedule, and reported with
+// ErrorDuplicateID once the others are scheduled.
+func (s *Server) addToCronManager(bdc []backupapi.BackupDirectoryConfig) error {
+	var duplicates []string
 	for _, bd := range bdc {
 		if !bd.Activated {
 			continue
 		}
 		for _, policy := range bd.Policies {
+			if _, ok := s.mappingToCronEntryID[mappingID(bd.ID, policy.ID)]; ok {
+				s.logger.Error("Refuse duplicate policy, keep the one scheduled first",
+					zap.String("backup_directory_id", bd.ID), zap.String("policy_id", policy.ID))
+				duplicates = append(duplicates, fmt.Sprintf("policy %s of backup directory %s", policy.ID, bd.ID))
+				continue
+			}
 			directoryID := bd.ID
 			policyID := policy.ID
 			limitUpload := policy.LimitUpload
@@ -338,11 +735,39 @@ func (s *Server) addToCronManager(bdc []backupapi.BackupDirectoryConfig) {
 				limitUpload = viper.GetInt("limit_upload")
 			}
 			limitDownload := 0
-			entryID, err := s.cronManager.AddFunc(policy.SchedulePattern, func() {
+			id := mappingID(bd.ID, policy.ID)
+			jitter := s.policyJitter(id)
+			ctx, cancel := context.WithCancel(context.Background())
+			var entryID cron.EntryID
+			cronManager := s.cronManager
+			nextRun := func() time.Time { return cronManager.Entry(entryID).Next }
+			entryID, err := s.cronManager.AddFunc(s.schedulePattern(policy, policy.SchedulePattern), func() {
+				if !s.startPolicyRun(id) {
+					s.logger.Warn("Skip scheduled backup, the previous run is still running", zap.String("backup_directory_id", directoryID), zap.String("policy_id", policyID))
+					return
+				}
+				defer s.finishPolicyRun(id)
+				// The next run is already scheduled when this one fires.
+				if jitter := capJitter(jitter, time.Until(nextRun())); jitter > 0 {
+					s.logger.Sugar().Infof("Delay scheduled backup %s by %s", id, jitter)
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(jitter):
+					}
+				}
+				if !s.circuitAllows(directoryID) {
+					s.logger.Warn("Skip scheduled backup of paused directory", zap.String("backup_directory_id", directoryID), zap.String("policy_id", policyID))
+					return
+				}
 				name := "auto-" + time.Now().Format(time.RFC3339)
 				// improve when support incremental backup
 				recoveryPointType := backupapi.RecoveryPointTypeInitialReplica
-				if err := s.backup(directoryID, policyID, name, limitUpload, limitDownload, recoveryPointType, ioutil.Discard); err != nil {
+				err := s.backupWithRetry(ctx, directoryID, policyID, nextRun, func() error {
+					return s.backup(directoryID, policyID, name, limitUpload, limitDownload, recoveryPointType, ioutil.Discard)
+				})
+				s.recordScheduledBackup(directoryID, policyID, err)
+				if err != nil {
 					zapFields := []zap.Field{
 						zap.Error(err),
 						zap.String("service", "cron"),
@@ -353,19 +778,33 @@ func (s *Server) addToCronManager(bdc []backupapi.BackupDirectoryConfig) {
 				}
 			})
 			if err != nil {
+				cancel()
 				s.logger.Error("failed to add cron entry", zap.Error(err))
 				continue
 			}
-			s.mappingToCronEntryID[mappingID(bd.ID, policy.ID)] = entryID
+			s.mappingToCronEntryID[id] = entryID
+			s.mappingToCronCancel[id] = cancel
+			if policy.Verify != nil {
+				s.addVerifyToCron(directoryID, policy)
+			}
 		}
 	}
+	if len(duplicates) > 0 {
+		return fmt.Errorf("%w: %s", backupapi.ErrorDuplicateID, strings.Join(duplicates, ", "))
+	}
+	return nil
 }
 
+// RequestBackup runs a backup of backup_directory_id under policy_id at once,
+// answering with its action and recovery point. A body with id only asks the
+// backup service for a manual backup instead.
 func (s *Server) RequestBackup(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		ID          string `json:"id"`
-		StorageType string `json:"storage_type"`
-		Name        string `json:"name"`
+		ID                string `json:"id"`
+		StorageType       string `json:"storage_type"`
+		Name              string `json:"name"`
+		BackupDirectoryID string `json:"backup_directory_id"`
+		PolicyID          string `json:"policy_id"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -373,9 +812,91 @@ func (s *Server) RequestBackup(w http.ResponseWriter, r *http.Request) {
 		return
 
 	}
-	if err := s.requestBackup(body.ID, body.Name, body.StorageType); err != nil {
+	if body.BackupDirectoryID == "" && body.PolicyID == "" {
+		if err := s.requestBackup(body.ID, body.Name, body.StorageType); err != nil {
+			s.logger.Error("err ", zap.Error(err))
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(err.Error()))
+		}
+		return
+	}
+
+	if body.BackupDirectoryID == "" || body.PolicyID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`backup_directory_id and policy_id are required`))
+		return
+	}
+	if err := s.checkBackupPolicy(r.Context(), body.BackupDirectoryID, body.PolicyID); err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, ErrorUnknownBackupDirectory) || errors.Is(err, ErrorUnknownPolicy) {
+			status = http.StatusBadRequest
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
+	if err := s.reserveBackup(body.BackupDirectoryID); err != nil {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	type startResult struct {
+		action *backupapi.CreateRecoveryPointResponse
+		err    error
+	}
+	startCh := make(chan startResult, 1)
+	var once sync.Once
+	limitUpload := viper.GetInt("limit_upload")
+	limitDownload := viper.GetInt("limit_download")
+	go func() {
+		err := runIsolated(func() error {
+			return s.runBackup(body.BackupDirectoryID, body.PolicyID, body.Name, limitUpload, limitDownload, backupapi.RecoveryPointTypeInitialReplica, ioutil.Discard, func(action *backupapi.CreateRecoveryPointResponse) {
+				once.Do(func() { startCh <- startResult{action: action} })
+			})
+		})
+		if err != nil {
+			s.logger.Error("failed to run backup", zap.Error(err), zap.String("backup_directory_id", body.BackupDirectoryID))
+		}
+		// A backup failing before it started is answered with its error.
+		once.Do(func() { startCh <- startResult{err: err} })
+	}()
+
+	// The backup holds the directory once registered as running.
+	started := <-startCh
+	s.releaseBackup(body.BackupDirectoryID)
+	if started.action == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(fmt.Sprint(started.err)))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"action_id":         started.action.ID,
+		"recovery_point_id": started.action.RecoveryPoint.ID,
+	})
+}
+
+// checkBackupPolicy returns ErrorUnknownBackupDirectory or ErrorUnknownPolicy
+// unless policyID is a policy of backupDirectoryID in the config of the agent.
+func (s *Server) checkBackupPolicy(ctx context.Context, backupDirectoryID, policyID string) error {
+	cfg, err := s.backupClient.GetConfig(ctx)
+	if err != nil {
+		return err
+	}
+	for _, bd := range cfg.BackupDirectories {
+		if bd.ID != backupDirectoryID {
+			continue
+		}
+		for _, policy := range bd.Policies {
+			if policy.ID == policyID {
+				return nil
+			}
+		}
+		return fmt.Errorf("%w %s of backup directory %s", ErrorUnknownPolicy, policyID, backupDirectoryID)
+	}
+	return fmt.Errorf("%w %s", ErrorUnknownBackupDirectory, backupDirectoryID)
 }
 
 func (s *Server) ListBackup(w http.ResponseWriter, r *http.Request) {
@@ -386,9 +907,42 @@ func (s *Server) ListBackup(w http.ResponseWriter, r *http.Request) {
 		_, _ = w.Write([]byte(err.Error()))
 		return
 	}
+	s.mu.Lock()
+	c.BackupDirectories = backupapi.MergeBackupDirectories(c.BackupDirectories, s.localDirectories)
+	s.mu.Unlock()
 	_ = json.NewEncoder(w).Encode(c)
 }
 
+func (s *Server) ListSchedule(w http.ResponseWriter, r *http.Request) {
+	runs := defaultScheduleRuns
+	if v := r.URL.Query().Get("runs"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`invalid runs`))
+			return
+		}
+		runs = n
+	}
+
+	now := time.Now()
+	var until time.Time
+	if v := r.URL.Query().Get("within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`invalid within`))
+			return
+		}
+		until = now.Add(d)
+	}
+
+	s.mu.Lock()
+	plan := s.schedulePlan(now, until, runs)
+	s.mu.Unlock()
+	_ = json.NewEncoder(w).Encode(plan)
+}
+
 func (s *Server) ListRecoveryPoints(w http.ResponseWriter, r *http.Request) {
 	backupID := chi.URLParam(r, "backupID")
 	rps, err := s.backupClient.ListRecoveryPoints(r.Context(), backupID)
@@ -414,8 +968,12 @@ func (s *Server) DeleteRecoveryPoints(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) RequestRestore(w http.ResponseWriter, r *http.Request) {
 	var body struct {
-		MachineID string `json:"machine_id"`
-		Path      string `json:"path"`
+		MachineID    string `json:"machine_id"`
+		Path         string `json:"path"`
+		StripPrefix  string `json:"strip_prefix"`
+		MetadataOnly bool   `json:"metadata_only"`
+		Force        bool   `json:"force"`
+		Profile      string `json:"profile"`
 	}
 
 	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
@@ -426,10 +984,169 @@ func (s *Server) RequestRestore(w http.ResponseWriter, r *http.Request) {
 
 	body.MachineID = s.backupClient.Id
 
+	// Refused early, so that the command reports it, the restore checks again
+	// before writing anything.
+	if _, err := backupapi.GetRestoreProfile(body.Profile); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if !body.MetadataOnly {
+		if err := backupapi.CheckRestoreDestination(body.Path, body.Force); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
 	recoveryPointID := chi.URLParam(r, "recoveryPointID")
-	if err := s.requestRestore(recoveryPointID, body.MachineID, body.Path); err != nil {
+	if err := s.requestRestore(recoveryPointID, body.MachineID, body.Path, body.StripPrefix, body.MetadataOnly, body.Force, body.Profile); err != nil {
+		return
+	}
+}
+
+// Restore runs a restore of recovery_point_id from storage_vault_id into
+// destination_directory at once, answering with its action ID, by which its
+// progress is followed. The action is created by the backup service, as for
+// a restore it sends, so that the restore is authorized and reported as any
+// other.
+func (s *Server) Restore(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		RecoveryPointID      string `json:"recovery_point_id"`
+		DestinationDirectory string `json:"destination_directory"`
+		StorageVaultID       string `json:"storage_vault_id"`
+		MachineID            string `json:"machine_id"`
+		StripPrefix          string `json:"strip_prefix"`
+		Force                bool   `json:"force"`
+		Profile              string `json:"profile"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`malformed body`))
 		return
 	}
+	if body.RecoveryPointID == "" || body.DestinationDirectory == "" || body.StorageVaultID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`recovery_point_id, destination_directory and storage_vault_id are required`))
+		return
+	}
+	if body.MachineID == "" {
+		body.MachineID = s.backupClient.Id
+	}
+	destDir := filepath.Clean(body.DestinationDirectory)
+
+	if _, err := backupapi.GetRestoreProfile(body.Profile); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if err := backupapi.CheckRestoreDestination(destDir, body.Force); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if err := backupapi.CheckRestoreWritable(destDir); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if _, err := s.backupClient.GetRecoveryPointInfo(body.RecoveryPointID); err != nil {
+		status := http.StatusBadGateway
+		if errors.Is(err, backupapi.ErrorNotFound) {
+			status = http.StatusNotFound
+		}
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	action, err := s.backupClient.RequestRestore(body.RecoveryPointID, &backupapi.CreateRestoreRequest{
+		MachineID:   body.MachineID,
+		Path:        destDir,
+		StripPrefix: body.StripPrefix,
+		Force:       body.Force,
+		Profile:     body.Profile,
+	})
+	if err == nil && action.ActionID == "" {
+		err = errors.New("backup service created no restore action")
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Registered before answering, so that a restore of the same recovery
+	// point into the same destination is refused at once. The backup service
+	// also sends the restore as a restore_manual event, acknowledged without
+	// running it again, unless the event came first and runs it already.
+	actionID := action.ActionID
+	start, err := s.startLocalRestore(actionID, contextStruct{
+		action:          notifier.ActionRestore,
+		recoveryPointID: body.RecoveryPointID,
+		startedAt:       time.Now(),
+		destDir:         destDir,
+	})
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	if start {
+		go func() {
+			err := runIsolated(func() error {
+				return s.restore(body.MachineID, actionID, action.CreatedAt, action.RestoreSessionKey, body.RecoveryPointID, destDir, body.StripPrefix, false, body.Force, body.Profile, body.StorageVaultID, 0, ioutil.Discard)
+			})
+			if err != nil {
+				s.logger.Error("failed to run restore", zap.Error(err), zap.String("action_id", actionID))
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"action_id":         actionID,
+		"recovery_point_id": body.RecoveryPointID,
+	})
+}
+
+func (s *Server) InspectObject(w http.ResponseWriter, r *http.Request) {
+	storageVaultID := chi.URLParam(r, "storageVaultID")
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`missing key`))
+		return
+	}
+
+	vault, err := s.backupClient.GetCredentialStorageVault(storageVaultID, "", nil)
+	if err != nil {
+		s.logger.Error("err ", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	storageVault, err := s.NewStorageVault(*vault, "", 0, 0)
+	if err != nil {
+		s.logger.Error("err ", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	info, err := storageVault.InspectObject(r.Context(), key)
+	if err != nil {
+		s.logger.Error("err ", zap.Error(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+	_ = json.NewEncoder(w).Encode(info)
+}
+
+// VaultCooldown returns the state of the agent-wide storage vault cool-down.
+func (s *Server) VaultCooldown(w http.ResponseWriter, r *http.Request) {
+	_ = json.NewEncoder(w).Encode(s.cooldown.State())
 }
 
 func (s *Server) SyncConfig(w http.ResponseWriter, r *http.Request) {
@@ -583,31 +1300,80 @@ func (s *Server) upgradeLoop(ctx context.Context) {
 	}
 }
 
+var (
+	// brokerWatchInterval is the interval at which the broker connection is
+	// checked.
+	brokerWatchInterval = time.Second
+	// brokerStableAfter is how long a broker connection must last for the
+	// reconnect backoff to start over.
+	brokerStableAfter = time.Minute
+)
+
+// subscribeBrokerLoop connects to the broker and subscribes to subscribeTopics,
+// retrying with backoff, then connects and subscribes again whenever the
+// connection is lost, until ctx is done. Every connection is announced with an
+// ONLINE status, since the last will of the agent reported it offline.
 func (s *Server) subscribeBrokerLoop(ctx context.Context) {
 	if len(s.subscribeTopics) == 0 {
 		return
 	}
 	b := &backoff.Backoff{Jitter: true}
+	first := true
 	for {
-		select {
-		case <-ctx.Done():
-			return
-		default:
-		}
-		if err := s.b.ConnectAndSubscribe(s.handleBrokerEvent, s.subscribeTopics); err == nil {
-			break
-		} else {
+		if err := s.b.ConnectAndSubscribe(s.handleBrokerEvent, s.subscribeTopics); err != nil {
 			s.logger.Error("connect to broker failed", zap.Error(err))
-			time.Sleep(b.Duration())
+			if storage_vault.Sleep(ctx, b.Duration()) != nil {
+				return
+			}
 			continue
 		}
+
+		// publish message to notify online status
+		msg := map[string]string{"status": "ONLINE", "event_type": broker.StatusNotify}
+		payload, _ := json.Marshal(msg)
+		if err := s.b.Publish(s.publishTopics[0], payload); err != nil {
+			s.logger.Error("failed to notify server status online", zap.Error(err))
+		}
+		if first {
+			s.reportInterruptedBackups()
+			first = false
+		}
+
+		connectedAt := time.Now()
+		if !s.watchBroker(ctx) {
+			return
+		}
+		if time.Since(connectedAt) >= brokerStableAfter {
+			b.Reset()
+		}
+		s.logger.Warn("Connection to broker lost, reconnecting")
+		_ = s.b.Disconnect()
+		if storage_vault.Sleep(ctx, b.Duration()) != nil {
+			return
+		}
 	}
+}
 
-	// publish message to notify online status
-	msg := map[string]string{"status": "ONLINE", "event_type": broker.StatusNotify}
-	payload, _ := json.Marshal(msg)
-	if err := s.b.Publish(s.publishTopics[0], payload); err != nil {
-		s.logger.Error("failed to notify server status online", zap.Error(err))
+// watchBroker waits until the broker connection is lost, returning true, or
+// ctx is done, returning false. A broker which can not report its connection
+// is only waited on for ctx.
+func (s *Server) watchBroker(ctx context.Context) bool {
+	status, ok := s.b.(broker.ConnectionStatus)
+	if !ok {
+		<-ctx.Done()
+		return false
+	}
+	ticker := time.NewTicker(brokerWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-ticker.C:
+			if !status.IsConnected() {
+				return true
+			}
+		}
 	}
 }
 
@@ -672,6 +1438,13 @@ func (s *Server) Run() error {
 	go s.subscribeBrokerLoop(baseCtx)
 	go s.shutdownSignalLoop(baseCtx, valv)
 	go s.upgradeLoop(baseCtx)
+	go s.heartbeatLoop(baseCtx, valv.Stop())
+
+	s.mu.Lock()
+	if err := s.reloadConfigDir(); err != nil {
+		s.logger.Error("failed to load config directory", zap.Error(err))
+	}
+	s.mu.Unlock()
 
 	srv := http.Server{Handler: chi.ServerBaseContext(baseCtx, s.router)}
 
@@ -724,17 +1497,60 @@ func (s *Server) notifyStatusFailed(actionID, reason string) {
 		"status":    statusFailed,
 		"reason":    reason,
 	})
+
+	e := notifier.Event{
+		ActionID: actionID,
+		Status:   statusFailed,
+		Error:    reason,
+	}
+	if actionContext, ok := s.action(actionID); ok {
+		e.Action = actionContext.action
+		e.RecoveryPointID = actionContext.recoveryPointID
+		e.Duration = time.Since(actionContext.startedAt)
+	}
+	s.notifyResult(e)
+}
+
+// notifyResult sends the result of an action to the configured notifiers.
+func (s *Server) notifyResult(e notifier.Event) {
+	s.recordBackupResult(e)
+	if s.notifier == nil {
+		return
+	}
+	go func() {
+		if err := s.notifier.Notify(context.Background(), e); err != nil {
+			s.logger.Warn("failed to notify result", zap.Error(err), zap.Any("event", e))
+		}
+	}()
 }
 
 // backup performs backup flow.
 func (s *Server) backup(backupDirectoryID string, policyID string, name string, limitUpload, limitDownload int, recoveryPointType string, progressOutput io.Writer) error {
+	return s.runBackup(backupDirectoryID, policyID, name, limitUpload, limitDownload, recoveryPointType, progressOutput, nil)
+}
+
+// runBackup performs backup flow, calling started, when not nil, once the
+// recovery point is created and the backup registered as running.
+func (s *Server) runBackup(backupDirectoryID string, policyID string, name string, limitUpload, limitDownload int, recoveryPointType string, progressOutput io.Writer, started func(*backupapi.CreateRecoveryPointResponse)) error {
 	chErr := make(chan error, 1)
 
 	s.logger.Info("Backup directory ID: ", zap.String("backupDirectoryID", backupDirectoryID), zap.String("policyID", policyID), zap.String("name", name), zap.String("recoveryPointType", recoveryPointType))
 
 	ctx, cancel := context.WithCancel(context.Background())
+	if timeout := viper.GetDuration("backup_timeout"); timeout > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), timeout)
+	}
 	defer cancel()
 
+	// A new recovery point replaces the one of a backup interrupted before,
+	// a dry run leaves it to the next backup.
+	dryRun := viper.GetBool("dry_run")
+	if dryRun {
+		s.logger.Info("Dry run, nothing is uploaded", zap.String("backupDirectoryID", backupDirectoryID))
+	} else if err := s.abandonJournal(backupDirectoryID, journalSupersededReason); err != nil && !errors.Is(err, ErrorNoJournal) {
+		s.logger.Warn("failed to abandon backup journal", zap.Error(err))
+	}
+
 	// Create recovery point
 	s.logger.Sugar().Infof("Creating recovery point %s", backupDirectoryID)
 	actionCreateRP, err := s.backupClient.CreateRecoveryPoint(ctx, backupDirectoryID, &backupapi.CreateRecoveryPointRequest{
@@ -747,9 +1563,28 @@ func (s *Server) backup(backupDirectoryID string, policyID string, name string,
 		chErr <- err
 		return <-chErr
 	}
+	var j *journal
+	if !dryRun {
+		j = s.startJournal(actionCreateRP, backupDirectoryID)
+	}
+	defer func() {
+		if err := j.remove(); err != nil {
+			s.logger.Warn("failed to remove backup journal", zap.Error(err))
+		}
+	}()
 
 	// Save context of worker to map for manage
-	s.mapActionContext[actionCreateRP.ID] = contextStruct{ctx: ctx, cancel: cancel}
+	s.setAction(actionCreateRP.ID, contextStruct{
+		ctx:               ctx,
+		cancel:            cancel,
+		action:            notifier.ActionBackup,
+		recoveryPointID:   actionCreateRP.RecoveryPoint.ID,
+		startedAt:         time.Now(),
+		backupDirectoryID: backupDirectoryID,
+	})
+	if started != nil {
+		started(actionCreateRP)
+	}
 
 	// Notify status pending to backend
 	s.notifyMsg(map[string]string{
@@ -757,10 +1592,25 @@ func (s *Server) backup(backupDirectoryID string, policyID string, name string,
 		"status":    statusPendingFile,
 	})
 
-	_ = s.poolDir.Submit(s.backupWorker(ctx, actionCreateRP, backupDirectoryID, limitUpload, limitDownload, progressOutput, chErr))
+	if err := s.poolDir.Submit(s.backupWorker(ctx, actionCreateRP, backupDirectoryID, limitUpload, limitDownload, progressOutput, chErr, j)); err != nil {
+		s.logger.Error("Submit backup worker error", zap.Error(err))
+		s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+		return err
+	}
 	return <-chErr
 }
 
+// runIsolated runs job, turning a panic into an error so that a broken backup
+// neither crashes the agent nor stops the other backups.
+func runIsolated(job func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("recovered from panic: %v", r)
+		}
+	}()
+	return job()
+}
+
 // requestBackup performs a request backup flow.
 func (s *Server) requestBackup(backupDirectoryID string, name string, storageType string) error {
 	if err := s.backupClient.RequestBackupDirectory(backupDirectoryID, &backupapi.CreateManualBackupRequest{
@@ -781,12 +1631,40 @@ func (s *Server) reportRestoreCompleted(w io.Writer) {
 	_, _ = w.Write([]byte("Restore completed."))
 }
 
-func (s *Server) restore(machineID, actionID string, createdAt string, restoreSessionKey string, recoveryPointID string, destDir string, storageVaultID string, limitUpload, limitDownload int, progressOutput io.Writer) error {
+// restore restores recovery point recoveryPointID under destDir. The restore
+// profile called profileName, the default one when empty, sets the resources
+// used and the download limit, see GetRestoreProfile.
+func (s *Server) restore(machineID, actionID string, createdAt string, restoreSessionKey string, recoveryPointID string, destDir string, stripPrefix string, metadataOnly bool, force bool, profileName string, storageVaultID string, limitUpload int, progressOutput io.Writer) error {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Save context of worker to map for manage
-	s.mapActionContext[actionID] = contextStruct{ctx: ctx, cancel: cancel}
+	// Save context of worker to map for manage. Restores of other recovery
+	// points or into other destinations run side by side, each with the
+	// storage vault, chunk budget and chunk cache of its own profile; they
+	// share the open file budget of the client and the index cache, whose
+	// files are written atomically.
+	if err := s.startRestore(actionID, contextStruct{
+		ctx:             ctx,
+		cancel:          cancel,
+		action:          notifier.ActionRestore,
+		recoveryPointID: recoveryPointID,
+		startedAt:       time.Now(),
+		destDir:         filepath.Clean(destDir),
+	}); err != nil {
+		s.logger.Error("Refuse restore", zap.Error(err))
+		s.notifyStatusFailed(actionID, err.Error())
+		return err
+	}
+	defer s.deleteAction(actionID)
+	startedAt := time.Now()
+
+	profile, err := backupapi.GetRestoreProfile(profileName)
+	if err != nil {
+		s.logger.Error("Refuse restore", zap.Error(err))
+		s.notifyStatusFailed(actionID, err.Error())
+		return err
+	}
+	s.logger.Info("Restore profile", zap.String("action_id", actionID), zap.Any("profile", profile))
 
 	_, cachePath, err := support.CheckPath()
 	if err != nil {
@@ -809,7 +1687,13 @@ func (s *Server) restore(machineID, actionID string, createdAt string, restoreSe
 		s.notifyStatusFailed(actionID, err.Error())
 		return err
 	}
-	storageVault, _ := s.NewStorageVault(*vault, actionID, limitUpload, limitDownload)
+	storageVault, err := s.NewStorageVault(*vault, actionID, limitUpload, profile.LimitDownload)
+	if err != nil {
+		s.logger.Error("NewStorageVault error", zap.Error(err))
+		s.notifyStatusFailed(actionID, err.Error())
+		return err
+	}
+	defer s.logVaultRequests(storageVault)
 
 	s.logger.Sugar().Info("Get recovery point info", recoveryPointID)
 	rp, err := s.backupClient.GetRecoveryPointInfo(recoveryPointID)
@@ -819,51 +1703,43 @@ func (s *Server) restore(machineID, actionID string, createdAt string, restoreSe
 		return err
 	}
 
-	_, err = os.Stat(filepath.Join(cachePath, machineID, recoveryPointID, "index.json"))
-	if err != nil {
-		if os.IsNotExist(err) {
-			s.logger.Sugar().Info("Get index.json from storage", zap.String("key", filepath.Join(machineID, recoveryPointID, "index.json")))
-			buf, err := storageVault.GetObject(filepath.Join(machineID, recoveryPointID, "index.json"))
-			if err == nil {
-				_ = os.MkdirAll(filepath.Join(cachePath, machineID, recoveryPointID), 0700)
-				if err := ioutil.WriteFile(filepath.Join(cachePath, machineID, recoveryPointID, "index.json"), buf, 0700); err != nil {
-					s.logger.Error("Error writing index.json file", zap.Error(err), zap.String("key", filepath.Join(machineID, recoveryPointID, "index.json")))
-					s.notifyStatusFailed(actionID, err.Error())
-					return err
-				}
-			} else {
-				s.logger.Error("Error get index.json from storage", zap.Error(err), zap.String("key", filepath.Join(machineID, recoveryPointID, "index.json")))
-				s.notifyStatusFailed(actionID, err.Error())
-				return err
-			}
-		} else {
-			s.logger.Error("Error stat index.json file", zap.Error(err))
-			s.notifyStatusFailed(actionID, err.Error())
-			return err
-		}
+	// A verified restore trusts only the index in the storage vault matching
+	// the hash recorded by the server, never the local cache.
+	verify := viper.GetBool("restore_verify")
+	indexCachePath := cachePath
+	if verify {
+		indexCachePath = ""
 	}
-
-	index := cache.Index{}
-
-	buf, err := ioutil.ReadFile(filepath.Join(cachePath, machineID, recoveryPointID, "index.json"))
+	loaded, _, err := s.loadIndexUnder(ctx, storageVault, indexCachePath, machineID, recoveryPointID, rp.IndexHash, stripPrefix)
 	if err != nil {
-		s.logger.Error("Error read index.json file", zap.Error(err), zap.String("key", filepath.Join(machineID, recoveryPointID, "index.json")))
+		s.logger.Error("Error load index", zap.Error(err), zap.String("recovery_point_id", recoveryPointID))
 		s.notifyStatusFailed(actionID, err.Error())
 		return err
-	} else {
-		_ = json.Unmarshal([]byte(buf), &index)
 	}
+	// A metadata only restore downloads no chunk.
+	if !metadataOnly {
+		if err := s.checkChunks(ctx, storageVault, machineID, loaded); err != nil {
+			s.logger.Error("Error check index", zap.Error(err), zap.String("recovery_point_id", recoveryPointID))
+			s.notifyStatusFailed(actionID, err.Error())
+			return err
+		}
+	}
+	index := *loaded
 
-	hash := sha256.Sum256(buf)
-	if hex.EncodeToString(hash[:]) != rp.IndexHash {
-		s.logger.Error("index.json is corrupted", zap.Error(err))
-		s.notifyStatusFailed(actionID, err.Error())
-		return err
+	if stripPrefix != "" {
+		if index, err = backupapi.StripPrefix(index, stripPrefix); err != nil {
+			s.logger.Error("Error strip prefix", zap.Error(err))
+			s.notifyStatusFailed(actionID, err.Error())
+			return err
+		}
 	}
 
 	s.notifyMsg(map[string]string{
-		"action_id": actionID,
-		"status":    statusDownloading,
+		"action_id":         actionID,
+		"status":            statusDownloading,
+		"recovery_point_id": recoveryPointID,
+		"dest_directory":    filepath.Clean(destDir),
+		"restore_profile":   profile.Name,
 	})
 
 	s.reportStartDownload(progressOutput)
@@ -874,12 +1750,23 @@ func (s *Server) restore(machineID, actionID string, createdAt string, restoreSe
 		s.notifyStatusFailed(actionID, err.Error())
 		return err
 	}
-	progressRestore := s.newDownloadProgress(recoveryPointID, itemTodo)
+	progressRestore := s.newDownloadProgress(actionID, recoveryPointID, filepath.Clean(destDir), itemTodo, storageVault)
+	s.setActionProgress(actionID, statusDownloading, progressRestore, itemTodo)
 	progressRestore.Start()
 	defer progressRestore.Done()
 
+	if metadataOnly {
+		return s.restoreMetadata(ctx, actionID, recoveryPointID, filepath.Clean(destDir), index, startedAt, progressRestore, progressOutput)
+	}
+
+	client, err := s.backupClient.RestoreClient(ctx, storageVault, machineID, recoveryPointID, restoreKey)
+	if err != nil {
+		s.logger.Error("Error unwrap content key", zap.Error(err), zap.String("recovery_point_id", recoveryPointID))
+		s.notifyStatusFailed(actionID, err.Error())
+		return err
+	}
 	s.logger.Sugar().Info("Restore directory", filepath.Clean(destDir))
-	if err := s.backupClient.RestoreDirectory(ctx, index, filepath.Clean(destDir), storageVault, restoreKey, progressRestore); err != nil {
+	if err := client.RestoreDirectory(ctx, index, filepath.Clean(destDir), force, profile, storageVault, restoreKey, progressRestore); err != nil {
 		s.logger.Error("failed to download file", zap.Error(err))
 		cancel()
 		s.notifyStatusFailed(actionID, err.Error())
@@ -887,8 +1774,40 @@ func (s *Server) restore(machineID, actionID string, createdAt string, restoreSe
 		return err
 	}
 
-	// remove worker out of manage context mapping
-	delete(s.mapActionContext, actionID)
+	rewrites := backupapi.RewrittenSymlinks(index, filepath.Clean(destDir))
+	if len(rewrites) > 0 {
+		s.logger.Info("Symlink targets rewritten into the restore destination", zap.Int("count", len(rewrites)), zap.Any("symlinks", rewrites))
+	}
+
+	var verified int
+	if verify {
+		var mismatches []backupapi.Mismatch
+		verified, mismatches, err = s.backupClient.VerifyRestore(ctx, index, filepath.Clean(destDir))
+		if err == nil && len(mismatches) > 0 {
+			err = fmt.Errorf("%w: %d files, first %s: %s", backupapi.ErrorRestoreMismatch, len(mismatches), mismatches[0].Path, mismatches[0].Reason)
+		}
+		if err != nil {
+			s.logger.Error("Restore verification failed", zap.Error(err))
+			s.notifyStatusFailed(actionID, err.Error())
+			progressRestore.Done()
+			return err
+		}
+		s.logger.Info("Restore verified", zap.Int("files", verified))
+	}
+
+	// The checksums let the restored tree be checked with sha256sum alone.
+	var manifestPath string
+	if fi, errStat := os.Stat(destDir); errStat == nil && fi.IsDir() && viper.GetBool("restore_checksum_manifest") {
+		manifestPath = filepath.Join(destDir, backupapi.ChecksumManifestName+"."+recoveryPointID)
+		n, err := backupapi.WriteChecksumManifest(manifestPath, index, filepath.Clean(destDir))
+		if err != nil {
+			s.logger.Error("Error write checksum manifest", zap.Error(err), zap.String("path", manifestPath))
+			s.notifyStatusFailed(actionID, err.Error())
+			progressRestore.Done()
+			return err
+		}
+		s.logger.Info("Checksum manifest written", zap.String("path", manifestPath), zap.Int("files", n))
+	}
 
 	select {
 	case <-ctx.Done():
@@ -896,9 +1815,31 @@ func (s *Server) restore(machineID, actionID string, createdAt string, restoreSe
 	default:
 		s.reportRestoreCompleted(progressOutput)
 		progressRestore.Done()
-		s.notifyMsg(map[string]string{
-			"action_id": actionID,
-			"status":    statusComplete,
+		msg := map[string]string{
+			"action_id":         actionID,
+			"status":            statusComplete,
+			"recovery_point_id": recoveryPointID,
+			"dest_directory":    filepath.Clean(destDir),
+			"restore_profile":   profile.Name,
+		}
+		if verify {
+			msg["verified_files"] = strconv.Itoa(verified)
+		}
+		if len(rewrites) > 0 {
+			msg["rewritten_symlinks"] = strconv.Itoa(len(rewrites))
+		}
+		if manifestPath != "" {
+			msg["checksum_manifest"] = manifestPath
+		}
+		s.notifyMsg(msg)
+		s.notifyResult(notifier.Event{
+			Action:          notifier.ActionRestore,
+			ActionID:        actionID,
+			RecoveryPointID: recoveryPointID,
+			Status:          statusComplete,
+			Duration:        time.Since(startedAt),
+			TotalSize:       itemTodo.Bytes,
+			TotalFiles:      int64(itemTodo.Items),
 		})
 	}
 
@@ -906,10 +1847,14 @@ func (s *Server) restore(machineID, actionID string, createdAt string, restoreSe
 }
 
 // requestRestore performs a request restore flow.
-func (s *Server) requestRestore(recoveryPointID string, machineID string, path string) error {
-	if err := s.backupClient.RequestRestore(recoveryPointID, &backupapi.CreateRestoreRequest{
-		MachineID: machineID,
-		Path:      path,
+func (s *Server) requestRestore(recoveryPointID string, machineID string, path string, stripPrefix string, metadataOnly bool, force bool, profile string) error {
+	if _, err := s.backupClient.RequestRestore(recoveryPointID, &backupapi.CreateRestoreRequest{
+		MachineID:    machineID,
+		Path:         path,
+		StripPrefix:  stripPrefix,
+		MetadataOnly: metadataOnly,
+		Force:        force,
+		Profile:      profile,
 	}); err != nil {
 		return err
 	}
@@ -917,15 +1862,39 @@ func (s *Server) requestRestore(recoveryPointID string, machineID string, path s
 }
 
 func (s *Server) NewStorageVault(storageVault backupapi.StorageVault, actionID string, limitUpload, limitDownload int) (storage_vault.StorageVault, error) {
+	if s.testStorageVault != nil {
+		return s.testStorageVault, nil
+	}
+	vault, err := s.newVault(storageVault, actionID, limitUpload, limitDownload)
+	if err != nil {
+		return nil, err
+	}
+	return naming.FromConfig(budget.FromConfig(vault))
+}
+
+// ErrorStorageVaultNotSupported is returned for a storage vault of a type the
+// agent can not store to.
+var ErrorStorageVaultNotSupported = errors.New("storage vault type not supported")
+
+// newVault returns the storage vault of the type of storageVault behind the
+// cool-down gate of the agent.
+func (s *Server) newVault(storageVault backupapi.StorageVault, actionID string, limitUpload, limitDownload int) (storage_vault.StorageVault, error) {
 	switch storageVault.StorageVaultType {
 	case "S3":
 		newS3Default, err := s3.NewS3Default(storageVault, actionID, limitUpload, limitDownload, s.backupClient)
 		if err != nil {
 			return nil, err
 		}
-		return newS3Default, nil
+		return cooldown.New(newS3Default, s.cooldown), nil
+	case local.StorageVaultType:
+		// The storage bucket of a local storage vault is its root directory.
+		newLocal, err := local.New(storageVault.ID, actionID, storageVault.StorageBucket)
+		if err != nil {
+			return nil, err
+		}
+		return cooldown.New(newLocal, s.cooldown), nil
 	default:
-		return nil, fmt.Errorf(fmt.Sprintf("storage vault type not supported %s", storageVault.StorageVaultType))
+		return nil, fmt.Errorf("%w: %s", ErrorStorageVaultNotSupported, storageVault.StorageVaultType)
 	}
 }
 
@@ -951,23 +1920,148 @@ func WalkerItem(index *cache.Index, p *progress.Progress, logger *zap.Logger) (p
 	return st, nil
 }
 
-func WalkerDir(dir string, index *cache.Index, p *progress.Progress, logger *zap.Logger) (progress.Stat, int64, error) {
+// ErrorBackupLimitExceeded is returned when a backup grows past backup_max_files or backup_max_bytes.
+var ErrorBackupLimitExceeded = errors.New("backup exceeds configured limit")
+
+// ErrorIndexCorrupted is returned when a stored index does not match the hash
+// recorded for its recovery point.
+var ErrorIndexCorrupted = errors.New("index is corrupted")
+
+// walkLimits bounds the number of files and bytes of a single backup, zero means unlimited.
+// Files outside age and items matched by exclude are left out before they count.
+type walkLimits struct {
+	maxFiles int64
+	maxBytes uint64
+	warnOnly bool
+	age      ageWindow
+	exclude  *backupapi.Excluder
+}
+
+// ErrorRootSymlink is returned when the root of a backup is a symlink and
+// refuse_root_symlink is set.
+var ErrorRootSymlink = errors.New("backup root is a symlink")
+
+// resolveRoot returns the path walked for the backup root dir. A root which is
+// itself a symlink is resolved once, so that the tree it points to is backed up
+// rather than the link; symlinks below the root are never followed.
+func resolveRoot(dir string) (string, error) {
+	fi, err := os.Lstat(dir)
+	if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		return dir, nil
+	}
+	if viper.GetBool("refuse_root_symlink") {
+		return "", fmt.Errorf("%w: %s", ErrorRootSymlink, dir)
+	}
+	return filepath.EvalSymlinks(dir)
+}
+
+func walkLimitsFromConfig() walkLimits {
+	return walkLimits{
+		maxFiles: viper.GetInt64("backup_max_files"),
+		maxBytes: uint64(viper.GetSizeInBytes("backup_max_bytes")),
+		warnOnly: viper.GetString("backup_limit_action") == "warn",
+	}
+}
+
+func (l walkLimits) check(files int64, bytes uint64) error {
+	if l.maxFiles > 0 && files > l.maxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrorBackupLimitExceeded, l.maxFiles)
+	}
+	if l.maxBytes > 0 && bytes > l.maxBytes {
+		return fmt.Errorf("%w: more than %d bytes", ErrorBackupLimitExceeded, l.maxBytes)
+	}
+	return nil
+}
+
+// WalkerDir adds the items found under dir to index. An item which can not be
+// read fails the walk, unless denied records it as skipped for lack of
+// permission or errs lets the backup go on without it. A dir which is a
+// symlink is walked at its target, recorded in index next to dir.
+func WalkerDir(dir string, index *cache.Index, p *progress.Progress, limits walkLimits, errs, denied *fileErrors, logger *zap.Logger) (progress.Stat, int64, error) {
 	p.Start()
 	defer p.Done()
 
+	index.Path = dir
+	resolved, err := resolveRoot(dir)
+	if err != nil {
+		return progress.Stat{}, 0, err
+	}
+	if resolved != dir {
+		logger.Info("Backup root is a symlink, walking its target", zap.String("path", dir), zap.String("resolved_path", resolved))
+		index.ResolvedPath = resolved
+		dir = resolved
+	}
+
 	var lastDir string
+	var warned bool
+	var fileBytes uint64
+	preserveACLs := viper.GetBool("preserve_acls")
+	oneFileSystem := viper.GetBool("one_file_system")
+	var rootDevice uint64
 
 	var st progress.Stat
-	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
-		if err != nil {
+	skip := func(path string, fi os.FileInfo, err error) error {
+		if path == dir {
 			return err
 		}
+		if errors.Is(err, fs.ErrPermission) && denied.add(path, err, 0) == nil {
+			logger.Warn("Skip item without permission ", zap.Error(err), zap.String("path", path))
+			p.Report(progress.Stat{Errors: true})
+			if fi != nil && fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if errSkip := errs.add(path, err, uint64(len(index.Items))+1); errSkip != nil {
+			return errSkip
+		}
+		logger.Warn("Skip unreadable item ", zap.Error(err), zap.String("path", path))
+		p.Report(progress.Stat{Errors: true})
+		if fi != nil && fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	err = filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return skip(path, fi, err)
+		}
 
 		if filepath.Dir(path) != lastDir {
 			lastDir = filepath.Dir(path)
 			logger.Sugar().Infof("WalkerDir scanning: %s", lastDir)
 		}
 
+		if path != dir {
+			if rel, errRel := filepath.Rel(dir, path); errRel == nil && limits.exclude.ShouldExclude(rel, fi.IsDir()) {
+				logger.Debug("Skip excluded item", zap.String("path", path))
+				index.Excluded++
+				if fi.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+		}
+
+		if fi.Mode().IsRegular() && limits.age.excludes(fi.ModTime()) {
+			logger.Debug("Skip file outside age window", zap.String("path", path), zap.Time("mod_time", fi.ModTime()))
+			index.AgeSkipped++
+			return nil
+		}
+
+		// Mount points are kept as empty directories, their content is left
+		// out like the --one-file-system of other backup tools.
+		var mountPoint bool
+		if oneFileSystem && fi.IsDir() {
+			if device, ok := support.DeviceID(fi); ok {
+				if path == dir {
+					rootDevice = device
+				} else if device != rootDevice {
+					mountPoint = true
+				}
+			}
+		}
+
 		s := progress.Stat{
 			Items: 1,
 			Bytes: uint64(fi.Size()),
@@ -975,16 +2069,41 @@ func WalkerDir(dir string, index *cache.Index, p *progress.Progress, logger *zap
 
 		node, err := cache.NodeFromFileInfo(dir, path, fi)
 		if err != nil {
-			return err
+			return skip(path, fi, err)
+		}
+		if preserveACLs && node.Type != "symlink" {
+			node.SecurityDescriptor, err = support.GetSecurityDescriptor(path)
+			if err != nil {
+				logger.Warn("Failed to read ACL ", zap.Error(err), zap.String("path", path))
+			}
 		}
 		index.Items[path] = node
 
 		if !fi.IsDir() {
 			index.TotalFiles++
+			fileBytes += node.Size
+		}
+		if node.Type == "blockdev" {
+			s.Bytes = node.Size
 		}
 
 		p.Report(s)
 		st.Add(s)
+
+		if errLimit := limits.check(index.TotalFiles, fileBytes); errLimit != nil {
+			if !limits.warnOnly {
+				return errLimit
+			}
+			if !warned {
+				warned = true
+				logger.Warn("Backup limit exceeded, continuing", zap.Error(errLimit), zap.String("dir", dir))
+			}
+		}
+		if mountPoint {
+			logger.Info("Skip mount point on another filesystem", zap.String("path", path))
+			index.SkippedMounts = append(index.SkippedMounts, path)
+			return filepath.SkipDir
+		}
 		return nil
 	})
 	if err != nil {
@@ -995,31 +2114,98 @@ func WalkerDir(dir string, index *cache.Index, p *progress.Progress, logger *zap
 
 type backupJob func()
 
-func (s *Server) uploadFileWorker(ctx context.Context, itemInfo *cache.Node, latestInfo *cache.Node, cacheWriter *cache.Repository, storageVault storage_vault.StorageVault,
-	wg *sync.WaitGroup, size *uint64, errCh *error, p *progress.Progress, pipe chan<- *cache.Chunk, rpID, bdID string) backupJob {
+// uploadOptions is what every file of a backup is uploaded with.
+type uploadOptions struct {
+	cacheWriter  *cache.Repository
+	storageVault storage_vault.StorageVault
+	progress     *progress.Progress
+	pipe         chan<- *cache.Chunk
+	rpID         string
+	bdID         string
+
+	stable   backupapi.StableCheck
+	trust    *backupapi.MtimeCheck
+	chunking cache.Chunking
+	hashAlgo string
+	dedup    *backupapi.FileDedup
+	journal  *journal
+
+	// errs, unstable and denied collect the files left out, a share of
+	// total, the number of items of the backup.
+	errs     *fileErrors
+	unstable *fileErrors
+	denied   *fileErrors
+	total    uint64
+
+	// wg counts the files being uploaded, size sums the bytes they stored and
+	// err is set by the first failure stopping the backup.
+	wg   *sync.WaitGroup
+	size *uint64
+	err  *error
+}
+
+// uploadFileWorker uploads the changes of itemInfo since latestInfo, in
+// storage class class when not empty.
+func (s *Server) uploadFileWorker(ctx context.Context, opts *uploadOptions, itemInfo *cache.Node, latestInfo *cache.Node, class string) backupJob {
 	return func() {
-		defer wg.Done()
+		defer opts.wg.Done()
 		select {
 		case <-ctx.Done():
 			return
 		default:
 			ctx, cancel := context.WithCancel(ctx)
 			defer cancel()
-			storageSize, err := s.backupClient.UploadFile(ctx, s.chunkPool, latestInfo, itemInfo, cacheWriter, storageVault, p, pipe, rpID, bdID)
+			storageSize, err := s.backupClient.UploadFile(ctx, s.chunkPool, latestInfo, itemInfo, opts.cacheWriter, opts.storageVault, opts.progress, opts.pipe, opts.rpID, opts.bdID,
+				opts.stable, opts.trust, opts.chunking, opts.hashAlgo, opts.dedup, class)
+			if errors.Is(err, backupapi.ErrorFileUnstable) {
+				_ = opts.unstable.add(itemInfo.AbsolutePath, err, opts.total)
+				s.logger.Warn("Skip file still being written", zap.Error(err))
+				return
+			}
+			if errors.Is(err, fs.ErrPermission) && opts.denied.add(itemInfo.AbsolutePath, err, opts.total) == nil {
+				s.logger.Warn("Skip file without permission", zap.Error(err))
+				opts.progress.Report(progress.Stat{Errors: true})
+				return
+			}
 			if err != nil {
+				if ctx.Err() == nil && !errors.Is(err, backupapi.ErrorGotCancelRequest) && !errors.Is(err, storage_vault.ErrRequestBudgetExhausted) {
+					if err = opts.errs.add(itemInfo.AbsolutePath, err, opts.total); err == nil {
+						s.logger.Warn("Skip file failed to upload", zap.String("path", itemInfo.AbsolutePath))
+						opts.progress.Report(progress.Stat{Errors: true})
+						return
+					}
+				}
 				s.logger.Error("uploadFileWorker error", zap.Error(err))
-				*errCh = err
+				*opts.err = err
 				cancel()
 				return
 			}
 
-			*size += storageSize
+			*opts.size += storageSize
+			if itemInfo.Type == "file" {
+				if err := opts.journal.record(itemInfo); err != nil {
+					s.logger.Warn("failed to record file in backup journal", zap.Error(err))
+				}
+			}
 		}
 	}
 }
 
-func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.CreateRecoveryPointResponse, backupDirectoryID string, limitUpload, limitDownload int, progressOutput io.Writer, errCh chan<- error) backupJob {
+func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.CreateRecoveryPointResponse, backupDirectoryID string, limitUpload, limitDownload int, progressOutput io.Writer, errCh chan<- error, j *journal) backupJob {
 	return func() {
+		defer func() {
+			if r := recover(); r != nil {
+				err := fmt.Errorf("recovered from panic: %v", r)
+				s.logger.Error("backupWorker panic", zap.Error(err), zap.Stack("stack"))
+				s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+				select {
+				case errCh <- err:
+				default:
+				}
+			}
+		}()
+
+		startedAt := time.Now()
 		s.notifyMsg(map[string]string{
 			"action_id": actionCreateRP.ID,
 			"status":    statusUploadFile,
@@ -1054,6 +2240,7 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 			errCh <- err
 			return
 		}
+		defer s.logVaultRequests(storageVault)
 
 		// Scaning failed backup list
 		s.logger.Sugar().Info("Scanning failed backup list")
@@ -1063,33 +2250,103 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 			errCh <- errScanListBackupFailed
 			return
 		}
-
-		if listBackupFailed != nil {
-			// Uploading failed backup list to storage
-			s.logger.Sugar().Info("Uploading failed backup list to storage")
-			errUploadListBackupFailed := s.uploadListBackupFailed(listBackupFailed, storageVault)
-			if errUploadListBackupFailed != nil {
-				errCh <- errUploadListBackupFailed
-				return
-			}
-		}
-
-		mcID := s.backupClient.Id
-		rpID := actionCreateRP.RecoveryPoint.ID
-		bdID := bd.ID
-		progressScan := s.newProgressScanDir(rpID)
-
-		index := cache.NewIndex(bd.ID, rpID)
-		chunks := cache.NewChunk(bdID, rpID)
-
-		s.logger.Sugar().Infof("Scanning directory %s", backupDirectoryID)
-		itemTodo, totalFiles, err := WalkerDir(bd.Path, index, progressScan, s.logger)
+
+		dryRun := viper.GetBool("dry_run")
+		if listBackupFailed != nil && !dryRun {
+			// Uploading failed backup list to storage
+			s.logger.Sugar().Info("Uploading failed backup list to storage")
+			errUploadListBackupFailed := s.uploadListBackupFailed(ctx, listBackupFailed, storageVault)
+			if errUploadListBackupFailed != nil {
+				errCh <- errUploadListBackupFailed
+				return
+			}
+		}
+
+		mcID := s.backupClient.Id
+		rpID := actionCreateRP.RecoveryPoint.ID
+		bdID := bd.ID
+		progressScan := s.newProgressScanDir(rpID)
+
+		index := cache.NewIndex(bd.ID, rpID)
+		chunks := cache.NewChunk(bdID, rpID)
+
+		s.logger.Sugar().Infof("Scanning directory %s", backupDirectoryID)
+		errs, err := fileErrorsFromConfig()
+		if err != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+			errCh <- err
+			return
+		}
+		denied, err := permissionErrorsFromConfig()
+		if err != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+			errCh <- err
+			return
+		}
+		stable, err := backupapi.StableCheckFromConfig(s.localDirectory(bdID))
+		if err != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+			errCh <- err
+			return
+		}
+		trust, err := backupapi.MtimeCheckFromConfig(s.localDirectory(bdID))
+		if err != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+			errCh <- err
+			return
+		}
+		classRules, err := backupapi.ClassRulesFromConfig()
+		if err != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+			errCh <- err
+			return
+		}
+		chunking, err := backupapi.ChunkingFromConfig()
+		if err != nil {
+			s.logger.Warn("invalid chunking, using the default one", zap.Error(err))
+		}
+		index.Chunking = &chunking
+		if _, err := backupapi.CompressionFromConfig(); err != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+			errCh <- err
+			return
+		}
+		hashAlgo, err := backupapi.FileHashFromConfig()
+		if err != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+			errCh <- err
+			return
+		}
+		dedup := backupapi.FileDedupFromConfig(hashAlgo)
+		limits := walkLimitsFromConfig()
+		limits.age, err = ageWindowFromConfig(s.localDirectory(bdID), startedAt)
+		if err != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+			errCh <- err
+			return
+		}
+		limits.exclude, err = backupapi.ExcluderFromConfig(bd.Path)
+		if err != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+			errCh <- err
+			return
+		}
+		itemTodo, totalFiles, err := WalkerDir(bd.Path, index, progressScan, limits, errs, denied, s.logger)
 		if err != nil {
 			s.notifyStatusFailed(actionCreateRP.ID, err.Error())
 			s.logger.Error("WalkerDir error", zap.Error(err))
 			errCh <- err
 			return
 		}
+		if len(index.SkippedMounts) > 0 {
+			s.logger.Info("Mount points left out of backup", zap.String("dir", bd.Path), zap.Strings("paths", index.SkippedMounts))
+		}
+		if index.AgeSkipped > 0 {
+			s.logger.Info("Files left out of backup by age", zap.String("dir", bd.Path), zap.Int64("files", index.AgeSkipped))
+		}
+		if index.Excluded > 0 {
+			s.logger.Info("Items left out of backup by exclude and include patterns", zap.String("dir", bd.Path), zap.Int64("items", index.Excluded))
+		}
 
 		_, cachePath, err := support.CheckPath()
 		if err != nil {
@@ -1103,9 +2360,11 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 			return
 		}
 
+		parentDepth := 0
 		if lrp != nil {
 			// Store index
-			errStoreIndexs := s.storeIndexs(cachePath, mcID, lrp, storageVault)
+			var errStoreIndexs error
+			parentDepth, errStoreIndexs = s.storeIndexs(ctx, cachePath, mcID, lrp, storageVault)
 			if errStoreIndexs != nil {
 				s.notifyStatusFailed(actionCreateRP.ID, errStoreIndexs.Error())
 				errCh <- errStoreIndexs
@@ -1139,6 +2398,7 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 					} else {
 						chunks.Chunks[key] = []string{fmt.Sprintf("%s-%s", strconv.Itoa(1), receiver.Chunks[key][1])}
 					}
+					mergeClasses(chunks, receiver)
 
 					if time.Now().Minute()%5 == 0 && time.Now().Second() == 0 {
 						// Save chunks to chunk.json
@@ -1159,9 +2419,45 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 
 		var storageSize uint64
 		var errFileWorker error
-		progressUpload := s.newUploadProgress(rpID, itemTodo)
+		// The progress state of a dry run would replace the one of an
+		// interrupted backup.
+		var state *backupState
+		if !dryRun {
+			state = s.newBackupState(actionCreateRP.ID, bdID, rpID, itemTodo)
+		}
+		defer func() {
+			if err := state.remove(); err != nil {
+				s.logger.Warn("failed to remove progress state", zap.Error(err))
+			}
+		}()
+		progressUpload := s.newUploadProgress(actionCreateRP.ID, bdID, rpID, itemTodo, state, storageVault)
+		s.setActionProgress(actionCreateRP.ID, statusUploadFile, progressUpload, itemTodo)
 
 		var wg sync.WaitGroup
+		// Files still being written are left out, whatever continue_on_error.
+		unstable := &fileErrors{}
+
+		opts := &uploadOptions{
+			cacheWriter:  cacheWriter,
+			storageVault: storageVault,
+			progress:     progressUpload,
+			pipe:         pipe,
+			rpID:         rpID,
+			bdID:         bdID,
+			stable:       stable,
+			trust:        trust,
+			chunking:     chunking,
+			hashAlgo:     hashAlgo,
+			dedup:        dedup,
+			journal:      j,
+			errs:         errs,
+			unstable:     unstable,
+			denied:       denied,
+			total:        uint64(len(index.Items)),
+			wg:           &wg,
+			size:         &storageSize,
+			err:          &errFileWorker,
+		}
 
 		progressUpload.Start()
 		defer progressUpload.Cancel()
@@ -1183,10 +2479,14 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 				st.Items = 1
 				progressUpload.Report(st)
 
-				if itemInfo.Type == "file" {
+				if itemInfo.Type == "file" || itemInfo.Type == "blockdev" {
 					lastInfo := latestIndex.Items[itemInfo.AbsolutePath]
+					// Files uploaded before the backup was interrupted are stored already.
+					if node := j.lookup(itemInfo.AbsolutePath, itemInfo.ModTime, itemInfo.Size); node != nil {
+						lastInfo = node
+					}
 					wg.Add(1)
-					_ = s.pool.Submit(s.uploadFileWorker(ctx, itemInfo, lastInfo, cacheWriter, storageVault, &wg, &storageSize, &errFileWorker, progressUpload, pipe, rpID, bdID))
+					_ = s.pool.Submit(s.uploadFileWorker(ctx, opts, itemInfo, lastInfo, classRules.Class(itemInfo.AbsolutePath)))
 				}
 			}
 		}
@@ -1196,6 +2496,70 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 		}()
 		<-done
 
+		// Items which failed are left out of the recovery point.
+		failedItems := errs.failed()
+		for _, path := range failedItems {
+			if node, ok := index.Items[path]; ok {
+				delete(index.Items, path)
+				if node.Type != "dir" {
+					totalFiles--
+					index.TotalFiles--
+				}
+			}
+		}
+		if errFileWorker == nil {
+			if err := errs.final(uint64(len(index.Items) + len(failedItems))); err != nil {
+				s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+				errCh <- err
+				return
+			}
+		}
+		if len(failedItems) > 0 {
+			s.logger.Warn("Backup goes on without failed items", zap.Int("failed", len(failedItems)))
+		}
+		unstableItems := unstable.failed()
+		for _, path := range unstableItems {
+			if _, ok := index.Items[path]; ok {
+				delete(index.Items, path)
+				totalFiles--
+				index.TotalFiles--
+			}
+		}
+		if len(unstableItems) > 0 {
+			s.logger.Warn("Backup goes on without files still being written", zap.Strings("paths", unstableItems))
+		}
+		// Items denied while walking never made it to the index, files denied
+		// when read are left out too.
+		index.PermissionDenied = denied.failed()
+		for _, path := range index.PermissionDenied {
+			if _, ok := index.Items[path]; ok {
+				delete(index.Items, path)
+				totalFiles--
+				index.TotalFiles--
+			}
+		}
+		if len(index.PermissionDenied) > 0 {
+			s.logger.Warn("Backup goes on without items denied by permissions", zap.Strings("paths", index.PermissionDenied))
+		}
+
+		if dryRun {
+			s.finishDryRun(ctx, actionCreateRP.ID, filepath.Join(cachePath, mcID, rpID), progressUpload, itemTodo, totalFiles, errFileWorker, errCh)
+			return
+		}
+
+		// All chunks are uploaded, the metadata of the recovery point is
+		// written and uploaded in a phase of its own.
+		progressUpload.Done()
+		s.notifyMsg(map[string]string{
+			"action_id": actionCreateRP.ID,
+			"status":    statusFinalizing,
+		})
+		progressFinalize := s.newFinalizeProgress(rpID, finalizeObjects, storageVault)
+		s.setActionProgress(actionCreateRP.ID, statusFinalizing, progressFinalize, progress.Stat{Items: finalizeObjects})
+		progressFinalize.Start()
+		defer progressFinalize.Cancel()
+
+		s.placeChunks(ctx, storageVault, chunks)
 		s.logger.Sugar().Info("Save all chunks to chunk.json")
 		errSaveChunks := cacheWriter.SaveChunk(chunks)
 		if errSaveChunks != nil {
@@ -1234,16 +2598,23 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 
 		// Put chunks
 		s.logger.Sugar().Info("Put chunk.json to storage", zap.String("key", filepath.Join(mcID, rpID, "chunk.json")))
-		errPutChunks := s.putChunks(cachePath, mcID, rpID, chunkFailedPath, storageVault)
+		errPutChunks := s.putChunks(ctx, cachePath, mcID, rpID, chunkFailedPath, storageVault, progressFinalize)
 		if errPutChunks != nil {
 			s.notifyStatusFailed(actionCreateRP.ID, errPutChunks.Error())
 			errCh <- errPutChunks
 			return
 		}
 
+		// The content key wrapped to the recipients of chunk encryption.
+		if errPutKeys := s.backupClient.PutContentKeys(ctx, storageVault, mcID, rpID); errPutKeys != nil {
+			s.notifyStatusFailed(actionCreateRP.ID, errPutKeys.Error())
+			errCh <- errPutKeys
+			return
+		}
+
 		// Put file.csv
 		s.logger.Sugar().Info("Put file.csv to storage", zap.String("key", filepath.Join(mcID, rpID, "file.csv")))
-		errPutFiles := s.putFiles(cachePath, mcID, rpID, fileFailedPath, storageVault)
+		errPutFiles := s.putFiles(ctx, cachePath, mcID, rpID, fileFailedPath, storageVault, progressFinalize)
 		if errPutFiles != nil {
 			s.notifyStatusFailed(actionCreateRP.ID, errPutFiles.Error())
 			errCh <- errPutFiles
@@ -1270,6 +2641,30 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 			return
 		}
 
+		// The uploaded chunks are read back before the index which makes the
+		// recovery point usable is put.
+		var verified int
+		verifyRate := viper.GetFloat64("backup_verify_rate")
+		if verifyRate > 0 {
+			var mismatches []backupapi.Mismatch
+			verified, mismatches, err = s.backupClient.VerifyBackup(ctx, index, storageVault, verifyRate)
+			if err == nil && len(mismatches) > 0 {
+				err = fmt.Errorf("%w: %d files, first %s: %s", backupapi.ErrorBackupMismatch, len(mismatches), mismatches[0].Path, mismatches[0].Reason)
+			}
+			if err != nil {
+				s.logger.Error("Backup verification failed", zap.Error(err))
+				s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+				errCh <- err
+				return
+			}
+			s.logger.Info("Backup verified", zap.Int("files", verified), zap.Float64("rate", verifyRate))
+		}
+
+		// Directory sizes are summed once the items left out are removed.
+		if viper.GetBool("index_dir_sizes") {
+			index.AggregateDirSizes()
+		}
+
 		// Save Indexs
 		err = cacheWriter.SaveIndex(index)
 		if err != nil {
@@ -1278,14 +2673,34 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 			return
 		}
 
+		var delta *cache.IndexDelta
+		if lrp != nil {
+			delta, err = indexDelta(index, &latestIndex, lrp.ID, parentDepth)
+			if err != nil {
+				s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+				errCh <- err
+				return
+			}
+		}
+		if delta != nil {
+			if err := cacheWriter.SaveIndexDelta(delta); err != nil {
+				s.notifyStatusFailed(actionCreateRP.ID, err.Error())
+				errCh <- err
+				return
+			}
+		}
+
 		// Put indexs
-		s.logger.Sugar().Info("Put index.json to storage", zap.String("key", filepath.Join(mcID, rpID, "index.json")))
-		indexHash, errPutIndexs := s.putIndexs(storageVault, latestIndex, cachePath, mcID, rpID)
+		indexHash, indexSize, errPutIndexs := s.putIndexs(ctx, storageVault, delta != nil, cachePath, mcID, rpID, progressFinalize)
 		if errPutIndexs != nil {
 			s.notifyStatusFailed(actionCreateRP.ID, errPutIndexs.Error())
 			errCh <- errPutIndexs
 			return
 		}
+		if err := s.backupClient.SaveHostIndex(); err != nil {
+			s.logger.Warn("failed to save host cache", zap.Error(err))
+		}
+		s.logExistsCacheStats(storageVault)
 		if lrp != nil {
 			err := os.RemoveAll(filepath.Join(cachePath, mcID, lrp.ID))
 			if err != nil {
@@ -1295,7 +2710,7 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 		}
 
 		// remove worker out of manage context mapping
-		delete(s.mapActionContext, actionCreateRP.ID)
+		s.deleteAction(actionCreateRP.ID)
 
 		// check if context done before return --> got cancel request
 		// else report done
@@ -1304,69 +2719,516 @@ func (s *Server) backupWorker(ctx context.Context, actionCreateRP *backupapi.Cre
 			errCh <- backupapi.ErrorGotCancelRequest
 		default:
 			s.reportUploadCompleted(progressOutput)
-			progressUpload.Done()
-			s.notifyMsg(map[string]string{
+			progressFinalize.Done()
+			stat := progressUpload.Current()
+			s.logger.Info("Backup completed",
+				zap.Uint64("scanned_bytes", stat.ScannedBytes()),
+				zap.Uint64("new_bytes", stat.NewBytes),
+				zap.Uint64("unchanged_bytes", stat.UnchangedBytes),
+				zap.Uint64("deduped_bytes", stat.DedupedBytes))
+			msg := map[string]string{
 				"action_id":    actionCreateRP.ID,
 				"status":       statusComplete,
 				"index_hash":   indexHash,
+				"index_size":   strconv.Itoa(indexSize),
 				"storage_size": strconv.FormatUint(storageSize, 10),
 				"total":        strconv.FormatUint(itemTodo.Bytes, 10),
 				"total_files":  strconv.Itoa(int(totalFiles)),
+			}
+			for key, value := range byteCounts(stat) {
+				msg[key] = value
+			}
+			if verifyRate > 0 {
+				msg["verified_files"] = strconv.Itoa(verified)
+			}
+			if len(failedItems) > 0 {
+				msg["failed_files"] = strconv.Itoa(len(failedItems))
+			}
+			if len(unstableItems) > 0 {
+				msg["unstable_files"] = strconv.Itoa(len(unstableItems))
+			}
+			if len(index.PermissionDenied) > 0 {
+				msg["permission_denied"] = strconv.Itoa(len(index.PermissionDenied))
+			}
+			if len(index.SkippedMounts) > 0 {
+				msg["skipped_mounts"] = strings.Join(index.SkippedMounts, ",")
+			}
+			if index.AgeSkipped > 0 {
+				msg["age_skipped_files"] = strconv.FormatInt(index.AgeSkipped, 10)
+			}
+			if index.Excluded > 0 {
+				msg["excluded_items"] = strconv.FormatInt(index.Excluded, 10)
+			}
+			if n, ok := vaultRequests(storageVault); ok {
+				msg["vault_requests"] = strconv.FormatUint(n, 10)
+			}
+			s.notifyMsg(msg)
+			s.notifyResult(notifier.Event{
+				Action:          notifier.ActionBackup,
+				ActionID:        actionCreateRP.ID,
+				RecoveryPointID: rpID,
+				Status:          statusComplete,
+				Duration:        time.Since(startedAt),
+				TotalSize:       itemTodo.Bytes,
+				StorageSize:     storageSize,
+				TotalFiles:      totalFiles,
 			})
+			s.pruneCache(cachePath, mcID, bdID, rpID)
 		}
 
 		errCh <- nil
 	}
 }
 
-func (s *Server) storeIndexs(cachePath, mcID string, lrp *backupapi.RecoveryPointResponse, storageVault storage_vault.StorageVault) error {
-	_, err := os.Stat(filepath.Join(cachePath, mcID, lrp.ID, "index.json"))
+// finishDryRun reports what the dry run of a backup found would be uploaded.
+// Neither chunks nor index are written, the recovery point is reported failed
+// so that it is never taken as the latest one by the next backup, and the
+// cache directory created for it is removed.
+func (s *Server) finishDryRun(ctx context.Context, actionID, rpCache string, p *progress.Progress, todo progress.Stat, totalFiles int64, errFileWorker error, errCh chan<- error) {
+	stat := p.Current()
+	p.Done()
+	s.deleteAction(actionID)
+	if err := os.RemoveAll(rpCache); err != nil {
+		s.logger.Warn("failed to remove dry run cache", zap.Error(err))
+	}
+	if errFileWorker != nil {
+		s.notifyStatusFailed(actionID, errFileWorker.Error())
+		errCh <- errFileWorker
+		return
+	}
+	if ctx.Err() != nil {
+		errCh <- backupapi.ErrorGotCancelRequest
+		return
+	}
+	s.logger.Info("Dry run completed",
+		zap.Uint64("new_bytes", stat.NewBytes),
+		zap.Uint64("changed_bytes", stat.ChangedBytes),
+		zap.Uint64("unchanged_bytes", stat.UnchangedBytes),
+		zap.Uint64("deduped_bytes", stat.DedupedBytes))
+	msg := map[string]string{
+		"action_id":   actionID,
+		"status":      statusFailed,
+		"reason":      dryRunReason,
+		"dry_run":     "true",
+		"total":       strconv.FormatUint(todo.Bytes, 10),
+		"total_files": strconv.FormatInt(totalFiles, 10),
+	}
+	for key, value := range byteCounts(stat) {
+		msg[key] = value
+	}
+	s.notifyMsg(msg)
+	errCh <- nil
+}
+
+// byteCounts returns the bytes a backup scanned, and of them those uploaded,
+// unchanged since the last backup, or already held by the vault.
+func byteCounts(stat progress.Stat) map[string]string {
+	return map[string]string{
+		"scanned_bytes":   strconv.FormatUint(stat.ScannedBytes(), 10),
+		"new_bytes":       strconv.FormatUint(stat.NewBytes, 10),
+		"changed_bytes":   strconv.FormatUint(stat.ChangedBytes, 10),
+		"unchanged_bytes": strconv.FormatUint(stat.UnchangedBytes, 10),
+		"deduped_bytes":   strconv.FormatUint(stat.DedupedBytes, 10),
+	}
+}
+
+// vaultRequests returns the number of requests made to storageVault during
+// the run, if it counts them.
+func vaultRequests(storageVault storage_vault.StorageVault) (uint64, bool) {
+	counter, ok := storageVault.(storage_vault.RequestCounter)
+	if !ok {
+		return 0, false
+	}
+	return counter.Requests(), true
+}
+
+// addRetryProgress adds to progress message msg the requests to storageVault
+// being retried and the time left before the next retry. While there are some,
+// the RETRYING sub-state tells a stalled job from a slow one.
+func addRetryProgress(msg map[string]string, storageVault storage_vault.StorageVault) {
+	retries := storage_vault.RetriesOf(storageVault)
+	if retries == nil {
+		return
+	}
+	state := retries.State()
+	msg["retrying"] = strconv.Itoa(state.Retrying)
+	if state.Retrying > 0 {
+		msg["substate"] = statusRetrying
+		msg["next_retry"] = state.NextDelay.Round(time.Millisecond).String()
+	}
+}
+
+func (s *Server) logVaultRequests(storageVault storage_vault.StorageVault) {
+	if n, ok := vaultRequests(storageVault); ok {
+		s.logger.Info("Storage vault requests", zap.Uint64("requests", n), zap.Int64("budget", viper.GetInt64("vault_request_budget")))
+	}
+}
+
+func (s *Server) logExistsCacheStats(storageVault storage_vault.StorageVault) {
+	reporter, ok := storageVault.(storage_vault.ExistsCacheReporter)
+	if !ok {
+		return
+	}
+	hits, misses := reporter.ExistsCacheStats()
+	var rate float64
+	if hits+misses > 0 {
+		rate = float64(hits) / float64(hits+misses)
+	}
+	s.logger.Info("Existence cache stats", zap.Uint64("hits", hits), zap.Uint64("misses", misses), zap.Float64("hit_rate", rate))
+}
+
+// storeIndexs writes the full index of lrp to the cache, rebuilding it from
+// the storage vault if needed, and returns the depth of its delta index, 0 when
+// its index is a full one. The backup goes on without a parent index when it
+// can not be loaded, and the depth returned is then -1.
+func (s *Server) storeIndexs(ctx context.Context, cachePath, mcID string, lrp *backupapi.RecoveryPointResponse, storageVault storage_vault.StorageVault) (int, error) {
+	indexPath := filepath.Join(cachePath, mcID, lrp.ID, cache.Type(cache.INDEX).String())
+	_, err := os.Stat(indexPath)
+	if err == nil {
+		if depth, ok := cachedIndexDepth(cachePath, mcID, lrp.ID, lrp.IndexHash); ok {
+			return depth, nil
+		}
+		// The cached delta index is not the one stored, the recovery point
+		// was consolidated since.
+		_ = os.Remove(filepath.Join(cachePath, mcID, lrp.ID, cache.Type(cache.INDEX_DELTA).String()))
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+	index, depth, err := s.loadIndex(ctx, storageVault, cachePath, mcID, lrp.ID, lrp.IndexHash)
 	if err != nil {
-		if os.IsNotExist(err) {
-			buf, err := storageVault.GetObject(filepath.Join(mcID, lrp.ID, "index.json"))
-			if err == nil {
-				_ = os.MkdirAll(filepath.Join(cachePath, mcID, lrp.ID), 0700)
-				if err := ioutil.WriteFile(filepath.Join(cachePath, mcID, lrp.ID, "index.json"), buf, 0700); err != nil {
-					return err
-				}
-			} else {
-				lrp = nil
+		s.logger.Warn("Failed to load index of latest recovery point", zap.Error(err), zap.String("recovery_point_id", lrp.ID))
+		return -1, nil
+	}
+	buf, err := json.Marshal(index)
+	if err != nil {
+		return 0, err
+	}
+	return depth, ioutil.WriteFile(indexPath, buf, 0700)
+}
+
+// loadIndex returns the full index of recovery point rpID, whose stored index
+// hashes to indexHash, and the depth stored with its delta index, 0 when it is
+// a full one. Delta indexes are folded onto the indexes of their ancestors,
+// which are checked against the hashes known to the server.
+func (s *Server) loadIndex(ctx context.Context, storageVault storage_vault.StorageVault, cachePath, mcID, rpID, indexHash string) (*cache.Index, int, error) {
+	return s.loadIndexUnder(ctx, storageVault, cachePath, mcID, rpID, indexHash, "")
+}
+
+// loadIndexUnder is loadIndex for a restore of the items below prefix only:
+// only the shards of sharded indexes which may hold them are read, so the
+// index returned may hold other items but lacks some outside prefix.
+func (s *Server) loadIndexUnder(ctx context.Context, storageVault storage_vault.StorageVault, cachePath, mcID, rpID, indexHash, prefix string) (*cache.Index, int, error) {
+	return cache.ResolveIndex(rpID, func(id string) (*cache.Index, *cache.IndexDelta, error) {
+		if id == rpID {
+			return s.readStoredIndex(ctx, storageVault, cachePath, mcID, id, indexHash, prefix, true)
+		}
+		rp, err := s.backupClient.GetRecoveryPointInfo(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s.readStoredIndex(ctx, storageVault, cachePath, mcID, id, rp.IndexHash, prefix, false)
+	})
+}
+
+// readStoredIndex returns the index of rpID, full or delta, from the cache or
+// else from the storage vault. Objects read from the storage vault must match
+// indexHash and are written to the cache when save is set. An empty cachePath
+// reads from the storage vault only. A consolidated recovery point keeps its
+// delta index next to the full one, the one matching indexHash is read. The
+// shards of a sharded index are read from the storage vault, only those under
+// prefix when it is not empty, and the index is cached whole only.
+func (s *Server) readStoredIndex(ctx context.Context, storageVault storage_vault.StorageVault, cachePath, mcID, rpID, indexHash, prefix string, save bool) (*cache.Index, *cache.IndexDelta, error) {
+	types := []cache.Type{cache.INDEX_DELTA, cache.INDEX}
+
+	var buf []byte
+	var found cache.Type
+	for _, t := range types {
+		if cachePath == "" {
+			break
+		}
+		data, err := ioutil.ReadFile(filepath.Join(cachePath, mcID, rpID, t.String()))
+		if err == nil && hashIndex(data) == indexHash {
+			buf, found = data, t
+			break
+		}
+	}
+	if buf == nil {
+		var err, corrupted error
+		for _, t := range []cache.Type{cache.INDEX, cache.INDEX_DELTA} {
+			key := filepath.Join(mcID, rpID, t.String())
+			s.logger.Sugar().Info("Get index from storage", zap.String("key", key))
+			var data []byte
+			data, err = storageVault.GetObject(ctx, key)
+			if err != nil {
+				continue
 			}
-		} else {
-			return err
+			if hashIndex(data) != indexHash {
+				corrupted = fmt.Errorf("%w: %s", ErrorIndexCorrupted, key)
+				continue
+			}
+			buf, found = data, t
+			break
 		}
-	} else {
-		buf, err := ioutil.ReadFile(filepath.Join(cachePath, mcID, lrp.ID, "index.json"))
+		if buf == nil {
+			if corrupted != nil {
+				return nil, nil, corrupted
+			}
+			return nil, nil, err
+		}
+		if save && cachePath != "" && !isShardedIndex(buf) {
+			if err := s.cacheIndex(cachePath, mcID, rpID, found, buf); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+
+	if found == cache.INDEX_DELTA {
+		var delta cache.IndexDelta
+		if err := json.Unmarshal(buf, &delta); err != nil {
+			return nil, nil, fmt.Errorf("%w: recovery point %s: %v", cache.ErrIncompleteIndex, rpID, err)
+		}
+		if err := delta.Validate(rpID); err != nil {
+			return nil, nil, err
+		}
+		return nil, &delta, nil
+	}
+	var index cache.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return nil, nil, fmt.Errorf("%w: recovery point %s: %v", cache.ErrIncompleteIndex, rpID, err)
+	}
+	if err := index.Validate(rpID); err != nil {
+		return nil, nil, err
+	}
+	if !index.Sharded() {
+		return &index, nil, nil
+	}
+	merged, err := s.readIndexShards(ctx, storageVault, mcID, &index, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	if save && cachePath != "" && prefix == "" {
+		buf, err := json.Marshal(merged)
 		if err != nil {
-			return err
+			return nil, nil, err
 		}
-		hash := sha256.Sum256(buf)
-		if hex.EncodeToString(hash[:]) != lrp.IndexHash {
-			lrp = nil
+		if err := s.cacheIndex(cachePath, mcID, rpID, cache.INDEX, buf); err != nil {
+			return nil, nil, err
 		}
 	}
-	return nil
+	return merged, nil, nil
+}
+
+// isShardedIndex reports whether buf is a stored index listing its shards,
+// without decoding its items.
+func isShardedIndex(buf []byte) bool {
+	var header struct {
+		Version int `json:"version"`
+	}
+	return json.Unmarshal(buf, &header) == nil && header.Version == cache.ShardedIndexVersion
+}
+
+func (s *Server) cacheIndex(cachePath, mcID, rpID string, t cache.Type, buf []byte) error {
+	_ = os.MkdirAll(filepath.Join(cachePath, mcID, rpID), 0700)
+	return writeFileAtomic(filepath.Join(cachePath, mcID, rpID, t.String()), buf, 0700)
+}
+
+// readIndexShards reads the shards of index under prefix in parallel and
+// returns the index holding their items.
+func (s *Server) readIndexShards(ctx context.Context, storageVault storage_vault.StorageVault, mcID string, index *cache.Index, prefix string) (*cache.Index, error) {
+	shards := index.ShardsUnder(prefix)
+	s.logger.Info("Get index shards from storage", zap.String("recovery_point_id", index.RecoveryPointID),
+		zap.Int("shards", len(shards)), zap.Int("total", len(index.Shards)))
+	var mu sync.Mutex
+	bufs := make(map[string][]byte, len(shards))
+	var group errgroup.Group
+	group.SetLimit(indexShardConcurrency)
+	for _, shard := range shards {
+		key := filepath.Join(mcID, index.RecoveryPointID, shard.Name)
+		name := shard.Name
+		group.Go(func() error {
+			buf, err := storageVault.GetObject(ctx, key)
+			if err != nil {
+				return fmt.Errorf("%w: %s: %v", cache.ErrIncompleteIndex, key, err)
+			}
+			mu.Lock()
+			bufs[name] = buf
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return index.MergeShards(index.RecoveryPointID, bufs)
+}
+
+// writeFileAtomic writes buf to a temporary file renamed to path, so that
+// concurrent restores of the same recovery point never read a partial file.
+func writeFileAtomic(path string, buf []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// checkChunks checks index against the chunk list stored with its recovery
+// point. Recovery points stored without a chunk list are not checked.
+func (s *Server) checkChunks(ctx context.Context, storageVault storage_vault.StorageVault, mcID string, index *cache.Index) error {
+	key := filepath.Join(mcID, index.RecoveryPointID, cache.Type(cache.CHUNK).String())
+	buf, err := storageVault.GetObject(ctx, key)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NoSuchKey" {
+			s.logger.Warn("No chunk list to check the index against", zap.String("key", key))
+			return nil
+		}
+		return err
+	}
+	var chunks cache.Chunk
+	if err := json.Unmarshal(buf, &chunks); err != nil {
+		return fmt.Errorf("%w: recovery point %s: %s: %v", cache.ErrIncompleteIndex, index.RecoveryPointID, cache.Type(cache.CHUNK), err)
+	}
+	return cache.ValidateChunks(index, &chunks)
+}
+
+func hashIndex(buf []byte) string {
+	hash := sha256.Sum256(buf)
+	return hex.EncodeToString(hash[:])
+}
+
+// indexDelta returns the delta of index against latestIndex, the index of the
+// parent recovery point, or nil when the full index must be stored: delta
+// indexes are disabled, the depth of the parent is not known, or the chain
+// already holds index_delta_max_chain deltas, in which case the full index is
+// a synthetic full that resets it.
+func indexDelta(index *cache.Index, latestIndex *cache.Index, parentID string, parentDepth int) (*cache.IndexDelta, error) {
+	if !viper.GetBool("index_delta") || latestIndex.Items == nil {
+		return nil, nil
+	}
+	maxChain := defaultIndexDeltaMaxChain
+	if viper.IsSet("index_delta_max_chain") {
+		maxChain = viper.GetInt("index_delta_max_chain")
+	}
+	depth := parentDepth + 1
+	if parentDepth < 0 || depth > maxChain {
+		return nil, nil
+	}
+	return cache.NewIndexDelta(parentID, depth, latestIndex, index)
+}
+
+// cachedIndexDepth returns the depth of the cached delta index of rpID, 0 when
+// none is cached as its index is a full one. The depth is not known when the
+// cached delta index is not the one stored, which hashes to indexHash.
+func cachedIndexDepth(cachePath, mcID, rpID, indexHash string) (int, bool) {
+	buf, err := ioutil.ReadFile(filepath.Join(cachePath, mcID, rpID, cache.Type(cache.INDEX_DELTA).String()))
+	if os.IsNotExist(err) {
+		return 0, true
+	}
+	if err != nil || hashIndex(buf) != indexHash {
+		return 0, false
+	}
+	var delta cache.IndexDelta
+	if err := json.Unmarshal(buf, &delta); err != nil {
+		return 0, false
+	}
+	return delta.Depth, true
 }
 
-func (s *Server) putIndexs(storageVault storage_vault.StorageVault, latestIndex cache.Index, cachePath, mcID, rpID string) (string, error) {
-	buf, err := ioutil.ReadFile(filepath.Join(cachePath, mcID, rpID, "index.json"))
+// putIndexs uploads the index of rpID, its delta when delta is set, and returns
+// the hash and size of the uploaded object. A full index of more than
+// index_shard_files items is uploaded as shards followed by the index listing
+// them, whose hash and size are returned.
+func (s *Server) putIndexs(ctx context.Context, storageVault storage_vault.StorageVault, delta bool, cachePath, mcID, rpID string, p *progress.Progress) (string, int, error) {
+	name := cache.Type(cache.INDEX).String()
+	if delta {
+		name = cache.Type(cache.INDEX_DELTA).String()
+	}
+	s.logger.Sugar().Info("Put index to storage", zap.String("key", filepath.Join(mcID, rpID, name)))
+	buf, err := ioutil.ReadFile(filepath.Join(cachePath, mcID, rpID, name))
 	if err != nil {
 		s.logger.Error("Read indexs error", zap.Error(err))
-		return "", err
+		return "", 0, err
+	}
+	if !delta {
+		if buf, err = s.putIndexShards(ctx, storageVault, mcID, rpID, buf, p); err != nil {
+			s.logger.Error("Put index shards to storage error", zap.Error(err))
+			os.RemoveAll(filepath.Join(cachePath, mcID, rpID))
+			return "", 0, err
+		}
 	}
-	err = storageVault.PutObject(filepath.Join(mcID, rpID, "index.json"), buf)
+	err = storageVault.PutObject(ctx, filepath.Join(mcID, rpID, name), buf)
 	if err != nil {
 		s.logger.Error("Put indexs to storage error", zap.Error(err))
 		os.RemoveAll(filepath.Join(cachePath, mcID, rpID))
-		return "", err
+		return "", 0, err
 	}
-	hash := sha256.Sum256(buf)
-	indexHash := hex.EncodeToString(hash[:])
+	s.logger.Info("Index uploaded", zap.String("key", filepath.Join(mcID, rpID, name)), zap.Int("size", len(buf)))
+	p.Report(progress.Stat{Items: 1, Bytes: uint64(len(buf)), Storage: uint64(len(buf))})
+	return hashIndex(buf), len(buf), nil
+}
+
+// indexShardFiles returns the number of items per index shard, 0 when indexes
+// are not sharded.
+func indexShardFiles() int {
+	if viper.IsSet("index_shard_files") {
+		return viper.GetInt("index_shard_files")
+	}
+	return defaultIndexShardFiles
+}
 
-	return indexHash, nil
+// putIndexShards uploads the shards of the full index buf in parallel when it
+// holds more than index_shard_files items, and returns the index listing them
+// to upload in its place. buf is returned as is when it is not sharded.
+func (s *Server) putIndexShards(ctx context.Context, storageVault storage_vault.StorageVault, mcID, rpID string, buf []byte, p *progress.Progress) ([]byte, error) {
+	perShard := indexShardFiles()
+	if perShard <= 0 {
+		return buf, nil
+	}
+	var index cache.Index
+	if err := json.Unmarshal(buf, &index); err != nil {
+		return nil, err
+	}
+	if len(index.Items) <= perShard {
+		return buf, nil
+	}
+	manifest, shards, err := cache.ShardIndex(&index, perShard)
+	if err != nil {
+		return nil, err
+	}
+	s.logger.Info("Put index shards to storage", zap.String("recovery_point_id", rpID),
+		zap.Int("items", len(index.Items)), zap.Int("shards", len(shards)))
+	var group errgroup.Group
+	group.SetLimit(indexShardConcurrency)
+	for i := range shards {
+		key := filepath.Join(mcID, rpID, manifest.Shards[i].Name)
+		shard := shards[i]
+		group.Go(func() error {
+			if err := storageVault.PutObject(ctx, key, shard); err != nil {
+				return err
+			}
+			p.Report(progress.Stat{Items: 1, Bytes: uint64(len(shard)), Storage: uint64(len(shard))})
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(manifest)
 }
 
-func (s *Server) putChunks(cachePath, mcID, rpID, chunkPath string, storageVault storage_vault.StorageVault) error {
+func (s *Server) putChunks(ctx context.Context, cachePath, mcID, rpID, chunkPath string, storageVault storage_vault.StorageVault, p *progress.Progress) error {
 	if chunkPath == "" {
 		chunkPath = filepath.Join(cachePath, mcID, rpID, "chunk.json")
 	} else {
@@ -1377,23 +3239,24 @@ func (s *Server) putChunks(cachePath, mcID, rpID, chunkPath string, storageVault
 		s.logger.Error("Read chunk.json error", zap.Error(err))
 		return err
 	}
-	err = storageVault.PutObject(filepath.Join(mcID, rpID, "chunk.json"), buf)
+	err = storageVault.PutObject(ctx, filepath.Join(mcID, rpID, "chunk.json"), buf)
 	if err != nil {
 		s.logger.Error("Put chunk.json to storage error", zap.Error(err))
 		return err
 	}
+	p.Report(progress.Stat{Items: 1, Bytes: uint64(len(buf)), Storage: uint64(len(buf))})
 	return nil
 }
 
 // Upload list backup failed to storage
-func (s *Server) uploadListBackupFailed(listBackupFailed []string, storageVault storage_vault.StorageVault) error {
+func (s *Server) uploadListBackupFailed(ctx context.Context, listBackupFailed []string, storageVault storage_vault.StorageVault) error {
 	for _, fileFailed := range listBackupFailed {
 		buf, err := ioutil.ReadFile(filepath.Join(BACKUP_FAILED_PATH, fileFailed))
 		if err != nil {
 			s.logger.Error("Read file error ", zap.Error(err))
 			return err
 		}
-		err = storageVault.PutObject(fileFailed, buf)
+		err = storageVault.PutObject(ctx, fileFailed, buf)
 		if err != nil {
 			s.logger.Error("Put file to storage error ", zap.Error(err))
 			return err
@@ -1421,19 +3284,25 @@ func (s *Server) storeFiles(cachePath, mcID string, rpID string, index *cache.In
 	defer file.Close()
 	writerCSV := csv.NewWriter(file)
 	defer writerCSV.Flush()
-	errWriteCSV := writerCSV.Write([]string{"name", "hash", "path", "size", "type", "modify_time"})
+	// hash_algorithm names the hash of the hash column, which is not always
+	// sha256 since hash_algo.
+	errWriteCSV := writerCSV.Write([]string{"name", "hash", "path", "size", "type", "modify_time", "hash_algorithm"})
 	if errWriteCSV != nil {
 		return errWriteCSV
 	}
 	for _, itemInfo := range index.Items {
 		itemHash := ""
+		itemHashAlgo := ""
 		var itemSize uint64
 		itemModifiedTime := itemInfo.ModTime.String()
 		if itemInfo.Type == "file" {
 			itemHash = itemInfo.Sha256Hash.String()
 			itemSize = itemInfo.Size
 		}
-		err := writerCSV.Write([]string{itemInfo.Name, itemHash, itemInfo.AbsolutePath, strconv.FormatUint(itemSize, 10), itemInfo.Type, itemModifiedTime})
+		if itemHash != "" {
+			itemHashAlgo = backupapi.HashName(itemInfo.HashAlgo)
+		}
+		err := writerCSV.Write([]string{itemInfo.Name, itemHash, itemInfo.AbsolutePath, strconv.FormatUint(itemSize, 10), itemInfo.Type, itemModifiedTime, itemHashAlgo})
 		if err != nil {
 			s.logger.Error("Err writer file.csv", zap.Error(err))
 			return err
@@ -1442,7 +3311,7 @@ func (s *Server) storeFiles(cachePath, mcID string, rpID string, index *cache.In
 	return nil
 }
 
-func (s *Server) putFiles(cachePath, mcID, rpID string, filePath string, storageVault storage_vault.StorageVault) error {
+func (s *Server) putFiles(ctx context.Context, cachePath, mcID, rpID string, filePath string, storageVault storage_vault.StorageVault, p *progress.Progress) error {
 	if filePath == "" {
 		filePath = filepath.Join(cachePath, mcID, rpID, "file.csv")
 	} else {
@@ -1453,11 +3322,12 @@ func (s *Server) putFiles(cachePath, mcID, rpID string, filePath string, storage
 		s.logger.Error("Read file.csv error", zap.Error(err))
 		return err
 	}
-	err = storageVault.PutObject(filepath.Join(mcID, rpID, "file.csv"), buf)
+	err = storageVault.PutObject(ctx, filepath.Join(mcID, rpID, "file.csv"), buf)
 	if err != nil {
 		s.logger.Error("Put file.csv error", zap.Error(err))
 		return err
 	}
+	p.Report(progress.Stat{Items: 1, Bytes: uint64(len(buf)), Storage: uint64(len(buf))})
 	return nil
 }
 
@@ -1476,13 +3346,18 @@ func (s *Server) newProgressScanDir(recoverypointID string) *progress.Progress {
 	return p
 }
 
-func (s *Server) newUploadProgress(recoveryPointID string, todo progress.Stat) *progress.Progress {
+func (s *Server) newUploadProgress(actionID, bdID, recoveryPointID string, todo progress.Stat, state *backupState, storageVault storage_vault.StorageVault) *progress.Progress {
 	p := progress.NewProgress(intervalPushProgress)
+	events := s.newProgressPublisher(actionID, bdID, recoveryPointID, todo)
 
 	var bps, eta uint64
 	itemsTodo := todo.Items
 
 	p.OnUpdate = func(stat progress.Stat, d time.Duration, ticker bool) {
+		if err := state.save(stat, d); err != nil {
+			s.logger.Warn("failed to save progress state", zap.Error(err))
+		}
+		events.update(stat)
 		sec := uint64(d / time.Second)
 
 		if todo.Bytes > 0 && sec > 0 && ticker {
@@ -1499,7 +3374,7 @@ func (s *Server) newUploadProgress(recoveryPointID string, todo progress.Stat) *
 			strItemsDone := strconv.FormatUint(itemsDone, 10)
 			strItemsTodo := strconv.FormatUint(itemsTodo, 10)
 
-			s.notifyMsgProgress(recoveryPointID, map[string]string{
+			msg := map[string]string{
 				"duration":          formatDuration(d),
 				"percent":           formatPercent(stat.Bytes, todo.Bytes),
 				"speed":             formatBytes(bps),
@@ -1509,11 +3384,20 @@ func (s *Server) newUploadProgress(recoveryPointID string, todo progress.Stat) *
 				"erros":             strconv.FormatBool(stat.Errors),
 				"eta":               formatSeconds(eta),
 				"recovery_point_id": recoveryPointID,
-			})
+			}
+			if resumedFrom := state.resumedFromID(); resumedFrom != "" {
+				msg["resumed_from"] = resumedFrom
+			}
+			if n, ok := vaultRequests(storageVault); ok {
+				msg["vault_requests"] = strconv.FormatUint(n, 10)
+			}
+			addRetryProgress(msg, storageVault)
+			s.notifyMsgProgress(recoveryPointID, msg)
 		}
 	}
 
 	p.OnDone = func(stat progress.Stat, d time.Duration, ticker bool) {
+		events.final(stat, false)
 		message := fmt.Sprintf("Duration: %s, %s", d, formatBytes(todo.Storage))
 		s.notifyMsgProgress(recoveryPointID, map[string]string{
 			"COMPLETE UPLOAD": message,
@@ -1521,6 +3405,7 @@ func (s *Server) newUploadProgress(recoveryPointID string, todo progress.Stat) *
 	}
 
 	p.OnCancel = func(stat progress.Stat, d time.Duration, ticker bool) {
+		events.final(stat, true)
 		message := fmt.Sprintf("Duration: %s, %s", d, formatBytes(todo.Storage))
 		s.notifyMsgProgress(recoveryPointID, map[string]string{
 			"CANCELED UPLOAD": message,
@@ -1529,7 +3414,50 @@ func (s *Server) newUploadProgress(recoveryPointID string, todo progress.Stat) *
 	return p
 }
 
-func (s *Server) newDownloadProgress(recoveryPointID string, todo progress.Stat) *progress.Progress {
+// finalizeObjects is the number of metadata objects uploaded for a recovery
+// point: chunk.json, file.csv and its index.
+const finalizeObjects = 3
+
+// newFinalizeProgress reports the upload of the metadata of a recovery point,
+// counting the objects uploaded and their size.
+func (s *Server) newFinalizeProgress(recoveryPointID string, objects uint64, storageVault storage_vault.StorageVault) *progress.Progress {
+	p := progress.NewProgress(intervalPushProgress)
+
+	p.OnUpdate = func(stat progress.Stat, d time.Duration, ticker bool) {
+		if ticker {
+			msg := map[string]string{
+				"phase":             statusFinalizing,
+				"duration":          formatDuration(d),
+				"percent":           formatPercent(stat.Items, objects),
+				"total":             formatBytes(stat.Bytes),
+				"items":             fmt.Sprintf("%d/%d", stat.Items, objects),
+				"recovery_point_id": recoveryPointID,
+			}
+			addRetryProgress(msg, storageVault)
+			s.notifyMsgProgress(recoveryPointID, msg)
+		}
+	}
+
+	p.OnDone = func(stat progress.Stat, d time.Duration, ticker bool) {
+		message := fmt.Sprintf("Duration: %s, %s", d, formatBytes(stat.Bytes))
+		s.notifyMsgProgress(recoveryPointID, map[string]string{
+			"COMPLETE FINALIZING": message,
+		})
+	}
+
+	p.OnCancel = func(stat progress.Stat, d time.Duration, ticker bool) {
+		message := fmt.Sprintf("Duration: %s, %s", d, formatBytes(stat.Bytes))
+		s.notifyMsgProgress(recoveryPointID, map[string]string{
+			"CANCELED FINALIZING": message,
+		})
+	}
+	return p
+}
+
+// newDownloadProgress returns the progress of restore actionID. Its messages
+// carry the action and destination, so that concurrent restores of the same
+// recovery point can be told apart.
+func (s *Server) newDownloadProgress(actionID, recoveryPointID, destDir string, todo progress.Stat, storageVault storage_vault.StorageVault) *progress.Progress {
 	p := progress.NewProgress(intervalPushProgress)
 
 	var bps, eta uint64
@@ -1552,7 +3480,7 @@ func (s *Server) newDownloadProgress(recoveryPointID string, todo progress.Stat)
 			strItemsDone := strconv.FormatUint(itemsDone, 10)
 			strItemsTodo := strconv.FormatUint(itemsTodo, 10)
 
-			s.notifyMsgProgress(recoveryPointID, map[string]string{
+			msg := map[string]string{
 				"duration":          formatDuration(d),
 				"percent":           formatPercent(stat.Bytes, todo.Bytes),
 				"speed":             formatBytes(bps),
@@ -1562,7 +3490,14 @@ func (s *Server) newDownloadProgress(recoveryPointID string, todo progress.Stat)
 				"erros":             strconv.FormatBool(stat.Errors),
 				"eta":               formatSeconds(eta),
 				"recovery_point_id": recoveryPointID,
-			})
+				"action_id":         actionID,
+				"dest_directory":    destDir,
+			}
+			if n, ok := vaultRequests(storageVault); ok {
+				msg["vault_requests"] = strconv.FormatUint(n, 10)
+			}
+			addRetryProgress(msg, storageVault)
+			s.notifyMsgProgress(recoveryPointID, msg)
 		}
 	}
 
@@ -1570,6 +3505,8 @@ func (s *Server) newDownloadProgress(recoveryPointID string, todo progress.Stat)
 		message := fmt.Sprintf("Duration: %s, %s", d, formatBytes(todo.Storage))
 		s.notifyMsgProgress(recoveryPointID, map[string]string{
 			"COMPLETE DOWNLOAD": message,
+			"action_id":         actionID,
+			"dest_directory":    destDir,
 		})
 	}
 
@@ -1577,6 +3514,8 @@ func (s *Server) newDownloadProgress(recoveryPointID string, todo progress.Stat)
 		message := fmt.Sprintf("Duration: %s, %s", d, formatBytes(todo.Storage))
 		s.notifyMsgProgress(recoveryPointID, map[string]string{
 			"CANCELED DOWNLOAD": message,
+			"action_id":         actionID,
+			"dest_directory":    destDir,
 		})
 	}
 	return p
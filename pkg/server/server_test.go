@@ -1,13 +1,29 @@
 package server
 
 import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"math/rand"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -16,12 +32,20 @@ import (
 	"github.com/bizflycloud/bizfly-backup/pkg/broker"
 	"github.com/bizflycloud/bizfly-backup/pkg/broker/mqtt"
 	"github.com/bizflycloud/bizfly-backup/pkg/cache"
+	"github.com/bizflycloud/bizfly-backup/pkg/notifier"
+	"github.com/bizflycloud/bizfly-backup/pkg/progress"
 	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/budget"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/cooldown"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/local"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+	"github.com/bizflycloud/bizfly-backup/pkg/support"
 
 	"github.com/go-chi/chi"
 	"github.com/ory/dockertest/v3"
 	"github.com/panjf2000/ants/v2"
 	"github.com/robfig/cron/v3"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
@@ -39,8 +63,9 @@ var (
 )
 
 func TestMain(m *testing.M) {
+	// Without MQTT only the tests which need a broker are skipped.
 	if os.Getenv("EXCLUDE_MQTT") != "" {
-		os.Exit(0)
+		os.Exit(m.Run())
 	}
 
 	pool, err := dockertest.NewPool("")
@@ -73,7 +98,15 @@ func TestMain(m *testing.M) {
 	os.Exit(code)
 }
 
+// skipWithoutMQTT skips a test which needs the broker started by TestMain.
+func skipWithoutMQTT(t *testing.T) {
+	if b == nil {
+		t.Skip("EXCLUDE_MQTT is set")
+	}
+}
+
 func TestServerRun(t *testing.T) {
+	skipWithoutMQTT(t)
 	tests := []struct {
 		addr string
 	}{
@@ -97,6 +130,7 @@ func TestServerRun(t *testing.T) {
 }
 
 func TestServerEventHandler(t *testing.T) {
+	skipWithoutMQTT(t)
 	addr := "http://localhost:" + strconv.Itoa(defaultTestPort)
 	s, err := New(WithAddr(addr), WithBroker(b))
 	require.NoError(t, err)
@@ -232,10 +266,190 @@ func TestServerCron(t *testing.T) {
 			assert.Len(t, s.mappingToCronEntryID, tc.expectedNumEntries)
 			s.removeFromCronManager(tc.bdc)
 			assert.Equal(t, map[string]cron.EntryID{}, s.mappingToCronEntryID)
+			assert.Empty(t, s.mappingToCronCancel)
 		})
 	}
 }
 
+func TestServerAddToCronManagerDuplicate(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+	policy := func(id, pattern string) backupapi.BackupDirectoryConfigPolicy {
+		return backupapi.BackupDirectoryConfigPolicy{ID: id, SchedulePattern: pattern}
+	}
+	bdc := []backupapi.BackupDirectoryConfig{
+		{ID: "dir1", Activated: true, Policies: []backupapi.BackupDirectoryConfigPolicy{policy("policy_1", "0 1 * * *"), policy("policy_1", "0 2 * * *")}},
+		// The same policy on another directory is another schedule.
+		{ID: "dir2", Activated: true, Policies: []backupapi.BackupDirectoryConfigPolicy{policy("policy_1", "0 3 * * *")}},
+		{ID: "dir2", Activated: true, Policies: []backupapi.BackupDirectoryConfigPolicy{policy("policy_1", "0 4 * * *")}},
+	}
+	err = s.addToCronManager(bdc)
+	assert.ErrorIs(t, err, backupapi.ErrorDuplicateID)
+	assert.Contains(t, err.Error(), "policy policy_1 of backup directory dir1, policy policy_1 of backup directory dir2")
+
+	// The first schedules are kept, none is left running unmanaged.
+	assert.Len(t, s.mappingToCronEntryID, 2)
+	assert.Len(t, s.cronManager.Entries(), 2)
+	from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.Local)
+	assert.Equal(t, []ScheduledRun{
+		{BackupDirectoryID: "dir1", PolicyID: "policy_1", At: from.Add(time.Hour)},
+		{BackupDirectoryID: "dir2", PolicyID: "policy_1", At: from.Add(3 * time.Hour)},
+	}, s.schedulePlan(from, time.Time{}, 1))
+
+	// A config update with a duplicate is reported to the broker handler.
+	err = s.handleConfigUpdate(broker.Message{Action: broker.ConfigUpdateActionAddPolicy, BackupDirectories: bdc[2:]})
+	assert.NoError(t, err)
+	err = s.handleConfigUpdate(broker.Message{Action: broker.ConfigUpdateActionAddPolicy, BackupDirectories: bdc[:1]})
+	assert.ErrorIs(t, err, backupapi.ErrorDuplicateID)
+	assert.Len(t, s.cronManager.Entries(), 2)
+}
+
+func TestServerCronSharedPolicyID(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+	shared := []backupapi.BackupDirectoryConfigPolicy{{ID: "policy_1", SchedulePattern: "0 1 * * *"}}
+	dir1 := backupapi.BackupDirectoryConfig{ID: "dir1", Activated: true, Policies: shared}
+	dir2 := backupapi.BackupDirectoryConfig{ID: "dir2", Activated: true, Policies: shared}
+	require.NoError(t, s.addToCronManager([]backupapi.BackupDirectoryConfig{dir1, dir2}))
+	assert.Len(t, s.mappingToCronEntryID, 2)
+	assert.Len(t, s.cronManager.Entries(), 2)
+
+	// Removing the policy of one directory leaves the other scheduled.
+	s.removeFromCronManager([]backupapi.BackupDirectoryConfig{dir1})
+	assert.NotContains(t, s.mappingToCronEntryID, mappingID("dir1", "policy_1"))
+	assert.Contains(t, s.mappingToCronEntryID, mappingID("dir2", "policy_1"))
+	require.Len(t, s.cronManager.Entries(), 1)
+	assert.Equal(t, s.mappingToCronEntryID[mappingID("dir2", "policy_1")], s.cronManager.Entries()[0].ID)
+
+	// And it can be scheduled again.
+	require.NoError(t, s.addToCronManager([]backupapi.BackupDirectoryConfig{dir1}))
+	assert.Len(t, s.cronManager.Entries(), 2)
+	s.removeFromCronManager([]backupapi.BackupDirectoryConfig{dir1, dir2})
+	assert.Empty(t, s.mappingToCronEntryID)
+	assert.Empty(t, s.mappingToCronCancel)
+	assert.Empty(t, s.cronManager.Entries())
+}
+
+func TestServerAddToCronManagerTimezone(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+	policy := func(id, tz string) backupapi.BackupDirectoryConfigPolicy {
+		return backupapi.BackupDirectoryConfigPolicy{ID: id, SchedulePattern: "0 2 * * *", Timezone: tz}
+	}
+	require.NoError(t, s.addToCronManager([]backupapi.BackupDirectoryConfig{{ID: "dir1", Activated: true, Policies: []backupapi.BackupDirectoryConfigPolicy{
+		policy("hcm", "Asia/Ho_Chi_Minh"),
+		// An unknown time zone falls back to UTC rather than dropping the schedule.
+		policy("unknown", "Mars/Olympus_Mons"),
+		policy("utc", "UTC"),
+	}}}))
+	assert.Len(t, s.cronManager.Entries(), 3)
+
+	from := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	at := make(map[string]time.Time)
+	for _, run := range s.schedulePlan(from, time.Time{}, 1) {
+		at[run.PolicyID] = run.At
+	}
+	assert.True(t, at["hcm"].Equal(time.Date(2021, 1, 1, 19, 0, 0, 0, time.UTC)), at["hcm"])
+	assert.True(t, at["unknown"].Equal(time.Date(2021, 1, 1, 2, 0, 0, 0, time.UTC)), at["unknown"])
+	assert.True(t, at["utc"].Equal(time.Date(2021, 1, 1, 2, 0, 0, 0, time.UTC)), at["utc"])
+
+	// A pattern naming its time zone keeps it.
+	assert.Equal(t, "CRON_TZ=Asia/Tokyo 0 2 * * *", s.schedulePattern(policy("p", "UTC"), "CRON_TZ=Asia/Tokyo 0 2 * * *"))
+	assert.Equal(t, "0 2 * * *", s.schedulePattern(policy("p", ""), "0 2 * * *"))
+}
+
+func TestServerAddToCronManagerVerify(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+	bdc := []backupapi.BackupDirectoryConfig{{ID: "dir1", Activated: true, Policies: []backupapi.BackupDirectoryConfigPolicy{
+		{ID: "policy_1", SchedulePattern: "0 1 * * *", Verify: &backupapi.VerifyPolicy{SchedulePattern: "0 3 * * *", StorageVaultID: "vault"}},
+		// A scan without a storage vault is not scheduled.
+		{ID: "policy_2", SchedulePattern: "0 2 * * *", Verify: &backupapi.VerifyPolicy{SchedulePattern: "0 4 * * *"}},
+	}}}
+	require.NoError(t, s.addToCronManager(bdc))
+	assert.Len(t, s.mappingToCronEntryID, 2)
+	assert.Len(t, s.mappingToVerifyEntryID, 1)
+	assert.Len(t, s.cronManager.Entries(), 3)
+	// Scans are not backups, the plan only lists the backups.
+	assert.Len(t, s.schedulePlan(time.Now(), time.Time{}, 1), 2)
+
+	s.removeFromCronManager(bdc)
+	assert.Empty(t, s.mappingToVerifyEntryID)
+	assert.Empty(t, s.mappingToCronCancel)
+	assert.Empty(t, s.cronManager.Entries())
+}
+
+func TestServerCronSkipsOverlappingRun(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file.txt"), []byte("hello world\n"), 0640))
+	vault := memory.New("vault", "")
+	mcID := fmt.Sprintf("overlap-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+	// The first backup hangs creating its recovery point until released.
+	var created int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.HasSuffix(r.URL.Path, "/recovery-points") && atomic.AddInt32(&created, 1) == 1 {
+			<-release
+		}
+		backend.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	s, err := New(WithBroker(&recordBroker{}), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+
+	require.NoError(t, s.addToCronManager([]backupapi.BackupDirectoryConfig{{ID: "bd", Activated: true,
+		Policies: []backupapi.BackupDirectoryConfigPolicy{{ID: "policy", SchedulePattern: "0 1 1 1 *"}}}}))
+	job := s.cronManager.Entry(s.mappingToCronEntryID[mappingID("bd", "policy")]).Job
+
+	done := make(chan struct{})
+	go func() {
+		job.Run()
+		close(done)
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&created) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// Triggered again while the first run goes on, the policy is skipped.
+	job.Run()
+	assert.Equal(t, int32(1), atomic.LoadInt32(&created))
+
+	close(release)
+	<-done
+	job.Run()
+	assert.Equal(t, int32(2), atomic.LoadInt32(&created))
+	assert.Empty(t, s.runningPolicies)
+}
+
+func TestSampleRecoveryPoints(t *testing.T) {
+	rps := []backupapi.RecoveryPointResponse{
+		{ID: "rp1", Status: backupapi.RecoveryPointStatusCompleted, CreatedAt: "2021-01-01T00:00:00Z"},
+		{ID: "rp4", Status: backupapi.RecoveryPointStatusCompleted, CreatedAt: "2021-01-04T00:00:00Z"},
+		{ID: "rp2", Status: backupapi.RecoveryPointStatusFAILED, CreatedAt: "2021-01-02T00:00:00Z"},
+		{ID: "rp3", Status: backupapi.RecoveryPointStatusCompleted, CreatedAt: "2021-01-03T00:00:00Z"},
+	}
+	ids := func(rps []backupapi.RecoveryPointResponse) []string {
+		var ids []string
+		for _, rp := range rps {
+			ids = append(ids, rp.ID)
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	assert.Equal(t, []string{"rp3", "rp4"}, ids(sampleRecoveryPoints(rps, 2, 5)))
+	assert.Equal(t, []string{"rp1", "rp3", "rp4"}, ids(sampleRecoveryPoints(rps, 10, 5)))
+	sampled := sampleRecoveryPoints(rps, 2, 1)
+	require.Len(t, sampled, 1)
+	assert.Contains(t, []string{"rp3", "rp4"}, sampled[0].ID)
+}
+
 func TestServer_storeFiles(t *testing.T) {
 	type fields struct {
 		Addr                 string
@@ -308,3 +522,1872 @@ func TestServer_storeFiles(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_storeFilesHashAlgorithm(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+	index := cache.NewIndex("bd", "rp")
+	index.Items["/a"] = &cache.Node{Name: "a", AbsolutePath: "/a", Type: "file", Size: 1, Sha256Hash: []byte{0xab}}
+	index.Items["/b"] = &cache.Node{Name: "b", AbsolutePath: "/b", Type: "file", Size: 1, Sha256Hash: []byte{0xcd}, HashAlgo: backupapi.HashBlake3}
+	index.Items["/d"] = &cache.Node{Name: "d", AbsolutePath: "/d", Type: "dir"}
+
+	cachePath := t.TempDir()
+	require.NoError(t, s.storeFiles(cachePath, "mc", "rp", index, nil))
+	f, err := os.Open(filepath.Join(cachePath, "mc", "rp", "file.csv"))
+	require.NoError(t, err)
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, []string{"name", "hash", "path", "size", "type", "modify_time", "hash_algorithm"}, records[0])
+
+	// The hash of every file is named with its algorithm.
+	algos := make(map[string][2]string)
+	for _, record := range records[1:] {
+		algos[record[0]] = [2]string{record[1], record[6]}
+	}
+	assert.Equal(t, [2]string{"ab", backupapi.HashSHA256}, algos["a"])
+	assert.Equal(t, [2]string{"cd", backupapi.HashBlake3}, algos["b"])
+	assert.Equal(t, [2]string{"", ""}, algos["d"])
+}
+
+func TestServerSchedulePlan(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+	s.addToCronManager([]backupapi.BackupDirectoryConfig{
+		{
+			ID: "dir1",
+			Policies: []backupapi.BackupDirectoryConfigPolicy{
+				{ID: "policy_1", SchedulePattern: "0 2 * * *"},
+			},
+			Activated: true,
+		},
+		{
+			ID: "dir2",
+			Policies: []backupapi.BackupDirectoryConfigPolicy{
+				{ID: "policy_2", SchedulePattern: "0 */12 * * *"},
+			},
+			Activated: true,
+		},
+	})
+
+	from := time.Date(2021, 1, 1, 0, 30, 0, 0, time.Local)
+	plan := s.schedulePlan(from, time.Time{}, 2)
+	require.Len(t, plan, 4)
+	assert.Equal(t, "policy_1", plan[0].PolicyID)
+	assert.Equal(t, time.Date(2021, 1, 1, 2, 0, 0, 0, time.Local), plan[0].At)
+	assert.Equal(t, "policy_2", plan[1].PolicyID)
+	assert.Equal(t, time.Date(2021, 1, 1, 12, 0, 0, 0, time.Local), plan[1].At)
+
+	plan = s.schedulePlan(from, from.Add(12*time.Hour), 10)
+	assert.Len(t, plan, 2)
+}
+
+func TestScheduleJitter(t *testing.T) {
+	window := 10 * time.Minute
+	assert.Equal(t, time.Duration(0), scheduleJitter("dir1|policy_1", 0))
+	jitter := scheduleJitter("dir1|policy_1", window)
+	assert.True(t, jitter >= 0 && jitter < window)
+	assert.Equal(t, jitter, scheduleJitter("dir1|policy_1", window))
+	assert.NotEqual(t, jitter, scheduleJitter("dir2|policy_1", window))
+
+	// A delay never reaches the next run.
+	assert.Equal(t, 5*time.Minute, capJitter(5*time.Minute, time.Hour))
+	assert.Equal(t, 2*time.Minute, capJitter(5*time.Minute, 3*time.Minute))
+	assert.Equal(t, 5*time.Minute, capJitter(5*time.Minute, 0))
+
+	defer viper.Set("schedule_jitter", nil)
+	viper.Set("schedule_jitter", "10m")
+	assert.Equal(t, window, scheduleJitterWindow())
+	viper.Set("schedule_jitter", 600)
+	assert.Equal(t, window, scheduleJitterWindow())
+
+	// Agents sharing a policy are spread too.
+	s, err := New()
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithID("agent1"))
+	require.NoError(t, err)
+	jitter = s.policyJitter("dir1|policy_1")
+	assert.Equal(t, jitter, s.policyJitter("dir1|policy_1"))
+	s.backupClient, err = backupapi.NewClient(backupapi.WithID("agent2"))
+	require.NoError(t, err)
+	assert.NotEqual(t, jitter, s.policyJitter("dir1|policy_1"))
+}
+
+func TestServerSchedulePlanJitterCapped(t *testing.T) {
+	viper.Set("schedule_jitter", "2h")
+	defer viper.Set("schedule_jitter", nil)
+	s, err := New()
+	require.NoError(t, err)
+	require.NoError(t, s.addToCronManager([]backupapi.BackupDirectoryConfig{{ID: "dir1", Activated: true,
+		Policies: []backupapi.BackupDirectoryConfigPolicy{{ID: "policy_1", SchedulePattern: "@every 30m"}}}}))
+
+	from := time.Now()
+	plan := s.schedulePlan(from, time.Time{}, 3)
+	require.Len(t, plan, 3)
+	next := from
+	entry := s.cronManager.Entries()[0]
+	for _, run := range plan {
+		next = entry.Schedule.Next(next)
+		assert.False(t, run.At.Before(next))
+		assert.True(t, run.At.Before(next.Add(30*time.Minute)), "run at %s after the next one at %s", run.At, next.Add(30*time.Minute))
+	}
+}
+
+func TestRunIsolated(t *testing.T) {
+	var wg sync.WaitGroup
+	var completed int32
+	errs := make([]error, 5)
+	for i := 0; i < len(errs); i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = runIsolated(func() error {
+				if i == 2 {
+					panic("boom")
+				}
+				time.Sleep(10 * time.Millisecond)
+				atomic.AddInt32(&completed, 1)
+				return nil
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int32(len(errs)-1), completed)
+	for i, err := range errs {
+		if i == 2 {
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "boom")
+			continue
+		}
+		assert.NoError(t, err)
+	}
+}
+
+func TestWalkerDirLimits(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 3; i++ {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("file%d", i)), make([]byte, 100), 0600))
+	}
+
+	tests := []struct {
+		name    string
+		limits  walkLimits
+		wantErr bool
+	}{
+		{"unlimited", walkLimits{}, false},
+		{"within limits", walkLimits{maxFiles: 3, maxBytes: 300}, false},
+		{"too many files", walkLimits{maxFiles: 2}, true},
+		{"too many bytes", walkLimits{maxBytes: 250}, true},
+		{"warn only", walkLimits{maxFiles: 1, warnOnly: true}, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			index := cache.NewIndex("bd", "rp")
+			_, total, err := WalkerDir(dir, index, progress.NewProgress(time.Second), tc.limits, nil, nil, zap.NewNop())
+			if tc.wantErr {
+				assert.ErrorIs(t, err, ErrorBackupLimitExceeded)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, int64(3), total)
+		})
+	}
+}
+
+func TestWalkerDirAge(t *testing.T) {
+	dir := t.TempDir()
+	start := time.Now()
+	for name, age := range map[string]time.Duration{"old": 40 * 24 * time.Hour, "recent": 2 * 24 * time.Hour, "fresh": time.Minute} {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte(name), 0600))
+		mtime := start.Add(-age)
+		require.NoError(t, os.Chtimes(path, mtime, mtime))
+	}
+	// Directories are walked whatever their age.
+	sub := filepath.Join(dir, "sub")
+	require.NoError(t, os.Mkdir(sub, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(sub, "new"), []byte("new"), 0600))
+	recent := start.Add(-3 * 24 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(sub, "new"), recent, recent))
+	old := start.Add(-100 * 24 * time.Hour)
+	require.NoError(t, os.Chtimes(sub, old, old))
+
+	w, err := ageWindowFromConfig(&backupapi.BackupDirectoryConfig{ID: "bd", MaxAge: "30d", MinAge: "1h"}, start)
+	require.NoError(t, err)
+	index := cache.NewIndex("bd", "rp")
+	_, total, err := WalkerDir(dir, index, progress.NewProgress(time.Second), walkLimits{maxFiles: 2, age: w}, nil, nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	assert.Equal(t, int64(2), index.AgeSkipped)
+	for _, name := range []string{"recent", "sub", "sub/new"} {
+		assert.Contains(t, index.Items, filepath.Join(dir, name))
+	}
+}
+
+func TestWalkerDirExclude(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"main.go", "debug.log", "keep.log", "node_modules/pkg/index.js", "src/node_modules/x.js", "dist/app", "src/dist/app"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, []byte(name), 0600))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(dir, backupapi.IgnoreFile), []byte("/dist\n*.log\n!keep.log\n"), 0600))
+	viper.Set("exclude", []string{"node_modules/"})
+	defer viper.Set("exclude", nil)
+
+	exclude, err := backupapi.ExcluderFromConfig(dir)
+	require.NoError(t, err)
+	index := cache.NewIndex("bd", "rp")
+	_, total, err := WalkerDir(dir, index, progress.NewProgress(time.Second), walkLimits{exclude: exclude}, nil, nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(4), total)
+	// Excluded directories count once, their content is not walked.
+	assert.Equal(t, int64(4), index.Excluded)
+	for _, name := range []string{"main.go", "keep.log", backupapi.IgnoreFile, "src", "src/dist/app"} {
+		assert.Contains(t, index.Items, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+	for _, name := range []string{"debug.log", "node_modules", "node_modules/pkg/index.js", "src/node_modules", "dist"} {
+		assert.NotContains(t, index.Items, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+}
+
+func TestWalkerDirInclude(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"etc/app.conf", "etc/app.log", "db/dump.sql", "db/old/dump.sql", "vendor/lib.conf"} {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, os.WriteFile(path, []byte(name), 0600))
+	}
+	viper.Set("include", []string{"*.conf", "*.sql"})
+	viper.Set("exclude", []string{"vendor/", "old/"})
+	defer viper.Set("include", nil)
+	defer viper.Set("exclude", nil)
+
+	exclude, err := backupapi.ExcluderFromConfig(dir)
+	require.NoError(t, err)
+	index := cache.NewIndex("bd", "rp")
+	_, total, err := WalkerDir(dir, index, progress.NewProgress(time.Second), walkLimits{exclude: exclude}, nil, nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	for _, name := range []string{"etc", "etc/app.conf", "db", "db/dump.sql"} {
+		assert.Contains(t, index.Items, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+	for _, name := range []string{"etc/app.log", "db/old", "vendor"} {
+		assert.NotContains(t, index.Items, filepath.Join(dir, filepath.FromSlash(name)))
+	}
+}
+
+func TestAgeWindowFromConfig(t *testing.T) {
+	tests := []struct {
+		maxAge, minAge string
+		wantMax        time.Duration
+		wantMin        time.Duration
+		wantErr        bool
+	}{
+		{"", "", 0, 0, false},
+		{"30d", "", 30 * 24 * time.Hour, 0, false},
+		{"36h", "15m", 36 * time.Hour, 15 * time.Minute, false},
+		{"", "1d", 0, 24 * time.Hour, false},
+		{"1h", "2h", 0, 0, true},
+		{"-1h", "", 0, 0, true},
+		{"xd", "", 0, 0, true},
+		{"", "week", 0, 0, true},
+	}
+	for _, tc := range tests {
+		w, err := ageWindowFromConfig(&backupapi.BackupDirectoryConfig{ID: "bd", MaxAge: tc.maxAge, MinAge: tc.minAge}, time.Now())
+		if tc.wantErr {
+			assert.ErrorIs(t, err, backupapi.ErrorInvalidConfig, tc)
+			continue
+		}
+		require.NoError(t, err, tc)
+		assert.Equal(t, tc.wantMax, w.maxAge, tc)
+		assert.Equal(t, tc.wantMin, w.minAge, tc)
+	}
+	w, err := ageWindowFromConfig(nil, time.Now())
+	require.NoError(t, err)
+	assert.False(t, w.excludes(time.Time{}))
+}
+
+type recordBroker struct {
+	mu       sync.Mutex
+	payloads []map[string]string
+	raw      [][]byte
+}
+
+func (b *recordBroker) Connect() error { return nil }
+func (b *recordBroker) ConnectAndSubscribe(broker.Handler, []string) error {
+	return nil
+}
+func (b *recordBroker) Disconnect() error                        { return nil }
+func (b *recordBroker) Subscribe([]string, broker.Handler) error { return nil }
+func (b *recordBroker) String() string                           { return "record" }
+func (b *recordBroker) Publish(topic string, payload interface{}) error {
+	var msg map[string]string
+	_ = json.Unmarshal(payload.([]byte), &msg)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.payloads = append(b.payloads, msg)
+	b.raw = append(b.raw, payload.([]byte))
+	return nil
+}
+
+// flakyBroker is a recordBroker whose connection fails to be established the
+// first time and can be cut.
+type flakyBroker struct {
+	recordBroker
+	attempts  int32
+	connected int32
+	topics    [][]string
+}
+
+func (b *flakyBroker) ConnectAndSubscribe(_ broker.Handler, topics []string) error {
+	if atomic.AddInt32(&b.attempts, 1) == 1 {
+		return errors.New("connection refused")
+	}
+	b.mu.Lock()
+	b.topics = append(b.topics, topics)
+	b.mu.Unlock()
+	atomic.StoreInt32(&b.connected, 1)
+	return nil
+}
+
+func (b *flakyBroker) IsConnected() bool { return atomic.LoadInt32(&b.connected) == 1 }
+
+func (b *flakyBroker) online() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, msg := range b.payloads {
+		if msg["status"] == "ONLINE" {
+			n++
+		}
+	}
+	return n
+}
+
+func TestServerSubscribeBrokerLoop(t *testing.T) {
+	interval := brokerWatchInterval
+	brokerWatchInterval = 5 * time.Millisecond
+	defer func() { brokerWatchInterval = interval }()
+
+	fb := &flakyBroker{}
+	s, err := New(WithBroker(fb), WithSubscribeTopics("agent/test"), WithPublishTopics("agent/test"))
+	require.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.subscribeBrokerLoop(ctx)
+		close(done)
+	}()
+
+	// A failed connection is retried.
+	require.Eventually(t, func() bool { return fb.online() == 1 }, 5*time.Second, 5*time.Millisecond)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&fb.attempts))
+
+	// A lost connection is established again, with the same topics.
+	atomic.StoreInt32(&fb.connected, 0)
+	require.Eventually(t, func() bool { return fb.online() == 2 }, 5*time.Second, 5*time.Millisecond)
+	fb.mu.Lock()
+	assert.Equal(t, [][]string{{"agent/test"}, {"agent/test"}}, fb.topics)
+	fb.mu.Unlock()
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscribeBrokerLoop did not stop once canceled")
+	}
+}
+
+func TestServerBackupWithRetry(t *testing.T) {
+	viper.Set("backup_retry_backoff", time.Millisecond)
+	defer viper.Set("backup_retry_backoff", 0)
+	defer viper.Set("backup_retry_attempts", 0)
+
+	errTransient := errors.New("credential expired")
+	noNextRun := func() time.Time { return time.Time{} }
+	tests := []struct {
+		name         string
+		attempts     int
+		failures     int
+		err          error
+		nextRun      func() time.Time
+		wantCalls    int
+		wantErr      bool
+		wantRetrying int
+	}{
+		{"no retry configured", 0, 1, errTransient, noNextRun, 1, true, 0},
+		{"succeeds after retry", 3, 2, errTransient, noNextRun, 3, false, 2},
+		{"gives up after attempts", 2, 5, errTransient, noNextRun, 3, true, 2},
+		{"cancelled is not retried", 3, 1, backupapi.ErrorGotCancelRequest, noNextRun, 1, true, 0},
+		{"limit is not retried", 3, 1, ErrorBackupLimitExceeded, noNextRun, 1, true, 0},
+		{"request budget is not retried", 3, 1, fmt.Errorf("put chunk: %w", storage_vault.ErrRequestBudgetExhausted), noNextRun, 1, true, 0},
+		{"next run comes first", 3, 1, errTransient, func() time.Time { return time.Now() }, 1, true, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			viper.Set("backup_retry_attempts", tc.attempts)
+			b := &recordBroker{}
+			s := &Server{b: b, publishTopics: []string{"agent/test"}, logger: zap.NewNop()}
+
+			calls := 0
+			err := s.backupWithRetry(context.Background(), "dir1", "policy1", tc.nextRun, func() error {
+				calls++
+				if calls <= tc.failures {
+					return tc.err
+				}
+				return nil
+			})
+			assert.Equal(t, tc.wantCalls, calls)
+			assert.Equal(t, tc.wantErr, err != nil)
+			assert.Len(t, b.payloads, tc.wantRetrying)
+			for _, msg := range b.payloads {
+				assert.Equal(t, statusRetrying, msg["status"])
+				assert.Equal(t, "dir1", msg["backup_directory_id"])
+			}
+		})
+	}
+}
+
+func TestServerLoadIndex(t *testing.T) {
+	rp1 := cache.NewIndex("bd", "rp1")
+	rp1.Items["/a"] = &cache.Node{AbsolutePath: "/a", Type: "file", Size: 1}
+	rp1.Items["/b"] = &cache.Node{AbsolutePath: "/b", Type: "file", Size: 2}
+	rp2 := cache.NewIndex("bd", "rp2")
+	rp2.Items["/a"] = &cache.Node{AbsolutePath: "/a", Type: "file", Size: 10}
+	delta, err := cache.NewIndexDelta("rp1", 1, rp1, rp2)
+	require.NoError(t, err)
+
+	vault := memory.New("vault", "")
+	hashes := make(map[string]string)
+	for key, v := range map[string]interface{}{"mc/rp1/index.json": rp1, "mc/rp2/index_delta.json": delta} {
+		buf, err := json.Marshal(v)
+		require.NoError(t, err)
+		require.NoError(t, vault.PutObject(context.Background(), key, buf))
+		hashes[filepath.Base(filepath.Dir(key))] = hashIndex(buf)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := filepath.Base(r.URL.Path)
+		_ = json.NewEncoder(w).Encode(backupapi.RecoveryPointResponse{ID: id, IndexHash: hashes[id]})
+	}))
+	defer backend.Close()
+
+	s, err := New()
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(backend.URL + "/api/v1"))
+	require.NoError(t, err)
+
+	cachePath := t.TempDir()
+	index, depth, err := s.loadIndex(context.Background(), vault, cachePath, "mc", "rp2", hashes["rp2"])
+	require.NoError(t, err)
+	assert.Equal(t, 1, depth)
+	assert.Equal(t, "rp2", index.RecoveryPointID)
+	assert.Len(t, index.Items, 1)
+	assert.Equal(t, uint64(10), index.Items["/a"].Size)
+	assert.FileExists(t, filepath.Join(cachePath, "mc", "rp2", "index_delta.json"))
+	assert.NoDirExists(t, filepath.Join(cachePath, "mc", "rp1"))
+
+	// Without a cache path the index is only read from the storage vault.
+	index, _, err = s.loadIndex(context.Background(), vault, "", "mc", "rp2", hashes["rp2"])
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), index.Items["/a"].Size)
+	assert.NoDirExists(t, "mc")
+
+	_, _, err = s.loadIndex(context.Background(), vault, t.TempDir(), "mc", "rp2", "bad")
+	assert.ErrorIs(t, err, ErrorIndexCorrupted)
+
+	vault.Delete("mc/rp1/index.json")
+	_, _, err = s.loadIndex(context.Background(), vault, cachePath, "mc", "rp2", hashes["rp2"])
+	assert.ErrorIs(t, err, cache.ErrBrokenIndexChain)
+
+	// A truncated index matching the recorded hash is reported as incomplete.
+	truncated := []byte(`{"recovery_point_id":"rp3","items":{"/a":{"path":"/a"`)
+	require.NoError(t, vault.PutObject(context.Background(), "mc/rp3/index.json", truncated))
+	_, _, err = s.loadIndex(context.Background(), vault, "", "mc", "rp3", hashIndex(truncated))
+	assert.ErrorIs(t, err, cache.ErrIncompleteIndex)
+	assert.Contains(t, err.Error(), "recovery point rp3")
+}
+
+func TestServerConsolidateIndex(t *testing.T) {
+	rp1 := cache.NewIndex("bd", "rp1")
+	rp1.Items["/a"] = &cache.Node{AbsolutePath: "/a", Type: "file", Size: 1}
+	rp2 := cache.NewIndex("bd", "rp2")
+	rp2.Items["/a"] = &cache.Node{AbsolutePath: "/a", Type: "file", Size: 2}
+	rp3 := cache.NewIndex("bd", "rp3")
+	rp3.Items["/a"] = &cache.Node{AbsolutePath: "/a", Type: "file", Size: 3}
+	d2, err := cache.NewIndexDelta("rp1", 1, rp1, rp2)
+	require.NoError(t, err)
+	d3, err := cache.NewIndexDelta("rp2", 2, rp2, rp3)
+	require.NoError(t, err)
+
+	vault := memory.New("vault", "")
+	var mu sync.Mutex
+	hashes := make(map[string]string)
+	for key, v := range map[string]interface{}{"mc/rp1/index.json": rp1, "mc/rp2/index_delta.json": d2, "mc/rp3/index_delta.json": d3} {
+		buf, err := json.Marshal(v)
+		require.NoError(t, err)
+		require.NoError(t, vault.PutObject(context.Background(), key, buf))
+		hashes[filepath.Base(filepath.Dir(key))] = hashIndex(buf)
+	}
+	deltaHash := hashes["rp3"]
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		id := filepath.Base(r.URL.Path)
+		if r.Method == http.MethodPatch {
+			var req backupapi.UpdateRecoveryPointIndexRequest
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			hashes[id] = req.IndexHash
+		}
+		_ = json.NewEncoder(w).Encode(backupapi.RecoveryPointResponse{ID: id, IndexHash: hashes[id]})
+	}))
+	defer backend.Close()
+
+	s, err := New()
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(backend.URL + "/api/v1"))
+	require.NoError(t, err)
+
+	// The depth of a parent whose cache is rebuilt is the stored one.
+	cachePath := t.TempDir()
+	lrp := &backupapi.RecoveryPointResponse{ID: "rp3", IndexHash: deltaHash}
+	for i := 0; i < 2; i++ {
+		depth, err := s.storeIndexs(context.Background(), cachePath, "mc", lrp, vault)
+		require.NoError(t, err)
+		assert.Equal(t, 2, depth)
+		assert.FileExists(t, filepath.Join(cachePath, "mc", "rp3", "index.json"))
+	}
+
+	result, err := s.consolidateIndex(context.Background(), vault, "mc", "rp3", deltaHash)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.Depth)
+	assert.Equal(t, hashes["rp3"], result.IndexHash)
+	assert.NotEqual(t, deltaHash, result.IndexHash)
+
+	// The consolidated index is read without its ancestors.
+	vault.Delete("mc/rp1/index.json")
+	index, depth, err := s.loadIndex(context.Background(), vault, "", "mc", "rp3", result.IndexHash)
+	require.NoError(t, err)
+	assert.Equal(t, 0, depth)
+	assert.Equal(t, uint64(3), index.Items["/a"].Size)
+	_, _, err = s.loadIndex(context.Background(), vault, "", "mc", "rp3", deltaHash)
+	assert.ErrorIs(t, err, cache.ErrBrokenIndexChain)
+
+	// The next backup starts a new chain from it, the stale cached delta is
+	// dropped.
+	lrp.IndexHash = result.IndexHash
+	depth, err = s.storeIndexs(context.Background(), cachePath, "mc", lrp, vault)
+	require.NoError(t, err)
+	assert.Equal(t, 0, depth)
+	assert.NoFileExists(t, filepath.Join(cachePath, "mc", "rp3", "index_delta.json"))
+
+	result, err = s.consolidateIndex(context.Background(), vault, "mc", "rp3", result.IndexHash)
+	require.NoError(t, err)
+	assert.Equal(t, &ConsolidateIndexResult{RecoveryPointID: "rp3", IndexHash: lrp.IndexHash}, result)
+}
+
+func TestServerShardedIndex(t *testing.T) {
+	viper.Set("index_shard_files", 2)
+	defer viper.Set("index_shard_files", nil)
+
+	index := cache.NewIndex("bd", "rp1")
+	for _, rel := range []string{"data", "data/a/f1", "data/a/f2", "data/b/f1", "data/b/f2"} {
+		abs := "/" + rel
+		index.Items[abs] = &cache.Node{AbsolutePath: abs, BasePath: "/data", RelativePath: rel, Type: "file"}
+	}
+	buf, err := json.Marshal(index)
+	require.NoError(t, err)
+	cachePath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(cachePath, "mc", "rp1"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(cachePath, "mc", "rp1", "index.json"), buf, 0600))
+
+	s, err := New()
+	require.NoError(t, err)
+	vault := memory.New("vault", "")
+	p := s.newFinalizeProgress("rp1", finalizeObjects, nil)
+	p.Start()
+	hash, size, err := s.putIndexs(context.Background(), vault, false, cachePath, "mc", "rp1", p)
+	require.NoError(t, err)
+	p.Done()
+	assert.Equal(t, []string{"mc/rp1/index.json", "mc/rp1/index_shard_0.json", "mc/rp1/index_shard_1.json", "mc/rp1/index_shard_2.json"}, vault.Keys())
+	stored, err := vault.GetObject(context.Background(), "mc/rp1/index.json")
+	require.NoError(t, err)
+	assert.Equal(t, hashIndex(stored), hash)
+	assert.Equal(t, len(stored), size)
+	assert.Less(t, size, len(buf))
+
+	loaded, _, err := s.loadIndex(context.Background(), vault, "", "mc", "rp1", hash)
+	require.NoError(t, err)
+	assert.Equal(t, cache.IndexVersion, loaded.Version)
+	assert.Len(t, loaded.Items, len(index.Items))
+
+	// The merged index is cached, for the next backup to compare against.
+	restoreCache := t.TempDir()
+	_, _, err = s.loadIndex(context.Background(), vault, restoreCache, "mc", "rp1", hash)
+	require.NoError(t, err)
+	cached, err := os.ReadFile(filepath.Join(restoreCache, "mc", "rp1", "index.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(cached), "data/b/f2")
+
+	// Only the shards under the prefix are read.
+	vault.Delete("mc/rp1/index_shard_0.json")
+	loaded, _, err = s.loadIndexUnder(context.Background(), vault, "", "mc", "rp1", hash, "data/b")
+	require.NoError(t, err)
+	stripped, err := backupapi.StripPrefix(*loaded, "data/b")
+	require.NoError(t, err)
+	assert.Len(t, stripped.Items, 2)
+	_, _, err = s.loadIndex(context.Background(), vault, "", "mc", "rp1", hash)
+	assert.ErrorIs(t, err, cache.ErrIncompleteIndex)
+
+	// Indexes are stored whole with sharding off.
+	viper.Set("index_shard_files", 0)
+	vault = memory.New("vault", "")
+	p = s.newFinalizeProgress("rp1", finalizeObjects, nil)
+	p.Start()
+	defer p.Done()
+	_, _, err = s.putIndexs(context.Background(), vault, false, cachePath, "mc", "rp1", p)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"mc/rp1/index.json"}, vault.Keys())
+}
+
+func TestServerConcurrentRestores(t *testing.T) {
+	vault := memory.New("vault", "")
+	index := cache.NewIndex("bd", "rp1")
+	node := &cache.Node{Type: "file", Mode: 0600, AbsolutePath: "/data/file.txt", RelativePath: "data/file.txt"}
+	var start uint
+	for _, part := range []string{"hello ", "world"} {
+		key := part + "-key"
+		require.NoError(t, vault.PutObject(context.Background(), key, []byte(part)))
+		node.Content = append(node.Content, &cache.ChunkInfo{Start: start, Length: uint(len(part)), Etag: key})
+		start += uint(len(part))
+	}
+	node.Size = uint64(start)
+	index.Items[node.AbsolutePath] = node
+	buf, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, vault.PutObject(context.Background(), "mc/rp1/index.json", buf))
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(backupapi.RecoveryPointResponse{ID: "rp1", IndexHash: hashIndex(buf)})
+	}))
+	defer backend.Close()
+
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(backend.URL + "/api/v1"))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	defer os.RemoveAll("cache")
+
+	dests := []string{filepath.Join(t.TempDir(), "a"), filepath.Join(t.TempDir(), "b")}
+	profiles := []string{"", "gentle"}
+	var wg sync.WaitGroup
+	errs := make([]error, len(dests))
+	for i, dest := range dests {
+		wg.Add(1)
+		go func(i int, dest string) {
+			defer wg.Done()
+			errs[i] = s.restore("mc", fmt.Sprintf("action%d", i), "", "", "rp1", dest, "", false, false, profiles[i], "vault", 0, io.Discard)
+		}(i, dest)
+	}
+	wg.Wait()
+
+	for i, dest := range dests {
+		require.NoError(t, errs[i])
+		data, err := os.ReadFile(filepath.Join(dest, "data/file.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "hello world", string(data))
+	}
+	_, running := s.action("action0")
+	assert.False(t, running)
+
+	// Every status message names the restore it belongs to and its profile.
+	completed := make(map[string]string)
+	for _, msg := range rb.payloads {
+		if msg["status"] != statusDownloading && msg["status"] != statusComplete {
+			continue
+		}
+		assert.Equal(t, "rp1", msg["recovery_point_id"])
+		if msg["action_id"] == "action0" {
+			assert.Equal(t, backupapi.DefaultRestoreProfile, msg["restore_profile"])
+		} else {
+			assert.Equal(t, "gentle", msg["restore_profile"])
+		}
+		if msg["status"] == statusComplete {
+			completed[msg["action_id"]] = msg["dest_directory"]
+		}
+	}
+	assert.Equal(t, map[string]string{"action0": dests[0], "action1": dests[1]}, completed)
+
+	err = s.restore("mc", "action3", "", "", "rp1", t.TempDir(), "", false, false, "unknown", "vault", 0, io.Discard)
+	assert.ErrorIs(t, err, backupapi.ErrorUnknownRestoreProfile)
+
+	// A second restore of the same recovery point into the same destination
+	// is refused while the first runs.
+	s.setAction("running", contextStruct{action: notifier.ActionRestore, recoveryPointID: "rp1", destDir: dests[0]})
+	err = s.restore("mc", "action2", "", "", "rp1", dests[0]+"/", "", false, false, "", "vault", 0, io.Discard)
+	assert.ErrorIs(t, err, ErrorRestoreRunning)
+}
+
+func TestServerRequestBackup(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file.txt"), []byte("hello world\n"), 0640))
+	vault := memory.New("vault", "")
+	mcID := fmt.Sprintf("request-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	s, err := New(WithBroker(&recordBroker{}), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/backups/", strings.NewReader(body)))
+		return rec
+	}
+
+	assert.Equal(t, http.StatusBadRequest, post(`{"backup_directory_id": "bd"`).Code)
+	rec := post(`{"backup_directory_id": "bd"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "policy_id")
+
+	// The directory and policy must be known to the agent.
+	rec = post(`{"backup_directory_id": "other", "policy_id": "policy"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrorUnknownBackupDirectory.Error())
+	rec = post(`{"backup_directory_id": "bd", "policy_id": "other"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrorUnknownPolicy.Error())
+
+	// A backup of the directory is running already.
+	s.setAction("running", contextStruct{action: notifier.ActionBackup, backupDirectoryID: "bd"})
+	rec = post(`{"backup_directory_id": "bd", "policy_id": "policy"}`)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), ErrorBackupRunning.Error())
+	s.deleteAction("running")
+
+	rec = post(`{"backup_directory_id": "bd", "policy_id": "policy", "name": "manual"}`)
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var started map[string]string
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &started))
+	assert.Equal(t, map[string]string{"action_id": "action1", "recovery_point_id": "rp1"}, started)
+
+	require.Eventually(t, func() bool {
+		_, running := s.action("action1")
+		return !running
+	}, 10*time.Second, 10*time.Millisecond)
+	assert.NotEmpty(t, backend.indexHash("rp1"))
+}
+
+func TestServerHandleBrokerEventAck(t *testing.T) {
+	src := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(src, "file.txt"), []byte("hello world\n"), 0640))
+	vault := memory.New("vault", "")
+	mcID := fmt.Sprintf("ack-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	s, err := New(WithBroker(&recordBroker{}), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+
+	event := func(payload string, duplicate bool) error {
+		return s.handleBrokerEvent(broker.Event{Payload: []byte(payload), Duplicate: duplicate})
+	}
+
+	// Events which would fail again are acknowledged.
+	assert.True(t, broker.IsPermanent(event(`{"event_type"`, false)))
+	assert.True(t, broker.IsPermanent(event(`{"event_type": "unknown"}`, false)))
+
+	// A backup delivered again while it runs is acknowledged.
+	s.setAction("running", contextStruct{action: notifier.ActionBackup, backupDirectoryID: "bd"})
+	err = event(`{"event_type": "backup_manual", "backup_directory_id": "bd", "policy_id": "policy"}`, true)
+	assert.True(t, broker.IsPermanent(err))
+	assert.ErrorIs(t, err, ErrorBackupRunning)
+	s.deleteAction("running")
+
+	// The event of a backup is handled once the backup ended.
+	require.NoError(t, event(`{"event_type": "backup_manual", "backup_directory_id": "bd", "policy_id": "policy"}`, false))
+	_, running := s.action("action1")
+	assert.False(t, running)
+	assert.NotEmpty(t, backend.indexHash("rp1"))
+
+	// A backup failing before it started is delivered again.
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(down.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	err = event(`{"event_type": "backup_manual", "backup_directory_id": "bd", "policy_id": "policy"}`, false)
+	require.Error(t, err)
+	assert.False(t, broker.IsPermanent(err))
+
+	// A restore delivered again while it runs is acknowledged.
+	s.setAction("restore", contextStruct{action: notifier.ActionRestore})
+	err = event(`{"event_type": "restore_manual", "action_id": "restore"}`, true)
+	assert.True(t, broker.IsPermanent(err))
+	assert.ErrorIs(t, err, ErrorRestoreRunning)
+	// As is one the agent started itself under the action.
+	err = event(`{"event_type": "restore_manual", "action_id": "restore"}`, false)
+	assert.ErrorIs(t, err, ErrorRestoreRunning)
+	s.deleteAction("restore")
+}
+
+func TestServerRestore(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks and modes differ on windows")
+	}
+	src := filepath.Join(t.TempDir(), "src")
+	writeTree(t, src)
+	vault := memory.New("vault", "")
+	mcID := fmt.Sprintf("restore-%d", time.Now().UnixNano())
+	backend := &roundTripBackend{t: t, mcID: mcID, bdID: "bd", path: src, vault: vault}
+	srv := httptest.NewServer(backend)
+	defer srv.Close()
+
+	s, err := New(WithBroker(&recordBroker{}), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(srv.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	_, cachePath, err := support.CheckPath()
+	require.NoError(t, err)
+	defer os.RemoveAll(filepath.Join(cachePath, mcID))
+	defer os.RemoveAll("cache")
+	require.NoError(t, s.backup("bd", "policy", "restore", 0, 0, backupapi.RecoveryPointTypeInitialReplica, io.Discard))
+
+	post := func(body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/backups/restore", strings.NewReader(body)))
+		return rec
+	}
+	dest := filepath.Join(t.TempDir(), "dest")
+
+	rec := post(`{"recovery_point_id": "rp1", "storage_vault_id": "vault"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), "destination_directory")
+	file := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(file, nil, 0600))
+	rec = post(fmt.Sprintf(`{"recovery_point_id": "rp1", "storage_vault_id": "vault", "destination_directory": %q}`, filepath.Join(file, "dest")))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Contains(t, rec.Body.String(), backupapi.ErrorDestinationReadOnly.Error())
+
+	rec = post(fmt.Sprintf(`{"recovery_point_id": "rp1", "storage_vault_id": "vault", "destination_directory": %q}`, dest))
+	require.Equal(t, http.StatusAccepted, rec.Code, rec.Body.String())
+	var started map[string]string
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &started))
+	assert.Equal(t, "rp1", started["recovery_point_id"])
+	assert.Equal(t, "action2", started["action_id"], "the action created by the backup service")
+
+	require.Eventually(t, func() bool {
+		_, running := s.action(started["action_id"])
+		return !running
+	}, 10*time.Second, 10*time.Millisecond)
+	assertSameTree(t, src, filepath.Join(dest, "src"))
+
+	// The restore_manual event the backup service sends for the action, late,
+	// is acknowledged without restoring again.
+	require.NoError(t, os.RemoveAll(dest))
+	err = s.handleBrokerEvent(broker.Event{Payload: []byte(fmt.Sprintf(`{"event_type": "restore_manual", "action_id": %q, "recovery_point_id": "rp1", "storage_vault_id": "vault", "dest_directory": %q}`, started["action_id"], dest))})
+	assert.True(t, broker.IsPermanent(err))
+	assert.ErrorIs(t, err, ErrorRestoreRun)
+	assert.NoDirExists(t, dest)
+
+	// A recovery point unknown to the backup service.
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(missing.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	rec = post(fmt.Sprintf(`{"recovery_point_id": "rp9", "storage_vault_id": "vault", "destination_directory": %q}`, t.TempDir()))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// A backup service failing is not a missing recovery point.
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("<html>"))
+	}))
+	defer failing.Close()
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(failing.URL+"/api/v1"), backupapi.WithID(mcID))
+	require.NoError(t, err)
+	rec = post(fmt.Sprintf(`{"recovery_point_id": "rp1", "storage_vault_id": "vault", "destination_directory": %q}`, t.TempDir()))
+	assert.Equal(t, http.StatusBadGateway, rec.Code)
+}
+
+func TestServerStreamProgress(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+	interval := progressStreamInterval
+	progressStreamInterval = 10 * time.Millisecond
+	defer func() { progressStreamInterval = interval }()
+
+	p := progress.NewProgress(time.Hour)
+	p.Start()
+	defer p.Done()
+	p.Report(progress.Stat{Items: 1, Bytes: 10, Storage: 4})
+	s.setAction("action1", contextStruct{action: notifier.ActionBackup, recoveryPointID: "rp1", backupDirectoryID: "bd1"})
+	s.setActionProgress("action1", statusUploadFile, p, progress.Stat{Items: 2, Bytes: 20})
+
+	srv := httptest.NewServer(s.router)
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/backups/unknown/progress")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	// The running backup is found by its backup directory as well.
+	resp, err = http.Get(srv.URL + "/backups/bd1/progress")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	lines := bufio.NewScanner(resp.Body)
+	require.True(t, lines.Scan())
+	var e progressEvent
+	require.NoError(t, json.Unmarshal(lines.Bytes(), &e))
+	assert.Equal(t, progressEvent{ActionID: "action1", Action: notifier.ActionBackup, BackupDirectoryID: "bd1", RecoveryPointID: "rp1",
+		Phase: statusUploadFile, Items: 1, Bytes: 10, Storage: 4, TotalItems: 2, TotalBytes: 20}, e)
+
+	p.Report(progress.Stat{Items: 1, Bytes: 10})
+	s.deleteAction("action1")
+	for lines.Scan() {
+		require.NoError(t, json.Unmarshal(lines.Bytes(), &e))
+	}
+	assert.True(t, e.Done)
+	assert.Equal(t, uint64(2), e.Items)
+	assert.Equal(t, uint64(20), e.Bytes)
+
+	// Server-sent events when asked for.
+	s.setAction("action2", contextStruct{action: notifier.ActionRestore, recoveryPointID: "rp1"})
+	s.setActionProgress("action2", statusDownloading, p, progress.Stat{})
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/backups/action2/progress", nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err = http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(line, `data: {"action_id":"action2"`), line)
+	s.deleteAction("action2")
+}
+
+func TestServerRestoreMetadataOnly(t *testing.T) {
+	// Only the index is stored, the chunks are never read.
+	vault := memory.New("vault", "")
+	hash := sha256.Sum256([]byte("hello world"))
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	index := cache.NewIndex("bd", "rp1")
+	for _, name := range []string{"file.txt", "changed.txt"} {
+		index.Items["/data/"+name] = &cache.Node{
+			Type: "file", Mode: 0640, AbsolutePath: "/data/" + name, RelativePath: "data/" + name,
+			UID: uint32(os.Getuid()), GID: uint32(os.Getgid()), AccessTime: mtime, ModTime: mtime,
+			Size: 11, Sha256Hash: hash[:], Content: []*cache.ChunkInfo{{Length: 11, Etag: "missing-key"}},
+		}
+	}
+	buf, err := json.Marshal(index)
+	require.NoError(t, err)
+	require.NoError(t, vault.PutObject(context.Background(), "mc/rp1/index.json", buf))
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(backupapi.RecoveryPointResponse{ID: "rp1", IndexHash: hashIndex(buf)})
+	}))
+	defer backend.Close()
+
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(backend.URL + "/api/v1"))
+	require.NoError(t, err)
+	s.testStorageVault = vault
+	defer os.RemoveAll("cache")
+
+	dest := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dest, "data"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dest, "data/file.txt"), []byte("hello world"), 0600))
+	require.NoError(t, os.WriteFile(filepath.Join(dest, "data/changed.txt"), []byte("hello WORLD"), 0600))
+
+	require.NoError(t, s.restore("mc", "action", "", "", "rp1", dest, "", true, false, "", "vault", 0, io.Discard))
+
+	fi, err := os.Stat(filepath.Join(dest, "data/file.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0640), fi.Mode().Perm())
+	assert.True(t, fi.ModTime().Equal(mtime))
+	fi, err = os.Stat(filepath.Join(dest, "data/changed.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	var completed map[string]string
+	for _, msg := range rb.payloads {
+		if msg["status"] == statusComplete {
+			completed = msg
+		}
+	}
+	require.NotNil(t, completed)
+	assert.Equal(t, "true", completed["metadata_only"])
+	assert.Equal(t, "1", completed["repaired_items"])
+	assert.Equal(t, "1", completed["mismatched_items"])
+}
+
+func TestServerCheckChunks(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+
+	index := cache.NewIndex("bd", "rp1")
+	index.Items["/a"] = &cache.Node{AbsolutePath: "/a", Type: "file", Content: []*cache.ChunkInfo{{Etag: "e1"}}}
+	vault := memory.New("vault", "")
+	assert.NoError(t, s.checkChunks(context.Background(), vault, "mc", index), "no chunk list")
+
+	require.NoError(t, vault.PutObject(context.Background(), "mc/rp1/chunk.json", []byte(`{"recovery_point_id":"rp1","chunks":{"e1"`)))
+	assert.ErrorIs(t, s.checkChunks(context.Background(), vault, "mc", index), cache.ErrIncompleteIndex)
+
+	require.NoError(t, vault.PutObject(context.Background(), "mc/rp1/chunk.json", []byte(`{"recovery_point_id":"rp1","chunks":{"e2":["1-10"]}}`)))
+	assert.ErrorIs(t, s.checkChunks(context.Background(), vault, "mc", index), cache.ErrIncompleteIndex)
+
+	require.NoError(t, vault.PutObject(context.Background(), "mc/rp1/chunk.json", []byte(`{"recovery_point_id":"rp1","chunks":{"e1":["1-10"]}}`)))
+	assert.NoError(t, s.checkChunks(context.Background(), vault, "mc", index))
+}
+
+func TestServerRebuildChunks(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+
+	index := cache.NewIndex("bd", "rp1")
+	index.Items["/a"] = &cache.Node{AbsolutePath: "/a", Type: "file", Content: []*cache.ChunkInfo{{Length: 10, Etag: "e1"}, {Start: 10, Length: 5, Etag: "e2"}}}
+	index.Items["/b"] = &cache.Node{AbsolutePath: "/b", Type: "file", Content: []*cache.ChunkInfo{{Length: 10, Etag: "e1"}}}
+	buf, err := json.Marshal(index)
+	require.NoError(t, err)
+	vault := memory.New("vault", "")
+	require.NoError(t, vault.PutObject(context.Background(), "mc/rp1/index.json", buf))
+	require.NoError(t, vault.PutObject(context.Background(), "mc/rp1/chunk.json", []byte(`{"recovery_point_id":"rp1","chunks":{"e1"`)))
+	require.NoError(t, vault.PutObject(context.Background(), "e1", []byte("0123456789")))
+
+	// Nothing is uploaded while a referenced chunk is missing.
+	_, err = s.rebuildChunks(context.Background(), vault, "mc", "rp1", hashIndex(buf))
+	assert.ErrorIs(t, err, ErrorMissingChunks)
+	assert.Contains(t, err.Error(), "e2")
+	assert.ErrorIs(t, s.checkChunks(context.Background(), vault, "mc", index), cache.ErrIncompleteIndex)
+
+	require.NoError(t, vault.PutObject(context.Background(), "e2", []byte("01234")))
+	result, err := s.rebuildChunks(context.Background(), vault, "mc", "rp1", hashIndex(buf))
+	require.NoError(t, err)
+	assert.Equal(t, &RebuildChunksResult{RecoveryPointID: "rp1", Chunks: 2, References: 3}, result)
+	assert.NoError(t, s.checkChunks(context.Background(), vault, "mc", index))
+
+	stored, err := vault.GetObject(context.Background(), "mc/rp1/chunk.json")
+	require.NoError(t, err)
+	var chunks cache.Chunk
+	require.NoError(t, json.Unmarshal(stored, &chunks))
+	assert.Equal(t, map[string][]string{"e1": {"2-10"}, "e2": {"1-5"}}, chunks.Chunks)
+
+	_, err = s.rebuildChunks(context.Background(), vault, "mc", "rp1", "bad")
+	assert.ErrorIs(t, err, ErrorIndexCorrupted)
+}
+
+func TestIndexDeltaMaxChain(t *testing.T) {
+	defer viper.Set("index_delta", nil)
+	defer viper.Set("index_delta_max_chain", nil)
+
+	parent := cache.NewIndex("bd", "rp1")
+	index := cache.NewIndex("bd", "rp2")
+	index.Items["/a"] = &cache.Node{AbsolutePath: "/a"}
+
+	delta, err := indexDelta(index, parent, "rp1", 0)
+	require.NoError(t, err)
+	assert.Nil(t, delta, "disabled by default")
+
+	viper.Set("index_delta", true)
+	viper.Set("index_delta_max_chain", 2)
+	delta, err = indexDelta(index, parent, "rp1", 1)
+	require.NoError(t, err)
+	require.NotNil(t, delta)
+	assert.Equal(t, 2, delta.Depth)
+	assert.Equal(t, "rp1", delta.ParentRecoveryPointID)
+
+	delta, err = indexDelta(index, parent, "rp1", 2)
+	require.NoError(t, err)
+	assert.Nil(t, delta, "chain full, store a synthetic full index")
+
+	delta, err = indexDelta(index, parent, "rp1", -1)
+	require.NoError(t, err)
+	assert.Nil(t, delta, "depth of the parent not known")
+}
+
+func TestServerPruneCache(t *testing.T) {
+	defer viper.Set("cache_generations", nil)
+	s, err := New()
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithID("mc"))
+	require.NoError(t, err)
+
+	cachePath := t.TempDir()
+	for i, rpID := range []string{"rp1", "rp2", "rp3"} {
+		repo, err := cache.NewRepository(cachePath, "mc", rpID)
+		require.NoError(t, err)
+		require.NoError(t, repo.SaveIndex(cache.NewIndex("bd", rpID)))
+		mtime := time.Now().Add(time.Duration(i-3) * time.Hour)
+		require.NoError(t, os.Chtimes(filepath.Join(cachePath, "mc", rpID, "index.json"), mtime, mtime))
+	}
+
+	// Nothing is pruned unless configured.
+	s.pruneCache(cachePath, "mc", "bd", "rp3")
+	generations, err := cache.Generations(cachePath, "mc")
+	require.NoError(t, err)
+	assert.Len(t, generations, 3)
+
+	viper.Set("cache_generations", 2)
+	s.pruneCache(cachePath, "mc", "bd", "rp3")
+	generations, err = cache.Generations(cachePath, "mc")
+	require.NoError(t, err)
+	require.Len(t, generations, 2)
+	assert.Equal(t, "rp3", generations[0].RecoveryPointID)
+	assert.Equal(t, "rp2", generations[1].RecoveryPointID)
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/cache/status", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+	var status CacheStatusResponse
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&status))
+	assert.NotEmpty(t, status.Path)
+}
+
+func TestServerCircuit(t *testing.T) {
+	viper.Set("backup_circuit_failures", 3)
+	viper.Set("backup_circuit_cooldown", time.Hour)
+	defer viper.Set("backup_circuit_failures", nil)
+	defer viper.Set("backup_circuit_cooldown", nil)
+
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test"))
+	require.NoError(t, err)
+	errDisk := errors.New("input/output error")
+
+	// Cancelled backups and successes in between do not count.
+	s.recordScheduledBackup("dir1", "policy1", errDisk)
+	s.recordScheduledBackup("dir1", "policy1", nil)
+	s.recordScheduledBackup("dir1", "policy1", errDisk)
+	s.recordScheduledBackup("dir1", "policy1", errDisk)
+	s.recordScheduledBackup("dir1", "policy1", backupapi.ErrorGotCancelRequest)
+	assert.True(t, s.circuitAllows("dir1"))
+	assert.Empty(t, rb.payloads)
+
+	s.recordScheduledBackup("dir1", "policy1", errDisk)
+	assert.False(t, s.circuitAllows("dir1"))
+	assert.True(t, s.circuitAllows("dir2"))
+	require.Len(t, rb.payloads, 1)
+	assert.Equal(t, statusPaused, rb.payloads[0]["status"])
+	assert.Equal(t, "dir1", rb.payloads[0]["backup_directory_id"])
+	assert.Equal(t, "3", rb.payloads[0]["failures"])
+	assert.Equal(t, errDisk.Error(), rb.payloads[0]["reason"])
+
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/backups/circuits", nil))
+	var circuits []circuit
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &circuits))
+	require.Len(t, circuits, 1)
+	assert.True(t, circuits[0].Open)
+	assert.Equal(t, 3, circuits[0].Failures)
+
+	// After the cool-down a single run is let through, failing opens again.
+	s.circuits["dir1"].Until = time.Now()
+	assert.True(t, s.circuitAllows("dir1"))
+	s.recordScheduledBackup("dir1", "policy1", errDisk)
+	assert.False(t, s.circuitAllows("dir1"))
+	assert.Len(t, rb.payloads, 2)
+
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/backups/dir1/circuit", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.True(t, s.circuitAllows("dir1"))
+	w = httptest.NewRecorder()
+	s.router.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/backups/dir1/circuit", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	viper.Set("backup_circuit_failures", 0)
+	for i := 0; i < 5; i++ {
+		s.recordScheduledBackup("dir1", "policy1", errDisk)
+	}
+	assert.True(t, s.circuitAllows("dir1"), "disabled")
+}
+
+func TestServerHeartbeatLoop(t *testing.T) {
+	viper.Set("heartbeat_interval", 10*time.Millisecond)
+	defer viper.Set("heartbeat_interval", nil)
+
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test"))
+	require.NoError(t, err)
+	s.notifyResult(notifier.Event{Action: notifier.ActionRestore, ActionID: "restore", Status: statusComplete})
+	s.notifyResult(notifier.Event{Action: notifier.ActionBackup, ActionID: "backup", RecoveryPointID: "rp", Status: statusFailed, Error: "boom"})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		s.heartbeatLoop(context.Background(), stop)
+		close(done)
+	}()
+	require.Eventually(t, func() bool {
+		rb.mu.Lock()
+		defer rb.mu.Unlock()
+		return len(rb.raw) >= 2
+	}, time.Second, 5*time.Millisecond)
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("heartbeat loop did not stop")
+	}
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	var hb heartbeat
+	require.NoError(t, json.Unmarshal(rb.raw[0], &hb))
+	assert.Equal(t, broker.Heartbeat, hb.EventType)
+	assert.Equal(t, Version, hb.Version)
+	assert.False(t, hb.BrokerConnected)
+	require.NotNil(t, hb.LastBackup)
+	assert.Equal(t, "backup", hb.LastBackup.ActionID)
+	assert.Equal(t, statusFailed, hb.LastBackup.Status)
+	assert.Equal(t, "boom", hb.LastBackup.Error)
+}
+
+func TestServerHeartbeatDisabled(t *testing.T) {
+	viper.Set("heartbeat_interval", 0)
+	defer viper.Set("heartbeat_interval", nil)
+
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test"))
+	require.NoError(t, err)
+	// Returns at once instead of blocking on the never closed stop channel.
+	s.heartbeatLoop(context.Background(), make(chan struct{}))
+	assert.Empty(t, rb.raw)
+}
+
+func TestServerProgressState(t *testing.T) {
+	viper.Set("progress_state_interval", time.Nanosecond)
+	defer viper.Set("progress_state_interval", nil)
+	viper.Set("progress_event_interval", 0)
+	defer viper.Set("progress_event_interval", nil)
+
+	dir := t.TempDir()
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"), WithProgressStateDir(dir))
+	require.NoError(t, err)
+
+	// A backup of bd1 persists its progress until the agent is stopped.
+	state := s.newBackupState("action1", "bd1", "rp1", progress.Stat{Items: 4, Bytes: 100})
+	p := s.newUploadProgress("action1", "bd1", "rp1", progress.Stat{Items: 4, Bytes: 100}, state, nil)
+	p.Start()
+	p.Report(progress.Stat{Items: 2, Bytes: 40, Storage: 10})
+	p.Cancel()
+
+	states, err := progress.LoadStates(dir)
+	require.NoError(t, err)
+	require.Contains(t, states, "bd1")
+	assert.Equal(t, uint64(40), states["bd1"].Bytes)
+
+	// On restart the interrupted backup is reported with its last progress.
+	restarted, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"), WithProgressStateDir(dir))
+	require.NoError(t, err)
+	restarted.reportInterruptedBackups()
+	rb.mu.Lock()
+	require.Len(t, rb.payloads, 1)
+	assert.Equal(t, "action1", rb.payloads[0]["action_id"])
+	assert.Equal(t, statusFailed, rb.payloads[0]["status"])
+	assert.Equal(t, "2/4", rb.payloads[0]["items"])
+	rb.mu.Unlock()
+	states, err = progress.LoadStates(dir)
+	require.NoError(t, err)
+	assert.Empty(t, states)
+
+	// The next backup of bd1 reports where it resumes from, and cleans up.
+	state = restarted.newBackupState("action2", "bd1", "rp2", progress.Stat{})
+	assert.Equal(t, "rp1", state.resumedFromID())
+	assert.Empty(t, restarted.newBackupState("action3", "bd1", "rp3", progress.Stat{}).resumedFromID())
+	require.NoError(t, state.save(progress.Stat{Bytes: 1}, time.Second))
+	require.NoError(t, state.remove())
+	states, err = progress.LoadStates(dir)
+	require.NoError(t, err)
+	assert.Empty(t, states)
+
+	viper.Set("progress_state_interval", 0)
+	assert.Nil(t, restarted.newBackupState("action4", "bd1", "rp4", progress.Stat{}))
+}
+
+func TestServerJournal(t *testing.T) {
+	viper.Set("backup_journal", true)
+	defer viper.Set("backup_journal", nil)
+	defer viper.Set("backup_journal_max_age", nil)
+
+	dir := t.TempDir()
+	rb := &recordBroker{}
+	s, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"), WithProgressStateDir(dir))
+	require.NoError(t, err)
+
+	action := func(id string) *backupapi.CreateRecoveryPointResponse {
+		return &backupapi.CreateRecoveryPointResponse{ID: "action-" + id, RecoveryPoint: &backupapi.RecoveryPoint{ID: "rp-" + id}}
+	}
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 8, time.UTC)
+	j := s.startJournal(action("1"), "bd1")
+	require.NotNil(t, j)
+	require.NoError(t, j.record(&cache.Node{AbsolutePath: "/data/a", ModTime: mtime, Size: 3, Content: []*cache.ChunkInfo{{Etag: "etag", Length: 3}}, Sha256Hash: []byte("hash")}))
+	require.NoError(t, j.record(&cache.Node{AbsolutePath: "/data/b", ModTime: mtime, Size: 4}))
+	// The agent stopped in the middle of a line.
+	_, err = j.file.Write([]byte(`{"path":"/data/c","mod`))
+	require.NoError(t, err)
+	require.NoError(t, j.file.Close())
+	j2 := s.startJournal(action("2"), "bd2")
+	require.NotNil(t, j2)
+	require.NoError(t, j2.file.Close())
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(journalPath(dir, "bd2"), old, old))
+
+	// On restart bd1 can be resumed, the stale journal of bd2 is abandoned.
+	restarted, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"), WithProgressStateDir(dir))
+	require.NoError(t, err)
+	restarted.reportInterruptedBackups()
+	rb.mu.Lock()
+	require.Len(t, rb.payloads, 2)
+	byAction := map[string]map[string]string{}
+	for _, p := range rb.payloads {
+		byAction[p["action_id"]] = p
+	}
+	rb.payloads = nil
+	rb.mu.Unlock()
+	assert.Equal(t, statusResumable, byAction["action-1"]["status"])
+	assert.Equal(t, "2", byAction["action-1"]["files"])
+	assert.Equal(t, statusFailed, byAction["action-2"]["status"])
+	assert.Equal(t, journalExpiredReason, byAction["action-2"]["reason"])
+	assert.NoFileExists(t, journalPath(dir, "bd2"))
+
+	rec := httptest.NewRecorder()
+	restarted.ListJournals(rec, httptest.NewRequest(http.MethodGet, "/backups/journals", nil))
+	var infos []JournalInfo
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&infos))
+	require.Len(t, infos, 1)
+	assert.Equal(t, "rp-1", infos[0].RecoveryPointID)
+	assert.Equal(t, 2, infos[0].Files)
+
+	// Reopened to go on, the cut line is dropped and new files are kept.
+	j, err = openJournal(journalPath(dir, "bd1"))
+	require.NoError(t, err)
+	assert.Nil(t, j.lookup("/data/a", mtime.Add(time.Second), 3))
+	assert.Nil(t, j.lookup("/data/c", mtime, 3))
+	node := j.lookup("/data/a", mtime, 3)
+	require.NotNil(t, node)
+	assert.Equal(t, "etag", node.Content[0].Etag)
+	require.NoError(t, j.record(&cache.Node{AbsolutePath: "/data/c", ModTime: mtime, Size: 5}))
+	require.NoError(t, j.file.Close())
+	j, err = readJournal(journalPath(dir, "bd1"))
+	require.NoError(t, err)
+	assert.Len(t, j.entries, 3)
+
+	// Abandoned, the recovery point is reported as failed.
+	r := httptest.NewRequest(http.MethodDelete, "/backups/bd1/journal", nil)
+	rctx := chi.NewRouteContext()
+	rctx.URLParams.Add("backupID", "bd1")
+	r = r.WithContext(context.WithValue(r.Context(), chi.RouteCtxKey, rctx))
+	rec = httptest.NewRecorder()
+	restarted.AbandonJournal(rec, r)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NoFileExists(t, journalPath(dir, "bd1"))
+	rb.mu.Lock()
+	require.Len(t, rb.payloads, 1)
+	assert.Equal(t, "action-1", rb.payloads[0]["action_id"])
+	assert.Equal(t, journalAbandonReason, rb.payloads[0]["reason"])
+	rb.mu.Unlock()
+
+	rec = httptest.NewRecorder()
+	restarted.AbandonJournal(rec, r)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.ErrorIs(t, restarted.resumeBackup("bd1", 0, 0, io.Discard), ErrorNoJournal)
+
+	viper.Set("backup_journal", false)
+	assert.Nil(t, restarted.startJournal(action("3"), "bd3"))
+}
+
+func TestErrorThreshold(t *testing.T) {
+	tests := []struct {
+		s       string
+		failed  uint64
+		total   uint64
+		final   bool
+		want    bool
+		wantErr bool
+	}{
+		{"", 1000, 1000, true, false, false},
+		{"0", 1000, 1000, true, false, false},
+		{"10", 10, 20, false, false, false},
+		{"10", 11, 20, false, true, false},
+		{"5%", 6, 100, false, true, false},
+		{"5%", 5, 100, false, false, false},
+		{"5%", 2, 10, false, false, false},
+		{"5%", 2, 10, true, true, false},
+		{"2.5%", 3, 100, false, true, false},
+		{"abc", 0, 0, false, false, true},
+		{"150%", 0, 0, false, false, true},
+		{"-1", 0, 0, false, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.s, func(t *testing.T) {
+			threshold, err := parseErrorThreshold(tt.s)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, threshold.exceeded(tt.failed, tt.total, tt.final))
+		})
+	}
+}
+
+func TestFileErrors(t *testing.T) {
+	errRead := errors.New("input/output error")
+
+	// Without continue_on_error the first error fails the backup.
+	errs, err := fileErrorsFromConfig()
+	require.NoError(t, err)
+	assert.Nil(t, errs)
+	assert.Equal(t, errRead, errs.add("/a", errRead, 1))
+	assert.NoError(t, errs.final(1))
+
+	viper.Set("continue_on_error", true)
+	viper.Set("max_file_errors", "2")
+	defer viper.Set("continue_on_error", nil)
+	defer viper.Set("max_file_errors", nil)
+	errs, err = fileErrorsFromConfig()
+	require.NoError(t, err)
+	assert.NoError(t, errs.add("/a", errRead, 1))
+	assert.NoError(t, errs.add("/b", errRead, 2))
+	err = errs.add("/c", errRead, 3)
+	assert.ErrorIs(t, err, ErrorTooManyFileErrors)
+	assert.Equal(t, []string{"/a", "/b", "/c"}, errs.failed())
+
+	viper.Set("max_file_errors", "10%")
+	errs, err = fileErrorsFromConfig()
+	require.NoError(t, err)
+	assert.NoError(t, errs.add("/a", errRead, 1))
+	assert.ErrorIs(t, errs.final(5), ErrorTooManyFileErrors)
+	assert.NoError(t, errs.final(10))
+
+	viper.Set("max_file_errors", "many")
+	_, err = fileErrorsFromConfig()
+	assert.Error(t, err)
+}
+
+func TestPermissionErrors(t *testing.T) {
+	defer viper.Set("permission_errors", nil)
+	errDenied := &os.PathError{Op: "open", Path: "/a", Err: fs.ErrPermission}
+
+	for _, policy := range []string{"", permissionErrorsFail} {
+		viper.Set("permission_errors", policy)
+		denied, err := permissionErrorsFromConfig()
+		require.NoError(t, err)
+		assert.Equal(t, errDenied, denied.add("/a", errDenied, 1))
+	}
+
+	// Skipped items are not limited by max_file_errors.
+	viper.Set("permission_errors", permissionErrorsSkip)
+	denied, err := permissionErrorsFromConfig()
+	require.NoError(t, err)
+	for i := uint64(1); i <= 3; i++ {
+		assert.NoError(t, denied.add("/a", errDenied, i))
+	}
+	assert.Len(t, denied.failed(), 3)
+
+	viper.Set("permission_errors", "ignore")
+	_, err = permissionErrorsFromConfig()
+	assert.Error(t, err)
+}
+
+func TestWalkerDirSymlinkRoot(t *testing.T) {
+	defer viper.Set("refuse_root_symlink", nil)
+
+	target, err := filepath.EvalSymlinks(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(target, "file"), []byte("data"), 0600))
+	require.NoError(t, os.Symlink(filepath.Join(target, "file"), filepath.Join(target, "inner-link")))
+	root := filepath.Join(t.TempDir(), "root")
+	require.NoError(t, os.Symlink(target, root))
+
+	// The tree behind the root link is walked, links below it are kept as is.
+	index := cache.NewIndex("bd", "rp")
+	_, total, err := WalkerDir(root, index, progress.NewProgress(time.Second), walkLimits{}, nil, nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), total)
+	assert.Equal(t, root, index.Path)
+	assert.Equal(t, target, index.ResolvedPath)
+	require.Contains(t, index.Items, filepath.Join(target, "file"))
+	assert.Equal(t, "file", index.Items[filepath.Join(target, "file")].Type)
+	assert.Equal(t, "symlink", index.Items[filepath.Join(target, "inner-link")].Type)
+
+	// A root which is not a link has no resolved path.
+	index = cache.NewIndex("bd", "rp")
+	_, _, err = WalkerDir(target, index, progress.NewProgress(time.Second), walkLimits{}, nil, nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, target, index.Path)
+	assert.Empty(t, index.ResolvedPath)
+
+	viper.Set("refuse_root_symlink", true)
+	_, _, err = WalkerDir(root, cache.NewIndex("bd", "rp"), progress.NewProgress(time.Second), walkLimits{}, nil, nil, zap.NewNop())
+	assert.ErrorIs(t, err, ErrorRootSymlink)
+}
+
+func TestWalkerDirOneFileSystem(t *testing.T) {
+	defer viper.Set("one_file_system", nil)
+	viper.Set("one_file_system", true)
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "sub", "file"), []byte("data"), 0600))
+	index := cache.NewIndex("bd", "rp")
+	_, total, err := WalkerDir(dir, index, progress.NewProgress(time.Second), walkLimits{}, nil, nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.Empty(t, index.SkippedMounts)
+
+	// /dev/pts is usually a mount point of its own below /dev.
+	devFi, err := os.Stat("/dev")
+	if err != nil {
+		t.Skip("no /dev")
+	}
+	ptsFi, err := os.Stat("/dev/pts")
+	if err != nil {
+		t.Skip("no /dev/pts")
+	}
+	devID, ok := support.DeviceID(devFi)
+	ptsID, _ := support.DeviceID(ptsFi)
+	if !ok || devID == ptsID {
+		t.Skip("/dev/pts is not a mount point")
+	}
+	index = cache.NewIndex("bd", "rp")
+	_, _, err = WalkerDir("/dev", index, progress.NewProgress(time.Second), walkLimits{}, &fileErrors{}, nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.Contains(t, index.SkippedMounts, "/dev/pts")
+	assert.Contains(t, index.Items, "/dev/pts")
+	for path := range index.Items {
+		assert.False(t, strings.HasPrefix(path, "/dev/pts/"), path)
+	}
+}
+
+func TestWalkerDirContinueOnError(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any directory")
+	}
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0600))
+	locked := filepath.Join(dir, "locked")
+	require.NoError(t, os.Mkdir(locked, 0700))
+	require.NoError(t, os.WriteFile(filepath.Join(locked, "secret"), []byte("data"), 0600))
+	require.NoError(t, os.Chmod(locked, 0))
+	defer os.Chmod(locked, 0700)
+
+	index := cache.NewIndex("bd", "rp")
+	_, _, err := WalkerDir(dir, index, progress.NewProgress(time.Second), walkLimits{}, nil, nil, zap.NewNop())
+	assert.Error(t, err)
+
+	errs := &fileErrors{}
+	index = cache.NewIndex("bd", "rp")
+	_, total, err := WalkerDir(dir, index, progress.NewProgress(time.Second), walkLimits{}, errs, nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.Equal(t, []string{locked}, errs.failed())
+
+	// A percentage is only checked once the backup knows all its items.
+	errs = &fileErrors{threshold: errorThreshold{percent: 10}}
+	index = cache.NewIndex("bd", "rp")
+	_, _, err = WalkerDir(dir, index, progress.NewProgress(time.Second), walkLimits{}, errs, nil, zap.NewNop())
+	require.NoError(t, err)
+	assert.ErrorIs(t, errs.final(uint64(len(index.Items)+1)), ErrorTooManyFileErrors)
+
+	// Without permission, the directory is left out and recorded as denied
+	// whatever the other errors allowed.
+	denied := &fileErrors{}
+	index = cache.NewIndex("bd", "rp")
+	_, total, err = WalkerDir(dir, index, progress.NewProgress(time.Second), walkLimits{}, nil, denied, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+	assert.Equal(t, []string{locked}, denied.failed())
+	assert.NotContains(t, index.Items, locked)
+}
+
+func TestServerConfigDir(t *testing.T) {
+	dir := t.TempDir()
+	writeFragment := func(content string) {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "10-local.yaml"), []byte(content), 0600))
+	}
+	writeFragment(`
+backup_directories:
+- id: dir1
+  path: /local/dir1
+  activated: true
+  policies:
+  - id: local_policy
+    schedule_pattern: '0 1 * * *'
+`)
+	s, err := New(WithConfigDir(dir))
+	require.NoError(t, err)
+
+	server := []backupapi.BackupDirectoryConfig{
+		{ID: "dir1", Activated: true, Policies: []backupapi.BackupDirectoryConfigPolicy{{ID: "server_policy", SchedulePattern: "0 2 * * *"}}},
+		{ID: "dir2", Activated: true, Policies: []backupapi.BackupDirectoryConfigPolicy{{ID: "policy_2", SchedulePattern: "0 3 * * *"}}},
+	}
+	require.NoError(t, s.handleConfigRefresh(server))
+	// dir1 is defined locally, the server schedule of dir1 is ignored.
+	assert.Len(t, s.cronManager.Entries(), 2)
+	assert.Contains(t, s.mappingToCronEntryID, mappingID("dir1", "local_policy"))
+	assert.Contains(t, s.mappingToCronEntryID, mappingID("dir2", "policy_2"))
+
+	// A ConfigUpdate reloads the fragments.
+	writeFragment(`
+backup_directories:
+- id: dir1
+  path: /local/dir1
+  activated: true
+  policies:
+  - id: local_policy
+    schedule_pattern: '0 1 * * *'
+  - id: local_policy_2
+    schedule_pattern: '0 4 * * *'
+`)
+	require.NoError(t, s.handleConfigUpdate(broker.Message{Action: broker.ConfigUpdateActionUpdatePolicy, BackupDirectories: server[:1]}))
+	assert.Len(t, s.cronManager.Entries(), 3)
+	assert.Contains(t, s.mappingToCronEntryID, mappingID("dir1", "local_policy_2"))
+	assert.NotContains(t, s.mappingToCronEntryID, mappingID("dir1", "server_policy"))
+
+	// An invalid fragment keeps the previous schedules.
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "20-dup.yaml"), []byte("backup_directories:\n- id: dir1\n  path: /other\n"), 0600))
+	require.NoError(t, s.handleConfigRefresh(server))
+	assert.Len(t, s.cronManager.Entries(), 3)
+	assert.Len(t, s.localDirectories, 1)
+}
+
+func TestVaultRequests(t *testing.T) {
+	vault := budget.New(memory.New("vault", ""), 0)
+	require.NoError(t, vault.PutObject(context.Background(), "key", []byte("data")))
+	n, ok := vaultRequests(vault)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(1), n)
+
+	_, ok = vaultRequests(memory.New("vault", ""))
+	assert.False(t, ok)
+	_, ok = vaultRequests(nil)
+	assert.False(t, ok)
+}
+
+func TestServerVaultCooldown(t *testing.T) {
+	s, err := New()
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/storage-vaults/cooldown", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var state cooldown.State
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&state))
+	assert.True(t, state.Enabled)
+	assert.False(t, state.Active)
+	assert.Equal(t, 0.5, state.Threshold)
+}
+
+func TestServerFinalizeProgress(t *testing.T) {
+	s, err := New(WithBroker(&recordBroker{}), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+	require.NoError(t, err)
+
+	cachePath := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(cachePath, "mc", "rp1"), 0700))
+	for name, content := range map[string]string{"chunk.json": "{}", "file.csv": "name\n", "index.json": `{"items":{}}`} {
+		require.NoError(t, os.WriteFile(filepath.Join(cachePath, "mc", "rp1", name), []byte(content), 0600))
+	}
+
+	var done progress.Stat
+	p := s.newFinalizeProgress("rp1", finalizeObjects, nil)
+	onDone := p.OnDone
+	p.OnDone = func(stat progress.Stat, d time.Duration, ticker bool) {
+		done = stat
+		onDone(stat, d, ticker)
+	}
+	p.Start()
+
+	vault := memory.New("vault", "")
+	require.NoError(t, s.putChunks(context.Background(), cachePath, "mc", "rp1", "", vault, p))
+	require.NoError(t, s.putFiles(context.Background(), cachePath, "mc", "rp1", "", vault, p))
+	hash, size, err := s.putIndexs(context.Background(), vault, false, cachePath, "mc", "rp1", p)
+	require.NoError(t, err)
+	p.Done()
+
+	assert.Equal(t, hashIndex([]byte(`{"items":{}}`)), hash)
+	assert.Equal(t, len(`{"items":{}}`), size)
+	assert.Equal(t, uint64(finalizeObjects), done.Items)
+	assert.Equal(t, uint64(2+5+12), done.Bytes)
+}
+
+func TestAddRetryProgress(t *testing.T) {
+	vault := cooldown.New(memory.New("vault", ""), nil)
+	msg := map[string]string{}
+	addRetryProgress(msg, vault)
+	assert.Equal(t, map[string]string{"retrying": "0"}, msg)
+
+	retry := vault.Retries().Wait(nil, time.Minute)
+	defer vault.Retries().Done(retry)
+	addRetryProgress(msg, vault)
+	assert.Equal(t, "1", msg["retrying"])
+	assert.Equal(t, statusRetrying, msg["substate"])
+	d, err := time.ParseDuration(msg["next_retry"])
+	require.NoError(t, err)
+	assert.InDelta(t, time.Minute, d, float64(time.Second))
+
+	// Vaults without a tracker add nothing.
+	msg = map[string]string{}
+	addRetryProgress(msg, memory.New("vault", ""))
+	assert.Empty(t, msg)
+}
+
+func TestPlaceChunks(t *testing.T) {
+	vault := memory.New("vault", "")
+	glacier := storage_vault.WithClass(context.Background(), "GLACIER")
+	require.NoError(t, vault.PutObject(glacier, "shared", []byte("shared")))
+	require.NoError(t, vault.PutObject(glacier, "old", []byte("old")))
+	require.NoError(t, vault.PutObject(context.Background(), "hot", []byte("hot")))
+
+	chunks := cache.NewChunk("bd", "rp")
+	for _, claim := range []*cache.Chunk{
+		{Classes: map[string]string{"shared": "GLACIER"}, Uploaded: map[string]string{"shared": "GLACIER"}},
+		{Classes: map[string]string{"shared": "STANDARD"}},
+		{Classes: map[string]string{"old": "STANDARD_IA", "hot": "GLACIER", "gone": "STANDARD"}},
+		{Classes: map[string]string{"missing": "STANDARD"}, Uploaded: map[string]string{"missing": "DEEP_ARCHIVE"}},
+	} {
+		mergeClasses(chunks, claim)
+	}
+	s := &Server{logger: zap.NewNop()}
+	s.placeChunks(context.Background(), vault, chunks)
+
+	// Every chunk keeps its claim, chunks stored by earlier backups included,
+	// a chunk which cannot be moved keeps the class it is stored in.
+	assert.Equal(t, map[string]string{"shared": "STANDARD", "old": "STANDARD_IA", "hot": "GLACIER", "gone": "STANDARD", "missing": "DEEP_ARCHIVE"}, chunks.Classes)
+	for key, class := range map[string]string{"shared": "STANDARD", "old": "STANDARD_IA", "hot": "STANDARD"} {
+		info, err := vault.InspectObject(context.Background(), key)
+		require.NoError(t, err)
+		assert.Equal(t, class, info.StorageClass, key)
+	}
+}
+
+func TestServerProgressEvents(t *testing.T) {
+	viper.Set("progress_event_interval", time.Hour)
+	defer viper.Set("progress_event_interval", nil)
+
+	decode := func(t *testing.T, raw []byte) brokerProgressEvent {
+		var e brokerProgressEvent
+		require.NoError(t, json.Unmarshal(raw, &e))
+		return e
+	}
+
+	for _, canceled := range []bool{false, true} {
+		rb := &recordBroker{}
+		s, err := New(WithBroker(rb), WithPublishTopics("agent/test", "agent/recovery-points/test"))
+		require.NoError(t, err)
+
+		p := s.newUploadProgress("action1", "bd1", "rp1", progress.Stat{Items: 4, Bytes: 100}, nil, nil)
+		p.Start()
+		p.Report(progress.Stat{Items: 1, Bytes: 10, Storage: 5})
+		// Throttled: the next reports are not published.
+		p.Report(progress.Stat{Items: 1, Bytes: 30, Storage: 20})
+		time.Sleep(20 * time.Millisecond)
+		p.Report(progress.Stat{Items: 2, Bytes: 10, Storage: 5, Errors: true})
+		if canceled {
+			p.Cancel()
+		} else {
+			p.Done()
+		}
+
+		rb.mu.Lock()
+		var events []brokerProgressEvent
+		for _, raw := range rb.raw {
+			if e := decode(t, raw); e.EventType == broker.BackupProgress {
+				events = append(events, e)
+			}
+		}
+		rb.mu.Unlock()
+
+		require.Len(t, events, 2)
+		assert.Equal(t, "action1", events[0].ActionID)
+		assert.Equal(t, uint64(10), events[0].Bytes)
+		assert.False(t, events[0].Done)
+
+		// The last event is published at once, with the final progress.
+		last := events[1]
+		assert.True(t, last.Done)
+		assert.Equal(t, canceled, last.Canceled)
+		assert.Equal(t, uint64(4), last.Items)
+		assert.Equal(t, uint64(50), last.Bytes)
+		assert.Equal(t, uint64(30), last.Storage)
+		assert.True(t, last.Errors)
+		assert.Equal(t, uint64(100), last.TotalBytes)
+	}
+}
+
+func TestServerMigrateVaultLocal(t *testing.T) {
+	roots := map[string]string{"src": t.TempDir(), "dst": t.TempDir()}
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := filepath.Base(filepath.Dir(r.URL.Path))
+		vault := backupapi.StorageVault{ID: id, StorageVaultType: local.StorageVaultType, StorageBucket: roots[id]}
+		if id == "swift" {
+			vault.StorageVaultType = "SWIFT"
+		}
+		_ = json.NewEncoder(w).Encode(vault)
+	}))
+	defer backend.Close()
+
+	s, err := New()
+	require.NoError(t, err)
+	s.backupClient, err = backupapi.NewClient(backupapi.WithServerURL(backend.URL + "/api/v1"))
+	require.NoError(t, err)
+
+	src, err := local.New("src", "", roots["src"])
+	require.NoError(t, err)
+	data := []byte("hello world")
+	sum := md5.Sum(data)
+	chunk := hex.EncodeToString(sum[:])
+	require.NoError(t, src.PutObject(context.Background(), chunk, data))
+	require.NoError(t, src.PutObject(context.Background(), "mc/rp1/index.json", []byte(`{}`)))
+
+	migrate := func(src, dst string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		body := fmt.Sprintf(`{"source_storage_vault_id":%q,"destination_storage_vault_id":%q}`, src, dst)
+		s.MigrateVault(w, httptest.NewRequest(http.MethodPost, "/storage-vaults/migrate", strings.NewReader(body)))
+		return w
+	}
+
+	w := migrate("src", "dst")
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result backupapi.MigrateResult
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&result))
+	assert.Equal(t, uint64(2), result.Copied)
+	dst, err := local.New("dst", "", roots["dst"])
+	require.NoError(t, err)
+	got, err := dst.GetObject(context.Background(), chunk)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	// A storage vault the agent can not store to is refused.
+	w = migrate("src", "swift")
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "SWIFT")
+}
@@ -0,0 +1,164 @@
+// Package budget provides a storage vault wrapper which caps the number of
+// requests of a run, so that runaway retries against a misbehaving endpoint
+// abort the run instead of piling up requests.
+package budget
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+
+	"github.com/spf13/viper"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// Vault counts the object requests made to the wrapped vault, retries
+// included, and fails them once the limit is reached. The attempts the wrapped
+// vault retries itself, such as the S3 client does, count as requests too.
+type Vault struct {
+	storage_vault.StorageVault
+
+	limit    uint64
+	requests uint64
+}
+
+// New wraps inner with a budget of limit requests, 0 only counts them.
+func New(inner storage_vault.StorageVault, limit uint64) *Vault {
+	return &Vault{StorageVault: inner, limit: limit}
+}
+
+// FromConfig wraps inner with the budget configured by vault_request_budget.
+func FromConfig(inner storage_vault.StorageVault) *Vault {
+	return New(inner, uint64(viper.GetInt64("vault_request_budget")))
+}
+
+func (v *Vault) take() error {
+	n := atomic.AddUint64(&v.requests, 1)
+	if v.limit > 0 && n > v.limit {
+		return fmt.Errorf("%w: more than %d requests", storage_vault.ErrRequestBudgetExhausted, v.limit)
+	}
+	return nil
+}
+
+// counted returns the context in which the wrapped vault reports the attempts
+// it retries itself, each taking a request of the budget.
+func (v *Vault) counted(ctx context.Context) context.Context {
+	return storage_vault.WithRetryHook(ctx, v.retried)
+}
+
+func (v *Vault) retried(ctx context.Context, err error) error {
+	return v.take()
+}
+
+// Requests returns the number of requests made so far, refused ones included.
+func (v *Vault) Requests() uint64 {
+	return atomic.LoadUint64(&v.requests)
+}
+
+func (v *Vault) HeadObject(ctx context.Context, key string) (bool, string, error) {
+	if err := v.take(); err != nil {
+		return false, "", err
+	}
+	return v.StorageVault.HeadObject(v.counted(ctx), key)
+}
+
+func (v *Vault) PutObject(ctx context.Context, key string, data []byte) error {
+	if err := v.take(); err != nil {
+		return err
+	}
+	return v.StorageVault.PutObject(v.counted(ctx), key, data)
+}
+
+func (v *Vault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	if err := v.take(); err != nil {
+		return nil, err
+	}
+	return v.StorageVault.GetObject(v.counted(ctx), key)
+}
+
+// GetObjectStream forwards the stream of the wrapped vault, counted as a
+// request.
+func (v *Vault) GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	streamer, ok := v.StorageVault.(storage_vault.ObjectStreamer)
+	if !ok {
+		return nil, storage_vault.ErrNotSupported
+	}
+	if err := v.take(); err != nil {
+		return nil, err
+	}
+	return streamer.GetObjectStream(v.counted(ctx), key)
+}
+
+func (v *Vault) InspectObject(ctx context.Context, key string) (*storage_vault.ObjectInfo, error) {
+	if err := v.take(); err != nil {
+		return nil, err
+	}
+	return v.StorageVault.InspectObject(v.counted(ctx), key)
+}
+
+// CheckChunk forwards the chunk check of the wrapped vault, counted as a
+// single request.
+func (v *Vault) CheckChunk(ctx context.Context, key string, data []byte) (bool, bool, error) {
+	checker, ok := v.StorageVault.(storage_vault.ChunkChecker)
+	if !ok {
+		return false, false, storage_vault.ErrNotSupported
+	}
+	if err := v.take(); err != nil {
+		return false, false, err
+	}
+	return checker.CheckChunk(v.counted(ctx), key, data)
+}
+
+// VerifyObject forwards the object check of the wrapped vault, counted as a
+// request.
+func (v *Vault) VerifyObject(ctx context.Context, key string, data []byte) (bool, bool, string, error) {
+	verifier, ok := v.StorageVault.(storage_vault.ObjectVerifier)
+	if !ok {
+		return false, false, "", storage_vault.ErrNotSupported
+	}
+	if err := v.take(); err != nil {
+		return false, false, "", err
+	}
+	return verifier.VerifyObject(v.counted(ctx), key, data)
+}
+
+// ListObjects forwards the listing of the wrapped vault, counted as a single
+// request.
+func (v *Vault) ListObjects(ctx context.Context, prefix string, fn func(key string) error) error {
+	lister, ok := v.StorageVault.(storage_vault.ObjectLister)
+	if !ok {
+		return storage_vault.ErrNotSupported
+	}
+	if err := v.take(); err != nil {
+		return err
+	}
+	return lister.ListObjects(v.counted(ctx), prefix, fn)
+}
+
+// ExistsCacheStats forwards the existence cache stats of the wrapped vault.
+func (v *Vault) ExistsCacheStats() (uint64, uint64) {
+	if reporter, ok := v.StorageVault.(storage_vault.ExistsCacheReporter); ok {
+		return reporter.ExistsCacheStats()
+	}
+	return 0, 0
+}
+
+// Retries forwards the retry tracker of the wrapped vault.
+func (v *Vault) Retries() *storage_vault.RetryTracker {
+	return storage_vault.RetriesOf(v.StorageVault)
+}
+
+// SetObjectClass forwards the storage class change of key to the wrapped
+// vault.
+func (v *Vault) SetObjectClass(ctx context.Context, key, class string) error {
+	placer, ok := v.StorageVault.(storage_vault.ClassPlacer)
+	if !ok {
+		return storage_vault.ErrNotSupported
+	}
+	if err := v.take(); err != nil {
+		return err
+	}
+	return placer.SetObjectClass(v.counted(ctx), key, class)
+}
@@ -0,0 +1,132 @@
+package budget
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/cooldown"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/fault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+func TestVault(t *testing.T) {
+	v := New(memory.New("vault", "action"), 3)
+	require.NoError(t, v.PutObject(context.Background(), "key", []byte("data")))
+	_, _, err := v.HeadObject(context.Background(), "key")
+	require.NoError(t, err)
+	_, err = v.GetObject(context.Background(), "key")
+	require.NoError(t, err)
+
+	_, err = v.InspectObject(context.Background(), "key")
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+	assert.ErrorIs(t, v.PutObject(context.Background(), "other", []byte("data")), storage_vault.ErrRequestBudgetExhausted)
+	assert.Equal(t, uint64(5), v.Requests())
+
+	// The type and id of the wrapped vault are kept.
+	id, actionID := v.ID()
+	assert.Equal(t, "vault", id)
+	assert.Equal(t, "action", actionID)
+}
+
+func TestVaultCountsRetries(t *testing.T) {
+	// Failed requests count as much as successful ones.
+	inner := fault.New(memory.New("vault", "")).Inject(fault.Fault{Op: fault.OpPut, Times: 2, Err: fault.ServiceUnavailable()})
+	v := New(inner, 0)
+	for i := 0; i < 3; i++ {
+		_ = v.PutObject(context.Background(), "key", []byte("data"))
+	}
+	assert.Equal(t, uint64(3), v.Requests())
+	assert.Equal(t, 3, inner.Calls(fault.OpPut))
+}
+
+// retryingVault retries its gets itself, as S3 does, failing the first
+// attempts.
+type retryingVault struct {
+	*memory.Memory
+	failures int
+}
+
+func (v *retryingVault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	for ; v.failures > 0; v.failures-- {
+		if err := storage_vault.RetryAttempt(ctx, fault.ServiceUnavailable()); err != nil {
+			return nil, err
+		}
+	}
+	return v.Memory.GetObject(ctx, key)
+}
+
+func TestVaultCountsInnerRetries(t *testing.T) {
+	inner := &retryingVault{Memory: memory.New("vault", "")}
+	require.NoError(t, inner.PutObject(context.Background(), "key", []byte("data")))
+
+	// Each attempt the wrapped vault retries itself takes a request.
+	inner.failures = 2
+	v := New(inner, 0)
+	_, err := v.GetObject(context.Background(), "key")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), v.Requests())
+
+	// The retries are given up on once the budget is exhausted.
+	inner.failures = 10
+	v = New(inner, 3)
+	_, err = v.GetObject(context.Background(), "key")
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+	assert.Equal(t, uint64(4), v.Requests())
+	assert.Equal(t, 8, inner.failures)
+
+	// They are counted through the cool-down gate, which hooks them too.
+	inner.failures = 2
+	gate := cooldown.NewGate(1, time.Minute, nil)
+	v = New(cooldown.New(inner, gate), 0)
+	_, err = v.GetObject(context.Background(), "key")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(3), v.Requests())
+	assert.InDelta(t, 2.0/3, gate.State().ErrorRate, 0.01)
+}
+
+func TestVaultCheckChunk(t *testing.T) {
+	inner := memory.New("vault", "")
+	require.NoError(t, inner.PutObject(context.Background(), "key", []byte("data")))
+	v := New(inner, 0)
+	exists, same, err := v.CheckChunk(context.Background(), "key", []byte("data"))
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.True(t, same)
+	assert.Equal(t, uint64(1), v.Requests())
+
+	// Without support in the wrapped vault no request is made.
+	v = New(fault.New(inner), 0)
+	_, _, err = v.CheckChunk(context.Background(), "key", []byte("data"))
+	assert.ErrorIs(t, err, storage_vault.ErrNotSupported)
+	assert.Equal(t, uint64(0), v.Requests())
+}
+
+func TestVaultVerifyObjectListObjects(t *testing.T) {
+	inner := memory.New("vault", "")
+	require.NoError(t, inner.PutObject(context.Background(), "key", []byte("data")))
+	v := New(inner, 2)
+	exists, integrity, _, err := v.VerifyObject(context.Background(), "key", []byte("data"))
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.True(t, integrity)
+	var keys []string
+	require.NoError(t, v.ListObjects(context.Background(), "", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"key"}, keys)
+	_, _, _, err = v.VerifyObject(context.Background(), "key", []byte("data"))
+	assert.ErrorIs(t, err, storage_vault.ErrRequestBudgetExhausted)
+
+	// Without support in the wrapped vault no request is made.
+	v = New(fault.New(inner), 0)
+	_, _, _, err = v.VerifyObject(context.Background(), "key", []byte("data"))
+	assert.ErrorIs(t, err, storage_vault.ErrNotSupported)
+	assert.ErrorIs(t, v.ListObjects(context.Background(), "", func(string) error { return nil }), storage_vault.ErrNotSupported)
+	assert.Equal(t, uint64(0), v.Requests())
+}
@@ -0,0 +1,276 @@
+// Package chunkcache provides a storage vault wrapper which keeps the chunks
+// read last in memory, so that a chunk shared by several files of a restore
+// is downloaded once, and which reads chunks ahead on request.
+package chunkcache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// Vault caches the chunks read from the wrapped vault, least recently used
+// first out once they hold more than the size of the cache. The data returned
+// is shared and must not be modified.
+//
+// Chunks prefetched and not read yet hold at most half of the cache, so that
+// reading ahead never evicts them before they are used.
+type Vault struct {
+	storage_vault.StorageVault
+
+	maxBytes int64
+
+	mu         sync.Mutex
+	size       int64
+	order      *list.List
+	entries    map[string]*list.Element
+	inflight   map[string]*call
+	prefetched map[string]int64
+	ahead      int64
+	hits       uint64
+	misses     uint64
+}
+
+type entry struct {
+	key  string
+	data []byte
+}
+
+// call is a read of the wrapped vault others wait for.
+type call struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+// New wraps inner with a cache of maxBytes.
+func New(inner storage_vault.StorageVault, maxBytes int64) *Vault {
+	return &Vault{
+		StorageVault: inner,
+		maxBytes:     maxBytes,
+		order:        list.New(),
+		entries:      make(map[string]*list.Element),
+		inflight:     make(map[string]*call),
+		prefetched:   make(map[string]int64),
+	}
+}
+
+// isChunk reports whether key names a chunk, stored at the root of the vault,
+// rather than a metadata object of a recovery point.
+func isChunk(key string) bool {
+	return !strings.ContainsAny(key, `/\`)
+}
+
+// GetObject returns the chunk key from the cache, waiting for a read of key
+// already running until ctx is done, or else reads it from the wrapped vault.
+// A failed prefetch is read again.
+func (v *Vault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	if !isChunk(key) {
+		return v.StorageVault.GetObject(ctx, key)
+	}
+	data, ok, err := v.cached(ctx, key)
+	if ok || err != nil {
+		return data, err
+	}
+	c := v.start(key)
+	v.mu.Unlock()
+	return v.fetch(ctx, key, c)
+}
+
+// cached returns the chunk key from the cache, waiting for a read of key
+// already running until ctx is done. When key is neither cached nor being
+// read, or its read failed, the miss is counted and cached returns with v.mu
+// held.
+func (v *Vault) cached(ctx context.Context, key string) ([]byte, bool, error) {
+	v.mu.Lock()
+	v.consumed(key)
+	if e, ok := v.entries[key]; ok {
+		v.order.MoveToFront(e)
+		v.hits++
+		data := e.Value.(*entry).data
+		v.mu.Unlock()
+		return data, true, nil
+	}
+	if c, ok := v.inflight[key]; ok {
+		v.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-c.done:
+		}
+		if c.err == nil {
+			v.mu.Lock()
+			v.hits++
+			v.mu.Unlock()
+			return c.data, true, nil
+		}
+		v.mu.Lock()
+	}
+	v.misses++
+	return nil, false, nil
+}
+
+// GetObjectStream returns a reader of the chunk key from the cache, waiting
+// for a read of key already running until ctx is done, or else opens key for
+// reading from the wrapped vault as it is downloaded. A chunk streamed whole is
+// cached when the stream is closed.
+func (v *Vault) GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	streamer, ok := v.StorageVault.(storage_vault.ObjectStreamer)
+	if !ok {
+		return nil, storage_vault.ErrNotSupported
+	}
+	if !isChunk(key) {
+		return streamer.GetObjectStream(ctx, key)
+	}
+	data, ok, err := v.cached(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	v.mu.Unlock()
+	body, err := streamer.GetObjectStream(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return &stream{vault: v, key: key, body: body}, nil
+}
+
+// stream is a chunk read from the wrapped vault, kept as it is read so that it
+// can be cached once read whole. A chunk larger than the cache or failing to
+// read is not kept.
+type stream struct {
+	vault *Vault
+	key   string
+	body  io.ReadCloser
+	buf   bytes.Buffer
+	whole bool
+	skip  bool
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	n, err := s.body.Read(p)
+	if !s.skip {
+		if int64(s.buf.Len()+n) > s.vault.maxBytes {
+			s.skip = true
+			s.buf = bytes.Buffer{}
+		} else {
+			s.buf.Write(p[:n])
+		}
+	}
+	switch {
+	case err == io.EOF:
+		s.whole = true
+	case err != nil:
+		s.skip = true
+	}
+	return n, err
+}
+
+func (s *stream) Close() error {
+	if s.whole && !s.skip {
+		s.vault.add(s.key, s.buf.Bytes())
+	}
+	return s.body.Close()
+}
+
+// Prefetch starts reading chunk key of size bytes in the background, unless
+// it is cached, already being read, or would take the chunks prefetched and
+// not read yet past half of the cache. The read is canceled with ctx.
+func (v *Vault) Prefetch(ctx context.Context, key string, size int64) bool {
+	if !isChunk(key) {
+		return false
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.entries[key]; ok {
+		return true
+	}
+	if _, ok := v.inflight[key]; ok {
+		return true
+	}
+	if v.ahead+size > v.maxBytes/2 {
+		return false
+	}
+	v.ahead += size
+	v.prefetched[key] = size
+	c := v.start(key)
+	go func() {
+		if _, err := v.fetch(ctx, key, c); err != nil {
+			v.mu.Lock()
+			v.consumed(key)
+			v.mu.Unlock()
+		}
+	}()
+	return true
+}
+
+// start records a read of key by the caller, v.mu held.
+func (v *Vault) start(key string) *call {
+	c := &call{done: make(chan struct{})}
+	v.inflight[key] = c
+	return c
+}
+
+func (v *Vault) fetch(ctx context.Context, key string, c *call) ([]byte, error) {
+	c.data, c.err = v.StorageVault.GetObject(ctx, key)
+	if c.err == nil {
+		v.add(key, c.data)
+	}
+	v.mu.Lock()
+	if v.inflight[key] == c {
+		delete(v.inflight, key)
+	}
+	v.mu.Unlock()
+	close(c.done)
+	return c.data, c.err
+}
+
+// consumed releases the share of the prefetched chunk key, v.mu held.
+func (v *Vault) consumed(key string) {
+	if size, ok := v.prefetched[key]; ok {
+		v.ahead -= size
+		delete(v.prefetched, key)
+	}
+}
+
+func (v *Vault) add(key string, data []byte) {
+	if int64(len(data)) > v.maxBytes {
+		return
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if _, ok := v.entries[key]; ok {
+		return
+	}
+	v.entries[key] = v.order.PushFront(&entry{key: key, data: data})
+	v.size += int64(len(data))
+	for v.size > v.maxBytes {
+		oldest := v.order.Back()
+		e := oldest.Value.(*entry)
+		v.order.Remove(oldest)
+		delete(v.entries, e.key)
+		v.size -= int64(len(e.data))
+		v.consumed(e.key)
+	}
+}
+
+// Stats returns the hits and misses of the cache. A chunk read while being
+// prefetched is a hit.
+func (v *Vault) Stats() (uint64, uint64) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.hits, v.misses
+}
+
+// Retries forwards the retry tracker of the wrapped vault.
+func (v *Vault) Retries() *storage_vault.RetryTracker {
+	return storage_vault.RetriesOf(v.StorageVault)
+}
@@ -0,0 +1,176 @@
+package chunkcache
+
+import (
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+func TestVault(t *testing.T) {
+	inner := memory.New("vault", "")
+	for key, data := range map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc", "big": "0123456789", "mc/rp/index.json": "{}"} {
+		require.NoError(t, inner.PutObject(context.Background(), key, []byte(data)))
+	}
+	v := New(inner, 8)
+
+	get := func(key string) string {
+		data, err := v.GetObject(context.Background(), key)
+		require.NoError(t, err)
+		return string(data)
+	}
+	assert.Equal(t, "aaaa", get("a"))
+	assert.Equal(t, "bbbb", get("b"))
+	assert.Equal(t, "aaaa", get("a"))
+	hits, misses := v.Stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(2), misses)
+
+	// c evicts b, read longer ago than a.
+	assert.Equal(t, "cccc", get("c"))
+	inner.Delete("a")
+	inner.Delete("b")
+	assert.Equal(t, "aaaa", get("a"))
+	_, err := v.GetObject(context.Background(), "b")
+	assert.Error(t, err)
+
+	// Chunks larger than the cache and metadata objects are not kept.
+	assert.Equal(t, "0123456789", get("big"))
+	assert.Equal(t, "{}", get("mc/rp/index.json"))
+	inner.Delete("big")
+	inner.Delete("mc/rp/index.json")
+	_, err = v.GetObject(context.Background(), "big")
+	assert.Error(t, err)
+	_, err = v.GetObject(context.Background(), "mc/rp/index.json")
+	assert.Error(t, err)
+	assert.Equal(t, "cccc", get("c"))
+}
+
+// gatedVault counts the reads of the wrapped vault and holds them until
+// release is closed.
+type gatedVault struct {
+	*memory.Memory
+	release chan struct{}
+	mu      sync.Mutex
+	reads   map[string]int
+}
+
+func (g *gatedVault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	g.mu.Lock()
+	g.reads[key]++
+	g.mu.Unlock()
+	<-g.release
+	return g.Memory.GetObject(ctx, key)
+}
+
+func TestVaultPrefetch(t *testing.T) {
+	inner := &gatedVault{Memory: memory.New("vault", ""), release: make(chan struct{}), reads: make(map[string]int)}
+	for key, data := range map[string]string{"a": "aaaa", "b": "bbbb", "c": "cccc", "mc/rp/index.json": "{}"} {
+		require.NoError(t, inner.PutObject(context.Background(), key, []byte(data)))
+	}
+	v := New(inner, 16)
+
+	// Prefetched chunks hold at most half of the cache.
+	assert.True(t, v.Prefetch(context.Background(), "a", 4))
+	assert.True(t, v.Prefetch(context.Background(), "b", 4))
+	assert.True(t, v.Prefetch(context.Background(), "a", 4))
+	assert.False(t, v.Prefetch(context.Background(), "c", 4))
+	assert.False(t, v.Prefetch(context.Background(), "mc/rp/index.json", 2))
+
+	// A read waits for the prefetch of its chunk instead of reading it again.
+	done := make(chan string)
+	go func() {
+		data, err := v.GetObject(context.Background(), "a")
+		assert.NoError(t, err)
+		done <- string(data)
+	}()
+	close(inner.release)
+	assert.Equal(t, "aaaa", <-done)
+	data, err := v.GetObject(context.Background(), "b")
+	require.NoError(t, err)
+	assert.Equal(t, "bbbb", string(data))
+	assert.Equal(t, map[string]int{"a": 1, "b": 1}, inner.reads)
+	hits, misses := v.Stats()
+	assert.Equal(t, uint64(2), hits)
+	assert.Equal(t, uint64(0), misses)
+
+	// Reading the prefetched chunks frees their share.
+	assert.True(t, v.Prefetch(context.Background(), "c", 8))
+	data, err = v.GetObject(context.Background(), "c")
+	require.NoError(t, err)
+	assert.Equal(t, "cccc", string(data))
+
+	// A failed prefetch is read again, and frees its share.
+	assert.True(t, v.Prefetch(context.Background(), "missing", 8))
+	_, err = v.GetObject(context.Background(), "missing")
+	assert.Error(t, err)
+	require.NoError(t, inner.PutObject(context.Background(), "d", []byte("dddddddd")))
+	assert.True(t, v.Prefetch(context.Background(), "d", 8))
+}
+
+func TestVaultGetObjectCanceled(t *testing.T) {
+	inner := &gatedVault{Memory: memory.New("vault", ""), release: make(chan struct{}), reads: make(map[string]int)}
+	require.NoError(t, inner.PutObject(context.Background(), "a", []byte("aaaa")))
+	v := New(inner, 16)
+
+	// A read waiting for the prefetch of its chunk gives up with its context.
+	assert.True(t, v.Prefetch(context.Background(), "a", 4))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := v.GetObject(ctx, "a")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	close(inner.release)
+	data, err := v.GetObject(context.Background(), "a")
+	require.NoError(t, err)
+	assert.Equal(t, "aaaa", string(data))
+}
+
+func TestVaultGetObjectStream(t *testing.T) {
+	inner := memory.New("vault", "")
+	for key, data := range map[string]string{"a": "aaaa", "b": "bbbb", "big": "0123456789"} {
+		require.NoError(t, inner.PutObject(context.Background(), key, []byte(data)))
+	}
+	v := New(inner, 8)
+
+	read := func(key string, n int64) string {
+		body, err := v.GetObjectStream(context.Background(), key)
+		require.NoError(t, err)
+		defer body.Close()
+		data, err := io.ReadAll(io.LimitReader(body, n))
+		require.NoError(t, err)
+		return string(data)
+	}
+
+	// A chunk streamed whole is cached, one read in part or larger than the
+	// cache is not.
+	assert.Equal(t, "aaaa", read("a", 8))
+	assert.Equal(t, "bb", read("b", 2))
+	assert.Equal(t, "0123456789", read("big", 16))
+	inner.Delete("a")
+	inner.Delete("b")
+	inner.Delete("big")
+	assert.Equal(t, "aaaa", read("a", 8))
+	_, err := v.GetObjectStream(context.Background(), "b")
+	assert.Error(t, err)
+	_, err = v.GetObjectStream(context.Background(), "big")
+	assert.Error(t, err)
+	hits, misses := v.Stats()
+	assert.Equal(t, uint64(1), hits)
+	assert.Equal(t, uint64(5), misses)
+
+	// A vault which cannot stream is read whole by the caller.
+	_, err = New(plainVault{inner}, 8).GetObjectStream(context.Background(), "a")
+	assert.ErrorIs(t, err, storage_vault.ErrNotSupported)
+}
+
+// plainVault hides the stream of the wrapped vault.
+type plainVault struct {
+	storage_vault.StorageVault
+}
@@ -0,0 +1,58 @@
+package storage_vault
+
+import "context"
+
+// ClassPlacer is implemented by storage vaults which can store an object in a
+// given storage class. They put objects in the class of WithClass.
+type ClassPlacer interface {
+	// SetObjectClass moves the object stored under key to class.
+	SetObjectClass(ctx context.Context, key, class string) error
+}
+
+type classKey struct{}
+
+// WithClass returns a context derived from ctx whose puts store their object
+// in storage class class, retries included. Each put carries its own class,
+// so that backups sharing a vault never mix up theirs.
+func WithClass(ctx context.Context, class string) context.Context {
+	return context.WithValue(ctx, classKey{}, class)
+}
+
+// ClassOf returns the storage class of the puts of ctx, empty when not set.
+func ClassOf(ctx context.Context) string {
+	class, _ := ctx.Value(classKey{}).(string)
+	return class
+}
+
+// classRanks orders the S3 storage classes from the fastest to the cheapest
+// tier. Other classes rank with the fastest, so that an unknown class never
+// takes a chunk out of a hotter one.
+var classRanks = map[string]int{
+	"STANDARD":            0,
+	"REDUCED_REDUNDANCY":  0,
+	"EXPRESS_ONEZONE":     0,
+	"INTELLIGENT_TIERING": 1,
+	"STANDARD_IA":         2,
+	"ONEZONE_IA":          3,
+	"GLACIER_IR":          4,
+	"GLACIER":             5,
+	"DEEP_ARCHIVE":        6,
+}
+
+// HotterClass returns the faster of storage classes a and b, a when they rank
+// the same.
+func HotterClass(a, b string) string {
+	if classRanks[b] < classRanks[a] {
+		return b
+	}
+	return a
+}
+
+// ColderClass returns the cheaper of storage classes a and b, a when they rank
+// the same.
+func ColderClass(a, b string) string {
+	if classRanks[b] > classRanks[a] {
+		return b
+	}
+	return a
+}
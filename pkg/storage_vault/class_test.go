@@ -0,0 +1,29 @@
+package storage_vault
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHotterClass(t *testing.T) {
+	assert.Equal(t, "STANDARD", HotterClass("GLACIER", "STANDARD"))
+	assert.Equal(t, "STANDARD_IA", HotterClass("STANDARD_IA", "DEEP_ARCHIVE"))
+	assert.Equal(t, "GLACIER", ColderClass("GLACIER", "STANDARD"))
+	assert.Equal(t, "DEEP_ARCHIVE", ColderClass("STANDARD_IA", "DEEP_ARCHIVE"))
+	// An unknown class ranks with the fastest, ties keep the first class.
+	assert.Equal(t, "HOT", HotterClass("HOT", "STANDARD"))
+	assert.Equal(t, "STANDARD", HotterClass("STANDARD", "HOT"))
+	assert.Equal(t, "GLACIER", ColderClass("GLACIER", "HOT"))
+}
+
+func TestWithClass(t *testing.T) {
+	ctx := context.Background()
+	assert.Empty(t, ClassOf(ctx))
+	glacier := WithClass(ctx, "GLACIER")
+	assert.Equal(t, "GLACIER", ClassOf(glacier))
+	// Each put carries its own class.
+	assert.Equal(t, "STANDARD", ClassOf(WithClass(glacier, "STANDARD")))
+	assert.Empty(t, ClassOf(ctx))
+}
@@ -0,0 +1,366 @@
+// Package cooldown provides an agent-wide pause of storage vault requests.
+// Per request backoff retries each request on its own, so many workers keep
+// hammering a throttling endpoint. A Gate shared by all storage vaults of the
+// agent watches the error rate of their requests and, once it is too high,
+// holds every new request for a pause which grows while errors go on.
+package cooldown
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/spf13/viper"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+const (
+	defaultErrorRate = 0.5
+	defaultMaxPause  = time.Minute
+
+	// window is the number of latest requests the error rate is computed on.
+	window = 20
+	// minPause is the first pause, doubled by every following one.
+	minPause = time.Second
+)
+
+// State is the cool-down state of a Gate.
+type State struct {
+	Enabled   bool      `json:"enabled"`
+	Active    bool      `json:"active"`
+	Until     time.Time `json:"until,omitempty"`
+	Pause     string    `json:"pause"`
+	Pauses    uint64    `json:"pauses"`
+	ErrorRate float64   `json:"error_rate"`
+	Threshold float64   `json:"threshold"`
+}
+
+// Gate records the outcome of storage vault requests and pauses new ones
+// while the error rate of the latest requests is at least the threshold. A nil
+// Gate never pauses.
+type Gate struct {
+	threshold float64
+	maxPause  time.Duration
+	logger    *zap.Logger
+	now       func() time.Time
+	sleep     func(context.Context, time.Duration) error
+
+	mu       sync.Mutex
+	outcomes [window]bool
+	next     int
+	seen     int
+	failures int
+	pause    time.Duration
+	until    time.Time
+	pauses   uint64
+}
+
+// NewGate returns a Gate pausing requests once the error rate reaches
+// threshold, for at most maxPause at a time.
+func NewGate(threshold float64, maxPause time.Duration, logger *zap.Logger) *Gate {
+	if maxPause < minPause {
+		maxPause = minPause
+	}
+	return &Gate{
+		threshold: threshold,
+		maxPause:  maxPause,
+		logger:    logger,
+		now:       time.Now,
+		sleep:     storage_vault.Sleep,
+	}
+}
+
+// FromConfig returns the Gate configured by vault_cooldown_error_rate and
+// vault_cooldown_max_pause, nil when the cool-down is disabled.
+func FromConfig(logger *zap.Logger) *Gate {
+	threshold := defaultErrorRate
+	if viper.IsSet("vault_cooldown_error_rate") {
+		threshold = viper.GetFloat64("vault_cooldown_error_rate")
+	}
+	if threshold <= 0 {
+		return nil
+	}
+	maxPause := defaultMaxPause
+	if viper.IsSet("vault_cooldown_max_pause") {
+		maxPause = viper.GetDuration("vault_cooldown_max_pause")
+	}
+	return NewGate(threshold, maxPause, logger)
+}
+
+// Wait blocks while a cool-down is in progress, and returns the error of ctx
+// as soon as it is done.
+func (g *Gate) Wait(ctx context.Context) error {
+	if g == nil {
+		return ctx.Err()
+	}
+	for {
+		g.mu.Lock()
+		d := g.until.Sub(g.now())
+		g.mu.Unlock()
+		if d <= 0 {
+			return ctx.Err()
+		}
+		if err := g.sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// Record records the outcome of a request and starts a cool-down when the
+// error rate of the latest requests reaches the threshold.
+func (g *Gate) Record(err error) {
+	if g == nil {
+		return
+	}
+	failed := isFailure(err)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.seen == window && g.outcomes[g.next] {
+		g.failures--
+	}
+	g.outcomes[g.next] = failed
+	g.next = (g.next + 1) % window
+	if g.seen < window {
+		g.seen++
+	}
+	if failed {
+		g.failures++
+	}
+	if g.seen < window {
+		return
+	}
+
+	now := g.now()
+	if float64(g.failures)/window < g.threshold {
+		// The endpoint recovered, the next cool-down starts short again.
+		if !now.Before(g.until) {
+			g.pause = 0
+		}
+		return
+	}
+	if now.Before(g.until) {
+		return
+	}
+	g.pause *= 2
+	if g.pause < minPause {
+		g.pause = minPause
+	}
+	if g.pause > g.maxPause {
+		g.pause = g.maxPause
+	}
+	g.until = now.Add(g.pause)
+	g.pauses++
+	g.outcomes, g.next, g.seen, g.failures = [window]bool{}, 0, 0, 0
+	if g.logger != nil {
+		g.logger.Warn("Storage vault error rate too high, pausing requests", zap.Duration("pause", g.pause), zap.Uint64("pauses", g.pauses))
+	}
+}
+
+// State returns the current cool-down state.
+func (g *Gate) State() State {
+	if g == nil {
+		return State{Pause: "0s"}
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state := State{
+		Enabled:   true,
+		Active:    g.now().Before(g.until),
+		Pause:     g.pause.String(),
+		Pauses:    g.pauses,
+		Threshold: g.threshold,
+	}
+	if state.Active {
+		state.Until = g.until
+	}
+	if g.seen > 0 {
+		state.ErrorRate = float64(g.failures) / float64(g.seen)
+	}
+	return state
+}
+
+// isFailure reports whether err counts against the endpoint. Missing objects
+// are a normal answer.
+func isFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	var aerr awserr.Error
+	if errors.As(err, &aerr) && (aerr.Code() == "NotFound" || aerr.Code() == "NoSuchKey") {
+		return false
+	}
+	return true
+}
+
+// Vault holds the requests to the wrapped vault while the gate cools down and
+// records their outcome. It keeps track of the requests its callers retry.
+type Vault struct {
+	storage_vault.StorageVault
+
+	gate    *Gate
+	retries *storage_vault.RetryTracker
+}
+
+// New wraps inner with gate. The requests retried are tracked along with
+// those inner retries itself.
+func New(inner storage_vault.StorageVault, gate *Gate) *Vault {
+	retries := storage_vault.RetriesOf(inner)
+	if retries == nil {
+		retries = storage_vault.NewRetryTracker()
+	}
+	return &Vault{StorageVault: inner, gate: gate, retries: retries}
+}
+
+// wait holds a request while the gate cools down, and returns the context in
+// which the wrapped vault reports the attempts it retries itself, to the hooks
+// of ctx as well.
+func (v *Vault) wait(ctx context.Context) (context.Context, error) {
+	if err := v.gate.Wait(ctx); err != nil {
+		return ctx, err
+	}
+	return storage_vault.WithRetryHook(ctx, v.retried), nil
+}
+
+// retried records an attempt the wrapped vault retries itself, and holds the
+// retry while the gate cools down.
+func (v *Vault) retried(ctx context.Context, err error) error {
+	v.gate.Record(err)
+	return v.gate.Wait(ctx)
+}
+
+// Retries returns the requests to the vault being retried.
+func (v *Vault) Retries() *storage_vault.RetryTracker {
+	return v.retries
+}
+
+func (v *Vault) HeadObject(ctx context.Context, key string) (bool, string, error) {
+	ctx, err := v.wait(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	exists, etag, err := v.StorageVault.HeadObject(ctx, key)
+	v.gate.Record(err)
+	return exists, etag, err
+}
+
+func (v *Vault) PutObject(ctx context.Context, key string, data []byte) error {
+	ctx, err := v.wait(ctx)
+	if err != nil {
+		return err
+	}
+	err = v.StorageVault.PutObject(ctx, key, data)
+	v.gate.Record(err)
+	return err
+}
+
+func (v *Vault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	ctx, err := v.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	data, err := v.StorageVault.GetObject(ctx, key)
+	v.gate.Record(err)
+	return data, err
+}
+
+// GetObjectStream forwards the stream of the wrapped vault. Only opening it
+// is recorded.
+func (v *Vault) GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	streamer, ok := v.StorageVault.(storage_vault.ObjectStreamer)
+	if !ok {
+		return nil, storage_vault.ErrNotSupported
+	}
+	ctx, err := v.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := streamer.GetObjectStream(ctx, key)
+	v.gate.Record(err)
+	return body, err
+}
+
+func (v *Vault) InspectObject(ctx context.Context, key string) (*storage_vault.ObjectInfo, error) {
+	ctx, err := v.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+	info, err := v.StorageVault.InspectObject(ctx, key)
+	v.gate.Record(err)
+	return info, err
+}
+
+// CheckChunk forwards the chunk check of the wrapped vault.
+func (v *Vault) CheckChunk(ctx context.Context, key string, data []byte) (bool, bool, error) {
+	checker, ok := v.StorageVault.(storage_vault.ChunkChecker)
+	if !ok {
+		return false, false, storage_vault.ErrNotSupported
+	}
+	ctx, err := v.wait(ctx)
+	if err != nil {
+		return false, false, err
+	}
+	exists, same, err := checker.CheckChunk(ctx, key, data)
+	v.gate.Record(err)
+	return exists, same, err
+}
+
+// ListObjects forwards the listing of the wrapped vault, held and recorded
+// as a single request.
+func (v *Vault) ListObjects(ctx context.Context, prefix string, fn func(key string) error) error {
+	lister, ok := v.StorageVault.(storage_vault.ObjectLister)
+	if !ok {
+		return storage_vault.ErrNotSupported
+	}
+	ctx, err := v.wait(ctx)
+	if err != nil {
+		return err
+	}
+	err = lister.ListObjects(ctx, prefix, fn)
+	v.gate.Record(err)
+	return err
+}
+
+// VerifyObject forwards the object check of the wrapped vault.
+func (v *Vault) VerifyObject(ctx context.Context, key string, data []byte) (bool, bool, string, error) {
+	verifier, ok := v.StorageVault.(storage_vault.ObjectVerifier)
+	if !ok {
+		return false, false, "", storage_vault.ErrNotSupported
+	}
+	ctx, err := v.wait(ctx)
+	if err != nil {
+		return false, false, "", err
+	}
+	exists, integrity, etag, err := verifier.VerifyObject(ctx, key, data)
+	v.gate.Record(err)
+	return exists, integrity, etag, err
+}
+
+// ExistsCacheStats forwards the existence cache stats of the wrapped vault.
+func (v *Vault) ExistsCacheStats() (uint64, uint64) {
+	if reporter, ok := v.StorageVault.(storage_vault.ExistsCacheReporter); ok {
+		return reporter.ExistsCacheStats()
+	}
+	return 0, 0
+}
+
+// SetObjectClass forwards the storage class change of key to the wrapped
+// vault.
+func (v *Vault) SetObjectClass(ctx context.Context, key, class string) error {
+	placer, ok := v.StorageVault.(storage_vault.ClassPlacer)
+	if !ok {
+		return storage_vault.ErrNotSupported
+	}
+	ctx, err := v.wait(ctx)
+	if err != nil {
+		return err
+	}
+	err = placer.SetObjectClass(ctx, key, class)
+	v.gate.Record(err)
+	return err
+}
@@ -0,0 +1,155 @@
+package cooldown
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/fault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+type clock struct {
+	now   time.Time
+	slept []time.Duration
+}
+
+func (c *clock) sleep(ctx context.Context, d time.Duration) error {
+	c.slept = append(c.slept, d)
+	c.now = c.now.Add(d)
+	return nil
+}
+
+func testGate(threshold float64, maxPause time.Duration) (*Gate, *clock) {
+	c := &clock{now: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)}
+	g := NewGate(threshold, maxPause, nil)
+	g.now = func() time.Time { return c.now }
+	g.sleep = c.sleep
+	return g, c
+}
+
+func record(g *Gate, n int, err error) {
+	for i := 0; i < n; i++ {
+		g.Record(err)
+	}
+}
+
+// recordUntilActive records errors until a cool-down starts.
+func recordUntilActive(t *testing.T, g *Gate) {
+	for i := 0; !g.State().Active; i++ {
+		require.Less(t, i, window)
+		g.Record(fault.ServiceUnavailable())
+	}
+}
+
+func TestGate(t *testing.T) {
+	g, c := testGate(0.5, 3*time.Second)
+
+	// Below the threshold, or before a full window, nothing is paused.
+	record(g, window/2-1, fault.ServiceUnavailable())
+	record(g, window/2+1, nil)
+	assert.NoError(t, g.Wait(context.Background()))
+	assert.Empty(t, c.slept)
+	assert.False(t, g.State().Active)
+
+	// Missing objects are not errors of the endpoint.
+	record(g, window, fault.NoSuchKey())
+	assert.NoError(t, g.Wait(context.Background()))
+	assert.Empty(t, c.slept)
+
+	// The pause doubles while errors go on, up to the max pause.
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 3 * time.Second} {
+		recordUntilActive(t, g)
+		state := g.State()
+		assert.Equal(t, want.String(), state.Pause)
+		assert.NoError(t, g.Wait(context.Background()))
+		assert.Equal(t, want, c.slept[len(c.slept)-1])
+	}
+	assert.Equal(t, uint64(3), g.State().Pauses)
+
+	// Once the endpoint recovers the next pause starts short again.
+	record(g, window, nil)
+	recordUntilActive(t, g)
+	assert.Equal(t, time.Second.String(), g.State().Pause)
+}
+
+func TestGateDisabled(t *testing.T) {
+	defer viper.Set("vault_cooldown_error_rate", nil)
+
+	assert.NotNil(t, FromConfig(nil))
+	viper.Set("vault_cooldown_error_rate", 0)
+	g := FromConfig(nil)
+	require.Nil(t, g)
+
+	record(g, window, fault.ServiceUnavailable())
+	assert.NoError(t, g.Wait(context.Background()))
+	assert.False(t, g.State().Enabled)
+}
+
+func TestVault(t *testing.T) {
+	g, c := testGate(0.5, time.Minute)
+	inner := fault.New(memory.New("vault", "action")).Inject(fault.Fault{Op: fault.OpPut, Times: window, Err: fault.ServiceUnavailable()})
+	v := New(inner, g)
+
+	for i := 0; i < window; i++ {
+		assert.Error(t, v.PutObject(context.Background(), "key", []byte("data")))
+	}
+	assert.Empty(t, c.slept)
+
+	// The next request of any kind waits for the cool-down.
+	_, _, err := v.HeadObject(context.Background(), "key")
+	assert.Error(t, err)
+	assert.Equal(t, []time.Duration{time.Second}, c.slept)
+
+	require.NoError(t, v.PutObject(context.Background(), "key", []byte("data")))
+	_, err = v.GetObject(context.Background(), "key")
+	require.NoError(t, err)
+
+	id, actionID := v.ID()
+	assert.Equal(t, "vault", id)
+	assert.Equal(t, "action", actionID)
+}
+
+// retryingVault retries its puts itself, as S3 does, failing the first
+// attempts.
+type retryingVault struct {
+	*memory.Memory
+	failures int
+}
+
+func (v *retryingVault) PutObject(ctx context.Context, key string, data []byte) error {
+	for ; v.failures > 0; v.failures-- {
+		if err := storage_vault.RetryAttempt(ctx, fault.ServiceUnavailable()); err != nil {
+			return err
+		}
+	}
+	return v.Memory.PutObject(ctx, key, data)
+}
+
+func TestVaultInnerRetries(t *testing.T) {
+	g, c := testGate(0.5, time.Minute)
+	v := New(&retryingVault{Memory: memory.New("vault", ""), failures: window}, g)
+
+	// The attempts retried by the wrapped vault count, and its retries wait
+	// for the cool-down they start.
+	require.NoError(t, v.PutObject(context.Background(), "key", []byte("data")))
+	assert.Equal(t, []time.Duration{time.Second}, c.slept)
+	assert.Equal(t, uint64(1), g.State().Pauses)
+}
+
+func TestGateWaitCanceled(t *testing.T) {
+	g := NewGate(0.5, time.Minute, nil)
+	recordUntilActive(t, g)
+
+	// A canceled request does not wait for the end of the cool-down.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, g.Wait(ctx), context.Canceled)
+	_, err := New(memory.New("vault", ""), g).GetObject(ctx, "key")
+	assert.ErrorIs(t, err, context.Canceled)
+}
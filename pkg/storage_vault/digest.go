@@ -0,0 +1,19 @@
+package storage_vault
+
+import "context"
+
+type digestKey struct{}
+
+// WithDigestKey returns a context derived from ctx whose chunk puts and checks
+// record and compare the HMAC-SHA256 of chunks under key rather than their
+// sha256, which anyone reading the object metadata could match against known
+// content.
+func WithDigestKey(ctx context.Context, key []byte) context.Context {
+	return context.WithValue(ctx, digestKey{}, key)
+}
+
+// DigestKeyOf returns the key of the chunk digests of ctx, nil when not set.
+func DigestKeyOf(ctx context.Context) []byte {
+	key, _ := ctx.Value(digestKey{}).([]byte)
+	return key
+}
@@ -0,0 +1,204 @@
+// Package fault provides a storage vault wrapper which injects failures, for
+// testing the retry and credential refresh paths of its callers.
+package fault
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+// Op is a storage vault operation a fault applies to.
+type Op string
+
+const (
+	OpAny     Op = ""
+	OpHead    Op = "HeadObject"
+	OpPut     Op = "PutObject"
+	OpGet     Op = "GetObject"
+	OpInspect Op = "InspectObject"
+	OpRefresh Op = "RefreshCredential"
+)
+
+// Fault describes what happens to the calls matching Op and Key.
+//
+// The fault fires from the Nth matching call (1 based, 0 means the first one)
+// for Times calls, 0 meaning every call from then on. A firing fault sleeps
+// for Latency, then either returns Err without reaching the underlying vault,
+// or, for GetObject, drops the last Truncate bytes of the object.
+type Fault struct {
+	Op       Op
+	Key      string
+	Nth      int
+	Times    int
+	Err      error
+	Latency  time.Duration
+	Truncate int
+
+	calls int
+	fired int
+}
+
+func (f *Fault) match(op Op, key string) bool {
+	if f.Op != OpAny && f.Op != op {
+		return false
+	}
+	if f.Key != "" && f.Key != key {
+		return false
+	}
+	f.calls++
+	if f.calls < f.Nth {
+		return false
+	}
+	return f.Times == 0 || f.fired < f.Times
+}
+
+// AccessDenied returns the error S3 reports for an expired credential.
+func AccessDenied() error {
+	return awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), http.StatusForbidden, "")
+}
+
+// ServiceUnavailable returns the error S3 reports when it throttles requests.
+func ServiceUnavailable() error {
+	return awserr.NewRequestFailure(awserr.New("ServiceUnavailable", "Please reduce your request rate.", nil), http.StatusServiceUnavailable, "")
+}
+
+// NoSuchKey returns the error S3 reports on getting a missing object.
+func NoSuchKey() error {
+	return awserr.NewRequestFailure(awserr.New("NoSuchKey", "The specified key does not exist.", nil), http.StatusNotFound, "")
+}
+
+// Vault delegates to an underlying storage vault, except for the calls
+// matched by one of its faults.
+type Vault struct {
+	storage_vault.StorageVault
+
+	mu             sync.Mutex
+	faults         []*Fault
+	calls          map[Op]int
+	credentialType string
+}
+
+var _ storage_vault.StorageVault = (*Vault)(nil)
+
+// New wraps inner with no faults.
+func New(inner storage_vault.StorageVault) *Vault {
+	return &Vault{
+		StorageVault: inner,
+		calls:        make(map[Op]int),
+	}
+}
+
+// Inject adds f to the faults of v. Faults are evaluated in the order they were
+// added and the first firing one applies.
+func (v *Vault) Inject(f Fault) *Vault {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.faults = append(v.faults, &f)
+	return v
+}
+
+// SetCredentialType overrides the credential type reported by Type, so that
+// callers take their credential refresh path.
+func (v *Vault) SetCredentialType(credentialType string) *Vault {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.credentialType = credentialType
+	return v
+}
+
+// Calls returns how many times op was called, including failed calls.
+func (v *Vault) Calls(op Op) int {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.calls[op]
+}
+
+func (v *Vault) fault(op Op, key string) *Fault {
+	v.mu.Lock()
+	v.calls[op]++
+	var fired *Fault
+	for _, f := range v.faults {
+		// Every fault counts the call, only the first firing one applies.
+		if f.match(op, key) && fired == nil {
+			fired = f
+			fired.fired++
+		}
+	}
+	v.mu.Unlock()
+
+	if fired != nil && fired.Latency > 0 {
+		time.Sleep(fired.Latency)
+	}
+	return fired
+}
+
+func (v *Vault) HeadObject(ctx context.Context, key string) (bool, string, error) {
+	if f := v.fault(OpHead, key); f != nil && f.Err != nil {
+		return false, "", f.Err
+	}
+	return v.StorageVault.HeadObject(ctx, key)
+}
+
+func (v *Vault) PutObject(ctx context.Context, key string, data []byte) error {
+	if f := v.fault(OpPut, key); f != nil && f.Err != nil {
+		return f.Err
+	}
+	return v.StorageVault.PutObject(ctx, key, data)
+}
+
+func (v *Vault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	f := v.fault(OpGet, key)
+	if f != nil && f.Err != nil {
+		return nil, f.Err
+	}
+	data, err := v.StorageVault.GetObject(ctx, key)
+	if err != nil || f == nil || f.Truncate <= 0 {
+		return data, err
+	}
+	if f.Truncate >= len(data) {
+		return data[:0], nil
+	}
+	return data[:len(data)-f.Truncate], nil
+}
+
+// GetObjectStream reads key whole with GetObject, so that its faults apply.
+func (v *Vault) GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	data, err := v.GetObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+func (v *Vault) InspectObject(ctx context.Context, key string) (*storage_vault.ObjectInfo, error) {
+	if f := v.fault(OpInspect, key); f != nil && f.Err != nil {
+		return nil, f.Err
+	}
+	return v.StorageVault.InspectObject(ctx, key)
+}
+
+func (v *Vault) RefreshCredential(credential storage_vault.Credential) error {
+	if f := v.fault(OpRefresh, ""); f != nil && f.Err != nil {
+		return f.Err
+	}
+	return v.StorageVault.RefreshCredential(credential)
+}
+
+func (v *Vault) Type() storage_vault.Type {
+	t := v.StorageVault.Type()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.credentialType != "" {
+		t.CredentialType = v.credentialType
+	}
+	return t
+}
@@ -0,0 +1,82 @@
+package fault
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+func TestVault(t *testing.T) {
+	inner := memory.New("vault", "action")
+	require.NoError(t, inner.PutObject(context.Background(), "key", []byte("hello world")))
+
+	tests := []struct {
+		name    string
+		fault   Fault
+		calls   int
+		wantErr []string
+		wantLen []int
+	}{
+		{"no fault", Fault{Op: OpPut}, 2, []string{"", ""}, []int{11, 11}},
+		{"every call", Fault{Err: AccessDenied()}, 2, []string{"AccessDenied", "AccessDenied"}, nil},
+		{"nth call", Fault{Op: OpGet, Nth: 2, Times: 1, Err: ServiceUnavailable()}, 3, []string{"", "ServiceUnavailable", ""}, []int{11, 0, 11}},
+		{"other key", Fault{Key: "other", Err: NoSuchKey()}, 1, []string{""}, []int{11}},
+		{"truncate", Fault{Op: OpGet, Times: 1, Truncate: 5}, 2, []string{"", ""}, []int{6, 11}},
+		{"truncate all", Fault{Op: OpGet, Truncate: 20}, 1, []string{""}, []int{0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := New(inner).Inject(tt.fault)
+			for i := 0; i < tt.calls; i++ {
+				data, err := v.GetObject(context.Background(), "key")
+				if tt.wantErr[i] == "" {
+					require.NoError(t, err)
+				} else {
+					require.Error(t, err)
+					assert.Equal(t, tt.wantErr[i], err.(awserr.Error).Code())
+				}
+				if tt.wantLen != nil {
+					assert.Len(t, data, tt.wantLen[i])
+				}
+			}
+			assert.Equal(t, tt.calls, v.Calls(OpGet))
+		})
+	}
+}
+
+func TestVaultFirstFaultApplies(t *testing.T) {
+	v := New(memory.New("vault", "action")).
+		Inject(Fault{Op: OpPut, Times: 1, Err: ServiceUnavailable()}).
+		Inject(Fault{Op: OpPut, Times: 1, Err: AccessDenied()})
+
+	err := v.PutObject(context.Background(), "key", nil)
+	assert.Equal(t, "ServiceUnavailable", err.(awserr.Error).Code())
+	err = v.PutObject(context.Background(), "key", nil)
+	assert.Equal(t, "AccessDenied", err.(awserr.Error).Code())
+	assert.NoError(t, v.PutObject(context.Background(), "key", nil))
+	exists, _, err := v.HeadObject(context.Background(), "key")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func TestVaultLatency(t *testing.T) {
+	v := New(memory.New("vault", "action")).Inject(Fault{Op: OpHead, Latency: 20 * time.Millisecond})
+	start := time.Now()
+	_, _, _ = v.HeadObject(context.Background(), "key")
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(20*time.Millisecond))
+}
+
+func TestVaultCredentialType(t *testing.T) {
+	v := New(memory.New("vault", "action"))
+	assert.Equal(t, memory.StorageVaultType, v.Type().StorageVaultType)
+	assert.Equal(t, "", v.Type().CredentialType)
+	v.SetCredentialType("DEFAULT")
+	assert.Equal(t, "DEFAULT", v.Type().CredentialType)
+	assert.Equal(t, memory.StorageVaultType, v.Type().StorageVaultType)
+}
@@ -0,0 +1,296 @@
+// Package local provides a storage vault keeping objects as files in a local
+// directory, for air-gapped machines and tests without any cloud.
+package local
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+const (
+	StorageVaultType    = "LOCAL"
+	defaultStorageClass = "STANDARD"
+
+	// tempPrefix starts the names of the files being written, which are not
+	// objects yet.
+	tempPrefix = ".tmp-"
+	// shortShard is the shard of the keys shorter than two characters.
+	shortShard = "_"
+)
+
+// Local is a storage vault keeping each object in a file under a root
+// directory. Objects are sharded in subdirectories named by the first two
+// characters of their key, so the chunks, named by their hex MD5, spread over
+// 256 directories. Like S3, the ETag of an object is the quoted MD5 of its
+// content, missing objects are reported with NotFound on head and NoSuchKey on
+// get.
+type Local struct {
+	id       string
+	actionID string
+	root     string
+
+	mu         sync.Mutex
+	credential storage_vault.Credential
+}
+
+var _ storage_vault.StorageVault = (*Local)(nil)
+
+// New returns a storage vault storing its objects under root, which is
+// created when missing.
+func New(id string, actionID string, root string) (*Local, error) {
+	if root == "" {
+		return nil, errors.New("local storage vault needs a root directory")
+	}
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	return &Local{id: id, actionID: actionID, root: root}, nil
+}
+
+// Root returns the directory the objects are stored under.
+func (l *Local) Root() string {
+	return l.root
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return strconv.Quote(hex.EncodeToString(sum[:]))
+}
+
+func shard(key string) string {
+	if len(key) < 2 {
+		return shortShard
+	}
+	return key[:2]
+}
+
+// path returns the file of key, refusing the keys which would escape root.
+func (l *Local) path(key string) (string, error) {
+	if key == "" || path.IsAbs(key) || strings.Contains(key, "\\") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	for _, elem := range strings.Split(key, "/") {
+		if elem == "" || elem == "." || elem == ".." || strings.HasPrefix(elem, tempPrefix) {
+			return "", fmt.Errorf("invalid object key %q", key)
+		}
+	}
+	return filepath.Join(l.root, shard(key), filepath.FromSlash(key)), nil
+}
+
+func (l *Local) read(key string) ([]byte, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(name)
+}
+
+// HeadObject reports whether key exists, with the MD5 of its content as ETag.
+func (l *Local) HeadObject(ctx context.Context, key string) (bool, string, error) {
+	data, err := l.read(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, "", awserr.New("NotFound", "Not Found", nil)
+	}
+	if err != nil {
+		return false, "", err
+	}
+	return true, etag(data), nil
+}
+
+// VerifyObject reports whether key exists and whether its content hashes the
+// same as data.
+func (l *Local) VerifyObject(ctx context.Context, key string, data []byte) (bool, bool, string, error) {
+	stored, err := l.read(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, false, "", nil
+	}
+	if err != nil {
+		return false, false, "", err
+	}
+	tag := etag(stored)
+	return true, tag == etag(data), tag, nil
+}
+
+// PutObject writes data to a temporary file next to the object and renames
+// it in place, so a reader never sees a partial object.
+func (l *Local) PutObject(ctx context.Context, key string, data []byte) error {
+	name, err := l.path(key)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(name)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, tempPrefix+"*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return err
+	}
+	storage_vault.MarkSent(ctx)
+	return nil
+}
+
+func (l *Local) GetObject(ctx context.Context, key string) ([]byte, error) {
+	data, err := l.read(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, awserr.New("NoSuchKey", "The specified key does not exist.", nil)
+	}
+	return data, err
+}
+
+// GetObjectStream opens the file of key.
+func (l *Local) GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	name, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, awserr.New("NoSuchKey", "The specified key does not exist.", nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// CheckChunk reports whether key exists and holds data.
+func (l *Local) CheckChunk(ctx context.Context, key string, data []byte) (bool, bool, error) {
+	stored, err := l.read(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	return true, bytes.Equal(stored, data), nil
+}
+
+// InspectObject reads key back. As its ETag is computed from its content, the
+// integrity of an object is only known when its key is the MD5 it must have.
+func (l *Local) InspectObject(ctx context.Context, key string) (*storage_vault.ObjectInfo, error) {
+	info := &storage_vault.ObjectInfo{Key: key}
+	name, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return info, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := md5.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+
+	info.Exists = true
+	info.Size = fi.Size()
+	info.ETag = strconv.Quote(digest)
+	info.StorageClass = defaultStorageClass
+	info.LastModified = fi.ModTime()
+	info.Integrity = !isMD5(key) || key == digest
+	return info, nil
+}
+
+func isMD5(key string) bool {
+	if len(key) != 2*md5.Size {
+		return false
+	}
+	_, err := hex.DecodeString(key)
+	return err == nil
+}
+
+// RefreshCredential keeps credential, a local directory needs none.
+func (l *Local) RefreshCredential(credential storage_vault.Credential) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.credential = credential
+	return nil
+}
+
+func (l *Local) ID() (string, string) {
+	return l.id, l.actionID
+}
+
+func (l *Local) Type() storage_vault.Type {
+	return storage_vault.Type{StorageVaultType: StorageVaultType}
+}
+
+// ListObjects calls fn with the sorted keys starting with prefix.
+func (l *Local) ListObjects(ctx context.Context, prefix string, fn func(key string) error) error {
+	var keys []string
+	err := filepath.WalkDir(l.root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() || strings.HasPrefix(d.Name(), tempPrefix) {
+			return nil
+		}
+		rel, err := filepath.Rel(l.root, name)
+		if err != nil {
+			return err
+		}
+		parts := strings.SplitN(filepath.ToSlash(rel), "/", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		if key := parts[1]; shard(key) == parts[0] && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package local
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLocal(t *testing.T) {
+	root := t.TempDir()
+	l, err := New("vault", "action", filepath.Join(root, "vault"))
+	require.NoError(t, err)
+	key := "5eb63bbbe01eeed093cb22bb8f5acdc3"
+	data := []byte("hello world")
+
+	exists, _, err := l.HeadObject(context.Background(), key)
+	assert.False(t, exists)
+	assert.Equal(t, "NotFound", err.(awserr.Error).Code())
+	_, err = l.GetObject(context.Background(), key)
+	assert.Equal(t, "NoSuchKey", err.(awserr.Error).Code())
+	exists, integrity, _, err := l.VerifyObject(context.Background(), key, data)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.False(t, integrity)
+	info, err := l.InspectObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.False(t, info.Exists)
+
+	require.NoError(t, l.PutObject(context.Background(), key, data))
+	assert.FileExists(t, filepath.Join(l.Root(), "5e", key))
+	exists, etag, err := l.HeadObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, `"`+key+`"`, etag)
+
+	got, err := l.GetObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+	stream, err := l.GetObjectStream(context.Background(), key)
+	require.NoError(t, err)
+	got, err = io.ReadAll(stream)
+	require.NoError(t, err)
+	require.NoError(t, stream.Close())
+	assert.Equal(t, data, got)
+	_, err = l.GetObjectStream(context.Background(), "missing")
+	assert.Equal(t, "NoSuchKey", err.(awserr.Error).Code())
+
+	exists, integrity, _, _ = l.VerifyObject(context.Background(), key, data)
+	assert.True(t, exists)
+	assert.True(t, integrity)
+	_, integrity, _, _ = l.VerifyObject(context.Background(), key, []byte("other"))
+	assert.False(t, integrity)
+	exists, same, err := l.CheckChunk(context.Background(), key, data)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.True(t, same)
+
+	info, err = l.InspectObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.True(t, info.Exists)
+	assert.True(t, info.Integrity)
+	assert.Equal(t, int64(len(data)), info.Size)
+	assert.Equal(t, `"`+key+`"`, info.ETag)
+
+	require.NoError(t, os.WriteFile(filepath.Join(l.Root(), "5e", key), []byte("bit rot"), 0600))
+	info, err = l.InspectObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.False(t, info.Integrity)
+
+	id, actionID := l.ID()
+	assert.Equal(t, "vault", id)
+	assert.Equal(t, "action", actionID)
+	assert.Equal(t, StorageVaultType, l.Type().StorageVaultType)
+}
+
+func TestLocal_PutObjectReplaces(t *testing.T) {
+	l, err := New("vault", "action", t.TempDir())
+	require.NoError(t, err)
+
+	require.NoError(t, l.PutObject(context.Background(), "rp1/index.json", []byte("old")))
+	require.NoError(t, l.PutObject(context.Background(), "rp1/index.json", []byte("new")))
+	got, err := l.GetObject(context.Background(), "rp1/index.json")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("new"), got)
+
+	entries, err := os.ReadDir(filepath.Join(l.Root(), "rp", "rp1"))
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "no temporary file is left behind")
+	assert.Equal(t, "index.json", entries[0].Name())
+}
+
+func TestLocal_ListObjects(t *testing.T) {
+	l, err := New("vault", "action", t.TempDir())
+	require.NoError(t, err)
+	for _, key := range []string{"b", "ab12", "rp1/index.json", "rp2/index.json"} {
+		require.NoError(t, l.PutObject(context.Background(), key, []byte(key)))
+	}
+	require.NoError(t, os.WriteFile(filepath.Join(l.Root(), "ab", tempPrefix+"1"), nil, 0600))
+
+	var keys []string
+	require.NoError(t, l.ListObjects(context.Background(), "", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"ab12", "b", "rp1/index.json", "rp2/index.json"}, keys)
+
+	keys = nil
+	require.NoError(t, l.ListObjects(context.Background(), "rp1/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"rp1/index.json"}, keys)
+}
+
+func TestLocal_InvalidKey(t *testing.T) {
+	l, err := New("vault", "action", t.TempDir())
+	require.NoError(t, err)
+	for _, key := range []string{"", "/etc/passwd", "../escape", "a/../../b", "a//b", tempPrefix + "x"} {
+		assert.Error(t, l.PutObject(context.Background(), key, []byte("x")), key)
+		_, err := l.GetObject(context.Background(), key)
+		assert.Error(t, err, key)
+	}
+}
@@ -0,0 +1,214 @@
+// Package memory provides an in-memory storage vault for tests.
+package memory
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+const (
+	StorageVaultType    = "MEMORY"
+	defaultStorageClass = "STANDARD"
+)
+
+type object struct {
+	data         []byte
+	etag         string
+	class        string
+	lastModified time.Time
+}
+
+// Memory is a storage vault keeping objects in a map. Like S3, the ETag of an
+// object is the quoted MD5 of its content, missing objects are reported with
+// NotFound on head and NoSuchKey on get.
+type Memory struct {
+	id       string
+	actionID string
+
+	mu         sync.RWMutex
+	objects    map[string]*object
+	credential storage_vault.Credential
+}
+
+var _ storage_vault.StorageVault = (*Memory)(nil)
+
+// New returns an empty in-memory storage vault.
+func New(id string, actionID string) *Memory {
+	return &Memory{
+		id:       id,
+		actionID: actionID,
+		objects:  make(map[string]*object),
+	}
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return strconv.Quote(hex.EncodeToString(sum[:]))
+}
+
+func (m *Memory) get(key string) (*object, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	obj, ok := m.objects[key]
+	return obj, ok
+}
+
+func (m *Memory) HeadObject(ctx context.Context, key string) (bool, string, error) {
+	obj, ok := m.get(key)
+	if !ok {
+		return false, "", awserr.New("NotFound", "Not Found", nil)
+	}
+	return true, obj.etag, nil
+}
+
+// VerifyObject reports whether key exists and whether its ETag matches data.
+func (m *Memory) VerifyObject(ctx context.Context, key string, data []byte) (bool, bool, string, error) {
+	obj, ok := m.get(key)
+	if !ok {
+		return false, false, "", nil
+	}
+	return true, obj.etag == etag(data), obj.etag, nil
+}
+
+func (m *Memory) PutObject(ctx context.Context, key string, data []byte) error {
+	buf := make([]byte, len(data))
+	copy(buf, data)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	class := defaultStorageClass
+	if hint := storage_vault.ClassOf(ctx); hint != "" {
+		class = hint
+	}
+	m.objects[key] = &object{data: buf, etag: etag(buf), class: class, lastModified: time.Now()}
+	storage_vault.MarkSent(ctx)
+	return nil
+}
+
+// SetObjectClass moves the object stored under key to class.
+func (m *Memory) SetObjectClass(ctx context.Context, key, class string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return fmt.Errorf("set storage class of %s: no such key", key)
+	}
+	m.objects[key] = &object{data: obj.data, etag: obj.etag, class: class, lastModified: obj.lastModified}
+	return nil
+}
+
+func (m *Memory) GetObject(ctx context.Context, key string) ([]byte, error) {
+	obj, ok := m.get(key)
+	if !ok {
+		return nil, awserr.New("NoSuchKey", "The specified key does not exist.", nil)
+	}
+	buf := make([]byte, len(obj.data))
+	copy(buf, obj.data)
+	return buf, nil
+}
+
+// GetObjectStream returns a reader of a copy of key.
+func (m *Memory) GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	data, err := m.GetObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// CheckChunk reports whether key exists and holds data.
+func (m *Memory) CheckChunk(ctx context.Context, key string, data []byte) (bool, bool, error) {
+	obj, ok := m.get(key)
+	if !ok {
+		return false, false, nil
+	}
+	return true, bytes.Equal(obj.data, data), nil
+}
+
+func (m *Memory) InspectObject(ctx context.Context, key string) (*storage_vault.ObjectInfo, error) {
+	info := &storage_vault.ObjectInfo{Key: key}
+	obj, ok := m.get(key)
+	if !ok {
+		return info, nil
+	}
+	info.Exists = true
+	info.Size = int64(len(obj.data))
+	info.ETag = obj.etag
+	info.StorageClass = obj.class
+	info.LastModified = obj.lastModified
+	info.Integrity = obj.etag == etag(obj.data)
+	return info, nil
+}
+
+func (m *Memory) RefreshCredential(credential storage_vault.Credential) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.credential = credential
+	return nil
+}
+
+func (m *Memory) ID() (string, string) {
+	return m.id, m.actionID
+}
+
+func (m *Memory) Type() storage_vault.Type {
+	return storage_vault.Type{StorageVaultType: StorageVaultType}
+}
+
+// ListObjects calls fn with the sorted keys starting with prefix.
+func (m *Memory) ListObjects(ctx context.Context, prefix string, fn func(key string) error) error {
+	for _, key := range m.Keys() {
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+		if err := fn(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keys returns the sorted keys of all stored objects.
+func (m *Memory) Keys() []string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	keys := make([]string, 0, len(m.objects))
+	for key := range m.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Delete removes key, as a retention policy or a lost object would.
+func (m *Memory) Delete(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+}
+
+// Corrupt replaces the content of key while keeping its ETag, modelling bit
+// rot in the backend. It reports whether key existed.
+func (m *Memory) Corrupt(key string, data []byte) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	obj, ok := m.objects[key]
+	if !ok {
+		return false
+	}
+	obj.data = append([]byte(nil), data...)
+	return true
+}
@@ -0,0 +1,85 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemory(t *testing.T) {
+	m := New("vault", "action")
+	key := "5eb63bbbe01eeed093cb22bb8f5acdc3"
+	data := []byte("hello world")
+
+	exists, _, err := m.HeadObject(context.Background(), key)
+	assert.False(t, exists)
+	assert.Equal(t, "NotFound", err.(awserr.Error).Code())
+	_, err = m.GetObject(context.Background(), key)
+	assert.Equal(t, "NoSuchKey", err.(awserr.Error).Code())
+	exists, integrity, _, err := m.VerifyObject(context.Background(), key, data)
+	assert.NoError(t, err)
+	assert.False(t, exists)
+	assert.False(t, integrity)
+
+	require.NoError(t, m.PutObject(context.Background(), key, data))
+	exists, etag, err := m.HeadObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, `"`+key+`"`, etag)
+
+	got, err := m.GetObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.Equal(t, data, got)
+
+	exists, integrity, _, _ = m.VerifyObject(context.Background(), key, data)
+	assert.True(t, exists)
+	assert.True(t, integrity)
+	_, integrity, _, _ = m.VerifyObject(context.Background(), key, []byte("other"))
+	assert.False(t, integrity)
+
+	info, err := m.InspectObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.True(t, info.Exists)
+	assert.True(t, info.Integrity)
+	assert.Equal(t, int64(len(data)), info.Size)
+
+	assert.True(t, m.Corrupt(key, []byte("bit rot")))
+	info, err = m.InspectObject(context.Background(), key)
+	require.NoError(t, err)
+	assert.False(t, info.Integrity)
+
+	assert.Equal(t, []string{key}, m.Keys())
+	m.Delete(key)
+	assert.Empty(t, m.Keys())
+
+	id, actionID := m.ID()
+	assert.Equal(t, "vault", id)
+	assert.Equal(t, "action", actionID)
+}
+
+func TestMemoryListObjects(t *testing.T) {
+	m := New("vault", "")
+	for _, key := range []string{"b", "mc/rp/index.json", "a", "mc/rp/chunk.json"} {
+		require.NoError(t, m.PutObject(context.Background(), key, []byte(key)))
+	}
+	var keys []string
+	require.NoError(t, m.ListObjects(context.Background(), "", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"a", "b", "mc/rp/chunk.json", "mc/rp/index.json"}, keys)
+
+	keys = nil
+	require.NoError(t, m.ListObjects(context.Background(), "mc/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{"mc/rp/chunk.json", "mc/rp/index.json"}, keys)
+
+	stop := errors.New("stop")
+	assert.Equal(t, stop, m.ListObjects(context.Background(), "", func(key string) error { return stop }))
+}
@@ -0,0 +1,313 @@
+// Package naming provides a storage vault wrapper which hides from someone
+// with access to the bucket only what the agent stores in it.
+//
+// Chunks are stored under their content hash, so anyone able to list or head
+// the objects of a bucket can tell whether it holds a chunk of a known file.
+// With a per-repository secret, chunk keys are replaced by their HMAC-SHA256
+// under a key derived from the secret, which can not be computed from the
+// content alone. The metadata objects of recovery points, the index with the
+// paths of the backed up files and the chunk and file lists naming chunks by
+// content hash, can in addition be encrypted with AES-256-GCM under another
+// key derived from the secret. Storage vaults recording a digest of the chunks
+// in the object metadata, as S3 does under SSE-KMS or with chunk_sha256, key it
+// with a third key derived from the secret rather than record their sha256.
+//
+// Objects stored before the secret was set stay readable: a chunk missing
+// under its HMAC name is read under its plain one, and metadata objects which
+// do not start with the header of encrypted ones are returned as they are.
+package naming
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/spf13/viper"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+)
+
+const (
+	NamingPlain = "plain"
+	NamingHMAC  = "hmac"
+
+	nameKeyLabel   = "bizfly-backup object naming"
+	indexKeyLabel  = "bizfly-backup index encryption"
+	digestKeyLabel = "bizfly-backup chunk digest"
+)
+
+// header prefixes encrypted metadata objects, followed by the nonce.
+var header = []byte("BZBKENC1")
+
+var (
+	ErrorNoSecret      = errors.New("vault_object_secret is required")
+	ErrorInvalidNaming = errors.New("invalid vault_object_naming")
+	ErrorDecrypt       = errors.New("metadata object decryption failed")
+)
+
+// Vault maps chunk keys to their HMAC and encrypts metadata objects before
+// handing them to the wrapped vault.
+type Vault struct {
+	storage_vault.StorageVault
+
+	nameKey   []byte
+	digestKey []byte
+	aead      cipher.AEAD
+}
+
+// New wraps inner with keys derived from secret. Chunk keys are HMACed when
+// hmacNames is set, metadata objects encrypted when encryptIndex is set.
+func New(inner storage_vault.StorageVault, secret []byte, hmacNames bool, encryptIndex bool) (*Vault, error) {
+	if len(secret) == 0 {
+		return nil, ErrorNoSecret
+	}
+	v := &Vault{StorageVault: inner, digestKey: deriveKey(secret, digestKeyLabel)}
+	if hmacNames {
+		v.nameKey = deriveKey(secret, nameKeyLabel)
+	}
+	if encryptIndex {
+		block, err := aes.NewCipher(deriveKey(secret, indexKeyLabel))
+		if err != nil {
+			return nil, err
+		}
+		if v.aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
+}
+
+// FromConfig wraps inner as configured by vault_object_naming,
+// vault_encrypt_index and vault_object_secret, inner is returned as is when
+// both are off.
+func FromConfig(inner storage_vault.StorageVault) (storage_vault.StorageVault, error) {
+	hmacNames := false
+	switch naming := viper.GetString("vault_object_naming"); naming {
+	case "", NamingPlain:
+	case NamingHMAC:
+		hmacNames = true
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrorInvalidNaming, naming)
+	}
+	encryptIndex := viper.GetBool("vault_encrypt_index")
+	if !hmacNames && !encryptIndex {
+		return inner, nil
+	}
+	return New(inner, []byte(viper.GetString("vault_object_secret")), hmacNames, encryptIndex)
+}
+
+func deriveKey(secret []byte, label string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// isChunk reports whether key names a chunk, stored at the root of the
+// vault, rather than a metadata object of a recovery point.
+func isChunk(key string) bool {
+	return !strings.ContainsAny(key, `/\`)
+}
+
+// ObjectName returns the name key is stored under in the wrapped vault.
+func (v *Vault) ObjectName(key string) string {
+	if v.nameKey == nil || !isChunk(key) {
+		return key
+	}
+	mac := hmac.New(sha256.New, v.nameKey)
+	mac.Write([]byte(key))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// digests returns ctx with the key of the chunk digests recorded by the wrapped
+// vault.
+func (v *Vault) digests(ctx context.Context) context.Context {
+	return storage_vault.WithDigestKey(ctx, v.digestKey)
+}
+
+func (v *Vault) encrypts(key string) bool {
+	return v.aead != nil && !isChunk(key)
+}
+
+func (v *Vault) seal(key string, data []byte) ([]byte, error) {
+	nonce := make([]byte, v.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(header)+len(nonce)+len(data)+v.aead.Overhead())
+	out = append(append(out, header...), nonce...)
+	return v.aead.Seal(out, nonce, data, []byte(key)), nil
+}
+
+func (v *Vault) open(key string, data []byte) ([]byte, error) {
+	if !bytes.HasPrefix(data, header) {
+		return data, nil
+	}
+	data = data[len(header):]
+	if len(data) < v.aead.NonceSize() {
+		return nil, fmt.Errorf("%w: %s", ErrorDecrypt, key)
+	}
+	plaintext, err := v.aead.Open(nil, data[:v.aead.NonceSize()], data[v.aead.NonceSize():], []byte(key))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrorDecrypt, key)
+	}
+	return plaintext, nil
+}
+
+func (v *Vault) HeadObject(ctx context.Context, key string) (bool, string, error) {
+	name := v.ObjectName(key)
+	exists, etag, err := v.StorageVault.HeadObject(ctx, name)
+	if !exists && name != key && (err == nil || isNotFound(err)) {
+		return v.StorageVault.HeadObject(ctx, key)
+	}
+	return exists, etag, err
+}
+
+func (v *Vault) PutObject(ctx context.Context, key string, data []byte) error {
+	if v.encrypts(key) {
+		var err error
+		if data, err = v.seal(key, data); err != nil {
+			return err
+		}
+	}
+	return v.StorageVault.PutObject(v.digests(ctx), v.ObjectName(key), data)
+}
+
+func (v *Vault) GetObject(ctx context.Context, key string) ([]byte, error) {
+	name := v.ObjectName(key)
+	data, err := v.StorageVault.GetObject(ctx, name)
+	if err != nil && name != key && isNotFound(err) {
+		data, err = v.StorageVault.GetObject(ctx, key)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v.encrypts(key) {
+		return v.open(key, data)
+	}
+	return data, nil
+}
+
+// GetObjectStream forwards the stream of the wrapped vault under the name of
+// key. Encrypted objects are read whole to be decrypted.
+func (v *Vault) GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	streamer, ok := v.StorageVault.(storage_vault.ObjectStreamer)
+	if !ok {
+		return nil, storage_vault.ErrNotSupported
+	}
+	if v.encrypts(key) {
+		data, err := v.GetObject(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(data)), nil
+	}
+	name := v.ObjectName(key)
+	body, err := streamer.GetObjectStream(ctx, name)
+	if err != nil && name != key && isNotFound(err) {
+		body, err = streamer.GetObjectStream(ctx, key)
+	}
+	return body, err
+}
+
+func isNotFound(err error) bool {
+	var aerr awserr.Error
+	return errors.As(err, &aerr) && (aerr.Code() == "NoSuchKey" || aerr.Code() == "NotFound")
+}
+
+func (v *Vault) InspectObject(ctx context.Context, key string) (*storage_vault.ObjectInfo, error) {
+	info, err := v.StorageVault.InspectObject(v.digests(ctx), v.ObjectName(key))
+	if info != nil {
+		info.Key = key
+	}
+	return info, err
+}
+
+// CheckChunk forwards the chunk check of the wrapped vault under the name of
+// the chunk.
+func (v *Vault) CheckChunk(ctx context.Context, key string, data []byte) (bool, bool, error) {
+	checker, ok := v.StorageVault.(storage_vault.ChunkChecker)
+	if !ok {
+		return false, false, storage_vault.ErrNotSupported
+	}
+	return checker.CheckChunk(v.digests(ctx), v.ObjectName(key), data)
+}
+
+// VerifyObject forwards the object check of the wrapped vault under the name
+// of key. Encrypted objects are sealed under a random nonce, so they never
+// match data as stored: they are read back and compared once decrypted.
+func (v *Vault) VerifyObject(ctx context.Context, key string, data []byte) (bool, bool, string, error) {
+	verifier, ok := v.StorageVault.(storage_vault.ObjectVerifier)
+	if !ok {
+		return false, false, "", storage_vault.ErrNotSupported
+	}
+	if v.encrypts(key) {
+		stored, err := v.GetObject(ctx, key)
+		if isNotFound(err) {
+			return false, false, "", nil
+		}
+		if err != nil {
+			return false, false, "", err
+		}
+		return true, bytes.Equal(stored, data), "", nil
+	}
+	ctx = v.digests(ctx)
+	name := v.ObjectName(key)
+	exists, integrity, etag, err := verifier.VerifyObject(ctx, name, data)
+	if err == nil && !exists && name != key {
+		return verifier.VerifyObject(ctx, key, data)
+	}
+	return exists, integrity, etag, err
+}
+
+// ListObjects forwards the listing of the wrapped vault. Keys are listed as
+// stored: with hmac naming, chunks are listed under their HMAC, which can not
+// be mapped back to their keys.
+func (v *Vault) ListObjects(ctx context.Context, prefix string, fn func(key string) error) error {
+	lister, ok := v.StorageVault.(storage_vault.ObjectLister)
+	if !ok {
+		return storage_vault.ErrNotSupported
+	}
+	return lister.ListObjects(ctx, prefix, fn)
+}
+
+// ExistsCacheStats forwards the existence cache stats of the wrapped vault.
+func (v *Vault) ExistsCacheStats() (uint64, uint64) {
+	if reporter, ok := v.StorageVault.(storage_vault.ExistsCacheReporter); ok {
+		return reporter.ExistsCacheStats()
+	}
+	return 0, 0
+}
+
+// Requests forwards the request count of the wrapped vault.
+func (v *Vault) Requests() uint64 {
+	if counter, ok := v.StorageVault.(storage_vault.RequestCounter); ok {
+		return counter.Requests()
+	}
+	return 0
+}
+
+// Retries forwards the retry tracker of the wrapped vault.
+func (v *Vault) Retries() *storage_vault.RetryTracker {
+	return storage_vault.RetriesOf(v.StorageVault)
+}
+
+// SetObjectClass forwards the storage class change of key to the wrapped vault
+// under the name of the object.
+func (v *Vault) SetObjectClass(ctx context.Context, key, class string) error {
+	placer, ok := v.StorageVault.(storage_vault.ClassPlacer)
+	if !ok {
+		return storage_vault.ErrNotSupported
+	}
+	return placer.SetObjectClass(ctx, v.ObjectName(key), class)
+}
@@ -0,0 +1,175 @@
+package naming
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/budget"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/cooldown"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/memory"
+)
+
+const (
+	chunk = "5d41402abc4b2a76b9719d911017c592"
+	index = "machine/rp1/index.json"
+)
+
+var indexData = []byte(`{"items":{"/home/user/secret plan.txt":{}}}`)
+
+func TestVault(t *testing.T) {
+	inner := memory.New("vault", "action")
+	v, err := New(inner, []byte("secret"), true, true)
+	require.NoError(t, err)
+	require.NoError(t, v.PutObject(context.Background(), chunk, []byte("hello")))
+	require.NoError(t, v.PutObject(context.Background(), index, indexData))
+
+	// Neither the chunk key nor the paths of the index show in the vault.
+	keys := inner.Keys()
+	assert.NotContains(t, keys, chunk)
+	assert.Contains(t, keys, v.ObjectName(chunk))
+	assert.Contains(t, keys, index)
+	stored, err := inner.GetObject(context.Background(), index)
+	require.NoError(t, err)
+	assert.False(t, bytes.Contains(stored, []byte("secret plan")))
+
+	data, err := v.GetObject(context.Background(), chunk)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	data, err = v.GetObject(context.Background(), index)
+	require.NoError(t, err)
+	assert.Equal(t, indexData, data)
+	exists, _, err := v.HeadObject(context.Background(), chunk)
+	require.NoError(t, err)
+	assert.True(t, exists)
+	info, err := v.InspectObject(context.Background(), chunk)
+	require.NoError(t, err)
+	assert.True(t, info.Exists)
+	assert.Equal(t, chunk, info.Key)
+	exists, same, err := v.CheckChunk(context.Background(), chunk, []byte("hello"))
+	require.NoError(t, err)
+	assert.True(t, exists)
+	assert.True(t, same)
+
+	// Another secret names chunks differently and can not read the index.
+	other, err := New(inner, []byte("other"), true, true)
+	require.NoError(t, err)
+	assert.NotEqual(t, v.ObjectName(chunk), other.ObjectName(chunk))
+	_, err = other.GetObject(context.Background(), index)
+	assert.ErrorIs(t, err, ErrorDecrypt)
+
+	// An index moved to another key does not decrypt.
+	require.NoError(t, inner.PutObject(context.Background(), "machine/rp2/index.json", stored))
+	_, err = v.GetObject(context.Background(), "machine/rp2/index.json")
+	assert.ErrorIs(t, err, ErrorDecrypt)
+}
+
+func TestVaultPlainObjects(t *testing.T) {
+	// Objects stored before the secret was set are still read.
+	inner := memory.New("vault", "")
+	require.NoError(t, inner.PutObject(context.Background(), chunk, []byte("hello")))
+	require.NoError(t, inner.PutObject(context.Background(), index, indexData))
+	v, err := New(inner, []byte("secret"), true, true)
+	require.NoError(t, err)
+
+	data, err := v.GetObject(context.Background(), chunk)
+	require.NoError(t, err)
+	assert.Equal(t, []byte("hello"), data)
+	data, err = v.GetObject(context.Background(), index)
+	require.NoError(t, err)
+	assert.Equal(t, indexData, data)
+	exists, _, err := v.HeadObject(context.Background(), chunk)
+	require.NoError(t, err)
+	assert.True(t, exists)
+
+	exists, _, err = v.HeadObject(context.Background(), "0123456789abcdef0123456789abcdef")
+	assert.Error(t, err)
+	assert.False(t, exists)
+	_, err = v.GetObject(context.Background(), "0123456789abcdef0123456789abcdef")
+	assert.Error(t, err)
+}
+
+func TestFromConfig(t *testing.T) {
+	defer func() {
+		viper.Set("vault_object_naming", nil)
+		viper.Set("vault_encrypt_index", nil)
+		viper.Set("vault_object_secret", nil)
+	}()
+	inner := memory.New("vault", "")
+
+	v, err := FromConfig(inner)
+	require.NoError(t, err)
+	assert.Equal(t, inner, v)
+
+	viper.Set("vault_object_naming", NamingHMAC)
+	_, err = FromConfig(inner)
+	assert.ErrorIs(t, err, ErrorNoSecret)
+
+	viper.Set("vault_object_secret", "secret")
+	v, err = FromConfig(inner)
+	require.NoError(t, err)
+	require.NoError(t, v.PutObject(context.Background(), index, indexData))
+	stored, err := inner.GetObject(context.Background(), index)
+	require.NoError(t, err)
+	assert.Equal(t, indexData, stored)
+
+	viper.Set("vault_object_naming", NamingPlain)
+	viper.Set("vault_encrypt_index", true)
+	v, err = FromConfig(inner)
+	require.NoError(t, err)
+	assert.Equal(t, chunk, v.(*Vault).ObjectName(chunk))
+
+	viper.Set("vault_object_naming", "md5")
+	_, err = FromConfig(inner)
+	assert.ErrorIs(t, err, ErrorInvalidNaming)
+}
+
+func TestVaultVerifyObjectListObjects(t *testing.T) {
+	// The wrappers of a storage vault as built for a backup.
+	inner := memory.New("vault", "")
+	require.NoError(t, inner.PutObject(context.Background(), "plain", []byte("old")))
+	counted := budget.New(cooldown.New(inner, cooldown.NewGate(0.5, time.Second, zap.NewNop())), 0)
+	v, err := New(counted, []byte("secret"), true, true)
+	require.NoError(t, err)
+	require.NoError(t, v.PutObject(context.Background(), chunk, []byte("hello")))
+	require.NoError(t, v.PutObject(context.Background(), index, indexData))
+
+	verify := func(key string, data []byte) (bool, bool) {
+		exists, integrity, _, err := v.VerifyObject(context.Background(), key, data)
+		require.NoError(t, err)
+		return exists, integrity
+	}
+	exists, integrity := verify(chunk, []byte("hello"))
+	assert.True(t, exists)
+	assert.True(t, integrity)
+	_, integrity = verify(chunk, []byte("other"))
+	assert.False(t, integrity)
+	// A chunk stored before the secret was set is found under its plain name.
+	exists, integrity = verify("plain", []byte("old"))
+	assert.True(t, exists)
+	assert.True(t, integrity)
+	exists, _ = verify("missing", []byte("data"))
+	assert.False(t, exists)
+	// An encrypted index is compared once decrypted.
+	exists, integrity = verify(index, indexData)
+	assert.True(t, exists)
+	assert.True(t, integrity)
+	_, integrity = verify(index, []byte("{}"))
+	assert.False(t, integrity)
+	exists, _ = verify("machine/rp2/index.json", indexData)
+	assert.False(t, exists)
+
+	var keys []string
+	require.NoError(t, v.ListObjects(context.Background(), "machine/", func(key string) error {
+		keys = append(keys, key)
+		return nil
+	}))
+	assert.Equal(t, []string{index}, keys)
+	assert.NotZero(t, counted.Requests())
+}
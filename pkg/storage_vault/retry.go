@@ -0,0 +1,141 @@
+package storage_vault
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// RetryState is the requests to a storage vault failed and waiting to be
+// tried again.
+type RetryState struct {
+	// Retrying is the number of requests not given up on yet.
+	Retrying int
+	// NextDelay is the time left before the first of them is tried again.
+	NextDelay time.Duration
+}
+
+// RetryReporter is implemented by storage vaults which keep track of the
+// requests their callers retry.
+type RetryReporter interface {
+	Retries() *RetryTracker
+}
+
+// RetriesOf returns the retry tracker of storageVault, nil if it has none.
+func RetriesOf(storageVault StorageVault) *RetryTracker {
+	if reporter, ok := storageVault.(RetryReporter); ok {
+		return reporter.Retries()
+	}
+	return nil
+}
+
+// Sleep waits for d before a request is retried, and returns the error of ctx
+// as soon as it is done.
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+type retryHookKey struct{}
+
+// WithRetryHook returns a context derived from ctx whose requests report to
+// hook every failed attempt a storage vault retries itself, so that the errors
+// its retries hide are seen. The retry waits for hook, and is given up on with
+// the error hook returns. The hooks of ctx are kept and called first, so that
+// every wrapper of a vault sees the retries of the vaults it wraps.
+func WithRetryHook(ctx context.Context, hook func(ctx context.Context, err error) error) context.Context {
+	if outer, ok := ctx.Value(retryHookKey{}).(func(context.Context, error) error); ok {
+		inner := hook
+		hook = func(ctx context.Context, err error) error {
+			if err := outer(ctx, err); err != nil {
+				return err
+			}
+			return inner(ctx, err)
+		}
+	}
+	return context.WithValue(ctx, retryHookKey{}, hook)
+}
+
+// RetryAttempt reports the failed attempt err, about to be retried, to the
+// hook of ctx if any, and returns its error.
+func RetryAttempt(ctx context.Context, err error) error {
+	if hook, ok := ctx.Value(retryHookKey{}).(func(context.Context, error) error); ok {
+		return hook(ctx, err)
+	}
+	return nil
+}
+
+// Retry is a request retried by the caller of a storage vault.
+type Retry struct {
+	due time.Time
+}
+
+// RetryTracker records the requests being retried, from their first failure
+// until they succeed or are given up on. A nil RetryTracker records nothing.
+type RetryTracker struct {
+	now func() time.Time
+
+	mu      sync.Mutex
+	retries map[*Retry]struct{}
+}
+
+// NewRetryTracker returns an empty RetryTracker.
+func NewRetryTracker() *RetryTracker {
+	return &RetryTracker{now: time.Now, retries: make(map[*Retry]struct{})}
+}
+
+// Wait records that request r is tried again after delay, r being nil on its
+// first failure. It returns r to pass to the next calls for the request.
+func (t *RetryTracker) Wait(r *Retry, delay time.Duration) *Retry {
+	if t == nil {
+		return nil
+	}
+	if r == nil {
+		r = &Retry{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r.due = t.now().Add(delay)
+	t.retries[r] = struct{}{}
+	return r
+}
+
+// Done records the end of the retries of request r, which may be nil when it
+// never failed.
+func (t *RetryTracker) Done(r *Retry) {
+	if t == nil || r == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.retries, r)
+}
+
+// State returns the requests being retried.
+func (t *RetryTracker) State() RetryState {
+	if t == nil {
+		return RetryState{}
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state := RetryState{Retrying: len(t.retries)}
+	now := t.now()
+	first := true
+	for r := range t.retries {
+		delay := r.due.Sub(now)
+		if delay < 0 {
+			delay = 0
+		}
+		if first || delay < state.NextDelay {
+			state.NextDelay = delay
+			first = false
+		}
+	}
+	return state
+}
@@ -0,0 +1,51 @@
+package storage_vault
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryTracker(t *testing.T) {
+	now := time.Date(2022, 1, 2, 3, 4, 5, 0, time.UTC)
+	tracker := NewRetryTracker()
+	tracker.now = func() time.Time { return now }
+	assert.Equal(t, RetryState{}, tracker.State())
+
+	a := tracker.Wait(nil, 4*time.Second)
+	b := tracker.Wait(nil, time.Second)
+	assert.Equal(t, RetryState{Retrying: 2, NextDelay: time.Second}, tracker.State())
+
+	// A request failing again keeps counting once, with its new delay.
+	now = now.Add(2 * time.Second)
+	assert.Same(t, b, tracker.Wait(b, 3*time.Second))
+	assert.Equal(t, RetryState{Retrying: 2, NextDelay: 2 * time.Second}, tracker.State())
+
+	tracker.Done(a)
+	tracker.Done(nil)
+	assert.Equal(t, RetryState{Retrying: 1, NextDelay: 3 * time.Second}, tracker.State())
+	// A retry due already reports no delay.
+	now = now.Add(time.Minute)
+	assert.Equal(t, RetryState{Retrying: 1}, tracker.State())
+	tracker.Done(b)
+	assert.Equal(t, RetryState{}, tracker.State())
+
+	// A nil tracker records nothing.
+	var none *RetryTracker
+	assert.Nil(t, none.Wait(nil, time.Second))
+	none.Done(a)
+	assert.Equal(t, RetryState{}, none.State())
+	assert.Nil(t, RetriesOf(nil))
+}
+
+func TestSleep(t *testing.T) {
+	assert.NoError(t, Sleep(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	assert.ErrorIs(t, Sleep(ctx, time.Hour), context.Canceled)
+	assert.Less(t, time.Since(start), time.Second)
+}
@@ -0,0 +1,101 @@
+package s3
+
+import (
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const defaultExistsCacheSize = 100000
+
+// existsCache remembers chunk keys confirmed to exist with the right content
+// during a run, so that duplicated chunks do not cost a HEAD request each.
+// Once full, the oldest keys are evicted first.
+type existsCache struct {
+	mu     sync.Mutex
+	size   int
+	keys   map[string]struct{}
+	order  []string
+	hits   uint64
+	misses uint64
+}
+
+func newExistsCache(size int) *existsCache {
+	return &existsCache{size: size, keys: make(map[string]struct{})}
+}
+
+// existsCacheSize returns the configured exists_cache_size, 0 disables the cache.
+func existsCacheSize() int {
+	if !viper.IsSet("exists_cache_size") {
+		return defaultExistsCacheSize
+	}
+	return viper.GetInt("exists_cache_size")
+}
+
+func (c *existsCache) contains(key string) bool {
+	if c == nil || c.size <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; ok {
+		c.hits++
+		return true
+	}
+	c.misses++
+	return false
+}
+
+func (c *existsCache) add(key string) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; ok {
+		return
+	}
+	for len(c.order) >= c.size {
+		delete(c.keys, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.keys[key] = struct{}{}
+	c.order = append(c.order, key)
+}
+
+func (c *existsCache) remove(key string) {
+	if c == nil || c.size <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.keys[key]; !ok {
+		return
+	}
+	delete(c.keys, key)
+	for i, k := range c.order {
+		if k == key {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// record adds key when a check found it stored with the right content and
+// removes it otherwise, so that a missing or corrupted chunk is put again.
+func (c *existsCache) record(key string, ok bool) {
+	if ok {
+		c.add(key)
+	} else {
+		c.remove(key)
+	}
+}
+
+func (c *existsCache) stats() (hits, misses uint64) {
+	if c == nil {
+		return 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
@@ -0,0 +1,42 @@
+package s3
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_existsCache(t *testing.T) {
+	c := newExistsCache(2)
+	assert.False(t, c.contains("a"))
+
+	c.add("a")
+	c.add("b")
+	assert.True(t, c.contains("a"))
+	assert.True(t, c.contains("b"))
+
+	// Bounded: the oldest key is evicted.
+	c.add("c")
+	assert.False(t, c.contains("a"))
+	assert.True(t, c.contains("c"))
+
+	// A failed put invalidates the key.
+	c.remove("c")
+	assert.False(t, c.contains("c"))
+	c.add("d")
+	assert.True(t, c.contains("b"))
+
+	hits, misses := c.stats()
+	assert.Equal(t, uint64(4), hits)
+	assert.Equal(t, uint64(3), misses)
+}
+
+func Test_existsCacheDisabled(t *testing.T) {
+	viper.Set("exists_cache_size", 0)
+	defer viper.Set("exists_cache_size", nil)
+
+	c := newExistsCache(existsCacheSize())
+	c.add("a")
+	assert.False(t, c.contains("a"))
+}
@@ -2,9 +2,19 @@ package s3
 
 import (
 	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +27,8 @@ import (
 	storage "github.com/aws/aws-sdk-go/service/s3"
 	"github.com/cenkalti/backoff"
 	"github.com/spf13/viper"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/semaphore"
 
 	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 	"github.com/bizflycloud/bizfly-backup/pkg/limiter"
@@ -34,9 +46,18 @@ type S3 struct {
 	Location         string
 	Region           string
 	S3Session        *storage.S3
+	// StorageClass is the storage class of the chunks put, "" for
+	// storage_class_chunk.
+	StorageClass string
+	// SSE is the server-side encryption of the objects put, "" for the
+	// default of the bucket, and SSEKMSKeyID the KMS key of aws:kms.
+	SSE         string
+	SSEKMSKeyID string
 
 	logger       *zap.Logger
 	backupClient *backupapi.Client
+	exists       *existsCache
+	retries      *storage_vault.RetryTracker
 }
 
 func (s3 *S3) Type() storage_vault.Type {
@@ -52,10 +73,22 @@ func (s3 *S3) ID() (string, string) {
 }
 
 var _ storage_vault.StorageVault = (*S3)(nil)
+
+// Retries returns the requests to the vault being retried.
+func (s3 *S3) Retries() *storage_vault.RetryTracker {
+	return s3.retries
+}
+
+// ErrObjectArchived is storage_vault.ErrObjectArchived.
+var ErrObjectArchived = storage_vault.ErrObjectArchived
 var uploadKb, downloadKb int
 
 func NewS3Default(vault backupapi.StorageVault, actionID string, limitUpload, limitDownload int, backupClient *backupapi.Client) (*S3, error) {
 	uploadKb, downloadKb = limitUpload, limitDownload
+	sse, kmsKeyID, err := sseFromConfig()
+	if err != nil {
+		return nil, err
+	}
 
 	s3 := &S3{
 		Id:               vault.ID,
@@ -67,7 +100,12 @@ func NewS3Default(vault backupapi.StorageVault, actionID string, limitUpload, li
 		StorageVaultType: vault.StorageVaultType,
 		Location:         vault.Credential.AwsLocation,
 		Region:           vault.Credential.Region,
+		StorageClass:     vault.Credential.StorageClass,
 		backupClient:     backupClient,
+		exists:           newExistsCache(existsCacheSize()),
+		retries:          storage_vault.NewRetryTracker(),
+		SSE:              sse,
+		SSEKMSKeyID:      kmsKeyID,
 	}
 
 	if s3.logger == nil {
@@ -79,7 +117,7 @@ func NewS3Default(vault backupapi.StorageVault, actionID string, limitUpload, li
 	}
 
 	cred := credentials.NewStaticCredentials(vault.Credential.AwsAccessKeyId, vault.Credential.AwsSecretAccessKey, vault.Credential.Token)
-	_, err := cred.Get()
+	_, err = cred.Get()
 	if err != nil {
 		s3.logger.Error("Bad credentials", zap.Error(err))
 	}
@@ -116,6 +154,23 @@ func NewS3Default(vault backupapi.StorageVault, actionID string, limitUpload, li
 
 }
 
+// sseFromConfig returns the server-side encryption of vault_sse and the KMS
+// key of vault_sse_kms_key_id, which only applies to aws:kms.
+func sseFromConfig() (string, string, error) {
+	sse := viper.GetString("vault_sse")
+	kmsKeyID := viper.GetString("vault_sse_kms_key_id")
+	switch sse {
+	case "", storage.ServerSideEncryptionAes256:
+		if kmsKeyID != "" {
+			return "", "", fmt.Errorf("%w: vault_sse_kms_key_id needs vault_sse %s", backupapi.ErrorInvalidConfig, storage.ServerSideEncryptionAwsKms)
+		}
+	case storage.ServerSideEncryptionAwsKms:
+	default:
+		return "", "", fmt.Errorf("%w: vault_sse %q", backupapi.ErrorInvalidConfig, sse)
+	}
+	return sse, kmsKeyID, nil
+}
+
 type HTTPClient struct{}
 
 var (
@@ -124,22 +179,54 @@ var (
 
 const (
 	maxRetry = 3 * time.Minute
+
+	defaultStallTimeout = time.Minute
+
+	defaultMultipartThresholdMB = 8
+	// multipartPartSize is the size of the parts of a multipart upload but
+	// the last one, the minimum allowed by S3.
+	multipartPartSize     = 5 << 20
+	multipartConcurrency  = 4
+	multipartPartAttempts = 3
 )
 
-func (s3 *S3) VerifyObject(key string) (bool, bool, string, error) {
+// multipartThreshold returns the size in bytes from which objects are
+// uploaded in parts, from vault_multipart_threshold_mb. 0 disables multipart
+// uploads.
+func multipartThreshold() int {
+	if !viper.IsSet("vault_multipart_threshold_mb") {
+		return defaultMultipartThresholdMB << 20
+	}
+	return viper.GetInt("vault_multipart_threshold_mb") << 20
+}
+
+// stallTimeout returns the configured vault_stall_timeout, 0 disables the
+// stall detection.
+func stallTimeout() time.Duration {
+	if !viper.IsSet("vault_stall_timeout") {
+		return defaultStallTimeout
+	}
+	return viper.GetDuration("vault_stall_timeout")
+}
+
+// VerifyObject reports whether key exists in the vault and whether the stored
+// object matches data.
+func (s3 *S3) VerifyObject(ctx context.Context, key string, data []byte) (bool, bool, string, error) {
 	var isExist bool
 	var integrity bool
 	var etag string
+	var head *storage.HeadObjectOutput
 	var err error
 	bo := backoff.NewExponentialBackOff()
 	bo.MaxInterval = maxRetry
 	bo.MaxElapsedTime = maxRetry
 
 	for {
-		isExist, etag, err = s3.HeadObject(key)
+		isExist, head, err = s3.headObject(ctx, key)
 		if err == nil {
 			if isExist {
-				integrity = strings.Contains(etag, key)
+				etag = aws.StringValue(head.ETag)
+				integrity = checkIntegrity(ctx, key, data, head)
 			}
 			break
 		}
@@ -173,25 +260,59 @@ func (s3 *S3) VerifyObject(key string) (bool, bool, string, error) {
 			break
 		}
 		s3.logger.Sugar().Info("VerifyObject. Retry in ", d)
+		if ctx.Err() != nil {
+			return false, false, "", ctx.Err()
+		}
+		if err := storage_vault.RetryAttempt(ctx, err); err != nil {
+			return false, false, "", err
+		}
+	}
+	if err == nil && !isMetadataKey(key) {
+		s3.exists.record(key, isExist && integrity)
 	}
 	return isExist, integrity, etag, err
 }
 
-func (s3 *S3) PutObject(key string, data []byte) error {
+// ListObjects calls fn with the keys of the bucket starting with prefix, page
+// by page as they are listed.
+func (s3 *S3) ListObjects(ctx context.Context, prefix string, fn func(key string) error) error {
+	var fnErr error
+	err := s3.S3Session.ListObjectsV2PagesWithContext(ctx, &storage.ListObjectsV2Input{
+		Bucket: aws.String(s3.StorageBucket),
+		Prefix: aws.String(prefix),
+	}, func(page *storage.ListObjectsV2Output, last bool) bool {
+		for _, obj := range page.Contents {
+			if fnErr = fn(aws.StringValue(obj.Key)); fnErr != nil {
+				return false
+			}
+		}
+		return true
+	})
+	if fnErr != nil {
+		return fnErr
+	}
+	return err
+}
+
+func (s3 *S3) PutObject(ctx context.Context, key string, data []byte) error {
+	// Chunks are content addressed, one confirmed to exist never needs another HEAD.
+	cacheable := !isMetadataKey(key)
+	if cacheable && s3.exists.contains(key) {
+		return nil
+	}
+
 	var err error
 	var once bool
+	var retry *storage_vault.Retry
+	defer func() { s3.retries.Done(retry) }()
 	bo := backoff.NewExponentialBackOff()
 	bo.MaxInterval = maxRetry
 	bo.MaxElapsedTime = maxRetry
 	for {
-		isExist, integrity, _, _ := s3.VerifyObject(key)
+		isExist, integrity, _, _ := s3.VerifyObject(ctx, key, data)
 		if isExist {
 			if !integrity {
-				_, err = s3.S3Session.PutObject(&storage.PutObjectInput{
-					Bucket: aws.String(s3.StorageBucket),
-					Key:    aws.String(key),
-					Body:   bytes.NewReader(data),
-				})
+				err = s3.putObject(ctx, key, data)
 				if err == nil {
 					break
 				}
@@ -199,20 +320,12 @@ func (s3 *S3) PutObject(key string, data []byte) error {
 				break
 			}
 		} else {
-			_, err = s3.S3Session.PutObject(&storage.PutObjectInput{
-				Bucket: aws.String(s3.StorageBucket),
-				Key:    aws.String(key),
-				Body:   bytes.NewReader(data),
-			})
-			if !strings.Contains(key, "chunk.json") && !strings.Contains(key, "index.json") && !strings.Contains(key, "file.csv") {
-				isExist, integrity, _, _ = s3.VerifyObject(key)
+			err = s3.putObject(ctx, key, data)
+			if !isMetadataKey(key) {
+				isExist, integrity, _, _ = s3.VerifyObject(ctx, key, data)
 				if isExist {
 					if !integrity {
-						_, err = s3.S3Session.PutObject(&storage.PutObjectInput{
-							Bucket: aws.String(s3.StorageBucket),
-							Key:    aws.String(key),
-							Body:   bytes.NewReader(data),
-						})
+						err = s3.putObject(ctx, key, data)
 						if err == nil {
 							break
 						}
@@ -230,13 +343,16 @@ func (s3 *S3) PutObject(key string, data []byte) error {
 			if aerr.Code() == "AccessDenied" || aerr.Code() == "Forbidden" {
 				if once {
 					s3.logger.Error("Return false cause in put object: ", zap.Error(err), zap.String("code", aerr.Code()), zap.String("key", key))
+					s3.exists.remove(key)
 					return err
 				}
 				s3.logger.Info("Put object one more time")
 				once = true
 				rand.Seed(time.Now().UnixNano())
 				n := rand.Intn(3) // n will be between 0 and 10
-				time.Sleep(time.Duration(n) * time.Second)
+				if err = storage_vault.Sleep(ctx, time.Duration(n)*time.Second); err != nil {
+					break
+				}
 			}
 		}
 		s3.logger.Debug("PutObject error. Retrying")
@@ -246,95 +362,582 @@ func (s3 *S3) PutObject(key string, data []byte) error {
 			break
 		}
 		s3.logger.Sugar().Info("PutObject error. Retry in ", d)
-		time.Sleep(d)
+		if err = storage_vault.RetryAttempt(ctx, err); err != nil {
+			break
+		}
+		retry = s3.retries.Wait(retry, d)
+		if err = storage_vault.Sleep(ctx, d); err != nil {
+			break
+		}
 	}
 
+	if cacheable {
+		if err == nil {
+			s3.exists.add(key)
+		} else {
+			s3.exists.remove(key)
+		}
+	}
 	return err
 }
 
-func (s3 *S3) GetObject(key string) ([]byte, error) {
+// SetObjectClass moves the object stored under key to class, copying it onto
+// itself. An archived object must be restored first.
+func (s3 *S3) SetObjectClass(ctx context.Context, key, class string) error {
+	_, err := s3.S3Session.CopyObjectWithContext(ctx, &storage.CopyObjectInput{
+		Bucket:            aws.String(s3.StorageBucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(s3.StorageBucket + "/" + url.PathEscape(key)),
+		StorageClass:      aws.String(class),
+		MetadataDirective: aws.String(storage.MetadataDirectiveCopy),
+		// A copy is encrypted as the bucket default unless told otherwise.
+		ServerSideEncryption: s3.sse(),
+		SSEKMSKeyId:          s3.kmsKeyID(),
+	})
+	return err
+}
+
+// ExistsCacheStats returns the hits and misses of the chunk existence cache.
+func (s3 *S3) ExistsCacheStats() (uint64, uint64) {
+	return s3.exists.stats()
+}
+
+// isMetadataKey reports whether key holds recovery point metadata rather than
+// chunk data.
+func isMetadataKey(key string) bool {
+	return strings.Contains(key, "chunk.json") || strings.Contains(key, "index.json") || strings.Contains(key, "index_shard_") || strings.Contains(key, "file.csv") || strings.Contains(key, "keys.json")
+}
+
+// storageClass returns the configured S3 storage class for key. Chunks use
+// storage_class_chunk while metadata uses storage_class_metadata, so that
+// rarely read chunk data can live in a cheaper tier.
+func storageClass(key string) string {
+	if isMetadataKey(key) {
+		return viper.GetString("storage_class_metadata")
+	}
+	return viper.GetString("storage_class_chunk")
+}
+
+// contentType returns the MIME type stored with key, so that metadata objects
+// can be read directly in storage consoles.
+func contentType(key string) string {
+	switch {
+	case strings.HasSuffix(key, ".json"):
+		return "application/json"
+	case strings.HasSuffix(key, ".csv"):
+		return "text/csv"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+func (s3 *S3) putObjectInput(ctx context.Context, key string, data []byte) *storage.PutObjectInput {
+	input := &storage.PutObjectInput{
+		Bucket:      aws.String(s3.StorageBucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(data),
+		ContentType: aws.String(contentType(key)),
+	}
+	class := storageClass(key)
+	if s3.StorageClass != "" && !isMetadataKey(key) {
+		class = s3.StorageClass
+	}
+	if hint := storage_vault.ClassOf(ctx); hint != "" {
+		class = hint
+	}
+	if class != "" {
+		input.StorageClass = aws.String(class)
+	}
+	input.ServerSideEncryption = s3.sse()
+	input.SSEKMSKeyId = s3.kmsKeyID()
+	// The ETag of an object encrypted with a KMS key is not its MD5, so its
+	// digest is recorded for checkIntegrity.
+	kms := s3.SSE == storage.ServerSideEncryptionAwsKms
+	switch {
+	case isChunkKey(key) && (kms || viper.GetBool("chunk_sha256")):
+		name, digest := chunkDigest(ctx, data)
+		input.Metadata = map[string]*string{name: aws.String(digest)}
+	case !isChunkKey(key) && kms:
+		input.Metadata = map[string]*string{chunkSha256Meta: aws.String(sha256Hex(data))}
+	}
+	return input
+}
+
+// isChunkKey reports whether key names a chunk, stored at the root of the
+// vault under its content hash or the HMAC of vault_object_naming, rather than
+// a metadata object of a recovery point.
+func isChunkKey(key string) bool {
+	return !isMetadataKey(key) && !strings.ContainsAny(key, `/\`)
+}
+
+func (s3 *S3) sse() *string {
+	if s3.SSE == "" {
+		return nil
+	}
+	return aws.String(s3.SSE)
+}
+
+func (s3 *S3) kmsKeyID() *string {
+	if s3.SSE != storage.ServerSideEncryptionAwsKms || s3.SSEKMSKeyID == "" {
+		return nil
+	}
+	return aws.String(s3.SSEKMSKeyID)
+}
+
+// chunkSha256Meta is the object metadata holding the sha256 hash of a chunk,
+// recorded when chunk_sha256 is set or the chunk is encrypted with a KMS key,
+// and of the other objects encrypted with a KMS key. chunkHmacMeta holds
+// instead the HMAC-SHA256 of a chunk under the digest key of the put, see
+// storage_vault.WithDigestKey.
+const (
+	chunkSha256Meta = "Sha256"
+	chunkHmacMeta   = "Hmac-Sha256"
+)
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacHex(key, data []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// chunkDigest returns the object metadata recording the digest of the chunk
+// data, keyed under the digest key of ctx when set, and the digest.
+func chunkDigest(ctx context.Context, data []byte) (string, string) {
+	if key := storage_vault.DigestKeyOf(ctx); key != nil {
+		return chunkHmacMeta, hmacHex(key, data)
+	}
+	return chunkSha256Meta, sha256Hex(data)
+}
+
+// storedMeta returns the object metadata name of head, in any case.
+func storedMeta(head *storage.HeadObjectOutput, name string) string {
+	for stored, value := range head.Metadata {
+		if strings.EqualFold(stored, name) {
+			return aws.StringValue(value)
+		}
+	}
+	return ""
+}
+
+// storedSha256 returns the sha256 hash recorded with the object of head.
+func storedSha256(head *storage.HeadObjectOutput) string {
+	return storedMeta(head, chunkSha256Meta)
+}
+
+// matchDigest compares data with the digest recorded with the object of head:
+// its HMAC under the digest key of ctx, or its sha256. ok is false when
+// neither is recorded, or the HMAC is without the digest key.
+func matchDigest(ctx context.Context, head *storage.HeadObjectOutput, data []byte) (match bool, ok bool) {
+	if stored := storedMeta(head, chunkHmacMeta); stored != "" {
+		if key := storage_vault.DigestKeyOf(ctx); key != nil {
+			return stored == hmacHex(key, data), true
+		}
+	}
+	if stored := storedSha256(head); stored != "" {
+		return stored == sha256Hex(data), true
+	}
+	return false, false
+}
+
+// CheckChunk reports whether key exists and holds data, by the digest
+// recorded with the object. An object stored without one is downloaded and
+// compared, then given its digest by recordChunkDigest so that it is only read
+// once.
+func (s3 *S3) CheckChunk(ctx context.Context, key string, data []byte) (bool, bool, error) {
+	exists, head, err := s3.headObject(ctx, key)
+	if !exists {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			s3.exists.remove(key)
+			return false, false, nil
+		}
+		return false, false, err
+	}
+	if integrity, ok := matchDigest(ctx, head, data); ok {
+		s3.exists.record(key, integrity)
+		return true, integrity, nil
+	}
+
+	stored, err := s3.GetObject(ctx, key)
+	if err != nil {
+		return true, false, err
+	}
+	if !bytes.Equal(stored, data) {
+		s3.exists.remove(key)
+		return true, false, nil
+	}
+	if err := s3.recordChunkDigest(ctx, key, head, data); err != nil {
+		s3.logger.Warn("Failed to record chunk hash", zap.Error(err), zap.String("key", key))
+	}
+	return true, true, nil
+}
+
+// recordChunkDigest adds the digest of data to the metadata of the chunk
+// stored under key, copying the object onto itself within the bucket rather
+// than uploading it again. Its other metadata, content type and storage class
+// are kept.
+func (s3 *S3) recordChunkDigest(ctx context.Context, key string, head *storage.HeadObjectOutput, data []byte) error {
+	metadata := make(map[string]*string, len(head.Metadata)+1)
+	for name, value := range head.Metadata {
+		metadata[name] = value
+	}
+	name, digest := chunkDigest(ctx, data)
+	metadata[name] = aws.String(digest)
+	input := &storage.CopyObjectInput{
+		Bucket:            aws.String(s3.StorageBucket),
+		Key:               aws.String(key),
+		CopySource:        aws.String(s3.StorageBucket + "/" + url.PathEscape(key)),
+		ContentType:       head.ContentType,
+		Metadata:          metadata,
+		MetadataDirective: aws.String(storage.MetadataDirectiveReplace),
+		// A copy is encrypted as the bucket default unless told otherwise.
+		ServerSideEncryption: s3.sse(),
+		SSEKMSKeyId:          s3.kmsKeyID(),
+	}
+	// A copy is stored in the standard class unless told otherwise.
+	if class := aws.StringValue(head.StorageClass); class != "" {
+		input.StorageClass = aws.String(class)
+	}
+	_, err := s3.S3Session.CopyObjectWithContext(ctx, input)
+	return err
+}
+
+func (s3 *S3) GetObject(ctx context.Context, key string) ([]byte, error) {
+	var body []byte
+	err := s3.retryGet(ctx, key, func() (err error) {
+		body, err = s3.getObject(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// GetObjectStream opens key for reading as it is downloaded, retried like
+// GetObject until the object is open. The stream is canceled when it stalls.
+func (s3 *S3) GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := s3.retryGet(ctx, key, func() (err error) {
+		body, err = s3.getObjectStream(ctx, key)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// retryGet calls get until it succeeds or ctx is done, retrying the errors of
+// reading key which may pass.
+func (s3 *S3) retryGet(ctx context.Context, key string, get func() error) error {
 	var err error
 	var once bool
+	var retry *storage_vault.Retry
+	defer func() { s3.retries.Done(retry) }()
 	bo := backoff.NewExponentialBackOff()
 	bo.MaxInterval = maxRetry
 	bo.MaxElapsedTime = maxRetry
-	var obj *storage.GetObjectOutput
 	for {
-		obj, err = s3.S3Session.GetObject(&storage.GetObjectInput{
-			Bucket: aws.String(s3.StorageBucket),
-			Key:    aws.String(key),
-		})
-		if err == nil {
-			break
+		if err = get(); err == nil {
+			return nil
 		}
 
-		if aerr, ok := err.(awserr.Error); ok {
+		if errors.Is(err, storage_vault.ErrStalled) {
+			s3.logger.Warn("GetObject stalled", zap.Error(err), zap.String("key", key))
+		} else if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == "NoSuchKey" {
-				return nil, err
+				return err
+			}
+			if aerr.Code() == "InvalidObjectState" {
+				s3.logger.Error("Object is archived and must be restored before reading", zap.String("key", key))
+				return fmt.Errorf("%w: %s", ErrObjectArchived, key)
 			}
 
 			s3.logger.Sugar().Errorf("GetObject error: %s %s", aerr.Code(), aerr.Message())
 			if aerr.Code() == "AccessDenied" || aerr.Code() == "Forbidden" {
 				if once {
 					s3.logger.Error("Return false cause in get object: ", zap.Error(err), zap.String("code", aerr.Code()), zap.String("key", key))
-					return nil, err
+					return err
 				}
 				s3.logger.Sugar().Info("Get object one more time ", key)
 				once = true
 				rand.Seed(time.Now().UnixNano())
 				n := rand.Intn(3) // n will be between 0 and 10
-				time.Sleep(time.Duration(n) * time.Second)
+				if err := storage_vault.Sleep(ctx, time.Duration(n)*time.Second); err != nil {
+					return err
+				}
 			} else {
-				return nil, err
+				return err
 			}
 		}
 		s3.logger.Debug("GetObject error. Retrying")
 		d := bo.NextBackOff()
 		if d == backoff.Stop {
 			s3.logger.Debug("GetObject error. Retry time out")
-			break
+			return err
 		}
 		s3.logger.Sugar().Info("GetObject error. Retry in ", d)
-		time.Sleep(d)
+		if err := storage_vault.RetryAttempt(ctx, err); err != nil {
+			return err
+		}
+		retry = s3.retries.Wait(retry, d)
+		if err := storage_vault.Sleep(ctx, d); err != nil {
+			return err
+		}
+	}
+}
+
+// putObject uploads data to key, canceling the request when it stalls or ctx
+// is done. The upload is marked sent in ctx once stored.
+func (s3 *S3) putObject(ctx context.Context, key string, data []byte) error {
+	var err error
+	if threshold := multipartThreshold(); threshold > 0 && len(data) >= threshold {
+		err = s3.putMultipart(ctx, key, data)
+	} else {
+		err = s3.putSingle(ctx, key, data)
+	}
+	if err == nil {
+		storage_vault.MarkSent(ctx)
+	}
+	return err
+}
+
+// putSingle uploads data to key in one request.
+func (s3 *S3) putSingle(ctx context.Context, key string, data []byte) error {
+	ctx, watch := storage_vault.WatchStall(ctx, stallTimeout())
+	defer watch.Stop()
+	input := s3.putObjectInput(ctx, key, data)
+	input.Body = watch.ReadSeeker(input.Body)
+	_, err := s3.S3Session.PutObjectWithContext(ctx, input)
+	if err = watch.Err(err); errors.Is(err, storage_vault.ErrStalled) {
+		s3.logger.Warn("PutObject stalled", zap.Error(err), zap.String("key", key))
+	}
+	return err
+}
+
+// putMultipart uploads data in parts of multipartPartSize, multipartConcurrency
+// at a time. A failed part is retried alone, the upload is aborted when one
+// keeps failing.
+func (s3 *S3) putMultipart(ctx context.Context, key string, data []byte) error {
+	input := s3.putObjectInput(ctx, key, data)
+	upload, err := s3.S3Session.CreateMultipartUploadWithContext(ctx, &storage.CreateMultipartUploadInput{
+		Bucket:       input.Bucket,
+		Key:          input.Key,
+		ContentType:  input.ContentType,
+		StorageClass: input.StorageClass,
+		Metadata:     input.Metadata,
+		// Parts are encrypted as the upload.
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+	})
+	if err != nil {
+		return err
+	}
+
+	parts := make([]*storage.CompletedPart, (len(data)+multipartPartSize-1)/multipartPartSize)
+	sem := semaphore.NewWeighted(multipartConcurrency)
+	group, gctx := errgroup.WithContext(ctx)
+	for i := range parts {
+		if err := sem.Acquire(gctx, 1); err != nil {
+			break
+		}
+		i := i
+		end := (i + 1) * multipartPartSize
+		if end > len(data) {
+			end = len(data)
+		}
+		part := data[i*multipartPartSize : end]
+		group.Go(func() error {
+			defer sem.Release(1)
+			etag, err := s3.uploadPart(gctx, key, upload.UploadId, int64(i+1), part)
+			if err != nil {
+				return err
+			}
+			parts[i] = &storage.CompletedPart{ETag: etag, PartNumber: aws.Int64(int64(i + 1))}
+			return nil
+		})
+	}
+	if err = group.Wait(); err == nil {
+		_, err = s3.S3Session.CompleteMultipartUploadWithContext(ctx, &storage.CompleteMultipartUploadInput{
+			Bucket:          input.Bucket,
+			Key:             input.Key,
+			UploadId:        upload.UploadId,
+			MultipartUpload: &storage.CompletedMultipartUpload{Parts: parts},
+		})
+	}
+	if err != nil {
+		if _, abortErr := s3.S3Session.AbortMultipartUpload(&storage.AbortMultipartUploadInput{
+			Bucket:   input.Bucket,
+			Key:      input.Key,
+			UploadId: upload.UploadId,
+		}); abortErr != nil {
+			s3.logger.Warn("AbortMultipartUpload error", zap.Error(abortErr), zap.String("key", key))
+		}
+		return err
 	}
+	return nil
+}
 
-	body, err := ioutil.ReadAll(obj.Body)
+// uploadPart uploads part number of a multipart upload, retrying it up to
+// multipartPartAttempts times, and returns its ETag.
+func (s3 *S3) uploadPart(ctx context.Context, key string, uploadID *string, number int64, part []byte) (*string, error) {
+	bo := backoff.WithContext(backoff.WithMaxRetries(backoff.NewExponentialBackOff(), multipartPartAttempts-1), ctx)
+	var etag *string
+	err := backoff.Retry(func() error {
+		pctx, watch := storage_vault.WatchStall(ctx, stallTimeout())
+		defer watch.Stop()
+		out, err := s3.S3Session.UploadPartWithContext(pctx, &storage.UploadPartInput{
+			Bucket:     aws.String(s3.StorageBucket),
+			Key:        aws.String(key),
+			UploadId:   uploadID,
+			PartNumber: aws.Int64(number),
+			Body:       watch.ReadSeeker(bytes.NewReader(part)),
+		})
+		if err = watch.Err(err); err != nil {
+			s3.logger.Debug("UploadPart error", zap.Error(err), zap.String("key", key), zap.Int64("part", number))
+			if herr := storage_vault.RetryAttempt(ctx, err); herr != nil {
+				return backoff.Permanent(herr)
+			}
+			return err
+		}
+		etag = out.ETag
+		return nil
+	}, bo)
+	return etag, err
+}
 
-	return body, err
+// getObject reads key, canceling the request when it stalls or ctx is done.
+func (s3 *S3) getObject(ctx context.Context, key string) ([]byte, error) {
+	ctx, watch := storage_vault.WatchStall(ctx, stallTimeout())
+	defer watch.Stop()
+	obj, err := s3.S3Session.GetObjectWithContext(ctx, &storage.GetObjectInput{
+		Bucket: aws.String(s3.StorageBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, watch.Err(err)
+	}
+	defer obj.Body.Close()
+	body, err := ioutil.ReadAll(watch.Reader(obj.Body))
+	if err != nil {
+		return nil, watch.Err(err)
+	}
+	return body, nil
 }
 
-func (s3 *S3) HeadObject(key string) (bool, string, error) {
+// getObjectStream opens key, watching the body for stalls until it is closed.
+func (s3 *S3) getObjectStream(ctx context.Context, key string) (io.ReadCloser, error) {
+	ctx, watch := storage_vault.WatchStall(ctx, stallTimeout())
+	obj, err := s3.S3Session.GetObjectWithContext(ctx, &storage.GetObjectInput{
+		Bucket: aws.String(s3.StorageBucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		watch.Stop()
+		return nil, watch.Err(err)
+	}
+	return &objectStream{r: watch.Reader(obj.Body), body: obj.Body, watch: watch}, nil
+}
+
+// objectStream is the body of an object being read, reporting a stall as
+// ErrStalled.
+type objectStream struct {
+	r     io.Reader
+	body  io.Closer
+	watch *storage_vault.StallWatch
+}
+
+func (s *objectStream) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = s.watch.Err(err)
+	}
+	return n, err
+}
+
+func (s *objectStream) Close() error {
+	s.watch.Stop()
+	return s.body.Close()
+}
+
+func (s3 *S3) HeadObject(ctx context.Context, key string) (bool, string, error) {
+	isExist, headObject, err := s3.headObject(ctx, key)
+	if !isExist {
+		return false, "", err
+	}
+	return true, aws.StringValue(headObject.ETag), nil
+}
+
+// InspectObject returns the metadata of key and whether its content passes the
+// integrity check used on upload.
+func (s3 *S3) InspectObject(ctx context.Context, key string) (*storage_vault.ObjectInfo, error) {
+	info := &storage_vault.ObjectInfo{Key: key}
+	isExist, head, err := s3.headObject(ctx, key)
+	if !isExist {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == "NotFound" {
+			return info, nil
+		}
+		return nil, err
+	}
+
+	info.Exists = true
+	info.Size = aws.Int64Value(head.ContentLength)
+	info.ETag = aws.StringValue(head.ETag)
+	info.StorageClass = aws.StringValue(head.StorageClass)
+	if info.StorageClass == "" {
+		info.StorageClass = storage.StorageClassStandard
+	}
+	info.LastModified = aws.TimeValue(head.LastModified)
+
+	data, err := s3.GetObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	info.Integrity = checkIntegrity(ctx, key, data, head)
+	return info, nil
+}
+
+func (s3 *S3) headObject(ctx context.Context, key string) (bool, *storage.HeadObjectOutput, error) {
 	var err error
 	var headObject *storage.HeadObjectOutput
 	var once bool
+	var retry *storage_vault.Retry
+	defer func() { s3.retries.Done(retry) }()
 	bo := backoff.NewExponentialBackOff()
 	bo.MaxInterval = maxRetry
 	bo.MaxElapsedTime = maxRetry
 	for {
-		headObject, err = s3.S3Session.HeadObject(&storage.HeadObjectInput{
+		headObject, err = s3.S3Session.HeadObjectWithContext(ctx, &storage.HeadObjectInput{
 			Bucket: aws.String(s3.StorageBucket),
 			Key:    aws.String(key),
 		})
 		if err == nil {
-			return true, *headObject.ETag, nil
+			return true, headObject, nil
 		}
 
 		if aerr, ok := err.(awserr.Error); ok {
 			if aerr.Code() == "NotFound" {
-				return false, "", err
+				return false, nil, err
 			}
 
 			s3.logger.Sugar().Errorf("HeadObject error: %s %s", aerr.Code(), aerr.Message())
 			if aerr.Code() == "AccessDenied" || aerr.Code() == "Forbidden" {
 				if once {
 					s3.logger.Error("Return false cause in head object: ", zap.Error(err), zap.String("code", aerr.Code()), zap.String("key", key))
-					return false, "", err
+					return false, nil, err
 				}
 				s3.logger.Sugar().Info("Head object one more time ", key)
 				once = true
 				rand.Seed(time.Now().UnixNano())
 				n := rand.Intn(3) // n will be between 0 and 10
-				time.Sleep(time.Duration(n) * time.Second)
+				if err := storage_vault.Sleep(ctx, time.Duration(n)*time.Second); err != nil {
+					return false, nil, err
+				}
 			}
 		}
 		s3.logger.Debug("Head object error. Retrying")
@@ -344,10 +947,76 @@ func (s3 *S3) HeadObject(key string) (bool, string, error) {
 			break
 		}
 		s3.logger.Sugar().Info("Head object error. Retry in ", d)
-		time.Sleep(d)
+		if err := storage_vault.RetryAttempt(ctx, err); err != nil {
+			return false, nil, err
+		}
+		retry = s3.retries.Wait(retry, d)
+		if err := storage_vault.Sleep(ctx, d); err != nil {
+			return false, nil, err
+		}
+	}
+	return false, nil, err
+}
+
+// plainETag returns the MD5 digest carried by etag. It reports false when the
+// ETag is not a plain MD5 of the content, e.g. the "<hash>-<parts>" form
+// returned for multipart uploads.
+func plainETag(etag string) (string, bool) {
+	etag = strings.ToLower(strings.Trim(etag, `"`))
+	if len(etag) != md5.Size*2 {
+		return "", false
+	}
+	if _, err := hex.DecodeString(etag); err != nil {
+		return "", false
+	}
+	return etag, true
+}
+
+// multipartETag returns the ETag S3 gives data uploaded by putMultipart: the
+// MD5 of the MD5 digests of its parts, followed by the number of parts.
+func multipartETag(data []byte) string {
+	all := md5.New()
+	n := 0
+	for start := 0; start < len(data) || n == 0; start += multipartPartSize {
+		end := start + multipartPartSize
+		if end > len(data) {
+			end = len(data)
+		}
+		sum := md5.Sum(data[start:end])
+		all.Write(sum[:])
+		n++
+	}
+	return hex.EncodeToString(all.Sum(nil)) + "-" + strconv.Itoa(n)
+}
+
+// checkIntegrity reports whether the object described by head holds data.
+// A multipart ETag is compared with the one of the parts putMultipart would
+// upload. Objects encrypted with SSE-KMS or SSE-C never carry the content MD5
+// as ETag, they are compared by the digest recorded with them, if any, see
+// matchDigest. Otherwise, like other multipart ETags, they fall back to a size
+// comparison, only trusted for content-addressed keys, where the key is the
+// data digest.
+func checkIntegrity(ctx context.Context, key string, data []byte, head *storage.HeadObjectOutput) bool {
+	sum := md5.Sum(data)
+	digest := hex.EncodeToString(sum[:])
+
+	etag, ok := plainETag(aws.StringValue(head.ETag))
+	encrypted := aws.StringValue(head.ServerSideEncryption) == storage.ServerSideEncryptionAwsKms ||
+		aws.StringValue(head.SSECustomerAlgorithm) != ""
+	if ok && !encrypted {
+		return etag == digest
+	}
+	if match, ok := matchDigest(ctx, head, data); encrypted && ok {
+		return match
+	}
+	if !encrypted && strings.EqualFold(strings.Trim(aws.StringValue(head.ETag), `"`), multipartETag(data)) {
+		return true
+	}
 
+	if key != digest {
+		return false
 	}
-	return false, "", err
+	return aws.Int64Value(head.ContentLength) == int64(len(data))
 }
 
 func (s3 *S3) RefreshCredential(credential storage_vault.Credential) error {
@@ -1,12 +1,29 @@
 package s3
 
 import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
 	storage "github.com/aws/aws-sdk-go/service/s3"
+	"github.com/spf13/viper"
 
+	"github.com/bizflycloud/bizfly-backup/pkg/backupapi"
 	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault"
+	"github.com/bizflycloud/bizfly-backup/pkg/storage_vault/naming"
 
 	"go.uber.org/zap"
 )
@@ -112,3 +129,753 @@ func TestS3_ID(t *testing.T) {
 		})
 	}
 }
+
+func Test_plainETag(t *testing.T) {
+	tests := []struct {
+		name   string
+		etag   string
+		want   string
+		wantOk bool
+	}{
+		{
+			name:   "quoted md5",
+			etag:   `"9E107D9D372BB6826BD81D3542A419D6"`,
+			want:   "9e107d9d372bb6826bd81d3542a419d6",
+			wantOk: true,
+		},
+		{
+			name:   "multipart etag",
+			etag:   `"9e107d9d372bb6826bd81d3542a419d6-3"`,
+			wantOk: false,
+		},
+		{
+			name:   "not hex",
+			etag:   "zz107d9d372bb6826bd81d3542a419d6",
+			wantOk: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := plainETag(tt.etag)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("plainETag() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func Test_checkIntegrity(t *testing.T) {
+	data := []byte("bizfly-backup")
+	sum := md5.Sum(data)
+	digest := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name string
+		key  string
+		head *storage.HeadObjectOutput
+		want bool
+	}{
+		{
+			name: "plain md5 etag",
+			key:  digest,
+			head: &storage.HeadObjectOutput{ETag: aws.String(`"` + digest + `"`), ContentLength: aws.Int64(int64(len(data)))},
+			want: true,
+		},
+		{
+			name: "plain md5 etag mismatch",
+			key:  digest,
+			head: &storage.HeadObjectOutput{ETag: aws.String(`"00000000000000000000000000000000"`), ContentLength: aws.Int64(int64(len(data)))},
+			want: false,
+		},
+		{
+			name: "multipart etag with same size",
+			key:  digest,
+			head: &storage.HeadObjectOutput{ETag: aws.String(`"0123456789abcdef0123456789abcdef-2"`), ContentLength: aws.Int64(int64(len(data)))},
+			want: true,
+		},
+		{
+			name: "multipart etag with other size",
+			key:  digest,
+			head: &storage.HeadObjectOutput{ETag: aws.String(`"0123456789abcdef0123456789abcdef-2"`), ContentLength: aws.Int64(1)},
+			want: false,
+		},
+		{
+			name: "multipart etag for metadata key",
+			key:  "machine/rp/index.json",
+			head: &storage.HeadObjectOutput{ETag: aws.String(`"0123456789abcdef0123456789abcdef-2"`), ContentLength: aws.Int64(int64(len(data)))},
+			want: false,
+		},
+		{
+			name: "sse-kms etag",
+			key:  digest,
+			head: &storage.HeadObjectOutput{
+				ETag:                 aws.String(`"0123456789abcdef0123456789abcdef"`),
+				ContentLength:        aws.Int64(int64(len(data))),
+				ServerSideEncryption: aws.String(storage.ServerSideEncryptionAwsKms),
+			},
+			want: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := checkIntegrity(context.Background(), tt.key, data, tt.head); got != tt.want {
+				t.Errorf("checkIntegrity() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_storageClass(t *testing.T) {
+	viper.Set("storage_class_chunk", storage.StorageClassStandardIa)
+	viper.Set("storage_class_metadata", "")
+	defer viper.Set("storage_class_chunk", "")
+
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"chunk", "9e107d9d372bb6826bd81d3542a419d6", storage.StorageClassStandardIa},
+		{"index", "machine/rp/index.json", ""},
+		{"chunk list", "machine/rp/chunk.json", ""},
+		{"file list", "machine/rp/file.csv", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := storageClass(tt.key); got != tt.want {
+				t.Errorf("storageClass() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestS3_putObjectInput(t *testing.T) {
+	s3 := &S3{StorageBucket: "bucket"}
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"chunk", "9e107d9d372bb6826bd81d3542a419d6", "application/octet-stream"},
+		{"index", "machine/rp/index.json", "application/json"},
+		{"chunk list", "machine/rp/chunk.json", "application/json"},
+		{"file list", "machine/rp/file.csv", "text/csv"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := s3.putObjectInput(context.Background(), tt.key, []byte("data"))
+			if got := aws.StringValue(input.ContentType); got != tt.want {
+				t.Errorf("putObjectInput().ContentType = %v, want %v", got, tt.want)
+			}
+			if got := aws.StringValue(input.Key); got != tt.key {
+				t.Errorf("putObjectInput().Key = %v, want %v", got, tt.key)
+			}
+		})
+	}
+}
+
+func TestS3_putObjectInputClass(t *testing.T) {
+	viper.Set("storage_class_chunk", storage.StorageClassStandardIa)
+	defer viper.Set("storage_class_chunk", "")
+	s3 := &S3{StorageBucket: "bucket"}
+	chunk := "9e107d9d372bb6826bd81d3542a419d6"
+
+	ctx := storage_vault.WithClass(context.Background(), storage.StorageClassGlacier)
+	if got := aws.StringValue(s3.putObjectInput(ctx, chunk, []byte("data")).StorageClass); got != storage.StorageClassGlacier {
+		t.Errorf("putObjectInput().StorageClass = %v, want the class of the put", got)
+	}
+	if got := aws.StringValue(s3.putObjectInput(context.Background(), chunk, []byte("data")).StorageClass); got != storage.StorageClassStandardIa {
+		t.Errorf("putObjectInput().StorageClass = %v, want storage_class_chunk for another put", got)
+	}
+}
+
+func TestS3_putObjectInputVaultClass(t *testing.T) {
+	viper.Set("storage_class_chunk", storage.StorageClassStandardIa)
+	defer viper.Set("storage_class_chunk", "")
+	viper.Set("storage_class_metadata", storage.StorageClassStandard)
+	defer viper.Set("storage_class_metadata", "")
+	s3 := &S3{StorageBucket: "bucket", StorageClass: storage.StorageClassGlacierIr}
+	chunk := "9e107d9d372bb6826bd81d3542a419d6"
+
+	if got := aws.StringValue(s3.putObjectInput(context.Background(), chunk, []byte("data")).StorageClass); got != storage.StorageClassGlacierIr {
+		t.Errorf("putObjectInput().StorageClass = %v, want the class of the vault", got)
+	}
+	if got := aws.StringValue(s3.putObjectInput(context.Background(), "machine/rp/index.json", []byte("data")).StorageClass); got != storage.StorageClassStandard {
+		t.Errorf("putObjectInput().StorageClass = %v, want storage_class_metadata for metadata", got)
+	}
+	ctx := storage_vault.WithClass(context.Background(), storage.StorageClassStandard)
+	if got := aws.StringValue(s3.putObjectInput(ctx, chunk, []byte("data")).StorageClass); got != storage.StorageClassStandard {
+		t.Errorf("putObjectInput().StorageClass = %v, want the class of the put", got)
+	}
+}
+
+func TestS3_putObjectInputSha256(t *testing.T) {
+	defer viper.Set("chunk_sha256", nil)
+	s3 := &S3{StorageBucket: "bucket"}
+	sum := "3a6eb0790f39ac87c94f3856b2dd2c5d110e6811602261a9a923d3bb23adc8b7"
+	chunk := "8d777f385d3dfec8815d20f7496026dc"
+
+	if got := s3.putObjectInput(context.Background(), chunk, []byte("data")).Metadata; got != nil {
+		t.Errorf("putObjectInput().Metadata = %v, want none by default", got)
+	}
+	viper.Set("chunk_sha256", true)
+	if got := aws.StringValue(s3.putObjectInput(context.Background(), chunk, []byte("data")).Metadata[chunkSha256Meta]); got != sum {
+		t.Errorf("putObjectInput().Metadata[%s] = %v, want %v", chunkSha256Meta, got, sum)
+	}
+	if got := s3.putObjectInput(context.Background(), "machine/rp/index.json", []byte("data")).Metadata; got != nil {
+		t.Errorf("putObjectInput().Metadata = %v, want none for metadata objects", got)
+	}
+
+	// Metadata names come back from S3 in any case.
+	head := &storage.HeadObjectOutput{Metadata: map[string]*string{"sha256": aws.String(sum)}}
+	if got := storedSha256(head); got != sum {
+		t.Errorf("storedSha256() = %v, want %v", got, sum)
+	}
+	if got := storedSha256(&storage.HeadObjectOutput{}); got != "" {
+		t.Errorf("storedSha256() = %v, want none", got)
+	}
+}
+
+func TestS3_getObjectStall(t *testing.T) {
+	viper.Set("vault_stall_timeout", 100*time.Millisecond)
+	defer viper.Set("vault_stall_timeout", nil)
+
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "10")
+		_, _ = w.Write([]byte("da"))
+		if strings.HasSuffix(r.URL.Path, "/stuck") {
+			// A half-open connection: the rest never comes.
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+			case <-release:
+			}
+			return
+		}
+		_, _ = w.Write([]byte("ta-chunk"))
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	s3 := &S3{
+		StorageBucket: "bucket",
+		logger:        zap.NewNop(),
+		S3Session: storage.New(session.Must(session.NewSession(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+			Endpoint:         aws.String(srv.URL),
+			Region:           aws.String("hn"),
+			S3ForcePathStyle: aws.Bool(true),
+			MaxRetries:       aws.Int(0),
+		}))),
+	}
+
+	body, err := s3.getObject(context.Background(), "ok")
+	if err != nil || string(body) != "data-chunk" {
+		t.Fatalf("getObject() = %q, %v", body, err)
+	}
+
+	start := time.Now()
+	_, err = s3.getObject(context.Background(), "stuck")
+	if !errors.Is(err, storage_vault.ErrStalled) {
+		t.Fatalf("getObject() error = %v, want ErrStalled", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("getObject() took %s to give up", d)
+	}
+
+	stream, err := s3.getObjectStream(context.Background(), "ok")
+	if err != nil {
+		t.Fatalf("getObjectStream() error = %v", err)
+	}
+	body, err = io.ReadAll(stream)
+	stream.Close()
+	if err != nil || string(body) != "data-chunk" {
+		t.Fatalf("getObjectStream() read %q, %v", body, err)
+	}
+
+	stream, err = s3.getObjectStream(context.Background(), "stuck")
+	if err != nil {
+		t.Fatalf("getObjectStream() error = %v", err)
+	}
+	defer stream.Close()
+	if _, err = io.ReadAll(stream); !errors.Is(err, storage_vault.ErrStalled) {
+		t.Fatalf("getObjectStream() read error = %v, want ErrStalled", err)
+	}
+}
+
+func TestS3_retryCanceled(t *testing.T) {
+	// Every request is throttled, as by an overloaded endpoint.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	s3 := &S3{
+		StorageBucket: "bucket",
+		logger:        zap.NewNop(),
+		S3Session: storage.New(session.Must(session.NewSession(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+			Endpoint:         aws.String(srv.URL),
+			Region:           aws.String("hn"),
+			S3ForcePathStyle: aws.Bool(true),
+			MaxRetries:       aws.Int(0),
+		}))),
+	}
+
+	for name, call := range map[string]func(ctx context.Context) error{
+		"HeadObject": func(ctx context.Context) error {
+			_, _, err := s3.HeadObject(ctx, "chunk")
+			return err
+		},
+		"PutObject": func(ctx context.Context) error {
+			return s3.PutObject(ctx, "chunk", []byte("data"))
+		},
+	} {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		start := time.Now()
+		err := call(ctx)
+		cancel()
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("%s() error = %v, want context.DeadlineExceeded", name, err)
+		}
+		if d := time.Since(start); d > 5*time.Second {
+			t.Errorf("%s() took %s to give up once canceled", name, d)
+		}
+	}
+}
+
+// multipartServer serves the multipart upload API of one bucket, failing the
+// parts numbered in fail.
+type multipartServer struct {
+	mu       sync.Mutex
+	fail     map[string]bool
+	parts    map[string][]byte
+	puts     int
+	complete []byte
+	aborted  bool
+}
+
+func (m *multipartServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	q := r.URL.Query()
+	switch {
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		_, _ = w.Write([]byte(`<InitiateMultipartUploadResult><UploadId>upload</UploadId></InitiateMultipartUploadResult>`))
+	case r.Method == http.MethodPut && q.Has("partNumber"):
+		number := q.Get("partNumber")
+		if m.fail[number] {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		sum := md5.Sum(body)
+		m.parts[number] = body
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		m.complete, _ = io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(`<CompleteMultipartUploadResult><ETag>"etag-2"</ETag></CompleteMultipartUploadResult>`))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		m.aborted = true
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		m.puts++
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func TestS3_putObjectMultipart(t *testing.T) {
+	viper.Set("vault_multipart_threshold_mb", 1)
+	defer viper.Set("vault_multipart_threshold_mb", nil)
+
+	srv := &multipartServer{fail: map[string]bool{}, parts: map[string][]byte{}}
+	ts := httptest.NewServer(srv)
+	defer ts.Close()
+	s3 := &S3{
+		StorageBucket: "bucket",
+		logger:        zap.NewNop(),
+		S3Session: storage.New(session.Must(session.NewSession(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+			Endpoint:         aws.String(ts.URL),
+			Region:           aws.String("hn"),
+			S3ForcePathStyle: aws.Bool(true),
+			MaxRetries:       aws.Int(0),
+		}))),
+	}
+
+	small := []byte("small")
+	if err := s3.putObject(context.Background(), "small", small); err != nil {
+		t.Fatalf("putObject() error = %v", err)
+	}
+	if srv.puts != 1 || len(srv.parts) != 0 {
+		t.Errorf("small object: %d puts, %d parts, want a single put", srv.puts, len(srv.parts))
+	}
+
+	data := make([]byte, multipartPartSize+1<<20)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	if err := s3.putObject(context.Background(), "large", data); err != nil {
+		t.Fatalf("putObject() error = %v", err)
+	}
+	if len(srv.parts) != 2 {
+		t.Fatalf("uploaded %d parts, want 2", len(srv.parts))
+	}
+	if got := append(append([]byte(nil), srv.parts["1"]...), srv.parts["2"]...); !reflect.DeepEqual(got, data) {
+		t.Errorf("parts do not add up to the object")
+	}
+	if !strings.Contains(string(srv.complete), "<PartNumber>2</PartNumber>") {
+		t.Errorf("complete request %s misses part 2", srv.complete)
+	}
+	if srv.aborted {
+		t.Errorf("successful upload was aborted")
+	}
+
+	srv.fail["2"] = true
+	if err := s3.putObject(context.Background(), "large", data); err == nil {
+		t.Fatalf("putObject() with a failing part succeeded")
+	}
+	if !srv.aborted {
+		t.Errorf("failed upload was not aborted")
+	}
+}
+
+func Test_multipartETag(t *testing.T) {
+	data := make([]byte, multipartPartSize+10)
+	first := md5.Sum(data[:multipartPartSize])
+	second := md5.Sum(data[multipartPartSize:])
+	all := md5.Sum(append(first[:], second[:]...))
+	want := hex.EncodeToString(all[:]) + "-2"
+	if got := multipartETag(data); got != want {
+		t.Errorf("multipartETag() = %s, want %s", got, want)
+	}
+
+	head := &storage.HeadObjectOutput{ETag: aws.String(`"` + want + `"`), ContentLength: aws.Int64(int64(len(data)))}
+	if !checkIntegrity(context.Background(), "machine/rp/index.json", data, head) {
+		t.Errorf("checkIntegrity() = false for the multipart ETag of the data")
+	}
+	data[0] = 1
+	if checkIntegrity(context.Background(), "machine/rp/index.json", data, head) {
+		t.Errorf("checkIntegrity() = true for changed data")
+	}
+}
+
+func Test_sseFromConfig(t *testing.T) {
+	defer viper.Set("vault_sse", nil)
+	defer viper.Set("vault_sse_kms_key_id", nil)
+	tests := []struct {
+		sse, kmsKeyID string
+		wantErr       bool
+	}{
+		{"", "", false},
+		{"AES256", "", false},
+		{"aws:kms", "", false},
+		{"aws:kms", "key", false},
+		{"AES256", "key", true},
+		{"", "key", true},
+		{"rot13", "", true},
+	}
+	for _, tt := range tests {
+		viper.Set("vault_sse", tt.sse)
+		viper.Set("vault_sse_kms_key_id", tt.kmsKeyID)
+		sse, kmsKeyID, err := sseFromConfig()
+		if (err != nil) != tt.wantErr {
+			t.Errorf("sseFromConfig(%q, %q) error = %v, wantErr %v", tt.sse, tt.kmsKeyID, err, tt.wantErr)
+			continue
+		}
+		if err != nil && !errors.Is(err, backupapi.ErrorInvalidConfig) {
+			t.Errorf("sseFromConfig(%q, %q) error = %v, want ErrorInvalidConfig", tt.sse, tt.kmsKeyID, err)
+		}
+		if err == nil && (sse != tt.sse || kmsKeyID != tt.kmsKeyID) {
+			t.Errorf("sseFromConfig() = %q, %q", sse, kmsKeyID)
+		}
+	}
+}
+
+func TestS3_putObjectInputSSE(t *testing.T) {
+	data := []byte("data")
+	input := (&S3{StorageBucket: "bucket"}).putObjectInput(context.Background(), "machine/rp/index.json", data)
+	if input.ServerSideEncryption != nil || input.SSEKMSKeyId != nil || input.Metadata != nil {
+		t.Errorf("putObjectInput() without SSE = %v", input)
+	}
+
+	input = (&S3{StorageBucket: "bucket", SSE: "AES256"}).putObjectInput(context.Background(), "machine/rp/index.json", data)
+	if aws.StringValue(input.ServerSideEncryption) != "AES256" || input.SSEKMSKeyId != nil || input.Metadata != nil {
+		t.Errorf("putObjectInput() with SSE-S3 = %v", input)
+	}
+
+	input = (&S3{StorageBucket: "bucket", SSE: "aws:kms", SSEKMSKeyID: "key"}).putObjectInput(context.Background(), "machine/rp/index.json", data)
+	if aws.StringValue(input.ServerSideEncryption) != "aws:kms" || aws.StringValue(input.SSEKMSKeyId) != "key" {
+		t.Errorf("putObjectInput() with SSE-KMS = %v", input)
+	}
+	if got := aws.StringValue(input.Metadata[chunkSha256Meta]); got != sha256Hex(data) {
+		t.Errorf("putObjectInput() with SSE-KMS records sha256 %q, want %q", got, sha256Hex(data))
+	}
+
+	// A chunk, whatever its name, records its sha256, or its HMAC under the
+	// digest key of the put instead.
+	for _, chunk := range []string{"8d777f385d3dfec8815d20f7496026dc", "not-the-md5-of-the-data"} {
+		input = (&S3{StorageBucket: "bucket", SSE: "aws:kms"}).putObjectInput(context.Background(), chunk, data)
+		if got := aws.StringValue(input.Metadata[chunkSha256Meta]); got != sha256Hex(data) {
+			t.Errorf("putObjectInput() of chunk %s with SSE-KMS records sha256 %q, want %q", chunk, got, sha256Hex(data))
+		}
+		ctx := storage_vault.WithDigestKey(context.Background(), []byte("key"))
+		input = (&S3{StorageBucket: "bucket", SSE: "aws:kms"}).putObjectInput(ctx, chunk, data)
+		if len(input.Metadata) != 1 || aws.StringValue(input.Metadata[chunkHmacMeta]) != hmacHex([]byte("key"), data) {
+			t.Errorf("putObjectInput() of chunk %s with a digest key records %v, want its HMAC only", chunk, input.Metadata)
+		}
+	}
+}
+
+func Test_checkIntegritySSEKMS(t *testing.T) {
+	data := []byte("bizfly-backup")
+	head := &storage.HeadObjectOutput{
+		ETag:                 aws.String(`"0123456789abcdef0123456789abcdef"`),
+		ContentLength:        aws.Int64(int64(len(data))),
+		ServerSideEncryption: aws.String(storage.ServerSideEncryptionAwsKms),
+		Metadata:             map[string]*string{"Sha256": aws.String(sha256Hex(data))},
+	}
+	if !checkIntegrity(context.Background(), "machine/rp/index.json", data, head) {
+		t.Errorf("checkIntegrity() = false with the recorded sha256 of the data")
+	}
+	if checkIntegrity(context.Background(), "machine/rp/index.json", []byte("bizfly-backuq"), head) {
+		t.Errorf("checkIntegrity() = true for changed data of the same size")
+	}
+
+	// A chunk stored without its sha256 is checked by size.
+	head.Metadata = nil
+	sum := md5.Sum(data)
+	chunk := hex.EncodeToString(sum[:])
+	if !checkIntegrity(context.Background(), chunk, data, head) {
+		t.Errorf("checkIntegrity() = false for a chunk of the same size")
+	}
+	if checkIntegrity(context.Background(), "machine/rp/index.json", data, head) {
+		t.Errorf("checkIntegrity() = true for metadata without its sha256")
+	}
+
+	// A chunk named by its HMAC is compared by the HMAC recorded with it.
+	ctx := storage_vault.WithDigestKey(context.Background(), []byte("key"))
+	head.Metadata = map[string]*string{"Hmac-Sha256": aws.String(hmacHex([]byte("key"), data))}
+	if !checkIntegrity(ctx, "hmac-name", data, head) {
+		t.Errorf("checkIntegrity() = false with the recorded HMAC of the data")
+	}
+	if checkIntegrity(ctx, "hmac-name", []byte("bizfly-backuq"), head) {
+		t.Errorf("checkIntegrity() = true for changed data with the recorded HMAC")
+	}
+	if checkIntegrity(context.Background(), "hmac-name", data, head) {
+		t.Errorf("checkIntegrity() = true for a recorded HMAC without its key")
+	}
+}
+
+func TestS3_existsCacheVerify(t *testing.T) {
+	// The chunk is gone from the bucket, as after a lifecycle rule expired it.
+	var heads, puts int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			heads++
+			w.WriteHeader(http.StatusNotFound)
+		case http.MethodPut:
+			puts++
+		}
+	}))
+	defer srv.Close()
+
+	s3 := &S3{
+		StorageBucket: "bucket",
+		logger:        zap.NewNop(),
+		exists:        newExistsCache(10),
+		S3Session: storage.New(session.Must(session.NewSession(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+			Endpoint:         aws.String(srv.URL),
+			Region:           aws.String("hn"),
+			S3ForcePathStyle: aws.Bool(true),
+			MaxRetries:       aws.Int(0),
+		}))),
+	}
+	s3.exists.add("chunk")
+
+	ctx, upload := storage_vault.WithUpload(context.Background())
+	if err := s3.PutObject(ctx, "chunk", []byte("data")); err != nil {
+		t.Fatalf("PutObject() error = %v", err)
+	}
+	if heads != 0 || puts != 0 {
+		t.Fatalf("PutObject() of a cached key sent %d HEAD and %d PUT, want none", heads, puts)
+	}
+	if upload.Sent() {
+		t.Errorf("PutObject() of a cached key recorded its data sent")
+	}
+
+	exists, _, _, err := s3.VerifyObject(context.Background(), "chunk", []byte("data"))
+	if err != nil || exists {
+		t.Fatalf("VerifyObject() = %v, %v, want false, nil", exists, err)
+	}
+	if s3.exists.contains("chunk") {
+		t.Errorf("VerifyObject() left a missing chunk in the exists cache")
+	}
+
+	exists, _, err = s3.CheckChunk(context.Background(), "chunk", []byte("data"))
+	if err != nil || exists {
+		t.Fatalf("CheckChunk() = %v, %v, want false, nil", exists, err)
+	}
+	if s3.exists.contains("chunk") {
+		t.Errorf("CheckChunk() left a missing chunk in the exists cache")
+	}
+
+	ctx, upload = storage_vault.WithUpload(context.Background())
+	s3.PutObject(ctx, "chunk", []byte("data"))
+	if puts == 0 || !upload.Sent() {
+		t.Errorf("PutObject() of a missing chunk sent %d PUT, recorded sent %v", puts, upload.Sent())
+	}
+}
+
+func TestS3_CheckChunkRecordsSha256(t *testing.T) {
+	// The chunk was stored without its sha256, in a colder class.
+	data := []byte("data")
+	var puts, copies int
+	var copied http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			w.Header().Set("Content-Length", "4")
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("X-Amz-Storage-Class", storage.StorageClassStandardIa)
+			w.Header().Set("X-Amz-Meta-Owner", "agent")
+		case http.MethodGet:
+			_, _ = w.Write(data)
+		case http.MethodPut:
+			if r.Header.Get("X-Amz-Copy-Source") == "" {
+				puts++
+				return
+			}
+			copies++
+			copied = r.Header.Clone()
+			_, _ = io.WriteString(w, `<CopyObjectResult><ETag>"8d777f385d3dfec8815d20f7496026dc"</ETag></CopyObjectResult>`)
+		}
+	}))
+	defer srv.Close()
+
+	s3 := &S3{
+		StorageBucket: "bucket",
+		logger:        zap.NewNop(),
+		exists:        newExistsCache(10),
+		S3Session: storage.New(session.Must(session.NewSession(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+			Endpoint:         aws.String(srv.URL),
+			Region:           aws.String("hn"),
+			S3ForcePathStyle: aws.Bool(true),
+			MaxRetries:       aws.Int(0),
+		}))),
+	}
+
+	exists, integrity, err := s3.CheckChunk(context.Background(), "chunk", data)
+	if err != nil || !exists || !integrity {
+		t.Fatalf("CheckChunk() = %v, %v, %v, want true, true, nil", exists, integrity, err)
+	}
+	if puts != 0 || copies != 1 {
+		t.Fatalf("CheckChunk() sent %d PUT and %d copies, want the hash recorded by one copy", puts, copies)
+	}
+	if got := copied.Get("X-Amz-Copy-Source"); got != "bucket/chunk" {
+		t.Errorf("copy source = %q, want bucket/chunk", got)
+	}
+	if got := copied.Get("X-Amz-Metadata-Directive"); got != storage.MetadataDirectiveReplace {
+		t.Errorf("metadata directive = %q, want %s", got, storage.MetadataDirectiveReplace)
+	}
+	if got := copied.Get("X-Amz-Meta-Sha256"); got != sha256Hex(data) {
+		t.Errorf("copied sha256 = %q, want %q", got, sha256Hex(data))
+	}
+	if got := copied.Get("X-Amz-Meta-Owner"); got != "agent" {
+		t.Errorf("copy dropped the other metadata, owner = %q", got)
+	}
+	if got := copied.Get("X-Amz-Storage-Class"); got != storage.StorageClassStandardIa {
+		t.Errorf("copied storage class = %q, want %s", got, storage.StorageClassStandardIa)
+	}
+	if got := copied.Get("Content-Type"); got != "application/octet-stream" {
+		t.Errorf("copied content type = %q", got)
+	}
+}
+
+func TestS3_namingSSEKMS(t *testing.T) {
+	// A bucket encrypting objects with a KMS key, whose ETags are no MD5.
+	type object struct {
+		data   []byte
+		header http.Header
+	}
+	var mu sync.Mutex
+	objects := make(map[string]object)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		key := strings.TrimPrefix(r.URL.Path, "/bucket/")
+		switch r.Method {
+		case http.MethodPut:
+			data, _ := io.ReadAll(r.Body)
+			objects[key] = object{data: data, header: r.Header.Clone()}
+			w.Header().Set("ETag", `"0123456789abcdef0123456789abcdef"`)
+		case http.MethodHead, http.MethodGet:
+			o, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			for name, values := range o.header {
+				if strings.HasPrefix(name, "X-Amz-Meta-") {
+					w.Header()[name] = values
+				}
+			}
+			w.Header().Set("X-Amz-Server-Side-Encryption", storage.ServerSideEncryptionAwsKms)
+			w.Header().Set("ETag", `"0123456789abcdef0123456789abcdef"`)
+			w.Header().Set("Content-Length", strconv.Itoa(len(o.data)))
+			if r.Method == http.MethodGet {
+				_, _ = w.Write(o.data)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	s3 := &S3{
+		StorageBucket: "bucket",
+		SSE:           storage.ServerSideEncryptionAwsKms,
+		logger:        zap.NewNop(),
+		exists:        newExistsCache(10),
+		S3Session: storage.New(session.Must(session.NewSession(&aws.Config{
+			Credentials:      credentials.NewStaticCredentials("id", "secret", ""),
+			Endpoint:         aws.String(srv.URL),
+			Region:           aws.String("hn"),
+			S3ForcePathStyle: aws.Bool(true),
+			MaxRetries:       aws.Int(0),
+		}))),
+	}
+	vault, err := naming.New(s3, []byte("secret"), true, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := []byte("bizfly-backup")
+	sum := md5.Sum(data)
+	chunk := hex.EncodeToString(sum[:])
+	if err := vault.PutObject(context.Background(), chunk, data); err != nil {
+		t.Fatalf("PutObject() error = %v", err)
+	}
+	stored, ok := objects[vault.ObjectName(chunk)]
+	if !ok {
+		t.Fatalf("PutObject() did not store the chunk under its HMAC name")
+	}
+	if got := stored.header.Get("X-Amz-Meta-Sha256"); got != "" {
+		t.Errorf("PutObject() recorded the sha256 of the chunk %q", got)
+	}
+	if got := stored.header.Get("X-Amz-Meta-Hmac-Sha256"); got == "" || got == sha256Hex(data) {
+		t.Errorf("PutObject() recorded digest %q, want a keyed one", got)
+	}
+
+	exists, integrity, _, err := vault.VerifyObject(context.Background(), chunk, data)
+	if err != nil || !exists || !integrity {
+		t.Errorf("VerifyObject() = %v, %v, %v, want true, true, nil", exists, integrity, err)
+	}
+	_, integrity, _, err = vault.VerifyObject(context.Background(), chunk, []byte("bizfly-backuq"))
+	if err != nil || integrity {
+		t.Errorf("VerifyObject() of changed data of the same size = %v, %v, want false, nil", integrity, err)
+	}
+}
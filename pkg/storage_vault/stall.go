@@ -0,0 +1,127 @@
+package storage_vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrStalled is returned when a request transferred no bytes for longer than
+// its stall timeout, such as on a half-open connection.
+var ErrStalled = errors.New("storage vault request stalled")
+
+// StallWatch cancels the context of a request once the bodies it watches go
+// without transferring a byte for longer than the timeout. A nil StallWatch,
+// or one with no timeout, watches nothing.
+type StallWatch struct {
+	timeout time.Duration
+	cancel  context.CancelFunc
+	last    int64
+	stalled int32
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// WatchStall returns a context derived from ctx, canceled when the request
+// stalls for timeout. Stop must be called once the request is done.
+func WatchStall(ctx context.Context, timeout time.Duration) (context.Context, *StallWatch) {
+	if timeout <= 0 {
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	w := &StallWatch{timeout: timeout, cancel: cancel, last: time.Now().UnixNano(), stop: make(chan struct{})}
+	go w.run()
+	return ctx, w
+}
+
+func (w *StallWatch) run() {
+	tick := w.timeout / 4
+	if tick < 10*time.Millisecond {
+		tick = 10 * time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case now := <-ticker.C:
+			if now.Sub(time.Unix(0, atomic.LoadInt64(&w.last))) > w.timeout {
+				atomic.StoreInt32(&w.stalled, 1)
+				w.cancel()
+				return
+			}
+		}
+	}
+}
+
+func (w *StallWatch) touch() {
+	atomic.StoreInt64(&w.last, time.Now().UnixNano())
+}
+
+// Stop stops watching and releases the context.
+func (w *StallWatch) Stop() {
+	if w == nil {
+		return
+	}
+	w.once.Do(func() {
+		close(w.stop)
+		w.cancel()
+	})
+}
+
+// Stalled reports whether the request was canceled for stalling.
+func (w *StallWatch) Stalled() bool {
+	return w != nil && atomic.LoadInt32(&w.stalled) == 1
+}
+
+// Err returns err wrapped in ErrStalled when the request was canceled for
+// stalling.
+func (w *StallWatch) Err(err error) error {
+	if err == nil || !w.Stalled() {
+		return err
+	}
+	return fmt.Errorf("%w: no bytes transferred for %s: %v", ErrStalled, w.timeout, err)
+}
+
+// Reader returns r, counting every read of it as progress.
+func (w *StallWatch) Reader(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &stallReader{r: r, w: w}
+}
+
+// ReadSeeker returns r, counting every read of it as progress.
+func (w *StallWatch) ReadSeeker(r io.ReadSeeker) io.ReadSeeker {
+	if w == nil {
+		return r
+	}
+	return &stallReadSeeker{stallReader{r: r, w: w}, r}
+}
+
+type stallReader struct {
+	r io.Reader
+	w *StallWatch
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.w.touch()
+	}
+	return n, err
+}
+
+type stallReadSeeker struct {
+	stallReader
+	s io.Seeker
+}
+
+func (r *stallReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return r.s.Seek(offset, whence)
+}
@@ -0,0 +1,61 @@
+package storage_vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// trickle returns one byte per read, after delay.
+type trickle struct {
+	n     int
+	delay time.Duration
+}
+
+func (t *trickle) Read(p []byte) (int, error) {
+	if t.n == 0 {
+		return 0, io.EOF
+	}
+	time.Sleep(t.delay)
+	t.n--
+	p[0] = 'x'
+	return 1, nil
+}
+
+func TestStallWatch(t *testing.T) {
+	// A slow but steady transfer is not a stall.
+	ctx, w := WatchStall(context.Background(), 50*time.Millisecond)
+	_, err := ioutil.ReadAll(w.Reader(&trickle{n: 8, delay: 20 * time.Millisecond}))
+	require.NoError(t, err)
+	assert.NoError(t, ctx.Err())
+	assert.False(t, w.Stalled())
+	w.Stop()
+	assert.Error(t, ctx.Err())
+	assert.False(t, errors.Is(w.Err(errors.New("boom")), ErrStalled))
+
+	// No byte for longer than the timeout cancels the request.
+	ctx, w = WatchStall(context.Background(), 30*time.Millisecond)
+	defer w.Stop()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("stalled request not canceled")
+	}
+	assert.True(t, w.Stalled())
+	assert.ErrorIs(t, w.Err(ctx.Err()), ErrStalled)
+
+	// Disabled, nothing is watched.
+	ctx, w = WatchStall(context.Background(), 0)
+	assert.Nil(t, w)
+	assert.NoError(t, ctx.Err())
+	rs := bytes.NewReader([]byte("data"))
+	assert.Equal(t, rs, w.ReadSeeker(rs))
+	w.Stop()
+}
@@ -1,15 +1,36 @@
 package storage_vault
 
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrRequestBudgetExhausted is returned once a run made more requests to the
+// storage vault than vault_request_budget allows.
+var ErrRequestBudgetExhausted = errors.New("storage vault request budget exhausted")
+
+// ErrObjectArchived is returned when reading an object kept in an archive
+// storage class, such as GLACIER, which has not been restored yet. Retrying
+// does not help.
+var ErrObjectArchived = errors.New("object is archived, restore it from the archive storage class first")
+
 // storageVault ...
+//
+// The requests taking a context give up their retries as soon as it is done.
 type StorageVault interface {
 	// HeadObject a boolean value whether object name existing in storage.
-	HeadObject(key string) (bool, string, error)
+	HeadObject(ctx context.Context, key string) (bool, string, error)
 
 	// PutObject stores the data to the storage backend.
-	PutObject(key string, data []byte) error
+	PutObject(ctx context.Context, key string, data []byte) error
 
 	// GetObject downloads the object by name in storage.
-	GetObject(key string) ([]byte, error)
+	GetObject(ctx context.Context, key string) ([]byte, error)
+
+	// InspectObject returns the metadata of the object by name in storage.
+	InspectObject(ctx context.Context, key string) (*ObjectInfo, error)
 
 	// SetCredential sets a new credential with backend credential not constant.
 	RefreshCredential(credential Credential) error
@@ -21,6 +42,68 @@ type StorageVault interface {
 	Type() Type
 }
 
+// ErrNotSupported is returned by wrappers of storage vaults for an optional
+// operation the wrapped vault does not implement.
+var ErrNotSupported = errors.New("operation not supported by storage vault")
+
+// ChunkChecker is implemented by storage vaults which can tell whether the
+// object stored under a chunk key holds the given data, compared by sha256
+// rather than by the MD5 digest the key is made of.
+type ChunkChecker interface {
+	CheckChunk(ctx context.Context, key string, data []byte) (exists bool, same bool, err error)
+}
+
+// ObjectLister is implemented by storage vaults which can list the keys of
+// their objects. fn is called with every key starting with prefix, as the
+// listing goes, and stops it by returning an error.
+type ObjectLister interface {
+	ListObjects(ctx context.Context, prefix string, fn func(key string) error) error
+}
+
+// ObjectVerifier is implemented by storage vaults which can tell whether the
+// object stored under key holds data without downloading it.
+type ObjectVerifier interface {
+	VerifyObject(ctx context.Context, key string, data []byte) (exists bool, integrity bool, etag string, err error)
+}
+
+// ExistsCacheReporter is implemented by storage vaults which cache the keys
+// known to exist.
+type ExistsCacheReporter interface {
+	ExistsCacheStats() (hits uint64, misses uint64)
+}
+
+// RequestCounter is implemented by storage vaults which count the requests
+// made during a run.
+type RequestCounter interface {
+	Requests() uint64
+}
+
+// ChunkPrefetcher is implemented by storage vaults which can start reading a
+// chunk in the background, to be returned by a later GetObject, until ctx is
+// done. It reports false when the chunk is not prefetched, e.g. because of its
+// memory bound.
+type ChunkPrefetcher interface {
+	Prefetch(ctx context.Context, key string, size int64) bool
+}
+
+// ObjectStreamer is implemented by storage vaults which can read an object as
+// it is downloaded, without holding all of it in memory. The caller closes
+// the stream, which is canceled with ctx.
+type ObjectStreamer interface {
+	GetObjectStream(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// ObjectInfo describes an object in storage.
+type ObjectInfo struct {
+	Key          string    `json:"key"`
+	Exists       bool      `json:"exists"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	StorageClass string    `json:"storage_class"`
+	LastModified time.Time `json:"last_modified"`
+	Integrity    bool      `json:"integrity"`
+}
+
 type Type struct {
 	StorageVaultType string
 	CredentialType   string
@@ -32,4 +115,7 @@ type Credential struct {
 	AwsLocation        string `json:"aws_location,omitempty"`
 	Token              string `json:"token,omitempty"`
 	Region             string `json:"region,omitempty"`
+	// StorageClass is the storage class of the chunks put in the vault, in
+	// place of storage_class_chunk.
+	StorageClass string `json:"storage_class,omitempty"`
 }
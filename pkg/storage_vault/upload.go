@@ -0,0 +1,34 @@
+package storage_vault
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Upload records whether the puts of a context sent data to the vault, rather
+// than finding the object stored already, such as a chunk S3 has.
+type Upload struct {
+	sent int32
+}
+
+type uploadKey struct{}
+
+// WithUpload returns a context derived from ctx whose puts are recorded in
+// the Upload returned.
+func WithUpload(ctx context.Context) (context.Context, *Upload) {
+	u := &Upload{}
+	return context.WithValue(ctx, uploadKey{}, u), u
+}
+
+// MarkSent records in the Upload of ctx, if any, that a put sent its data.
+// Storage vaults call it once the data is stored.
+func MarkSent(ctx context.Context) {
+	if u, ok := ctx.Value(uploadKey{}).(*Upload); ok {
+		atomic.StoreInt32(&u.sent, 1)
+	}
+}
+
+// Sent reports whether a put of the context sent its data.
+func (u *Upload) Sent() bool {
+	return atomic.LoadInt32(&u.sent) == 1
+}
@@ -0,0 +1,8 @@
+package support
+
+import "errors"
+
+// ErrOwnerNotRestored is returned by SetSecurityDescriptor when the DACL was
+// applied but the owner could not be, e.g. when restoring as a user without
+// SeRestorePrivilege.
+var ErrOwnerNotRestored = errors.New("owner not restored, only the DACL was applied")
@@ -0,0 +1,14 @@
+// +build !windows
+
+package support
+
+// GetSecurityDescriptor returns an empty descriptor, file ACLs are only
+// preserved on Windows.
+func GetSecurityDescriptor(path string) (string, error) {
+	return "", nil
+}
+
+// SetSecurityDescriptor does nothing, file ACLs are only preserved on Windows.
+func SetSecurityDescriptor(path string, sddl string) error {
+	return nil
+}
@@ -0,0 +1,96 @@
+package support
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"golang.org/x/sys/windows"
+)
+
+var privilegesOnce sync.Once
+
+// enablePrivileges enables the privileges needed to read the SACL and to set
+// the owner of files, when the process token holds them.
+func enablePrivileges() {
+	privilegesOnce.Do(func() {
+		var token windows.Token
+		if err := windows.OpenProcessToken(windows.CurrentProcess(), windows.TOKEN_ADJUST_PRIVILEGES|windows.TOKEN_QUERY, &token); err != nil {
+			return
+		}
+		defer token.Close()
+		for _, name := range []string{"SeSecurityPrivilege", "SeRestorePrivilege", "SeBackupPrivilege"} {
+			var luid windows.LUID
+			if err := windows.LookupPrivilegeValue(nil, windows.StringToUTF16Ptr(name), &luid); err != nil {
+				continue
+			}
+			privileges := windows.Tokenprivileges{PrivilegeCount: 1}
+			privileges.Privileges[0] = windows.LUIDAndAttributes{Luid: luid, Attributes: windows.SE_PRIVILEGE_ENABLED}
+			_ = windows.AdjustTokenPrivileges(token, false, &privileges, 0, nil, nil)
+		}
+	})
+}
+
+// GetSecurityDescriptor returns the owner, group and DACL of path in SDDL form.
+// The SACL is included when the process holds SeSecurityPrivilege.
+func GetSecurityDescriptor(path string) (string, error) {
+	enablePrivileges()
+	info := windows.SECURITY_INFORMATION(windows.OWNER_SECURITY_INFORMATION | windows.GROUP_SECURITY_INFORMATION | windows.DACL_SECURITY_INFORMATION)
+	sd, err := windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, info|windows.SACL_SECURITY_INFORMATION)
+	if errors.Is(err, windows.ERROR_PRIVILEGE_NOT_HELD) {
+		sd, err = windows.GetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, info)
+	}
+	if err != nil {
+		return "", err
+	}
+	return sd.String(), nil
+}
+
+// SetSecurityDescriptor applies the SDDL security descriptor to path. When the
+// owner, group or SACL can not be set, it falls back to the DACL alone and
+// returns ErrOwnerNotRestored.
+func SetSecurityDescriptor(path string, sddl string) error {
+	enablePrivileges()
+	sd, err := windows.SecurityDescriptorFromString(sddl)
+	if err != nil {
+		return err
+	}
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return err
+	}
+	control, _, err := sd.Control()
+	if err != nil {
+		return err
+	}
+	daclInfo := windows.SECURITY_INFORMATION(windows.DACL_SECURITY_INFORMATION | windows.UNPROTECTED_DACL_SECURITY_INFORMATION)
+	if control&windows.SE_DACL_PROTECTED != 0 {
+		daclInfo = windows.DACL_SECURITY_INFORMATION | windows.PROTECTED_DACL_SECURITY_INFORMATION
+	}
+
+	info := daclInfo
+	owner, _, err := sd.Owner()
+	if err == nil && owner != nil {
+		info |= windows.OWNER_SECURITY_INFORMATION
+	}
+	group, _, err := sd.Group()
+	if err == nil && group != nil {
+		info |= windows.GROUP_SECURITY_INFORMATION
+	}
+	sacl, _, err := sd.SACL()
+	if err == nil {
+		info |= windows.SACL_SECURITY_INFORMATION
+	}
+
+	err = windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, info, owner, group, dacl, sacl)
+	if err == nil || info == daclInfo {
+		return err
+	}
+	if !errors.Is(err, windows.ERROR_INVALID_OWNER) && !errors.Is(err, windows.ERROR_ACCESS_DENIED) && !errors.Is(err, windows.ERROR_PRIVILEGE_NOT_HELD) {
+		return err
+	}
+	if errDACL := windows.SetNamedSecurityInfo(path, windows.SE_FILE_OBJECT, daclInfo, nil, nil, dacl, nil); errDACL != nil {
+		return errDACL
+	}
+	return fmt.Errorf("%w: %v", ErrOwnerNotRestored, err)
+}
@@ -0,0 +1,36 @@
+package support
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecurityDescriptor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "acl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "test.txt")
+	if err := ioutil.WriteFile(path, []byte("acl"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sddl, err := GetSecurityDescriptor(path)
+	if err != nil {
+		t.Fatalf("GetSecurityDescriptor() error = %v", err)
+	}
+	if !strings.Contains(sddl, "D:") {
+		t.Fatalf("GetSecurityDescriptor() = %q, want a DACL", sddl)
+	}
+	if err := SetSecurityDescriptor(path, sddl); err != nil && !errors.Is(err, ErrOwnerNotRestored) {
+		t.Fatalf("SetSecurityDescriptor() error = %v", err)
+	}
+	if err := SetSecurityDescriptor(path, "not sddl"); err == nil {
+		t.Fatal("SetSecurityDescriptor() with invalid SDDL, want error")
+	}
+}
@@ -13,3 +13,8 @@ func SetChownItem(name string, uid int, gid int) error {
 	}
 	return nil
 }
+
+// SetLchownItem sets the owner of name, not following a symlink.
+func SetLchownItem(name string, uid int, gid int) error {
+	return os.Lchown(name, uid, gid)
+}
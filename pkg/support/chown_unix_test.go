@@ -2,7 +2,11 @@
 
 package support
 
-import "testing"
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
 
 func TestSetChownItem(t *testing.T) {
 	type args struct {
@@ -33,3 +37,19 @@ func TestSetChownItem(t *testing.T) {
 		})
 	}
 }
+
+func TestSetLchownItem(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "missing"), link); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dangling symlink is owned without following it.
+	if err := SetLchownItem(link, os.Getuid(), os.Getgid()); err != nil {
+		t.Errorf("SetLchownItem() error = %v", err)
+	}
+	if err := SetChownItem(link, os.Getuid(), os.Getgid()); err == nil {
+		t.Errorf("SetChownItem() of a dangling symlink succeeded")
+	}
+}
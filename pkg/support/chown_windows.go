@@ -3,3 +3,7 @@ package support
 func SetChownItem(name string, uid int, gid int) error {
 	return nil
 }
+
+func SetLchownItem(name string, uid int, gid int) error {
+	return nil
+}
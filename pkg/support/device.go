@@ -0,0 +1,16 @@
+package support
+
+import (
+	"errors"
+	"os"
+)
+
+var (
+	ErrDeviceUnsupported = errors.New("block device backup is only supported on linux")
+	ErrDevicePermission  = errors.New("no permission to access block device, the agent must run as root")
+)
+
+// IsBlockDevice reports whether fi describes a block device.
+func IsBlockDevice(fi os.FileInfo) bool {
+	return fi.Mode()&os.ModeDevice != 0 && fi.Mode()&os.ModeCharDevice == 0
+}
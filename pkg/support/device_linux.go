@@ -0,0 +1,32 @@
+// +build linux
+
+package support
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// DeviceSize returns the size in bytes of the block device at path. It opens
+// the device for reading, or for writing when write is set, so it also checks
+// that the agent is allowed to back it up or to restore onto it.
+func DeviceSize(path string, write bool) (uint64, error) {
+	flag := os.O_RDONLY
+	if write {
+		flag = os.O_WRONLY
+	}
+	f, err := os.OpenFile(path, flag, 0)
+	if err != nil {
+		if os.IsPermission(err) {
+			return 0, fmt.Errorf("%w: %s", ErrDevicePermission, path)
+		}
+		return 0, err
+	}
+	defer f.Close()
+	size, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(size), nil
+}
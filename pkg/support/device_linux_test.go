@@ -0,0 +1,42 @@
+// +build linux
+
+package support
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDeviceSize(t *testing.T) {
+	// Regular files seek like block devices, which can not be created here.
+	path := filepath.Join(t.TempDir(), "disk.img")
+	if err := ioutil.WriteFile(path, make([]byte, 4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, write := range []bool{false, true} {
+		size, err := DeviceSize(path, write)
+		if err != nil {
+			t.Fatalf("DeviceSize(write=%v) error = %v", write, err)
+		}
+		if size != 4096 {
+			t.Errorf("DeviceSize(write=%v) = %d, want 4096", write, size)
+		}
+	}
+
+	if _, err := DeviceSize(filepath.Join(t.TempDir(), "missing"), false); !os.IsNotExist(err) {
+		t.Errorf("DeviceSize() on missing device error = %v, want not exist", err)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("root bypasses file permissions")
+	}
+	if err := os.Chmod(path, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := DeviceSize(path, false); !errors.Is(err, ErrDevicePermission) {
+		t.Errorf("DeviceSize() without permission error = %v, want %v", err, ErrDevicePermission)
+	}
+}
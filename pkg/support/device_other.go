@@ -0,0 +1,8 @@
+// +build !linux
+
+package support
+
+// DeviceSize always fails, block devices are only backed up on linux.
+func DeviceSize(path string, write bool) (uint64, error) {
+	return 0, ErrDeviceUnsupported
+}
@@ -22,3 +22,11 @@ func ItemLocal(fi fs.FileInfo) (time.Time, time.Time, time.Time, uint32, uint32,
 	}
 	return atimeLocal, ctimeLocal, mtimeLocal, uid, gid, size
 }
+
+// DeviceID returns the ID of the device holding the item of fi.
+func DeviceID(fi fs.FileInfo) (uint64, bool) {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev), true
+	}
+	return 0, false
+}
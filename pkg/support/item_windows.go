@@ -20,3 +20,8 @@ func ItemLocal(fi fs.FileInfo) (time.Time, time.Time, time.Time, uint32, uint32,
 
 	return atimeLocal, ctimeLocal, mtimeLocal, uid, gid, size
 }
+
+// DeviceID is not known on Windows.
+func DeviceID(fi fs.FileInfo) (uint64, bool) {
+	return 0, false
+}
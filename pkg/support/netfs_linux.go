@@ -0,0 +1,27 @@
+// +build linux
+
+package support
+
+import "syscall"
+
+// networkFSMagic are the statfs types of the network filesystems, whose inode
+// numbers and modification times may not be reliable.
+var networkFSMagic = map[uint32]bool{
+	0x6969:     true, // nfs
+	0x517b:     true, // smb
+	0xff534d42: true, // cifs
+	0xfe534d42: true, // smb2
+	0x01021997: true, // 9p
+	0x00c36400: true, // ceph
+	0x5346414f: true, // afs
+	0x73757245: true, // coda
+}
+
+// IsNetworkFS reports whether path is on a network filesystem.
+func IsNetworkFS(path string) (bool, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return false, err
+	}
+	return networkFSMagic[uint32(st.Type)], nil
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package support
+
+// IsNetworkFS always reports false, network filesystems are only detected on
+// linux.
+func IsNetworkFS(path string) (bool, error) {
+	return false, nil
+}